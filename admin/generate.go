@@ -0,0 +1,4 @@
+// Package admin is the gRPC admin API of sinker. admin.pb.go and admin_grpc.pb.go are generated from admin.proto.
+package admin
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative admin.proto
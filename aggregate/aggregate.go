@@ -0,0 +1,153 @@
+// Package aggregate rolls up rows of each batch before insert, so that metric-like topics write a row per group and
+// window instead of a row per message.
+package aggregate
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/forever765/clickhouse_sinker_nali/config"
+	"github.com/forever765/clickhouse_sinker_nali/model"
+)
+
+// Aggregation functions
+const (
+	FuncCount = "count"
+	FuncSum   = "sum"
+	FuncMin   = "min"
+	FuncMax   = "max"
+)
+
+// Aggregator groups rows of a batch by the tumbling window of the time column and the group columns. It's stateless
+// between batches, so a window spanning batches is written as multiple partial rows, which a SummingMergeTree or an
+// AggregatingMergeTree table is expected to merge.
+type Aggregator struct {
+	idxTime int
+	window  time.Duration
+	groupBy []int
+	metrics []metric
+}
+
+type metric struct {
+	idx int
+	fn  string
+	typ int
+}
+
+// New binds the config to columns of the table.
+func New(aggCfg *config.AggregateConfig, dims []*model.ColumnWithType) (a *Aggregator, err error) {
+	indexOf := func(name string) (idx int, err error) {
+		for i, dim := range dims {
+			if dim.Name == name {
+				return i, nil
+			}
+		}
+		return -1, errors.Errorf("aggregate: no such column %s", name)
+	}
+	a = &Aggregator{window: time.Duration(aggCfg.Window) * time.Second}
+	if a.idxTime, err = indexOf(aggCfg.TimeColumn); err != nil {
+		return
+	}
+	if typ := dims[a.idxTime].Type; typ != model.DateTime {
+		err = errors.Errorf("aggregate: time column %s is %s instead of DateTime", aggCfg.TimeColumn, model.GetTypeName(typ))
+		return
+	}
+	for _, name := range aggCfg.GroupBy {
+		var idx int
+		if idx, err = indexOf(name); err != nil {
+			return
+		}
+		a.groupBy = append(a.groupBy, idx)
+	}
+	for name, fn := range aggCfg.Metrics {
+		var idx int
+		if idx, err = indexOf(name); err != nil {
+			return
+		}
+		typ := dims[idx].Type
+		switch {
+		case fn == FuncCount && typ == model.Int:
+		case (fn == FuncSum || fn == FuncMin || fn == FuncMax) && (typ == model.Int || typ == model.Float):
+		default:
+			err = errors.Errorf("aggregate: %s of column %s of type %s is unsupported", fn, name, model.GetTypeName(typ))
+			return
+		}
+		a.metrics = append(a.metrics, metric{idx: idx, fn: fn, typ: typ})
+	}
+	return
+}
+
+// Apply replaces rows of the batch with rollups. Columns other than the time column, group columns and metrics take
+// values of the first row of each group. RealSize of the batch is kept as the number of messages.
+func (a *Aggregator) Apply(batch *model.Batch) {
+	rows := *batch.Rows
+	groups := make(map[string]*model.Row, len(rows)/8)
+	rollups := rows[:0]
+	var sb strings.Builder
+	for _, row := range rows {
+		a.truncate(*row)
+		sb.Reset()
+		fmt.Fprint(&sb, (*row)[a.idxTime])
+		for _, idx := range a.groupBy {
+			sb.WriteByte(0)
+			fmt.Fprint(&sb, (*row)[idx])
+		}
+		key := sb.String()
+		if rollup, ok := groups[key]; ok {
+			a.merge(*rollup, *row)
+			model.PutRow(row)
+			continue
+		}
+		for _, m := range a.metrics {
+			if m.fn == FuncCount {
+				(*row)[m.idx] = int64(1)
+			}
+		}
+		groups[key] = row
+		rollups = append(rollups, row)
+	}
+	*batch.Rows = rollups
+}
+
+func (a *Aggregator) truncate(row model.Row) {
+	if t, ok := row[a.idxTime].(time.Time); ok {
+		row[a.idxTime] = t.Truncate(a.window)
+	}
+}
+
+func (a *Aggregator) merge(rollup, row model.Row) {
+	for _, m := range a.metrics {
+		if m.fn == FuncCount {
+			rollup[m.idx] = rollup[m.idx].(int64) + 1
+			continue
+		}
+		v := row[m.idx]
+		if v == nil {
+			continue
+		}
+		if rollup[m.idx] == nil {
+			rollup[m.idx] = v
+			continue
+		}
+		if m.typ == model.Int {
+			x, y := rollup[m.idx].(int64), v.(int64)
+			switch {
+			case m.fn == FuncSum:
+				rollup[m.idx] = x + y
+			case m.fn == FuncMin && y < x, m.fn == FuncMax && y > x:
+				rollup[m.idx] = y
+			}
+		} else {
+			x, y := rollup[m.idx].(float64), v.(float64)
+			switch {
+			case m.fn == FuncSum:
+				rollup[m.idx] = x + y
+			case m.fn == FuncMin && y < x, m.fn == FuncMax && y > x:
+				rollup[m.idx] = y
+			}
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package aggregate
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/forever765/clickhouse_sinker_nali/config"
+	"github.com/forever765/clickhouse_sinker_nali/model"
+)
+
+func TestApply(t *testing.T) {
+	dims := []*model.ColumnWithType{
+		{Name: "ts", Type: model.DateTime},
+		{Name: "host", Type: model.String},
+		{Name: "cnt", Type: model.Int},
+		{Name: "bytes", Type: model.Int, Nullable: true},
+		{Name: "max_rtt", Type: model.Float},
+		{Name: "min_rtt", Type: model.Float},
+		{Name: "path", Type: model.String},
+	}
+	aggCfg := &config.AggregateConfig{
+		Enable:     true,
+		TimeColumn: "ts",
+		Window:     10,
+		GroupBy:    []string{"host"},
+		Metrics:    map[string]string{"cnt": FuncCount, "bytes": FuncSum, "max_rtt": FuncMax, "min_rtt": FuncMin},
+	}
+	a, err := New(aggCfg, dims)
+	require.Nil(t, err)
+
+	t0 := time.Date(2022, 5, 20, 10, 0, 0, 0, time.UTC)
+	batch := model.NewBatch()
+	for _, r := range []model.Row{
+		{t0.Add(1 * time.Second), "a", int64(0), int64(100), 0.5, 0.5, "/x"},
+		{t0.Add(9 * time.Second), "a", int64(0), nil, 0.9, 0.9, "/y"},
+		{t0.Add(3 * time.Second), "b", int64(0), int64(1), 0.1, 0.1, "/z"},
+		{t0.Add(5 * time.Second), "a", int64(0), int64(20), 0.2, 0.2, "/w"},
+		{t0.Add(11 * time.Second), "a", int64(0), int64(7), 0.3, 0.3, "/v"},
+	} {
+		row := model.GetRow()
+		*row = append(*row, r...)
+		*batch.Rows = append(*batch.Rows, row)
+	}
+	batch.RealSize = len(*batch.Rows)
+	a.Apply(batch)
+	require.Equal(t, 5, batch.RealSize)
+	require.Len(t, *batch.Rows, 3)
+	require.Equal(t, model.Row{t0, "a", int64(3), int64(120), 0.9, 0.2, "/x"}, *(*batch.Rows)[0])
+	require.Equal(t, model.Row{t0, "b", int64(1), int64(1), 0.1, 0.1, "/z"}, *(*batch.Rows)[1])
+	require.Equal(t, model.Row{t0.Add(10 * time.Second), "a", int64(1), int64(7), 0.3, 0.3, "/v"}, *(*batch.Rows)[2])
+
+	for _, invalid := range []map[string]string{
+		{"cnt": "avg"},
+		{"host": FuncSum},
+		{"max_rtt": FuncCount},
+		{"absent": FuncSum},
+	} {
+		aggCfg.Metrics = invalid
+		_, err = New(aggCfg, dims)
+		require.NotNil(t, err)
+	}
+	aggCfg.Metrics, aggCfg.TimeColumn = map[string]string{"cnt": FuncCount}, "host"
+	_, err = New(aggCfg, dims)
+	require.NotNil(t, err)
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"go.uber.org/zap"
+
+	"github.com/forever765/clickhouse_sinker_nali/config"
+	"github.com/forever765/clickhouse_sinker_nali/model"
+	"github.com/forever765/clickhouse_sinker_nali/pool"
+	"github.com/forever765/clickhouse_sinker_nali/statistics"
+	"github.com/forever765/clickhouse_sinker_nali/task"
+	"github.com/forever765/clickhouse_sinker_nali/util"
+)
+
+var (
+	localCfgFile = flag.String("local-cfg-file", "/etc/clickhouse_sinker_nali.json", "local config file")
+	taskName     = flag.String("task", "", "task whose parser, enrichments and table are used")
+	format       = flag.String("format", "auto", "format of files, auto(by extensions), ndjson or csv")
+	csvDelimiter = flag.String("csv-delimiter", ",", "delimiter of CSV files")
+	csvHeader    = flag.Bool("csv-header", true, "CSV files begin with a header naming columns")
+	s3Endpoint   = flag.String("s3-endpoint", "", "endpoint of S3 compatible storage such as http://minio:9000, empty means AWS")
+	s3Region     = flag.String("s3-region", "", "S3 region, default to env AWS_REGION or us-east-1")
+	skip         = flag.Int64("skip", 0, "number of records to skip, which resumes an interrupted backfill")
+	drainTimeout = flag.Duration("drain-timeout", 5*time.Minute, "max time to write buffered rows after reading all records")
+)
+
+// fileInputer feeds the task with records of sources in place of Kafka. Records are numbered from 0 across all
+// sources as offsets of partition 0, so that the ring and batches of the task work as usual. The task reads again from
+// the beginning after restarts, and skips records which have been committed.
+type fileInputer struct {
+	sources []*source
+	rr      *recordReader
+	topic   string
+
+	putFn     func(msg *model.InputMessage)
+	cleanupFn func()
+	ctx       context.Context
+	cancel    context.CancelFunc
+	wgRun     sync.WaitGroup
+
+	read      int64      // records read in the current run
+	committed int64      // offset of the last committed record
+	done      chan error // gets the result once a run reads all sources
+	doneOnce  sync.Once
+}
+
+func newFileInputer(sources []*source, rr *recordReader, topic string, skip int64) *fileInputer {
+	return &fileInputer{sources: sources, rr: rr, topic: topic, committed: skip - 1, done: make(chan error, 1)}
+}
+
+func (fi *fileInputer) Init(cfg *config.Config, taskCfg *config.TaskConfig, putFn func(msg *model.InputMessage), cleanupFn func()) error {
+	fi.putFn = putFn
+	fi.cleanupFn = cleanupFn
+	fi.ctx, fi.cancel = context.WithCancel(context.Background())
+	return nil
+}
+
+func (fi *fileInputer) Run() {
+	fi.wgRun.Add(1)
+	defer fi.wgRun.Done()
+	var offset int64
+	from := atomic.LoadInt64(&fi.committed) + 1
+	for _, src := range fi.sources {
+		util.Logger.Info("reading", zap.String("file", src.name), zap.Int64("offset", offset))
+		err := fi.rr.read(src, func(value []byte) bool {
+			if offset >= from {
+				fi.putFn(&model.InputMessage{Topic: fi.topic, Partition: 0, Offset: offset, Value: value})
+				atomic.StoreInt64(&fi.read, offset+1)
+			}
+			offset++
+			return fi.ctx.Err() == nil
+		})
+		if fi.ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			fi.finish(err)
+			return
+		}
+	}
+	atomic.StoreInt64(&fi.read, offset)
+	fi.finish(nil)
+}
+
+func (fi *fileInputer) finish(err error) {
+	fi.doneOnce.Do(func() { fi.done <- err })
+}
+
+func (fi *fileInputer) CommitMessages(msg *model.InputMessage) error {
+	atomic.StoreInt64(&fi.committed, msg.Offset)
+	return nil
+}
+
+func (fi *fileInputer) Stop() error {
+	fi.cancel()
+	fi.cleanupFn()
+	fi.wgRun.Wait()
+	return nil
+}
+
+func counterValue(vec *prometheus.CounterVec, labels ...string) float64 {
+	var m dto.Metric
+	_ = vec.WithLabelValues(labels...).Write(&m)
+	return m.GetCounter().GetValue()
+}
+
+func loadTask() (cfg *config.Config, taskCfg *config.TaskConfig) {
+	var err error
+	if cfg, err = config.ParseLocalCfgFile(*localCfgFile); err != nil {
+		util.Logger.Fatal("config.ParseLocalCfgFile failed", zap.Error(err))
+	}
+	if err = cfg.Normallize(); err != nil {
+		util.Logger.Fatal("cfg.Normallize failed", zap.Error(err))
+	}
+	for _, t := range cfg.Tasks {
+		if t.Name == *taskName {
+			return cfg, t
+		}
+	}
+	util.Logger.Fatal("task not found", zap.String("task", *taskName))
+	return
+}
+
+func main() {
+	util.InitLogger([]string{"stdout"})
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, `Usage of %s
+    %s -task <task> [flags] <file|directory|glob|s3://bucket/prefix>...
+This util writes historical records in files to ClickHouse with the parser, enrichments and table of a task, which
+repairs a gap without publishing the records to Kafka again. NDJSON and CSV files, optionally gzipped, are read in
+the given order, and files in a directory or under a prefix in lexical order. Parquet is unsupported.
+S3 credentials are taken from env AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN.
+`, os.Args[0], os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	comma, _ := utf8.DecodeRuneInString(*csvDelimiter)
+	if *taskName == "" || flag.NArg() == 0 || *skip < 0 || utf8.RuneCountInString(*csvDelimiter) != 1 ||
+		(*format != "auto" && *format != formatNDJSON && *format != formatCSV) {
+		flag.Usage()
+		os.Exit(1)
+	}
+	cfg, taskCfg := loadTask()
+	sources, err := listSources(flag.Args(), *format, newS3Client(*s3Endpoint, *s3Region))
+	if err != nil {
+		util.Logger.Fatal("failed to list files", zap.Error(err))
+	}
+	util.Logger.Info("backfilling", zap.String("task", taskCfg.Name), zap.Int("files", len(sources)))
+
+	if err = pool.InitClusterConn(&cfg.Clickhouse); err != nil {
+		util.Logger.Fatal("pool.InitClusterConn failed", zap.Error(err))
+	}
+	defer pool.CloseAll()
+	util.InitGlobalParsingPool()
+	util.InitGlobalWritingPool(len(cfg.Clickhouse.Hosts) * cfg.Clickhouse.MaxOpenConns)
+
+	fi := newFileInputer(sources, newRecordReader(taskCfg, comma, *csvHeader), taskCfg.Topic, *skip)
+	service := task.NewTaskService(cfg, taskCfg)
+	service.SetInputer(fi)
+	if err = service.Init(); err != nil {
+		util.Logger.Fatal("service.Init failed", zap.Error(err))
+	}
+	go service.Run()
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+	var readErr error
+LOOP:
+	for {
+		select {
+		case readErr = <-fi.done:
+			break LOOP
+		case sig := <-sigCh:
+			util.Logger.Warn("interrupted", zap.String("signal", sig.String()))
+			readErr = errors.Errorf("interrupted by %s", sig)
+			break LOOP
+		case <-ticker.C:
+			util.Logger.Info("progress", zap.Int64("read", atomic.LoadInt64(&fi.read)),
+				zap.Int64("written", atomic.LoadInt64(&fi.committed)+1))
+		}
+	}
+
+	// write what has been read
+	ctx, cancel := context.WithTimeout(context.Background(), *drainTimeout)
+	_, undrained := service.Shutdown(ctx)
+	cancel()
+	read, written := atomic.LoadInt64(&fi.read), atomic.LoadInt64(&fi.committed)+1
+	if readErr == nil && !undrained && written >= read {
+		util.Logger.Info("backfilled", zap.String("task", taskCfg.Name), zap.Int64("records", written-*skip),
+			zap.Float64("malformed", counterValue(statistics.ParseMsgsErrorTotal, taskCfg.Name, "parse")),
+			zap.Float64("filtered", counterValue(statistics.FilteredRowsTotal, taskCfg.Name)),
+			zap.Float64("duplicated", counterValue(statistics.DuplicatedRowsTotal, taskCfg.Name)),
+			zap.Float64("rejected", counterValue(statistics.ParseMsgsErrorTotal, taskCfg.Name, "insert")))
+		return
+	}
+	util.Logger.Error("backfill is incomplete, rerun with -skip to resume", zap.Int64("skip", written),
+		zap.Int64("read", read), zap.Bool("undrained", undrained), zap.NamedError("readError", readErr))
+	os.Exit(1)
+}
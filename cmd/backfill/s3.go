@@ -0,0 +1,204 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// emptySHA256 is the hash of an empty payload, which is the payload of all requests.
+const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// s3Client lists and reads objects with AWS Signature Version 4, which works with S3 compatible storages such as
+// MinIO as well. Credentials are taken from AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN. Requests
+// are anonymous without credentials.
+type s3Client struct {
+	endpoint  string // empty means AWS with virtual-hosted style URLs, otherwise path style URLs are used
+	region    string
+	accessKey string
+	secretKey string
+	token     string
+	client    *http.Client
+}
+
+func newS3Client(endpoint, region string) *s3Client {
+	if region == "" {
+		if region = os.Getenv("AWS_REGION"); region == "" {
+			region = "us-east-1"
+		}
+	}
+	return &s3Client{
+		endpoint:  strings.TrimSuffix(endpoint, "/"),
+		region:    region,
+		accessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		token:     os.Getenv("AWS_SESSION_TOKEN"),
+		client:    &http.Client{},
+	}
+}
+
+// parseS3URL splits s3://bucket/key into the bucket and the key.
+func parseS3URL(s string) (bucket, key string, err error) {
+	rest := strings.TrimPrefix(s, "s3://")
+	if i := strings.Index(rest, "/"); i >= 0 {
+		bucket, key = rest[:i], rest[i+1:]
+	} else {
+		bucket = rest
+	}
+	if bucket == "" {
+		err = errors.Errorf("invalid S3 URL %s", s)
+	}
+	return
+}
+
+// list returns keys of objects with the prefix in lexical order.
+func (c *s3Client) list(bucket, prefix string) (keys []string, err error) {
+	var token string
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		var body io.ReadCloser
+		if body, err = c.get(bucket, "", query); err != nil {
+			return
+		}
+		var result struct {
+			Contents []struct {
+				Key string
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		err = xml.NewDecoder(body).Decode(&result)
+		body.Close()
+		if err != nil {
+			err = errors.Wrapf(err, "listing s3://%s/%s", bucket, prefix)
+			return
+		}
+		for _, obj := range result.Contents {
+			if !strings.HasSuffix(obj.Key, "/") {
+				keys = append(keys, obj.Key)
+			}
+		}
+		if !result.IsTruncated {
+			return
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// open returns the content of the object.
+func (c *s3Client) open(bucket, key string) (body io.ReadCloser, err error) {
+	return c.get(bucket, key, nil)
+}
+
+func (c *s3Client) get(bucket, key string, query url.Values) (body io.ReadCloser, err error) {
+	var u string
+	if c.endpoint == "" {
+		u = fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", bucket, c.region, s3Escape(key, false))
+	} else {
+		u = fmt.Sprintf("%s/%s", c.endpoint, bucket)
+		if key != "" {
+			u += "/" + s3Escape(key, false)
+		}
+	}
+	if len(query) != 0 {
+		u += "?" + canonicalQuery(query)
+	}
+	var req *http.Request
+	if req, err = http.NewRequest(http.MethodGet, u, nil); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	if c.accessKey != "" {
+		c.sign(req, time.Now())
+	}
+	var resp *http.Response
+	if resp, err = c.client.Do(req); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		err = errors.Errorf("GET s3://%s/%s got %s: %s", bucket, key, resp.Status, msg)
+		return
+	}
+	return resp.Body, nil
+}
+
+// sign adds headers of AWS Signature Version 4.
+func (c *s3Client) sign(req *http.Request, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", emptySHA256)
+	headers := []string{"host:" + req.URL.Host, "x-amz-content-sha256:" + emptySHA256, "x-amz-date:" + amzDate}
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	if c.token != "" {
+		req.Header.Set("x-amz-security-token", c.token)
+		headers = append(headers, "x-amz-security-token:"+c.token)
+		signedHeaders += ";x-amz-security-token"
+	}
+	canonicalRequest := strings.Join([]string{req.Method, req.URL.EscapedPath(), req.URL.RawQuery,
+		strings.Join(headers, "\n") + "\n", signedHeaders, emptySHA256}, "\n")
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", date, c.region)
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, hex.EncodeToString(hash[:])}, "\n")
+	key := hmacSHA256([]byte("AWS4"+c.secretKey), date)
+	for _, part := range []string{c.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.accessKey, scope, signedHeaders, hex.EncodeToString(hmacSHA256(key, stringToSign))))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// canonicalQuery encodes the query sorted by keys, as Signature Version 4 requires.
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// s3Escape percent-encodes all but unreserved characters, and slashes unless escapeSlash.
+func s3Escape(s string, escapeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !escapeSlash) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
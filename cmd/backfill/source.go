@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/forever765/clickhouse_sinker_nali/config"
+	"github.com/forever765/clickhouse_sinker_nali/util"
+)
+
+const (
+	formatNDJSON = "ndjson"
+	formatCSV    = "csv"
+)
+
+var errUnknownFormat = errors.New("unknown format")
+
+// source is a file or an S3 object to backfill.
+type source struct {
+	name   string // path or s3://bucket/key
+	format string
+	gzip   bool
+	open   func() (io.ReadCloser, error)
+}
+
+// detectFormat tells the format of a file by its extension, unless format is given. A ".gz" suffix means gzip.
+func detectFormat(name, format string) (f string, gz bool, err error) {
+	gz = strings.HasSuffix(name, ".gz")
+	ext := strings.ToLower(filepath.Ext(strings.TrimSuffix(name, ".gz")))
+	switch {
+	case ext == ".parquet":
+		err = errors.Errorf("%s: Parquet is unsupported, convert it to NDJSON or CSV first, such as by clickhouse-local", name)
+	case format != "auto":
+		f = format
+	case ext == ".json" || ext == ".ndjson" || ext == ".jsonl":
+		f = formatNDJSON
+	case ext == ".csv":
+		f = formatCSV
+	default:
+		err = errors.Wrapf(errUnknownFormat, "%s, set -format", name)
+	}
+	return
+}
+
+// listSources expands arguments into sources in the given order. An argument is a file, a directory, a glob pattern,
+// or an S3 URL which is a key or a prefix. Files of unknown formats in directories and under prefixes are skipped.
+func listSources(args []string, format string, s3c *s3Client) (sources []*source, err error) {
+	add := func(name string, listed bool, open func() (io.ReadCloser, error)) (err error) {
+		src := &source{name: name, open: open}
+		if src.format, src.gzip, err = detectFormat(name, format); err != nil {
+			if listed && errors.Is(err, errUnknownFormat) {
+				util.Logger.Warn("skipped file of unknown format", zap.String("file", name))
+				err = nil
+			}
+			return
+		}
+		sources = append(sources, src)
+		return
+	}
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "s3://") {
+			var bucket, key string
+			if bucket, key, err = parseS3URL(arg); err != nil {
+				return
+			}
+			var keys []string
+			if keys, err = s3c.list(bucket, key); err != nil {
+				return
+			}
+			if len(keys) == 0 {
+				err = errors.Errorf("no object at %s", arg)
+				return
+			}
+			for _, k := range keys {
+				k := k
+				open := func() (io.ReadCloser, error) { return s3c.open(bucket, k) }
+				if err = add("s3://"+bucket+"/"+k, k != key, open); err != nil {
+					return
+				}
+			}
+			continue
+		}
+		var matches []string
+		if matches, err = filepath.Glob(arg); err != nil {
+			err = errors.Wrapf(err, "")
+			return
+		}
+		if len(matches) == 0 {
+			err = errors.Errorf("no file at %s", arg)
+			return
+		}
+		for _, match := range matches {
+			if err = filepath.Walk(match, func(path string, info os.FileInfo, err error) error {
+				if err != nil || !info.Mode().IsRegular() {
+					return err
+				}
+				open := func() (io.ReadCloser, error) { return os.Open(path) }
+				return add(path, path != match, open)
+			}); err != nil {
+				err = errors.Wrapf(err, "")
+				return
+			}
+		}
+	}
+	return
+}
+
+// recordReader turns records of sources into messages for the parser of the task.
+type recordReader struct {
+	parser    string   // parser of the task
+	csvFormat []string // columns of the csv parser
+	delimiter rune     // of the csv parser
+	comma     rune     // of CSV files
+	header    bool     // CSV files begin with a header
+}
+
+func newRecordReader(taskCfg *config.TaskConfig, comma rune, header bool) *recordReader {
+	rr := &recordReader{parser: taskCfg.Parser, csvFormat: taskCfg.CsvFormat, delimiter: ',', comma: comma, header: header}
+	if taskCfg.Delimiter != "" {
+		rr.delimiter = rune(taskCfg.Delimiter[0])
+	}
+	return rr
+}
+
+// read calls fn with each message of the source, until fn returns false.
+func (rr *recordReader) read(src *source, fn func(value []byte) bool) (err error) {
+	var rc io.ReadCloser
+	if rc, err = src.open(); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	defer rc.Close()
+	var r io.Reader = rc
+	if src.gzip {
+		var gr *gzip.Reader
+		if gr, err = gzip.NewReader(rc); err != nil {
+			err = errors.Wrapf(err, "%s", src.name)
+			return
+		}
+		defer gr.Close()
+		r = gr
+	}
+	if src.format == formatCSV {
+		err = rr.readCSV(r, fn)
+	} else {
+		err = rr.readNDJSON(r, fn)
+	}
+	if err != nil {
+		err = errors.Wrapf(err, "%s", src.name)
+	}
+	return
+}
+
+func (rr *recordReader) readNDJSON(r io.Reader, fn func(value []byte) bool) (err error) {
+	br := bufio.NewReaderSize(r, 1<<20)
+	for {
+		var line []byte
+		line, err = br.ReadBytes('\n')
+		if line = bytes.TrimSpace(line); len(line) != 0 && !fn(line) {
+			return nil
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return errors.Wrapf(err, "")
+		}
+	}
+}
+
+func (rr *recordReader) readCSV(r io.Reader, fn func(value []byte) bool) (err error) {
+	cr := csv.NewReader(r)
+	cr.Comma = rr.comma
+	cr.FieldsPerRecord = -1
+	var header []string
+	if rr.header {
+		if header, err = cr.Read(); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return errors.Wrapf(err, "")
+		}
+	} else if rr.parser != "csv" {
+		if header = rr.csvFormat; len(header) == 0 {
+			return errors.Errorf("CSV files without a header need csvFormat of the task to name columns")
+		}
+	}
+	for {
+		var record []string
+		if record, err = cr.Read(); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return errors.Wrapf(err, "")
+		}
+		var value []byte
+		if rr.parser == "csv" {
+			value = rr.toCSV(header, record)
+		} else {
+			value = toJSON(header, record)
+		}
+		if !fn(value) {
+			return nil
+		}
+	}
+}
+
+// toCSV re-encodes the record for the csv parser, with columns ordered by csvFormat if the file has a header.
+func (rr *recordReader) toCSV(header, record []string) []byte {
+	if header != nil {
+		idx := make(map[string]int, len(header))
+		for i, name := range header {
+			idx[name] = i
+		}
+		ordered := make([]string, len(rr.csvFormat))
+		for i, name := range rr.csvFormat {
+			if j, ok := idx[name]; ok && j < len(record) {
+				ordered[i] = record[j]
+			} else {
+				ordered[i] = "null"
+			}
+		}
+		record = ordered
+	}
+	var b bytes.Buffer
+	w := csv.NewWriter(&b)
+	w.Comma = rr.delimiter
+	_ = w.Write(record)
+	w.Flush()
+	return bytes.TrimRight(b.Bytes(), "\r\n")
+}
+
+// toJSON converts the record into a JSON object keyed by the header. Numeric values become numbers so that they fit
+// numeric columns, and empty values are left out.
+func toJSON(header, record []string) []byte {
+	obj := make(map[string]interface{}, len(header))
+	for i, name := range header {
+		if i >= len(record) || record[i] == "" {
+			continue
+		}
+		if v := record[i]; (v[0] == '-' || (v[0] >= '0' && v[0] <= '9')) && json.Valid([]byte(v)) {
+			obj[name] = json.Number(v)
+		} else {
+			obj[name] = v
+		}
+	}
+	b, _ := json.Marshal(obj)
+	return b
+}
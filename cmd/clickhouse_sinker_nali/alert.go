@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+
+	"github.com/forever765/clickhouse_sinker_nali/config"
+	cm "github.com/forever765/clickhouse_sinker_nali/config_manager"
+	"github.com/forever765/clickhouse_sinker_nali/statistics"
+	"github.com/forever765/clickhouse_sinker_nali/util"
+)
+
+const (
+	alertCheckInterval = time.Minute
+
+	alertLag       = "lag"
+	alertErrorRate = "errorRate"
+	alertLatency   = "latencyP99"
+
+	alertFiring   = "firing"
+	alertResolved = "resolved"
+)
+
+// alerter checks SLA thresholds of tasks running on this instance every minute, and posts to a webhook when one has
+// been breached for a while, see config.AlertConfig. Error rate and latency are computed from metrics of the last
+// minute.
+type alerter struct {
+	s        *Sinker
+	client   *http.Client
+	prev     map[string]*alertSample // metrics of tasks at the last check
+	breaches map[alertKey]*alertBreach
+}
+
+type alertKey struct {
+	task string
+	rule string
+}
+
+type alertBreach struct {
+	since time.Time
+	fired bool
+}
+
+// alertSample is the cumulative metrics of a task.
+type alertSample struct {
+	consumed float64
+	dropped  float64
+	latency  map[float64]uint64 // cumulative counts of end-to-end latency buckets by upper bound, including +Inf
+}
+
+// alertEvent is the payload of format "json".
+type alertEvent struct {
+	State     string    `json:"state"` // firing or resolved
+	Instance  string    `json:"instance"`
+	Task      string    `json:"task"`
+	Rule      string    `json:"rule"` // lag, errorRate or latencyP99
+	Value     float64   `json:"value"`
+	Threshold float64   `json:"threshold"`
+	Since     time.Time `json:"since"`
+	Text      string    `json:"text"`
+}
+
+func newAlerter(s *Sinker) *alerter {
+	return &alerter{
+		s:        s,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		prev:     make(map[string]*alertSample),
+		breaches: make(map[alertKey]*alertBreach),
+	}
+}
+
+func (a *alerter) run() {
+	for {
+		if cfg, running := a.s.snapshot(); cfg != nil && cfg.Alert.Webhook != "" {
+			a.check(cfg, running)
+		}
+		select {
+		case <-a.s.ctx.Done():
+			return
+		case <-time.After(alertCheckInterval):
+		}
+	}
+}
+
+func (a *alerter) check(cfg *config.Config, running map[string]bool) {
+	al := cfg.Alert
+	now := time.Now()
+	// values of rules which could be evaluated, breached or not
+	values := make(map[alertKey]float64)
+	thresholds := map[string]float64{alertLag: float64(al.Lag), alertErrorRate: al.ErrorRate, alertLatency: al.LatencySeconds}
+
+	if al.Lag > 0 {
+		lagCfg := *cfg
+		lagCfg.Tasks = nil
+		for _, taskCfg := range cfg.Tasks {
+			if running[taskCfg.Name] {
+				lagCfg.Tasks = append(lagCfg.Tasks, taskCfg)
+			}
+		}
+		if len(lagCfg.Tasks) != 0 {
+			if lags, err := cm.GetTaskLags(&lagCfg); err != nil {
+				util.Logger.Warn("failed to get lags of tasks for alerting", zap.Error(err))
+			} else {
+				for taskName, lag := range lags {
+					values[alertKey{taskName, alertLag}] = float64(lag)
+				}
+			}
+		}
+	}
+	cur := gatherAlertSamples()
+	for taskName := range running {
+		sample, prev := cur[taskName], a.prev[taskName]
+		if sample == nil || prev == nil {
+			continue
+		}
+		if consumed := sample.consumed - prev.consumed; al.ErrorRate > 0 && consumed > 0 {
+			values[alertKey{taskName, alertErrorRate}] = (sample.dropped - prev.dropped) / consumed
+		}
+		if al.LatencySeconds > 0 {
+			if p99, ok := statistics.Quantile(0.99, sample.latency, prev.latency); ok {
+				values[alertKey{taskName, alertLatency}] = p99
+			}
+		}
+	}
+	a.prev = cur
+
+	forDuration := time.Duration(al.ForMinutes) * time.Minute
+	for key, value := range values {
+		threshold := thresholds[key.rule]
+		b := a.breaches[key]
+		if value <= threshold {
+			if b != nil {
+				if b.fired {
+					a.notify(al, alertResolved, key, value, threshold, b.since)
+				}
+				delete(a.breaches, key)
+			}
+			continue
+		}
+		if b == nil {
+			b = &alertBreach{since: now}
+			a.breaches[key] = b
+		}
+		if !b.fired && now.Sub(b.since) >= forDuration {
+			b.fired = true
+			a.notify(al, alertFiring, key, value, threshold, b.since)
+		}
+	}
+	for key := range a.breaches {
+		if !running[key.task] || thresholds[key.rule] <= 0 {
+			delete(a.breaches, key)
+		}
+	}
+}
+
+func (a *alerter) notify(al config.AlertConfig, state string, key alertKey, value, threshold float64, since time.Time) {
+	ev := alertEvent{
+		State:     state,
+		Instance:  httpAddr,
+		Task:      key.task,
+		Rule:      key.rule,
+		Value:     value,
+		Threshold: threshold,
+		Since:     since,
+	}
+	if state == alertFiring {
+		ev.Text = fmt.Sprintf("[FIRING] clickhouse_sinker task %s %s %g exceeds %g since %s on %s",
+			key.task, key.rule, value, threshold, since.Format(time.RFC3339), httpAddr)
+	} else {
+		ev.Text = fmt.Sprintf("[RESOLVED] clickhouse_sinker task %s %s %g is within %g on %s",
+			key.task, key.rule, value, threshold, httpAddr)
+	}
+	var payload interface{}
+	switch al.Format {
+	case "dingtalk":
+		payload = map[string]interface{}{"msgtype": "text", "text": map[string]string{"content": ev.Text}}
+	case "slack":
+		payload = map[string]string{"text": ev.Text}
+	default:
+		payload = ev
+	}
+	if err := a.post(al.Webhook, payload); err != nil {
+		util.Logger.Error("failed to post alert", zap.String("task", key.task), zap.String("rule", key.rule), zap.Error(err))
+		return
+	}
+	util.Logger.Info("posted alert", zap.String("task", key.task), zap.String("rule", key.rule), zap.String("state", state),
+		zap.Float64("value", value))
+}
+
+func (a *alerter) post(url string, payload interface{}) (err error) {
+	var body []byte
+	if body, err = json.Marshal(payload); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	var resp *http.Response
+	if resp, err = a.client.Post(url, "application/json", bytes.NewReader(body)); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		err = errors.Errorf("webhook responded %s", resp.Status)
+	}
+	return
+}
+
+// gatherAlertSamples sums metrics of each task from the default registry.
+func gatherAlertSamples() (samples map[string]*alertSample) {
+	samples = make(map[string]*alertSample)
+	mfs, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		util.Logger.Warn("failed to gather metrics", zap.Error(err))
+	}
+	for _, mf := range mfs {
+		name := mf.GetName()
+		if name != "clickhouse_sinker_consume_msgs_total" && name != "clickhouse_sinker_parse_msgs_error_total" &&
+			name != "clickhouse_sinker_end_to_end_latency_seconds" {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			var taskName string
+			for _, lp := range m.GetLabel() {
+				if lp.GetName() == "task" {
+					taskName = lp.GetValue()
+				}
+			}
+			if taskName == "" {
+				continue
+			}
+			sample := samples[taskName]
+			if sample == nil {
+				sample = &alertSample{latency: make(map[float64]uint64)}
+				samples[taskName] = sample
+			}
+			switch name {
+			case "clickhouse_sinker_consume_msgs_total":
+				sample.consumed += m.GetCounter().GetValue()
+			case "clickhouse_sinker_parse_msgs_error_total":
+				sample.dropped += m.GetCounter().GetValue()
+			default:
+				statistics.AddBuckets(sample.latency, m.GetHistogram())
+			}
+		}
+	}
+	return
+}
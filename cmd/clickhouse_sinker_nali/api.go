@@ -0,0 +1,431 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/forever765/clickhouse_sinker_nali/config"
+	cm "github.com/forever765/clickhouse_sinker_nali/config_manager"
+	"github.com/forever765/clickhouse_sinker_nali/util"
+)
+
+const (
+	apiTasksPath  = "/api/v1/tasks"
+	apiConfigPath = "/api/v1/config"
+)
+
+// taskAPI manages tasks at runtime:
+//
+//	GET    /api/v1/tasks               list tasks
+//	POST   /api/v1/tasks               create a task
+//	GET    /api/v1/tasks/<name>        get a task
+//	PUT    /api/v1/tasks/<name>        replace a task
+//	DELETE /api/v1/tasks/<name>        delete a task
+//	POST   /api/v1/tasks/<name>/pause  keep the task in config, but stop running it
+//	POST   /api/v1/tasks/<name>/resume
+//	PUT    /api/v1/tasks/<name>/dynamic-schema  replace DynamicSchema, which running tasks apply without restarting
+//	GET    /api/v1/config/versions     list versions of applied configs, the latest first
+//	GET    /api/v1/config/versions/<n> get the config of version n
+//	POST   /api/v1/config/rollback/<n> publish the config of version n, except the assignment
+//
+// Changes are written to the config center in use(or the local config file), and take effect once instances reload it.
+type taskAPI struct {
+	s     *Sinker
+	rcm   cm.RemoteConfManager
+	token string
+	mux   sync.Mutex // serialize read-modify-write of the config
+}
+
+// taskStatus is a task as listed by the API.
+type taskStatus struct {
+	Name    string             `json:"name"`
+	Paused  bool               `json:"paused"`
+	Running bool               `json:"running"` // whether it's running on this instance
+	Config  *config.TaskConfig `json:"config"`
+}
+
+// apiError is an error with the HTTP status to reply.
+type apiError struct {
+	status int
+	msg    string
+}
+
+func (e *apiError) Error() string {
+	return e.msg
+}
+
+func newTaskAPI(s *Sinker, rcm cm.RemoteConfManager, token string) *taskAPI {
+	return &taskAPI{s: s, rcm: rcm, token: token}
+}
+
+func (api *taskAPI) register(mux *http.ServeMux) {
+	mux.Handle(apiTasksPath, api)
+	mux.Handle(apiTasksPath+"/", api)
+	mux.Handle(apiConfigPath+"/", api)
+}
+
+// ServeHTTP audits calls except GETs, including unauthorized ones.
+func (api *taskAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet || api.s.audit == nil {
+		api.serve(w, r)
+		return
+	}
+	ev := newHTTPAuditEvent(r)
+	rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	api.serve(rec, r.WithContext(withAuditEvent(r.Context(), ev)))
+	ev.Status = fmt.Sprintf("%d %s", rec.status, http.StatusText(rec.status))
+	api.s.audit.record(ev)
+}
+
+func (api *taskAPI) serve(w http.ResponseWriter, r *http.Request) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") || subtle.ConstantTimeCompare([]byte(auth[len("Bearer "):]), []byte(api.token)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		api.reply(w, 0, nil, &apiError{http.StatusUnauthorized, "invalid or missing bearer token"})
+		return
+	}
+	if api.managedByKubernetes() {
+		api.reply(w, 0, nil, &apiError{http.StatusNotImplemented, "tasks are ClickHouseSinkerTask resources, manage them via the Kubernetes API"})
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, apiConfigPath+"/") {
+		api.serveConfig(w, r)
+		return
+	}
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, apiTasksPath), "/"), "/")
+	var resp interface{}
+	var err error
+	status := http.StatusOK
+	switch {
+	case parts[0] == "" && r.Method == http.MethodGet:
+		resp, err = api.list()
+	case parts[0] == "" && r.Method == http.MethodPost:
+		var taskCfg *config.TaskConfig
+		if taskCfg, err = decodeTask(r); err == nil {
+			resp, err = api.modify(r.Context(), taskCfg.Name, false, func(cfg *config.Config, idx int) error {
+				if idx >= 0 {
+					return &apiError{http.StatusConflict, "task already exists"}
+				}
+				cfg.Tasks = append(cfg.Tasks, taskCfg)
+				return nil
+			})
+			status = http.StatusCreated
+		}
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		resp, err = api.get(parts[0])
+	case len(parts) == 1 && r.Method == http.MethodPut:
+		var taskCfg *config.TaskConfig
+		if taskCfg, err = decodeTask(r); err == nil {
+			taskCfg.Name = parts[0]
+			resp, err = api.modify(r.Context(), parts[0], true, func(cfg *config.Config, idx int) error {
+				cfg.Tasks[idx] = taskCfg
+				return nil
+			})
+		}
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		_, err = api.modify(r.Context(), parts[0], true, func(cfg *config.Config, idx int) error {
+			cfg.Tasks = append(cfg.Tasks[:idx], cfg.Tasks[idx+1:]...)
+			return nil
+		})
+		status = http.StatusNoContent
+	case len(parts) == 2 && (parts[1] == "pause" || parts[1] == "resume") && r.Method == http.MethodPost:
+		paused := parts[1] == "pause"
+		resp, err = api.modify(r.Context(), parts[0], true, func(cfg *config.Config, idx int) error {
+			cfg.Tasks[idx].Paused = paused
+			return nil
+		})
+	case len(parts) == 2 && parts[1] == "dynamic-schema" && r.Method == http.MethodPut:
+		var dsCfg config.DynamicSchemaConfig
+		dec := json.NewDecoder(r.Body)
+		dec.DisallowUnknownFields()
+		if err = dec.Decode(&dsCfg); err != nil {
+			err = &apiError{http.StatusBadRequest, err.Error()}
+			break
+		}
+		resp, err = api.modify(r.Context(), parts[0], true, func(cfg *config.Config, idx int) error {
+			cfg.Tasks[idx].DynamicSchema = dsCfg
+			return nil
+		})
+	default:
+		err = &apiError{http.StatusNotFound, "no such API"}
+	}
+	api.reply(w, status, resp, err)
+}
+
+func (api *taskAPI) managedByKubernetes() bool {
+	_, ok := api.rcm.(*cm.KubernetesConfManager)
+	return ok
+}
+
+func (api *taskAPI) serveConfig(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, apiConfigPath), "/"), "/")
+	var resp interface{}
+	var err error
+	var version int64
+	if len(parts) == 2 {
+		if version, err = strconv.ParseInt(parts[1], 10, 64); err != nil {
+			api.reply(w, 0, nil, &apiError{http.StatusBadRequest, "invalid version " + parts[1]})
+			return
+		}
+	}
+	switch {
+	case len(parts) == 1 && parts[0] == "versions" && r.Method == http.MethodGet:
+		resp = map[string]interface{}{"current": api.s.history.current(), "versions": api.s.history.list()}
+	case len(parts) == 2 && parts[0] == "versions" && r.Method == http.MethodGet:
+		resp, err = api.version(version)
+	case len(parts) == 2 && parts[0] == "rollback" && r.Method == http.MethodPost:
+		resp, err = api.rollback(r.Context(), version)
+	default:
+		err = &apiError{http.StatusNotFound, "no such API"}
+	}
+	api.reply(w, http.StatusOK, resp, err)
+}
+
+func (api *taskAPI) version(version int64) (cfg *config.Config, err error) {
+	if cfg, err = api.s.history.get(version); err == nil && cfg == nil {
+		err = &apiError{http.StatusNotFound, fmt.Sprintf("version %d isn't kept", version)}
+	}
+	return
+}
+
+// rollback publishes the config of a version as a whole. The current assignment is kept, since it's up to
+// instances alive now. The rolled back config takes effect as a new version.
+func (api *taskAPI) rollback(ctx context.Context, version int64) (resp interface{}, err error) {
+	var cfg, cur *config.Config
+	if cfg, err = api.version(version); err != nil {
+		return
+	}
+	api.mux.Lock()
+	defer api.mux.Unlock()
+	if cur, err = api.load(); err != nil {
+		return
+	}
+	cfg.Assignment = cur.Assignment
+	if err = api.save(ctx, cur, cfg); err != nil {
+		return
+	}
+	util.Logger.Info("rolled back config", zap.Int64("version", version))
+	resp = map[string]int64{"rolledBackTo": version}
+	return
+}
+
+func (api *taskAPI) reply(w http.ResponseWriter, status int, resp interface{}, err error) {
+	if err != nil {
+		var ae *apiError
+		if errors.As(err, &ae) {
+			status = ae.status
+		} else {
+			status = http.StatusInternalServerError
+			util.Logger.Error("task API failed", zap.Error(err))
+		}
+		resp = map[string]string{"error": err.Error()}
+	}
+	if status == http.StatusNoContent {
+		w.WriteHeader(status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+func decodeTask(r *http.Request) (taskCfg *config.TaskConfig, err error) {
+	taskCfg = &config.TaskConfig{}
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err = dec.Decode(taskCfg); err != nil {
+		err = &apiError{http.StatusBadRequest, err.Error()}
+	} else if taskCfg.Name == "" && r.Method == http.MethodPost {
+		err = &apiError{http.StatusBadRequest, "task name is required"}
+	}
+	return
+}
+
+// load reads the config as is, without normallizing it.
+func (api *taskAPI) load() (cfg *config.Config, err error) {
+	if api.rcm != nil {
+		cfg, err = api.rcm.GetConfig()
+	} else {
+		cfg, err = config.ParseLocalCfgFile(cmdOps.LocalCfgFile)
+	}
+	if err != nil {
+		return
+	}
+	if cfg.Task != nil {
+		cfg.Tasks = append(cfg.Tasks, cfg.Task)
+		cfg.Task = nil
+	}
+	return
+}
+
+// save publishes cfg, and adds changes from before to the audit event of ctx if any.
+func (api *taskAPI) save(ctx context.Context, before, cfg *config.Config) (err error) {
+	if api.rcm != nil {
+		err = api.rcm.PublishConfig(cfg)
+	} else {
+		err = writeLocalCfgFile(cmdOps.LocalCfgFile, cfg)
+	}
+	if err != nil {
+		return
+	}
+	api.s.reload()
+	if ev := auditEventOf(ctx); ev != nil {
+		if plan, e := config.MakePlan(before, cfg); e == nil {
+			ev.Changes = &plan
+		}
+	}
+	return
+}
+
+// writeLocalCfgFile replaces the file atomically, so that a concurrent reload never sees a partial one.
+func writeLocalCfgFile(cfgPath string, cfg *config.Config) (err error) {
+	var layer []byte
+	if layer, err = cfg.MainLayer(); err != nil {
+		err = &apiError{http.StatusConflict, err.Error()}
+		return
+	}
+	var buf bytes.Buffer
+	if err = json.Indent(&buf, layer, "", "  "); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	bs := buf.Bytes()
+	var f *os.File
+	if f, err = ioutil.TempFile(filepath.Dir(cfgPath), filepath.Base(cfgPath)+".tmp"); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	defer os.Remove(f.Name())
+	if _, err = f.Write(bs); err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	if fi, e := os.Stat(cfgPath); e == nil {
+		_ = os.Chmod(f.Name(), fi.Mode())
+	}
+	if err = os.Rename(f.Name(), cfgPath); err != nil {
+		err = errors.Wrapf(err, "")
+	}
+	return
+}
+
+func (api *taskAPI) list() (tasks []taskStatus, err error) {
+	var cfg *config.Config
+	if cfg, err = api.load(); err != nil {
+		return
+	}
+	running := api.s.runningTasks()
+	tasks = []taskStatus{}
+	for _, taskCfg := range cfg.Tasks {
+		tasks = append(tasks, taskStatus{Name: taskCfg.Name, Paused: taskCfg.Paused, Running: running[taskCfg.Name], Config: taskCfg})
+	}
+	sort.Slice(tasks, func(i, j int) bool { return tasks[i].Name < tasks[j].Name })
+	return
+}
+
+func (api *taskAPI) get(name string) (task *taskStatus, err error) {
+	var tasks []taskStatus
+	if tasks, err = api.list(); err != nil {
+		return
+	}
+	for i := range tasks {
+		if tasks[i].Name == name {
+			return &tasks[i], nil
+		}
+	}
+	err = &apiError{http.StatusNotFound, "task not found"}
+	return
+}
+
+// modify applies change to the config, validates and saves it. idx is the position of the named task, -1 if absent.
+func (api *taskAPI) modify(ctx context.Context, name string, mustExist bool, change func(cfg *config.Config, idx int) error) (task *taskStatus, err error) {
+	api.mux.Lock()
+	defer api.mux.Unlock()
+	var cfg, before *config.Config
+	if cfg, err = api.load(); err != nil {
+		return
+	}
+	if auditEventOf(ctx) != nil {
+		if before, err = api.load(); err != nil {
+			return
+		}
+	}
+	idx := -1
+	for i, taskCfg := range cfg.Tasks {
+		if taskCfg.Name == name {
+			idx = i
+			break
+		}
+	}
+	if idx < 0 && mustExist {
+		err = &apiError{http.StatusNotFound, "task not found"}
+		return
+	}
+	if err = change(cfg, idx); err != nil {
+		return
+	}
+	if err = validateTasks(cfg); err != nil {
+		err = &apiError{http.StatusBadRequest, err.Error()}
+		return
+	}
+	if err = api.save(ctx, before, cfg); err != nil {
+		return
+	}
+	util.Logger.Info("task changed via API", zap.String("task", name))
+	for _, taskCfg := range cfg.Tasks {
+		if taskCfg.Name == name {
+			task = &taskStatus{Name: name, Paused: taskCfg.Paused, Config: taskCfg}
+		}
+	}
+	return
+}
+
+// validateTasks normallizes copies of the config and tasks, and reports the first problem.
+func validateTasks(cfg *config.Config) (err error) {
+	// Instances of templates are checked as tasks.
+	expanded := *cfg
+	expanded.Tasks = append([]*config.TaskConfig(nil), cfg.Tasks...)
+	if err = expanded.ExpandTemplates(); err != nil {
+		return
+	}
+	global := expanded
+	global.Tasks = nil
+	if err = global.Normallize(); err != nil {
+		return
+	}
+	names := make(map[string]bool)
+	for _, orig := range expanded.Tasks {
+		if names[orig.Name] {
+			return errors.Errorf("task %s is duplicated", orig.Name)
+		}
+		names[orig.Name] = true
+		// Clear the cron spec to avoid scheduling the update job.
+		taskCfg := *orig
+		taskCfg.AutoUpdateGeoIPDB = ""
+		taskCfg.Dims = append(taskCfg.Dims[:0:0], taskCfg.Dims...)
+		taskCfg.Enrichments = append(taskCfg.Enrichments[:0:0], taskCfg.Enrichments...)
+		if err = global.NormallizeTask(&taskCfg); err != nil {
+			return errors.Wrapf(err, "task %s", orig.Name)
+		}
+	}
+	return
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+
+	"github.com/forever765/clickhouse_sinker_nali/config"
+	"github.com/forever765/clickhouse_sinker_nali/model"
+	"github.com/forever765/clickhouse_sinker_nali/output"
+	"github.com/forever765/clickhouse_sinker_nali/util"
+)
+
+const (
+	auditConfigApplied = "config_applied"
+	auditAPICall       = "api_call"
+
+	// auditUserHeader names the operator of an admin API call. It's also the key of gRPC metadata.
+	auditUserHeader = "X-Sinker-User"
+
+	auditFlushInterval = 5 * time.Second
+	maxPendingAudits   = 10000
+)
+
+// auditEvent is a line of the audit log.
+type auditEvent struct {
+	Time     time.Time    `json:"time"`
+	Instance string       `json:"instance"`
+	Action   string       `json:"action"`
+	User     string       `json:"user,omitempty"`   // the operator of an API call, from header X-Sinker-User
+	Remote   string       `json:"remote,omitempty"` // the client address of an API call
+	Method   string       `json:"method,omitempty"` // HTTP method and path, or the gRPC method
+	Status   string       `json:"status,omitempty"` // the result of an API call
+	Version  int64        `json:"version,omitempty"`
+	Changes  *config.Plan `json:"changes,omitempty"` // secrets are redacted
+}
+
+// auditLog records applied configs and admin API calls which change something, to a file of JSON lines and
+// optionally a ClickHouse table with columns (time DateTime, instance String, action String, user String, event String).
+type auditLog struct {
+	mux  sync.Mutex
+	file *os.File
+
+	table     string
+	insertSQL string
+	started   bool
+	ch        chan *auditEvent
+	stopped   chan struct{}
+}
+
+func newAuditLog(filePath, table string) (al *auditLog, err error) {
+	if filePath == "" && table == "" {
+		return
+	}
+	al = &auditLog{}
+	if filePath != "" {
+		if al.file, err = os.OpenFile(filePath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600); err != nil {
+			err = errors.Wrapf(err, "")
+			return
+		}
+	}
+	if table != "" {
+		// The database is unknown until the first config is applied, events are queued till then.
+		al.table = table
+		al.ch = make(chan *auditEvent, 1024)
+		al.stopped = make(chan struct{})
+	}
+	return
+}
+
+// start writing to the ClickHouse table in database db. Later calls are ignored.
+func (al *auditLog) start(db string) {
+	if al == nil || al.table == "" || al.started {
+		return
+	}
+	al.insertSQL = fmt.Sprintf("INSERT INTO %s.%s (time, instance, action, user, event) VALUES (?, ?, ?, ?, ?)", db, al.table)
+	al.started = true
+	go al.run()
+}
+
+func (al *auditLog) record(ev *auditEvent) {
+	if al == nil {
+		return
+	}
+	ev.Time = time.Now()
+	ev.Instance = httpAddr
+	if ev.Changes != nil {
+		ev.Changes.Redact()
+	}
+	line, err := json.Marshal(ev)
+	if err != nil {
+		util.Logger.Error("failed to marshal audit event", zap.Error(err))
+		return
+	}
+	if al.file != nil {
+		al.mux.Lock()
+		_, err = al.file.Write(append(line, '\n'))
+		al.mux.Unlock()
+		if err != nil {
+			util.Logger.Error("failed to write audit log", zap.Error(err))
+		}
+	}
+	if al.ch != nil {
+		select {
+		case al.ch <- ev:
+		default:
+			util.Logger.Error("audit table queue is full, dropped an event", zap.ByteString("event", line))
+		}
+	}
+}
+
+// run writes events to ClickHouse in batches. Failed ones are retried at the next flush.
+func (al *auditLog) run() {
+	ticker := time.NewTicker(auditFlushInterval)
+	defer ticker.Stop()
+	var pending model.Rows
+	var round int64
+	flush := func() {
+		if len(pending) == 0 {
+			return
+		}
+		round++
+		if err := output.InsertRows(round, al.insertSQL, pending); err != nil {
+			util.Logger.Error("failed to write audit events to ClickHouse", zap.Int("pending", len(pending)), zap.Error(err))
+			if len(pending) > maxPendingAudits {
+				pending = pending[len(pending)-maxPendingAudits:]
+			}
+			return
+		}
+		pending = nil
+	}
+	for {
+		select {
+		case ev, ok := <-al.ch:
+			if !ok {
+				flush()
+				al.stopped <- struct{}{}
+				return
+			}
+			line, _ := json.Marshal(ev)
+			row := model.Row{ev.Time, ev.Instance, ev.Action, ev.User, string(line)}
+			pending = append(pending, &row)
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// close flushes events. The ClickHouse table shall be written before connections are closed.
+func (al *auditLog) close() {
+	if al == nil {
+		return
+	}
+	if al.started {
+		close(al.ch)
+		<-al.stopped
+	}
+	if al.file != nil {
+		_ = al.file.Close()
+	}
+}
+
+// configApplied records a new version of config with changes from the previous one, if it's known.
+func (al *auditLog) configApplied(version int64, prev []byte, cfg *config.Config) {
+	if al == nil {
+		return
+	}
+	ev := &auditEvent{Action: auditConfigApplied, Version: version}
+	if prev != nil {
+		var prevCfg config.Config
+		if err := json.Unmarshal(prev, &prevCfg); err == nil {
+			next := *cfg
+			next.Assignment = config.Assignment{}
+			if plan, err := config.MakePlan(&prevCfg, &next); err == nil {
+				ev.Changes = &plan
+			}
+		}
+	}
+	al.record(ev)
+}
+
+type auditEventKey struct{}
+
+func withAuditEvent(ctx context.Context, ev *auditEvent) context.Context {
+	return context.WithValue(ctx, auditEventKey{}, ev)
+}
+
+// auditEventOf returns the event of the API call being served, nil if it isn't audited.
+func auditEventOf(ctx context.Context) *auditEvent {
+	ev, _ := ctx.Value(auditEventKey{}).(*auditEvent)
+	return ev
+}
+
+func newHTTPAuditEvent(r *http.Request) *auditEvent {
+	return &auditEvent{
+		Action: auditAPICall,
+		User:   r.Header.Get(auditUserHeader),
+		Remote: r.RemoteAddr,
+		Method: r.Method + " " + r.URL.Path,
+	}
+}
+
+// newGRPCAuditEvent returns nil for read-only methods.
+func newGRPCAuditEvent(ctx context.Context, fullMethod string) *auditEvent {
+	name := fullMethod[strings.LastIndex(fullMethod, "/")+1:]
+	if strings.HasPrefix(name, "List") || strings.HasPrefix(name, "Get") {
+		return nil
+	}
+	ev := &auditEvent{Action: auditAPICall, Method: fullMethod}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if users := md.Get(strings.ToLower(auditUserHeader)); len(users) != 0 {
+			ev.User = users[0]
+		}
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		ev.Remote = p.Addr.String()
+	}
+	return ev
+}
+
+// statusRecorder keeps the status replied to an HTTP request.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
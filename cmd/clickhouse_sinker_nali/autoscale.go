@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/forever765/clickhouse_sinker_nali/config"
+	cm "github.com/forever765/clickhouse_sinker_nali/config_manager"
+	"github.com/forever765/clickhouse_sinker_nali/statistics"
+	"github.com/forever765/clickhouse_sinker_nali/util"
+)
+
+const (
+	apiAutoscalePath = "/api/v1/autoscale"
+	// scaleDownDelay keeps a lower desired number for so long before scaling down, to avoid flapping.
+	scaleDownDelay = 5 * time.Minute
+)
+
+// autoscaler computes the desired number of replicas from the total lag and incoming rate of tasks, see
+// config.AutoscaleConfig. Every instance exposes it, and only the coordinator scales the target.
+type autoscaler struct {
+	s *Sinker
+
+	mux      sync.Mutex
+	state    autoscaleState
+	produced int64 // sum of newest offsets at the last computation
+	scaled   int   // the number of replicas applied to the target, 0 means none
+	lowSince time.Time
+}
+
+type autoscaleState struct {
+	DesiredReplicas int       `json:"desiredReplicas"`
+	Lag             int64     `json:"lag"`
+	IncomingRate    float64   `json:"incomingRate"` // messages per second
+	UpdatedAt       time.Time `json:"updatedAt"`
+}
+
+func newAutoscaler(s *Sinker) *autoscaler {
+	return &autoscaler{s: s}
+}
+
+func (a *autoscaler) register(mux *http.ServeMux) {
+	mux.HandleFunc(apiAutoscalePath, func(w http.ResponseWriter, r *http.Request) {
+		a.mux.Lock()
+		state := a.state
+		a.mux.Unlock()
+		if state.UpdatedAt.IsZero() {
+			http.Error(w, "autoscale is disabled or not computed yet", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(state)
+	})
+}
+
+func (a *autoscaler) run() {
+	for {
+		interval := time.Minute
+		if cfg, _ := a.s.snapshot(); cfg != nil && cfg.Autoscale.ReplicaThroughput > 0 {
+			interval = time.Duration(cfg.Autoscale.Interval) * time.Second
+			a.compute(cfg)
+		}
+		select {
+		case <-a.s.ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+func (a *autoscaler) compute(cfg *config.Config) {
+	taskLags, taskProduced, err := cm.GetTaskOffsets(cfg)
+	if err != nil {
+		util.Logger.Warn("failed to get offsets of tasks for autoscaling", zap.Error(err))
+		return
+	}
+	// Tasks sharing a topic count it once for the rate.
+	var lag, produced int64
+	topics := make(map[string]bool)
+	for _, taskCfg := range cfg.Tasks {
+		lag += taskLags[taskCfg.Name]
+		if !topics[taskCfg.Topic] {
+			topics[taskCfg.Topic] = true
+			produced += taskProduced[taskCfg.Name]
+		}
+	}
+	now := time.Now()
+
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	prev := a.state
+	var rate float64
+	if !prev.UpdatedAt.IsZero() && produced >= a.produced {
+		rate = float64(produced-a.produced) / now.Sub(prev.UpdatedAt).Seconds()
+	}
+	desired := cfg.Autoscale.DesiredReplicas(lag, rate)
+	a.state = autoscaleState{DesiredReplicas: desired, Lag: lag, IncomingRate: rate, UpdatedAt: now}
+	a.produced = produced
+	statistics.AutoscaleLag.Set(float64(lag))
+	statistics.AutoscaleIncomingRate.Set(rate)
+	statistics.DesiredReplicas.Set(float64(desired))
+	util.Logger.Debug("computed desired replicas", zap.Int("replicas", desired), zap.Int64("lag", lag), zap.Float64("rate", rate))
+
+	// The rate is unknown at the first computation.
+	if prev.UpdatedAt.IsZero() || cfg.Autoscale.Target == "" || !isCoordinator(cfg) {
+		return
+	}
+	scaler, ok := a.s.rcm.(cm.Scaler)
+	if !ok {
+		util.Logger.Warn("autoscale target requires --k8s-configmap", zap.String("target", cfg.Autoscale.Target))
+		return
+	}
+	if desired >= a.scaled {
+		a.lowSince = time.Time{}
+	} else if a.lowSince.IsZero() {
+		a.lowSince = now
+	}
+	if desired == a.scaled || desired < a.scaled && now.Sub(a.lowSince) < scaleDownDelay {
+		return
+	}
+	if err = scaler.Scale(cfg.Autoscale.Target, desired); err != nil {
+		util.Logger.Error("failed to scale", zap.String("target", cfg.Autoscale.Target), zap.Int("replicas", desired), zap.Error(err))
+		return
+	}
+	util.Logger.Info("scaled", zap.String("target", cfg.Autoscale.Target), zap.Int("from", a.scaled), zap.Int("to", desired))
+	a.scaled, a.lowSince = desired, time.Time{}
+}
+
+// isCoordinator tells whether this instance acts for the cluster, which is the first instance of the assignment.
+func isCoordinator(cfg *config.Config) bool {
+	if serviceName == "" {
+		return true
+	}
+	insts := make([]string, 0, len(cfg.Assignment.Map))
+	for inst := range cfg.Assignment.Map {
+		insts = append(insts, inst)
+	}
+	sort.Strings(insts)
+	return len(insts) != 0 && insts[0] == httpAddr
+}
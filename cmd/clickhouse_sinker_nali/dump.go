@@ -0,0 +1,59 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"runtime"
+	"sort"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/forever765/clickhouse_sinker_nali/util"
+)
+
+// stateDump is the internal state logged on dumpSignals, for incidents where the http port isn't reachable.
+type stateDump struct {
+	Time          time.Time `json:"time"`
+	Instance      string    `json:"instance"`
+	Version       string    `json:"version"`
+	ConfigVersion int64     `json:"configVersion"`
+	Goroutines    int       `json:"goroutines"`
+	Running       []string  `json:"running"` // tasks running on this instance
+	internals
+}
+
+// dumpOnSignal logs the state at each of dumpSignals until the sinker is closed.
+func (s *Sinker) dumpOnSignal() {
+	if len(dumpSignals) == 0 {
+		return
+	}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, dumpSignals...)
+	defer signal.Stop(ch)
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case sig := <-ch:
+			util.Logger.Info("state dump", zap.String("signal", sig.String()), zap.Reflect("state", s.dumpState()))
+		}
+	}
+}
+
+func (s *Sinker) dumpState() (dump stateDump) {
+	dump = stateDump{
+		Time:          time.Now(),
+		Instance:      httpAddr,
+		Version:       getVersion(),
+		ConfigVersion: s.history.current(),
+		Goroutines:    runtime.NumGoroutine(),
+		Running:       []string{},
+		internals:     s.internals(),
+	}
+	for name := range s.runningTasks() {
+		dump.Running = append(dump.Running, name)
+	}
+	sort.Strings(dump.Running)
+	return
+}
@@ -0,0 +1,6 @@
+package main
+
+import "os"
+
+// There's no SIGUSR1 on Windows, use /debug/vars instead.
+var dumpSignals []os.Signal
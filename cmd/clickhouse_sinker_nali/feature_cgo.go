@@ -0,0 +1,9 @@
+//go:build cgo
+// +build cgo
+
+package main
+
+func init() {
+	// Go plugins, such as enrichment plugins, can only be loaded by binaries built with cgo
+	detectedFeatures = append(detectedFeatures, "plugins")
+}
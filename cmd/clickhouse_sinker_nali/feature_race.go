@@ -0,0 +1,8 @@
+//go:build race
+// +build race
+
+package main
+
+func init() {
+	detectedFeatures = append(detectedFeatures, "race")
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/Shopify/sarama"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/forever765/clickhouse_sinker_nali/admin"
+	"github.com/forever765/clickhouse_sinker_nali/config"
+	"github.com/forever765/clickhouse_sinker_nali/input"
+	"github.com/forever765/clickhouse_sinker_nali/util"
+)
+
+// adminServer serves the task management API over gRPC, see admin/admin.proto. It shares the implementation of
+// taskAPI, so both behave the same.
+type adminServer struct {
+	admin.UnimplementedAdminServer
+	api *taskAPI
+	sc  *statusCollector
+}
+
+func newGRPCServer(api *taskAPI, sc *statusCollector) *grpc.Server {
+	server := grpc.NewServer(grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+		// Calls except reads are audited, including unauthorized ones.
+		var ev *auditEvent
+		if api.s.audit != nil {
+			if ev = newGRPCAuditEvent(ctx, info.FullMethod); ev != nil {
+				ctx = withAuditEvent(ctx, ev)
+				defer func() {
+					ev.Status = status.Code(err).String()
+					api.s.audit.record(ev)
+				}()
+			}
+		}
+		if err = api.authorize(ctx); err != nil {
+			return
+		}
+		resp, err = handler(ctx, req)
+		err = toGRPCError(err)
+		return
+	}))
+	admin.RegisterAdminServer(server, &adminServer{api: api, sc: sc})
+	return server
+}
+
+func (api *taskAPI) authorize(ctx context.Context) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, auth := range md.Get("authorization") {
+		if strings.HasPrefix(auth, "Bearer ") && subtle.ConstantTimeCompare([]byte(auth[len("Bearer "):]), []byte(api.token)) == 1 {
+			return nil
+		}
+	}
+	return status.Error(codes.Unauthenticated, "invalid or missing bearer token")
+}
+
+// toGRPCError converts an apiError to a status with the corresponding code.
+func toGRPCError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	var ae *apiError
+	if !errors.As(err, &ae) {
+		util.Logger.Error("admin gRPC API failed", zap.Error(err))
+		return status.Error(codes.Internal, err.Error())
+	}
+	code := codes.Unknown
+	switch ae.status {
+	case http.StatusBadRequest:
+		code = codes.InvalidArgument
+	case http.StatusNotFound:
+		code = codes.NotFound
+	case http.StatusConflict:
+		code = codes.FailedPrecondition
+	case http.StatusNotImplemented:
+		code = codes.Unimplemented
+	}
+	return status.Error(code, ae.msg)
+}
+
+func toTask(ts *taskStatus) (task *admin.Task, err error) {
+	var bs []byte
+	if bs, err = json.Marshal(ts.Config); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	task = &admin.Task{Name: ts.Name, Paused: ts.Paused, Running: ts.Running, ConfigJson: string(bs)}
+	return
+}
+
+func parseTask(configJSON string) (taskCfg *config.TaskConfig, err error) {
+	taskCfg = &config.TaskConfig{}
+	dec := json.NewDecoder(strings.NewReader(configJSON))
+	dec.DisallowUnknownFields()
+	if err = dec.Decode(taskCfg); err != nil {
+		err = &apiError{http.StatusBadRequest, err.Error()}
+	}
+	return
+}
+
+// manageable rejects requests when tasks are managed elsewhere.
+func (s *adminServer) manageable() error {
+	if s.api.managedByKubernetes() {
+		return &apiError{http.StatusNotImplemented, "tasks are ClickHouseSinkerTask resources, manage them via the Kubernetes API"}
+	}
+	return nil
+}
+
+func (s *adminServer) ListTasks(ctx context.Context, req *admin.ListTasksRequest) (resp *admin.ListTasksResponse, err error) {
+	if err = s.manageable(); err != nil {
+		return
+	}
+	var tasks []taskStatus
+	if tasks, err = s.api.list(); err != nil {
+		return
+	}
+	resp = &admin.ListTasksResponse{}
+	for i := range tasks {
+		var task *admin.Task
+		if task, err = toTask(&tasks[i]); err != nil {
+			return
+		}
+		resp.Tasks = append(resp.Tasks, task)
+	}
+	return
+}
+
+func (s *adminServer) GetTask(ctx context.Context, req *admin.GetTaskRequest) (task *admin.Task, err error) {
+	if err = s.manageable(); err != nil {
+		return
+	}
+	var ts *taskStatus
+	if ts, err = s.api.get(req.Name); err != nil {
+		return
+	}
+	return toTask(ts)
+}
+
+func (s *adminServer) CreateTask(ctx context.Context, req *admin.CreateTaskRequest) (task *admin.Task, err error) {
+	if err = s.manageable(); err != nil {
+		return
+	}
+	var taskCfg *config.TaskConfig
+	if taskCfg, err = parseTask(req.ConfigJson); err != nil {
+		return
+	}
+	if taskCfg.Name == "" {
+		err = &apiError{http.StatusBadRequest, "task name is required"}
+		return
+	}
+	var ts *taskStatus
+	if ts, err = s.api.modify(ctx, taskCfg.Name, false, func(cfg *config.Config, idx int) error {
+		if idx >= 0 {
+			return &apiError{http.StatusConflict, "task already exists"}
+		}
+		cfg.Tasks = append(cfg.Tasks, taskCfg)
+		return nil
+	}); err != nil {
+		return
+	}
+	return toTask(ts)
+}
+
+func (s *adminServer) UpdateTask(ctx context.Context, req *admin.UpdateTaskRequest) (task *admin.Task, err error) {
+	if err = s.manageable(); err != nil {
+		return
+	}
+	var taskCfg *config.TaskConfig
+	if taskCfg, err = parseTask(req.ConfigJson); err != nil {
+		return
+	}
+	taskCfg.Name = req.Name
+	var ts *taskStatus
+	if ts, err = s.api.modify(ctx, req.Name, true, func(cfg *config.Config, idx int) error {
+		cfg.Tasks[idx] = taskCfg
+		return nil
+	}); err != nil {
+		return
+	}
+	return toTask(ts)
+}
+
+func (s *adminServer) DeleteTask(ctx context.Context, req *admin.DeleteTaskRequest) (resp *admin.DeleteTaskResponse, err error) {
+	if err = s.manageable(); err != nil {
+		return
+	}
+	if _, err = s.api.modify(ctx, req.Name, true, func(cfg *config.Config, idx int) error {
+		cfg.Tasks = append(cfg.Tasks[:idx], cfg.Tasks[idx+1:]...)
+		return nil
+	}); err != nil {
+		return
+	}
+	resp = &admin.DeleteTaskResponse{}
+	return
+}
+
+func (s *adminServer) PauseTask(ctx context.Context, req *admin.PauseTaskRequest) (*admin.Task, error) {
+	return s.setPaused(ctx, req.Name, true)
+}
+
+func (s *adminServer) ResumeTask(ctx context.Context, req *admin.ResumeTaskRequest) (*admin.Task, error) {
+	return s.setPaused(ctx, req.Name, false)
+}
+
+func (s *adminServer) setPaused(ctx context.Context, name string, paused bool) (task *admin.Task, err error) {
+	if err = s.manageable(); err != nil {
+		return
+	}
+	var ts *taskStatus
+	if ts, err = s.api.modify(ctx, name, true, func(cfg *config.Config, idx int) error {
+		cfg.Tasks[idx].Paused = paused
+		return nil
+	}); err != nil {
+		return
+	}
+	return toTask(ts)
+}
+
+func (s *adminServer) GetStatus(ctx context.Context, req *admin.GetStatusRequest) (resp *admin.Status, err error) {
+	snap := s.sc.collect()
+	resp = &admin.Status{Instance: snap.Instance, Version: snap.Version, ConfigVersion: snap.ConfigVersion}
+	for _, ts := range snap.Tasks {
+		resp.Tasks = append(resp.Tasks, &admin.TaskStatus{
+			Name:     ts.Name,
+			Topic:    ts.Topic,
+			Table:    ts.Table,
+			Paused:   ts.Paused,
+			Running:  ts.Running,
+			Lag:      ts.Lag,
+			Counters: ts.Counters,
+		})
+	}
+	return
+}
+
+// SeekOffsets requires the task be paused, so that its consumer group is empty once all instances apply that.
+func (s *adminServer) SeekOffsets(ctx context.Context, req *admin.SeekOffsetsRequest) (resp *admin.SeekOffsetsResponse, err error) {
+	// Use the applied config, whose Kafka settings are normallized.
+	cfg, _ := s.api.s.snapshot()
+	if cfg == nil {
+		err = &apiError{http.StatusConflict, "no config is applied yet"}
+		return
+	}
+	var taskCfg *config.TaskConfig
+	for _, tc := range cfg.Tasks {
+		if tc.Name == req.Name {
+			taskCfg = tc
+		}
+	}
+	if taskCfg == nil {
+		err = &apiError{http.StatusNotFound, "task not found"}
+		return
+	}
+	if !taskCfg.Paused {
+		err = &apiError{http.StatusConflict, "pause the task and wait for instances to apply that before seeking"}
+		return
+	}
+	at := int64(input.SeekNone)
+	switch target := req.Target.(type) {
+	case *admin.SeekOffsetsRequest_Earliest:
+		if target.Earliest {
+			at = sarama.OffsetOldest
+		}
+	case *admin.SeekOffsetsRequest_Latest:
+		if target.Latest {
+			at = sarama.OffsetNewest
+		}
+	case *admin.SeekOffsetsRequest_TimestampMs:
+		if target.TimestampMs < 0 {
+			err = &apiError{http.StatusBadRequest, "invalid timestamp"}
+			return
+		}
+		at = target.TimestampMs
+	}
+	if at == input.SeekNone && len(req.PartitionOffsets) == 0 {
+		err = &apiError{http.StatusBadRequest, "either a target or partition offsets is required"}
+		return
+	}
+	var committed map[int32]int64
+	if committed, err = input.SeekOffsets(&cfg.Kafka, taskCfg.ConsumerGroup, taskCfg.Topic, at, req.PartitionOffsets); err != nil {
+		err = &apiError{http.StatusConflict, err.Error()}
+		return
+	}
+	util.Logger.Info("task offsets sought via API", zap.String("task", req.Name))
+	resp = &admin.SeekOffsetsResponse{Offsets: committed}
+	return
+}
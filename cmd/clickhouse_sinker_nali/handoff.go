@@ -0,0 +1,167 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/forever765/clickhouse_sinker_nali/util"
+)
+
+const (
+	apiHandoffPath = "/api/v1/handoff"
+	// handoffTimeout bounds waiting for the previous owner of a task. The task is taken over anyway after it.
+	handoffTimeout = time.Minute
+)
+
+// handoff moves a task between instances without both of them racing on the consumer group:
+//  1. The new owner asks the previous one to release the task, which makes the latter reload config at once.
+//  2. The previous owner stops fetching, flushes and commits flying batchs, and leaves the consumer group.
+//  3. The previous owner tells the new one that the task is released, and the latter starts it.
+//
+// Peers are addressed by their instance name, which is the address of the HTTP server. Handoff requires api-token, since
+// anyone able to ask for releasing a task could make the instance reload config. Without it tasks are taken over at once.
+type handoff struct {
+	s      *Sinker
+	client *http.Client
+
+	mux     sync.Mutex
+	waiting map[string]chan struct{} // tasks waiting to be released, by name
+}
+
+type handoffReply struct {
+	Released bool `json:"released"`
+}
+
+func newHandoff(s *Sinker) *handoff {
+	return &handoff{s: s, client: &http.Client{Timeout: handoffTimeout}, waiting: make(map[string]chan struct{})}
+}
+
+func (h *handoff) register(mux *http.ServeMux) {
+	mux.Handle(apiHandoffPath+"/", h)
+}
+
+// ServeHTTP serves peers:
+//
+//	POST /api/v1/handoff/release/<task>   from the new owner to the previous one
+//	POST /api/v1/handoff/released/<task>  from the previous owner to the new one
+func (h *handoff) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	auth := r.Header.Get("Authorization")
+	if cmdOps.APIToken == "" || !strings.HasPrefix(auth, "Bearer ") ||
+		subtle.ConstantTimeCompare([]byte(auth[len("Bearer "):]), []byte(cmdOps.APIToken)) != 1 {
+		http.Error(w, "invalid or missing bearer token", http.StatusUnauthorized)
+		return
+	}
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, apiHandoffPath), "/"), "/")
+	if r.Method != http.MethodPost || len(parts) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+	var reply handoffReply
+	switch parts[0] {
+	case "release":
+		if reply.Released = !h.s.runningTasks()[parts[1]]; !reply.Released {
+			// The task is stopped once the new assignment is applied.
+			util.Logger.Info("another instance is taking over a task", zap.String("task", parts[1]), zap.String("by", r.RemoteAddr))
+			h.s.reload()
+		}
+	case "released":
+		h.mux.Lock()
+		if ch, ok := h.waiting[parts[1]]; ok {
+			close(ch)
+			delete(h.waiting, parts[1])
+		}
+		h.mux.Unlock()
+		reply.Released = true
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(reply)
+}
+
+func (h *handoff) post(instance, action, taskName string) (reply handoffReply, err error) {
+	var req *http.Request
+	u := fmt.Sprintf("http://%s%s/%s/%s", instance, apiHandoffPath, action, url.PathEscape(taskName))
+	if req, err = http.NewRequest(http.MethodPost, u, nil); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	req.Header.Set("Authorization", "Bearer "+cmdOps.APIToken)
+	var resp *http.Response
+	if resp, err = h.client.Do(req); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		err = errors.Errorf("%s replied %s", u, resp.Status)
+		return
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		err = errors.Wrapf(err, "")
+	}
+	return
+}
+
+// await starts a task newly assigned to this instance once prevOwner releases it.
+func (h *handoff) await(prevOwner, taskName string) {
+	if cmdOps.APIToken == "" {
+		// the caller holds the lock of the sinker
+		go h.s.startHandedOff(taskName)
+		return
+	}
+	h.mux.Lock()
+	if _, ok := h.waiting[taskName]; ok {
+		h.mux.Unlock()
+		return
+	}
+	ch := make(chan struct{})
+	h.waiting[taskName] = ch
+	h.mux.Unlock()
+	go func() {
+		defer func() {
+			h.mux.Lock()
+			if h.waiting[taskName] == ch {
+				delete(h.waiting, taskName)
+			}
+			h.mux.Unlock()
+		}()
+		reply, err := h.post(prevOwner, "release", taskName)
+		if err != nil {
+			util.Logger.Warn("failed to ask the previous owner to release a task, take it over at once",
+				zap.String("task", taskName), zap.String("owner", prevOwner), zap.Error(err))
+		} else if !reply.Released {
+			util.Logger.Info("waiting for the previous owner to release a task", zap.String("task", taskName), zap.String("owner", prevOwner))
+			select {
+			case <-ch:
+			case <-time.After(handoffTimeout):
+				util.Logger.Warn("the previous owner didn't release a task in time, take it over anyway",
+					zap.String("task", taskName), zap.String("owner", prevOwner))
+			case <-h.s.ctx.Done():
+				return
+			}
+		}
+		h.s.startHandedOff(taskName)
+	}()
+}
+
+// notify tells the new owner of a task that this instance has released it.
+func (h *handoff) notify(newOwner, taskName string) {
+	if cmdOps.APIToken == "" {
+		return
+	}
+	if _, err := h.post(newOwner, "released", taskName); err != nil {
+		util.Logger.Warn("failed to tell the new owner that a task is released", zap.String("task", taskName),
+			zap.String("owner", newOwner), zap.Error(err))
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/forever765/clickhouse_sinker_nali/config"
+	"github.com/forever765/clickhouse_sinker_nali/statistics"
+	"github.com/forever765/clickhouse_sinker_nali/util"
+)
+
+const maxConfigVersions = 100
+
+// configVersion is a config applied by this instance.
+type configVersion struct {
+	Version   int64           `json:"version"`
+	AppliedAt time.Time       `json:"appliedAt"`
+	Config    json.RawMessage `json:"config,omitempty"`
+}
+
+// configHistory numbers applied configs with increasing versions, and keeps the latest ones for rolling back.
+// Versions are persistent across restarts if dir isn't empty.
+type configHistory struct {
+	dir string
+
+	mux      sync.Mutex
+	versions []*configVersion // the oldest first
+	next     int64
+}
+
+func newConfigHistory(dir string) (h *configHistory) {
+	h = &configHistory{dir: dir, next: 1}
+	if dir == "" {
+		return
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		util.Logger.Warn("failed to create config history dir, keep history in memory", zap.Error(err))
+		h.dir = ""
+		return
+	}
+	names, _ := filepath.Glob(filepath.Join(dir, "config-*.json"))
+	for _, name := range names {
+		var cv configVersion
+		content, err := ioutil.ReadFile(name)
+		if err == nil {
+			err = json.Unmarshal(content, &cv)
+		}
+		if err != nil {
+			util.Logger.Warn("ignored a bad config snapshot", zap.String("file", name), zap.Error(err))
+			continue
+		}
+		h.versions = append(h.versions, &cv)
+	}
+	sort.Slice(h.versions, func(i, j int) bool { return h.versions[i].Version < h.versions[j].Version })
+	if n := len(h.versions); n != 0 {
+		h.next = h.versions[n-1].Version + 1
+		statistics.ConfigVersion.Set(float64(h.versions[n-1].Version))
+	}
+	return
+}
+
+// record assigns a new version to cfg if it differs from the current one, and returns it with the content of the
+// previous version if any. version is 0 if cfg isn't new. The assignment isn't a part of versions.
+func (h *configHistory) record(cfg *config.Config) (version int64, prev []byte) {
+	snap := *cfg
+	snap.Assignment = config.Assignment{}
+	snap.Flatten()
+	content, err := json.Marshal(&snap)
+	if err != nil {
+		util.Logger.Error("failed to marshal config", zap.Error(err))
+		return
+	}
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	if n := len(h.versions); n != 0 {
+		if bytes.Equal(h.versions[n-1].Config, content) {
+			return
+		}
+		prev = h.versions[n-1].Config
+	}
+	cv := &configVersion{Version: h.next, AppliedAt: time.Now(), Config: content}
+	h.next++
+	h.versions = append(h.versions, cv)
+	if len(h.versions) > maxConfigVersions {
+		h.remove(h.versions[0])
+		h.versions = h.versions[1:]
+	}
+	version = cv.Version
+	statistics.ConfigVersion.Set(float64(cv.Version))
+	util.Logger.Info("applied config version", zap.Int64("version", cv.Version))
+	if h.dir != "" {
+		if content, err = json.Marshal(cv); err == nil {
+			err = ioutil.WriteFile(h.file(cv.Version), content, 0644)
+		}
+		if err != nil {
+			util.Logger.Warn("failed to save config snapshot", zap.Int64("version", cv.Version), zap.Error(err))
+		}
+	}
+	return
+}
+
+func (h *configHistory) file(version int64) string {
+	return filepath.Join(h.dir, fmt.Sprintf("config-%d.json", version))
+}
+
+func (h *configHistory) remove(cv *configVersion) {
+	if h.dir != "" {
+		if err := os.Remove(h.file(cv.Version)); err != nil && !os.IsNotExist(err) {
+			util.Logger.Warn("failed to remove config snapshot", zap.Int64("version", cv.Version), zap.Error(err))
+		}
+	}
+}
+
+// current returns the current version, 0 means none.
+func (h *configHistory) current() int64 {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	if n := len(h.versions); n != 0 {
+		return h.versions[n-1].Version
+	}
+	return 0
+}
+
+// list returns kept versions without content, the latest first.
+func (h *configHistory) list() (versions []configVersion) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	versions = make([]configVersion, 0, len(h.versions))
+	for i := len(h.versions) - 1; i >= 0; i-- {
+		versions = append(versions, configVersion{Version: h.versions[i].Version, AppliedAt: h.versions[i].AppliedAt})
+	}
+	return
+}
+
+// get returns the config of a version, nil if it isn't kept.
+func (h *configHistory) get(version int64) (cfg *config.Config, err error) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	for _, cv := range h.versions {
+		if cv.Version == version {
+			cfg = &config.Config{}
+			if err = json.Unmarshal(cv.Config, cfg); err != nil {
+				err = errors.Wrapf(err, "")
+			}
+			return
+		}
+	}
+	return
+}
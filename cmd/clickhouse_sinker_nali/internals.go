@@ -0,0 +1,69 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+
+	"github.com/forever765/clickhouse_sinker_nali/task"
+	"github.com/forever765/clickhouse_sinker_nali/util"
+)
+
+// Client libraries whose versions are shown in internals.
+var clientModules = map[string]string{
+	"github.com/Shopify/sarama":           "sarama",
+	"github.com/segmentio/kafka-go":       "kafka-go",
+	"github.com/ClickHouse/clickhouse-go": "clickhouse-go",
+}
+
+// internals is published as expvar "sinker", for quick inspection without attaching gops.
+type internals struct {
+	Pools   map[string]poolInternal   `json:"pools"`
+	Tasks   map[string]task.Internals `json:"tasks"`
+	Clients map[string]string         `json:"clients"` // versions of the runtime, client libraries and the Kafka protocol
+}
+
+type poolInternal struct {
+	MaxWorkers int `json:"maxWorkers"`
+	Backlog    int `json:"backlog"` // functions queued or running
+}
+
+func (s *Sinker) registerInternals(mux *http.ServeMux) {
+	expvar.Publish("sinker", expvar.Func(func() interface{} { return s.internals() }))
+	mux.Handle("/debug/vars", expvar.Handler())
+}
+
+func (s *Sinker) internals() (in internals) {
+	in.Pools = make(map[string]poolInternal)
+	for name, pool := range map[string]*util.WorkerPool{"parsing": util.GlobalParsingPool, "writing": util.GlobalWritingPool} {
+		if pool != nil {
+			in.Pools[name] = poolInternal{MaxWorkers: pool.MaxWorkers(), Backlog: pool.Backlog()}
+		}
+	}
+
+	s.mux.Lock()
+	tasks := make(map[string]*task.Service, len(s.tasks))
+	for name, tsk := range s.tasks {
+		tasks[name] = tsk
+	}
+	cfg := s.curCfg
+	s.mux.Unlock()
+	in.Tasks = make(map[string]task.Internals, len(tasks))
+	for name, tsk := range tasks {
+		in.Tasks[name] = tsk.Internals()
+	}
+
+	in.Clients = map[string]string{"go": runtime.Version()}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, dep := range bi.Deps {
+			if name, ok := clientModules[dep.Path]; ok {
+				in.Clients[name] = dep.Version
+			}
+		}
+	}
+	if cfg != nil {
+		in.Clients["kafkaProtocol"] = cfg.Kafka.Version
+	}
+	return
+}
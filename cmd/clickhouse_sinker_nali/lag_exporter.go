@@ -0,0 +1,78 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+
+	cm "github.com/forever765/clickhouse_sinker_nali/config_manager"
+	"github.com/forever765/clickhouse_sinker_nali/statistics"
+	"github.com/forever765/clickhouse_sinker_nali/util"
+)
+
+// lagHistorySize is the number of newest offsets kept per partition to estimate lag seconds.
+const lagHistorySize = 120
+
+// lagExporter periodically queries brokers and exports lags of tasks running on this instance, so that each partition
+// is exported by only one instance.
+type lagExporter struct {
+	s       *Sinker
+	history *cm.OffsetHistory
+}
+
+func newLagExporter(s *Sinker) *lagExporter {
+	return &lagExporter{s: s, history: cm.NewOffsetHistory(lagHistorySize)}
+}
+
+func (e *lagExporter) run(interval time.Duration) {
+	for {
+		e.export()
+		select {
+		case <-e.s.ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+func (e *lagExporter) export() {
+	cfg, running := e.s.snapshot()
+	if cfg == nil {
+		return
+	}
+	lagCfg := *cfg
+	lagCfg.Tasks = nil
+	for _, taskCfg := range cfg.Tasks {
+		if running[taskCfg.Name] {
+			lagCfg.Tasks = append(lagCfg.Tasks, taskCfg)
+		}
+	}
+	statistics.ConsumerLag.Reset()
+	statistics.ConsumerLagSeconds.Reset()
+	if len(lagCfg.Tasks) == 0 {
+		return
+	}
+	now := time.Now()
+	lags, err := cm.GetPartitionLags(&lagCfg)
+	if err != nil {
+		util.Logger.Warn("failed to get lags of tasks", zap.Error(err))
+		return
+	}
+	for _, pl := range lags {
+		e.history.Add(pl.Topic, pl.Partition, now, pl.Newest)
+	}
+	for _, pl := range lags {
+		partition := strconv.Itoa(int(pl.Partition))
+		statistics.ConsumerLag.WithLabelValues(pl.Task, pl.Topic, partition).Set(float64(pl.Lag))
+		statistics.ConsumerLagSeconds.WithLabelValues(pl.Task, pl.Topic, partition).Set(e.lagSeconds(pl, now))
+	}
+	e.history.Sweep(now)
+}
+
+func (e *lagExporter) lagSeconds(pl cm.PartitionLag, now time.Time) float64 {
+	if pl.Lag == 0 {
+		return 0
+	}
+	return e.history.LagSeconds(pl.Topic, pl.Partition, pl.Committed, now)
+}
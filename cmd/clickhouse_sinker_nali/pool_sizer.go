@@ -0,0 +1,36 @@
+package main
+
+import (
+	"time"
+
+	"github.com/forever765/clickhouse_sinker_nali/statistics"
+	"github.com/forever765/clickhouse_sinker_nali/tenant"
+	"github.com/forever765/clickhouse_sinker_nali/util"
+)
+
+const poolResizeInterval = 10 * time.Second
+
+// resizePools resizes the parsing pool within config.ParsingPool, and keeps tenant quotas in proportion to it.
+func (s *Sinker) resizePools() {
+	var sizer *util.PoolSizer
+	for {
+		if cfg, _ := s.snapshot(); cfg != nil && util.GlobalParsingPool != nil {
+			if sizer == nil {
+				sizer = util.NewPoolSizer("parsing", util.GlobalParsingPool)
+			}
+			prev := util.GlobalParsingPool.MaxWorkers()
+			if workers := sizer.Adjust(cfg.ParsingPool.MinWorkers, cfg.ParsingPool.MaxWorkers, util.DefaultParsingWorkers()); workers != prev {
+				tenant.Apply(cfg.Tenants, workers)
+			}
+			statistics.PoolWorkers.WithLabelValues("parsing").Set(float64(util.GlobalParsingPool.MaxWorkers()))
+			if util.GlobalWritingPool != nil {
+				statistics.PoolWorkers.WithLabelValues("writing").Set(float64(util.GlobalWritingPool.MaxWorkers()))
+			}
+		}
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-time.After(poolResizeInterval):
+		}
+	}
+}
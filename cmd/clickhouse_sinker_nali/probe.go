@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// States of a task reported by /healthz and /readyz.
+const (
+	taskConsuming             = "consuming"
+	taskLagging               = "lagging"
+	taskClickHouseUnreachable = "clickhouse_unreachable"
+	taskPaused                = "paused"
+	taskUnassigned            = "unassigned" // runs on another instance
+)
+
+type probeReport struct {
+	Status string       `json:"status"` // "ok" or "fail"
+	Reason string       `json:"reason,omitempty"`
+	Tasks  []taskHealth `json:"tasks"`
+}
+
+type taskHealth struct {
+	Name        string     `json:"name"`
+	State       string     `json:"state"`
+	Lag         int64      `json:"lag"` // -1 means unknown
+	Error       string     `json:"error,omitempty"`
+	FailingFrom *time.Time `json:"failingFrom,omitempty"`
+}
+
+// probe serves /healthz for liveness and /readyz for readiness with the state of each task. Liveness doesn't depend
+// on ClickHouse or Kafka, so that their outage doesn't restart sinker.
+type probe struct {
+	s      *Sinker
+	sc     *statusCollector
+	maxLag int64 // a running task lagging behind more than it fails readiness, 0 means lag is ignored
+}
+
+func newProbe(s *Sinker, sc *statusCollector, maxLag int64) *probe {
+	return &probe{s: s, sc: sc, maxLag: maxLag}
+}
+
+func (p *probe) register(mux *http.ServeMux) {
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		p.serve(w, p.report(), false)
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		p.serve(w, p.report(), true)
+	})
+}
+
+func (p *probe) serve(w http.ResponseWriter, rep probeReport, readiness bool) {
+	if !readiness {
+		rep.Status, rep.Reason = "ok", ""
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if rep.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_ = json.NewEncoder(w).Encode(rep)
+}
+
+// report tells the state of each task, and fails if any running task is unhealthy or no config is applied yet.
+func (p *probe) report() (rep probeReport) {
+	rep = probeReport{Status: "ok", Tasks: []taskHealth{}}
+	cfg, running := p.s.snapshot()
+	if cfg == nil {
+		rep.Status, rep.Reason = "fail", "config is not applied yet"
+		return
+	}
+	lags := p.sc.taskLags(cfg, running)
+	failures := p.s.writeFailures()
+	for _, taskCfg := range cfg.Tasks {
+		th := taskHealth{Name: taskCfg.Name, State: taskConsuming, Lag: -1}
+		if lag, ok := lags[taskCfg.Name]; ok && running[taskCfg.Name] {
+			th.Lag = lag
+		}
+		switch {
+		case taskCfg.Paused:
+			th.State = taskPaused
+		case !running[taskCfg.Name]:
+			th.State = taskUnassigned
+		case failures[taskCfg.Name].err != nil:
+			wf := failures[taskCfg.Name]
+			th.State = taskClickHouseUnreachable
+			th.Error = wf.err.Error()
+			th.FailingFrom = &wf.since
+		case p.maxLag > 0 && th.Lag > p.maxLag:
+			th.State = taskLagging
+		}
+		if th.State == taskClickHouseUnreachable || th.State == taskLagging {
+			rep.Status, rep.Reason = "fail", "some tasks are unhealthy"
+		}
+		rep.Tasks = append(rep.Tasks, th)
+	}
+	sort.Slice(rep.Tasks, func(i, j int) bool { return rep.Tasks[i].Name < rep.Tasks[j].Name })
+	return
+}
+
+type writeFailure struct {
+	since time.Time
+	err   error
+}
+
+// writeFailures returns tasks whose writes to ClickHouse are failing.
+func (s *Sinker) writeFailures() (failures map[string]writeFailure) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	failures = make(map[string]writeFailure)
+	for name, service := range s.tasks {
+		if since, err := service.WriteErr(); err != nil {
+			failures[name] = writeFailure{since: since, err: err}
+		}
+	}
+	return
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"go.uber.org/zap"
+
+	"github.com/forever765/clickhouse_sinker_nali/config"
+	cm "github.com/forever765/clickhouse_sinker_nali/config_manager"
+	"github.com/forever765/clickhouse_sinker_nali/util"
+)
+
+// Querying lags is costly, so it's done in background at most once per lagRefreshInterval.
+const lagRefreshInterval = 30 * time.Second
+
+//go:embed ui/index.html
+var uiIndex []byte
+
+// Counters shown per task, keyed by the metric name.
+var statusCounters = map[string]string{
+	"clickhouse_sinker_consume_msgs_total":     "consumed",
+	"clickhouse_sinker_flush_msgs_total":       "flushed",
+	"clickhouse_sinker_parse_msgs_error_total": "parseErrors",
+	"clickhouse_sinker_flush_msgs_error_total": "flushErrors",
+}
+
+// statusSnapshot is served at /api/v1/status for the web UI and tools.
+type statusSnapshot struct {
+	Instance      string            `json:"instance"`
+	Version       string            `json:"version"`
+	ConfigVersion int64             `json:"configVersion"`
+	Time          time.Time         `json:"time"`
+	Tasks         []taskSnapshot    `json:"tasks"`
+	RecentErrors  []util.ErrorEvent `json:"recentErrors"`
+}
+
+type taskSnapshot struct {
+	Name     string             `json:"name"`
+	Topic    string             `json:"topic"`
+	Table    string             `json:"table"`
+	Paused   bool               `json:"paused"`
+	Running  bool               `json:"running"`
+	Lag      int64              `json:"lag"` // -1 means unknown
+	Counters map[string]float64 `json:"counters"`
+	// ColumnErrors sums counters labelled with a column, such as parse failures of each column.
+	ColumnErrors map[string]float64 `json:"columnErrors,omitempty"`
+}
+
+type statusCollector struct {
+	s *Sinker
+
+	mux        sync.Mutex // protect following
+	lags       map[string]int64
+	lagsAt     time.Time
+	refreshing bool
+}
+
+func newStatusCollector(s *Sinker) *statusCollector {
+	return &statusCollector{s: s}
+}
+
+func (sc *statusCollector) register(mux *http.ServeMux) {
+	mux.HandleFunc("/api/v1/status", sc.statusEndpoint)
+	mux.HandleFunc("/ui/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = w.Write(uiIndex)
+	})
+}
+
+func (sc *statusCollector) statusEndpoint(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(sc.collect())
+}
+
+func (sc *statusCollector) collect() (snap statusSnapshot) {
+	snap = statusSnapshot{Instance: httpAddr, Version: getVersion(), ConfigVersion: sc.s.history.current(), Time: time.Now(), Tasks: []taskSnapshot{}}
+	cfg, running := sc.s.snapshot()
+	counters, columnErrors := gatherTaskCounters()
+	var lags map[string]int64
+	if cfg != nil {
+		lags = sc.taskLags(cfg, running)
+		for _, taskCfg := range cfg.Tasks {
+			ts := taskSnapshot{
+				Name:         taskCfg.Name,
+				Topic:        taskCfg.Topic,
+				Table:        taskCfg.TableName,
+				Paused:       taskCfg.Paused,
+				Running:      running[taskCfg.Name],
+				Lag:          -1,
+				Counters:     counters[taskCfg.Name],
+				ColumnErrors: columnErrors[taskCfg.Name],
+			}
+			if lag, ok := lags[taskCfg.Name]; ok && ts.Running {
+				ts.Lag = lag
+			}
+			if ts.Counters == nil {
+				ts.Counters = map[string]float64{}
+			}
+			snap.Tasks = append(snap.Tasks, ts)
+		}
+	}
+	sort.Slice(snap.Tasks, func(i, j int) bool { return snap.Tasks[i].Name < snap.Tasks[j].Name })
+	snap.RecentErrors = util.RecentErrors()
+	return
+}
+
+// taskLags returns the cached lags of running tasks, and refreshes them in background if stale.
+func (sc *statusCollector) taskLags(cfg *config.Config, running map[string]bool) map[string]int64 {
+	sc.mux.Lock()
+	defer sc.mux.Unlock()
+	if sc.refreshing || time.Since(sc.lagsAt) < lagRefreshInterval || len(running) == 0 {
+		return sc.lags
+	}
+	lagCfg := *cfg
+	lagCfg.Tasks = nil
+	for _, taskCfg := range cfg.Tasks {
+		if running[taskCfg.Name] {
+			lagCfg.Tasks = append(lagCfg.Tasks, taskCfg)
+		}
+	}
+	sc.refreshing = true
+	go func() {
+		lags, err := cm.GetTaskLags(&lagCfg)
+		if err != nil {
+			util.Logger.Warn("failed to get lags of tasks", zap.Error(err))
+		}
+		sc.mux.Lock()
+		defer sc.mux.Unlock()
+		if err == nil {
+			sc.lags = lags
+		}
+		sc.lagsAt = time.Now()
+		sc.refreshing = false
+	}()
+	return sc.lags
+}
+
+// gatherTaskCounters sums counters of each task from the default registry.
+func gatherTaskCounters() (counters, columnErrors map[string]map[string]float64) {
+	counters = make(map[string]map[string]float64)
+	columnErrors = make(map[string]map[string]float64)
+	mfs, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		util.Logger.Warn("failed to gather metrics", zap.Error(err))
+	}
+	for _, mf := range mfs {
+		if mf.GetType() != dto.MetricType_COUNTER {
+			continue
+		}
+		key, known := statusCounters[mf.GetName()]
+		for _, m := range mf.GetMetric() {
+			var taskName, column string
+			for _, lp := range m.GetLabel() {
+				switch lp.GetName() {
+				case "task":
+					taskName = lp.GetValue()
+				case "column":
+					column = lp.GetValue()
+				}
+			}
+			if taskName == "" {
+				continue
+			}
+			val := m.GetCounter().GetValue()
+			if column != "" {
+				if columnErrors[taskName] == nil {
+					columnErrors[taskName] = make(map[string]float64)
+				}
+				columnErrors[taskName][column] += val
+			} else if known {
+				if counters[taskName] == nil {
+					counters[taskName] = make(map[string]float64)
+				}
+				counters[taskName][key] += val
+			}
+		}
+	}
+	return
+}
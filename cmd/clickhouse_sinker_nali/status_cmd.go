@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// statusRow is a task summarized by the status subcommand.
+type statusRow struct {
+	Task      string  `json:"task"`
+	State     string  `json:"state"` // running, paused or stopped
+	Lag       int64   `json:"lag"`   // -1 means unknown
+	ConsumePS float64 `json:"consumePerSecond"`
+	FlushPS   float64 `json:"flushPerSecond"`
+	Errors    float64 `json:"errors"` // parse and flush errors since the instance started
+	LastError string  `json:"lastError,omitempty"`
+}
+
+// runStatus implements `clickhouse_sinker_nali status [flags]`, and returns the exit code. It queries /api/v1/status
+// of a running instance twice, and prints tasks with their throughput in between.
+func runStatus(args []string) int {
+	fs := flag.NewFlagSet("status", flag.ContinueOnError)
+	addr := fs.String("addr", "127.0.0.1:21888", "http address of the instance, could be given as the positional argument as well")
+	interval := fs.Duration("interval", 5*time.Second, "time between the two queries to compute throughput, 0 skips throughput")
+	timeout := fs.Duration("timeout", 10*time.Second, "timeout of each query")
+	output := fs.String("output", "text", "format, text or json")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() > 0 {
+		*addr = fs.Arg(0)
+	}
+	if *output != "text" && *output != "json" {
+		fmt.Fprintf(os.Stderr, "invalid output format %s\n", *output)
+		return 2
+	}
+	url := *addr
+	if !strings.Contains(url, "://") {
+		url = "http://" + url
+	}
+	url = strings.TrimSuffix(url, "/") + "/api/v1/status"
+	client := &http.Client{Timeout: *timeout}
+
+	first, err := fetchStatus(client, url)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%+v\n", err)
+		return 1
+	}
+	last := first
+	if *interval > 0 {
+		time.Sleep(*interval)
+		if last, err = fetchStatus(client, url); err != nil {
+			fmt.Fprintf(os.Stderr, "%+v\n", err)
+			return 1
+		}
+	}
+	rows := statusRows(first, last)
+	if *output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(rows)
+		return 0
+	}
+	fmt.Printf("instance %s, config version %d, %s\n", last.Instance, last.ConfigVersion, last.Version)
+	printStatusRows(os.Stdout, rows)
+	return 0
+}
+
+func fetchStatus(client *http.Client, url string) (snap statusSnapshot, err error) {
+	var resp *http.Response
+	if resp, err = client.Get(url); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		err = errors.Errorf("%s responded %s", url, resp.Status)
+		return
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&snap); err != nil {
+		err = errors.Wrapf(err, "")
+	}
+	return
+}
+
+// statusRows summarizes tasks of last. Throughput is computed against first, and is 0 if they're the same snapshot.
+func statusRows(first, last statusSnapshot) (rows []statusRow) {
+	prev := make(map[string]map[string]float64, len(first.Tasks))
+	for _, ts := range first.Tasks {
+		prev[ts.Name] = ts.Counters
+	}
+	elapsed := last.Time.Sub(first.Time).Seconds()
+	rows = []statusRow{}
+	for _, ts := range last.Tasks {
+		row := statusRow{Task: ts.Name, State: "stopped", Lag: ts.Lag,
+			Errors: ts.Counters["parseErrors"] + ts.Counters["flushErrors"]}
+		if ts.Paused {
+			row.State = "paused"
+		} else if ts.Running {
+			row.State = "running"
+		}
+		if counters, ok := prev[ts.Name]; ok && elapsed > 0 {
+			row.ConsumePS = perSecond(ts.Counters["consumed"], counters["consumed"], elapsed)
+			row.FlushPS = perSecond(ts.Counters["flushed"], counters["flushed"], elapsed)
+		}
+		// RecentErrors is newest first.
+		for _, ev := range last.RecentErrors {
+			if fmt.Sprint(ev.Fields["task"]) == ts.Name {
+				row.LastError = fmt.Sprintf("%s %s", ev.Time.Format(time.RFC3339), ev.Message)
+				if e, ok := ev.Fields["error"]; ok {
+					row.LastError += ": " + fmt.Sprint(e)
+				}
+				break
+			}
+		}
+		rows = append(rows, row)
+	}
+	return
+}
+
+// perSecond is 0 if the counter was reset in between, e.g. the task restarted.
+func perSecond(cur, prev, seconds float64) float64 {
+	if cur < prev {
+		return 0
+	}
+	return (cur - prev) / seconds
+}
+
+func printStatusRows(w io.Writer, rows []statusRow) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "TASK\tSTATE\tLAG\tCONSUME/S\tFLUSH/S\tERRORS\tLAST ERROR")
+	for _, row := range rows {
+		lag := "-"
+		if row.Lag >= 0 {
+			lag = fmt.Sprint(row.Lag)
+		}
+		lastError := strings.Join(strings.Fields(row.LastError), " ")
+		if len(lastError) > 120 {
+			lastError = lastError[:117] + "..."
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%.1f\t%.1f\t%.0f\t%s\n", row.Task, row.State, lag, row.ConsumePS, row.FlushPS, row.Errors, lastError)
+	}
+	_ = tw.Flush()
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/forever765/clickhouse_sinker_nali/util"
+)
+
+// notifySupervisor tells systemd that the sinker is ready once the first config is applied and its tasks are
+// consuming, rather than at exec. With WatchdogSec, it keeps sending keep-alives as long as the main loop isn't stuck.
+func (s *Sinker) notifySupervisor() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for ready := false; !ready; {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		cfg, running := s.snapshot()
+		if ready = cfg != nil; ready {
+			if err := util.SdNotify(fmt.Sprintf("READY=1\nSTATUS=running %d tasks", len(running))); err != nil {
+				util.Logger.Warn("util.SdNotify failed", zap.Error(err))
+			}
+		}
+	}
+	interval := util.SdWatchdogInterval()
+	if interval == 0 {
+		return
+	}
+	watchdog := time.NewTicker(interval)
+	defer watchdog.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-watchdog.C:
+		}
+		// snapshot blocks if the main loop holds the lock forever, then systemd restarts the process
+		_, running := s.snapshot()
+		if err := util.SdNotify(fmt.Sprintf("WATCHDOG=1\nSTATUS=running %d tasks", len(running))); err != nil {
+			util.Logger.Warn("util.SdNotify failed", zap.Error(err))
+		}
+	}
+}
+
+// runService implements `clickhouse_sinker_nali service install|uninstall [flags]`, and returns the exit code. It
+// registers the executable as a Windows service, which runs with the flags following install.
+func runService(args []string) int {
+	fs := flag.NewFlagSet("service", flag.ContinueOnError)
+	name := fs.String("name", "clickhouse_sinker_nali", "name of the Windows service")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s service [-name <name>] install [flags of the sinker] | uninstall\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil || fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+	var err error
+	switch fs.Arg(0) {
+	case "install":
+		var exe string
+		if exe, err = os.Executable(); err == nil {
+			err = util.InstallService(*name, exe, fs.Args()[1:])
+		}
+	case "uninstall":
+		err = util.UninstallService(*name)
+	default:
+		fs.Usage()
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%+v\n", err)
+		return 1
+	}
+	fmt.Printf("%sed service %s\n", fs.Arg(0), *name)
+	return 0
+}
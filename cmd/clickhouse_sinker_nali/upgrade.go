@@ -0,0 +1,70 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/forever765/clickhouse_sinker_nali/config"
+)
+
+// runConfig implements `clickhouse_sinker_nali config <command>`, and returns the exit code.
+func runConfig(args []string) int {
+	if len(args) == 0 || args[0] != "upgrade" {
+		fmt.Fprintf(os.Stderr, "usage: %s config upgrade [flags] <config file>\n", os.Args[0])
+		return 2
+	}
+	return runUpgrade(args[1:])
+}
+
+// runUpgrade rewrites a config of older releases or housepower/clickhouse_sinker into the current schema. Notes go to
+// stderr, so that stdout is the upgraded config unless --output is given.
+func runUpgrade(args []string) int {
+	fs := flag.NewFlagSet("config upgrade", flag.ContinueOnError)
+	output := fs.String("output", "", "file to write the upgraded config, default to stdout")
+	inPlace := fs.Bool("in-place", false, "overwrite the config file")
+	strict := fs.Bool("strict", false, "fail if any option is unsupported")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "expect exactly one config file")
+		return 2
+	}
+	cfgFile := fs.Arg(0)
+	if *inPlace {
+		*output = cfgFile
+	}
+	content, err := ioutil.ReadFile(cfgFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	upgraded, notes, err := config.Upgrade(content)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %+v\n", cfgFile, err)
+		return 1
+	}
+	var unsupported int
+	for _, n := range notes {
+		fmt.Fprintln(os.Stderr, n)
+		if n.Unsupported {
+			unsupported++
+		}
+	}
+	if unsupported != 0 && *strict {
+		fmt.Fprintf(os.Stderr, "%d options are unsupported, nothing is written\n", unsupported)
+		return 1
+	}
+	upgraded = append(upgraded, '\n')
+	if *output == "" {
+		_, _ = os.Stdout.Write(upgraded)
+		return 0
+	}
+	if err = ioutil.WriteFile(*output, upgraded, 0644); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/robfig/cron/v3"
+
+	"github.com/forever765/clickhouse_sinker_nali/aggregate"
+	"github.com/forever765/clickhouse_sinker_nali/config"
+	"github.com/forever765/clickhouse_sinker_nali/enrich"
+	"github.com/forever765/clickhouse_sinker_nali/filter"
+	"github.com/forever765/clickhouse_sinker_nali/ipHandle/cidr"
+	"github.com/forever765/clickhouse_sinker_nali/model"
+	"github.com/forever765/clickhouse_sinker_nali/parser"
+	"github.com/forever765/clickhouse_sinker_nali/pool"
+	"github.com/forever765/clickhouse_sinker_nali/privacy"
+	"github.com/forever765/clickhouse_sinker_nali/script"
+	"github.com/forever765/clickhouse_sinker_nali/task"
+	"github.com/forever765/clickhouse_sinker_nali/util"
+)
+
+const describeTableSQL = `select name, type, default_kind from system.columns where database = '%s' and table = '%s'`
+
+// validateIssue is a problem found by the validate subcommand.
+type validateIssue struct {
+	Task    string `json:"task,omitempty"`
+	Check   string `json:"check"`
+	Field   string `json:"field,omitempty"`
+	Message string `json:"message"`
+}
+
+type validateReport struct {
+	Valid  bool            `json:"valid"`
+	Errors []validateIssue `json:"errors"`
+}
+
+// tableColumn is a column of a live table.
+type tableColumn struct {
+	Type        string // with LowCardinality stripped
+	DefaultKind string
+}
+
+type validator struct {
+	checkClickHouse bool
+	conn            *sql.DB
+	issues          []validateIssue
+}
+
+// runValidate implements `clickhouse_sinker_nali validate [flags] [config file]`, and returns the exit code.
+// It checks a config file offline, and optionally against live ClickHouse tables. Nothing is consumed or written.
+func runValidate(args []string) int {
+	fs := flag.NewFlagSet("validate", flag.ContinueOnError)
+	cfgFile := fs.String("local-cfg-file", "/etc/clickhouse_sinker_nali.json", "config file to validate, could be given as the positional argument as well")
+	checkClickHouse := fs.Bool("check-clickhouse", false, "connect to ClickHouse, and check tables and column mapping of tasks")
+	output := fs.String("output", "text", "report format, text or json")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() > 0 {
+		*cfgFile = fs.Arg(0)
+	}
+	if *output != "text" && *output != "json" {
+		fmt.Fprintf(os.Stderr, "invalid output format %s\n", *output)
+		return 2
+	}
+	// Keep stdout for the report.
+	util.InitLogger([]string{"stderr"})
+	util.SetLogLevel("warn")
+
+	v := &validator{checkClickHouse: *checkClickHouse}
+	v.validateFile(*cfgFile)
+	if v.conn != nil {
+		pool.FreeClusterConn()
+	}
+
+	report := validateReport{Valid: len(v.issues) == 0, Errors: v.issues}
+	if report.Errors == nil {
+		report.Errors = []validateIssue{}
+	}
+	if *output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(report)
+	} else {
+		for _, issue := range v.issues {
+			fmt.Println(issue.String())
+		}
+		if report.Valid {
+			fmt.Printf("%s is valid\n", *cfgFile)
+		}
+	}
+	if !report.Valid {
+		return 1
+	}
+	return 0
+}
+
+func (issue validateIssue) String() string {
+	var b strings.Builder
+	if issue.Task != "" {
+		fmt.Fprintf(&b, "task %s: ", issue.Task)
+	}
+	b.WriteString(issue.Check)
+	if issue.Field != "" {
+		fmt.Fprintf(&b, " %s", issue.Field)
+	}
+	fmt.Fprintf(&b, ": %s", issue.Message)
+	return b.String()
+}
+
+func (v *validator) report(taskName, check, field string, err error) {
+	v.issues = append(v.issues, validateIssue{Task: taskName, Check: check, Field: field, Message: err.Error()})
+}
+
+func (v *validator) validateFile(cfgFile string) {
+	// Included files are checked as well.
+	loader := config.LocalLoader()
+	loader.Strict = true
+	cfg, err := loader.Load(cfgFile)
+	if err != nil {
+		// Unknown fields don't stop the sinker. Go on checking the rest if that's the only problem.
+		var e error
+		if cfg, e = config.ParseLocalCfgFile(cfgFile); e != nil {
+			v.report("", "read", "", e)
+			return
+		}
+		v.report("", "schema", "", err)
+	}
+
+	// Instances of templates are checked as tasks.
+	if err = cfg.ExpandTemplates(); err != nil {
+		v.report("", "template", "TaskTemplates", err)
+	}
+
+	// Normallize the common part only. Tasks are normallized one by one, since Normallize stops at the first bad task.
+	global := *cfg
+	global.Task, global.Tasks, global.TaskTemplates = nil, nil, nil
+	if err = global.Normallize(); err != nil {
+		v.report("", "config", "", err)
+	}
+	if global.GeoipUpdate.Cron != "" {
+		if _, err = cron.ParseStandard(global.GeoipUpdate.Cron); err != nil {
+			v.report("", "cron", "GeoipUpdate.Cron", err)
+		}
+	}
+	if len(cfg.EnrichPlugins) != 0 {
+		if err = enrich.LoadPlugins(cfg.EnrichPlugins); err != nil {
+			v.report("", "plugin", "EnrichPlugins", err)
+		}
+	}
+	if v.checkClickHouse {
+		v.connect(&global.Clickhouse)
+	}
+
+	taskCfgs := cfg.Tasks
+	if cfg.Task != nil {
+		taskCfgs = append(taskCfgs, cfg.Task)
+	}
+	names := make(map[string]bool)
+	for i, taskCfg := range taskCfgs {
+		taskName := taskCfg.Name
+		if taskName == "" {
+			taskName = fmt.Sprintf("#%d", i)
+			v.report(taskName, "required", "Name", errors.Errorf("task name is required"))
+		} else if names[taskName] {
+			v.report(taskName, "duplicate", "Name", errors.Errorf("task name is used more than once"))
+		}
+		names[taskName] = true
+		v.validateTask(&global, taskCfg, taskName)
+	}
+}
+
+func (v *validator) connect(chCfg *config.ClickHouseConfig) {
+	var err error
+	if err = pool.InitClusterConn(chCfg); err != nil {
+		v.report("", "clickhouse", "Clickhouse", err)
+		return
+	}
+	if v.conn, _, err = pool.GetShardConn(0).NextGoodReplica(0); err != nil {
+		v.report("", "clickhouse", "Clickhouse", err)
+		pool.FreeClusterConn()
+		v.conn = nil
+	}
+}
+
+func (v *validator) validateTask(cfg *config.Config, orig *config.TaskConfig, taskName string) {
+	var err error
+	if orig.AutoUpdateGeoIPDB != "" {
+		if _, err = cron.ParseStandard(orig.AutoUpdateGeoIPDB); err != nil {
+			v.report(taskName, "cron", "AutoUpdateGeoIPDB", err)
+		}
+	}
+	for _, req := range []struct{ field, val string }{
+		{"Topic", orig.Topic}, {"ConsumerGroup", orig.ConsumerGroup}, {"TableName", orig.TableName},
+	} {
+		if req.val == "" {
+			v.report(taskName, "required", req.field, errors.Errorf("%s is required", req.field))
+		}
+	}
+
+	// Normallize a copy. Clear the cron spec to avoid scheduling the update job.
+	taskCfg := *orig
+	taskCfg.AutoUpdateGeoIPDB = ""
+	if err = cfg.NormallizeTask(&taskCfg); err != nil {
+		v.report(taskName, "config", "", err)
+		return
+	}
+
+	switch taskCfg.Parser {
+	case "fastjson", "gjson":
+	case "csv":
+		if len(taskCfg.CsvFormat) == 0 {
+			v.report(taskName, "parser", "CsvFormat", errors.Errorf("CsvFormat is required by parser csv"))
+		}
+	default:
+		v.report(taskName, "parser", "Parser", errors.Errorf("unknown parser %s", taskCfg.Parser))
+	}
+	if _, err = parser.NewParserPool(taskCfg.Parser, taskCfg.CsvFormat, taskCfg.Delimiter, taskCfg.TimeZone, taskCfg.TimeUnit); err != nil {
+		v.report(taskName, "parser", "TimeZone", err)
+	}
+	if taskCfg.TimeUnit < 0 {
+		v.report(taskName, "parser", "TimeUnit", errors.Errorf("TimeUnit shall be positive"))
+	}
+
+	var dims []*model.ColumnWithType
+	if !taskCfg.AutoSchema {
+		if len(taskCfg.Dims) == 0 {
+			v.report(taskName, "schema", "Dims", errors.Errorf("Dims is required unless AutoSchema is true"))
+		}
+		for i, dim := range taskCfg.Dims {
+			tp, nullable, ok := model.TryWhichType(stripLowCardinality(dim.Type))
+			if !ok {
+				v.report(taskName, "schema", fmt.Sprintf("Dims[%d].Type", i), errors.Errorf("unsupported type %s", dim.Type))
+			}
+			dims = append(dims, &model.ColumnWithType{Name: dim.Name, Type: tp, Nullable: nullable, SourceName: dim.SourceName})
+		}
+	}
+
+	for i, step := range taskCfg.Enrichments {
+		if !util.StringContains(enrich.Types(), step.Type) {
+			v.report(taskName, "enrich", fmt.Sprintf("Enrichments[%d].Type", i), errors.Errorf("unknown enrichment type %s", step.Type))
+		}
+	}
+	v.validatePipeline(&taskCfg, taskName)
+	if taskCfg.Script.File != "" || taskCfg.Script.Source != "" {
+		var t *script.Transformer
+		if t, err = script.NewTransformer(&taskCfg.Script); err != nil {
+			v.report(taskName, "script", "Script", err)
+		} else {
+			t.Close()
+		}
+	}
+	if taskCfg.Filter != "" {
+		if _, err = filter.Compile(taskCfg.Filter); err != nil {
+			v.report(taskName, "filter", "Filter", err)
+		}
+	}
+	// Columns of AutoSchema are checked when the task starts.
+	if !taskCfg.AutoSchema && len(taskCfg.Privacy) != 0 {
+		if _, err = privacy.New(taskCfg.Privacy, dims); err != nil {
+			v.report(taskName, "privacy", "Privacy", err)
+		}
+	}
+	if !taskCfg.AutoSchema && taskCfg.Aggregate.Enable {
+		if _, err = aggregate.New(&taskCfg.Aggregate, dims); err != nil {
+			v.report(taskName, "aggregate", "Aggregate", err)
+		}
+	}
+	if taskCfg.IPZoneFile != "" {
+		if _, err = cidr.LoadFile(taskCfg.IPZoneFile); err != nil {
+			v.report(taskName, "ipzone", "IPZoneFile", err)
+		}
+	}
+
+	if v.conn != nil && taskCfg.TableName != "" {
+		var columns map[string]tableColumn
+		if columns, err = v.describeTable(cfg.Clickhouse.DB, taskCfg.TableName); err != nil {
+			v.report(taskName, "clickhouse", "TableName", err)
+		} else if taskCfg.AutoSchema {
+			dims = nil
+			for name := range columns {
+				if !util.StringContains(taskCfg.ExcludeColumns, name) && columns[name].DefaultKind != "MATERIALIZED" {
+					dims = append(dims, &model.ColumnWithType{Name: name})
+				}
+			}
+		} else {
+			v.validateColumns(&taskCfg, taskName, columns)
+		}
+	}
+
+	if taskCfg.ShardingKey != "" {
+		if dims == nil {
+			// Columns are unknown offline with AutoSchema. Check the policy only.
+			dims = []*model.ColumnWithType{{Name: taskCfg.ShardingKey}}
+		}
+		if _, err = task.NewShardingPolicy(taskCfg.ShardingKey, taskCfg.ShardingPolicy, dims, 1); err != nil {
+			v.report(taskName, "sharding", "ShardingKey", err)
+		}
+	}
+}
+
+// validatePipeline builds the enrichment pipeline to check params and data files.
+// Without ClickHouse, dict steps loading from a query are skipped.
+func (v *validator) validatePipeline(taskCfg *config.TaskConfig, taskName string) {
+	var steps []config.EnrichConfig
+	for _, step := range taskCfg.Enrichments {
+		if !util.StringContains(enrich.Types(), step.Type) {
+			continue
+		}
+		if step.Type == "dict" && step.Params["query"] != "" && v.conn == nil {
+			continue
+		}
+		steps = append(steps, step)
+	}
+	if len(steps) == 0 {
+		return
+	}
+	p, err := enrich.NewPipeline(steps)
+	if err != nil {
+		v.report(taskName, "enrich", "Enrichments", err)
+		return
+	}
+	p.Close()
+}
+
+// validateColumns checks Dims against columns of the table.
+func (v *validator) validateColumns(taskCfg *config.TaskConfig, taskName string, columns map[string]tableColumn) {
+	for i, dim := range taskCfg.Dims {
+		field := fmt.Sprintf("Dims[%d]", i)
+		col, ok := columns[dim.Name]
+		if !ok {
+			v.report(taskName, "column", field, errors.Errorf("column %s doesn't exist in table %s", dim.Name, taskCfg.TableName))
+			continue
+		}
+		if col.DefaultKind == "MATERIALIZED" || col.DefaultKind == "ALIAS" {
+			v.report(taskName, "column", field, errors.Errorf("column %s is %s, and can't be inserted", dim.Name, col.DefaultKind))
+			continue
+		}
+		cfgType, cfgNullable, ok1 := model.TryWhichType(stripLowCardinality(dim.Type))
+		tblType, tblNullable, ok2 := model.TryWhichType(col.Type)
+		if !ok2 {
+			v.report(taskName, "column", field, errors.Errorf("type %s of column %s is unsupported", col.Type, dim.Name))
+		} else if ok1 && (cfgType != tblType || cfgNullable != tblNullable) {
+			v.report(taskName, "column", field, errors.Errorf("type %s of column %s mismatches %s in table", dim.Type, dim.Name, col.Type))
+		}
+	}
+}
+
+func (v *validator) describeTable(database, table string) (columns map[string]tableColumn, err error) {
+	var rs *sql.Rows
+	if rs, err = v.conn.Query(fmt.Sprintf(describeTableSQL, database, table)); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	defer rs.Close()
+	columns = make(map[string]tableColumn)
+	var name, typ, defaultKind string
+	for rs.Next() {
+		if err = rs.Scan(&name, &typ, &defaultKind); err != nil {
+			err = errors.Wrapf(err, "")
+			return
+		}
+		columns[name] = tableColumn{Type: stripLowCardinality(typ), DefaultKind: defaultKind}
+	}
+	if err = rs.Err(); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	if len(columns) == 0 {
+		err = errors.Errorf("table %s.%s doesn't exist", database, table)
+	}
+	return
+}
+
+func stripLowCardinality(typ string) string {
+	if strings.HasPrefix(typ, "LowCardinality(") && strings.HasSuffix(typ, ")") {
+		return typ[len("LowCardinality(") : len(typ)-1]
+	}
+	return typ
+}
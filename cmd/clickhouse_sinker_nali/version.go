@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"sort"
+	"strings"
+
+	"github.com/forever765/clickhouse_sinker_nali/statistics"
+)
+
+// features lists features of the build besides detected ones, comma-separated. It's filled by
+// -ldflags '-X main.features=...'.
+var features string
+
+// detectedFeatures is appended by files built under some conditions, such as cgo.
+var detectedFeatures []string
+
+// buildInfo tells which build is running, for --version, /version and metric build_info.
+type buildInfo struct {
+	Version   string   `json:"version"`
+	Commit    string   `json:"commit"`
+	Date      string   `json:"date"`
+	BuiltBy   string   `json:"builtBy"`
+	GoVersion string   `json:"goVersion"`
+	Platform  string   `json:"platform"`
+	Features  []string `json:"features"`
+}
+
+func getBuildInfo() (bi buildInfo) {
+	bi = buildInfo{Version: version, Commit: commit, Date: date, BuiltBy: builtBy, GoVersion: runtime.Version(),
+		Platform: runtime.GOOS + "/" + runtime.GOARCH, Features: []string{}}
+	seen := make(map[string]bool)
+	for _, f := range append(strings.Split(features, ","), detectedFeatures...) {
+		if f = strings.TrimSpace(f); f != "" && !seen[f] {
+			seen[f] = true
+			bi.Features = append(bi.Features, f)
+		}
+	}
+	sort.Strings(bi.Features)
+	return
+}
+
+// registerVersion serves /version, and sets metric build_info.
+func registerVersion(mux *http.ServeMux) {
+	bi := getBuildInfo()
+	statistics.BuildInfo.WithLabelValues(bi.Version, bi.Commit, bi.Date, bi.GoVersion, strings.Join(bi.Features, ",")).Set(1)
+	mux.HandleFunc("/version", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(bi)
+	})
+}
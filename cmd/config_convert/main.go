@@ -0,0 +1,81 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/forever765/clickhouse_sinker_nali/config"
+)
+
+var (
+	output = flag.String("output", "", "file to write the converted config, default to stdout")
+	strict = flag.Bool("strict", false, "fail if any option is unsupported")
+)
+
+// flagNotes are differences of command line flags, which the config can't tell.
+var flagNotes = []string{
+	"check -local-cfg-file: it defaults to /etc/clickhouse_sinker_nali.json",
+	"check -http-port: it defaults to 21888, update scrape configs of Prometheus if they rely on the default port",
+	"check NALI_DB_HOME: env of the directory of nali databases, default to /usr/share/ch_sinker/geoip_db",
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, `Usage of %s
+    %s [flags] <config file of housepower/clickhouse_sinker>
+This util converts a config of housepower/clickhouse_sinker into the format of clickhouse_sinker_nali. Equivalent
+options are mapped, and options without an equivalent are removed. The converted config goes to stdout, and notes go
+to stderr, including a checklist of settings of this fork which need manual attention.
+`, os.Args[0], os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	cfgFile := flag.Arg(0)
+	content, err := ioutil.ReadFile(cfgFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	converted, notes, err := config.Convert(content)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %+v\n", cfgFile, err)
+		os.Exit(1)
+	}
+	// Mapped and removed options first, then the checklist.
+	var unsupported int
+	for _, n := range notes {
+		if !n.Manual {
+			fmt.Fprintln(os.Stderr, n)
+		}
+		if n.Unsupported {
+			unsupported++
+		}
+	}
+	for _, n := range notes {
+		if n.Manual {
+			fmt.Fprintln(os.Stderr, n)
+		}
+	}
+	for _, n := range flagNotes {
+		fmt.Fprintln(os.Stderr, n)
+	}
+	if unsupported != 0 && *strict {
+		fmt.Fprintf(os.Stderr, "%d options are unsupported, nothing is written\n", unsupported)
+		os.Exit(1)
+	}
+	converted = append(converted, '\n')
+	if *output == "" {
+		_, _ = os.Stdout.Write(converted)
+		return
+	}
+	if err = ioutil.WriteFile(*output, converted, 0644); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bytedance/sonic"
+	"github.com/pkg/errors"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/forever765/clickhouse_sinker_nali/model"
+)
+
+// Formats of messages
+const (
+	FormatJSON     = "json"
+	FormatAvro     = "avro"
+	FormatProtobuf = "protobuf"
+)
+
+const recordName = "Log"
+
+var invalidNameRegexp = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+// fieldKind is the type of a field in Avro and Protobuf.
+type fieldKind int
+
+const (
+	kindString fieldKind = iota
+	kindLong
+	kindDouble
+	kindTimestamp // milliseconds since epoch
+)
+
+// encodedField is a field of Avro records and Protobuf messages, whose name is sanitized since neither allows names
+// such as "@hostname".
+type encodedField struct {
+	name  string // in messages
+	field string // in Avro and Protobuf
+	kind  fieldKind
+	array bool
+}
+
+// encoder serializes messages in a format.
+type encoder struct {
+	format   string
+	fields   []encodedField
+	schemaID int32 // of the schema registry, -1 means not registered
+}
+
+// newEncoder returns an encoder of the format, whose fields are the columns in schema mode, or those of the sample
+// message otherwise. The Avro schema is registered under each subject if schemaRegistry is not empty, which gets the
+// same id for all subjects. The Avro schema or Protobuf definition is written to schemaOut if it's not empty.
+func newEncoder(format string, columns []*column, sample map[string]interface{}, schemaRegistry string, subjects []string, schemaOut string) (enc *encoder, err error) {
+	enc = &encoder{format: format, schemaID: -1}
+	switch format {
+	case FormatJSON:
+		return
+	case FormatAvro, FormatProtobuf:
+	default:
+		err = errors.Errorf("unknown format %s", format)
+		return
+	}
+	enc.fields = newEncodedFields(columns, sample)
+	var schema string
+	if format == FormatAvro {
+		schema = enc.avroSchema()
+		for _, subject := range subjects {
+			if schemaRegistry == "" {
+				break
+			}
+			if enc.schemaID, err = registerSchema(schemaRegistry, subject, schema); err != nil {
+				return
+			}
+		}
+	} else {
+		schema = enc.protoDefinition()
+	}
+	if schemaOut != "" {
+		if err = os.WriteFile(schemaOut, []byte(schema), 0644); err != nil {
+			err = errors.Wrapf(err, "")
+		}
+	}
+	return
+}
+
+func newEncodedFields(columns []*column, sample map[string]interface{}) (fields []encodedField) {
+	seen := make(map[string]bool)
+	add := func(f encodedField) {
+		if seen[f.name] {
+			return
+		}
+		seen[f.name] = true
+		f.field = invalidNameRegexp.ReplaceAllString(f.name, "_")
+		if f.field == "" || f.field[0] >= '0' && f.field[0] <= '9' {
+			f.field = "_" + f.field
+		}
+		fields = append(fields, f)
+	}
+	for _, c := range columns {
+		f := encodedField{name: c.name, array: c.array}
+		switch c.dataType {
+		case model.Int, model.IntArray:
+			f.kind = kindLong
+		case model.Float, model.FloatArray:
+			f.kind = kindDouble
+		case model.DateTime, model.DateTimeArray:
+			if c.typ != "Date" {
+				f.kind = kindTimestamp
+			}
+		}
+		add(f)
+	}
+	// fields of the template not in columns, or all fields of messages from log files
+	names := make([]string, 0, len(sample))
+	for name := range sample {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		f := encodedField{name: name}
+		v := sample[name]
+		if arr, ok := v.([]interface{}); ok {
+			f.array = true
+			if v = nil; len(arr) != 0 {
+				v = arr[0]
+			}
+		}
+		switch v.(type) {
+		case int, int64:
+			f.kind = kindLong
+		case float64:
+			f.kind = kindDouble
+		case time.Time:
+			f.kind = kindTimestamp
+		}
+		add(f)
+	}
+	return
+}
+
+func (enc *encoder) encode(msg map[string]interface{}) (b []byte, err error) {
+	switch enc.format {
+	case FormatAvro:
+		if enc.schemaID >= 0 {
+			// the wire format of Confluent: magic byte 0, and 4-byte schema id
+			b = append(b, 0, 0, 0, 0, 0)
+			binary.BigEndian.PutUint32(b[1:], uint32(enc.schemaID))
+		}
+		for _, f := range enc.fields {
+			b = enc.appendAvro(b, f, msg[f.name])
+		}
+	case FormatProtobuf:
+		for i, f := range enc.fields {
+			b = enc.appendProto(b, protowire.Number(i+1), f, msg[f.name])
+		}
+	default:
+		if b, err = sonic.Marshal(msg); err != nil {
+			err = errors.Wrapf(err, "")
+		}
+	}
+	return
+}
+
+// avroSchema returns the schema of records, whose fields are unions of null and the type.
+func (enc *encoder) avroSchema() string {
+	fields := make([]map[string]interface{}, 0, len(enc.fields))
+	for _, f := range enc.fields {
+		var typ interface{}
+		switch f.kind {
+		case kindLong:
+			typ = "long"
+		case kindDouble:
+			typ = "double"
+		case kindTimestamp:
+			typ = map[string]string{"type": "long", "logicalType": "timestamp-millis"}
+		default:
+			typ = "string"
+		}
+		if f.array {
+			typ = map[string]interface{}{"type": "array", "items": typ}
+		}
+		fields = append(fields, map[string]interface{}{"name": f.field, "type": []interface{}{"null", typ}, "default": nil})
+	}
+	b, _ := json.Marshal(map[string]interface{}{"type": "record", "name": recordName, "fields": fields})
+	return string(b)
+}
+
+func (enc *encoder) appendAvro(b []byte, f encodedField, v interface{}) []byte {
+	if v == nil {
+		return appendAvroLong(b, 0)
+	}
+	b = appendAvroLong(b, 1)
+	if !f.array {
+		return appendAvroValue(b, f.kind, v)
+	}
+	arr, _ := v.([]interface{})
+	if len(arr) != 0 {
+		b = appendAvroLong(b, int64(len(arr)))
+		for _, e := range arr {
+			b = appendAvroValue(b, f.kind, e)
+		}
+	}
+	return appendAvroLong(b, 0)
+}
+
+func appendAvroValue(b []byte, kind fieldKind, v interface{}) []byte {
+	switch kind {
+	case kindLong, kindTimestamp:
+		return appendAvroLong(b, toLong(v))
+	case kindDouble:
+		// both are little-endian
+		return protowire.AppendFixed64(b, math.Float64bits(toDouble(v)))
+	default:
+		s := toString(v)
+		return append(appendAvroLong(b, int64(len(s))), s...)
+	}
+}
+
+// appendAvroLong appends a zig-zag varint, whose encoding is the same as that of Protobuf.
+func appendAvroLong(b []byte, v int64) []byte {
+	return protowire.AppendVarint(b, protowire.EncodeZigZag(v))
+}
+
+// protoDefinition returns the .proto definition of messages, whose field numbers are in order of fields.
+func (enc *encoder) protoDefinition() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "syntax = \"proto3\";\n\nmessage %s {\n", recordName)
+	for i, f := range enc.fields {
+		typ := "string"
+		switch f.kind {
+		case kindLong:
+			typ = "int64"
+		case kindDouble:
+			typ = "double"
+		case kindTimestamp:
+			typ = "int64" // milliseconds since epoch
+		}
+		if f.array {
+			typ = "repeated " + typ
+		}
+		fmt.Fprintf(&sb, "  %s %s = %d;\n", typ, f.field, i+1)
+	}
+	sb.WriteString("}\n")
+	return sb.String()
+}
+
+func (enc *encoder) appendProto(b []byte, num protowire.Number, f encodedField, v interface{}) []byte {
+	if v == nil {
+		return b
+	}
+	if !f.array {
+		return appendProtoValue(b, num, f.kind, v)
+	}
+	arr, _ := v.([]interface{})
+	if len(arr) == 0 {
+		return b
+	}
+	if f.kind == kindString {
+		for _, e := range arr {
+			b = appendProtoValue(b, num, f.kind, e)
+		}
+		return b
+	}
+	// repeated scalars are packed in proto3
+	var packed []byte
+	for _, e := range arr {
+		if f.kind == kindDouble {
+			packed = protowire.AppendFixed64(packed, math.Float64bits(toDouble(e)))
+		} else {
+			packed = protowire.AppendVarint(packed, uint64(toLong(e)))
+		}
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, packed)
+}
+
+func appendProtoValue(b []byte, num protowire.Number, kind fieldKind, v interface{}) []byte {
+	switch kind {
+	case kindLong, kindTimestamp:
+		b = protowire.AppendTag(b, num, protowire.VarintType)
+		return protowire.AppendVarint(b, uint64(toLong(v)))
+	case kindDouble:
+		b = protowire.AppendTag(b, num, protowire.Fixed64Type)
+		return protowire.AppendFixed64(b, math.Float64bits(toDouble(v)))
+	default:
+		b = protowire.AppendTag(b, num, protowire.BytesType)
+		return protowire.AppendString(b, toString(v))
+	}
+}
+
+func toLong(v interface{}) int64 {
+	switch x := v.(type) {
+	case int:
+		return int64(x)
+	case int64:
+		return x
+	case float64:
+		return int64(x)
+	case time.Time:
+		return x.UnixNano() / int64(time.Millisecond)
+	}
+	return 0
+}
+
+func toDouble(v interface{}) float64 {
+	switch x := v.(type) {
+	case int:
+		return float64(x)
+	case int64:
+		return float64(x)
+	case float64:
+		return x
+	}
+	return 0
+}
+
+func toString(v interface{}) string {
+	switch x := v.(type) {
+	case string:
+		return x
+	case time.Time:
+		return x.Format(time.RFC3339Nano)
+	}
+	return fmt.Sprint(v)
+}
+
+// registerSchema registers the Avro schema under the subject of a Confluent schema registry, and returns its id.
+func registerSchema(registry, subject, schema string) (id int32, err error) {
+	body, _ := json.Marshal(map[string]string{"schema": schema})
+	url := fmt.Sprintf("%s/subjects/%s/versions", strings.TrimSuffix(registry, "/"), subject)
+	var resp *http.Response
+	if resp, err = http.Post(url, "application/vnd.schemaregistry.v1+json", bytes.NewReader(body)); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	defer resp.Body.Close()
+	var result struct {
+		ID      int32  `json:"id"`
+		Message string `json:"message"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		err = errors.Errorf("failed to register schema to %s: %d %s", url, resp.StatusCode, result.Message)
+		return
+	}
+	return result.ID, nil
+}
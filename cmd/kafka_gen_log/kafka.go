@@ -0,0 +1,170 @@
+package main
+
+import (
+	"flag"
+	"strconv"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/pkg/errors"
+
+	"github.com/forever765/clickhouse_sinker_nali/input"
+	"github.com/forever765/clickhouse_sinker_nali/util"
+)
+
+// kafkaOptions are the options of the producer besides brokers.
+type kafkaOptions struct {
+	TLS                   bool
+	TLSCaCertFiles        string
+	TLSClientCertFile     string
+	TLSClientKeyFile      string
+	TLSClientKeyPassword  string
+	TLSInsecureSkipVerify bool
+
+	SaslMechanism          string // empty means SASL is disabled
+	SaslUsername           string
+	SaslPassword           string
+	SaslKerberosConfigPath string
+	SaslKeyTabPath         string // GSSAPI authenticates with the keytab if given, otherwise with the password
+	SaslServiceName        string
+	SaslRealm              string
+
+	Compression string // none, gzip, snappy, lz4 or zstd
+	BatchSize   int    // bytes of a batch to trigger a flush, 0 means as soon as possible
+	Linger      time.Duration
+	Acks        string // 0, 1 or all
+
+	Partitioner string // hash, random, round-robin or manual
+	Partitions  string // picked by the manual partitioner, see parsePicker
+	KeyField    string // field whose value is the key, empty means no key
+}
+
+var kafkaOpts kafkaOptions
+
+func registerKafkaFlags() {
+	flag.BoolVar(&kafkaOpts.TLS, "tls", false, "connect to brokers over TLS")
+	flag.StringVar(&kafkaOpts.TLSCaCertFiles, "tls-ca-cert", "", "comma-separated CA cert.pem files, default to the system ones")
+	flag.StringVar(&kafkaOpts.TLSClientCertFile, "tls-client-cert", "", "client cert.pem for client authentication")
+	flag.StringVar(&kafkaOpts.TLSClientKeyFile, "tls-client-key", "", "client key.pem for client authentication")
+	flag.StringVar(&kafkaOpts.TLSClientKeyPassword, "tls-client-key-password", "", "password of an encrypted client key, \"env:NAME\" refers to an environment variable")
+	flag.BoolVar(&kafkaOpts.TLSInsecureSkipVerify, "tls-insecure-skip-verify", false, "skip verifying certs of brokers")
+	flag.StringVar(&kafkaOpts.SaslMechanism, "sasl-mechanism", "", "PLAIN, SCRAM-SHA-256, SCRAM-SHA-512 or GSSAPI, empty means SASL is disabled")
+	flag.StringVar(&kafkaOpts.SaslUsername, "sasl-username", "", "SASL username")
+	flag.StringVar(&kafkaOpts.SaslPassword, "sasl-password", "", "SASL password, \"env:NAME\" refers to an environment variable")
+	flag.StringVar(&kafkaOpts.SaslKerberosConfigPath, "sasl-kerberos-config", "/etc/krb5.conf", "krb5.conf of GSSAPI")
+	flag.StringVar(&kafkaOpts.SaslKeyTabPath, "sasl-keytab", "", "keytab of GSSAPI, empty means to authenticate with -sasl-password")
+	flag.StringVar(&kafkaOpts.SaslServiceName, "sasl-service-name", "kafka", "Kerberos service name of brokers")
+	flag.StringVar(&kafkaOpts.SaslRealm, "sasl-realm", "", "Kerberos realm of GSSAPI")
+	flag.StringVar(&kafkaOpts.Compression, "compression", "none", "compression codec, one of none, gzip, snappy, lz4 and zstd")
+	flag.IntVar(&kafkaOpts.BatchSize, "batch-size", 0, "bytes of buffered messages to trigger a flush, 0 means as soon as possible")
+	flag.DurationVar(&kafkaOpts.Linger, "linger", 0, "max time to buffer messages before a flush, 0 means as soon as possible")
+	flag.StringVar(&kafkaOpts.Acks, "acks", "1", "acks required from brokers, one of 0, 1 and all")
+	flag.StringVar(&kafkaOpts.Partitioner, "partitioner", "hash", "partitioner, one of hash, random, round-robin and manual")
+	flag.StringVar(&kafkaOpts.Partitions, "partitions", "", "partitions of the manual partitioner, such as 0,1 for round-robin or 0:9,1:1 by weights")
+	flag.StringVar(&kafkaOpts.KeyField, "key-field", "@hostname", "field whose value is the key of messages, empty means no key")
+}
+
+// newProducerConfig returns the config of the producer per kafkaOpts.
+func newProducerConfig() (config *sarama.Config, err error) {
+	config = sarama.NewConfig()
+	config.Version = sarama.V2_1_0_0
+	opts := kafkaOpts
+	switch opts.Compression {
+	case "none", "":
+		config.Producer.Compression = sarama.CompressionNone
+	case "gzip":
+		config.Producer.Compression = sarama.CompressionGZIP
+	case "snappy":
+		config.Producer.Compression = sarama.CompressionSnappy
+	case "lz4":
+		config.Producer.Compression = sarama.CompressionLZ4
+	case "zstd":
+		config.Producer.Compression = sarama.CompressionZSTD
+	default:
+		err = errors.Errorf("unknown compression codec %s", opts.Compression)
+		return
+	}
+	switch opts.Acks {
+	case "0":
+		config.Producer.RequiredAcks = sarama.NoResponse
+	case "1":
+		config.Producer.RequiredAcks = sarama.WaitForLocal
+	case "all", "-1":
+		config.Producer.RequiredAcks = sarama.WaitForAll
+	default:
+		err = errors.Errorf("invalid acks %s", opts.Acks)
+		return
+	}
+	switch opts.Partitioner {
+	case "hash":
+		config.Producer.Partitioner = sarama.NewHashPartitioner
+	case "random":
+		config.Producer.Partitioner = sarama.NewRandomPartitioner
+	case "round-robin":
+		config.Producer.Partitioner = sarama.NewRoundRobinPartitioner
+	case "manual":
+		config.Producer.Partitioner = sarama.NewManualPartitioner
+	default:
+		err = errors.Errorf("unknown partitioner %s", opts.Partitioner)
+		return
+	}
+	config.Producer.Flush.Bytes = opts.BatchSize
+	config.Producer.Flush.Frequency = opts.Linger
+	if opts.TLS {
+		config.Net.TLS.Enable = true
+		if config.Net.TLS.Config, err = util.NewTLSConfig(opts.TLSCaCertFiles, opts.TLSClientCertFile, opts.TLSClientKeyFile,
+			opts.TLSClientKeyPassword, opts.TLSInsecureSkipVerify); err != nil {
+			return
+		}
+	}
+	if opts.SaslMechanism == "" {
+		return
+	}
+	config.Net.SASL.Enable = true
+	config.Net.SASL.Version = sarama.SASLHandshakeV1
+	config.Net.SASL.Mechanism = sarama.SASLMechanism(opts.SaslMechanism)
+	config.Net.SASL.User = opts.SaslUsername
+	if config.Net.SASL.Password, err = util.ResolveSecret(opts.SaslPassword); err != nil {
+		return
+	}
+	switch config.Net.SASL.Mechanism {
+	case sarama.SASLTypePlaintext:
+	case sarama.SASLTypeSCRAMSHA256:
+		config.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient { return &input.XDGSCRAMClient{HashGeneratorFcn: input.SHA256} }
+	case sarama.SASLTypeSCRAMSHA512:
+		config.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient { return &input.XDGSCRAMClient{HashGeneratorFcn: input.SHA512} }
+	case sarama.SASLTypeGSSAPI:
+		config.Net.SASL.GSSAPI = sarama.GSSAPIConfig{
+			AuthType:           sarama.KRB5_USER_AUTH,
+			KerberosConfigPath: opts.SaslKerberosConfigPath,
+			ServiceName:        opts.SaslServiceName,
+			Username:           opts.SaslUsername,
+			Password:           config.Net.SASL.Password,
+			Realm:              opts.SaslRealm,
+		}
+		if opts.SaslKeyTabPath != "" {
+			config.Net.SASL.GSSAPI.AuthType = sarama.KRB5_KEYTAB_AUTH
+			config.Net.SASL.GSSAPI.KeyTabPath = opts.SaslKeyTabPath
+		}
+	default:
+		err = errors.Errorf("unknown SASL mechanism %s", opts.SaslMechanism)
+	}
+	return
+}
+
+// newPartitionPicker returns the picker of partitions for the manual partitioner, or nil for others.
+func newPartitionPicker() (p *picker, err error) {
+	if kafkaOpts.Partitioner != "manual" {
+		return
+	}
+	if p, err = parsePicker(kafkaOpts.Partitions); err != nil {
+		return
+	}
+	for _, item := range p.items {
+		if _, err = strconv.ParseInt(item, 10, 32); err != nil {
+			err = errors.Errorf("invalid partition %s", item)
+			return
+		}
+	}
+	return
+}
@@ -47,13 +47,14 @@ import (
 	"path/filepath"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/Shopify/sarama"
-	"github.com/bytedance/sonic"
 	"github.com/google/gops/agent"
 	"github.com/forever765/clickhouse_sinker_nali/util"
 	"github.com/pkg/errors"
@@ -65,63 +66,25 @@ var (
 	KafkaTopic     string
 	LogfileDir     string
 	LogfilePattern string
-
-	ListHostname = []string{"vm101101", "vm101102", "vm101103", "vm101104", "vm101105", "vm101106", "vm101107", "vm101108", "vm101109", "vm101110"}
-	ListIP       = []string{"192.168.101.101",
-		"192.168.101.102",
-		"192.168.101.103",
-		"192.168.101.104",
-		"192.168.101.105",
-		"192.168.101.106",
-		"192.168.101.107",
-		"192.168.101.108",
-		"192.168.101.109",
-		"192.168.101.110"}
-	ListAgent           = []string{"Mozilla/5.0(Windows NT 6.1; Win64; x64)AppleWebKit/537.36(KHTML,like Gecko)Chrome/69.0.3497.100Safari/537.36"}
-	ListAuth            = []string{"RFC1413身份"}
-	ListClientIP        = []string{"192.168.1.1", "192.168.1.2", "192.168.1.3", "192.168.1.4", "192.168.1.5"}
-	ListDeviceFamily    = []string{"Hawei", "Xiaomi", "OPPO", "Apple", "Other"}
-	ListHttpversion     = []string{"1.0", "1.1", "2.0", "3.0"}
-	ListOsFamily        = []string{"Android", "Mac OS X", "HMS"}
-	ListOsMajor         = []string{"6", "7", "8", "9", "10"}
-	ListOsMinor         = []string{"0", "1", "2", "3"}
-	ListResponse        = []string{"200", "301", "400", "404", "503"}
-	ListUserAgentFamily = []string{"Chrome", "Firefox", "AppleWebKit"}
-	ListUserAgentMajor  = []string{"75", "76", "77", "78", "79", "80", "81"}
-	ListUserAgentMinor  = []string{"0", "1", "2", "3"}
-	ListVerb            = []string{"GET", "POST", "HEAD"}
+	GopsAddr       string
+	Rate           string
+	RampUp         time.Duration
+	DDLFile        string
+	ClickHouseDSN  string
+	Table          string
+	TemplateFile   string
+	Format         string
+	SchemaRegistry string
+	SchemaOut      string
+	StateFile      string
+	Realtime       bool
+	Speedup        float64
+	Truncated      float64
+	WrongType      float64
+	Oversized      float64
+	OversizedBytes int
 )
 
-// generated by https://mholt.github.io/json-to-go/, https://transform.tools/json-to-go
-type Log struct {
-	Collectiontime  time.Time `json:"@collectiontime"`
-	Hostname        string    `json:"@hostname"`
-	IP              string    `json:"@ip"`
-	Path            string    `json:"@path"`
-	LineNo          int       `json:"@lineno"`
-	Message         string    `json:"@message"`
-	Agent           string    `json:"agent"`
-	Auth            string    `json:"auth"`
-	Bytes           int       `json:"bytes"`
-	ClientIP        string    `json:"clientIp"`
-	DeviceFamily    string    `json:"device_family"`
-	Httpversion     string    `json:"httpversion"`
-	Ident           string    `json:"ident"`
-	OsFamily        string    `json:"os_family"`
-	OsMajor         string    `json:"os_major"`
-	OsMinor         string    `json:"os_minor"`
-	Referrer        string    `json:"referrer"`
-	Request         string    `json:"request"`
-	Requesttime     int       `json:"requesttime"`
-	Response        string    `json:"response"`
-	Timestamp       time.Time `json:"timestamp"`
-	UserAgentFamily string    `json:"userAgent_family"`
-	UserAgentMajor  string    `json:"userAgent_major"`
-	UserAgentMinor  string    `json:"userAgent_minor"`
-	Verb            string    `json:"verb"`
-	Xforwardfor     string    `json:"xforwardfor"`
-}
-
 func randElement(list []string) string {
 	off := rand.Intn(len(list))
 	return list[off]
@@ -136,6 +99,16 @@ type LogGenerator struct {
 	scanner  *bufio.Scanner
 	lines    int64
 	size     int64
+	throttle *throttle
+	columns  []*column // of the target table in schema mode, nil means to generate Log
+	tmpl     *logTemplate
+	enc      *encoder
+	topics   *picker
+	parts    *picker // of the manual partitioner
+	faults   *faultInjector
+	errors   int64 // messages failed to produce
+	stateMux sync.Mutex
+	state    genState
 }
 
 func (g *LogGenerator) Stat() (l, s int64) {
@@ -229,110 +202,362 @@ func (g *LogGenerator) getLine() (fp string, lineno int, line string) {
 	}
 }
 
-func (g *LogGenerator) Run() {
-	toRound := time.Now()
-	// refers to time.Time.Truncate
-	rounded := time.Date(toRound.Year(), toRound.Month(), toRound.Day(), 0, 0, 0, 0, toRound.Location())
+// newLog fills a line of log files and values of the template into a message.
+func (g *LogGenerator) newLog(timestamp time.Time) map[string]interface{} {
+	fp, lineno, line := g.getLine()
+	row := map[string]interface{}{
+		"@collectiontime": timestamp,
+		"@path":           fp,
+		"@lineno":         lineno,
+		"@message":        line,
+		"bytes":           len(line),
+		"timestamp":       timestamp,
+	}
+	g.tmpl.fill(row, timestamp)
+	return row
+}
+
+// newRow returns random values of columns of the target table, or values of the template for fields in it.
+func (g *LogGenerator) newRow(timestamp time.Time) map[string]interface{} {
+	row := make(map[string]interface{}, len(g.columns))
+	for _, c := range g.columns {
+		row[c.name] = c.random(timestamp)
+	}
+	if g.tmpl != nil {
+		g.tmpl.fill(row, timestamp)
+	}
+	return row
+}
+
+// seek continues from the line following lineno of path, which is recorded by the state.
+func (g *LogGenerator) seek(path string, lineno int) (err error) {
+	for i, fp := range g.logfiles {
+		if fp != path {
+			continue
+		}
+		g.off = i - 1
+		if err = g.next(); err != nil {
+			return
+		}
+		for g.lineno < lineno && g.scanner.Scan() {
+			g.lineno++
+		}
+		return
+	}
+	util.Logger.Warn("log file of the state doesn't match the pattern, start from the first one", zap.String("path", path))
+	return
+}
+
+// persistState saves the position of the last message to StateFile.
+func (g *LogGenerator) persistState() {
+	if StateFile == "" {
+		return
+	}
+	g.stateMux.Lock()
+	st := g.state
+	g.stateMux.Unlock()
+	if st.Timestamp.IsZero() {
+		return
+	}
+	if err := saveState(StateFile, st); err != nil {
+		util.Logger.Error("saveState failed", zap.Error(err))
+	}
+}
+
+// simClock runs speedup times as fast as the wall clock from start.
+type simClock struct {
+	start   time.Time
+	begin   time.Time // wall clock at start
+	speedup float64
+}
+
+func (c *simClock) now() time.Time {
+	return c.start.Add(time.Duration(float64(time.Since(c.begin)) * c.speedup))
+}
+
+// Run generates messages until ctx is done, then flushes messages submitted.
+func (g *LogGenerator) Run(ctx context.Context) {
+	var day0, step0 int
+	g.stateMux.Lock()
+	last := g.state.Timestamp
+	if g.state.Base.IsZero() {
+		toRound := time.Now()
+		// refers to time.Time.Truncate
+		g.state.Base = time.Date(toRound.Year(), toRound.Month(), toRound.Day(), 0, 0, 0, 0, toRound.Location())
+	} else if !g.state.Timestamp.IsZero() {
+		day0, step0 = g.state.next()
+	}
+	rounded := g.state.Base
+	g.stateMux.Unlock()
 
 	wp := util.NewWorkerPool(10, 10000)
-	config := sarama.NewConfig()
-	config.Version = sarama.V2_1_0_0
+	config, err := newProducerConfig()
+	if err != nil {
+		util.Logger.Fatal("newProducerConfig failed", zap.Error(err))
+	}
+	if g.faults != nil && g.faults.oversized > 0 && config.Producer.MaxMessageBytes < 2*g.faults.oversizedBytes {
+		config.Producer.MaxMessageBytes = 2 * g.faults.oversizedBytes
+	}
 	w, err := sarama.NewAsyncProducer(strings.Split(KafkaBrokers, ","), config)
 	if err != nil {
 		util.Logger.Fatal("sarama.NewAsyncProducer failed", zap.Error(err))
 	}
 	defer w.Close()
+	go func() {
+		// such as oversized messages rejected by brokers
+		for range w.Errors() {
+			atomic.AddInt64(&g.errors, 1)
+		}
+	}()
+	// messages in the pool shall be sent before closing the producer
+	defer wp.StopWait()
 	chInput := w.Input()
 
-	var b []byte
-	for day := 0; ; day++ {
+	if Realtime {
+		// A clock running ahead of the wall clock continues from the last message.
+		clock := &simClock{start: time.Now(), begin: time.Now(), speedup: Speedup}
+		if last.After(clock.start) {
+			clock.start = last
+		}
+		for ctx.Err() == nil {
+			g.produce(wp, chInput, clock.now())
+		}
+		return
+	}
+	for day := day0; ; day++ {
 		tsDay := rounded.Add(time.Duration(-24*day) * time.Hour)
-		for step := 0; step < 24*60*60*1000; step++ {
-			timestamp := tsDay.Add(time.Duration(step) * time.Millisecond)
-			fp, lineno, line := g.getLine()
-			logObj := Log{
-				Collectiontime:  timestamp,
-				Hostname:        randElement(ListHostname),
-				IP:              randElement(ListIP),
-				Path:            fp,
-				LineNo:          lineno,
-				Message:         line,
-				Agent:           randElement(ListAgent),
-				Auth:            randElement(ListAuth),
-				Bytes:           len(line),
-				ClientIP:        randElement(ListClientIP),
-				DeviceFamily:    randElement(ListDeviceFamily),
-				Httpversion:     randElement(ListHttpversion),
-				Ident:           "",
-				OsFamily:        randElement(ListOsFamily),
-				OsMajor:         randElement(ListOsMajor),
-				OsMinor:         randElement(ListOsMinor),
-				Referrer:        "",
-				Request:         "",
-				Requesttime:     rand.Intn(1000),
-				Response:        randElement(ListResponse),
-				Timestamp:       timestamp,
-				UserAgentFamily: randElement(ListUserAgentFamily),
-				UserAgentMajor:  randElement(ListUserAgentMajor),
-				UserAgentMinor:  randElement(ListUserAgentMinor),
-				Verb:            randElement(ListVerb),
-				Xforwardfor:     "",
+		for step := step0; step < 24*60*60*1000; step++ {
+			if ctx.Err() != nil {
+				return
 			}
-			_ = wp.Submit(func() {
-				if b, err = sonic.Marshal(&logObj); err != nil {
-					err = errors.Wrapf(err, "")
-					util.Logger.Fatal("got error", zap.Error(err))
-				}
-				chInput <- &sarama.ProducerMessage{
-					Topic: KafkaTopic,
-					Key:   sarama.StringEncoder(logObj.Hostname),
-					Value: sarama.ByteEncoder(b),
-				}
-				atomic.AddInt64(&g.lines, int64(1))
-				atomic.AddInt64(&g.size, int64(len(b)))
-			})
+			g.produce(wp, chInput, tsDay.Add(time.Duration(step)*time.Millisecond))
 		}
+		step0 = 0
 	}
 }
 
+// produce generates a message of the timestamp and submits it to be sent.
+func (g *LogGenerator) produce(wp *util.WorkerPool, chInput chan<- *sarama.ProducerMessage, timestamp time.Time) {
+	var err error
+	g.throttle.waitMsg()
+	var obj map[string]interface{}
+	if g.columns != nil {
+		obj = g.newRow(timestamp)
+	} else {
+		obj = g.newLog(timestamp)
+	}
+	var malformed string
+	if g.faults != nil {
+		malformed = g.faults.pick()
+	}
+	var key sarama.Encoder
+	if v := obj[kafkaOpts.KeyField]; v != nil {
+		key = sarama.StringEncoder(fmt.Sprint(v))
+	}
+	var partition int32
+	if g.parts != nil {
+		p, _ := strconv.ParseInt(g.parts.pick(), 10, 32)
+		partition = int32(p)
+	}
+	if g.enc == nil {
+		subjects := make([]string, len(g.topics.items))
+		for i, topic := range g.topics.items {
+			subjects[i] = topic + "-value"
+		}
+		if g.enc, err = newEncoder(Format, g.columns, obj, SchemaRegistry, subjects, SchemaOut); err != nil {
+			util.Logger.Fatal("newEncoder failed", zap.Error(err))
+		}
+	}
+	g.stateMux.Lock()
+	g.state.Path, g.state.LineNo, g.state.Timestamp = g.fp, g.lineno, timestamp
+	g.stateMux.Unlock()
+	// after creating the encoder, so that the schema is of intact messages
+	if malformed != "" {
+		g.faults.corrupt(malformed, obj)
+	}
+	topic := g.topics.pick()
+	_ = wp.Submit(func() {
+		b, err := g.enc.encode(obj)
+		if err != nil {
+			util.Logger.Fatal("got error", zap.Error(err))
+		}
+		if malformed == malformedTruncated {
+			b = g.faults.truncate(b)
+		}
+		g.throttle.waitBytes(len(b))
+		chInput <- &sarama.ProducerMessage{
+			Topic:     topic,
+			Key:       key,
+			Value:     sarama.ByteEncoder(b),
+			Partition: partition,
+		}
+		atomic.AddInt64(&g.lines, int64(1))
+		atomic.AddInt64(&g.size, int64(len(b)))
+	})
+}
+
 func main() {
 	util.InitLogger([]string{"stdout"})
 	flag.Usage = func() {
 		usage := fmt.Sprintf(`Usage of %s
     %s kakfa_brokers topic log_file_dir log_file_pattern
+    %s -ddl ddl_file | -clickhouse-dsn dsn -table table kakfa_brokers topic
 This util read log from given paths, fill some fields with random content, serialize and send to kafka.
+In schema mode, it generates random values for each column of the table defined by -ddl, or introspected from ClickHouse.
 kakfa_brokers: for example, 192.168.102.114:9092,192.168.102.115:9092
-topic: for example, apache_access_log
+topic: for example, apache_access_log. Comma-separated topics are produced to in round-robin, such as apache_access_log1,apache_access_log2,
+    or by weights, such as apache_access_log1:3,apache_access_log2:1
 log_file_dir: log file directory, for example, /var/log
-log_file_pattern: file name pattern, for example, '^secure.*$'`, os.Args[0], os.Args[0])
+log_file_pattern: file name pattern, for example, '^secure.*$'
+-rate: target throughput, messages per second and/or megabytes per second, for example, 10000, 5MB/s or 10000,5MB/s
+-ramp-up: duration to increase throughput linearly to the target of -rate, for example, 5m
+-ddl: file of a CREATE TABLE statement, for example, apache_access_log.sql
+-clickhouse-dsn: for example, tcp://127.0.0.1:9000?username=default&password=
+-table: table introspected via -clickhouse-dsn, for example, default.apache_access_log
+-template: YAML or JSON file of field values, for example:
+    fields:
+      "@hostname": {faker: hostname, cardinality: 100}                     # fixed number of distinct fake values
+      response: {values: ["200", "404", "503"], weights: [90, 8, 2]}       # weighted value list
+      requesttime: {range: [0, 1000], decimals: 3}                         # uniform in [min, max)
+    fakers: ipv4, ipv6, uuid, word, hostname, email, url, path, user_agent, http_method, http_status, timestamp
+-tls, -tls-ca-cert, -tls-client-cert, -tls-client-key, -tls-client-key-password, -tls-insecure-skip-verify: TLS of brokers
+-sasl-mechanism, -sasl-username, -sasl-password: SASL of brokers, mechanism is PLAIN, SCRAM-SHA-256, SCRAM-SHA-512 or GSSAPI
+-sasl-kerberos-config, -sasl-keytab, -sasl-service-name, -sasl-realm: Kerberos of GSSAPI
+-compression, -batch-size, -linger, -acks: tuning of the producer, for example, -compression lz4 -batch-size 1048576 -linger 10ms -acks all
+-format: json, avro or protobuf. Fields of Avro and Protobuf are named with characters other than [A-Za-z0-9_] replaced by _
+-schema-registry: URL of the Confluent schema registry to register the Avro schema under subject <topic>-value, then messages are prefixed with the schema id
+-schema-out: file to write the Avro schema or Protobuf definition to
+-state-file: file to persist the log file, line number and simulated timestamp of the last message to, every 10 seconds and at exit.
+    A restarted generator continues from the position instead of sending the same lines again.
+-realtime: timestamps of messages track the wall clock, instead of iterating milliseconds of past days as fast as possible.
+    Use -rate to pace messages as well.
+-speedup: with -realtime, timestamps advance this many times as fast as the wall clock, for example, 60 simulates an hour per minute.
+    They run ahead of the wall clock if it's greater than 1.
+-malformed-truncated, -malformed-wrong-type, -malformed-oversized: percentages of malformed messages, which are cut short,
+    have a field of another type, or are padded to -oversized-bytes by field @padding. Wrong types and oversized messages
+    are for the json format only. Oversized messages shall fit message.max.bytes of the topic to reach the sinker.
+-partitioner: hash(by key), random, round-robin or manual. The manual one sends to -partitions, such as 0,1 in round-robin, or 0:9,1:1 by weights
+-key-field: field whose value is the key of messages, default to @hostname`, os.Args[0], os.Args[0], os.Args[0])
 		util.Logger.Info(usage)
 		os.Exit(0)
 	}
+	flag.StringVar(&GopsAddr, "gops-addr", "127.0.0.1:0", "listen address of the gops agent, empty means disabled")
+	flag.StringVar(&Rate, "rate", "", "target throughput such as 10000, 5MB/s or 10000,5MB/s, empty means unlimited")
+	flag.DurationVar(&RampUp, "ramp-up", 0, "duration to reach the target throughput linearly")
+	flag.StringVar(&DDLFile, "ddl", "", "file of the CREATE TABLE statement of the target table, enables schema mode")
+	flag.StringVar(&ClickHouseDSN, "clickhouse-dsn", "", "ClickHouse to introspect -table from, enables schema mode")
+	flag.StringVar(&Table, "table", "", "target table to introspect via -clickhouse-dsn")
+	flag.StringVar(&TemplateFile, "template", "", "YAML or JSON file of field values, default to that of apache_access_log")
+	flag.StringVar(&Format, "format", FormatJSON, "format of messages, one of json, avro and protobuf")
+	flag.StringVar(&SchemaRegistry, "schema-registry", "", "URL of the schema registry to register the Avro schema")
+	flag.StringVar(&SchemaOut, "schema-out", "", "file to write the Avro schema or Protobuf definition to")
+	flag.StringVar(&StateFile, "state-file", "", "file to persist the position to, and continue from at restart")
+	flag.BoolVar(&Realtime, "realtime", false, "timestamps of messages track the wall clock")
+	flag.Float64Var(&Speedup, "speedup", 1, "with -realtime, how many times as fast as the wall clock timestamps advance")
+	flag.Float64Var(&Truncated, "malformed-truncated", 0, "percentage of messages cut short")
+	flag.Float64Var(&WrongType, "malformed-wrong-type", 0, "percentage of messages with a field of another type")
+	flag.Float64Var(&Oversized, "malformed-oversized", 0, "percentage of messages padded to -oversized-bytes")
+	flag.IntVar(&OversizedBytes, "oversized-bytes", 512*1024, "size of padding of oversized messages")
+	registerKafkaFlags()
 	flag.Parse()
 	args := flag.Args()
-	if len(args) != 4 {
+	schemaMode := DDLFile != "" || ClickHouseDSN != ""
+	if schemaMode && len(args) != 2 || !schemaMode && len(args) != 4 || ClickHouseDSN != "" && Table == "" || Speedup <= 0 {
 		flag.Usage()
 	}
 	KafkaBrokers = args[0]
 	KafkaTopic = args[1]
-	LogfileDir = args[2]
-	LogfilePattern = args[3]
+	if !schemaMode {
+		LogfileDir = args[2]
+		LogfilePattern = args[3]
+	}
+	target, err := parseRate(Rate)
+	if err != nil {
+		util.Logger.Fatal("got error", zap.Error(err))
+	}
 	util.Logger.Info("CLI options",
 		zap.String("KafkaBrokers", KafkaBrokers),
 		zap.String("KafkaTopic", KafkaTopic),
 		zap.String("LogfileDir", LogfileDir),
-		zap.String("LogFilePattern", LogfilePattern))
+		zap.String("LogFilePattern", LogfilePattern),
+		zap.String("Rate", Rate),
+		zap.Duration("RampUp", RampUp),
+		zap.String("DDLFile", DDLFile),
+		zap.String("Table", Table),
+		zap.String("TemplateFile", TemplateFile),
+		zap.String("Format", Format),
+		zap.String("SchemaRegistry", SchemaRegistry),
+		zap.String("StateFile", StateFile),
+		zap.Bool("Realtime", Realtime),
+		zap.Float64("Speedup", Speedup),
+		zap.Float64("Truncated", Truncated),
+		zap.Float64("WrongType", WrongType),
+		zap.Float64("Oversized", Oversized),
+		zap.Int("OversizedBytes", OversizedBytes),
+		zap.Bool("TLS", kafkaOpts.TLS),
+		zap.String("SaslMechanism", kafkaOpts.SaslMechanism),
+		zap.String("Compression", kafkaOpts.Compression),
+		zap.Int("BatchSize", kafkaOpts.BatchSize),
+		zap.Duration("Linger", kafkaOpts.Linger),
+		zap.String("Acks", kafkaOpts.Acks),
+		zap.String("Partitioner", kafkaOpts.Partitioner),
+		zap.String("Partitions", kafkaOpts.Partitions),
+		zap.String("KeyField", kafkaOpts.KeyField))
 
-	if err := agent.Listen(agent.Options{}); err != nil {
-		util.Logger.Fatal("got error", zap.Error(err))
+	if GopsAddr != "" {
+		if err := agent.Listen(agent.Options{Addr: GopsAddr}); err != nil {
+			util.Logger.Fatal("got error", zap.Error(err))
+		}
 	}
 
 	ctx, _ := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
-	g := &LogGenerator{}
-	if err := g.Init(); err != nil {
+	g := &LogGenerator{throttle: newThrottle(target, RampUp)}
+	if g.topics, err = parsePicker(KafkaTopic); err != nil {
 		util.Logger.Fatal("got error", zap.Error(err))
 	}
-	go g.Run()
+	if g.parts, err = newPartitionPicker(); err != nil {
+		util.Logger.Fatal("got error", zap.Error(err))
+	}
+	if g.faults, err = newFaultInjector(Format, Truncated, WrongType, Oversized, OversizedBytes); err != nil {
+		util.Logger.Fatal("got error", zap.Error(err))
+	}
+	switch {
+	case DDLFile != "":
+		g.columns, err = loadSchemaFromDDL(DDLFile)
+	case ClickHouseDSN != "":
+		g.columns, err = loadSchemaFromClickHouse(ClickHouseDSN, Table)
+	default:
+		err = g.Init()
+	}
+	if err != nil {
+		util.Logger.Fatal("got error", zap.Error(err))
+	}
+	// the default template is for log files only
+	if TemplateFile != "" || !schemaMode {
+		if g.tmpl, err = loadTemplate(TemplateFile); err != nil {
+			util.Logger.Fatal("got error", zap.Error(err))
+		}
+	}
+	if StateFile != "" {
+		var st *genState
+		if st, err = loadState(StateFile); err != nil {
+			util.Logger.Fatal("loadState failed", zap.Error(err))
+		}
+		if st != nil {
+			util.Logger.Info("continue from the state", zap.String("path", st.Path), zap.Int("lineno", st.LineNo), zap.Time("timestamp", st.Timestamp))
+			g.state = *st
+			if st.Path != "" && !schemaMode {
+				if err = g.seek(st.Path, st.LineNo); err != nil {
+					util.Logger.Fatal("got error", zap.Error(err))
+				}
+			}
+		}
+	}
+	done := make(chan struct{})
+	go func() {
+		g.Run(ctx)
+		close(done)
+	}()
 
 	var prevLines, prevSize int64
 	ticker := time.NewTicker(10 * time.Second)
@@ -341,6 +566,8 @@ LOOP:
 		select {
 		case <-ctx.Done():
 			util.Logger.Info("quit due to context been canceled")
+			<-done
+			g.persistState()
 			break LOOP
 		case <-ticker.C:
 			var speedLine, speedSize int64
@@ -351,7 +578,14 @@ LOOP:
 			}
 			prevLines = lines
 			prevSize = size
-			util.Logger.Info("status", zap.Int64("lines", lines), zap.Int64("bytes", size), zap.Int64("speed(lines/s)", speedLine), zap.Int64("speed(bytes/s)", speedSize))
+			fields := []zap.Field{zap.Int64("lines", lines), zap.Int64("bytes", size), zap.Int64("speed(lines/s)", speedLine), zap.Int64("speed(bytes/s)", speedSize), zap.Duration("throttled", g.throttle.Throttled()),
+				zap.Int64("errors", atomic.LoadInt64(&g.errors))}
+			if g.faults != nil {
+				truncated, wrongType, oversized := g.faults.Stat()
+				fields = append(fields, zap.Int64("truncated", truncated), zap.Int64("wrongType", wrongType), zap.Int64("oversized", oversized))
+			}
+			util.Logger.Info("status", fields...)
+			g.persistState()
 		}
 	}
 }
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"math/rand"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Kinds of malformed messages
+const (
+	malformedTruncated = "truncated"  // the encoded message is cut short
+	malformedWrongType = "wrong_type" // a field has a value of another type
+	malformedOversized = "oversized"  // a padding field makes the message huge
+)
+
+// faultInjector turns percentages of messages into malformed ones, to exercise error handling of the sinker.
+type faultInjector struct {
+	truncated      float64 // percentages
+	wrongType      float64
+	oversized      float64
+	oversizedBytes int
+	counts         map[string]*int64 // of injected messages by kind
+}
+
+// newFaultInjector returns nil if no malformed message is wanted. Wrong types and oversized messages are for the json
+// format only, since fields of Avro and Protobuf are typed by the schema.
+func newFaultInjector(format string, truncated, wrongType, oversized float64, oversizedBytes int) (f *faultInjector, err error) {
+	for _, pct := range []float64{truncated, wrongType, oversized} {
+		if pct < 0 || pct > 100 {
+			err = errors.Errorf("percentage of malformed messages shall be in [0, 100]")
+			return
+		}
+	}
+	if truncated+wrongType+oversized > 100 {
+		err = errors.Errorf("percentages of malformed messages add up to more than 100")
+		return
+	}
+	if truncated+wrongType+oversized == 0 {
+		return
+	}
+	if format != FormatJSON && wrongType+oversized > 0 {
+		err = errors.Errorf("wrong types and oversized messages are for the json format only")
+		return
+	}
+	if oversized > 0 && oversizedBytes <= 0 {
+		err = errors.Errorf("invalid size of oversized messages %d", oversizedBytes)
+		return
+	}
+	f = &faultInjector{truncated: truncated, wrongType: wrongType, oversized: oversized, oversizedBytes: oversizedBytes,
+		counts: make(map[string]*int64)}
+	for _, kind := range []string{malformedTruncated, malformedWrongType, malformedOversized} {
+		f.counts[kind] = new(int64)
+	}
+	return
+}
+
+// pick returns the kind of malformation of the next message, or "" to leave it intact.
+func (f *faultInjector) pick() (kind string) {
+	r := rand.Float64() * 100
+	switch {
+	case r < f.truncated:
+		kind = malformedTruncated
+	case r < f.truncated+f.wrongType:
+		kind = malformedWrongType
+	case r < f.truncated+f.wrongType+f.oversized:
+		kind = malformedOversized
+	default:
+		return
+	}
+	atomic.AddInt64(f.counts[kind], 1)
+	return
+}
+
+// corrupt changes the message before encoding.
+func (f *faultInjector) corrupt(kind string, obj map[string]interface{}) {
+	switch kind {
+	case malformedWrongType:
+		names := make([]string, 0, len(obj))
+		for name := range obj {
+			names = append(names, name)
+		}
+		if len(names) == 0 {
+			return
+		}
+		name := names[rand.Intn(len(names))]
+		obj[name] = wrongValue(obj[name])
+	case malformedOversized:
+		obj["@padding"] = strings.Repeat(string(rune('a'+rand.Intn(26))), f.oversizedBytes)
+	}
+}
+
+// wrongValue returns a value of another type than v.
+func wrongValue(v interface{}) interface{} {
+	switch v.(type) {
+	case int, int64, float64:
+		return "not_a_number"
+	case string:
+		return map[string]interface{}{"unexpected": "object"}
+	case time.Time:
+		return "not_a_time"
+	case []interface{}:
+		return "not_an_array"
+	default:
+		return []interface{}{"unexpected", "array"}
+	}
+}
+
+// truncate cuts the encoded message at a random position.
+func (f *faultInjector) truncate(b []byte) []byte {
+	if len(b) < 2 {
+		return b
+	}
+	return b[:1+rand.Intn(len(b)-1)]
+}
+
+// Stat returns numbers of injected messages by kind.
+func (f *faultInjector) Stat() (truncated, wrongType, oversized int64) {
+	return atomic.LoadInt64(f.counts[malformedTruncated]), atomic.LoadInt64(f.counts[malformedWrongType]),
+		atomic.LoadInt64(f.counts[malformedOversized])
+}
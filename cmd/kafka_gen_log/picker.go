@@ -0,0 +1,58 @@
+package main
+
+import (
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// picker picks an item for each message, in round-robin or by weights, such as the topic or partition.
+type picker struct {
+	items      []string
+	cumWeights []float64 // nil means round-robin
+	next       int
+}
+
+// parsePicker parses comma-separated items, such as "a,b" for round-robin, or "a:3,b:1" for weighted picking.
+func parsePicker(spec string) (p *picker, err error) {
+	p = &picker{}
+	var sum float64
+	var weighted bool
+	for _, item := range strings.Split(spec, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		weight := 1.0
+		if pos := strings.LastIndexByte(item, ':'); pos >= 0 {
+			if weight, err = strconv.ParseFloat(item[pos+1:], 64); err != nil || weight <= 0 {
+				err = errors.Errorf("invalid weight of %s", item)
+				return
+			}
+			item, weighted = item[:pos], true
+		}
+		sum += weight
+		p.items = append(p.items, item)
+		p.cumWeights = append(p.cumWeights, sum)
+	}
+	if len(p.items) == 0 {
+		err = errors.Errorf("nothing to pick in %q", spec)
+		return
+	}
+	if !weighted {
+		p.cumWeights = nil
+	}
+	return
+}
+
+func (p *picker) pick() (item string) {
+	if p.cumWeights == nil {
+		item = p.items[p.next]
+		p.next = (p.next + 1) % len(p.items)
+		return
+	}
+	i := sort.SearchFloat64s(p.cumWeights, rand.Float64()*p.cumWeights[len(p.cumWeights)-1])
+	return p.items[i]
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/forever765/clickhouse_sinker_nali/util"
+)
+
+// rateTarget is the throughput to produce at, 0 means unlimited for each.
+type rateTarget struct {
+	msgs  float64 // messages per second
+	bytes float64 // bytes per second
+}
+
+// parseRate parses a comma-separated list of targets, such as "10000", "5MB/s" or "10000,5MB/s". A number alone is
+// messages per second, and one with suffix "MB/s"(or "MB") is megabytes per second.
+func parseRate(s string) (target rateTarget, err error) {
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		upper := strings.ToUpper(item)
+		isBytes := strings.HasSuffix(upper, "MB/S") || strings.HasSuffix(upper, "MB")
+		num := strings.TrimSuffix(strings.TrimSuffix(strings.TrimSuffix(upper, "/S"), "MB"), "MSG")
+		var v float64
+		if v, err = strconv.ParseFloat(strings.TrimSpace(num), 64); err != nil || v < 0 {
+			err = errors.Errorf("invalid rate %s", item)
+			return
+		}
+		if isBytes {
+			target.bytes = v * 1024 * 1024
+		} else {
+			target.msgs = v
+		}
+	}
+	return
+}
+
+// throttle paces producing at the target, which is reached linearly in rampUp.
+type throttle struct {
+	target rateTarget
+	rampUp time.Duration
+	msgs   *util.RateLimiter
+	bytes  *util.RateLimiter
+}
+
+func newThrottle(target rateTarget, rampUp time.Duration) *throttle {
+	t := &throttle{target: target, rampUp: rampUp, msgs: util.GetRateLimiter("msgs"), bytes: util.GetRateLimiter("bytes")}
+	t.set(1)
+	if rampUp > 0 {
+		go t.ramp()
+	}
+	return t
+}
+
+// set sets rates to the ratio of the target. A ratio of 0 would mean unlimited, so it starts at 1% at least.
+func (t *throttle) set(ratio float64) {
+	if ratio < 0.01 {
+		ratio = 0.01
+	}
+	t.msgs.SetRate(t.target.msgs * ratio)
+	t.bytes.SetRate(t.target.bytes * ratio)
+}
+
+func (t *throttle) ramp() {
+	begin := time.Now()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for ratio := 0.0; ratio < 1; {
+		ratio = float64(time.Since(begin)) / float64(t.rampUp)
+		if ratio > 1 {
+			ratio = 1
+		}
+		t.set(ratio)
+		<-ticker.C
+	}
+}
+
+// waitMsg blocks until another message is allowed.
+func (t *throttle) waitMsg() {
+	_ = t.msgs.WaitN(context.Background(), 1)
+}
+
+// waitBytes blocks until a message of size n is allowed.
+func (t *throttle) waitBytes(n int) {
+	_ = t.bytes.WaitN(context.Background(), n)
+}
+
+// Throttled returns the time spent waiting for the target.
+func (t *throttle) Throttled() time.Duration {
+	return t.msgs.Throttled() + t.bytes.Throttled()
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"math/rand"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	_ "github.com/ClickHouse/clickhouse-go"
+	"github.com/pkg/errors"
+
+	"github.com/forever765/clickhouse_sinker_nali/model"
+)
+
+const (
+	nullRatio   = 0.1 // of Nullable columns being null
+	maxArrayLen = 4
+	letters     = "abcdefghijklmnopqrstuvwxyz0123456789"
+)
+
+var (
+	lowCardinalityRegexp = regexp.MustCompile(`LowCardinality\((.+)\)`)
+	intBitsRegexp        = regexp.MustCompile(`^(U?)Int(\d+)$`)
+	fixedStringRegexp    = regexp.MustCompile(`^FixedString\((\d+)\)$`)
+	enumRegexp           = regexp.MustCompile(`'((?:[^'\\]|\\.)*)'\s*=`)
+)
+
+// column is a column of the target table, whose values are synthesized according to its type.
+type column struct {
+	name     string
+	typ      string // with LowCardinality, Nullable and Array stripped
+	dataType int
+	nullable bool
+	array    bool
+	enums    []string
+}
+
+func newColumn(name, typ string) (c *column, err error) {
+	typ = lowCardinalityRegexp.ReplaceAllString(typ, "$1")
+	c = &column{name: name}
+	var ok bool
+	if c.dataType, c.nullable, ok = model.TryWhichType(typ); !ok {
+		err = errors.Errorf("column %s has unsupported type %s", name, typ)
+		return
+	}
+	if strings.HasPrefix(typ, "Nullable(") {
+		typ = typ[len("Nullable(") : len(typ)-1]
+	}
+	if c.array = strings.HasPrefix(typ, "Array("); c.array {
+		typ = typ[len("Array(") : len(typ)-1]
+	}
+	c.typ = typ
+	if strings.HasPrefix(typ, "Enum") {
+		for _, m := range enumRegexp.FindAllStringSubmatch(typ, -1) {
+			c.enums = append(c.enums, m[1])
+		}
+	}
+	return
+}
+
+// random returns a random value of the column, timestamp is the one of the message.
+func (c *column) random(timestamp time.Time) interface{} {
+	if c.nullable && rand.Float64() < nullRatio {
+		return nil
+	}
+	if !c.array {
+		return c.randomElement(timestamp)
+	}
+	arr := make([]interface{}, rand.Intn(maxArrayLen+1))
+	for i := range arr {
+		arr[i] = c.randomElement(timestamp)
+	}
+	return arr
+}
+
+func (c *column) randomElement(timestamp time.Time) interface{} {
+	switch c.dataType {
+	case model.Int, model.IntArray:
+		return randomInt(c.typ)
+	case model.Float, model.FloatArray:
+		return float64(rand.Intn(100000)) / 100
+	case model.DateTime, model.DateTimeArray:
+		if c.typ == "Date" {
+			return timestamp.Format("2006-01-02")
+		}
+		return timestamp
+	default:
+		return c.randomString()
+	}
+}
+
+// randomInt returns an integer in the range of the type, limited to 32 bits to stay exact in JSON.
+func randomInt(typ string) int64 {
+	bits := 32
+	unsigned := true
+	if m := intBitsRegexp.FindStringSubmatch(typ); m != nil {
+		unsigned = m[1] == "U"
+		if b, _ := strconv.Atoi(m[2]); b < bits {
+			bits = b
+		}
+	}
+	v := rand.Int63n(int64(1) << bits)
+	if !unsigned {
+		v -= int64(1) << (bits - 1)
+	}
+	return v
+}
+
+func (c *column) randomString() string {
+	if len(c.enums) != 0 {
+		return randElement(c.enums)
+	}
+	if c.typ == "UUID" {
+		return randomUUID()
+	}
+	n := 1 + rand.Intn(16)
+	if m := fixedStringRegexp.FindStringSubmatch(c.typ); m != nil {
+		n, _ = strconv.Atoi(m[1])
+	}
+	return randomLetters(n)
+}
+
+func randomLetters(n int) string {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = letters[rand.Intn(len(letters))]
+	}
+	return string(b)
+}
+
+func randomUUID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// loadSchemaFromClickHouse introspects the columns of table, which is "database.table" or "table" of the database of
+// the dsn, such as tcp://127.0.0.1:9000?database=default&username=default.
+func loadSchemaFromClickHouse(dsn, table string) (columns []*column, err error) {
+	var db *sql.DB
+	if db, err = sql.Open("clickhouse", dsn); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	defer db.Close()
+	query := fmt.Sprintf(`SELECT name, type, default_kind FROM system.columns WHERE database = currentDatabase() AND table = '%s'`, table)
+	if pos := strings.IndexByte(table, '.'); pos >= 0 {
+		query = fmt.Sprintf(`SELECT name, type, default_kind FROM system.columns WHERE database = '%s' AND table = '%s'`, table[:pos], table[pos+1:])
+	}
+	var rs *sql.Rows
+	if rs, err = db.Query(query); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	defer rs.Close()
+	var name, typ, defaultKind string
+	for rs.Next() {
+		if err = rs.Scan(&name, &typ, &defaultKind); err != nil {
+			err = errors.Wrapf(err, "")
+			return
+		}
+		if defaultKind == "MATERIALIZED" || defaultKind == "ALIAS" {
+			continue
+		}
+		var c *column
+		if c, err = newColumn(name, typ); err != nil {
+			return
+		}
+		columns = append(columns, c)
+	}
+	if err = rs.Err(); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	if len(columns) == 0 {
+		err = errors.Errorf("table %s doesn't exist or has no columns", table)
+	}
+	return
+}
+
+// loadSchemaFromDDL parses the columns of the first CREATE TABLE statement of a file.
+func loadSchemaFromDDL(path string) (columns []*column, err error) {
+	var b []byte
+	if b, err = os.ReadFile(path); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	ddl := string(b)
+	begin := strings.Index(strings.ToUpper(ddl), "CREATE TABLE")
+	if begin < 0 {
+		err = errors.Errorf("no CREATE TABLE statement in %s", path)
+		return
+	}
+	if pos := strings.IndexByte(ddl[begin:], '('); pos >= 0 {
+		begin += pos + 1
+	} else {
+		err = errors.Errorf("no column definitions in %s", path)
+		return
+	}
+	for _, def := range splitTopLevel(ddl[begin:]) {
+		name, typ, rest := splitColumnDef(def)
+		switch strings.ToUpper(name) {
+		case "", "INDEX", "PROJECTION", "CONSTRAINT":
+			continue
+		}
+		if upper := strings.ToUpper(rest); strings.HasPrefix(upper, "MATERIALIZED") || strings.HasPrefix(upper, "ALIAS") {
+			continue
+		}
+		var c *column
+		if c, err = newColumn(name, typ); err != nil {
+			return
+		}
+		columns = append(columns, c)
+	}
+	if len(columns) == 0 {
+		err = errors.Errorf("no column definitions in %s", path)
+	}
+	return
+}
+
+// splitTopLevel splits s by commas outside of parentheses and quotes, until the parenthesis closing the column list.
+func splitTopLevel(s string) (parts []string) {
+	var depth, begin int
+	var quote rune
+	for i, r := range s {
+		switch {
+		case quote != 0:
+			if r == quote && s[i-1] != '\\' {
+				quote = 0
+			}
+		case r == '\'' || r == '`' || r == '"':
+			quote = r
+		case r == '(':
+			depth++
+		case r == ')' && depth == 0:
+			return append(parts, s[begin:i])
+		case r == ')':
+			depth--
+		case r == ',' && depth == 0:
+			parts = append(parts, s[begin:i])
+			begin = i + 1
+		}
+	}
+	return append(parts, s[begin:])
+}
+
+// splitColumnDef splits a column definition into its name, type and the rest such as DEFAULT or CODEC.
+func splitColumnDef(def string) (name, typ, rest string) {
+	def = strings.TrimSpace(def)
+	if strings.HasPrefix(def, "`") {
+		if end := strings.IndexByte(def[1:], '`'); end >= 0 {
+			name, def = def[1:end+1], def[end+2:]
+		}
+	} else if end := strings.IndexFunc(def, unicode.IsSpace); end >= 0 {
+		name, def = def[:end], def[end:]
+	} else {
+		return def, "", ""
+	}
+	def = strings.TrimSpace(def)
+	var depth int
+	for i, r := range def {
+		switch {
+		case r == '(':
+			depth++
+		case r == ')':
+			depth--
+		case depth == 0 && unicode.IsSpace(r):
+			return name, def[:i], strings.TrimSpace(def[i:])
+		}
+	}
+	return name, def, ""
+}
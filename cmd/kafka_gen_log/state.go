@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// genState is the position of the generator, which is persisted to continue where a previous run stopped.
+type genState struct {
+	Path      string    // log file of the last message, empty in schema mode
+	LineNo    int       // line of the last message in Path
+	Base      time.Time // midnight of the first simulated day, the simulated time goes backward day by day from it
+	Timestamp time.Time // simulated timestamp of the last message
+}
+
+// loadState returns the persisted state, or nil if there's none.
+func loadState(path string) (st *genState, err error) {
+	var b []byte
+	if b, err = os.ReadFile(path); err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		} else {
+			err = errors.Wrapf(err, "")
+		}
+		return
+	}
+	st = &genState{}
+	if err = json.Unmarshal(b, st); err != nil {
+		err = errors.Wrapf(err, "%s", path)
+	}
+	return
+}
+
+// saveState writes the state to a temporary file and renames it, so that a crash never leaves a partial state.
+func saveState(path string, st genState) (err error) {
+	b, _ := json.MarshalIndent(st, "", "  ")
+	tmp := path + ".tmp"
+	if err = os.WriteFile(tmp, b, 0644); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	if err = os.Rename(tmp, path); err != nil {
+		err = errors.Wrapf(err, "")
+	}
+	return
+}
+
+// next returns the day and step of the message following the state, see LogGenerator.Run.
+func (st *genState) next() (day, step int) {
+	const dayLen = 24 * time.Hour
+	off := st.Timestamp.Sub(st.Base)
+	day = -int(math.Floor(float64(off) / float64(dayLen)))
+	step = int((off+time.Duration(day)*dayLen)/time.Millisecond) + 1
+	return
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+// defaultTemplate generates fields of apache_access_log besides those taken from log files.
+const defaultTemplate = `
+fields:
+  "@hostname":
+    values: [vm101101, vm101102, vm101103, vm101104, vm101105, vm101106, vm101107, vm101108, vm101109, vm101110]
+  "@ip":
+    values: [192.168.101.101, 192.168.101.102, 192.168.101.103, 192.168.101.104, 192.168.101.105,
+      192.168.101.106, 192.168.101.107, 192.168.101.108, 192.168.101.109, 192.168.101.110]
+  agent:
+    values: ["Mozilla/5.0(Windows NT 6.1; Win64; x64)AppleWebKit/537.36(KHTML,like Gecko)Chrome/69.0.3497.100Safari/537.36"]
+  auth:
+    values: [RFC1413身份]
+  clientIp:
+    values: [192.168.1.1, 192.168.1.2, 192.168.1.3, 192.168.1.4, 192.168.1.5]
+  device_family:
+    values: [Hawei, Xiaomi, OPPO, Apple, Other]
+  httpversion:
+    values: ["1.0", "1.1", "2.0", "3.0"]
+  ident:
+    values: [""]
+  os_family:
+    values: [Android, Mac OS X, HMS]
+  os_major:
+    values: ["6", "7", "8", "9", "10"]
+  os_minor:
+    values: ["0", "1", "2", "3"]
+  referrer:
+    values: [""]
+  request:
+    values: [""]
+  requesttime:
+    range: [0, 1000]
+  response:
+    values: ["200", "301", "400", "404", "503"]
+  userAgent_family:
+    values: [Chrome, Firefox, AppleWebKit]
+  userAgent_major:
+    values: ["75", "76", "77", "78", "79", "80", "81"]
+  userAgent_minor:
+    values: ["0", "1", "2", "3"]
+  verb:
+    values: [GET, POST, HEAD]
+  xforwardfor:
+    values: [""]
+`
+
+var (
+	userAgents = []string{
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/96.0.4664.110 Safari/537.36",
+		"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/15.1 Safari/605.1.15",
+		"Mozilla/5.0 (X11; Linux x86_64; rv:95.0) Gecko/20100101 Firefox/95.0",
+		"Mozilla/5.0 (iPhone; CPU iPhone OS 15_2 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Mobile/15E148",
+		"Mozilla/5.0 (Linux; Android 11; M2012K11AC) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/96.0.4664.104 Mobile Safari/537.36",
+	}
+	httpMethods  = []string{"GET", "POST", "PUT", "DELETE", "HEAD", "OPTIONS"}
+	httpStatuses = []string{"200", "201", "204", "301", "302", "304", "400", "401", "403", "404", "500", "502", "503"}
+
+	fakers = map[string]func(timestamp time.Time) interface{}{
+		"ipv4": func(time.Time) interface{} {
+			return fmt.Sprintf("%d.%d.%d.%d", 1+rand.Intn(223), rand.Intn(256), rand.Intn(256), 1+rand.Intn(254))
+		},
+		"ipv6": func(time.Time) interface{} {
+			return fmt.Sprintf("2001:db8:%x:%x:%x:%x:%x:%x", rand.Intn(1<<16), rand.Intn(1<<16), rand.Intn(1<<16),
+				rand.Intn(1<<16), rand.Intn(1<<16), rand.Intn(1<<16))
+		},
+		"uuid": func(time.Time) interface{} { return randomUUID() },
+		"word": func(time.Time) interface{} { return randomWord() },
+		"hostname": func(time.Time) interface{} {
+			return fmt.Sprintf("%s-%03d", randomWord(), rand.Intn(1000))
+		},
+		"email": func(time.Time) interface{} {
+			return fmt.Sprintf("%s@%s.com", randomWord(), randomWord())
+		},
+		"url": func(time.Time) interface{} {
+			return fmt.Sprintf("https://%s.com/%s/%s", randomWord(), randomWord(), randomWord())
+		},
+		"path": func(time.Time) interface{} {
+			return fmt.Sprintf("/%s/%s", randomWord(), randomWord())
+		},
+		"user_agent":  func(time.Time) interface{} { return randElement(userAgents) },
+		"http_method": func(time.Time) interface{} { return randElement(httpMethods) },
+		"http_status": func(time.Time) interface{} { return randElement(httpStatuses) },
+		"timestamp":   func(timestamp time.Time) interface{} { return timestamp },
+	}
+)
+
+func randomWord() string {
+	return randomLetters(3 + rand.Intn(8))
+}
+
+// logTemplate describes how to generate fields of messages.
+type logTemplate struct {
+	Fields map[string]*fieldTemplate
+}
+
+// fieldTemplate generates values of a field with exactly one of Values, Range and Faker.
+type fieldTemplate struct {
+	Values      []interface{} // picked uniformly, or by Weights
+	Weights     []float64     // of Values
+	Range       []float64     // [min, max)
+	Decimals    int           // of values in Range, 0 means integers
+	Faker       string        // one of fakers
+	Cardinality int           // number of distinct values of Range or Faker, 0 means unlimited
+
+	cumWeights []float64
+	pool       []interface{}
+}
+
+// loadTemplate parses a template of YAML or JSON, or the default one if path is empty.
+func loadTemplate(path string) (tmpl *logTemplate, err error) {
+	b := []byte(defaultTemplate)
+	if path != "" {
+		if b, err = os.ReadFile(path); err != nil {
+			err = errors.Wrapf(err, "")
+			return
+		}
+	}
+	tmpl = &logTemplate{}
+	if err = yaml.Unmarshal(b, tmpl); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	for name, f := range tmpl.Fields {
+		if err = f.normalize(); err != nil {
+			err = errors.Wrapf(err, "field %s", name)
+			return
+		}
+	}
+	return
+}
+
+func (f *fieldTemplate) normalize() (err error) {
+	var kinds int
+	if len(f.Values) != 0 {
+		kinds++
+	}
+	if f.Range != nil {
+		kinds++
+	}
+	if f.Faker != "" {
+		kinds++
+	}
+	if kinds != 1 {
+		return errors.Errorf("exactly one of values, range and faker is required")
+	}
+	if f.Cardinality < 0 || f.Decimals < 0 {
+		return errors.Errorf("cardinality and decimals shall be non-negative")
+	}
+	if f.Range != nil && (len(f.Range) != 2 || f.Range[0] >= f.Range[1]) {
+		return errors.Errorf("range shall be [min, max) with min < max")
+	}
+	if _, ok := fakers[f.Faker]; f.Faker != "" && !ok {
+		return errors.Errorf("unknown faker %s", f.Faker)
+	}
+	if len(f.Weights) != 0 {
+		if len(f.Weights) != len(f.Values) {
+			return errors.Errorf("weights shall be as many as values")
+		}
+		var sum float64
+		for _, w := range f.Weights {
+			if w < 0 {
+				return errors.Errorf("weights shall be non-negative")
+			}
+			sum += w
+			f.cumWeights = append(f.cumWeights, sum)
+		}
+		if sum == 0 {
+			return errors.Errorf("weights shall not be all zero")
+		}
+	}
+	return
+}
+
+// value returns the next value of the field. timestamp is the one of the message.
+func (f *fieldTemplate) value(timestamp time.Time) interface{} {
+	switch {
+	case len(f.Values) != 0 && f.cumWeights == nil:
+		return f.Values[rand.Intn(len(f.Values))]
+	case len(f.Values) != 0:
+		sum := f.cumWeights[len(f.cumWeights)-1]
+		i := sort.SearchFloat64s(f.cumWeights, rand.Float64()*sum)
+		for f.Weights[i] == 0 {
+			// rand.Float64() may return 0, which shall not pick a value of weight 0
+			i++
+		}
+		return f.Values[i]
+	case f.Cardinality != 0 && len(f.pool) >= f.Cardinality:
+		return f.pool[rand.Intn(len(f.pool))]
+	}
+	var v interface{}
+	if f.Range != nil {
+		x := f.Range[0] + rand.Float64()*(f.Range[1]-f.Range[0])
+		if f.Decimals == 0 {
+			v = int64(math.Floor(x))
+		} else {
+			scale := math.Pow10(f.Decimals)
+			v = math.Floor(x*scale) / scale
+		}
+	} else {
+		v = fakers[f.Faker](timestamp)
+	}
+	if f.Cardinality != 0 {
+		f.pool = append(f.pool, v)
+	}
+	return v
+}
+
+// fill sets fields of the template in row.
+func (t *logTemplate) fill(row map[string]interface{}, timestamp time.Time) {
+	for name, f := range t.Fields {
+		row[name] = f.value(timestamp)
+	}
+}
@@ -60,6 +60,11 @@ const (
 var (
 	KafkaBrokers string
 	KafkaTopic   string
+	GopsAddr     string
+
+	SeriesNum        int
+	LabelCardinality string
+	Churn            float64
 
 	ListMetricName = []string{"CPU", "RAM", "IOPS"}
 	ListArgName    = []string{
@@ -74,8 +79,9 @@ var (
 		"SingularValueDecomposition",
 		"IndependentComponentAnalysis"}
 
-	gLines int64
-	gSize  int64
+	gLines  int64
+	gSize   int64
+	gSeries int64 // series ever created
 )
 
 type Metric struct {
@@ -108,7 +114,7 @@ func randElement(list []string) string {
 	return list[off]
 }
 
-func generate() {
+func generate(set *seriesSet) {
 	toRound := time.Now().Add(time.Duration(-30*24) * time.Hour)
 	// refers to time.Time.Truncate
 	rounded := time.Date(toRound.Year(), toRound.Month(), toRound.Day(), 0, 0, 0, 0, toRound.Location())
@@ -126,49 +132,50 @@ func generate() {
 	for day := 0; ; day++ {
 		tsDay := rounded.Add(time.Duration(24*day) * time.Hour)
 		for step := 0; step < 24*60*60; step++ {
-			for bus := 0; bus < BusinessNum; bus++ {
-				for ins := 0; ins < InstanceNum; ins++ {
-					timestamp := tsDay.Add(time.Duration(step) * time.Second)
-					metric := Metric{
-						Time:         timestamp,
-						ItemGUID:     fmt.Sprintf("bus%03d_ins%03d", bus, ins),
-						MetricName:   randElement(ListMetricName),
-						AlgName:      randElement(ListArgName),
-						Value:        float64(rand.Intn(100)),
-						Upper:        float64(100.0),
-						Lower:        float64(60.0),
-						YhatUpper:    float64(100.0),
-						YhatLower:    float64(60.0),
-						YhatFlag:     rand.Int31n(65535),
-						TotalAnomaly: rand.Int63n(65535),
-						Anomaly:      float64(rand.Intn(100)) / float64(100),
-						AbnormalType: int16(rand.Intn(1000)),
-						Abnormality:  int16(rand.Intn(1000)),
-						ContainerID:  rand.Int63n(65535),
-						HardUpper:    float64(100),
-						HardLower:    float64(60),
-						HardAnomaly:  int64(rand.Intn(65535)),
-						ShiftTag:     int32(rand.Intn(65535)),
-						SeasonTag:    int32(rand.Intn(65535)),
-						SpikeTag:     int32(rand.Intn(65535)),
-						IsMissing:    int32(rand.Intn(1)),
-					}
-
-					_ = wp.Submit(func() {
-						var b []byte
-						if b, err = sonic.Marshal(&metric); err != nil {
-							err = errors.Wrapf(err, "")
-							util.Logger.Fatal("got error", zap.Error(err))
-						}
-						chInput <- &sarama.ProducerMessage{
-							Topic: KafkaTopic,
-							Key:   sarama.StringEncoder(metric.ItemGUID),
-							Value: sarama.ByteEncoder(b),
-						}
-						atomic.AddInt64(&gLines, int64(1))
-						atomic.AddInt64(&gSize, int64(len(b)))
-					})
+			set.tick()
+			for _, sr := range set.active {
+				sr := sr
+				timestamp := tsDay.Add(time.Duration(step) * time.Second)
+				metric := Metric{
+					Time:         timestamp,
+					ItemGUID:     sr.itemGUID,
+					MetricName:   sr.metricName,
+					AlgName:      sr.algName,
+					Value:        float64(rand.Intn(100)),
+					Upper:        float64(100.0),
+					Lower:        float64(60.0),
+					YhatUpper:    float64(100.0),
+					YhatLower:    float64(60.0),
+					YhatFlag:     rand.Int31n(65535),
+					TotalAnomaly: rand.Int63n(65535),
+					Anomaly:      float64(rand.Intn(100)) / float64(100),
+					AbnormalType: int16(rand.Intn(1000)),
+					Abnormality:  int16(rand.Intn(1000)),
+					ContainerID:  rand.Int63n(65535),
+					HardUpper:    float64(100),
+					HardLower:    float64(60),
+					HardAnomaly:  int64(rand.Intn(65535)),
+					ShiftTag:     int32(rand.Intn(65535)),
+					SeasonTag:    int32(rand.Intn(65535)),
+					SpikeTag:     int32(rand.Intn(65535)),
+					IsMissing:    int32(rand.Intn(1)),
 				}
+
+				_ = wp.Submit(func() {
+					b, err := sonic.Marshal(&metric)
+					if err != nil {
+						err = errors.Wrapf(err, "")
+						util.Logger.Fatal("got error", zap.Error(err))
+					}
+					b = sr.appendLabels(b)
+					chInput <- &sarama.ProducerMessage{
+						Topic: KafkaTopic,
+						Key:   sarama.StringEncoder(metric.ItemGUID),
+						Value: sarama.ByteEncoder(b),
+					}
+					atomic.AddInt64(&gLines, int64(1))
+					atomic.AddInt64(&gSize, int64(len(b)))
+				})
 			}
 		}
 	}
@@ -181,10 +188,17 @@ func main() {
     %s kakfa_brokers topic
 This util fill some fields with random content, serialize and send to kafka.
 kakfa_brokers: for example, 192.168.102.114:9092,192.168.102.115:9092
-topic: for example, sensor_dt_result_online`, os.Args[0], os.Args[0])
+topic: for example, sensor_dt_result_online
+-series: number of active series, each of which sends a sample per simulated second
+-label-cardinality: comma-separated cardinalities of extra labels label_0, label_1, ..., for example, 10,1000
+-churn: number of active series replaced with new ones per simulated second, for example, 0.5`, os.Args[0], os.Args[0])
 		util.Logger.Info(usage)
 		os.Exit(0)
 	}
+	flag.StringVar(&GopsAddr, "gops-addr", "127.0.0.1:0", "listen address of the gops agent, empty means disabled")
+	flag.IntVar(&SeriesNum, "series", BusinessNum*InstanceNum, "number of active series")
+	flag.StringVar(&LabelCardinality, "label-cardinality", "", "comma-separated cardinalities of extra labels, empty means none")
+	flag.Float64Var(&Churn, "churn", 0, "number of series replaced with new ones per simulated second")
 	flag.Parse()
 	args := flag.Args()
 	if len(args) != 2 {
@@ -192,19 +206,29 @@ topic: for example, sensor_dt_result_online`, os.Args[0], os.Args[0])
 	}
 	KafkaBrokers = args[0]
 	KafkaTopic = args[1]
+	cardinalities, err := parseCardinalities(LabelCardinality)
+	if err != nil {
+		util.Logger.Fatal("got error", zap.Error(err))
+	}
+	if SeriesNum <= 0 || Churn < 0 {
+		util.Logger.Fatal("series shall be positive, and churn shall be non-negative")
+	}
 	util.Logger.Info("CLI options",
 		zap.String("KafkaBrokers", KafkaBrokers),
 		zap.String("KafkaTopic", KafkaTopic),
-		zap.Int("BusinessNum", BusinessNum),
-		zap.Int("InstanceNum", InstanceNum))
+		zap.Int("SeriesNum", SeriesNum),
+		zap.String("LabelCardinality", LabelCardinality),
+		zap.Float64("Churn", Churn))
 
-	if err := agent.Listen(agent.Options{}); err != nil {
-		util.Logger.Fatal("got error", zap.Error(err))
+	if GopsAddr != "" {
+		if err := agent.Listen(agent.Options{Addr: GopsAddr}); err != nil {
+			util.Logger.Fatal("got error", zap.Error(err))
+		}
 	}
 
 	var prevLines, prevSize int64
 	ctx, _ := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
-	go generate()
+	go generate(newSeriesSet(SeriesNum, cardinalities, Churn))
 
 	ticker := time.NewTicker(10 * time.Second)
 LOOP:
@@ -221,7 +245,7 @@ LOOP:
 			}
 			prevLines = gLines
 			prevSize = gSize
-			util.Logger.Info("status", zap.Int64("lines", gLines), zap.Int64("bytes", gSize), zap.Int64("speed(lines/s)", speedLine), zap.Int64("speed(bytes/s)", speedSize))
+			util.Logger.Info("status", zap.Int64("lines", gLines), zap.Int64("bytes", gSize), zap.Int64("speed(lines/s)", speedLine), zap.Int64("speed(bytes/s)", speedSize), zap.Int64("series", atomic.LoadInt64(&gSeries)))
 		}
 	}
 }
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// series is a unique combination of label values, whose samples are sent each simulated second.
+type series struct {
+	itemGUID   string
+	metricName string
+	algName    string
+	labelsJSON []byte // extra labels, such as `,"label_0":"v3","label_1":"v17"`
+}
+
+// seriesSet is the set of active series. Series churn by being replaced with new ones, which have item GUIDs never
+// seen before.
+type seriesSet struct {
+	active        []*series
+	cardinalities []int // of extra labels label_0, label_1, ...
+	churn         float64
+	churnDebt     float64
+}
+
+// parseCardinalities parses comma-separated cardinalities of extra labels, such as "10,100".
+func parseCardinalities(s string) (cards []int, err error) {
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		var card int
+		if card, err = strconv.Atoi(item); err != nil || card <= 0 {
+			err = errors.Errorf("invalid label cardinality %s", item)
+			return
+		}
+		cards = append(cards, card)
+	}
+	return
+}
+
+func newSeriesSet(num int, cardinalities []int, churn float64) (s *seriesSet) {
+	s = &seriesSet{cardinalities: cardinalities, churn: churn}
+	for i := 0; i < num; i++ {
+		s.active = append(s.active, s.newSeries())
+	}
+	return
+}
+
+func (s *seriesSet) newSeries() *series {
+	id := atomic.AddInt64(&gSeries, 1) - 1
+	sr := &series{
+		itemGUID:   fmt.Sprintf("bus%03d_ins%03d", id/InstanceNum, id%InstanceNum),
+		metricName: randElement(ListMetricName),
+		algName:    randElement(ListArgName),
+	}
+	for i, card := range s.cardinalities {
+		sr.labelsJSON = append(sr.labelsJSON, fmt.Sprintf(`,"label_%d":"v%d"`, i, rand.Intn(card))...)
+	}
+	return sr
+}
+
+// tick replaces churn series per simulated second with new ones.
+func (s *seriesSet) tick() {
+	if len(s.active) == 0 {
+		return
+	}
+	for s.churnDebt += s.churn; s.churnDebt >= 1; s.churnDebt-- {
+		s.active[rand.Intn(len(s.active))] = s.newSeries()
+	}
+}
+
+// appendLabels appends extra labels of the series to the JSON object b.
+func (sr *series) appendLabels(b []byte) []byte {
+	if len(sr.labelsJSON) == 0 || len(b) == 0 {
+		return b
+	}
+	b = append(b[:len(b)-1], sr.labelsJSON...)
+	return append(b, '}')
+}
@@ -16,6 +16,8 @@ limitations under the License.
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"os"
@@ -45,8 +47,11 @@ var (
 		`nacos data id`)
 
 	localCfgFile = flag.String("local-cfg-file", "/etc/clickhouse_sinker_nali.json", "local config file")
+	localCfgDir  = flag.String("local-cfg-dir", "", "directory of config files, such as one with shared settings and one per task, which are merged in lexical order and published as one config. Overrides --local-cfg-file")
 	replicas     = flag.Int("replicas", 1, "replicate each task to multiple ones with the same config except task name, consumer group and table name")
 	maxOpenConns = flag.Int("max-open-conns", 0, "max open connections per shard")
+	plan         = flag.Bool("plan", false, "show which tasks would be added, removed or modified on the running cluster, and quit without publishing")
+	dryRun       = flag.Bool("dry-run", false, "show the diff against the published config and the config to publish, and quit without publishing")
 )
 
 // Empty is not valid namespaceID
@@ -64,13 +69,18 @@ func getProperties() map[string]interface{} {
 func PublishSinkerConfig() {
 	var err error
 	var cfg *config.Config
-	if _, err = os.Stat(*localCfgFile); err == nil {
+	if *localCfgDir != "" {
+		if cfg, err = config.ParseLocalCfgDir(*localCfgDir); err != nil {
+			util.Logger.Fatal("config.ParseLocalCfgDir failed", zap.Error(err))
+			return
+		}
+	} else if _, err = os.Stat(*localCfgFile); err == nil {
 		if cfg, err = config.ParseLocalCfgFile(*localCfgFile); err != nil {
 			util.Logger.Fatal("config.ParseLocalCfgFile failed", zap.Error(err))
 			return
 		}
 	} else {
-		util.Logger.Fatal("expect --local-cfg-file")
+		util.Logger.Fatal("expect --local-cfg-file or --local-cfg-dir")
 		return
 	}
 
@@ -78,6 +88,8 @@ func PublishSinkerConfig() {
 		util.Logger.Fatal("cfg.Normallize failed", zap.Error(err))
 		return
 	}
+	// Included files are local, so publish the merged config.
+	cfg.Flatten()
 	tasks := cfg.Tasks
 	for i := 1; i < *replicas; i++ {
 		for j := 0; j < len(tasks); j++ {
@@ -100,7 +112,26 @@ func PublishSinkerConfig() {
 	if err = ncm.Init(properties); err != nil {
 		util.Logger.Fatal("ncm.Init failed", zap.Error(err))
 	}
+	changed := showPlan(&ncm, cfg)
+	if *plan {
+		return
+	}
+	if *dryRun {
+		var content []byte
+		if content, err = cfg.MainLayer(); err != nil {
+			util.Logger.Fatal("cfg.MainLayer failed", zap.Error(err))
+		}
+		var out bytes.Buffer
+		_ = json.Indent(&out, content, "", "  ")
+		fmt.Printf("\nConfig to publish to %s:\n%s\n", *nacosDataID, out.String())
+		return
+	}
+	if !changed {
+		util.Logger.Info("the published config is up to date")
+		return
+	}
 
+	// All tasks are in one data id, so that they're applied at once.
 	if err = ncm.PublishConfig(cfg); err != nil {
 		util.Logger.Fatal("ncm.PublishConfig failed", zap.Error(err))
 	}
@@ -116,6 +147,29 @@ func PublishSinkerConfig() {
 	}
 }
 
+// showPlan prints the difference between the published config and cfg, like `terraform plan`, and tells whether
+// there's any. An absent or invalid published config is compared as an empty one, so that it can be replaced.
+func showPlan(ncm *cm.NacosConfManager, cfg *config.Config) (changed bool) {
+	cur, err := ncm.GetConfig()
+	if err == nil {
+		err = cur.Normallize()
+	}
+	if err != nil {
+		util.Logger.Warn("no valid config is published", zap.String("dataId", *nacosDataID), zap.Error(err))
+		cur = &config.Config{}
+	}
+	p, err := config.MakePlan(cur, cfg)
+	if err != nil {
+		util.Logger.Fatal("config.MakePlan failed", zap.Error(err))
+	}
+	if p.Empty() {
+		fmt.Println("No changes.")
+		return
+	}
+	fmt.Print(p.String())
+	return true
+}
+
 func main() {
 	util.InitLogger([]string{"stdout"})
 	flag.Parse()
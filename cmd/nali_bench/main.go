@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/forever765/clickhouse_sinker_nali/config"
+	"github.com/forever765/clickhouse_sinker_nali/enrich"
+	"github.com/forever765/clickhouse_sinker_nali/input"
+	"github.com/forever765/clickhouse_sinker_nali/util"
+	"go.uber.org/zap"
+)
+
+var (
+	localCfgFile = flag.String("local-cfg-file", "/etc/clickhouse_sinker_nali.json", "local config file")
+	taskName     = flag.String("task", "", "task whose enrichment pipeline is benchmarked, default to the first one")
+	inputFile    = flag.String("input", "", "sample file, one JSON message per line")
+	workers      = flag.Int("workers", runtime.NumCPU(), "number of goroutines feeding messages, similar to the size of the parsing pool")
+	repeat       = flag.Int("repeat", 1, "times to feed the sample file")
+)
+
+// stage is a step of the pipeline, or the legacy geoipHandle processing
+type stage struct {
+	name  string
+	apply func(value []byte) ([]byte, bool, error)
+	step  *enrich.Step
+}
+
+type stageStats struct {
+	applied int64
+	errors  int64
+	total   time.Duration
+	max     time.Duration
+}
+
+func (s *stageStats) merge(o *stageStats) {
+	s.applied += o.applied
+	s.errors += o.errors
+	s.total += o.total
+	if o.max > s.max {
+		s.max = o.max
+	}
+}
+
+func loadTask() (taskCfg *config.TaskConfig) {
+	cfg, err := config.ParseLocalCfgFile(*localCfgFile)
+	if err != nil {
+		util.Logger.Fatal("config.ParseLocalCfgFile failed", zap.Error(err))
+	}
+	// Don't schedule geo database updates, which restart sinker.
+	if cfg.Task != nil {
+		cfg.Task.AutoUpdateGeoIPDB = ""
+	}
+	for _, t := range cfg.Tasks {
+		t.AutoUpdateGeoIPDB = ""
+	}
+	if err = cfg.Normallize(); err != nil {
+		util.Logger.Fatal("cfg.Normallize failed", zap.Error(err))
+	}
+	for _, t := range cfg.Tasks {
+		if *taskName == "" || t.Name == *taskName {
+			return t
+		}
+	}
+	util.Logger.Fatal("task not found", zap.String("task", *taskName))
+	return
+}
+
+func loadSamples() (samples [][]byte) {
+	f, err := os.Open(*inputFile)
+	if err != nil {
+		util.Logger.Fatal("os.Open failed", zap.Error(err))
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) != 0 {
+			samples = append(samples, append([]byte(nil), line...))
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		util.Logger.Fatal("failed to read samples", zap.Error(err))
+	}
+	if len(samples) == 0 {
+		util.Logger.Fatal("no samples", zap.String("input", *inputFile))
+	}
+	return
+}
+
+func buildStages(taskCfg *config.TaskConfig) (stages []stage, pipeline *enrich.Pipeline) {
+	if taskCfg.GeoipHandle {
+		stages = append(stages, stage{
+			name: "geoipHandle",
+			apply: func(value []byte) ([]byte, bool, error) {
+				return input.HandleMsg(value), true, nil
+			},
+		})
+	}
+	var err error
+	if pipeline, err = enrich.NewPipeline(taskCfg.Enrichments); err != nil {
+		util.Logger.Fatal("enrich.NewPipeline failed", zap.Error(err))
+	}
+	for _, step := range pipeline.Steps {
+		stages = append(stages, stage{
+			name:  fmt.Sprintf("%s(%s)", step.Type, step.Field),
+			apply: step.Apply,
+			step:  step,
+		})
+	}
+	if len(stages) == 0 {
+		util.Logger.Fatal("task has neither geoipHandle nor enrichments", zap.String("task", taskCfg.Name))
+	}
+	return
+}
+
+func run(stages []stage, samples [][]byte) (stats []stageStats, elapsed time.Duration) {
+	stats = make([]stageStats, len(stages))
+	var mux sync.Mutex
+	var wg sync.WaitGroup
+	total := len(samples) * *repeat
+	begin := time.Now()
+	for w := 0; w < *workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			local := make([]stageStats, len(stages))
+			for i := w; i < total; i += *workers {
+				value := samples[i%len(samples)]
+				for j, st := range stages {
+					t0 := time.Now()
+					result, applied, err := st.apply(value)
+					cost := time.Since(t0)
+					if err != nil {
+						local[j].errors++
+						continue
+					}
+					value = result
+					if applied {
+						local[j].applied++
+						local[j].total += cost
+						if cost > local[j].max {
+							local[j].max = cost
+						}
+					}
+				}
+			}
+			mux.Lock()
+			for j := range stats {
+				stats[j].merge(&local[j])
+			}
+			mux.Unlock()
+		}(w)
+	}
+	wg.Wait()
+	elapsed = time.Since(begin)
+	return
+}
+
+func report(stages []stage, stats []stageStats, messages int, elapsed time.Duration) {
+	var lookups int64
+	for _, s := range stats {
+		lookups += s.applied
+	}
+	seconds := elapsed.Seconds()
+	fmt.Printf("messages: %d, workers: %d, elapsed: %v\n", messages, *workers, elapsed)
+	fmt.Printf("messages/s: %.0f, lookups/s: %.0f\n\n", float64(messages)/seconds, float64(lookups)/seconds)
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "STEP\tAPPLIED\tERRORS\tAVG\tMAX\tCACHE HIT RATE")
+	for i, st := range stages {
+		s := stats[i]
+		var avg time.Duration
+		if s.applied != 0 {
+			avg = s.total / time.Duration(s.applied)
+		}
+		hitRate := "-"
+		if st.step != nil {
+			if hits, misses, ok := st.step.CacheStats(); ok && hits+misses != 0 {
+				hitRate = fmt.Sprintf("%.2f%%", float64(hits)*100/float64(hits+misses))
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%v\t%v\t%s\n", st.name, s.applied, s.errors, avg, s.max, hitRate)
+	}
+	tw.Flush()
+}
+
+func main() {
+	util.InitLogger([]string{"stdout"})
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, `Usage of %s
+This util feeds a sample file through the enrichment pipeline of a task, and reports lookups/s, cache hit rate and per-step latency.
+`, os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if *inputFile == "" || *workers <= 0 || *repeat <= 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	taskCfg := loadTask()
+	samples := loadSamples()
+	stages, pipeline := buildStages(taskCfg)
+	defer pipeline.Close()
+	util.Logger.Info("benchmarking", zap.String("task", taskCfg.Name), zap.Int("samples", len(samples)), zap.Int("stages", len(stages)))
+
+	stats, elapsed := run(stages, samples)
+	report(stages, stats, len(samples)**repeat, elapsed)
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/forever765/clickhouse_sinker_nali/config"
+	rcm "github.com/forever765/clickhouse_sinker_nali/config_manager"
+	"github.com/forever765/clickhouse_sinker_nali/input"
+	"github.com/forever765/clickhouse_sinker_nali/util"
+)
+
+var (
+	localCfgFile = flag.String("local-cfg-file", "/etc/clickhouse_sinker_nali.json", "local config file")
+	taskName     = flag.String("task", "", "task to operate, empty means all tasks for show and export")
+	to           = flag.String("to", "", "set: earliest, latest, or a timestamp in RFC3339 or milliseconds since epoch")
+	offsets      = flag.String("offsets", "", "set: comma-separated partition:offset, such as 0:1000,1:2000")
+	inputFile    = flag.String("input", "", "set: file exported by export, whose offsets of the task(s) are restored")
+	partition    = flag.Int("partition", -1, "skip: partition of the poison message")
+	count        = flag.Int64("count", 1, "skip: number of messages to skip from the committed offset")
+	dryRun       = flag.Bool("dry-run", false, "set and skip: print the offsets to commit without committing")
+)
+
+// taskOffsets is the committed offsets of the consumer group of a task, which is the format of export.
+type taskOffsets struct {
+	Task    string          `json:"task"`
+	Group   string          `json:"group"`
+	Topic   string          `json:"topic"`
+	Offsets map[int32]int64 `json:"offsets"`
+}
+
+func loadConfig() (cfg *config.Config) {
+	var err error
+	if cfg, err = config.ParseLocalCfgFile(*localCfgFile); err != nil {
+		util.Logger.Fatal("config.ParseLocalCfgFile failed", zap.Error(err))
+	}
+	if err = cfg.Normallize(); err != nil {
+		util.Logger.Fatal("cfg.Normallize failed", zap.Error(err))
+	}
+	if *taskName == "" {
+		return
+	}
+	for _, t := range cfg.Tasks {
+		if t.Name == *taskName {
+			cfg.Tasks = []*config.TaskConfig{t}
+			return
+		}
+	}
+	util.Logger.Fatal("task not found", zap.String("task", *taskName))
+	return
+}
+
+func show(cfg *config.Config) (err error) {
+	var lags []rcm.PartitionLag
+	if lags, err = rcm.GetPartitionLags(cfg); err != nil {
+		return
+	}
+	groups := make(map[string]string)
+	for _, t := range cfg.Tasks {
+		groups[t.Name] = t.ConsumerGroup
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "TASK\tGROUP\tTOPIC\tPARTITION\tNEWEST\tCOMMITTED\tLAG")
+	for _, pl := range lags {
+		committed := "-"
+		if pl.Committed >= 0 {
+			committed = strconv.FormatInt(pl.Committed, 10)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%d\t%s\t%d\n", pl.Task, groups[pl.Task], pl.Topic, pl.Partition, pl.Newest, committed, pl.Lag)
+	}
+	return tw.Flush()
+}
+
+// committedOffsets returns committed offsets of each task. Partitions without a committed offset are left out.
+func committedOffsets(cfg *config.Config) (result []*taskOffsets, err error) {
+	var lags []rcm.PartitionLag
+	if lags, err = rcm.GetPartitionLags(cfg); err != nil {
+		return
+	}
+	byTask := make(map[string]*taskOffsets)
+	for _, t := range cfg.Tasks {
+		o := &taskOffsets{Task: t.Name, Group: t.ConsumerGroup, Topic: t.Topic, Offsets: make(map[int32]int64)}
+		byTask[t.Name] = o
+		result = append(result, o)
+	}
+	for _, pl := range lags {
+		if pl.Committed >= 0 {
+			byTask[pl.Task].Offsets[pl.Partition] = pl.Committed
+		}
+	}
+	return
+}
+
+func export(cfg *config.Config) (err error) {
+	var result []*taskOffsets
+	if result, err = committedOffsets(cfg); err != nil {
+		return
+	}
+	b, _ := json.MarshalIndent(result, "", "  ")
+	fmt.Println(string(b))
+	return
+}
+
+// parseTarget parses -to into sarama.OffsetOldest, sarama.OffsetNewest, or a timestamp in milliseconds.
+func parseTarget(s string) (at int64, err error) {
+	switch s {
+	case "earliest":
+		return sarama.OffsetOldest, nil
+	case "latest":
+		return sarama.OffsetNewest, nil
+	}
+	if at, err = strconv.ParseInt(s, 10, 64); err == nil && at >= 0 {
+		return
+	}
+	var t time.Time
+	if t, err = time.Parse(time.RFC3339Nano, s); err != nil {
+		err = errors.Errorf("invalid target %s", s)
+		return
+	}
+	return t.UnixNano() / int64(time.Millisecond), nil
+}
+
+// parseOffsets parses comma-separated partition:offset.
+func parseOffsets(s string) (result map[int32]int64, err error) {
+	result = make(map[int32]int64)
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		parts := strings.Split(item, ":")
+		var p, off int64
+		if len(parts) != 2 {
+			err = errors.Errorf("invalid partition offset %s", item)
+			return
+		}
+		if p, err = strconv.ParseInt(parts[0], 10, 32); err != nil || p < 0 {
+			err = errors.Errorf("invalid partition offset %s", item)
+			return
+		}
+		if off, err = strconv.ParseInt(parts[1], 10, 64); err != nil || off < 0 {
+			err = errors.Errorf("invalid partition offset %s", item)
+			return
+		}
+		result[int32(p)] = off
+	}
+	return
+}
+
+// resolveOffsets returns the offset of each partition of the topic at the target, which is the newest one if no
+// message is at or after the timestamp.
+func resolveOffsets(kfkCfg *config.KafkaConfig, topic string, at int64) (result map[int32]int64, err error) {
+	var sarCfg *sarama.Config
+	if sarCfg, err = input.GetSaramaConfig(kfkCfg); err != nil {
+		return
+	}
+	var client sarama.Client
+	if client, err = sarama.NewClient(strings.Split(kfkCfg.Brokers, ","), sarCfg); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	defer client.Close()
+	var partitions []int32
+	if err = input.RetryKafka(func() (err error) {
+		partitions, err = client.Partitions(topic)
+		return
+	}); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	result = make(map[int32]int64)
+	for _, p := range partitions {
+		var offset int64
+		if offset, err = input.GetOffset(client, topic, p, at); err != nil {
+			return
+		}
+		if offset < 0 {
+			if offset, err = input.GetOffset(client, topic, p, sarama.OffsetNewest); err != nil {
+				return
+			}
+		}
+		result[p] = offset
+	}
+	return
+}
+
+// commit commits offsets of the task, or prints them if dry-run.
+func commit(cfg *config.Config, taskCfg *config.TaskConfig, target map[int32]int64) (err error) {
+	partitions := make([]int, 0, len(target))
+	for p := range target {
+		partitions = append(partitions, int(p))
+	}
+	sort.Ints(partitions)
+	for _, p := range partitions {
+		fmt.Printf("%s\t%s\t%s\t%d\t%d\n", taskCfg.Name, taskCfg.ConsumerGroup, taskCfg.Topic, p, target[int32(p)])
+	}
+	if *dryRun {
+		util.Logger.Info("dry run, offsets are not committed", zap.String("task", taskCfg.Name))
+		return
+	}
+	if len(target) == 0 {
+		return
+	}
+	_, err = input.SeekOffsets(&cfg.Kafka, taskCfg.ConsumerGroup, taskCfg.Topic, input.SeekNone, target)
+	return
+}
+
+func set(cfg *config.Config) (err error) {
+	if *inputFile != "" {
+		var b []byte
+		if b, err = os.ReadFile(*inputFile); err != nil {
+			err = errors.Wrapf(err, "")
+			return
+		}
+		var exported []*taskOffsets
+		if err = json.Unmarshal(b, &exported); err != nil {
+			err = errors.Wrapf(err, "%s", *inputFile)
+			return
+		}
+		for _, t := range cfg.Tasks {
+			for _, e := range exported {
+				if e.Task != t.Name {
+					continue
+				}
+				if e.Topic != t.Topic {
+					return errors.Errorf("topic of task %s has changed from %s to %s", t.Name, e.Topic, t.Topic)
+				}
+				if err = commit(cfg, t, e.Offsets); err != nil {
+					return
+				}
+			}
+		}
+		return
+	}
+	if len(cfg.Tasks) != 1 || *taskName == "" {
+		return errors.Errorf("-task is required")
+	}
+	taskCfg := cfg.Tasks[0]
+	var target map[int32]int64
+	switch {
+	case *to != "":
+		var at int64
+		if at, err = parseTarget(*to); err != nil {
+			return
+		}
+		if target, err = resolveOffsets(&cfg.Kafka, taskCfg.Topic, at); err != nil {
+			return
+		}
+	case *offsets != "":
+		if target, err = parseOffsets(*offsets); err != nil {
+			return
+		}
+	default:
+		return errors.Errorf("one of -to, -offsets and -input is required")
+	}
+	return commit(cfg, taskCfg, target)
+}
+
+// skip moves the committed offset of a partition forward by count, so that the task skips a poison message which it
+// fails on again and again.
+func skip(cfg *config.Config) (err error) {
+	if len(cfg.Tasks) != 1 || *taskName == "" || *partition < 0 || *count <= 0 {
+		return errors.Errorf("-task, -partition and a positive -count are required")
+	}
+	taskCfg := cfg.Tasks[0]
+	var lags []rcm.PartitionLag
+	if lags, err = rcm.GetPartitionLags(cfg); err != nil {
+		return
+	}
+	for _, pl := range lags {
+		if pl.Partition != int32(*partition) {
+			continue
+		}
+		if pl.Committed < 0 {
+			return errors.Errorf("no committed offset of partition %d", pl.Partition)
+		}
+		offset := pl.Committed + *count
+		if offset > pl.Newest {
+			offset = pl.Newest
+		}
+		return commit(cfg, taskCfg, map[int32]int64{pl.Partition: offset})
+	}
+	return errors.Errorf("topic %s has no partition %d", taskCfg.Topic, *partition)
+}
+
+func main() {
+	util.InitLogger([]string{"stderr"})
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, `Usage of %s
+    %s [flags] show|export|set|skip
+This util inspects and changes committed offsets of consumer groups of tasks, with Kafka settings of the config.
+show: print newest and committed offsets and lags of each partition.
+export: print committed offsets in JSON, which can be restored by set -input.
+set: commit offsets of a task by -to, -offsets or -input.
+skip: move the committed offset of -partition forward by -count to skip poison messages.
+Offsets can be changed only if the consumer group has no active member, which means the task shall be paused or
+stopped on all instances.
+`, os.Args[0], os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	cfg := loadConfig()
+	var err error
+	switch flag.Arg(0) {
+	case "show":
+		err = show(cfg)
+	case "export":
+		err = export(cfg)
+	case "set":
+		err = set(cfg)
+	case "skip":
+		err = skip(cfg)
+	default:
+		flag.Usage()
+		os.Exit(1)
+	}
+	if err != nil {
+		util.Logger.Fatal("got error", zap.Error(err))
+	}
+}
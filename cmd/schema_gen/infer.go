@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/forever765/clickhouse_sinker_nali/model"
+)
+
+var fractionRegexp = regexp.MustCompile(`:\d{2}[.,](\d+)`)
+
+// fieldStats is what has been seen of a field in sampled messages.
+type fieldStats struct {
+	name     string
+	types    map[int]int // by detected type
+	present  int         // messages having a non-null value
+	distinct map[string]struct{}
+	overflow bool // distinct values exceed maxDistinct
+	fraction int  // max digits of fractional seconds of DateTime values
+}
+
+// inferer infers column types from messages, with the type detection of DynamicSchema.
+type inferer struct {
+	fields      map[string]*fieldStats
+	order       []string // fields in order of appearance
+	messages    int
+	maxDistinct int // LowCardinality is suggested for strings with at most maxDistinct values
+}
+
+func newInferer(maxDistinct int) *inferer {
+	return &inferer{fields: make(map[string]*fieldStats), maxDistinct: maxDistinct}
+}
+
+func (in *inferer) add(metric model.Metric) {
+	in.messages++
+	var knownKeys, newKeys sync.Map
+	metric.GetNewKeys(&knownKeys, &newKeys, nil, nil)
+	var names []string
+	newKeys.Range(func(key, _ interface{}) bool {
+		names = append(names, key.(string))
+		return true
+	})
+	// fields new to the sample are appended in order of names
+	sort.Strings(names)
+	for _, name := range names {
+		value, _ := newKeys.Load(name)
+		typ := value.(int)
+		fs := in.fields[name]
+		if fs == nil {
+			fs = &fieldStats{name: name, types: make(map[int]int), distinct: make(map[string]struct{})}
+			in.fields[name] = fs
+			in.order = append(in.order, name)
+		}
+		fs.types[typ]++
+		fs.present++
+		switch typ {
+		case model.String:
+			if !fs.overflow {
+				fs.distinct[metric.GetString(name, false).(string)] = struct{}{}
+				if len(fs.distinct) > in.maxDistinct {
+					fs.overflow = true
+					fs.distinct = nil
+				}
+			}
+		case model.DateTime:
+			if m := fractionRegexp.FindStringSubmatch(metric.GetString(name, false).(string)); m != nil && len(m[1]) > fs.fraction {
+				fs.fraction = len(m[1])
+			}
+		}
+	}
+}
+
+// column is a suggested column of a field.
+type column struct {
+	name    string
+	typ     string
+	comment string
+}
+
+// columns returns suggested columns in order of appearance of fields. Fields never seen with a detectable value are
+// left out.
+func (in *inferer) columns() (cols []column) {
+	for _, name := range in.order {
+		fs := in.fields[name]
+		typ, comment := in.resolve(fs)
+		cols = append(cols, column{name: name, typ: typ, comment: comment})
+	}
+	return
+}
+
+// resolve returns the ClickHouse type of the field, and a comment of what's uncertain.
+func (in *inferer) resolve(fs *fieldStats) (typ, comment string) {
+	types := make([]int, 0, len(fs.types))
+	for t := range fs.types {
+		types = append(types, t)
+	}
+	sort.Ints(types)
+	dataType := types[0]
+	switch {
+	case len(types) == 1:
+	case len(types) == 2 && types[0] == model.Int && types[1] == model.Float:
+		dataType = model.Float
+	case len(types) == 2 && types[0] == model.String && types[1] == model.DateTime:
+		dataType = model.String
+		comment = "some values are not DateTime"
+	case len(types) == 2 && types[0] == model.IntArray && types[1] == model.FloatArray:
+		dataType = model.FloatArray
+	default:
+		names := make([]string, len(types))
+		for i, t := range types {
+			names[i] = model.GetTypeName(t)
+		}
+		dataType = model.String
+		comment = "mixed types " + strings.Join(names, ", ")
+	}
+
+	switch dataType {
+	case model.Int:
+		typ = "Int64"
+	case model.Float:
+		typ = "Float64"
+	case model.DateTime:
+		typ = "DateTime"
+		if fs.fraction > 0 {
+			precision := 3
+			if fs.fraction > 6 {
+				precision = 9
+			} else if fs.fraction > 3 {
+				precision = 6
+			}
+			typ = fmt.Sprintf("DateTime64(%d)", precision)
+		}
+	case model.IntArray:
+		return "Array(Int64)", comment
+	case model.FloatArray:
+		return "Array(Float64)", comment
+	case model.StringArray:
+		return "Array(String)", comment
+	case model.DateTimeArray:
+		return "Array(DateTime)", comment
+	default:
+		typ = "String"
+	}
+	if fs.present < in.messages {
+		typ = fmt.Sprintf("Nullable(%s)", typ)
+		if comment == "" {
+			comment = fmt.Sprintf("absent or null in %d of %d messages", in.messages-fs.present, in.messages)
+		}
+	}
+	// values repeat a lot
+	if len(types) == 1 && dataType == model.String && !fs.overflow && len(fs.distinct)*10 <= fs.present {
+		typ = fmt.Sprintf("LowCardinality(%s)", typ)
+	}
+	return
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/forever765/clickhouse_sinker_nali/config"
+	"github.com/forever765/clickhouse_sinker_nali/input"
+	"github.com/forever765/clickhouse_sinker_nali/parser"
+	"github.com/forever765/clickhouse_sinker_nali/util"
+)
+
+var (
+	localCfgFile = flag.String("local-cfg-file", "", "local config file whose kafka section is used to connect to brokers, empty means plaintext")
+	brokers      = flag.String("brokers", "", "comma-separated brokers, overrides those of the config file")
+	topic        = flag.String("topic", "", "topic to sample")
+	messages     = flag.Int("messages", 1000, "number of the newest messages to sample, spread over partitions")
+	parserName   = flag.String("parser", "fastjson", "parser of messages, fastjson or gjson")
+	database     = flag.String("database", "default", "database of the table")
+	table        = flag.String("table", "", "table name, default to the topic")
+	cluster      = flag.String("cluster", "", "cluster to create a ReplicatedMergeTree table on, empty means a local MergeTree table")
+	lowCard      = flag.Int("low-cardinality", 1000, "max distinct values of a String field to suggest LowCardinality")
+	timeout      = flag.Duration("timeout", 30*time.Second, "max time to sample messages")
+)
+
+// taskStanza is the suggested task config.
+type taskStanza struct {
+	Name           string   `json:"name"`
+	Topic          string   `json:"topic"`
+	ConsumerGroup  string   `json:"consumerGroup"`
+	Earliest       bool     `json:"earliest"`
+	Parser         string   `json:"parser"`
+	AutoSchema     bool     `json:"autoSchema"`
+	TableName      string   `json:"tableName"`
+	ExcludeColumns []string `json:"excludeColumns"`
+	BufferSize     int      `json:"bufferSize"`
+}
+
+func kafkaConfig() (kfkCfg *config.KafkaConfig, err error) {
+	kfkCfg = &config.KafkaConfig{Version: "2.1.0"}
+	if *localCfgFile != "" {
+		var cfg *config.Config
+		if cfg, err = config.ParseLocalCfgFile(*localCfgFile); err != nil {
+			return
+		}
+		if err = cfg.Normallize(); err != nil {
+			return
+		}
+		kfkCfg = &cfg.Kafka
+	}
+	if *brokers != "" {
+		kfkCfg.Brokers = *brokers
+	}
+	if kfkCfg.Brokers == "" {
+		err = errors.Errorf("brokers are not given")
+	}
+	return
+}
+
+// sample returns up to n of the newest messages of the topic, which are taken evenly from partitions.
+func sample(kfkCfg *config.KafkaConfig, n int) (values [][]byte, err error) {
+	var sarCfg *sarama.Config
+	if sarCfg, err = input.GetSaramaConfig(kfkCfg); err != nil {
+		return
+	}
+	var client sarama.Client
+	if client, err = sarama.NewClient(strings.Split(kfkCfg.Brokers, ","), sarCfg); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	defer client.Close()
+	var consumer sarama.Consumer
+	if consumer, err = sarama.NewConsumerFromClient(client); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	defer consumer.Close()
+	var partitions []int32
+	if partitions, err = client.Partitions(*topic); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	perPartition := int64((n + len(partitions) - 1) / len(partitions))
+	deadline := time.After(*timeout)
+	for _, partition := range partitions {
+		var oldest, newest int64
+		if oldest, err = client.GetOffset(*topic, partition, sarama.OffsetOldest); err != nil {
+			err = errors.Wrapf(err, "")
+			return
+		}
+		if newest, err = client.GetOffset(*topic, partition, sarama.OffsetNewest); err != nil {
+			err = errors.Wrapf(err, "")
+			return
+		}
+		begin := newest - perPartition
+		if begin < oldest {
+			begin = oldest
+		}
+		if begin >= newest {
+			continue
+		}
+		var pc sarama.PartitionConsumer
+		if pc, err = consumer.ConsumePartition(*topic, partition, begin); err != nil {
+			err = errors.Wrapf(err, "")
+			return
+		}
+	LOOP:
+		for len(values) < n {
+			select {
+			case msg := <-pc.Messages():
+				values = append(values, msg.Value)
+				if msg.Offset >= newest-1 {
+					break LOOP
+				}
+			case <-deadline:
+				util.Logger.Warn("sampling timed out", zap.Int("messages", len(values)))
+				pc.Close()
+				return
+			}
+		}
+		pc.Close()
+	}
+	return
+}
+
+// printDDL prints the CREATE TABLE statement. The first non-nullable DateTime column is used as the partition and
+// sorting key.
+func printDDL(cols []column) {
+	tbl := fmt.Sprintf("%s.%s", *database, *table)
+	var onCluster, engine = "", "MergeTree()"
+	if *cluster != "" {
+		onCluster = fmt.Sprintf(" ON CLUSTER %s", *cluster)
+		engine = "ReplicatedMergeTree('/clickhouse/tables/{cluster}/{database}/{table}/{shard}', '{replica}')"
+	}
+	var timeCol string
+	fmt.Printf("CREATE TABLE %s%s (\n", tbl, onCluster)
+	for i, c := range cols {
+		if timeCol == "" && strings.HasPrefix(c.typ, "DateTime") {
+			timeCol = c.name
+		}
+		sep := ","
+		if i == len(cols)-1 {
+			sep = ""
+		}
+		if c.comment != "" {
+			sep += " -- " + c.comment
+		}
+		fmt.Printf("    `%s` %s%s\n", c.name, c.typ, sep)
+	}
+	fmt.Printf(") ENGINE = %s\n", engine)
+	if timeCol != "" {
+		fmt.Printf("PARTITION BY toYYYYMMDD(`%s`)\nORDER BY `%s`;\n", timeCol, timeCol)
+	} else {
+		fmt.Printf("ORDER BY tuple();\n")
+	}
+}
+
+func main() {
+	util.InitLogger([]string{"stderr"})
+	// GetNewKeys warns of every null value
+	util.SetLogSampling(10, 0)
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, `Usage of %s
+This util samples messages of a topic, infers types of fields like DynamicSchema, and prints a suggested ClickHouse
+table and task config. Review them before use, since a sample may not cover all fields and values.
+`, os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if *topic == "" || *messages <= 0 || (*parserName != "fastjson" && *parserName != "gjson") {
+		flag.Usage()
+		os.Exit(1)
+	}
+	if *table == "" {
+		*table = strings.NewReplacer("-", "_", ".", "_").Replace(*topic)
+	}
+	kfkCfg, err := kafkaConfig()
+	if err != nil {
+		util.Logger.Fatal("got error", zap.Error(err))
+	}
+	values, err := sample(kfkCfg, *messages)
+	if err != nil {
+		util.Logger.Fatal("failed to sample messages", zap.Error(err))
+	}
+	pp, _ := parser.NewParserPool(*parserName, nil, "", "", 1.0)
+	p := pp.Get()
+	in := newInferer(*lowCard)
+	var malformed int
+	for _, value := range values {
+		metric, err := p.Parse(value)
+		if err != nil {
+			malformed++
+			continue
+		}
+		in.add(metric)
+	}
+	cols := in.columns()
+	if len(cols) == 0 {
+		util.Logger.Fatal("no field detected", zap.Int("messages", len(values)), zap.Int("malformed", malformed))
+	}
+	util.Logger.Info("sampled", zap.Int("messages", len(values)), zap.Int("malformed", malformed), zap.Int("fields", len(cols)))
+
+	printDDL(cols)
+	stanza := taskStanza{
+		Name:           *table,
+		Topic:          *topic,
+		ConsumerGroup:  *table,
+		Parser:         *parserName,
+		AutoSchema:     true,
+		TableName:      *table,
+		ExcludeColumns: []string{},
+		BufferSize:     50000,
+	}
+	b, _ := json.MarshalIndent(stanza, "", "  ")
+	fmt.Printf("\n%s\n", b)
+}
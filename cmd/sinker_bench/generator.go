@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/forever765/clickhouse_sinker_nali/config"
+	"github.com/forever765/clickhouse_sinker_nali/input"
+	"github.com/forever765/clickhouse_sinker_nali/model"
+	"github.com/forever765/clickhouse_sinker_nali/output"
+	"github.com/forever765/clickhouse_sinker_nali/util"
+)
+
+// numGenerated is the number of distinct messages generated from the schema, which are sent in turn.
+const numGenerated = 10000
+
+// generator produces messages to the topic of the task as fast as possible.
+type generator struct {
+	producer sarama.AsyncProducer
+	topic    string
+	messages [][]byte
+}
+
+func newGenerator(cfg *config.Config, taskCfg *config.TaskConfig, inputFile string) (g *generator, err error) {
+	g = &generator{topic: taskCfg.Topic}
+	if inputFile != "" {
+		g.messages, err = loadSamples(inputFile)
+	} else {
+		g.messages, err = generateMessages(cfg, taskCfg)
+	}
+	if err != nil {
+		return
+	}
+	var sarCfg *sarama.Config
+	if sarCfg, err = input.GetSaramaConfig(&cfg.Kafka); err != nil {
+		return
+	}
+	if g.producer, err = sarama.NewAsyncProducer(strings.Split(cfg.Kafka.Brokers, ","), sarCfg); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	go func() {
+		for err := range g.producer.Errors() {
+			util.Logger.Error("failed to produce", zap.Error(err))
+		}
+	}()
+	return
+}
+
+// produce sends n messages without waiting for acknowledgement.
+func (g *generator) produce(n int) {
+	ch := g.producer.Input()
+	for i := 0; i < n; i++ {
+		ch <- &sarama.ProducerMessage{Topic: g.topic, Value: sarama.ByteEncoder(g.messages[i%len(g.messages)])}
+	}
+}
+
+func (g *generator) close() {
+	_ = g.producer.Close()
+}
+
+// loadSamples reads one JSON message per line.
+func loadSamples(path string) (samples [][]byte, err error) {
+	var f *os.File
+	if f, err = os.Open(path); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) != 0 {
+			samples = append(samples, append([]byte(nil), line...))
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	if len(samples) == 0 {
+		err = errors.Errorf("no samples in %s", path)
+	}
+	return
+}
+
+// generateMessages returns messages with random values of columns of the task. Values of types with a restricted
+// format, such as UUID and Enum, are likely rejected by ClickHouse, so such tables need samples instead.
+func generateMessages(cfg *config.Config, taskCfg *config.TaskConfig) (messages [][]byte, err error) {
+	ck := output.NewClickHouse(cfg, taskCfg)
+	if err = ck.Init(); err != nil {
+		return
+	}
+	for i := 0; i < numGenerated; i++ {
+		msg := make(map[string]interface{}, len(ck.Dims))
+		for _, dim := range ck.Dims {
+			msg[strings.Replace(dim.SourceName, "\\.", ".", -1)] = randomValue(dim.Type)
+		}
+		b, _ := json.Marshal(msg)
+		messages = append(messages, b)
+	}
+	return
+}
+
+func randomValue(typ int) interface{} {
+	switch typ {
+	case model.Int:
+		return rand.Intn(100) // fits in Int8
+	case model.Float:
+		return float64(rand.Intn(100000)) / 100
+	case model.String:
+		return fmt.Sprintf("v%d", rand.Intn(1000))
+	case model.DateTime, model.ElasticDateTime:
+		return time.Now().Add(-time.Duration(rand.Intn(3600)) * time.Second).UTC().Format(time.RFC3339)
+	case model.IntArray:
+		return []interface{}{randomValue(model.Int), randomValue(model.Int)}
+	case model.FloatArray:
+		return []interface{}{randomValue(model.Float), randomValue(model.Float)}
+	case model.StringArray:
+		return []interface{}{randomValue(model.String), randomValue(model.String)}
+	case model.DateTimeArray:
+		return []interface{}{randomValue(model.DateTime), randomValue(model.DateTime)}
+	}
+	return nil
+}
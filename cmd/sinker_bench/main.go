@@ -0,0 +1,244 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"go.uber.org/zap"
+
+	"github.com/forever765/clickhouse_sinker_nali/config"
+	"github.com/forever765/clickhouse_sinker_nali/pool"
+	"github.com/forever765/clickhouse_sinker_nali/statistics"
+	"github.com/forever765/clickhouse_sinker_nali/task"
+	"github.com/forever765/clickhouse_sinker_nali/util"
+)
+
+var (
+	localCfgFile   = flag.String("local-cfg-file", "/etc/clickhouse_sinker_nali.json", "local config file")
+	taskName       = flag.String("task", "", "task to benchmark, default to the first one")
+	inputFile      = flag.String("input", "", "sample file, one JSON message per line, empty means random messages per the table schema")
+	rows           = flag.Int("rows", 1000000, "number of messages of each run")
+	bufferSizes    = flag.String("buffer-sizes", "", "comma-separated bufferSize(batch size) of runs, empty means the one of the task")
+	flushIntervals = flag.String("flush-intervals", "", "comma-separated flushInterval(seconds) of runs, empty means the one of the task")
+	parsingWorkers = flag.String("parsing-workers", "", "comma-separated sizes of the parsing pool of runs, empty means the default")
+	maxOpenConns   = flag.String("max-open-conns", "", "comma-separated clickhouse.maxOpenConns of runs, which sizes the writing pool, empty means the configured one")
+	warmup         = flag.Duration("warmup", 10*time.Second, "time for the task to join the consumer group before producing")
+	timeout        = flag.Duration("timeout", 10*time.Minute, "max time of each run to write all messages")
+)
+
+// params is a point of the sweep.
+type params struct {
+	bufferSize     int
+	flushInterval  int
+	parsingWorkers int
+	maxOpenConns   int
+}
+
+type result struct {
+	params
+	written  float64 // rows
+	errors   float64 // messages failed to parse or write
+	elapsed  time.Duration
+	complete bool // all messages are written or failed before timeout
+	e2eP50   float64
+	e2eP99   float64
+	flushP99 float64
+}
+
+func loadConfig() (cfg *config.Config, taskCfg *config.TaskConfig) {
+	var err error
+	if cfg, err = config.ParseLocalCfgFile(*localCfgFile); err != nil {
+		util.Logger.Fatal("config.ParseLocalCfgFile failed", zap.Error(err))
+	}
+	if err = cfg.Normallize(); err != nil {
+		util.Logger.Fatal("cfg.Normallize failed", zap.Error(err))
+	}
+	for _, t := range cfg.Tasks {
+		if *taskName == "" || t.Name == *taskName {
+			return cfg, t
+		}
+	}
+	util.Logger.Fatal("task not found", zap.String("task", *taskName))
+	return
+}
+
+// parseInts parses comma-separated positive integers, or returns def if s is empty.
+func parseInts(s string, def int) (values []int, err error) {
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		var v int
+		if v, err = strconv.Atoi(item); err != nil || v <= 0 {
+			err = errors.Errorf("invalid value %s", item)
+			return
+		}
+		values = append(values, v)
+	}
+	if len(values) == 0 {
+		values = []int{def}
+	}
+	return
+}
+
+// sweep returns the cartesian product of values of all parameters.
+func sweep(cfg *config.Config, taskCfg *config.TaskConfig) (points []params, err error) {
+	var bufs, intervals, parsings, conns []int
+	if bufs, err = parseInts(*bufferSizes, taskCfg.BufferSize); err != nil {
+		return
+	}
+	if intervals, err = parseInts(*flushIntervals, taskCfg.FlushInterval); err != nil {
+		return
+	}
+	if parsings, err = parseInts(*parsingWorkers, util.DefaultParsingWorkers()); err != nil {
+		return
+	}
+	if conns, err = parseInts(*maxOpenConns, cfg.Clickhouse.MaxOpenConns); err != nil {
+		return
+	}
+	for _, buf := range bufs {
+		if buf > config.MaxBufferSize {
+			buf = config.MaxBufferSize
+		}
+		buf = 1 << util.GetShift(buf)
+		for _, interval := range intervals {
+			for _, parsing := range parsings {
+				for _, conn := range conns {
+					points = append(points, params{bufferSize: buf, flushInterval: interval, parsingWorkers: parsing, maxOpenConns: conn})
+				}
+			}
+		}
+	}
+	return
+}
+
+// run runs a copy of the task with the params, which consumes from the newest offsets with its own consumer group,
+// and returns once all n messages produced are written or failed.
+func run(cfg *config.Config, taskCfg *config.TaskConfig, g *generator, seq int, p params, n int) (r result, err error) {
+	r.params = p
+	runCfg := *taskCfg
+	runCfg.Name = fmt.Sprintf("%s_bench_%d", taskCfg.Name, seq)
+	runCfg.ConsumerGroup = fmt.Sprintf("%s_bench_%d_%d", taskCfg.ConsumerGroup, time.Now().Unix(), seq)
+	runCfg.Earliest = false
+	runCfg.BufferSize = p.bufferSize
+	runCfg.FlushInterval = p.flushInterval
+	// measure the capacity instead of quotas
+	runCfg.Tenant = ""
+	runCfg.RateLimit = config.RateLimitConfig{}
+
+	cfg.Clickhouse.MaxOpenConns = p.maxOpenConns
+	if err = pool.InitClusterConn(&cfg.Clickhouse); err != nil {
+		return
+	}
+	util.GlobalParsingPool.Resize(p.parsingWorkers)
+	util.GlobalWritingPool.Resize(len(cfg.Clickhouse.Hosts) * p.maxOpenConns)
+
+	service := task.NewTaskService(cfg, &runCfg)
+	if err = service.Init(); err != nil {
+		return
+	}
+	go service.Run()
+	defer service.Stop()
+	time.Sleep(*warmup)
+
+	begin := time.Now()
+	g.produce(n)
+	deadline := begin.Add(*timeout)
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for range ticker.C {
+		r.written = counterValue(statistics.FlushMsgsTotal, runCfg.Name)
+		r.errors = counterValue(statistics.ParseMsgsErrorTotal, runCfg.Name, "parse") + counterValue(statistics.FlushMsgsErrorTotal, runCfg.Name)
+		if r.complete = r.written+r.errors >= float64(n); r.complete || time.Now().After(deadline) {
+			break
+		}
+	}
+	r.elapsed = time.Since(begin)
+	r.e2eP50, r.e2eP99 = histogramQuantile(statistics.EndToEndLatency, runCfg.Name, 0.5), histogramQuantile(statistics.EndToEndLatency, runCfg.Name, 0.99)
+	r.flushP99 = histogramQuantile(statistics.FlushDuration, runCfg.Name, 0.99)
+	return
+}
+
+func counterValue(vec *prometheus.CounterVec, labels ...string) float64 {
+	var m dto.Metric
+	_ = vec.WithLabelValues(labels...).Write(&m)
+	return m.GetCounter().GetValue()
+}
+
+func histogramQuantile(vec *prometheus.HistogramVec, taskName string, q float64) float64 {
+	var m dto.Metric
+	if h, ok := vec.WithLabelValues(taskName).(prometheus.Metric); ok {
+		_ = h.Write(&m)
+	}
+	buckets := make(map[float64]uint64)
+	statistics.AddBuckets(buckets, m.GetHistogram())
+	value, _ := statistics.Quantile(q, buckets, nil)
+	return value
+}
+
+func report(results []result) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "BUFFER SIZE\tFLUSH INTERVAL\tPARSING WORKERS\tMAX OPEN CONNS\tWRITTEN\tERRORS\tELAPSED\tROWS/S\tE2E P50\tE2E P99\tFLUSH P99")
+	for _, r := range results {
+		elapsed := r.elapsed.Round(time.Millisecond).String()
+		if !r.complete {
+			elapsed += "(timeout)"
+		}
+		fmt.Fprintf(tw, "%d\t%ds\t%d\t%d\t%.0f\t%.0f\t%s\t%.0f\t%.3fs\t%.3fs\t%.3fs\n", r.bufferSize, r.flushInterval, r.parsingWorkers,
+			r.maxOpenConns, r.written, r.errors, elapsed, r.written/r.elapsed.Seconds(), r.e2eP50, r.e2eP99, r.flushP99)
+	}
+	tw.Flush()
+}
+
+func main() {
+	util.InitLogger([]string{"stdout"})
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, `Usage of %s
+This util runs a task against its Kafka and ClickHouse with each combination of the given bufferSize, flushInterval,
+parsing pool and writing pool sizes, feeds it from an embedded generator, and reports throughput and latency.
+Rows are written to the table of the task.
+`, os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if *rows <= 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	cfg, taskCfg := loadConfig()
+	points, err := sweep(cfg, taskCfg)
+	if err != nil {
+		util.Logger.Fatal("got error", zap.Error(err))
+	}
+	if err = pool.InitClusterConn(&cfg.Clickhouse); err != nil {
+		util.Logger.Fatal("pool.InitClusterConn failed", zap.Error(err))
+	}
+	util.InitGlobalParsingPool()
+	util.InitGlobalWritingPool(len(cfg.Clickhouse.Hosts) * cfg.Clickhouse.MaxOpenConns)
+	g, err := newGenerator(cfg, taskCfg, *inputFile)
+	if err != nil {
+		util.Logger.Fatal("newGenerator failed", zap.Error(err))
+	}
+	defer g.close()
+
+	results := make([]result, 0, len(points))
+	for i, p := range points {
+		util.Logger.Info("running", zap.Int("run", i+1), zap.Int("runs", len(points)), zap.Int("bufferSize", p.bufferSize),
+			zap.Int("flushInterval", p.flushInterval), zap.Int("parsingWorkers", p.parsingWorkers), zap.Int("maxOpenConns", p.maxOpenConns))
+		r, err := run(cfg, taskCfg, g, i, p, *rows)
+		if err != nil {
+			util.Logger.Fatal("run failed", zap.Error(err))
+		}
+		util.Logger.Info("done", zap.Int("run", i+1), zap.Float64("written", r.written), zap.Duration("elapsed", r.elapsed))
+		results = append(results, r)
+	}
+	report(results)
+}
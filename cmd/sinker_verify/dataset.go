@@ -0,0 +1,166 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/forever765/clickhouse_sinker_nali/config"
+	"github.com/forever765/clickhouse_sinker_nali/model"
+	"github.com/forever765/clickhouse_sinker_nali/util"
+)
+
+const selectColumnsSQL = `select name, type, default_kind from system.columns where database = '%s' and table = '%s'`
+
+var wrapperRegexp = regexp.MustCompile(`^(Nullable|LowCardinality|Array)\((.+)\)$`)
+
+// column is a column of the table, whose values are generated from the row index, so that its checksum over any set
+// of rows is known in advance.
+type column struct {
+	name     string
+	key      string // field name in messages
+	elemType string // ClickHouse type without Nullable, LowCardinality and Array
+	dataType int    // of elements
+	array    bool
+}
+
+// newColumn returns nil if the type is not supported, or its values can't be verified, such as UUID and Enum.
+func newColumn(name, key, typ string) (c *column) {
+	c = &column{name: name, key: key}
+	for m := wrapperRegexp.FindStringSubmatch(typ); m != nil; m = wrapperRegexp.FindStringSubmatch(typ) {
+		c.array = c.array || m[1] == "Array"
+		typ = m[2]
+	}
+	var ok bool
+	if c.dataType, _, ok = model.TryWhichType(typ); !ok {
+		return nil
+	}
+	c.elemType = typ
+	switch c.dataType {
+	case model.Int, model.Float:
+	case model.String:
+		if typ != "String" {
+			return nil
+		}
+	case model.DateTime:
+		if !strings.HasPrefix(typ, "DateTime") {
+			return nil // Date and Date32 depend on the time zone of the server
+		}
+	default:
+		return nil
+	}
+	return
+}
+
+// value returns the value of row i.
+func (c *column) value(i int, base time.Time) interface{} {
+	if !c.array {
+		return c.scalar(i, base)
+	}
+	arr := make([]interface{}, i%3)
+	for j := range arr {
+		arr[j] = c.scalar(i, base)
+	}
+	return arr
+}
+
+func (c *column) scalar(i int, base time.Time) interface{} {
+	switch c.dataType {
+	case model.Int:
+		return i % 100 // fits in Int8
+	case model.Float:
+		if strings.HasPrefix(c.elemType, "Float") {
+			return float64(i%1000) / 4 // exact in Float32
+		}
+		return float64(i % 1000) // exact in Decimal of any scale
+	case model.DateTime:
+		return base.Add(time.Duration(i) * time.Second).UTC().Format(time.RFC3339)
+	default:
+		return fmt.Sprintf("v%d", i)
+	}
+}
+
+// checksumExpr returns the aggregate function whose result over a set of rows is the sum of weights of them.
+func (c *column) checksumExpr(base time.Time) string {
+	col := "`" + c.name + "`"
+	if c.array {
+		return fmt.Sprintf("sum(length(%s))", col)
+	}
+	switch c.dataType {
+	case model.Int:
+		return fmt.Sprintf("sum(toInt64(%s))", col)
+	case model.Float:
+		return fmt.Sprintf("sum(toFloat64(%s))", col)
+	case model.DateTime:
+		return fmt.Sprintf("sum(toInt64(toDateTime(%s)) - %d)", col, base.Unix())
+	default:
+		return fmt.Sprintf("sum(length(%s))", col)
+	}
+}
+
+// weight returns the contribution of row i to the checksum.
+func (c *column) weight(i int, base time.Time) float64 {
+	if c.array {
+		return float64(i % 3)
+	}
+	switch c.dataType {
+	case model.Int:
+		return float64(i % 100)
+	case model.Float:
+		return c.scalar(i, base).(float64)
+	case model.DateTime:
+		return float64(i)
+	default:
+		return float64(len(c.scalar(i, base).(string)))
+	}
+}
+
+// loadColumns returns columns of the task table, and names of those which can't be verified.
+func loadColumns(db *sql.DB, database string, taskCfg *config.TaskConfig) (columns []*column, skipped []string, err error) {
+	add := func(name, key, typ string) {
+		if c := newColumn(name, key, typ); c != nil {
+			columns = append(columns, c)
+		} else {
+			skipped = append(skipped, name)
+		}
+	}
+	if !taskCfg.AutoSchema {
+		for _, dim := range taskCfg.Dims {
+			key := strings.Replace(dim.SourceName, "\\.", ".", -1)
+			if key == "" {
+				key = dim.Name
+			}
+			add(dim.Name, key, dim.Type)
+		}
+		return
+	}
+	var rs *sql.Rows
+	if rs, err = db.Query(fmt.Sprintf(selectColumnsSQL, database, taskCfg.TableName)); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	defer rs.Close()
+	var name, typ, defaultKind string
+	for rs.Next() {
+		if err = rs.Scan(&name, &typ, &defaultKind); err != nil {
+			err = errors.Wrapf(err, "")
+			return
+		}
+		if util.StringContains(taskCfg.ExcludeColumns, name) || defaultKind == "MATERIALIZED" || defaultKind == "ALIAS" {
+			continue
+		}
+		add(name, name, typ)
+	}
+	if err = rs.Err(); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	if len(columns) == 0 && len(skipped) == 0 {
+		err = errors.Errorf("table %s.%s doesn't exist", database, taskCfg.TableName)
+	}
+	return
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/forever765/clickhouse_sinker_nali/config"
+	"github.com/forever765/clickhouse_sinker_nali/input"
+	"github.com/forever765/clickhouse_sinker_nali/model"
+	"github.com/forever765/clickhouse_sinker_nali/pool"
+	"github.com/forever765/clickhouse_sinker_nali/util"
+)
+
+var (
+	localCfgFile = flag.String("local-cfg-file", "/etc/clickhouse_sinker_nali.json", "local config file")
+	taskName     = flag.String("task", "", "task to verify, default to the first one")
+	rows         = flag.Int("rows", 10000, "number of messages to produce")
+	tagColumn    = flag.String("tag-column", "", "String column holding the tag of each row, default to the first String one")
+	timeout      = flag.Duration("timeout", 10*time.Minute, "max time to wait for ingestion")
+	pollInterval = flag.Duration("poll-interval", 5*time.Second, "interval to poll ClickHouse for ingested rows")
+)
+
+const batchSize = 1000
+
+// verifier produces a tagged dataset, and checks what has been written to ClickHouse. Each row is tagged with
+// "<runID>-<index>", and other columns are derived from the index.
+type verifier struct {
+	cfg     *config.Config
+	taskCfg *config.TaskConfig
+	tag     *column
+	columns []*column // verified by checksums
+	runID   string
+	base    time.Time
+}
+
+type columnResult struct {
+	name     string
+	expected float64
+	actual   float64
+}
+
+func loadTask() (cfg *config.Config, taskCfg *config.TaskConfig) {
+	var err error
+	if cfg, err = config.ParseLocalCfgFile(*localCfgFile); err != nil {
+		util.Logger.Fatal("config.ParseLocalCfgFile failed", zap.Error(err))
+	}
+	if err = cfg.Normallize(); err != nil {
+		util.Logger.Fatal("cfg.Normallize failed", zap.Error(err))
+	}
+	for _, t := range cfg.Tasks {
+		if *taskName == "" || t.Name == *taskName {
+			return cfg, t
+		}
+	}
+	util.Logger.Fatal("task not found", zap.String("task", *taskName))
+	return
+}
+
+func newVerifier(cfg *config.Config, taskCfg *config.TaskConfig) (v *verifier, skipped []string, err error) {
+	if taskCfg.Parser != "fastjson" && taskCfg.Parser != "gjson" {
+		err = errors.Errorf("Parser %s is not supported, only JSON is", taskCfg.Parser)
+		return
+	}
+	var db *sql.DB
+	if db, _, err = pool.GetShardConn(0).NextGoodReplica(0); err != nil {
+		return
+	}
+	var columns []*column
+	if columns, skipped, err = loadColumns(db, cfg.Clickhouse.DB, taskCfg); err != nil {
+		return
+	}
+	now := time.Now()
+	v = &verifier{
+		cfg:     cfg,
+		taskCfg: taskCfg,
+		runID:   fmt.Sprintf("verify-%d", now.UnixNano()),
+		base:    now.Truncate(time.Second),
+	}
+	for _, c := range columns {
+		if v.tag == nil && !c.array && c.dataType == model.String && (*tagColumn == "" || c.name == *tagColumn) {
+			v.tag = c
+		} else {
+			v.columns = append(v.columns, c)
+		}
+	}
+	if v.tag == nil {
+		err = errors.Errorf("no String column to hold the tag, tag-column: %q", *tagColumn)
+	}
+	return
+}
+
+func (v *verifier) message(i int) []byte {
+	msg := make(map[string]interface{}, len(v.columns)+1)
+	msg[v.tag.key] = fmt.Sprintf("%s-%d", v.runID, i)
+	for _, c := range v.columns {
+		msg[c.key] = c.value(i, v.base)
+	}
+	b, _ := json.Marshal(msg)
+	return b
+}
+
+// produce sends n messages, and waits until brokers have acknowledged all of them.
+func (v *verifier) produce(n int) (err error) {
+	var sarCfg *sarama.Config
+	if sarCfg, err = input.GetSaramaConfig(&v.cfg.Kafka); err != nil {
+		return
+	}
+	sarCfg.Producer.RequiredAcks = sarama.WaitForAll
+	sarCfg.Producer.Return.Successes = true
+	var producer sarama.SyncProducer
+	if producer, err = sarama.NewSyncProducer(strings.Split(v.cfg.Kafka.Brokers, ","), sarCfg); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	defer producer.Close()
+	msgs := make([]*sarama.ProducerMessage, 0, batchSize)
+	for i := 0; i < n; i++ {
+		msgs = append(msgs, &sarama.ProducerMessage{Topic: v.taskCfg.Topic, Value: sarama.ByteEncoder(v.message(i))})
+		if len(msgs) == batchSize || i == n-1 {
+			if err = producer.SendMessages(msgs); err != nil {
+				err = errors.Wrapf(err, "")
+				return
+			}
+			msgs = msgs[:0]
+		}
+	}
+	return
+}
+
+// queryShards runs the query on a replica of each shard.
+func (v *verifier) queryShards(query string, scan func(rs *sql.Rows) error) (err error) {
+	for i := 0; i < pool.NumShard(); i++ {
+		var db *sql.DB
+		if db, _, err = pool.GetShardConn(int64(i)).NextGoodReplica(0); err != nil {
+			return
+		}
+		var rs *sql.Rows
+		if rs, err = db.Query(query); err != nil {
+			err = errors.Wrapf(err, "")
+			return
+		}
+		for rs.Next() {
+			if err = scan(rs); err != nil {
+				rs.Close()
+				err = errors.Wrapf(err, "")
+				return
+			}
+		}
+		err = rs.Err()
+		rs.Close()
+		if err != nil {
+			err = errors.Wrapf(err, "")
+			return
+		}
+	}
+	return
+}
+
+func (v *verifier) selectSQL(exprs string) string {
+	return fmt.Sprintf("SELECT %s FROM %s.%s WHERE startsWith(`%s`, '%s-')", exprs, v.cfg.Clickhouse.DB, v.taskCfg.TableName, v.tag.name, v.runID)
+}
+
+func (v *verifier) count() (total int64, err error) {
+	err = v.queryShards(v.selectSQL("count()"), func(rs *sql.Rows) error {
+		var cnt uint64
+		if err := rs.Scan(&cnt); err != nil {
+			return err
+		}
+		total += int64(cnt)
+		return nil
+	})
+	return
+}
+
+// waitIngested waits until at least n rows have arrived and the count stays the same between two polls, or timeout.
+func (v *verifier) waitIngested(n int) (total int64, err error) {
+	deadline := time.Now().Add(*timeout)
+	prev := int64(-1)
+	for {
+		if total, err = v.count(); err != nil {
+			return
+		}
+		util.Logger.Info("waiting for ingestion", zap.Int64("rows", total), zap.Int("expected", n))
+		if (total >= int64(n) && total == prev) || time.Now().After(deadline) {
+			return
+		}
+		prev = total
+		time.Sleep(*pollInterval)
+	}
+}
+
+// tagCounts returns how many times each row has been written, and the number of rows whose tag is corrupted.
+func (v *verifier) tagCounts(n int) (counts []int, corrupted int, err error) {
+	counts = make([]int, n)
+	prefix := v.runID + "-"
+	err = v.queryShards(v.selectSQL(fmt.Sprintf("`%s`", v.tag.name)), func(rs *sql.Rows) error {
+		var tag string
+		if err := rs.Scan(&tag); err != nil {
+			return err
+		}
+		i, err := strconv.Atoi(strings.TrimPrefix(tag, prefix))
+		if err != nil || i < 0 || i >= n {
+			corrupted++
+			return nil
+		}
+		counts[i]++
+		return nil
+	})
+	return
+}
+
+// checksums compares the checksum of each column with the one expected from the rows written.
+func (v *verifier) checksums(counts []int) (results []columnResult, err error) {
+	if len(v.columns) == 0 {
+		return
+	}
+	results = make([]columnResult, len(v.columns))
+	exprs := make([]string, len(v.columns))
+	for j, c := range v.columns {
+		results[j].name = c.name
+		exprs[j] = c.checksumExpr(v.base)
+		for i, cnt := range counts {
+			results[j].expected += float64(cnt) * c.weight(i, v.base)
+		}
+	}
+	err = v.queryShards(v.selectSQL(strings.Join(exprs, ", ")), func(rs *sql.Rows) error {
+		sums := make([]sql.NullFloat64, len(v.columns))
+		dest := make([]interface{}, len(sums))
+		for j := range sums {
+			dest[j] = &sums[j]
+		}
+		if err := rs.Scan(dest...); err != nil {
+			return err
+		}
+		for j, s := range sums {
+			results[j].actual += s.Float64
+		}
+		return nil
+	})
+	return
+}
+
+func (r *columnResult) ok() bool {
+	return math.Abs(r.actual-r.expected) <= 1e-6*math.Max(1, math.Abs(r.expected))
+}
+
+func main() {
+	util.InitLogger([]string{"stdout"})
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, `Usage of %s
+This util produces a tagged dataset to the topic of a task, waits for sinker to ingest it, and compares row counts and
+per-column checksums in ClickHouse with the dataset. It exits with 1 if any row is lost, duplicated or corrupted.
+`, os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if *rows <= 0 || *pollInterval <= 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	cfg, taskCfg := loadTask()
+	if err := pool.InitClusterConn(&cfg.Clickhouse); err != nil {
+		util.Logger.Fatal("pool.InitClusterConn failed", zap.Error(err))
+	}
+	defer pool.CloseAll()
+	v, skipped, err := newVerifier(cfg, taskCfg)
+	if err != nil {
+		util.Logger.Fatal("got error", zap.Error(err))
+	}
+	util.Logger.Info("producing", zap.String("task", taskCfg.Name), zap.String("topic", taskCfg.Topic), zap.String("run", v.runID),
+		zap.String("tag column", v.tag.name), zap.Int("rows", *rows), zap.Strings("unverified columns", skipped))
+	begin := time.Now()
+	if err = v.produce(*rows); err != nil {
+		util.Logger.Fatal("failed to produce", zap.Error(err))
+	}
+	total, err := v.waitIngested(*rows)
+	if err != nil {
+		util.Logger.Fatal("failed to count rows", zap.Error(err))
+	}
+	elapsed := time.Since(begin)
+	counts, corrupted, err := v.tagCounts(*rows)
+	if err != nil {
+		util.Logger.Fatal("failed to query tags", zap.Error(err))
+	}
+	results, err := v.checksums(counts)
+	if err != nil {
+		util.Logger.Fatal("failed to query checksums", zap.Error(err))
+	}
+
+	var lost, duplicated int
+	for _, cnt := range counts {
+		if cnt == 0 {
+			lost++
+		} else {
+			duplicated += cnt - 1
+		}
+	}
+	fmt.Printf("run: %s, produced: %d, ingested: %d, elapsed: %v\n", v.runID, *rows, total, elapsed)
+	fmt.Printf("lost: %d, duplicated: %d, corrupted tags: %d\n\n", lost, duplicated, corrupted)
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "COLUMN\tEXPECTED\tACTUAL\tRESULT")
+	corruptedColumns := 0
+	for _, r := range results {
+		result := "ok"
+		if !r.ok() {
+			result = "MISMATCH"
+			corruptedColumns++
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", r.name, strconv.FormatFloat(r.expected, 'f', -1, 64), strconv.FormatFloat(r.actual, 'f', -1, 64), result)
+	}
+	for _, name := range skipped {
+		fmt.Fprintf(tw, "%s\t-\t-\tunverified\n", name)
+	}
+	tw.Flush()
+	if lost != 0 || duplicated != 0 || corrupted != 0 || corruptedColumns != 0 {
+		pool.CloseAll()
+		os.Exit(1)
+	}
+}
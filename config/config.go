@@ -16,8 +16,8 @@ limitations under the License.
 package config
 
 import (
-	"encoding/json"
-	"io/ioutil"
+	"math"
+	"path/filepath"
 	"regexp"
 	"strings"
 
@@ -32,11 +32,176 @@ type Config struct {
 	Clickhouse ClickHouseConfig
 	Task       *TaskConfig
 	Tasks      []*TaskConfig
-	Assignment Assignment
-	LogLevel   string
-	LogPaths   string
+	// TaskTemplates are expanded into Tasks at normallizing. The key is the template name.
+	TaskTemplates    map[string]TaskTemplate
+	Assignment       Assignment
+	LogLevel         string
+	LogPaths         string
 	SinkerListenPort int
-	GeoipFilePath	string
+	GeoipFilePath    string
+	GeoipUpdate      GeoipUpdateConfig
+	// EnrichPlugins are paths of Go plugins which register custom enrichment types
+	EnrichPlugins []string
+	// Tenants caps resources shared by tasks of each tenant. The key is the tenant name referred by TaskConfig.Tenant.
+	Tenants map[string]TenantConfig
+	// Defaults of tasks. Each task can override them.
+	FlushInterval int
+	FlushJitter   int
+	BufferSize    int
+	BufferBytes   int
+	TimeZone      string
+	// MaxInflightBatches is the default of tasks, there's no limit of all tasks.
+	MaxInflightBatches int
+	// Autoscale hints the number of replicas from lag and incoming rate of tasks.
+	Autoscale AutoscaleConfig
+	// ErrorEvents publishes failures of messages and batches to a Kafka topic.
+	ErrorEvents ErrorEventsConfig
+	// SlowPath logs and counts slow parsing and writing, so that pool sizing problems are visible before lagging.
+	SlowPath SlowPathConfig
+	// SelfMetrics writes metrics of tasks to a ClickHouse table.
+	SelfMetrics SelfMetricsConfig
+	// Watchdog dumps profiles when resources exceed thresholds, to help debugging OOM kills.
+	Watchdog WatchdogConfig
+	// LogSampling drops floods of identical logs, such as warnings of a malformed field in every message.
+	LogSampling LogSamplingConfig
+	// Alert posts to a webhook when tasks breach SLA thresholds, for teams without a full alerting stack.
+	Alert AlertConfig
+	// ParsingPool resizes the parsing pool at runtime by its queue depth and CPU utilization.
+	ParsingPool PoolConfig
+	// TaskRestart restarts a task whose parsing or writing panicked, instead of crashing the process.
+	TaskRestart RestartPolicy
+	// RateLimit throttles consuming and writing of all tasks together, in addition to limits of each task.
+	RateLimit RateLimitConfig
+	// Include lists layers merged before this one, see Loader.
+	Include []string `json:"include,omitempty"`
+
+	base *Config // merged included layers
+}
+
+// TenantConfig caps resources of a tenant, so that a noisy tenant can't degrade others. Zero values mean unlimited.
+// Quotas are changed without restarting tasks.
+type TenantConfig struct {
+	ParsingShare     float64 // max share of parsing pool workers, in (0, 1]
+	MaxWriters       int     // max concurrent writes to ClickHouse
+	MaxPendingBytes  int64   // max size of messages in batches waiting for or being written. Consuming pauses once reached.
+	MaxRowsPerSecond float64 // max messages consumed per second
+}
+
+// SelfMetricsConfig writes throughput, lag and errors of each task to Table in Clickhouse.DB every Interval seconds.
+// The table shall have columns (timestamp DateTime, instance String, task String, metric String, value Float64).
+type SelfMetricsConfig struct {
+	Table    string // empty means disabled
+	Interval int    // default to 60
+}
+
+// AlertConfig posts to Webhook when a task running on the instance keeps breaching a threshold for ForMinutes, and
+// again once it recovers. Thresholds are checked every minute, 0 disables each.
+type AlertConfig struct {
+	Webhook        string  // URL, empty means disabled
+	Format         string  // payload format, "json"(default), "dingtalk" or "slack"
+	Lag            int64   // messages behind the newest offset
+	ErrorRate      float64 // share of consumed messages dropped for parse errors or rejected by ClickHouse, in (0, 1]
+	LatencySeconds float64 // 99th percentile of end-to-end latency
+	ForMinutes     int     // default to 5
+}
+
+// LogSamplingConfig keeps the First logs of the same level and message each second, and every Thereafter-th one beyond.
+// Logs of dpanic and higher levels are never dropped. Changes are applied without restarting tasks.
+type LogSamplingConfig struct {
+	First      int // 0 disables sampling
+	Thereafter int // 0 drops all beyond First
+}
+
+// PoolConfig bounds the number of workers of a pool, which is resized every 10 seconds. MaxWorkers 0 disables resizing,
+// and the pool keeps NumCPU/2 workers(at most 10, CPUs are capped by the container quota). Changes are applied without restarting tasks.
+type PoolConfig struct {
+	MinWorkers int // default to 1
+	MaxWorkers int
+}
+
+// RestartPolicy restarts a failed task after a backoff, which starts at InitialBackoff seconds and doubles on each
+// consecutive failure up to MaxBackoff. Consecutive failures are reset once the task runs for ResetAfter seconds.
+type RestartPolicy struct {
+	MaxRestarts    int // consecutive restarts before the task is left failed, default to 10. Negative means unlimited
+	InitialBackoff int // default to 1
+	MaxBackoff     int // default to 300
+	ResetAfter     int // default to 600
+}
+
+// RateLimitConfig throttles consuming and writing, 0 disables each. Changes are applied without restarting tasks.
+type RateLimitConfig struct {
+	ConsumeBytesPerSecond float64 // size of messages consumed per second
+	WriteRowsPerSecond    float64 // rows written to ClickHouse per second, applied to messages consumed
+}
+
+// WatchdogConfig checks resources every 10 seconds against thresholds, 0 disables each. On a breach, heap and goroutine
+// profiles are written to DumpDir, at most once every MinDumpInterval seconds.
+type WatchdogConfig struct {
+	RssMB           int    // resident memory of the process
+	Goroutines      int    // number of goroutines
+	Backlog         int    // functions queued or running in the parsing or writing pool
+	DumpDir         string // default to the temporary directory
+	MinDumpInterval int    // default to 600
+}
+
+// SlowPathConfig sets thresholds of slow paths, 0 disables each. Changes are applied without restarting tasks.
+type SlowPathConfig struct {
+	ParseMs      int // a message taking longer to enrich and parse is slow
+	WriteQueueMs int // a batch waiting longer for a writer(tenant quota and the writing pool) is slow
+}
+
+// ErrorEventsConfig publishes a JSON event for each message failed to enrich or parse, and each batch failed to write,
+// to Topic of Config.Kafka. So that alerting and data quality dashboards can consume failures without grepping logs.
+type ErrorEventsConfig struct {
+	Topic        string // empty means disabled
+	MaxPerSecond int    // events beyond are dropped and counted, default to 100
+}
+
+// AutoscaleConfig computes the desired number of replicas, which is enough to sink incoming messages and drain the lag
+// in DrainSeconds. It's exposed as a metric, and optionally applied to Target.
+type AutoscaleConfig struct {
+	ReplicaThroughput int // messages per second a replica is able to sink. 0 disables autoscaling.
+	DrainSeconds      int // default to 300
+	MinReplicas       int // default to 1
+	MaxReplicas       int // 0 means unlimited
+	Interval          int // seconds between computations, default to 60
+	// Kubernetes resource in the namespace of the k8s backend, such as "deployments/clickhouse-sinker",
+	// "statefulsets/clickhouse-sinker" or "horizontalpodautoscalers/clickhouse-sinker". Deployments and statefulsets
+	// are scaled via the scale subresource, while minReplicas of an HPA is raised to the desired number. Empty means
+	// not to scale anything.
+	Target string
+}
+
+// DesiredReplicas computes the number of replicas for the total lag and the incoming rate(messages per second).
+func (ac *AutoscaleConfig) DesiredReplicas(lag int64, rate float64) (replicas int) {
+	need := float64(lag)/float64(ac.DrainSeconds) + rate
+	replicas = int(math.Ceil(need / float64(ac.ReplicaThroughput)))
+	if replicas < ac.MinReplicas {
+		replicas = ac.MinReplicas
+	}
+	if ac.MaxReplicas > 0 && replicas > ac.MaxReplicas {
+		replicas = ac.MaxReplicas
+	}
+	return
+}
+
+// GeoipUpdateConfig downloads geo databases on a cron, and reloads them without restarting sinker.
+type GeoipUpdateConfig struct {
+	Cron      string // cron spec, for example "0 4 * * *". Empty means disabled.
+	Databases []GeoipDatabase
+}
+
+// GeoipDatabase is a geo database to download
+type GeoipDatabase struct {
+	File     string // file name under NALI_DB_HOME, for example qqwry.dat, ipipfree.ipdb, GeoLite2-City.mmdb
+	URL      string
+	Format   string // "", "gzip" or "tar.gz". For "tar.gz", the entry whose base name equals to File is extracted.
+	Username string // for HTTP basic authentication
+	Password string
+	Headers  map[string]string // extra HTTP headers, for example an API token
+	// The expected hex encoded SHA256 of the download. Alternatively, ChecksumURL points to a file whose first word is it.
+	SHA256      string
+	ChecksumURL string
 }
 
 // KafkaConfig configuration parameters
@@ -45,10 +210,11 @@ type KafkaConfig struct {
 	Version  string
 	Security map[string]string
 	TLS      struct {
-		Enable         bool
-		CaCertFiles    string // Required. It's the CA cert.pem with which Kafka brokers certs be signed.
-		ClientCertFile string // Required for client authentication. It's client cert.pem.
-		ClientKeyFile  string // Required if and only if ClientCertFile is present. It's client key.pem.
+		Enable            bool
+		CaCertFiles       string // Required. It's the CA cert.pem with which Kafka brokers certs be signed.
+		ClientCertFile    string // Required for client authentication. It's client cert.pem.
+		ClientKeyFile     string // Required if and only if ClientCertFile is present. It's client key.pem.
+		ClientKeyPassword string // Required if ClientKeyFile is encrypted. "env:NAME" or "vault:PATH#FIELD" refers to a secret.
 
 		TrustStoreLocation string //JKS format of CA certificate, used to extract CA cert.pem.
 		TrustStorePassword string
@@ -96,9 +262,15 @@ type ClickHouseConfig struct {
 	Secure bool
 	// Whether skip verify clickhouse-server cert
 	InsecureSkipVerify bool
+	// Optional PEM files if Secure. Client certificates are reloaded once their files change.
+	CaCertFiles       string // CA certs to verify clickhouse-server cert, default to the system ones
+	ClientCertFile    string
+	ClientKeyFile     string
+	ClientKeyPassword string // passphrase of an encrypted ClientKeyFile, "env:NAME" or "vault:PATH#FIELD" refers to a secret
 
-	RetryTimes   int //<=0 means retry infinitely
-	MaxOpenConns int
+	RetryTimes    int //<=0 means retry infinitely
+	RetryInterval int // seconds between retries, default to 10
+	MaxOpenConns  int
 }
 
 // Task configuration parameters
@@ -111,7 +283,21 @@ type TaskConfig struct {
 
 	// Earliest set to true to consume the message from oldest position
 	Earliest bool
-	Parser   string
+	// Paused tasks are kept in the config, but not run.
+	Paused bool
+	// Tenant refers to an entry of Config.Tenants. Empty means the task isn't limited by any tenant quota.
+	Tenant string
+	// Priority of parsing and writing in the shared pools, "high", "normal"(default) or "low". Queued work of a
+	// higher priority runs first, e.g. "low" for bulk backfill tasks.
+	Priority string
+	// Overrides of global settings. Zero values follow the global ones.
+	LogLevel      string
+	MaxWriters    int // max concurrent writes of the task, in addition to the writing pool and the tenant quota
+	RetryTimes    int // overrides Clickhouse.RetryTimes. <0 means retry infinitely.
+	RetryInterval int // overrides Clickhouse.RetryInterval
+	// RateLimit throttles the task alone, in addition to the global one.
+	RateLimit RateLimitConfig
+	Parser    string
 	// the csv cloum title if Parser is csv
 	CsvFormat []string
 	Delimiter string
@@ -127,17 +313,15 @@ type TaskConfig struct {
 		SourceName string
 	} `json:"dims"`
 	// DynamicSchema will add columns present in message to clickhouse. Requires AutoSchema be true.
-	DynamicSchema struct {
-		Enable  bool
-		MaxDims int // the upper limit of dynamic columns number, <=0 means math.MaxInt16. protecting dirty data attack
-		// A column is added for new key K if all following conditions are true:
-		// - K isn't in ExcludeColumns
-		// - number of existing columns doesn't reach MaxDims-1
-		// - WhiteList is empty, or K matchs WhiteList
-		// - BlackList is empty, or K doesn't match BlackList
-		WhiteList string // the regexp of white list
-		BlackList string // the regexp of black list
-	}
+	// A change to it is applied to the running task without restarting it.
+	DynamicSchema DynamicSchemaConfig
+	// TypeWidening decides what to do with a value which doesn't fit its Int or Float column, such as a fraction of an
+	// Int column or a string of a Float column, instead of writing the default value silently. One of TypeWideningXXX,
+	// or empty.
+	TypeWidening string
+	// TypeWideningThreshold is the number of values of a column which don't fit it before "alter" widens the column, so
+	// that a few malformed values don't change the table. Values before are written as the default value. Default to 100.
+	TypeWideningThreshold int
 	// PrometheusSchema expects each message is a Prometheus metric(timestamp, value, metric name and a list of labels).
 	PrometheusSchema bool
 
@@ -146,12 +330,147 @@ type TaskConfig struct {
 	// ShardingPolicy is `stripe,<interval>`(requires ShardingKey be numerical) or `hash`(requires ShardingKey be string)
 	ShardingPolicy string `json:"shardingPolicy,omitempty"`
 
-	FlushInterval int     `json:"flushInterval,omitempty"`
-	BufferSize    int     `json:"bufferSize,omitempty"`
-	TimeZone      string  `json:"timeZone"`
-	TimeUnit      float64 `json:"timeUnit"`
-	GeoipHandle	bool
-	AutoUpdateGeoIPDB	string
+	FlushInterval int `json:"flushInterval,omitempty"`
+	FlushJitter   int `json:"flushJitter,omitempty"` // percent of FlushInterval by which flushes are randomly spread
+	BufferSize    int `json:"bufferSize,omitempty"`
+	BufferBytes   int `json:"bufferBytes,omitempty"` // size of messages which triggers a flush besides BufferSize, 0 means unlimited
+	// MaxInflightBatches caps batches of the task being written to ClickHouse, consuming more waits. 0 means unlimited.
+	MaxInflightBatches int     `json:"maxInflightBatches,omitempty"`
+	TimeZone           string  `json:"timeZone"`
+	TimeUnit           float64 `json:"timeUnit"`
+	GeoipHandle        bool
+	AutoUpdateGeoIPDB  string
+	// IPZoneFile maps CIDR blocks to labels(office sites, DC segments, VPN pools...). Requires Parser be "fastjson" or
+	// "gjson". The labels of ip_src and ip_dst are written to ip_zone_src and ip_zone_dst. It's a shorthand of "cidr"
+	// steps before Enrichments.
+	IPZoneFile string
+
+	// ReverseDNS resolves IP fields to host names via PTR lookups. Requires Parser be "fastjson" or "gjson".
+	// The host name of field F is written to field F_host. It's a shorthand of "rdns" steps before Enrichments.
+	ReverseDNS struct {
+		Enable      bool
+		Fields      []string // IP fields to resolve, default to ["ip_src", "ip_dst"]
+		Timeout     int      // per-lookup timeout in milliseconds, default to 200
+		CacheTTL    int      // seconds to cache a lookup result, default to 3600
+		FailureTTL  int      // seconds to cache a failed lookup, such as a timeout, default to 10
+		Concurrency int      // max number of in-flight lookups, default to 16
+	}
+
+	// Enrichments is an ordered list of enrichment steps applied to each message before parsing.
+	// Requires Parser be "fastjson" or "gjson".
+	Enrichments []EnrichConfig
+
+	// Script transforms each message after enrichments and before parsing. Requires Parser be "fastjson" or "gjson".
+	Script ScriptConfig
+
+	// Explode writes a row per element of an array field after Script. Requires Parser be "fastjson" or "gjson".
+	Explode ExplodeConfig
+
+	// RenameFields maps names of top-level fields into names of columns after parsing, such as {"@hostname": "hostname"}.
+	RenameFields map[string]string
+	// StripPrefixes are stripped from names of top-level fields which aren't in RenameFields, the first matched wins.
+	StripPrefixes []string
+
+	// Filter is an expression on parsed fields, such as `response != "200" && bytes > 1024`. Rows not matching it are
+	// dropped before batching. Empty means all rows are kept.
+	Filter string
+	// SamplePercent keeps only a percent(0 to 100) of rows which pass Filter and Dedup. 0 or 100 keeps all rows.
+	SamplePercent float64
+	// SampleKey samples rows by the hash of the field, so that rows of the same value are consistently kept or dropped.
+	SampleKey string
+	// Dedup drops duplicated rows, such as those produced by at-least-once upstreams, before sampling.
+	Dedup DedupConfig
+
+	// LateData handles rows whose event time is older than a threshold, so that partitions which have been merged or
+	// expired by TTL aren't reopened.
+	LateData LateDataConfig
+
+	// Aggregate rolls up rows of each batch before insert, for metric-like topics.
+	Aggregate AggregateConfig
+
+	// Privacy transforms values of columns before insert, for tables which must not keep personal data in clear.
+	Privacy []PrivacyConfig
+}
+
+// DynamicSchemaConfig controls detecting new keys in messages and adding them as columns.
+type DynamicSchemaConfig struct {
+	Enable  bool
+	MaxDims int // the upper limit of dynamic columns number, <=0 means math.MaxInt16. protecting dirty data attack
+	// A column is added for new key K if all following conditions are true:
+	// - K isn't in ExcludeColumns
+	// - number of existing columns doesn't reach MaxDims-1
+	// - WhiteList is empty, or K matchs WhiteList
+	// - BlackList is empty, or K doesn't match BlackList
+	WhiteList string // the regexp of white list
+	BlackList string // the regexp of black list
+	// the upper limit of distinct series of a task with PrometheusSchema, <=0 means unlimited. Rows of new series beyond
+	// it are dropped, protecting from series explosion
+	MaxSeries int
+}
+
+// ScriptConfig is a Lua script which defines function transform(row). row is a table of fields of a message, and the
+// returned table is parsed instead. Returning nil drops the message.
+type ScriptConfig struct {
+	File    string // path of the script, which is read when the task starts
+	Source  string // the script itself, instead of File
+	Timeout int    // milliseconds to transform a message, default to 100
+}
+
+// DedupConfig drops rows whose key has been seen within a window. Keys are forgotten when the task restarts, so that
+// messages consumed again aren't dropped.
+type DedupConfig struct {
+	Enable  bool
+	Fields  []string // fields of the key, default to the whole message
+	Window  int      // seconds a key is remembered since it's first seen, default to 60
+	MaxKeys int      // upper limit of remembered keys, the oldest are forgotten first. Default to 1000000.
+}
+
+// LateDataConfig decides what to do with late rows when their batch is flushed.
+type LateDataConfig struct {
+	TimeColumn string // a DateTime column of the event time, empty means disabled
+	Threshold  int    // seconds, rows older are late
+	Policy     string // write(default), drop or table
+	Table      string // of policy table, which has the same columns as TableName
+}
+
+// AggregateConfig groups rows of each batch by a tumbling window of TimeColumn and GroupBy columns, and inserts a row
+// per group. Columns are those of the table.
+type AggregateConfig struct {
+	Enable     bool
+	TimeColumn string            // a DateTime column, which is truncated to the window
+	Window     int               // seconds of the tumbling window, default to 10
+	GroupBy    []string          // columns of the group key besides TimeColumn
+	Metrics    map[string]string // column -> count, sum, min or max. Other columns take values of the first row.
+}
+
+// PrivacyConfig is a transform of a String or Array(String) column.
+type PrivacyConfig struct {
+	Column string
+	Method string // hash, mask or anonymizeIP
+	// Salt of hash, which is prepended to values. "env:NAME" or "vault:PATH#FIELD" refers to a secret.
+	Salt       string
+	KeepPrefix int    // characters of mask kept at the beginning
+	KeepSuffix int    // characters of mask kept at the end
+	MaskChar   string // of mask, default to "*"
+}
+
+// ExplodeConfig splits a message into a message per element of an array field. Other fields are duplicated.
+type ExplodeConfig struct {
+	Field     string // the array field, empty means disabled
+	Prefix    string // prefix of fields of object elements, which are merged into fields of the message
+	KeepEmpty bool   // write the message without the field if the array is empty or absent, otherwise drop it
+}
+
+// EnrichConfig is a step of the enrichment pipeline
+type EnrichConfig struct {
+	Type   string            // geoip, asn, ua, url, cidr, rdns, threat, or a type registered by a plugin
+	Field  string            // the input field. Optional for types which consume the whole message.
+	Prefix string            // prefix of output fields, default to Field+"_"
+	Params map[string]string // type specific parameters
+	// Outputs overrides names of output fields. The key is an output of the step, and the value is a template
+	// which can refer ${field}, ${prefix} and ${output}, e.g. "${field}_country" or "clientGeoCity".
+	// An output mapped to "-" is dropped. Outputs absent in Outputs are named "<prefix><output>".
+	Outputs map[string]string
 }
 
 type Assignment struct {
@@ -161,31 +480,56 @@ type Assignment struct {
 	Map       map[string][]string // map instance to a list of task_name
 }
 
+// Policies of type widening
+const (
+	TypeWideningAlter      = "alter"      // widen the column(Int to Float, or to String) and restart the task
+	TypeWideningCoerce     = "coerce"     // convert fractions and numeric strings with loss
+	TypeWideningQuarantine = "quarantine" // skip the message, and publish an error event of it
+)
+
+// Policies of late rows
+const (
+	LatePolicyWrite = "write" // write late rows as usual, only count them
+	LatePolicyDrop  = "drop"
+	LatePolicyTable = "table" // write late rows to LateDataConfig.Table
+)
+
 const (
 	MaxBufferSize             = 1 << 20 //1048576
 	defaultBufferSize         = 1 << 18 //262144
 	maxFlushInterval          = 600
+	maxFlushJitter            = 50
 	defaultFlushInterval      = 5
 	defaultGeoipHandle        = false
 	defaultTimeZone           = "Local"
+	defaultDrainSeconds       = 300
+	defaultAutoscaleInterval  = 60
+	defaultErrorEventsPerSec  = 100
+	defaultSelfMetricsPeriod  = 60
+	defaultWatchdogDumpPeriod = 600
+	defaultAlertForMinutes    = 5
+	defaultMaxRestarts        = 10
+	defaultInitialBackoff     = 1
+	defaultMaxBackoff         = 300
+	defaultRestartResetAfter  = 600
 	defaultLogLevel           = "info"
 	defaultKerberosConfigPath = "/etc/krb5.conf"
 	defaultMaxOpenConns       = 1
+	defaultRetryInterval      = 10
+	defaultRDNSTimeout        = 200
+	defaultRDNSCacheTTL       = 3600
+	defaultRDNSConcurrency    = 16
+	defaultRDNSFailureTTL     = 10
+	defaultScriptTimeout      = 100
+	defaultMaskChar           = "*"
+	defaultDedupWindow        = 60
+	defaultDedupMaxKeys       = 1000000
+	defaultAggregateWindow    = 10
+	defaultWideningThreshold  = 100
 )
 
 func ParseLocalCfgFile(cfgPath string) (cfg *Config, err error) {
-	cfg = &Config{}
-	var b []byte
-	b, err = ioutil.ReadFile(cfgPath)
-	if err != nil {
-		err = errors.Wrapf(err, "")
-		return
-	}
-	if err = json.Unmarshal(b, cfg); err != nil {
-		err = errors.Wrapf(err, "")
-		return
-	}
-	return
+	return LocalLoader().Load(cfgPath)
 }
 
 // normallize and validate configuration
@@ -211,28 +555,148 @@ func (cfg *Config) Normallize() (err error) {
 	if cfg.Clickhouse.RetryTimes < 0 {
 		cfg.Clickhouse.RetryTimes = 0
 	}
+	if cfg.Clickhouse.RetryInterval <= 0 {
+		cfg.Clickhouse.RetryInterval = defaultRetryInterval
+	}
 	if cfg.Clickhouse.MaxOpenConns <= 0 {
 		cfg.Clickhouse.MaxOpenConns = defaultMaxOpenConns
 	}
+	if cfg.TimeZone == "" {
+		cfg.TimeZone = defaultTimeZone
+	}
 
 	if cfg.Task != nil {
 		cfg.Tasks = append(cfg.Tasks, cfg.Task)
 		cfg.Task = nil
 	}
+	if err = cfg.ExpandTemplates(); err != nil {
+		return
+	}
+	for name, tenantCfg := range cfg.Tenants {
+		if tenantCfg.ParsingShare < 0 || tenantCfg.ParsingShare > 1 || tenantCfg.MaxWriters < 0 ||
+			tenantCfg.MaxPendingBytes < 0 || tenantCfg.MaxRowsPerSecond < 0 {
+			err = errors.Errorf("tenant %s has invalid quota", name)
+			return
+		}
+	}
 	for _, taskCfg := range cfg.Tasks {
-		if err = cfg.normallizeTask(taskCfg); err != nil {
+		if err = cfg.NormallizeTask(taskCfg); err != nil {
 			return
 		}
 	}
-	switch strings.ToLower(cfg.LogLevel) {
-	case "debug", "info", "warn", "error", "dpanic", "panic", "fatal":
-	default:
+	if cfg.GeoipUpdate.Cron != "" {
+		for i, db := range cfg.GeoipUpdate.Databases {
+			if db.File == "" || db.URL == "" || filepath.Base(db.File) != db.File {
+				err = errors.Errorf("geoipUpdate database %d requires url and a plain file name", i)
+				return
+			}
+			switch db.Format {
+			case "", "gzip", "tar.gz":
+			default:
+				err = errors.Errorf("geoipUpdate database %s has unsupported format %s", db.File, db.Format)
+				return
+			}
+		}
+	}
+	if ac := &cfg.Autoscale; ac.ReplicaThroughput > 0 {
+		if ac.DrainSeconds <= 0 {
+			ac.DrainSeconds = defaultDrainSeconds
+		}
+		if ac.MinReplicas <= 0 {
+			ac.MinReplicas = 1
+		}
+		if ac.Interval <= 0 {
+			ac.Interval = defaultAutoscaleInterval
+		}
+		if ac.MaxReplicas > 0 && ac.MaxReplicas < ac.MinReplicas {
+			err = errors.Errorf("autoscale maxReplicas %d is less than minReplicas %d", ac.MaxReplicas, ac.MinReplicas)
+			return
+		}
+		if ac.Target != "" && !isScaleTarget(ac.Target) {
+			err = errors.Errorf("autoscale target %s is unsupported", ac.Target)
+			return
+		}
+	}
+	if cfg.ErrorEvents.Topic != "" && cfg.ErrorEvents.MaxPerSecond <= 0 {
+		cfg.ErrorEvents.MaxPerSecond = defaultErrorEventsPerSec
+	}
+	if cfg.SelfMetrics.Table != "" && cfg.SelfMetrics.Interval <= 0 {
+		cfg.SelfMetrics.Interval = defaultSelfMetricsPeriod
+	}
+	if pc := &cfg.ParsingPool; pc.MaxWorkers > 0 {
+		if pc.MinWorkers <= 0 {
+			pc.MinWorkers = 1
+		}
+		if pc.MaxWorkers < pc.MinWorkers {
+			err = errors.Errorf("parsingPool maxWorkers %d is less than minWorkers %d", pc.MaxWorkers, pc.MinWorkers)
+			return
+		}
+	}
+	if al := &cfg.Alert; al.Webhook != "" {
+		switch al.Format {
+		case "":
+			al.Format = "json"
+		case "json", "dingtalk", "slack":
+		default:
+			err = errors.Errorf("alert format %s is unsupported", al.Format)
+			return
+		}
+		if al.ForMinutes <= 0 {
+			al.ForMinutes = defaultAlertForMinutes
+		}
+	}
+	rp := &cfg.TaskRestart
+	if rp.MaxRestarts == 0 {
+		rp.MaxRestarts = defaultMaxRestarts
+	}
+	if rp.InitialBackoff <= 0 {
+		rp.InitialBackoff = defaultInitialBackoff
+	}
+	if rp.MaxBackoff <= 0 {
+		rp.MaxBackoff = defaultMaxBackoff
+	}
+	if rp.MaxBackoff < rp.InitialBackoff {
+		err = errors.Errorf("taskRestart maxBackoff %d is less than initialBackoff %d", rp.MaxBackoff, rp.InitialBackoff)
+		return
+	}
+	if rp.ResetAfter <= 0 {
+		rp.ResetAfter = defaultRestartResetAfter
+	}
+	if cfg.RateLimit.ConsumeBytesPerSecond < 0 || cfg.RateLimit.WriteRowsPerSecond < 0 {
+		err = errors.Errorf("rateLimit has negative rates")
+		return
+	}
+	if wd := cfg.Watchdog; (wd.RssMB > 0 || wd.Goroutines > 0 || wd.Backlog > 0) && wd.MinDumpInterval <= 0 {
+		cfg.Watchdog.MinDumpInterval = defaultWatchdogDumpPeriod
+	}
+	if _, _, err := util.ParseLogLevel(cfg.LogLevel); err != nil || cfg.LogLevel == "" {
 		cfg.LogLevel = defaultLogLevel
 	}
 	return
 }
 
-func (cfg *Config) normallizeTask(taskCfg *TaskConfig) (err error) {
+func isScaleTarget(target string) bool {
+	parts := strings.Split(target, "/")
+	if len(parts) != 2 || parts[1] == "" {
+		return false
+	}
+	switch parts[0] {
+	case "deployments", "statefulsets", "horizontalpodautoscalers":
+		return true
+	}
+	return false
+}
+
+func isLogLevel(level string) bool {
+	switch strings.ToLower(level) {
+	case "debug", "info", "warn", "error", "dpanic", "panic", "fatal":
+		return true
+	}
+	return false
+}
+
+// NormallizeTask normallizes and validates a task against the common part of cfg.
+func (cfg *Config) NormallizeTask(taskCfg *TaskConfig) (err error) {
 	if taskCfg.KafkaClient == "" || (cfg.Kafka.Sasl.Enable && cfg.Kafka.Sasl.Username == "") {
 		// known limitations of kafka-go:
 		// - The Reader API is too high-level. There's no generation cleanup callback which sarama provides.
@@ -242,6 +706,14 @@ func (cfg *Config) normallizeTask(taskCfg *TaskConfig) (err error) {
 	if taskCfg.Parser == "" || taskCfg.Parser == "json" {
 		taskCfg.Parser = "fastjson"
 	}
+	if _, err = util.ParsePriority(taskCfg.Priority); err != nil {
+		err = errors.Wrapf(err, "task %s", taskCfg.Name)
+		return
+	}
+	if _, ok := cfg.Tenants[taskCfg.Tenant]; taskCfg.Tenant != "" && !ok {
+		err = errors.Errorf("task %s refers to unknown tenant %s", taskCfg.Name, taskCfg.Tenant)
+		return
+	}
 
 	for i := range taskCfg.Dims {
 		if taskCfg.Dims[i].SourceName == "" {
@@ -249,11 +721,24 @@ func (cfg *Config) normallizeTask(taskCfg *TaskConfig) (err error) {
 		}
 	}
 
+	if taskCfg.FlushInterval <= 0 {
+		taskCfg.FlushInterval = cfg.FlushInterval
+	}
 	if taskCfg.FlushInterval <= 0 {
 		taskCfg.FlushInterval = defaultFlushInterval
 	} else if taskCfg.FlushInterval > maxFlushInterval {
 		taskCfg.FlushInterval = maxFlushInterval
 	}
+	if taskCfg.FlushJitter <= 0 {
+		taskCfg.FlushJitter = cfg.FlushJitter
+	}
+	if taskCfg.FlushJitter < 0 || taskCfg.FlushJitter > maxFlushJitter {
+		err = errors.Errorf("task %s flushJitter %d is out of [0, %d]", taskCfg.Name, taskCfg.FlushJitter, maxFlushJitter)
+		return
+	}
+	if taskCfg.BufferSize <= 0 {
+		taskCfg.BufferSize = cfg.BufferSize
+	}
 	if taskCfg.BufferSize <= 0 {
 		taskCfg.BufferSize = defaultBufferSize
 	} else if taskCfg.BufferSize > MaxBufferSize {
@@ -261,9 +746,39 @@ func (cfg *Config) normallizeTask(taskCfg *TaskConfig) (err error) {
 	} else {
 		taskCfg.BufferSize = 1 << util.GetShift(taskCfg.BufferSize)
 	}
+	if taskCfg.BufferBytes <= 0 {
+		taskCfg.BufferBytes = cfg.BufferBytes
+	}
+	if taskCfg.MaxInflightBatches <= 0 {
+		taskCfg.MaxInflightBatches = cfg.MaxInflightBatches
+	}
+	if taskCfg.TimeZone == "" {
+		taskCfg.TimeZone = cfg.TimeZone
+	}
 	if taskCfg.TimeZone == "" {
 		taskCfg.TimeZone = defaultTimeZone
 	}
+	if taskCfg.LogLevel != "" && !isLogLevel(taskCfg.LogLevel) {
+		err = errors.Errorf("task %s has invalid logLevel %s", taskCfg.Name, taskCfg.LogLevel)
+		return
+	}
+	if taskCfg.MaxWriters < 0 {
+		err = errors.Errorf("task %s has invalid maxWriters %d", taskCfg.Name, taskCfg.MaxWriters)
+		return
+	}
+	if taskCfg.RateLimit.ConsumeBytesPerSecond < 0 || taskCfg.RateLimit.WriteRowsPerSecond < 0 {
+		err = errors.Errorf("task %s rateLimit has negative rates", taskCfg.Name)
+		return
+	}
+	if taskCfg.RetryTimes == 0 {
+		taskCfg.RetryTimes = cfg.Clickhouse.RetryTimes
+	}
+	if taskCfg.RetryInterval <= 0 {
+		taskCfg.RetryInterval = cfg.Clickhouse.RetryInterval
+	}
+	if taskCfg.RetryInterval <= 0 {
+		taskCfg.RetryInterval = defaultRetryInterval
+	}
 	if taskCfg.TimeUnit == 0.0 {
 		taskCfg.TimeUnit = float64(1.0)
 	}
@@ -277,6 +792,24 @@ func (cfg *Config) normallizeTask(taskCfg *TaskConfig) (err error) {
 			return
 		}
 	}
+	switch taskCfg.TypeWidening {
+	case "":
+	case TypeWideningAlter, TypeWideningCoerce, TypeWideningQuarantine:
+		if taskCfg.Parser != "fastjson" && taskCfg.Parser != "gjson" {
+			err = errors.Errorf("Parser %s doesn't support TypeWidening", taskCfg.Parser)
+			return
+		}
+		if taskCfg.TypeWidening == TypeWideningAlter && (!taskCfg.DynamicSchema.Enable || taskCfg.PrometheusSchema) {
+			err = errors.Errorf("TypeWidening %s requires DynamicSchema, and isn't supported with PrometheusSchema", taskCfg.TypeWidening)
+			return
+		}
+		if taskCfg.TypeWideningThreshold <= 0 {
+			taskCfg.TypeWideningThreshold = defaultWideningThreshold
+		}
+	default:
+		err = errors.Errorf("unknown TypeWidening %q", taskCfg.TypeWidening)
+		return
+	}
 	if taskCfg.DynamicSchema.WhiteList != "" {
 		if _, err = regexp.Compile(taskCfg.DynamicSchema.WhiteList); err != nil {
 			err = errors.Wrapf(err, "WhiteList %s is invalid regexp", taskCfg.DynamicSchema.WhiteList)
@@ -289,6 +822,156 @@ func (cfg *Config) normallizeTask(taskCfg *TaskConfig) (err error) {
 			return
 		}
 	}
+	if taskCfg.IPZoneFile != "" && taskCfg.Parser != "fastjson" && taskCfg.Parser != "gjson" {
+		err = errors.Errorf("Parser %s doesn't support IPZoneFile", taskCfg.Parser)
+		return
+	}
+	if taskCfg.ReverseDNS.Enable {
+		if taskCfg.Parser != "fastjson" && taskCfg.Parser != "gjson" {
+			err = errors.Errorf("Parser %s doesn't support ReverseDNS", taskCfg.Parser)
+			return
+		}
+		if len(taskCfg.ReverseDNS.Fields) == 0 {
+			taskCfg.ReverseDNS.Fields = []string{"ip_src", "ip_dst"}
+		}
+		if taskCfg.ReverseDNS.Timeout <= 0 {
+			taskCfg.ReverseDNS.Timeout = defaultRDNSTimeout
+		}
+		if taskCfg.ReverseDNS.CacheTTL <= 0 {
+			taskCfg.ReverseDNS.CacheTTL = defaultRDNSCacheTTL
+		}
+		if taskCfg.ReverseDNS.FailureTTL <= 0 {
+			taskCfg.ReverseDNS.FailureTTL = defaultRDNSFailureTTL
+		}
+		if taskCfg.ReverseDNS.Concurrency <= 0 {
+			taskCfg.ReverseDNS.Concurrency = defaultRDNSConcurrency
+		}
+	}
+	if len(taskCfg.Enrichments) != 0 {
+		if taskCfg.Parser != "fastjson" && taskCfg.Parser != "gjson" {
+			err = errors.Errorf("Parser %s doesn't support Enrichments", taskCfg.Parser)
+			return
+		}
+		for i := range taskCfg.Enrichments {
+			step := &taskCfg.Enrichments[i]
+			if step.Type == "" {
+				err = errors.Errorf("enrichment step %d requires type", i)
+				return
+			}
+			if step.Prefix == "" && step.Field != "" {
+				step.Prefix = step.Field + "_"
+			}
+		}
+	}
+	if sc := &taskCfg.Script; sc.File != "" || sc.Source != "" {
+		if taskCfg.Parser != "fastjson" && taskCfg.Parser != "gjson" {
+			err = errors.Errorf("Parser %s doesn't support Script", taskCfg.Parser)
+			return
+		}
+		if sc.File != "" && sc.Source != "" {
+			err = errors.Errorf("task %s script has both file and source", taskCfg.Name)
+			return
+		}
+		if sc.Timeout <= 0 {
+			sc.Timeout = defaultScriptTimeout
+		}
+	}
+	cols := make(map[string]string, len(taskCfg.RenameFields))
+	for field, col := range taskCfg.RenameFields {
+		if field == "" || col == "" {
+			err = errors.Errorf("task %s renameFields has an empty name", taskCfg.Name)
+			return
+		}
+		if other, ok := cols[col]; ok {
+			err = errors.Errorf("task %s renameFields maps both %s and %s to %s", taskCfg.Name, other, field, col)
+			return
+		}
+		cols[col] = field
+	}
+	for _, prefix := range taskCfg.StripPrefixes {
+		if prefix == "" {
+			err = errors.Errorf("task %s stripPrefixes has an empty prefix", taskCfg.Name)
+			return
+		}
+	}
+	if taskCfg.Explode.Field != "" && taskCfg.Parser != "fastjson" && taskCfg.Parser != "gjson" {
+		err = errors.Errorf("Parser %s doesn't support Explode", taskCfg.Parser)
+		return
+	}
+	if taskCfg.SamplePercent < 0 || taskCfg.SamplePercent > 100 {
+		err = errors.Errorf("task %s samplePercent %v isn't between 0 and 100", taskCfg.Name, taskCfg.SamplePercent)
+		return
+	}
+	if taskCfg.Dedup.Enable {
+		if taskCfg.Dedup.Window <= 0 {
+			taskCfg.Dedup.Window = defaultDedupWindow
+		}
+		if taskCfg.Dedup.MaxKeys <= 0 {
+			taskCfg.Dedup.MaxKeys = defaultDedupMaxKeys
+		}
+	}
+	if lc := &taskCfg.LateData; lc.TimeColumn != "" {
+		if lc.Threshold <= 0 {
+			err = errors.Errorf("task %s lateData requires a positive threshold", taskCfg.Name)
+			return
+		}
+		switch lc.Policy {
+		case "":
+			lc.Policy = LatePolicyWrite
+		case LatePolicyWrite, LatePolicyDrop:
+		case LatePolicyTable:
+			if lc.Table == "" || lc.Table == taskCfg.TableName {
+				err = errors.Errorf("task %s lateData policy table requires a table other than tableName", taskCfg.Name)
+				return
+			}
+		default:
+			err = errors.Errorf("task %s lateData has unknown policy %q", taskCfg.Name, lc.Policy)
+			return
+		}
+		if taskCfg.PrometheusSchema {
+			err = errors.Errorf("task %s lateData isn't supported with prometheusSchema", taskCfg.Name)
+			return
+		}
+	}
+	if ac := &taskCfg.Aggregate; ac.Enable {
+		if taskCfg.PrometheusSchema {
+			err = errors.Errorf("task %s aggregate isn't supported with prometheusSchema", taskCfg.Name)
+			return
+		}
+		if ac.TimeColumn == "" || len(ac.Metrics) == 0 {
+			err = errors.Errorf("task %s aggregate requires timeColumn and metrics", taskCfg.Name)
+			return
+		}
+		if ac.Window <= 0 {
+			ac.Window = defaultAggregateWindow
+		}
+	}
+	if len(taskCfg.Privacy) != 0 && taskCfg.PrometheusSchema {
+		// series labels would be kept in clear
+		err = errors.Errorf("task %s privacy isn't supported with prometheusSchema", taskCfg.Name)
+		return
+	}
+	for i := range taskCfg.Privacy {
+		pc := &taskCfg.Privacy[i]
+		if pc.Column == "" {
+			err = errors.Errorf("task %s privacy transform %d requires column", taskCfg.Name, i)
+			return
+		}
+		switch pc.Method {
+		case "hash", "anonymizeIP":
+		case "mask":
+			if pc.KeepPrefix < 0 || pc.KeepSuffix < 0 {
+				err = errors.Errorf("task %s privacy transform of column %s keeps negative characters", taskCfg.Name, pc.Column)
+				return
+			}
+			if pc.MaskChar == "" {
+				pc.MaskChar = defaultMaskChar
+			}
+		default:
+			err = errors.Errorf("task %s privacy transform of column %s has unknown method %q", taskCfg.Name, pc.Column, pc.Method)
+			return
+		}
+	}
 	// if GeoipHandle not set, don't open it
 	if !taskCfg.GeoipHandle {
 		taskCfg.GeoipHandle = defaultGeoipHandle
@@ -395,6 +1078,16 @@ func (cfg *Config) IsAssigned(instance, task string) (assigned bool) {
 	return
 }
 
+// Owner returns the instance to which the task is assigned, empty if none.
+func (cfg *Config) Owner(task string) (instance string) {
+	for inst := range cfg.Assignment.Map {
+		if cfg.IsAssigned(inst, task) {
+			return inst
+		}
+	}
+	return
+}
+
 func readConfig(config string) map[string]string {
 	configMap := make(map[string]string)
 	config = strings.TrimSuffix(config, ";")
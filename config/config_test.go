@@ -0,0 +1,15 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDesiredReplicas(t *testing.T) {
+	ac := AutoscaleConfig{ReplicaThroughput: 1000, DrainSeconds: 100, MinReplicas: 2, MaxReplicas: 10}
+	require.Equal(t, 2, ac.DesiredReplicas(0, 500))
+	// 200000/100 + 2500 = 4500 messages per second
+	require.Equal(t, 5, ac.DesiredReplicas(200000, 2500))
+	require.Equal(t, 10, ac.DesiredReplicas(1e8, 0))
+}
@@ -0,0 +1,333 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Loader reads a config which may be split into layers. A layer lists other layers at "include", which are merged
+// in the listed order before the layer itself, so that a later layer overrides an earlier one:
+// - objects are merged field by field, and map entries key by key
+// - arrays are replaced as a whole, except tasks
+// - tasks are merged by name. A task replaces the one of the same name in earlier layers.
+type Loader struct {
+	// Read returns the content of a layer, such as a file or a Nacos data id.
+	Read func(name string) (content []byte, err error)
+	// Expand resolves an include of the layer from into names of layers. nil means the include is the name.
+	Expand func(from, include string) (names []string, err error)
+	// Strict rejects unknown fields.
+	Strict bool
+}
+
+// LocalLoader reads layers from files. An include is a path relative to the including file, and may be a glob
+// pattern such as "tasks/*.json".
+func LocalLoader() Loader {
+	return Loader{
+		Read: func(name string) (content []byte, err error) {
+			if content, err = ioutil.ReadFile(name); err != nil {
+				err = errors.Wrapf(err, "")
+			}
+			return
+		},
+		Expand: func(from, include string) (names []string, err error) {
+			if !filepath.IsAbs(include) {
+				include = filepath.Join(filepath.Dir(from), include)
+			}
+			if names, err = filepath.Glob(include); err != nil {
+				err = errors.Wrapf(err, "include %s", include)
+				return
+			}
+			if len(names) == 0 && !hasMeta(include) {
+				// Let Read report the missing file.
+				names = []string{include}
+			}
+			sort.Strings(names)
+			return
+		},
+	}
+}
+
+// ParseLocalCfgDir merges *.json files of the directory in lexical order, such as one with shared settings and one
+// per task, so that they can be published as one config. A file may include others like a local config file, and
+// may define a task at "task" or "tasks". A task defined by more than one file is rejected.
+func ParseLocalCfgDir(dir string) (cfg *Config, err error) {
+	if dir, err = filepath.Abs(dir); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	var names []string
+	if names, err = filepath.Glob(filepath.Join(dir, "*.json")); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	if len(names) == 0 {
+		err = errors.Errorf("no *.json in %s", dir)
+		return
+	}
+	sort.Strings(names)
+	l := LocalLoader()
+	owners := make(map[string]string)
+	cfg = &Config{}
+	for _, name := range names {
+		if err = l.loadInto(cfg, []string{name}, name, map[string]bool{}); err != nil {
+			return
+		}
+		var layer struct {
+			Task  *struct{ Name string }
+			Tasks []struct{ Name string }
+		}
+		content, _ := l.Read(name)
+		_ = json.Unmarshal(content, &layer)
+		if layer.Task != nil {
+			layer.Tasks = append(layer.Tasks, *layer.Task)
+		}
+		for _, t := range layer.Tasks {
+			if owner, ok := owners[t.Name]; ok {
+				err = errors.Errorf("task %s is defined by both %s and %s", t.Name, owner, name)
+				return
+			}
+			owners[t.Name] = name
+		}
+		// Keep the task of each file, since a later "task" overrides an earlier one.
+		if cfg.Task != nil {
+			cfg.Tasks = mergeTasks(cfg.Tasks, []*TaskConfig{cfg.Task})
+			cfg.Task = nil
+		}
+	}
+	return
+}
+
+func hasMeta(path string) bool {
+	return strings.ContainsAny(path, `*?[\`)
+}
+
+// Load merges the layer name and all layers it includes.
+func (l Loader) Load(name string) (cfg *Config, err error) {
+	var content []byte
+	var include []string
+	if content, include, err = l.read(name); err != nil {
+		return
+	}
+	base := &Config{}
+	if err = l.loadInto(base, include, name, map[string]bool{name: true}); err != nil {
+		return
+	}
+	cfg = &Config{}
+	if len(include) != 0 {
+		// Keep what the main layer inherits, so that MainLayer can tell what belongs to it.
+		var bs []byte
+		if bs, err = json.Marshal(base); err != nil {
+			err = errors.Wrapf(err, "")
+			return
+		}
+		if err = json.Unmarshal(bs, cfg); err != nil {
+			err = errors.Wrapf(err, "")
+			return
+		}
+		cfg.base = base
+	}
+	if err = l.overlay(cfg, name, content); err != nil {
+		return
+	}
+	cfg.Include = include
+	return
+}
+
+func (l Loader) read(name string) (content []byte, include []string, err error) {
+	if content, err = l.Read(name); err != nil {
+		return
+	}
+	var layer struct {
+		Include []string
+	}
+	if err = json.Unmarshal(content, &layer); err != nil {
+		err = errors.Wrapf(err, "%s", name)
+		return
+	}
+	include = layer.Include
+	return
+}
+
+func (l Loader) loadInto(cfg *Config, include []string, from string, visiting map[string]bool) (err error) {
+	for _, inc := range include {
+		names := []string{inc}
+		if l.Expand != nil {
+			if names, err = l.Expand(from, inc); err != nil {
+				return
+			}
+		}
+		for _, name := range names {
+			if visiting[name] {
+				err = errors.Errorf("%s includes itself via %s", name, from)
+				return
+			}
+			var content []byte
+			var subInclude []string
+			if content, subInclude, err = l.read(name); err != nil {
+				return
+			}
+			visiting[name] = true
+			err = l.loadInto(cfg, subInclude, name, visiting)
+			delete(visiting, name)
+			if err != nil {
+				return
+			}
+			if err = l.overlay(cfg, name, content); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// overlay decodes a layer onto cfg.
+func (l Loader) overlay(cfg *Config, name string, content []byte) (err error) {
+	// Decoding into a non-empty slice reuses its elements, so tasks are decoded aside and merged later.
+	tasks, task := cfg.Tasks, cfg.Task
+	cfg.Tasks, cfg.Task = nil, nil
+	dec := json.NewDecoder(bytes.NewReader(content))
+	if l.Strict {
+		dec.DisallowUnknownFields()
+	}
+	if err = dec.Decode(cfg); err != nil {
+		err = errors.Wrapf(err, "%s", name)
+		return
+	}
+	cfg.Tasks = mergeTasks(tasks, cfg.Tasks)
+	if cfg.Task == nil {
+		cfg.Task = task
+	}
+	cfg.Include = nil
+	return
+}
+
+func mergeTasks(prev, tasks []*TaskConfig) (merged []*TaskConfig) {
+	merged = prev
+	for _, taskCfg := range tasks {
+		replaced := false
+		for i, prevCfg := range merged {
+			if prevCfg.Name == taskCfg.Name {
+				merged[i] = taskCfg
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			merged = append(merged, taskCfg)
+		}
+	}
+	return
+}
+
+// Flatten drops includes, so that cfg is stored as a whole.
+func (cfg *Config) Flatten() {
+	cfg.Include = nil
+	cfg.base = nil
+}
+
+// MainLayer marshals the part of cfg which differs from the included layers, so that storing it at the main file
+// or key keeps the included ones in effect. It fails if cfg drops a task defined by an included layer.
+func (cfg *Config) MainLayer() (content []byte, err error) {
+	if cfg.base == nil {
+		if content, err = json.Marshal(cfg); err != nil {
+			err = errors.Wrapf(err, "")
+		}
+		return
+	}
+	var base, cur map[string]interface{}
+	if base, err = toJSONMap(cfg.base); err != nil {
+		return
+	}
+	if cur, err = toJSONMap(cfg); err != nil {
+		return
+	}
+	baseTasks, _ := base["Tasks"].([]interface{})
+	curTasks, _ := cur["Tasks"].([]interface{})
+	delete(base, "Tasks")
+	delete(cur, "Tasks")
+	diff, _ := diffJSON(base, cur).(map[string]interface{})
+	if diff == nil {
+		diff = make(map[string]interface{})
+	}
+	var tasks []interface{}
+	for _, t := range curTasks {
+		if bt := findJSONTask(baseTasks, t); bt == nil || !reflect.DeepEqual(bt, t) {
+			tasks = append(tasks, t)
+		}
+	}
+	for _, bt := range baseTasks {
+		if findJSONTask(curTasks, bt) == nil {
+			err = errors.Errorf("task %v is defined in an included config, remove it there", jsonTaskName(bt))
+			return
+		}
+	}
+	if len(tasks) != 0 {
+		diff["Tasks"] = tasks
+	}
+	if content, err = json.Marshal(diff); err != nil {
+		err = errors.Wrapf(err, "")
+	}
+	return
+}
+
+func toJSONMap(v interface{}) (m map[string]interface{}, err error) {
+	var bs []byte
+	if bs, err = json.Marshal(v); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	if err = json.Unmarshal(bs, &m); err != nil {
+		err = errors.Wrapf(err, "")
+	}
+	return
+}
+
+// diffJSON returns the part of cur which differs from base, or nil if none. Removed keys can't be expressed by a
+// layer, so they're ignored.
+func diffJSON(base, cur interface{}) interface{} {
+	bm, ok1 := base.(map[string]interface{})
+	cm, ok2 := cur.(map[string]interface{})
+	if !ok1 || !ok2 {
+		if reflect.DeepEqual(base, cur) {
+			return nil
+		}
+		return cur
+	}
+	diff := make(map[string]interface{})
+	for k, v := range cm {
+		bv, ok := bm[k]
+		if !ok {
+			diff[k] = v
+		} else if d := diffJSON(bv, v); d != nil {
+			diff[k] = d
+		}
+	}
+	if len(diff) == 0 {
+		return nil
+	}
+	return diff
+}
+
+func jsonTaskName(t interface{}) interface{} {
+	if m, ok := t.(map[string]interface{}); ok {
+		return m["Name"]
+	}
+	return nil
+}
+
+func findJSONTask(tasks []interface{}, t interface{}) interface{} {
+	name := jsonTaskName(t)
+	for _, bt := range tasks {
+		if jsonTaskName(bt) == name {
+			return bt
+		}
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package config
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func writeLayers(t *testing.T, layers map[string]string) string {
+	dir, err := ioutil.TempDir("", "layer")
+	require.Nil(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	for name, content := range layers {
+		path := filepath.Join(dir, name)
+		require.Nil(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.Nil(t, ioutil.WriteFile(path, []byte(content), 0644))
+	}
+	return dir
+}
+
+func TestLoadLayers(t *testing.T) {
+	dir := writeLayers(t, map[string]string{
+		"main.json": `{"include": ["defaults.json", "tasks/*.json"], "clickhouse": {"db": "main"},
+			"tasks": [{"name": "t2", "topic": "main_topic"}]}`,
+		"defaults.json": `{"clickhouse": {"db": "default", "port": 9000}, "logLevel": "debug",
+			"kafka": {"security": {"a": "1"}}}`,
+		"tasks/a.json": `{"kafka": {"security": {"b": "2"}}, "tasks": [{"name": "t1", "topic": "a"}, {"name": "t2", "topic": "a"}]}`,
+		"tasks/b.json": `{"tasks": [{"name": "t3", "topic": "b"}]}`,
+	})
+	cfg, err := LocalLoader().Load(filepath.Join(dir, "main.json"))
+	require.Nil(t, err)
+	require.Equal(t, "main", cfg.Clickhouse.DB)
+	require.Equal(t, 9000, cfg.Clickhouse.Port)
+	require.Equal(t, "debug", cfg.LogLevel)
+	require.Equal(t, map[string]string{"a": "1", "b": "2"}, cfg.Kafka.Security)
+	var topics []string
+	for _, taskCfg := range cfg.Tasks {
+		topics = append(topics, taskCfg.Name+":"+taskCfg.Topic)
+	}
+	require.Equal(t, []string{"t1:a", "t2:main_topic", "t3:b"}, topics)
+
+	// The main layer keeps only what differs from included ones.
+	cfg.LogLevel = "warn"
+	cfg.Tasks[2].Topic = "c"
+	content, err := cfg.MainLayer()
+	require.Nil(t, err)
+	var layer map[string]interface{}
+	require.Nil(t, json.Unmarshal(content, &layer))
+	require.Equal(t, "warn", layer["LogLevel"])
+	require.Equal(t, map[string]interface{}{"DB": "main"}, layer["Clickhouse"])
+	require.Len(t, layer["Tasks"], 2)
+	require.Len(t, layer["include"], 2)
+
+	cfg.Tasks = cfg.Tasks[1:]
+	_, err = cfg.MainLayer()
+	require.NotNil(t, err)
+}
+
+func TestLoadLayersCycle(t *testing.T) {
+	dir := writeLayers(t, map[string]string{
+		"a.json": `{"include": ["b.json"]}`,
+		"b.json": `{"include": ["a.json"]}`,
+	})
+	_, err := LocalLoader().Load(filepath.Join(dir, "a.json"))
+	require.NotNil(t, err)
+}
+
+func TestParseLocalCfgDir(t *testing.T) {
+	dir := writeLayers(t, map[string]string{
+		"00_global.json": `{"clickhouse": {"db": "default", "hosts": [["127.0.0.1"]]}, "kafka": {"brokers": "127.0.0.1:9092"}}`,
+		"a.json":         `{"task": {"name": "t1", "topic": "a"}}`,
+		"b.json":         `{"task": {"name": "t2", "topic": "b"}}`,
+		"c.json":         `{"include": ["shared/c.json"], "tasks": [{"name": "t3", "topic": "c"}]}`,
+		"shared/c.json":  `{"logLevel": "debug"}`,
+	})
+	cfg, err := ParseLocalCfgDir(dir)
+	require.Nil(t, err)
+	require.Equal(t, "default", cfg.Clickhouse.DB)
+	require.Equal(t, "debug", cfg.LogLevel)
+	require.Nil(t, cfg.Task)
+	var topics []string
+	for _, taskCfg := range cfg.Tasks {
+		topics = append(topics, taskCfg.Name+":"+taskCfg.Topic)
+	}
+	require.Equal(t, []string{"t1:a", "t2:b", "t3:c"}, topics)
+
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "d.json"), []byte(`{"tasks": [{"name": "t1", "topic": "d"}]}`), 0644))
+	_, err = ParseLocalCfgDir(dir)
+	require.NotNil(t, err)
+}
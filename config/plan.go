@@ -0,0 +1,169 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// FieldChange is a changed field. Old or New is nil if the field is absent on that side.
+type FieldChange struct {
+	Path string
+	Old  interface{}
+	New  interface{}
+}
+
+// TaskChange lists changed fields of a task.
+type TaskChange struct {
+	Name    string
+	Changes []FieldChange
+}
+
+// Plan tells what applying a config does to the current one. Assignment is ignored since it's maintained by sinker.
+type Plan struct {
+	Added    []string
+	Removed  []string
+	Modified []TaskChange
+	Global   []FieldChange
+}
+
+// MakePlan compares configs field by field. Both shall be normallized, so that defaults don't show up as changes.
+func MakePlan(cur, next *Config) (plan Plan, err error) {
+	var curMap, nextMap map[string]interface{}
+	if curMap, err = toJSONMap(cur); err != nil {
+		return
+	}
+	if nextMap, err = toJSONMap(next); err != nil {
+		return
+	}
+	curTasks := taskMaps(curMap)
+	nextTasks := taskMaps(nextMap)
+	for _, m := range []map[string]interface{}{curMap, nextMap} {
+		delete(m, "Tasks")
+		delete(m, "Task")
+		delete(m, "Assignment")
+	}
+	plan.Global = diffFields("", curMap, nextMap, nil)
+
+	for _, taskCfg := range next.Tasks {
+		ct, ok := curTasks[taskCfg.Name]
+		if !ok {
+			plan.Added = append(plan.Added, taskCfg.Name)
+			continue
+		}
+		if changes := diffFields("", ct, nextTasks[taskCfg.Name], nil); len(changes) != 0 {
+			plan.Modified = append(plan.Modified, TaskChange{Name: taskCfg.Name, Changes: changes})
+		}
+	}
+	for _, taskCfg := range cur.Tasks {
+		if _, ok := nextTasks[taskCfg.Name]; !ok {
+			plan.Removed = append(plan.Removed, taskCfg.Name)
+		}
+	}
+	return
+}
+
+func taskMaps(m map[string]interface{}) map[string]interface{} {
+	tasks := make(map[string]interface{})
+	list, _ := m["Tasks"].([]interface{})
+	for _, t := range list {
+		if name, ok := jsonTaskName(t).(string); ok {
+			tasks[name] = t
+		}
+	}
+	return tasks
+}
+
+// diffFields appends changes of leaves. Arrays are compared as a whole.
+func diffFields(path string, prev, next interface{}, changes []FieldChange) []FieldChange {
+	om, ok1 := prev.(map[string]interface{})
+	nm, ok2 := next.(map[string]interface{})
+	if !ok1 || !ok2 {
+		if !reflect.DeepEqual(prev, next) {
+			changes = append(changes, FieldChange{Path: path, Old: prev, New: next})
+		}
+		return changes
+	}
+	keys := make([]string, 0, len(om)+len(nm))
+	for k := range om {
+		keys = append(keys, k)
+	}
+	for k := range nm {
+		if _, ok := om[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		changes = diffFields(joinPath(path, k), om[k], nm[k], changes)
+	}
+	return changes
+}
+
+// Redact masks values of fields which look like secrets, such as passwords and tokens, so that the plan can be logged.
+func (p *Plan) Redact() {
+	redactChanges(p.Global)
+	for _, tc := range p.Modified {
+		redactChanges(tc.Changes)
+	}
+}
+
+func redactChanges(changes []FieldChange) {
+	for i := range changes {
+		path := strings.ToLower(changes[i].Path)
+		if !strings.Contains(path, "password") && !strings.Contains(path, "secret") && !strings.Contains(path, "token") {
+			continue
+		}
+		if changes[i].Old != nil {
+			changes[i].Old = "******"
+		}
+		if changes[i].New != nil {
+			changes[i].New = "******"
+		}
+	}
+}
+
+// Empty tells whether applying changes nothing.
+func (p *Plan) Empty() bool {
+	return len(p.Added) == 0 && len(p.Removed) == 0 && len(p.Modified) == 0 && len(p.Global) == 0
+}
+
+func (p *Plan) String() string {
+	var b strings.Builder
+	for _, name := range p.Added {
+		fmt.Fprintf(&b, "+ task %s\n", name)
+	}
+	for _, name := range p.Removed {
+		fmt.Fprintf(&b, "- task %s\n", name)
+	}
+	for _, tc := range p.Modified {
+		fmt.Fprintf(&b, "~ task %s\n", tc.Name)
+		writeChanges(&b, tc.Changes)
+	}
+	if len(p.Global) != 0 {
+		b.WriteString("~ global\n")
+		writeChanges(&b, p.Global)
+	}
+	fmt.Fprintf(&b, "Plan: %d to add, %d to remove, %d to modify", len(p.Added), len(p.Removed), len(p.Modified))
+	if len(p.Global) != 0 {
+		fmt.Fprintf(&b, ", %d global changes", len(p.Global))
+	}
+	b.WriteString(".\n")
+	return b.String()
+}
+
+func writeChanges(b *strings.Builder, changes []FieldChange) {
+	for _, c := range changes {
+		fmt.Fprintf(b, "    %s: %s => %s\n", c.Path, planValue(c.Old), planValue(c.New))
+	}
+}
+
+func planValue(v interface{}) string {
+	if v == nil {
+		return "(none)"
+	}
+	bs, _ := json.Marshal(v)
+	return string(bs)
+}
@@ -0,0 +1,43 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMakePlan(t *testing.T) {
+	cur := &Config{
+		Clickhouse: ClickHouseConfig{MaxOpenConns: 1},
+		Tasks:      []*TaskConfig{{Name: "a", BufferSize: 1024}, {Name: "b"}},
+		Assignment: Assignment{Version: 3},
+	}
+	next := &Config{
+		Clickhouse: ClickHouseConfig{MaxOpenConns: 4},
+		Tasks:      []*TaskConfig{{Name: "a", BufferSize: 2048}, {Name: "c"}},
+	}
+	plan, err := MakePlan(cur, next)
+	require.Nil(t, err)
+	require.Equal(t, []string{"c"}, plan.Added)
+	require.Equal(t, []string{"b"}, plan.Removed)
+	require.Len(t, plan.Modified, 1)
+	require.Equal(t, []FieldChange{{Path: "bufferSize", Old: float64(1024), New: float64(2048)}}, plan.Modified[0].Changes)
+	require.Equal(t, []FieldChange{{Path: "Clickhouse.MaxOpenConns", Old: float64(1), New: float64(4)}}, plan.Global)
+	require.Contains(t, plan.String(), "Plan: 1 to add, 1 to remove, 1 to modify, 1 global changes.")
+
+	plan, err = MakePlan(next, next)
+	require.Nil(t, err)
+	require.True(t, plan.Empty())
+}
+
+func TestPlanRedact(t *testing.T) {
+	cur := &Config{Clickhouse: ClickHouseConfig{Username: "default", Password: "old"}}
+	next := &Config{Clickhouse: ClickHouseConfig{Username: "sinker", Password: "new"}}
+	plan, err := MakePlan(cur, next)
+	require.Nil(t, err)
+	plan.Redact()
+	require.ElementsMatch(t, []FieldChange{
+		{Path: "Clickhouse.Password", Old: "******", New: "******"},
+		{Path: "Clickhouse.Username", Old: "default", New: "sinker"},
+	}, plan.Global)
+}
@@ -0,0 +1,72 @@
+package config
+
+import (
+	"encoding/json"
+	"regexp"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+var templateVarRegexp = regexp.MustCompile(`\$\{(\w+)\}`)
+
+// TaskTemplate declares near-identical tasks at once. Task is a task config whose strings may refer variables
+// as ${var}, and each item of Instances gives values of variables to get a task.
+type TaskTemplate struct {
+	Task      json.RawMessage
+	Instances []map[string]string
+}
+
+// ExpandTemplates appends tasks instantiated from TaskTemplates to Tasks, and then clears TaskTemplates.
+func (cfg *Config) ExpandTemplates() (err error) {
+	names := make([]string, 0, len(cfg.TaskTemplates))
+	for name := range cfg.TaskTemplates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	seen := make(map[string]bool)
+	for _, taskCfg := range cfg.Tasks {
+		seen[taskCfg.Name] = true
+	}
+	for _, name := range names {
+		tmpl := cfg.TaskTemplates[name]
+		for i, vars := range tmpl.Instances {
+			var taskCfg *TaskConfig
+			if taskCfg, err = tmpl.instantiate(vars); err != nil {
+				err = errors.Wrapf(err, "instance %d of task template %s", i, name)
+				return
+			}
+			if taskCfg.Name == "" || seen[taskCfg.Name] {
+				err = errors.Errorf("instance %d of task template %s has an empty or duplicated name %q", i, name, taskCfg.Name)
+				return
+			}
+			seen[taskCfg.Name] = true
+			cfg.Tasks = append(cfg.Tasks, taskCfg)
+		}
+	}
+	cfg.TaskTemplates = nil
+	return
+}
+
+func (tmpl *TaskTemplate) instantiate(vars map[string]string) (taskCfg *TaskConfig, err error) {
+	content := templateVarRegexp.ReplaceAllFunc(tmpl.Task, func(ref []byte) []byte {
+		val, ok := vars[string(ref[2:len(ref)-1])]
+		if !ok {
+			if err == nil {
+				err = errors.Errorf("variable %s is undefined", ref)
+			}
+			return ref
+		}
+		// Escape the value as a part of a JSON string.
+		quoted, _ := json.Marshal(val)
+		return quoted[1 : len(quoted)-1]
+	})
+	if err != nil {
+		return
+	}
+	taskCfg = &TaskConfig{}
+	if err = json.Unmarshal(content, taskCfg); err != nil {
+		err = errors.Wrapf(err, "")
+	}
+	return
+}
@@ -0,0 +1,38 @@
+package config
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpandTemplates(t *testing.T) {
+	var cfg Config
+	require.Nil(t, json.Unmarshal([]byte(`{
+		"tasks": [{"name": "audit"}],
+		"taskTemplates": {
+			"nginx": {
+				"task": {"name": "nginx_${site}", "topic": "nginx_${site}", "tableName": "nginx_${site}", "consumerGroup": "${group}", "bufferSize": 1024},
+				"instances": [{"site": "a", "group": "g1"}, {"site": "b\"", "group": "g2"}]
+			}
+		}
+	}`), &cfg))
+	require.Nil(t, cfg.ExpandTemplates())
+	require.Nil(t, cfg.TaskTemplates)
+	require.Len(t, cfg.Tasks, 3)
+	require.Equal(t, "nginx_a", cfg.Tasks[1].Topic)
+	require.Equal(t, "g1", cfg.Tasks[1].ConsumerGroup)
+	require.Equal(t, 1024, cfg.Tasks[1].BufferSize)
+	require.Equal(t, `nginx_b"`, cfg.Tasks[2].TableName)
+
+	// Undefined variables and duplicated names are rejected.
+	cfg = Config{TaskTemplates: map[string]TaskTemplate{
+		"t": {Task: json.RawMessage(`{"name": "${name}", "topic": "${topic}"}`), Instances: []map[string]string{{"name": "x"}}},
+	}}
+	require.NotNil(t, cfg.ExpandTemplates())
+	cfg = Config{Tasks: []*TaskConfig{{Name: "x"}}, TaskTemplates: map[string]TaskTemplate{
+		"t": {Task: json.RawMessage(`{"name": "${name}"}`), Instances: []map[string]string{{"name": "x"}}},
+	}}
+	require.NotNil(t, cfg.ExpandTemplates())
+}
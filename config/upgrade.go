@@ -0,0 +1,391 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// UpgradeNote tells what Upgrade did to the option at Path.
+type UpgradeNote struct {
+	Path        string
+	Message     string
+	Unsupported bool // the option is dropped since this release has no equivalent
+	Manual      bool // the option is kept or absent, but needs a manual decision
+}
+
+func (n UpgradeNote) String() string {
+	if n.Manual {
+		return fmt.Sprintf("check %s: %s", n.Path, n.Message)
+	}
+	if n.Unsupported {
+		return fmt.Sprintf("unsupported %s: %s", n.Path, n.Message)
+	}
+	return fmt.Sprintf("upgraded %s: %s", n.Path, n.Message)
+}
+
+type upgrader struct {
+	notes []UpgradeNote
+}
+
+func (u *upgrader) note(path, format string, args ...interface{}) {
+	u.notes = append(u.notes, UpgradeNote{Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+func (u *upgrader) unsupported(path, format string, args ...interface{}) {
+	u.notes = append(u.notes, UpgradeNote{Path: path, Message: fmt.Sprintf(format, args...), Unsupported: true})
+}
+
+func (u *upgrader) manual(path, format string, args ...interface{}) {
+	u.notes = append(u.notes, UpgradeNote{Path: path, Message: fmt.Sprintf(format, args...), Manual: true})
+}
+
+// Upgrade rewrites a config written for older releases, or for housepower/clickhouse_sinker, into the current
+// schema. Options without an equivalent are dropped and reported as unsupported. Includes are kept as is, upgrade
+// included files one by one.
+func Upgrade(content []byte) (upgraded []byte, notes []UpgradeNote, err error) {
+	var m map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(content))
+	dec.UseNumber()
+	if err = dec.Decode(&m); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	u := &upgrader{}
+	u.upgradeTop(m)
+	u.prune(m, reflect.TypeOf(Config{}), "")
+
+	if upgraded, err = json.MarshalIndent(m, "", "  "); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	// Make sure the result is loadable.
+	dec = json.NewDecoder(bytes.NewReader(upgraded))
+	dec.DisallowUnknownFields()
+	if err = dec.Decode(&Config{}); err != nil {
+		err = errors.Wrapf(err, "upgraded config is invalid")
+		return
+	}
+	notes = u.notes
+	return
+}
+
+// Convert upgrades a housepower/clickhouse_sinker config as Upgrade does, and notes settings of this fork which the
+// upstream config can't tell whether they are wanted, such as nali geo lookups.
+func Convert(content []byte) (converted []byte, notes []UpgradeNote, err error) {
+	if converted, notes, err = Upgrade(content); err != nil {
+		return
+	}
+	var cfg Config
+	if err = json.Unmarshal(converted, &cfg); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	u := &upgrader{notes: notes}
+	u.checkNali(&cfg)
+	notes = u.notes
+	return
+}
+
+// checkNali notes tasks which may want nali geo lookups, and where the lookups read databases from.
+func (u *upgrader) checkNali(cfg *Config) {
+	var geo bool
+	for i, t := range cfg.Tasks {
+		path := fmt.Sprintf("tasks[%d]", i)
+		if t.GeoipHandle {
+			geo = true
+			if t.KafkaClient == "kafka-go" {
+				u.manual(path+".kafkaClient", "geoipHandle applies to the sarama client only, remove kafkaClient")
+			}
+			continue
+		}
+		for _, step := range t.Enrichments {
+			if step.Type == "geoip" {
+				geo = true
+			}
+		}
+		var hasIP bool
+		for _, dim := range t.Dims {
+			if dim.Name == "ip_src" || dim.Name == "ip_dst" {
+				hasIP = true
+			}
+		}
+		switch {
+		case hasIP:
+			u.manual(path+".geoipHandle", "set it to look up ip_src and ip_dst via nali, which adds loc_src, isp_src, "+
+				"loc_dst and isp_dst to messages. Add them to dims and table %s, and optionally set ipZoneFile to label private networks", t.TableName)
+			geo = true
+		case t.AutoSchema:
+			u.manual(path+".geoipHandle", "set it if messages have ip_src and ip_dst to look up via nali, and add loc_src, "+
+				"isp_src, loc_dst and isp_dst to table %s", t.TableName)
+			geo = true
+		}
+	}
+	if geo && cfg.GeoipUpdate.Cron == "" {
+		u.manual("geoipUpdate", "nali reads qqwry.dat, ipipfree.ipdb and GeoLite2-City.mmdb under $NALI_DB_HOME(default to "+
+			"/usr/share/ch_sinker/geoip_db). Put them there, or set geoipUpdate to download them")
+	}
+}
+
+// lookup finds the key case-insensitively as encoding/json does.
+func lookup(m map[string]interface{}, key string) (k string, v interface{}, ok bool) {
+	if v, ok = m[key]; ok {
+		return key, v, true
+	}
+	for k, v = range m {
+		if strings.EqualFold(k, key) {
+			return k, v, true
+		}
+	}
+	return "", nil, false
+}
+
+func take(m map[string]interface{}, key string) (v interface{}, ok bool) {
+	var k string
+	if k, v, ok = lookup(m, key); ok {
+		delete(m, k)
+	}
+	return
+}
+
+func put(m map[string]interface{}, key string, v interface{}) {
+	take(m, key)
+	m[key] = v
+}
+
+func (u *upgrader) upgradeTop(m map[string]interface{}) {
+	var tasks []interface{}
+	if v, ok := take(m, "tasks"); ok {
+		tasks, _ = v.([]interface{})
+	}
+	if v, ok := take(m, "task"); ok && v != nil {
+		tasks = append(tasks, v)
+		u.note("task", "moved into tasks")
+	}
+	if len(tasks) != 0 {
+		m["tasks"] = tasks
+	}
+	// Releases before v2 put defaults of tasks and logging in the common section.
+	if v, ok := take(m, "common"); ok {
+		common, _ := v.(map[string]interface{})
+		for _, key := range []string{"flushInterval", "bufferSize", "logLevel", "logPaths"} {
+			if v, ok := take(common, key); ok {
+				if _, _, has := lookup(m, key); !has {
+					m[key] = v
+					u.note("common."+key, "moved to %s", key)
+				} else {
+					u.unsupported("common."+key, "overridden by %s, removed", key)
+				}
+			}
+		}
+		keys := make([]string, 0, len(common))
+		for k := range common {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			u.unsupported("common."+k, "no equivalent option, removed")
+		}
+	}
+
+	// Releases before v2 declare named ClickHouse clusters and Kafka clients, and tasks refer them by name.
+	chRefs, kfkRefs := make(map[string]bool), make(map[string]bool)
+	for i, t := range tasks {
+		if tm, ok := t.(map[string]interface{}); ok {
+			if v, ok := take(tm, "clickhouse"); ok {
+				chRefs[fmt.Sprint(v)] = true
+			}
+			if v, ok := take(tm, "kafka"); ok {
+				kfkRefs[fmt.Sprint(v)] = true
+			}
+			u.upgradeTask(tm, fmt.Sprintf("tasks[%d]", i))
+		}
+	}
+	u.unnameSection(m, "clickhouse", reflect.TypeOf(ClickHouseConfig{}), chRefs)
+	u.unnameSection(m, "kafka", reflect.TypeOf(KafkaConfig{}), kfkRefs)
+	if _, v, ok := lookup(m, "clickhouse"); ok {
+		if chm, ok := v.(map[string]interface{}); ok {
+			u.upgradeClickHouse(chm)
+		}
+	}
+}
+
+// unnameSection replaces a section of named entries with the entry referred by tasks.
+func (u *upgrader) unnameSection(m map[string]interface{}, key string, typ reflect.Type, refs map[string]bool) {
+	k, v, ok := lookup(m, key)
+	if !ok {
+		return
+	}
+	named, ok := v.(map[string]interface{})
+	if !ok || len(named) == 0 {
+		return
+	}
+	for name, entry := range named {
+		if _, isObj := entry.(map[string]interface{}); !isObj || fieldByJSONName(typ, name) != nil {
+			return
+		}
+	}
+	names := make([]string, 0, len(named))
+	for name := range named {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	chosen := names[0]
+	if len(refs) != 0 {
+		referred := make([]string, 0, len(refs))
+		for name := range refs {
+			referred = append(referred, name)
+		}
+		sort.Strings(referred)
+		chosen = referred[0]
+		if len(referred) > 1 {
+			u.unsupported(key, "tasks refer %v, but only one is supported. Kept %s, run a sinker per the others", referred, chosen)
+		}
+	}
+	entry, ok := named[chosen].(map[string]interface{})
+	if !ok {
+		u.unsupported(key, "%s referred by tasks is undefined", chosen)
+		delete(m, k)
+		return
+	}
+	m[key] = entry
+	if k != key {
+		delete(m, k)
+	}
+	u.note(key, "kept %s of named entries %v", chosen, names)
+}
+
+func (u *upgrader) upgradeClickHouse(m map[string]interface{}) {
+	// A single host, or a list of hosts each of which is a shard.
+	if v, ok := take(m, "host"); ok {
+		put(m, "hosts", [][]interface{}{{v}})
+		u.note("clickhouse.host", "moved into hosts")
+	}
+	if _, v, ok := lookup(m, "hosts"); ok {
+		if hosts, ok := v.([]interface{}); ok {
+			flat := false
+			for _, h := range hosts {
+				if _, isStr := h.(string); isStr {
+					flat = true
+				}
+			}
+			if flat {
+				shards := make([]interface{}, 0, len(hosts))
+				for _, h := range hosts {
+					if _, isStr := h.(string); isStr {
+						h = []interface{}{h}
+					}
+					shards = append(shards, h)
+				}
+				put(m, "hosts", shards)
+				u.note("clickhouse.hosts", "each host is a shard of one replica")
+			}
+		}
+	}
+}
+
+func (u *upgrader) upgradeTask(m map[string]interface{}, path string) {
+	// Clients other than sarama and kafka-go, such as franz of housepower v3.
+	if k, v, ok := lookup(m, "kafkaClient"); ok {
+		if client := fmt.Sprint(v); client != "sarama" && client != "kafka-go" {
+			delete(m, k)
+			u.note(path+".kafkaClient", "%s is unavailable, default to sarama", client)
+		}
+	}
+	// Metrics were columns besides dims.
+	if v, ok := take(m, "metrics"); ok {
+		metrics, _ := v.([]interface{})
+		var dims []interface{}
+		if _, d, ok := lookup(m, "dims"); ok {
+			dims, _ = d.([]interface{})
+		}
+		put(m, "dims", append(dims, metrics...))
+		u.note(path+".metrics", "merged into dims")
+	}
+	// ShardingStripe>0 means stripes of a numerical key, otherwise hash of a string key.
+	if v, ok := take(m, "shardingStripe"); ok {
+		if _, _, has := lookup(m, "shardingPolicy"); !has {
+			if _, _, hasKey := lookup(m, "shardingKey"); hasKey {
+				policy := "hash"
+				if n, isNum := v.(json.Number); isNum && n.String() != "0" {
+					policy = "stripe," + n.String()
+				}
+				m["shardingPolicy"] = policy
+				u.note(path+".shardingStripe", "converted to shardingPolicy %q", policy)
+			}
+		}
+	}
+}
+
+// prune drops keys which typ doesn't have.
+func (u *upgrader) prune(v interface{}, typ reflect.Type, path string) {
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	switch typ.Kind() {
+	case reflect.Struct:
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return
+		}
+		keys := make([]string, 0, len(m))
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			p := joinPath(path, k)
+			f := fieldByJSONName(typ, k)
+			if f == nil {
+				delete(m, k)
+				u.unsupported(p, "no equivalent option, removed")
+				continue
+			}
+			u.prune(m[k], f.Type, p)
+		}
+	case reflect.Slice:
+		if s, ok := v.([]interface{}); ok {
+			for i, e := range s {
+				u.prune(e, typ.Elem(), fmt.Sprintf("%s[%d]", path, i))
+			}
+		}
+	case reflect.Map:
+		if m, ok := v.(map[string]interface{}); ok {
+			for k, e := range m {
+				u.prune(e, typ.Elem(), joinPath(path, k))
+			}
+		}
+	}
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// fieldByJSONName returns the exported field which encoding/json decodes the key into.
+func fieldByJSONName(typ reflect.Type, key string) *reflect.StructField {
+	for i := 0; i < typ.NumField(); i++ {
+		f := typ.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		name := f.Name
+		if tag := strings.Split(f.Tag.Get("json"), ",")[0]; tag == "-" {
+			continue
+		} else if tag != "" {
+			name = tag
+		}
+		if strings.EqualFold(name, key) {
+			return &f
+		}
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package config
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpgrade(t *testing.T) {
+	// Named clusters and clients, metrics and a single host of releases before v2.
+	content, notes, err := Upgrade([]byte(`{
+		"clickhouse": {"ch1": {"db": "default", "host": "127.0.0.1", "port": 9000, "dnsLoop": true}},
+		"kafka": {"kfk1": {"brokers": "127.0.0.1:9092", "version": "2.2.1"}},
+		"task": {
+			"name": "logs", "kafka": "kfk1", "clickhouse": "ch1", "topic": "logs", "consumerGroup": "g", "tableName": "logs",
+			"dims": [{"name": "ts", "type": "DateTime"}], "metrics": [{"name": "cnt", "type": "UInt64"}], "minBufferSize": 10
+		}
+	}`))
+	require.Nil(t, err)
+	var cfg Config
+	require.Nil(t, json.Unmarshal(content, &cfg))
+	require.Equal(t, [][]string{{"127.0.0.1"}}, cfg.Clickhouse.Hosts)
+	require.Equal(t, "127.0.0.1:9092", cfg.Kafka.Brokers)
+	require.Len(t, cfg.Tasks, 1)
+	require.Len(t, cfg.Tasks[0].Dims, 2)
+	var unsupported []string
+	for _, n := range notes {
+		if n.Unsupported {
+			unsupported = append(unsupported, n.Path)
+		}
+	}
+	require.Equal(t, []string{"clickhouse.dnsLoop", "tasks[0].minBufferSize"}, unsupported)
+
+	// ShardingStripe of housepower v3.
+	content, _, err = Upgrade([]byte(`{
+		"clickhouse": {"hosts": [["a"], ["b"]]},
+		"kafka": {"brokers": "k:9092", "properties": {"heartbeatInterval": 3000}},
+		"tasks": [
+			{"name": "t1", "shardingKey": "id", "shardingStripe": 1000},
+			{"name": "t2", "shardingKey": "host", "shardingStripe": 0}
+		]
+	}`))
+	require.Nil(t, err)
+	cfg = Config{}
+	require.Nil(t, json.Unmarshal(content, &cfg))
+	require.Equal(t, "stripe,1000", cfg.Tasks[0].ShardingPolicy)
+	require.Equal(t, "hash", cfg.Tasks[1].ShardingPolicy)
+}
+
+func TestConvert(t *testing.T) {
+	content, notes, err := Convert([]byte(`{
+		"common": {"flushInterval": 10, "layoutDate": "2006-01-02"},
+		"clickhouse": {"hosts": [["a"]]},
+		"kafka": {"brokers": "k:9092"},
+		"tasks": [
+			{"name": "flows", "kafkaClient": "franz", "dims": [{"name": "ip_src", "type": "String"}]},
+			{"name": "logs", "dims": [{"name": "msg", "type": "String"}]}
+		]
+	}`))
+	require.Nil(t, err)
+	var cfg Config
+	require.Nil(t, json.Unmarshal(content, &cfg))
+	require.Equal(t, 10, cfg.FlushInterval)
+	require.Equal(t, "", cfg.Tasks[0].KafkaClient)
+	var manual, unsupported []string
+	for _, n := range notes {
+		if n.Manual {
+			manual = append(manual, n.Path)
+		} else if n.Unsupported {
+			unsupported = append(unsupported, n.Path)
+		}
+	}
+	require.Equal(t, []string{"tasks[0].geoipHandle", "geoipUpdate"}, manual)
+	require.Equal(t, []string{"common.layoutDate"}, unsupported)
+}
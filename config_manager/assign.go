@@ -0,0 +1,228 @@
+package rcm
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/forever765/clickhouse_sinker_nali/config"
+	"github.com/forever765/clickhouse_sinker_nali/util"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+type InstanceAssignment struct {
+	Instance string
+	TotalLag int64
+	TaskLags []TaskLag
+}
+
+type TaskLag struct {
+	Task string
+	Lag  int64
+}
+
+// assignmentReporter is implemented by backends which surface the assignment and lags somewhere else than the config.
+type assignmentReporter interface {
+	reportAssignment(instAgs []*InstanceAssignment)
+}
+
+// assigner is the state of assignment loop, shared by backends.
+type assigner struct {
+	instance string     // ip:port
+	mux      sync.Mutex //protect curInsts, curCfg, curVer
+	curInsts []string
+	curCfg   *config.Config
+	curVer   int
+	leading  func() bool // tells whether this instance is the leader, nil means the first of sorted instances is
+
+	// newest offsets summed per task at the previous assignment, to estimate the incoming rate of each task
+	lastProduced map[string]int64
+	lastAt       time.Time
+}
+
+// loadWindow weighs the incoming rate of a task against its lag. The load of a task is its lag plus messages
+// expected to come in loadWindow.
+const loadWindow = 60 * time.Second
+
+// capacityFactor bounds the load of an instance to this factor of the average, see distribute.
+const capacityFactor = 1.25
+
+// taskLoads estimates the load of each task from its lag and the incoming rate since the previous call.
+func (a *assigner) taskLoads(taskLags, taskProduced map[string]int64) (loads map[string]float64) {
+	now := time.Now()
+	loads = make(map[string]float64, len(taskLags))
+	elapsed := now.Sub(a.lastAt).Seconds()
+	for taskName, lag := range taskLags {
+		load := float64(lag)
+		if prev, ok := a.lastProduced[taskName]; ok && elapsed > 0 && taskProduced[taskName] >= prev {
+			load += float64(taskProduced[taskName]-prev) / elapsed * loadWindow.Seconds()
+		}
+		loads[taskName] = load
+	}
+	a.lastProduced, a.lastAt = taskProduced, now
+	return
+}
+
+// distribute assigns tasks to instances with consistent hashing with bounded loads. Each task ranks instances by
+// rendezvous hashing, so that adding or removing an instance moves few tasks. An instance accepts tasks until its
+// load exceeds capacityFactor times the average, so that hot tasks spread. A task stays at its previous instance if
+// that one is still alive and has room, unless the task ranks a newly joined instance first, so that scaling out
+// takes over some tasks. Tasks are placed from the heaviest one. Every task weighs at least 1, so that idle tasks
+// spread by count.
+func distribute(tasks []string, loads map[string]float64, insts []string, prev map[string][]string) (assignment map[string][]string) {
+	assignment = make(map[string][]string, len(insts))
+	if len(insts) == 0 {
+		return
+	}
+	weight := func(taskName string) float64 { return loads[taskName] + 1 }
+	sorted := append([]string(nil), tasks...)
+	sort.Slice(sorted, func(i, j int) bool {
+		wi, wj := weight(sorted[i]), weight(sorted[j])
+		return wi > wj || (wi == wj && sorted[i] < sorted[j])
+	})
+	var total float64
+	for _, taskName := range sorted {
+		total += weight(taskName)
+	}
+	capacity := total / float64(len(insts)) * capacityFactor
+	alive := make(map[string]bool, len(insts))
+	for _, inst := range insts {
+		alive[inst] = true
+	}
+	prevOwner := make(map[string]string)
+	for inst, taskNames := range prev {
+		for _, taskName := range taskNames {
+			prevOwner[taskName] = inst
+		}
+	}
+	instLoads := make(map[string]float64, len(insts))
+	fits := func(inst, taskName string) bool {
+		// An empty instance takes any task, so that a task heavier than capacity still gets a place.
+		return instLoads[inst] == 0 || instLoads[inst]+weight(taskName) <= capacity
+	}
+	for _, taskName := range sorted {
+		target := ""
+		for _, inst := range rankInstances(taskName, insts) {
+			if fits(inst, taskName) {
+				target = inst
+				break
+			}
+		}
+		if _, existed := prev[target]; existed || target == "" {
+			// Stay at the previous instance unless the task prefers a newly joined one.
+			if inst := prevOwner[taskName]; alive[inst] && fits(inst, taskName) {
+				target = inst
+			}
+		}
+		if target == "" {
+			// No instance has room. Fall back to the least loaded one.
+			for _, inst := range insts {
+				if target == "" || instLoads[inst] < instLoads[target] {
+					target = inst
+				}
+			}
+		}
+		instLoads[target] += weight(taskName)
+		assignment[target] = append(assignment[target], taskName)
+	}
+	for inst := range assignment {
+		sort.Strings(assignment[inst])
+	}
+	return
+}
+
+// rankInstances orders instances by rendezvous hashing against the task.
+func rankInstances(taskName string, insts []string) (ranked []string) {
+	ranked = append([]string(nil), insts...)
+	scores := make(map[string]uint64, len(insts))
+	for _, inst := range insts {
+		scores[inst] = xxhash.Sum64String(taskName + "\x00" + inst)
+	}
+	sort.Slice(ranked, func(i, j int) bool { return scores[ranked[i]] > scores[ranked[j]] })
+	return
+}
+
+// assign distributes tasks among instances per lags, and publishs the assignment via rcm.
+// newInsts are the alive instances reported by the backend.
+func (a *assigner) assign(rcm RemoteConfManager, newInsts []string) (err error) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	sort.Strings(newInsts)
+	if a.leading != nil {
+		if newInsts == nil || !a.leading() {
+			return
+		}
+	} else if newInsts == nil || newInsts[0] != a.instance {
+		// Only the first instance is capable to assgin
+		return
+	}
+
+	var newCfg *config.Config
+	if newCfg, err = rcm.GetConfig(); err != nil {
+		err = errors.Wrapf(err, "rcm.GetConfig failed")
+		return
+	}
+	if reflect.DeepEqual(a.curInsts, newInsts) &&
+		reflect.DeepEqual(a.curCfg, newCfg) &&
+		a.curCfg.Assignment.UpdatedBy == a.instance &&
+		time.Unix(a.curCfg.Assignment.UpdatedAt, 0).Add(10*time.Minute).After(time.Now()) {
+		util.Logger.Info("Both instances and config are up-to-date, and the config was published by myself in less than 10 minutes.")
+		return
+	}
+
+	var taskLags, taskProduced map[string]int64
+	if taskLags, taskProduced, err = GetTaskOffsets(newCfg); err != nil {
+		return
+	}
+	util.Logger.Debug(fmt.Sprintf("task lags %+v", taskLags))
+	loads := a.taskLoads(taskLags, taskProduced)
+
+	var validTasks []string
+	for _, taskCfg := range newCfg.Tasks {
+		if _, ok := taskLags[taskCfg.Name]; ok {
+			validTasks = append(validTasks, taskCfg.Name)
+		}
+	}
+	assignment := distribute(validTasks, loads, newInsts, newCfg.Assignment.Map)
+	instAgs := make([]*InstanceAssignment, len(newInsts))
+	for i, instance := range newInsts {
+		instAgs[i] = &InstanceAssignment{
+			Instance: instance,
+		}
+		for _, taskName := range assignment[instance] {
+			instAgs[i].TotalLag += taskLags[taskName]
+			instAgs[i].TaskLags = append(instAgs[i].TaskLags, TaskLag{Task: taskName, Lag: taskLags[taskName]})
+		}
+	}
+
+	// publish assignment
+	newVer := a.curVer + 1
+	util.Logger.Debug("going to publish assignment", zap.Int("version", newVer), zap.Reflect("assignment", instAgs))
+	newCfg.Assignment.Map = make(map[string][]string)
+	for _, instAg := range instAgs {
+		var tasks []string
+		for _, taskLag := range instAg.TaskLags {
+			tasks = append(tasks, taskLag.Task)
+		}
+		sort.Strings(tasks)
+		newCfg.Assignment.Map[instAg.Instance] = tasks
+	}
+	newCfg.Assignment.Version = newVer
+	newCfg.Assignment.UpdatedBy = a.instance
+	newCfg.Assignment.UpdatedAt = time.Now().Unix()
+	if err = rcm.PublishConfig(newCfg); err != nil {
+		return
+	}
+	if reporter, ok := rcm.(assignmentReporter); ok {
+		reporter.reportAssignment(instAgs)
+	}
+	a.curCfg = newCfg
+	a.curInsts = newInsts
+	a.curVer = newVer
+
+	return
+}
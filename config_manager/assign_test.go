@@ -0,0 +1,77 @@
+package rcm
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDistribute(t *testing.T) {
+	var tasks []string
+	loads := make(map[string]float64)
+	for i := 0; i < 20; i++ {
+		task := fmt.Sprintf("task%d", i)
+		tasks = append(tasks, task)
+		loads[task] = 10
+	}
+	loads["task0"] = 1000 // a hot task
+	insts := []string{"a:1", "b:1", "c:1"}
+	assignment := distribute(tasks, loads, insts, nil)
+	require.Equal(t, []string{"task0"}, assignment[ownerOf(assignment, "task0")])
+	for _, inst := range insts {
+		require.NotEmpty(t, assignment[inst])
+	}
+
+	// Unchanged inputs keep the assignment.
+	require.Equal(t, assignment, distribute(tasks, loads, insts, assignment))
+
+	// Adding an instance moves tasks to the new one only.
+	newAssignment := distribute(tasks, loads, append(insts, "d:1"), assignment)
+	require.NotEmpty(t, newAssignment["d:1"])
+	for _, task := range tasks {
+		if owner := ownerOf(newAssignment, task); owner != "d:1" {
+			require.Equal(t, ownerOf(assignment, task), owner)
+		}
+	}
+}
+
+func TestDistributeToNewInstance(t *testing.T) {
+	var tasks []string
+	loads := make(map[string]float64)
+	for i := 0; i < 20; i++ {
+		task := fmt.Sprintf("task%d", i)
+		tasks = append(tasks, task)
+		loads[task] = 10
+	}
+	insts := []string{"a:1", "b:1", "c:1"}
+	assignment := distribute(tasks, loads, insts, nil)
+
+	// Tasks of equal loads are placed by name. The first one preferring the newly joined instance finds it empty,
+	// and moves to it.
+	newInsts := append(insts, "d:1")
+	sorted := append([]string(nil), tasks...)
+	sort.Strings(sorted)
+	var moved string
+	for _, task := range sorted {
+		if rankInstances(task, newInsts)[0] == "d:1" {
+			moved = task
+			break
+		}
+	}
+	require.NotEmpty(t, moved)
+	require.NotEqual(t, "d:1", ownerOf(assignment, moved))
+	require.Equal(t, "d:1", ownerOf(distribute(tasks, loads, newInsts, assignment), moved))
+}
+
+func ownerOf(assignment map[string][]string, task string) string {
+	for inst, tasks := range assignment {
+		for _, t := range tasks {
+			if t == task {
+				return inst
+			}
+		}
+	}
+	return ""
+}
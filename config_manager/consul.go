@@ -0,0 +1,297 @@
+package rcm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/forever765/clickhouse_sinker_nali/config"
+	"github.com/forever765/clickhouse_sinker_nali/util"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+var _ RemoteConfManager = (*ConsulConfManager)(nil)
+var _ ConfChangeNotifier = (*ConsulConfManager)(nil)
+
+// Blocking queries return after consulWait if nothing changed.
+const consulWait = 5 * time.Minute
+
+// ConsulConfManager stores the config at a Consul KV key, and registers sinker instances as a Consul service.
+// It talks to the Consul HTTP API directly, and watches changes with blocking queries.
+type ConsulConfManager struct {
+	client      *http.Client
+	addr        string // scheme://host:port of the Consul agent
+	token       string
+	datacenter  string
+	key         string
+	serviceName string
+	serviceID   string
+
+	// state of assignment loop
+	assigner
+	ctx       context.Context
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
+	changedCh chan struct{} // config changed
+	assignCh  chan struct{} // config or service changed
+}
+
+type consulServiceCheck struct {
+	HTTP                           string
+	Interval                       string
+	Timeout                        string
+	DeregisterCriticalServiceAfter string
+}
+
+type consulService struct {
+	ID      string
+	Name    string
+	Address string
+	Port    int
+	Check   *consulServiceCheck `json:",omitempty"`
+}
+
+type consulServiceEntry struct {
+	Service consulService
+}
+
+func (ccm *ConsulConfManager) Init(properties map[string]interface{}) (err error) {
+	ccm.addr = "http://127.0.0.1:8500"
+	if v, ok := properties["addr"].(string); ok && v != "" {
+		ccm.addr = v
+	}
+	if !strings.Contains(ccm.addr, "://") {
+		ccm.addr = "http://" + ccm.addr
+	}
+	ccm.addr = strings.TrimSuffix(ccm.addr, "/")
+	ccm.token, _ = properties["token"].(string)
+	ccm.datacenter, _ = properties["datacenter"].(string)
+	ccm.key, _ = properties["key"].(string)
+	ccm.serviceName, _ = properties["serviceName"].(string)
+	if ccm.key == "" {
+		err = errors.Errorf("consul key is required")
+		return
+	}
+	// Leave room for the blocking query's wait and its jitter(up to wait/16).
+	ccm.client = &http.Client{Timeout: consulWait + consulWait/16 + 10*time.Second}
+	ccm.changedCh = make(chan struct{}, 1)
+	ccm.assignCh = make(chan struct{}, 1)
+	ccm.ctx, ccm.cancel = context.WithCancel(context.Background())
+	ccm.wg.Add(1)
+	go ccm.watch("/v1/kv/"+ccm.key, func() {
+		notify(ccm.changedCh)
+		notify(ccm.assignCh)
+	})
+	return
+}
+
+// notify sends to a channel of size 1 without blocking. Pending notifications are merged.
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// ConfChanged implements ConfChangeNotifier.
+func (ccm *ConsulConfManager) ConfChanged() <-chan struct{} {
+	return ccm.changedCh
+}
+
+// do sends a request to the Consul agent, and returns the response body and the X-Consul-Index header.
+func (ccm *ConsulConfManager) do(ctx context.Context, method, path string, query url.Values, body []byte) (respBody []byte, index uint64, err error) {
+	if query == nil {
+		query = url.Values{}
+	}
+	if ccm.datacenter != "" {
+		query.Set("dc", ccm.datacenter)
+	}
+	u := ccm.addr + path
+	if len(query) != 0 {
+		u += "?" + query.Encode()
+	}
+	var req *http.Request
+	if req, err = http.NewRequestWithContext(ctx, method, u, bytes.NewReader(body)); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	if ccm.token != "" {
+		req.Header.Set("X-Consul-Token", ccm.token)
+	}
+	var resp *http.Response
+	if resp, err = ccm.client.Do(req); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	defer resp.Body.Close()
+	if respBody, err = ioutil.ReadAll(resp.Body); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		err = errors.Errorf("%s %s: %s %s", method, path, resp.Status, strings.TrimSpace(string(respBody)))
+		return
+	}
+	index, _ = strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	return
+}
+
+// watch issues blocking queries against path, and calls onChange whenever the index changes.
+func (ccm *ConsulConfManager) watch(path string, onChange func()) {
+	defer ccm.wg.Done()
+	var lastIndex uint64
+	for {
+		query := url.Values{}
+		if lastIndex != 0 {
+			query.Set("index", strconv.FormatUint(lastIndex, 10))
+			query.Set("wait", fmt.Sprintf("%ds", int(consulWait.Seconds())))
+		}
+		_, index, err := ccm.do(ccm.ctx, http.MethodGet, path, query, nil)
+		if ccm.ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			util.Logger.Warn("consul blocking query failed", zap.String("path", path), zap.Error(err))
+			select {
+			case <-ccm.ctx.Done():
+				return
+			case <-time.After(5 * time.Second):
+			}
+			continue
+		}
+		if lastIndex != 0 && index != lastIndex {
+			util.Logger.Debug("consul watch triggered", zap.String("path", path), zap.Uint64("index", index))
+			onChange()
+		}
+		if index < lastIndex {
+			// The index went backwards, such as after a Consul cluster recovery. Reset it as the Consul doc suggests.
+			index = 0
+		}
+		lastIndex = index
+	}
+}
+
+// GetConfig merges the config at the key and those it includes. Includes are keys.
+func (ccm *ConsulConfManager) GetConfig() (conf *config.Config, err error) {
+	loader := config.Loader{Read: func(key string) (content []byte, err error) {
+		content, _, err = ccm.do(ccm.ctx, http.MethodGet, "/v1/kv/"+key, url.Values{"raw": []string{""}}, nil)
+		return
+	}}
+	return loader.Load(ccm.key)
+}
+
+func (ccm *ConsulConfManager) PublishConfig(conf *config.Config) (err error) {
+	var bs []byte
+	if bs, err = conf.MainLayer(); err != nil {
+		return
+	}
+	_, _, err = ccm.do(ccm.ctx, http.MethodPut, "/v1/kv/"+ccm.key, nil, bs)
+	return
+}
+
+func (ccm *ConsulConfManager) Register(ip string, port int) (err error) {
+	ccm.instance = toInstanceID(ip, port)
+	ccm.serviceID = ccm.serviceName + "-" + ccm.instance
+	svc := consulService{
+		ID:      ccm.serviceID,
+		Name:    ccm.serviceName,
+		Address: ip,
+		Port:    port,
+		// An instance failed to deregister itself is removed once it's unhealthy for a while.
+		Check: &consulServiceCheck{
+			HTTP:                           fmt.Sprintf("http://%s/ready", ccm.instance),
+			Interval:                       "10s",
+			Timeout:                        "5s",
+			DeregisterCriticalServiceAfter: "1m",
+		},
+	}
+	var bs []byte
+	if bs, err = json.Marshal(svc); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	_, _, err = ccm.do(ccm.ctx, http.MethodPut, "/v1/agent/service/register", nil, bs)
+	return
+}
+
+func (ccm *ConsulConfManager) Deregister(ip string, port int) (err error) {
+	return ccm.deregister(ccm.serviceName + "-" + toInstanceID(ip, port))
+}
+
+func (ccm *ConsulConfManager) deregister(serviceID string) (err error) {
+	// The context of ccm could have been canceled at Stop.
+	_, _, err = ccm.do(context.Background(), http.MethodPut, "/v1/agent/service/deregister/"+url.PathEscape(serviceID), nil, nil)
+	return
+}
+
+// instances returns alive instances of the service.
+func (ccm *ConsulConfManager) instances() (insts []string, err error) {
+	var body []byte
+	if body, _, err = ccm.do(ccm.ctx, http.MethodGet, "/v1/health/service/"+url.PathEscape(ccm.serviceName), url.Values{"passing": []string{"true"}}, nil); err != nil {
+		return
+	}
+	var entries []consulServiceEntry
+	if err = json.Unmarshal(body, &entries); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	for _, entry := range entries {
+		insts = append(insts, toInstanceID(entry.Service.Address, entry.Service.Port))
+	}
+	return
+}
+
+func (ccm *ConsulConfManager) assign() (err error) {
+	var newInsts []string
+	if newInsts, err = ccm.instances(); err != nil {
+		err = errors.Wrapf(err, "ccm.instances failed")
+		return
+	}
+	return ccm.assigner.assign(ccm, newInsts)
+}
+
+func (ccm *ConsulConfManager) Run() {
+	ccm.wg.Add(2)
+	defer ccm.wg.Done()
+	go ccm.watch("/v1/health/service/"+url.PathEscape(ccm.serviceName), func() {
+		notify(ccm.assignCh)
+	})
+	util.Logger.Debug("assign first")
+	if err := ccm.assign(); err != nil {
+		util.Logger.Error("first assign failed", zap.Error(err))
+	}
+	for {
+		select {
+		case <-ccm.ctx.Done():
+			util.Logger.Info("ConsulConfManager.Run quit due to context has been canceled")
+			return
+		case <-ccm.assignCh:
+			util.Logger.Debug("assign triggered by config or service change")
+		case <-time.After(5 * time.Minute):
+			util.Logger.Debug("assign triggered by 5 min timer")
+		}
+		if err := ccm.assign(); err != nil {
+			util.Logger.Error("assign failed", zap.Error(err))
+		}
+	}
+}
+
+func (ccm *ConsulConfManager) Stop() {
+	ccm.cancel()
+	ccm.wg.Wait()
+	if ccm.serviceID != "" {
+		if err := ccm.deregister(ccm.serviceID); err != nil {
+			util.Logger.Error("failed to deregister from consul", zap.String("serviceID", ccm.serviceID), zap.Error(err))
+		}
+	}
+	util.Logger.Info("stopped consul config manager")
+}
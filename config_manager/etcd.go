@@ -0,0 +1,500 @@
+package rcm
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/forever765/clickhouse_sinker_nali/config"
+	"github.com/forever765/clickhouse_sinker_nali/util"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+var _ RemoteConfManager = (*EtcdConfManager)(nil)
+var _ ConfChangeNotifier = (*EtcdConfManager)(nil)
+
+// etcdLeaseTTL is the TTL in seconds of the lease attached to an instance key. A crashed instance disappears after that.
+const etcdLeaseTTL = 10
+
+const etcdRequestTimeout = 10 * time.Second
+
+// errEtcdUnauthenticated indicates the auth token is missing or expired.
+var errEtcdUnauthenticated = errors.New("etcd: unauthenticated")
+
+// EtcdConfManager stores the config at an etcd key, and registers sinker instances as keys under "<serviceName>/" with a lease.
+// It talks to the etcd v3 JSON gateway(etcd 3.4+) directly, and watches changes with the watch API.
+type EtcdConfManager struct {
+	client      *http.Client
+	endpoints   []string // scheme://host:port
+	username    string
+	password    string
+	key         string
+	serviceName string
+
+	mux     sync.Mutex // protect token, epIdx and leaseID
+	token   string
+	epIdx   int // index of the endpoint in use
+	leaseID string
+
+	// state of assignment loop
+	assigner
+	ctx       context.Context
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
+	changedCh chan struct{} // config changed
+	assignCh  chan struct{} // config or instances changed
+}
+
+type etcdHeader struct {
+	Revision string `json:"revision"`
+}
+
+type etcdKeyValue struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+}
+
+type etcdRangeRequest struct {
+	Key      []byte `json:"key"`
+	RangeEnd []byte `json:"range_end,omitempty"`
+	KeysOnly bool   `json:"keys_only,omitempty"`
+}
+
+type etcdRangeResponse struct {
+	Header etcdHeader     `json:"header"`
+	Kvs    []etcdKeyValue `json:"kvs"`
+}
+
+type etcdPutRequest struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+	Lease string `json:"lease,omitempty"`
+}
+
+type etcdLeaseRequest struct {
+	TTL string `json:"TTL,omitempty"`
+	ID  string `json:"ID,omitempty"`
+}
+
+type etcdLeaseResponse struct {
+	ID  string `json:"ID"`
+	TTL string `json:"TTL"`
+}
+
+type etcdWatchResponse struct {
+	Result *struct {
+		Created  bool              `json:"created"`
+		Canceled bool              `json:"canceled"`
+		Events   []json.RawMessage `json:"events"`
+	} `json:"result"`
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func (ecm *EtcdConfManager) Init(properties map[string]interface{}) (err error) {
+	endpoints := "http://127.0.0.1:2379"
+	if v, ok := properties["endpoints"].(string); ok && v != "" {
+		endpoints = v
+	}
+	for _, ep := range strings.Split(endpoints, ",") {
+		if ep = strings.TrimSpace(ep); ep == "" {
+			continue
+		}
+		if !strings.Contains(ep, "://") {
+			ep = "http://" + ep
+		}
+		ecm.endpoints = append(ecm.endpoints, strings.TrimSuffix(ep, "/"))
+	}
+	ecm.username, _ = properties["username"].(string)
+	ecm.password, _ = properties["password"].(string)
+	ecm.key, _ = properties["key"].(string)
+	ecm.serviceName, _ = properties["serviceName"].(string)
+	if ecm.key == "" {
+		err = errors.Errorf("etcd key is required")
+		return
+	}
+	// Streaming watch requests are limited by context instead of client timeout.
+	ecm.client = &http.Client{}
+	ecm.changedCh = make(chan struct{}, 1)
+	ecm.assignCh = make(chan struct{}, 1)
+	ecm.ctx, ecm.cancel = context.WithCancel(context.Background())
+	ecm.wg.Add(1)
+	go ecm.watch([]byte(ecm.key), nil, func() {
+		notify(ecm.changedCh)
+		notify(ecm.assignCh)
+	})
+	return
+}
+
+// ConfChanged implements ConfChangeNotifier.
+func (ecm *EtcdConfManager) ConfChanged() <-chan struct{} {
+	return ecm.changedCh
+}
+
+// endpoint returns the endpoint in use.
+func (ecm *EtcdConfManager) endpoint() string {
+	ecm.mux.Lock()
+	defer ecm.mux.Unlock()
+	return ecm.endpoints[ecm.epIdx]
+}
+
+// nextEndpoint switches to the next endpoint if the failed one is still in use.
+func (ecm *EtcdConfManager) nextEndpoint(failed string) {
+	ecm.mux.Lock()
+	defer ecm.mux.Unlock()
+	if ecm.endpoints[ecm.epIdx] == failed {
+		ecm.epIdx = (ecm.epIdx + 1) % len(ecm.endpoints)
+	}
+}
+
+// post sends a request to the gateway. The caller shall close the body of the returned response.
+func (ecm *EtcdConfManager) post(ctx context.Context, ep, path string, reqBody interface{}) (resp *http.Response, err error) {
+	var bs []byte
+	if bs, err = json.Marshal(reqBody); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	var req *http.Request
+	if req, err = http.NewRequestWithContext(ctx, http.MethodPost, ep+path, bytes.NewReader(bs)); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token := ecm.getToken(); token != "" {
+		req.Header.Set("Authorization", token)
+	}
+	if resp, err = ecm.client.Do(req); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusUnauthorized {
+			err = errEtcdUnauthenticated
+		} else {
+			err = errors.Errorf("POST %s: %s %s", path, resp.Status, strings.TrimSpace(string(body)))
+		}
+		resp = nil
+	}
+	return
+}
+
+func (ecm *EtcdConfManager) getToken() string {
+	ecm.mux.Lock()
+	defer ecm.mux.Unlock()
+	return ecm.token
+}
+
+func (ecm *EtcdConfManager) authenticate(ctx context.Context, ep string) (err error) {
+	ecm.mux.Lock()
+	ecm.token = ""
+	ecm.mux.Unlock()
+	var resp *http.Response
+	if resp, err = ecm.post(ctx, ep, "/v3/auth/authenticate", map[string]string{"name": ecm.username, "password": ecm.password}); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	var auth struct {
+		Token string `json:"token"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&auth); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	ecm.mux.Lock()
+	ecm.token = auth.Token
+	ecm.mux.Unlock()
+	return
+}
+
+// do sends a unary request, authenticates on demand, and tries the next endpoint once on failure.
+func (ecm *EtcdConfManager) do(ctx context.Context, path string, reqBody, respBody interface{}) (err error) {
+	ctx, cancel := context.WithTimeout(ctx, etcdRequestTimeout)
+	defer cancel()
+	var resp *http.Response
+	for attempt := 0; attempt < 2; attempt++ {
+		ep := ecm.endpoint()
+		if ecm.username != "" && ecm.getToken() == "" {
+			if err = ecm.authenticate(ctx, ep); err != nil {
+				ecm.nextEndpoint(ep)
+				continue
+			}
+		}
+		if resp, err = ecm.post(ctx, ep, path, reqBody); err == nil {
+			break
+		}
+		if err == errEtcdUnauthenticated && ecm.username != "" {
+			// The token expired. Authenticate again.
+			ecm.mux.Lock()
+			ecm.token = ""
+			ecm.mux.Unlock()
+			continue
+		}
+		ecm.nextEndpoint(ep)
+	}
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if err = json.NewDecoder(resp.Body).Decode(respBody); err != nil {
+		err = errors.Wrapf(err, "")
+	}
+	return
+}
+
+// prefixEnd returns the range end which covers all keys with the prefix.
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte(nil), prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return []byte{0}
+}
+
+// watch watches the key or range, and calls onChange once any event arrives.
+// Since events could be lost during reconnecting, onChange is called after every reconnection as well.
+func (ecm *EtcdConfManager) watch(key, rangeEnd []byte, onChange func()) {
+	defer ecm.wg.Done()
+	var connected bool
+	for {
+		err := ecm.watchOnce(key, rangeEnd, func(created bool) {
+			if created {
+				if connected {
+					onChange()
+				}
+				connected = true
+				return
+			}
+			onChange()
+		})
+		if ecm.ctx.Err() != nil {
+			return
+		}
+		util.Logger.Warn("etcd watch interrupted", zap.String("key", string(key)), zap.Error(err))
+		select {
+		case <-ecm.ctx.Done():
+			return
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+func (ecm *EtcdConfManager) watchOnce(key, rangeEnd []byte, onEvent func(created bool)) (err error) {
+	ep := ecm.endpoint()
+	if ecm.username != "" {
+		if err = ecm.authenticate(ecm.ctx, ep); err != nil {
+			ecm.nextEndpoint(ep)
+			return
+		}
+	}
+	req := map[string]interface{}{
+		"create_request": etcdRangeRequest{Key: key, RangeEnd: rangeEnd},
+	}
+	var resp *http.Response
+	if resp, err = ecm.post(ecm.ctx, ep, "/v3/watch", req); err != nil {
+		ecm.nextEndpoint(ep)
+		return
+	}
+	defer resp.Body.Close()
+	dec := json.NewDecoder(bufio.NewReader(resp.Body))
+	for {
+		var wr etcdWatchResponse
+		if err = dec.Decode(&wr); err != nil {
+			if err == io.EOF {
+				err = errors.Errorf("watch stream closed")
+			} else {
+				err = errors.Wrapf(err, "")
+			}
+			return
+		}
+		if wr.Error != nil {
+			err = errors.Errorf("watch: %s", wr.Error.Message)
+			return
+		}
+		if wr.Result == nil {
+			continue
+		}
+		if wr.Result.Canceled {
+			err = errors.Errorf("watch canceled")
+			return
+		}
+		if wr.Result.Created {
+			onEvent(true)
+		} else if len(wr.Result.Events) != 0 {
+			onEvent(false)
+		}
+	}
+}
+
+// GetConfig merges the config at the key and those it includes. Includes are keys.
+func (ecm *EtcdConfManager) GetConfig() (conf *config.Config, err error) {
+	loader := config.Loader{Read: func(key string) (content []byte, err error) {
+		var rr etcdRangeResponse
+		if err = ecm.do(ecm.ctx, "/v3/kv/range", etcdRangeRequest{Key: []byte(key)}, &rr); err != nil {
+			return
+		}
+		if len(rr.Kvs) == 0 {
+			err = errors.Errorf("etcd key %s not found", key)
+			return
+		}
+		content = rr.Kvs[0].Value
+		return
+	}}
+	return loader.Load(ecm.key)
+}
+
+func (ecm *EtcdConfManager) PublishConfig(conf *config.Config) (err error) {
+	var bs []byte
+	if bs, err = conf.MainLayer(); err != nil {
+		return
+	}
+	var resp json.RawMessage
+	err = ecm.do(ecm.ctx, "/v3/kv/put", etcdPutRequest{Key: []byte(ecm.key), Value: bs}, &resp)
+	return
+}
+
+func (ecm *EtcdConfManager) instanceKey(instance string) []byte {
+	return []byte(ecm.serviceName + "/" + instance)
+}
+
+// Register puts the instance key with a lease, and keeps the lease alive until Stop.
+func (ecm *EtcdConfManager) Register(ip string, port int) (err error) {
+	ecm.instance = toInstanceID(ip, port)
+	if err = ecm.grant(); err != nil {
+		return
+	}
+	ecm.wg.Add(1)
+	go ecm.keepAlive()
+	return
+}
+
+// grant creates a lease and attaches the instance key to it.
+func (ecm *EtcdConfManager) grant() (err error) {
+	var lr etcdLeaseResponse
+	if err = ecm.do(ecm.ctx, "/v3/lease/grant", etcdLeaseRequest{TTL: strconv.Itoa(etcdLeaseTTL)}, &lr); err != nil {
+		return
+	}
+	var resp json.RawMessage
+	if err = ecm.do(ecm.ctx, "/v3/kv/put", etcdPutRequest{Key: ecm.instanceKey(ecm.instance), Value: []byte(ecm.instance), Lease: lr.ID}, &resp); err != nil {
+		return
+	}
+	ecm.mux.Lock()
+	ecm.leaseID = lr.ID
+	ecm.mux.Unlock()
+	return
+}
+
+func (ecm *EtcdConfManager) keepAlive() {
+	defer ecm.wg.Done()
+	ticker := time.NewTicker(etcdLeaseTTL * time.Second / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ecm.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		ecm.mux.Lock()
+		leaseID := ecm.leaseID
+		ecm.mux.Unlock()
+		var resp struct {
+			Result etcdLeaseResponse `json:"result"`
+		}
+		if err := ecm.do(ecm.ctx, "/v3/lease/keepalive", etcdLeaseRequest{ID: leaseID}, &resp); err != nil {
+			util.Logger.Warn("etcd lease keepalive failed", zap.String("lease", leaseID), zap.Error(err))
+			continue
+		}
+		if ttl, _ := strconv.Atoi(resp.Result.TTL); ttl <= 0 {
+			// The lease expired and the instance key is gone. Register again.
+			util.Logger.Warn("etcd lease expired, register again", zap.String("lease", leaseID))
+			if err := ecm.grant(); err != nil {
+				util.Logger.Error("etcd register failed", zap.Error(err))
+			}
+		}
+	}
+}
+
+func (ecm *EtcdConfManager) Deregister(ip string, port int) (err error) {
+	var resp json.RawMessage
+	err = ecm.do(context.Background(), "/v3/kv/deleterange", etcdRangeRequest{Key: ecm.instanceKey(toInstanceID(ip, port))}, &resp)
+	return
+}
+
+// instances returns registered instances of the service.
+func (ecm *EtcdConfManager) instances() (insts []string, err error) {
+	prefix := []byte(ecm.serviceName + "/")
+	var rr etcdRangeResponse
+	if err = ecm.do(ecm.ctx, "/v3/kv/range", etcdRangeRequest{Key: prefix, RangeEnd: prefixEnd(prefix), KeysOnly: true}, &rr); err != nil {
+		return
+	}
+	for _, kv := range rr.Kvs {
+		insts = append(insts, string(kv.Key[len(prefix):]))
+	}
+	return
+}
+
+func (ecm *EtcdConfManager) assign() (err error) {
+	var newInsts []string
+	if newInsts, err = ecm.instances(); err != nil {
+		err = errors.Wrapf(err, "ecm.instances failed")
+		return
+	}
+	return ecm.assigner.assign(ecm, newInsts)
+}
+
+func (ecm *EtcdConfManager) Run() {
+	ecm.wg.Add(2)
+	defer ecm.wg.Done()
+	prefix := []byte(ecm.serviceName + "/")
+	go ecm.watch(prefix, prefixEnd(prefix), func() {
+		notify(ecm.assignCh)
+	})
+	util.Logger.Debug("assign first")
+	if err := ecm.assign(); err != nil {
+		util.Logger.Error("first assign failed", zap.Error(err))
+	}
+	for {
+		select {
+		case <-ecm.ctx.Done():
+			util.Logger.Info("EtcdConfManager.Run quit due to context has been canceled")
+			return
+		case <-ecm.assignCh:
+			util.Logger.Debug("assign triggered by config or instances change")
+		case <-time.After(5 * time.Minute):
+			util.Logger.Debug("assign triggered by 5 min timer")
+		}
+		if err := ecm.assign(); err != nil {
+			util.Logger.Error("assign failed", zap.Error(err))
+		}
+	}
+}
+
+func (ecm *EtcdConfManager) Stop() {
+	ecm.cancel()
+	ecm.wg.Wait()
+	ecm.mux.Lock()
+	leaseID := ecm.leaseID
+	ecm.mux.Unlock()
+	if leaseID != "" {
+		// Revoking the lease removes the instance key at once, instead of after TTL.
+		var resp json.RawMessage
+		if err := ecm.do(context.Background(), "/v3/lease/revoke", etcdLeaseRequest{ID: leaseID}, &resp); err != nil {
+			util.Logger.Error("failed to revoke etcd lease", zap.String("lease", leaseID), zap.Error(err))
+		}
+	}
+	util.Logger.Info("stopped etcd config manager")
+}
@@ -0,0 +1,529 @@
+package rcm
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/forever765/clickhouse_sinker_nali/config"
+	"github.com/forever765/clickhouse_sinker_nali/util"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+var _ RemoteConfManager = (*KubernetesConfManager)(nil)
+var _ ConfChangeNotifier = (*KubernetesConfManager)(nil)
+var _ Scaler = (*KubernetesConfManager)(nil)
+
+const (
+	k8sSATokenFile     = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	k8sSACAFile        = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+	k8sSANamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+	// the ClickHouseSinkerTask CRD, see deploy/kubernetes/crd.yaml
+	k8sTaskGroup   = "clickhouse-sinker.forever765.github.io"
+	k8sTaskVersion = "v1alpha1"
+	k8sTaskPlural  = "clickhousesinkertasks"
+
+	k8sAssignmentKey    = "assignment.json"
+	k8sDefaultConfigKey = "config.json"
+	k8sDefaultConfigMap = "clickhouse-sinker"
+	k8sRequestTimeout   = 10 * time.Second
+)
+
+// KubernetesConfManager runs sinker pods as the controller of ClickHouseSinkerTask resources.
+// The common config(clickhouse, kafka and so on) comes from a ConfigMap, and each ClickHouseSinkerTask in the namespace is a task whose spec is a task config.
+// Ready pods matching the label selector share tasks. The assignment is stored at the ConfigMap, and surfaced at status of tasks along with lags.
+// It talks to the API server with the service account of the pod.
+type KubernetesConfManager struct {
+	client      *http.Client
+	apiServer   string
+	namespace   string
+	configMap   string
+	configKey   string
+	podSelector string // label selector of sinker pods, empty means not participating in assignment
+	lease       string // name of the Lease for leader election, empty means discovering pods by podSelector
+	port        string // http port of sinker pods
+
+	mux     sync.Mutex        // protect crNames
+	crNames map[string]string // task name -> ClickHouseSinkerTask name
+
+	// state of assignment loop
+	assigner
+	ctx       context.Context
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
+	changedCh chan struct{} // config changed
+	assignCh  chan struct{} // config or pods changed
+	leading   int32         // 1 if holding the leader Lease
+	members   []string      // the last seen members, by the leader
+}
+
+type k8sObjectMeta struct {
+	Name            string            `json:"name"`
+	ResourceVersion string            `json:"resourceVersion,omitempty"`
+	Labels          map[string]string `json:"labels,omitempty"`
+}
+
+type k8sConfigMap struct {
+	Metadata k8sObjectMeta     `json:"metadata"`
+	Data     map[string]string `json:"data"`
+}
+
+type k8sTask struct {
+	Metadata k8sObjectMeta   `json:"metadata"`
+	Spec     json.RawMessage `json:"spec"`
+}
+
+type k8sTaskList struct {
+	Items []k8sTask `json:"items"`
+}
+
+type k8sTaskStatus struct {
+	AssignedTo string `json:"assignedTo"`
+	Lag        int64  `json:"lag"`
+	UpdatedAt  string `json:"updatedAt"`
+}
+
+type k8sPodList struct {
+	Items []struct {
+		Status struct {
+			Phase      string `json:"phase"`
+			PodIP      string `json:"podIP"`
+			Conditions []struct {
+				Type   string `json:"type"`
+				Status string `json:"status"`
+			} `json:"conditions"`
+		} `json:"status"`
+	} `json:"items"`
+}
+
+type k8sWatchEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+func (kcm *KubernetesConfManager) Init(properties map[string]interface{}) (err error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		err = errors.Errorf("not running inside a Kubernetes pod, KUBERNETES_SERVICE_HOST or KUBERNETES_SERVICE_PORT is absent")
+		return
+	}
+	kcm.apiServer = "https://" + net.JoinHostPort(host, port)
+	var ca []byte
+	if ca, err = ioutil.ReadFile(k8sSACAFile); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		err = errors.Errorf("no certificate found in %s", k8sSACAFile)
+		return
+	}
+	// Watch requests are limited by context instead of client timeout.
+	kcm.client = &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12},
+	}}
+
+	kcm.namespace, _ = properties["namespace"].(string)
+	if kcm.namespace == "" {
+		var ns []byte
+		if ns, err = ioutil.ReadFile(k8sSANamespaceFile); err != nil {
+			err = errors.Wrapf(err, "")
+			return
+		}
+		kcm.namespace = strings.TrimSpace(string(ns))
+	}
+	kcm.configMap, _ = properties["configMap"].(string)
+	if kcm.configMap == "" {
+		kcm.configMap = k8sDefaultConfigMap
+	}
+	kcm.configKey, _ = properties["configKey"].(string)
+	if kcm.configKey == "" {
+		kcm.configKey = k8sDefaultConfigKey
+	}
+	kcm.podSelector, _ = properties["serviceName"].(string)
+	kcm.lease, _ = properties["lease"].(string)
+	if kcm.lease != "" {
+		kcm.assigner.leading = kcm.isLeading
+	}
+	kcm.crNames = make(map[string]string)
+	kcm.changedCh = make(chan struct{}, 1)
+	kcm.assignCh = make(chan struct{}, 1)
+	kcm.ctx, kcm.cancel = context.WithCancel(context.Background())
+
+	onChange := func() {
+		notify(kcm.changedCh)
+		notify(kcm.assignCh)
+	}
+	kcm.wg.Add(2)
+	go kcm.watch(kcm.tasksPath(), nil, onChange)
+	go kcm.watch(kcm.configMapPath(""), url.Values{"fieldSelector": []string{"metadata.name=" + kcm.configMap}}, onChange)
+	return
+}
+
+// ConfChanged implements ConfChangeNotifier.
+func (kcm *KubernetesConfManager) ConfChanged() <-chan struct{} {
+	return kcm.changedCh
+}
+
+func (kcm *KubernetesConfManager) tasksPath() string {
+	return fmt.Sprintf("/apis/%s/%s/namespaces/%s/%s", k8sTaskGroup, k8sTaskVersion, kcm.namespace, k8sTaskPlural)
+}
+
+func (kcm *KubernetesConfManager) configMapPath(name string) string {
+	p := fmt.Sprintf("/api/v1/namespaces/%s/configmaps", kcm.namespace)
+	if name != "" {
+		p += "/" + name
+	}
+	return p
+}
+
+// request sends a request to the API server. The caller shall close the body of the returned response.
+func (kcm *KubernetesConfManager) request(ctx context.Context, method, path string, query url.Values, contentType string, body []byte) (resp *http.Response, err error) {
+	u := kcm.apiServer + path
+	if len(query) != 0 {
+		u += "?" + query.Encode()
+	}
+	var req *http.Request
+	if req, err = http.NewRequestWithContext(ctx, method, u, bytes.NewReader(body)); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	// Read the token every time since projected tokens are rotated.
+	var token []byte
+	if token, err = ioutil.ReadFile(k8sSATokenFile); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	req.Header.Set("Accept", "application/json")
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if resp, err = kcm.client.Do(req); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		err = errors.WithStack(&k8sStatusError{
+			Code: resp.StatusCode,
+			Msg:  fmt.Sprintf("%s %s: %s %s", method, path, resp.Status, strings.TrimSpace(string(msg))),
+		})
+		resp = nil
+	}
+	return
+}
+
+// k8sStatusError is a non-2xx response of the API server.
+type k8sStatusError struct {
+	Code int
+	Msg  string
+}
+
+func (e *k8sStatusError) Error() string {
+	return e.Msg
+}
+
+func isK8sStatus(err error, code int) bool {
+	e, ok := errors.Cause(err).(*k8sStatusError)
+	return ok && e.Code == code
+}
+
+// do sends a unary request and decodes the response into out, which could be nil.
+func (kcm *KubernetesConfManager) do(method, path string, query url.Values, contentType string, body []byte, out interface{}) (err error) {
+	return kcm.doWith(kcm.ctx, method, path, query, contentType, body, out)
+}
+
+func (kcm *KubernetesConfManager) doWith(parent context.Context, method, path string, query url.Values, contentType string, body []byte, out interface{}) (err error) {
+	ctx, cancel := context.WithTimeout(parent, k8sRequestTimeout)
+	defer cancel()
+	var resp *http.Response
+	if resp, err = kcm.request(ctx, method, path, query, contentType, body); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if out == nil {
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		return
+	}
+	if err = json.NewDecoder(resp.Body).Decode(out); err != nil {
+		err = errors.Wrapf(err, "")
+	}
+	return
+}
+
+// watch watches resources at path, and calls onChange for every event.
+// A new watch begins with synthetic ADDED events of existing resources, so nothing is lost during reconnecting.
+func (kcm *KubernetesConfManager) watch(path string, query url.Values, onChange func()) {
+	defer kcm.wg.Done()
+	for {
+		err := kcm.watchOnce(path, query, onChange)
+		if kcm.ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			util.Logger.Warn("kubernetes watch interrupted", zap.String("path", path), zap.Error(err))
+		}
+		select {
+		case <-kcm.ctx.Done():
+			return
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+func (kcm *KubernetesConfManager) watchOnce(path string, query url.Values, onChange func()) (err error) {
+	q := url.Values{"watch": []string{"true"}}
+	for k, v := range query {
+		q[k] = v
+	}
+	var resp *http.Response
+	if resp, err = kcm.request(kcm.ctx, http.MethodGet, path, q, "", nil); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	dec := json.NewDecoder(bufio.NewReader(resp.Body))
+	for {
+		var ev k8sWatchEvent
+		if err = dec.Decode(&ev); err != nil {
+			if err == io.EOF {
+				// The API server closes watches after a timeout.
+				err = nil
+			} else {
+				err = errors.Wrapf(err, "")
+			}
+			return
+		}
+		switch ev.Type {
+		case "ADDED", "MODIFIED", "DELETED":
+			onChange()
+		case "ERROR":
+			err = errors.Errorf("watch error: %s", string(ev.Object))
+			return
+		}
+	}
+}
+
+func (kcm *KubernetesConfManager) getConfigMap() (cm *k8sConfigMap, err error) {
+	cm = &k8sConfigMap{}
+	err = kcm.do(http.MethodGet, kcm.configMapPath(kcm.configMap), nil, "", nil, cm)
+	return
+}
+
+// GetConfig merges the common config at the ConfigMap, tasks and the assignment.
+func (kcm *KubernetesConfManager) GetConfig() (conf *config.Config, err error) {
+	var cm *k8sConfigMap
+	if cm, err = kcm.getConfigMap(); err != nil {
+		return
+	}
+	// Includes are other keys of the ConfigMap.
+	loader := config.Loader{Read: func(key string) (content []byte, err error) {
+		s, ok := cm.Data[key]
+		if !ok {
+			err = errors.Errorf("key %s not found in ConfigMap %s", key, kcm.configMap)
+		}
+		content = []byte(s)
+		return
+	}}
+	if conf, err = loader.Load(kcm.configKey); err != nil {
+		return
+	}
+	if assignment, ok := cm.Data[k8sAssignmentKey]; ok {
+		if err = json.Unmarshal([]byte(assignment), &conf.Assignment); err != nil {
+			err = errors.Wrapf(err, "ConfigMap %s", kcm.configMap)
+			return
+		}
+	}
+
+	var list k8sTaskList
+	if err = kcm.do(http.MethodGet, kcm.tasksPath(), nil, "", nil, &list); err != nil {
+		return
+	}
+	crNames := make(map[string]string)
+	for _, item := range list.Items {
+		taskCfg := &config.TaskConfig{}
+		if err = json.Unmarshal(item.Spec, taskCfg); err != nil {
+			err = errors.Wrapf(err, "ClickHouseSinkerTask %s", item.Metadata.Name)
+			return
+		}
+		if taskCfg.Name == "" {
+			taskCfg.Name = item.Metadata.Name
+		}
+		crNames[taskCfg.Name] = item.Metadata.Name
+		conf.Tasks = append(conf.Tasks, taskCfg)
+	}
+	kcm.mux.Lock()
+	kcm.crNames = crNames
+	kcm.mux.Unlock()
+	return
+}
+
+// PublishConfig only stores the assignment. The common config and tasks are owned by users.
+func (kcm *KubernetesConfManager) PublishConfig(conf *config.Config) (err error) {
+	var bs []byte
+	if bs, err = json.Marshal(conf.Assignment); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	patch := map[string]interface{}{
+		"data": map[string]string{k8sAssignmentKey: string(bs)},
+	}
+	if bs, err = json.Marshal(patch); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	err = kcm.do(http.MethodPatch, kcm.configMapPath(kcm.configMap), nil, "application/merge-patch+json", bs, nil)
+	return
+}
+
+// reportAssignment implements assignmentReporter. It writes the assigned instance and lag to status of each task.
+func (kcm *KubernetesConfManager) reportAssignment(instAgs []*InstanceAssignment) {
+	kcm.mux.Lock()
+	crNames := kcm.crNames
+	kcm.mux.Unlock()
+	now := time.Now().UTC().Format(time.RFC3339)
+	for _, instAg := range instAgs {
+		for _, taskLag := range instAg.TaskLags {
+			crName, ok := crNames[taskLag.Task]
+			if !ok {
+				continue
+			}
+			patch, _ := json.Marshal(map[string]interface{}{
+				"status": k8sTaskStatus{AssignedTo: instAg.Instance, Lag: taskLag.Lag, UpdatedAt: now},
+			})
+			if err := kcm.do(http.MethodPatch, kcm.tasksPath()+"/"+crName+"/status", nil, "application/merge-patch+json", patch, nil); err != nil {
+				util.Logger.Warn("failed to update status of ClickHouseSinkerTask", zap.String("name", crName), zap.Error(err))
+			}
+		}
+	}
+}
+
+// Scale implements Scaler. Deployments and statefulsets are patched via the scale subresource, while minReplicas of
+// an HPA is patched, so that the HPA still scales out further on other metrics.
+func (kcm *KubernetesConfManager) Scale(target string, replicas int) (err error) {
+	var path string
+	var patch interface{}
+	parts := strings.SplitN(target, "/", 2)
+	if len(parts) != 2 {
+		err = errors.Errorf("invalid scale target %s", target)
+		return
+	}
+	switch parts[0] {
+	case "deployments", "statefulsets":
+		path = fmt.Sprintf("/apis/apps/v1/namespaces/%s/%s/%s/scale", kcm.namespace, parts[0], parts[1])
+		patch = map[string]interface{}{"spec": map[string]int{"replicas": replicas}}
+	case "horizontalpodautoscalers":
+		path = fmt.Sprintf("/apis/autoscaling/v1/namespaces/%s/horizontalpodautoscalers/%s", kcm.namespace, parts[1])
+		patch = map[string]interface{}{"spec": map[string]int{"minReplicas": replicas}}
+	default:
+		err = errors.Errorf("invalid scale target %s", target)
+		return
+	}
+	var bs []byte
+	if bs, err = json.Marshal(patch); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	return kcm.do(http.MethodPatch, path, nil, "application/merge-patch+json", bs, nil)
+}
+
+// Register records the instance. Pods are discovered via the label selector, so nothing is written to the API server,
+// unless a Lease is used for leader election, in which case the instance keeps a member Lease.
+func (kcm *KubernetesConfManager) Register(ip string, port int) (err error) {
+	kcm.instance = toInstanceID(ip, port)
+	kcm.port = fmt.Sprint(port)
+	if kcm.lease != "" {
+		kcm.wg.Add(1)
+		go kcm.keepLeases()
+	}
+	return
+}
+
+func (kcm *KubernetesConfManager) Deregister(ip string, port int) (err error) {
+	return
+}
+
+// instances returns ready pods. All pods are assumed to listen at the same http port as this one.
+func (kcm *KubernetesConfManager) instances() (insts []string, err error) {
+	if kcm.lease != "" {
+		return kcm.leaseMembers()
+	}
+	var list k8sPodList
+	if err = kcm.do(http.MethodGet, fmt.Sprintf("/api/v1/namespaces/%s/pods", kcm.namespace), url.Values{"labelSelector": []string{kcm.podSelector}}, "", nil, &list); err != nil {
+		return
+	}
+	for _, pod := range list.Items {
+		if pod.Status.Phase != "Running" || pod.Status.PodIP == "" {
+			continue
+		}
+		for _, cond := range pod.Status.Conditions {
+			if cond.Type == "Ready" && cond.Status == "True" {
+				insts = append(insts, net.JoinHostPort(pod.Status.PodIP, kcm.port))
+				break
+			}
+		}
+	}
+	return
+}
+
+func (kcm *KubernetesConfManager) assign() (err error) {
+	var newInsts []string
+	if newInsts, err = kcm.instances(); err != nil {
+		err = errors.Wrapf(err, "kcm.instances failed")
+		return
+	}
+	return kcm.assigner.assign(kcm, newInsts)
+}
+
+func (kcm *KubernetesConfManager) Run() {
+	kcm.wg.Add(1)
+	defer kcm.wg.Done()
+	if kcm.lease == "" {
+		// Member Leases are checked by keepLeases instead.
+		kcm.wg.Add(1)
+		go kcm.watch(fmt.Sprintf("/api/v1/namespaces/%s/pods", kcm.namespace), url.Values{"labelSelector": []string{kcm.podSelector}}, func() {
+			notify(kcm.assignCh)
+		})
+	}
+	util.Logger.Debug("assign first")
+	if err := kcm.assign(); err != nil {
+		util.Logger.Error("first assign failed", zap.Error(err))
+	}
+	for {
+		select {
+		case <-kcm.ctx.Done():
+			util.Logger.Info("KubernetesConfManager.Run quit due to context has been canceled")
+			return
+		case <-kcm.assignCh:
+			util.Logger.Debug("assign triggered by tasks, ConfigMap, pods or leadership change")
+		case <-time.After(5 * time.Minute):
+			util.Logger.Debug("assign triggered by 5 min timer")
+		}
+		if err := kcm.assign(); err != nil {
+			util.Logger.Error("assign failed", zap.Error(err))
+		}
+	}
+}
+
+func (kcm *KubernetesConfManager) Stop() {
+	kcm.cancel()
+	kcm.wg.Wait()
+	util.Logger.Info("stopped kubernetes config manager")
+}
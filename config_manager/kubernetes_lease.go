@@ -0,0 +1,216 @@
+package rcm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/forever765/clickhouse_sinker_nali/util"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+const (
+	k8sLeaseDuration = 30 * time.Second
+	k8sLeaseRenew    = 10 * time.Second
+	// member Leases carry this label whose value is the name of the leader Lease
+	k8sLeaseLabel = "clickhouse-sinker.forever765.github.io/lease"
+	// format of MicroTime
+	k8sMicroTime = "2006-01-02T15:04:05.000000Z07:00"
+)
+
+type k8sLeaseSpec struct {
+	HolderIdentity       string `json:"holderIdentity,omitempty"`
+	LeaseDurationSeconds int    `json:"leaseDurationSeconds,omitempty"`
+	AcquireTime          string `json:"acquireTime,omitempty"`
+	RenewTime            string `json:"renewTime,omitempty"`
+	LeaseTransitions     int    `json:"leaseTransitions,omitempty"`
+}
+
+type k8sLease struct {
+	APIVersion string        `json:"apiVersion"`
+	Kind       string        `json:"kind"`
+	Metadata   k8sObjectMeta `json:"metadata"`
+	Spec       k8sLeaseSpec  `json:"spec"`
+}
+
+type k8sLeaseList struct {
+	Items []k8sLease `json:"items"`
+}
+
+// expired tells whether the holder failed to renew the Lease in time.
+func (l *k8sLease) expired(now time.Time) bool {
+	renewed, err := time.Parse(time.RFC3339Nano, l.Spec.RenewTime)
+	if err != nil {
+		return true
+	}
+	return renewed.Add(time.Duration(l.Spec.LeaseDurationSeconds) * time.Second).Before(now)
+}
+
+func (kcm *KubernetesConfManager) leasesPath(name string) string {
+	p := fmt.Sprintf("/apis/coordination.k8s.io/v1/namespaces/%s/leases", kcm.namespace)
+	if name != "" {
+		p += "/" + name
+	}
+	return p
+}
+
+// memberLease is the name of the Lease of this instance, such as "clickhouse-sinker-10-1-2-3-2112".
+func (kcm *KubernetesConfManager) memberLease() string {
+	return kcm.lease + "-" + strings.NewReplacer(".", "-", ":", "-", "[", "", "]", "").Replace(strings.ToLower(kcm.instance))
+}
+
+func (kcm *KubernetesConfManager) isLeading() bool {
+	return atomic.LoadInt32(&kcm.leading) == 1
+}
+
+// keepLeases renews the member Lease of this instance, and competes for the leader Lease. The leader checks members
+// at every renewal, and assigns tasks once they change. Both Leases are released on stop.
+func (kcm *KubernetesConfManager) keepLeases() {
+	defer kcm.wg.Done()
+	for {
+		if err := kcm.renewMember(); err != nil {
+			util.Logger.Warn("failed to renew member Lease", zap.String("lease", kcm.memberLease()), zap.Error(err))
+		}
+		leading, err := kcm.tryLead()
+		if err != nil {
+			util.Logger.Warn("failed to renew leader Lease", zap.String("lease", kcm.lease), zap.Error(err))
+		}
+		if was := atomic.SwapInt32(&kcm.leading, boolToInt32(leading)) == 1; was != leading {
+			util.Logger.Info("leadership changed", zap.String("lease", kcm.lease), zap.Bool("leading", leading))
+			kcm.members = nil
+		}
+		if leading {
+			if members, err := kcm.leaseMembers(); err == nil && !reflect.DeepEqual(members, kcm.members) {
+				kcm.members = members
+				notify(kcm.assignCh)
+			}
+		}
+		select {
+		case <-kcm.ctx.Done():
+			kcm.releaseLeases()
+			return
+		case <-time.After(k8sLeaseRenew):
+		}
+	}
+}
+
+func boolToInt32(b bool) int32 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// putLease creates the Lease if it's absent, otherwise replaces it.
+func (kcm *KubernetesConfManager) putLease(ctx context.Context, lease *k8sLease) (err error) {
+	lease.APIVersion, lease.Kind = "coordination.k8s.io/v1", "Lease"
+	var body []byte
+	if body, err = json.Marshal(lease); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	if lease.Metadata.ResourceVersion == "" {
+		return kcm.doWith(ctx, http.MethodPost, kcm.leasesPath(""), nil, "application/json", body, nil)
+	}
+	return kcm.doWith(ctx, http.MethodPut, kcm.leasesPath(lease.Metadata.Name), nil, "application/json", body, nil)
+}
+
+// getLease returns an empty Lease of the name if it's absent.
+func (kcm *KubernetesConfManager) getLease(name string) (lease *k8sLease, err error) {
+	lease = &k8sLease{}
+	if err = kcm.do(http.MethodGet, kcm.leasesPath(name), nil, "", nil, lease); err != nil {
+		if isK8sStatus(err, http.StatusNotFound) {
+			lease, err = &k8sLease{Metadata: k8sObjectMeta{Name: name}}, nil
+		}
+	}
+	return
+}
+
+func (kcm *KubernetesConfManager) renewMember() (err error) {
+	var lease *k8sLease
+	if lease, err = kcm.getLease(kcm.memberLease()); err != nil {
+		return
+	}
+	lease.Metadata.Labels = map[string]string{k8sLeaseLabel: kcm.lease}
+	lease.Spec.HolderIdentity = kcm.instance
+	lease.Spec.LeaseDurationSeconds = int(k8sLeaseDuration.Seconds())
+	lease.Spec.RenewTime = time.Now().UTC().Format(k8sMicroTime)
+	return kcm.putLease(kcm.ctx, lease)
+}
+
+// tryLead acquires or renews the leader Lease. The resource version guards against racing with other instances.
+func (kcm *KubernetesConfManager) tryLead() (leading bool, err error) {
+	var lease *k8sLease
+	if lease, err = kcm.getLease(kcm.lease); err != nil {
+		return
+	}
+	now := time.Now()
+	holder := lease.Spec.HolderIdentity
+	if holder != "" && holder != kcm.instance && !lease.expired(now) {
+		return
+	}
+	nowStr := now.UTC().Format(k8sMicroTime)
+	if holder != kcm.instance {
+		lease.Spec.HolderIdentity = kcm.instance
+		lease.Spec.AcquireTime = nowStr
+		lease.Spec.LeaseTransitions++
+	}
+	lease.Spec.LeaseDurationSeconds = int(k8sLeaseDuration.Seconds())
+	lease.Spec.RenewTime = nowStr
+	if err = kcm.putLease(kcm.ctx, lease); err != nil {
+		if isK8sStatus(err, http.StatusConflict) {
+			// Another instance won.
+			err = nil
+		}
+		return
+	}
+	leading = true
+	return
+}
+
+// leaseMembers returns holders of unexpired member Leases.
+func (kcm *KubernetesConfManager) leaseMembers() (insts []string, err error) {
+	var list k8sLeaseList
+	if err = kcm.do(http.MethodGet, kcm.leasesPath(""), url.Values{"labelSelector": []string{k8sLeaseLabel + "=" + kcm.lease}}, "", nil, &list); err != nil {
+		return
+	}
+	now := time.Now()
+	for i := range list.Items {
+		if lease := &list.Items[i]; lease.Spec.HolderIdentity != "" && !lease.expired(now) {
+			insts = append(insts, lease.Spec.HolderIdentity)
+		}
+	}
+	sort.Strings(insts)
+	return
+}
+
+// releaseLeases deletes the member Lease and gives up leadership, so that others needn't wait for them to expire.
+func (kcm *KubernetesConfManager) releaseLeases() {
+	ctx := context.Background()
+	if err := kcm.doWith(ctx, http.MethodDelete, kcm.leasesPath(kcm.memberLease()), nil, "", nil, nil); err != nil && !isK8sStatus(err, http.StatusNotFound) {
+		util.Logger.Warn("failed to delete member Lease", zap.String("lease", kcm.memberLease()), zap.Error(err))
+	}
+	if atomic.SwapInt32(&kcm.leading, 0) != 1 {
+		return
+	}
+	lease := &k8sLease{}
+	if err := kcm.doWith(ctx, http.MethodGet, kcm.leasesPath(kcm.lease), nil, "", nil, lease); err != nil {
+		return
+	}
+	if lease.Spec.HolderIdentity != kcm.instance {
+		return
+	}
+	lease.Spec.HolderIdentity = ""
+	lease.Spec.RenewTime = ""
+	if err := kcm.putLease(ctx, lease); err != nil {
+		util.Logger.Warn("failed to release leader Lease", zap.String("lease", kcm.lease), zap.Error(err))
+	}
+}
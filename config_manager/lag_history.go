@@ -0,0 +1,85 @@
+package rcm
+
+import (
+	"fmt"
+	"time"
+)
+
+type offsetSample struct {
+	at     time.Time
+	offset int64
+}
+
+// OffsetHistory keeps recent newest offsets of partitions, to estimate when a message was produced. It isn't safe for
+// concurrent use.
+type OffsetHistory struct {
+	size   int
+	series map[string][]offsetSample
+}
+
+// NewOffsetHistory keeps at most size samples per partition.
+func NewOffsetHistory(size int) *OffsetHistory {
+	if size < 2 {
+		size = 2
+	}
+	return &OffsetHistory{size: size, series: make(map[string][]offsetSample)}
+}
+
+func partitionKey(topic string, partition int32) string {
+	return fmt.Sprintf("%s/%d", topic, partition)
+}
+
+// Add records the newest offset of a partition at the given time.
+func (h *OffsetHistory) Add(topic string, partition int32, at time.Time, newest int64) {
+	key := partitionKey(topic, partition)
+	samples := h.series[key]
+	if n := len(samples); n != 0 && newest < samples[n-1].offset {
+		// The topic has been recreated.
+		samples = samples[:0]
+	}
+	samples = append(samples, offsetSample{at: at, offset: newest})
+	if len(samples) > h.size {
+		samples = append(samples[:0], samples[len(samples)-h.size:]...)
+	}
+	h.series[key] = samples
+}
+
+// Sweep forgets partitions which have no sample since the given time.
+func (h *OffsetHistory) Sweep(since time.Time) {
+	for key, samples := range h.series {
+		if samples[len(samples)-1].at.Before(since) {
+			delete(h.series, key)
+		}
+	}
+}
+
+// LagSeconds estimates how long the message at offset has been waiting. It's interpolated from the time the newest
+// offset went beyond offset, and extrapolated with the average produce rate if that's earlier than all samples.
+func (h *OffsetHistory) LagSeconds(topic string, partition int32, offset int64, now time.Time) float64 {
+	samples := h.series[partitionKey(topic, partition)]
+	n := len(samples)
+	if n == 0 || offset < 0 || offset >= samples[n-1].offset {
+		return 0
+	}
+	var produced time.Time
+	j := 0
+	for j < n && samples[j].offset <= offset {
+		j++
+	}
+	if j == 0 {
+		first, last := samples[0], samples[n-1]
+		produced = first.at
+		if elapsed := last.at.Sub(first.at); elapsed > 0 && last.offset > first.offset {
+			rate := float64(last.offset-first.offset) / elapsed.Seconds()
+			produced = first.at.Add(-time.Duration(float64(first.offset-offset) / rate * float64(time.Second)))
+		}
+	} else {
+		a, b := samples[j-1], samples[j]
+		ratio := float64(offset-a.offset) / float64(b.offset-a.offset)
+		produced = a.at.Add(time.Duration(ratio * float64(b.at.Sub(a.at))))
+	}
+	if lag := now.Sub(produced).Seconds(); lag > 0 {
+		return lag
+	}
+	return 0
+}
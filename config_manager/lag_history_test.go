@@ -0,0 +1,31 @@
+package rcm
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestOffsetHistory(t *testing.T) {
+	h := NewOffsetHistory(3)
+	t0 := time.Unix(1000, 0)
+	h.Add("logs", 0, t0, 100)
+	h.Add("logs", 0, t0.Add(10*time.Second), 200)
+	h.Add("logs", 0, t0.Add(20*time.Second), 300)
+	now := t0.Add(20 * time.Second)
+
+	require.Equal(t, 0.0, h.LagSeconds("logs", 0, 300, now))
+	// The newest offset went beyond 250 at t0+15s.
+	require.InDelta(t, 5.0, h.LagSeconds("logs", 0, 250, now), 1e-6)
+	// Extrapolated with 10 messages per second.
+	require.InDelta(t, 25.0, h.LagSeconds("logs", 0, 50, now), 1e-6)
+	require.Equal(t, 0.0, h.LagSeconds("logs", 1, 50, now))
+
+	// The oldest sample is dropped.
+	h.Add("logs", 0, t0.Add(30*time.Second), 300)
+	require.InDelta(t, 15.0, h.LagSeconds("logs", 0, 250, t0.Add(30*time.Second)), 1e-6)
+
+	h.Sweep(t0.Add(time.Minute))
+	require.Equal(t, 0.0, h.LagSeconds("logs", 0, 250, now))
+}
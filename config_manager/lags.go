@@ -13,10 +13,41 @@ import (
 
 // GetTaskLags inspired by https://github.com/cloudhut/kminion/blob/1ffd02ba94a5edc26d4f11e57191ed3479d8a111/prometheus/collect_consumer_group_lags.go
 func GetTaskLags(cfg *config.Config) (taskLags map[string]int64, err error) {
+	taskLags, _, err = GetTaskOffsets(cfg)
+	return
+}
+
+// GetTaskOffsets returns lags of tasks, and the sum of newest offsets of each task's topic. The latter tells the
+// incoming rate of a task if sampled twice.
+func GetTaskOffsets(cfg *config.Config) (taskLags, taskProduced map[string]int64, err error) {
+	var lags []PartitionLag
+	if lags, err = GetPartitionLags(cfg); err != nil {
+		return
+	}
+	taskLags = make(map[string]int64)     // taskName -> totalLags
+	taskProduced = make(map[string]int64) // taskName -> sum of newest offsets
+	for _, pl := range lags {
+		taskLags[pl.Task] += pl.Lag
+		taskProduced[pl.Task] += pl.Newest
+	}
+	return
+}
+
+// PartitionLag is the lag of the consumer group of a task at a partition.
+type PartitionLag struct {
+	Task      string
+	Topic     string
+	Partition int32
+	Newest    int64 // the offset of the next message to be produced
+	Committed int64 // -1 if unknown
+	Lag       int64
+}
+
+// GetPartitionLags returns lags of tasks at each partition of their topics.
+func GetPartitionLags(cfg *config.Config) (lags []PartitionLag, err error) {
 	var adminClient sarama.ClusterAdmin
 	var client sarama.Client
 	var sarCfg *sarama.Config
-	taskLags = make(map[string]int64) // taskName -> totalLags
 	if sarCfg, err = input.GetSaramaConfig(&cfg.Kafka); err != nil {
 		return
 	}
@@ -45,7 +76,10 @@ func GetTaskLags(cfg *config.Config) (taskLags map[string]int64, err error) {
 		topics = append(topics, topic)
 	}
 	var topicsMeta []*sarama.TopicMetadata
-	if topicsMeta, err = adminClient.DescribeTopics(topics); err != nil {
+	if err = input.RetryKafka(func() (err error) {
+		topicsMeta, err = adminClient.DescribeTopics(topics)
+		return
+	}); err != nil {
 		return
 	}
 	for i, topicMeta := range topicsMeta {
@@ -62,12 +96,12 @@ func GetTaskLags(cfg *config.Config) (taskLags map[string]int64, err error) {
 			var oldestOffsets, newestOffsets []int64
 			var oldestOffset, newestOffset int64
 			for partition := 0; partition < partitions; partition++ {
-				oldestOffset, err = client.GetOffset(topic, int32(partition), sarama.OffsetOldest)
+				oldestOffset, err = input.GetOffset(client, topic, int32(partition), sarama.OffsetOldest)
 				if err != nil {
 					err = errors.Wrapf(err, "failed to get topic/partition offsets for %q partition %q", topic, partition)
 					return
 				}
-				newestOffset, err = client.GetOffset(topic, int32(partition), sarama.OffsetNewest)
+				newestOffset, err = input.GetOffset(client, topic, int32(partition), sarama.OffsetNewest)
 				if err != nil {
 					err = errors.Wrapf(err, "failed to get topic/partition offsets for %q partition %q", topic, partition)
 					return
@@ -83,7 +117,6 @@ func GetTaskLags(cfg *config.Config) (taskLags map[string]int64, err error) {
 	// Get consumer groups' offset
 	for _, taskCfg := range cfg.Tasks {
 		topic := taskCfg.Topic
-		var totalLags int64
 		oldestOffsets := topicOldestOffsets[topic]
 		newestOffsets := topicNewestOffsets[topic]
 		if partitions, ok := topicPartitions[topic]; ok {
@@ -92,20 +125,26 @@ func GetTaskLags(cfg *config.Config) (taskLags map[string]int64, err error) {
 				pidList[partition] = int32(partition)
 			}
 			var rep *sarama.OffsetFetchResponse
-			if rep, err = adminClient.ListConsumerGroupOffsets(taskCfg.ConsumerGroup, map[string][]int32{topic: pidList}); err != nil {
-				for partition := 0; partition < partitions; partition++ {
-					totalLags += newestOffsets[partition] - oldestOffsets[partition] + 1
+			err2 := input.RetryKafka(func() (err error) {
+				rep, err = adminClient.ListConsumerGroupOffsets(taskCfg.ConsumerGroup, map[string][]int32{topic: pidList})
+				return
+			})
+			for partition := 0; partition < partitions; partition++ {
+				pl := PartitionLag{Task: taskCfg.Name, Topic: topic, Partition: int32(partition), Newest: newestOffsets[partition], Committed: -1}
+				var block *sarama.OffsetFetchResponseBlock
+				if err2 == nil {
+					block = rep.GetBlock(topic, int32(partition))
 				}
-			} else {
-				for partition := 0; partition < partitions; partition++ {
-					block := rep.GetBlock(topic, int32(partition))
-					lag := newestOffsets[partition] - block.Offset - 1
-					if lag > 0 {
-						totalLags += lag
+				if block == nil {
+					pl.Lag = newestOffsets[partition] - oldestOffsets[partition] + 1
+				} else {
+					pl.Committed = block.Offset
+					if lag := newestOffsets[partition] - block.Offset - 1; lag > 0 {
+						pl.Lag = lag
 					}
 				}
+				lags = append(lags, pl)
 			}
-			taskLags[taskCfg.Name] = totalLags
 		}
 	}
 	return
@@ -2,12 +2,8 @@ package rcm
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
-	"math"
 	"path/filepath"
-	"reflect"
-	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -27,43 +23,72 @@ import (
 
 var _ RemoteConfManager = (*NacosConfManager)(nil)
 
+// nacosRetry retries calls to nacos servers, which fail transiently while they restart or elect a leader.
+var nacosRetry = util.RetryPolicy{
+	MaxAttempts:    3,
+	InitialBackoff: time.Second,
+	MaxBackoff:     4 * time.Second,
+	OnRetry: func(attempt int, err error) {
+		util.Logger.Warn("nacos call failed, retrying", zap.Int("attempt", attempt), zap.Error(err))
+	},
+}
+
 type NacosConfManager struct {
+	mux          sync.RWMutex // protect clients, which are replaced at credential rotation
 	configClient config_client.IConfigClient
 	namingClient naming_client.INamingClient
+	sc           []constant.ServerConfig
+	cc           constant.ClientConfig
 	group        string
 	dataID       string
 	serviceName  string
-	instance     string // ip:port
+
+	// credentials are read from files if they're given, see watchCredentials
+	usernameFile string
+	passwordFile string
+	ip           string // registered address, empty means not registered
+	port         int
 
 	// state of assignment loop
-	ctx      context.Context
-	cancel   context.CancelFunc
-	wg       sync.WaitGroup
-	mux      sync.Mutex //protect curInsts, curCfg, curVer
-	curInsts []string
-	curCfg   *config.Config
-	curVer   int
+	assigner
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
 }
 
 func toInstanceID(ip string, port int) string {
 	return fmt.Sprintf("%s:%d", ip, port)
 }
 
+// Init accepts server addresses with a scheme, such as "https://nacos1:8848", to talk to Nacos over TLS.
 func (ncm *NacosConfManager) Init(properties map[string]interface{}) (err error) {
-	var sc []constant.ServerConfig
 	serverAddrs := strings.Split(properties["serverAddrs"].(string), ",")
 	for _, serverAddr := range serverAddrs {
+		scheme := "http"
+		if i := strings.Index(serverAddr, "://"); i >= 0 {
+			scheme, serverAddr = serverAddr[:i], serverAddr[i+3:]
+		}
 		serverAddrFields := strings.SplitN(serverAddr, ":", 2)
+		if len(serverAddrFields) != 2 {
+			err = errors.Errorf("invalid nacos server address %s, expect host:port", serverAddr)
+			return
+		}
 		var nacosPort uint64
 		if nacosPort, err = strconv.ParseUint(serverAddrFields[1], 10, 64); err != nil {
 			err = errors.Wrapf(err, "")
 			return
 		}
-		sc = append(sc, constant.ServerConfig{
+		ncm.sc = append(ncm.sc, constant.ServerConfig{
+			Scheme: scheme,
 			IpAddr: serverAddrFields[0],
 			Port:   nacosPort,
 		})
 	}
+	if caFile, _ := properties["caFile"].(string); caFile != "" {
+		if err = trustNacosCA(caFile); err != nil {
+			return
+		}
+	}
 
 	var clientDir string
 	if v, ok := properties["clientDir"]; ok {
@@ -79,7 +104,7 @@ func (ncm *NacosConfManager) Init(properties map[string]interface{}) (err error)
 	if pop, ok := properties["group"]; ok {
 		group, _ = pop.(string)
 	}
-	cc := constant.ClientConfig{
+	ncm.cc = constant.ClientConfig{
 		NamespaceId:         namespaceID,
 		TimeoutMs:           5000,
 		ListenInterval:      10000,
@@ -92,21 +117,21 @@ func (ncm *NacosConfManager) Init(properties map[string]interface{}) (err error)
 		Username:            properties["username"].(string),
 		Password:            properties["password"].(string),
 	}
-
-	ncm.configClient, err = clients.CreateConfigClient(map[string]interface{}{
-		"serverConfigs": sc,
-		"clientConfig":  cc,
-	})
-	if err != nil {
-		err = errors.Wrapf(err, "")
+	ncm.cc.AccessKey, _ = properties["accessKey"].(string)
+	ncm.cc.SecretKey, _ = properties["secretKey"].(string)
+	ncm.usernameFile, _ = properties["usernameFile"].(string)
+	ncm.passwordFile, _ = properties["passwordFile"].(string)
+	if _, err = ncm.loadCredentials(); err != nil {
 		return
 	}
-	ncm.namingClient, err = clients.CreateNamingClient(map[string]interface{}{
-		"serverConfigs": sc,
-		"clientConfig":  cc,
-	})
-	if err != nil {
-		err = errors.Wrapf(err, "")
+	// An environment is a namespace of the name, so that environments sharing a Nacos cluster are isolated.
+	if env, _ := properties["env"].(string); env != "" {
+		if ncm.cc.NamespaceId, err = ncm.resolveNamespace(env); err != nil {
+			return
+		}
+		util.Logger.Info("resolved nacos namespace of the environment", zap.String("env", env), zap.String("namespaceId", ncm.cc.NamespaceId))
+	}
+	if ncm.configClient, ncm.namingClient, err = ncm.newClients(); err != nil {
 		return
 	}
 
@@ -121,35 +146,67 @@ func (ncm *NacosConfManager) Init(properties map[string]interface{}) (err error)
 	return
 }
 
-func (ncm *NacosConfManager) GetConfig() (conf *config.Config, err error) {
-	var content string
-	content, err = ncm.configClient.GetConfig(vo.ConfigParam{
-		DataId: ncm.dataID,
-		Group:  ncm.group,
+func (ncm *NacosConfManager) newClients() (configClient config_client.IConfigClient, namingClient naming_client.INamingClient, err error) {
+	configClient, err = clients.CreateConfigClient(map[string]interface{}{
+		"serverConfigs": ncm.sc,
+		"clientConfig":  ncm.cc,
 	})
 	if err != nil {
 		err = errors.Wrapf(err, "")
 		return
 	}
-	conf = &config.Config{}
-	if err = json.Unmarshal([]byte(content), conf); err != nil {
+	namingClient, err = clients.CreateNamingClient(map[string]interface{}{
+		"serverConfigs": ncm.sc,
+		"clientConfig":  ncm.cc,
+	})
+	if err != nil {
 		err = errors.Wrapf(err, "")
 		return
 	}
 	return
 }
 
+func (ncm *NacosConfManager) clients() (config_client.IConfigClient, naming_client.INamingClient) {
+	ncm.mux.RLock()
+	defer ncm.mux.RUnlock()
+	return ncm.configClient, ncm.namingClient
+}
+
+// GetConfig merges the config at the data id and those it includes. Includes are data ids of the same group.
+func (ncm *NacosConfManager) GetConfig() (conf *config.Config, err error) {
+	loader := config.Loader{Read: func(dataID string) (content []byte, err error) {
+		var s string
+		err = util.Retry(ncm.ctx, nacosRetry, func(ctx context.Context) (err error) {
+			configClient, _ := ncm.clients()
+			s, err = configClient.GetConfig(vo.ConfigParam{
+				DataId: dataID,
+				Group:  ncm.group,
+			})
+			return
+		})
+		if err != nil {
+			err = errors.Wrapf(err, "")
+		}
+		content = []byte(s)
+		return
+	}}
+	return loader.Load(ncm.dataID)
+}
+
 func (ncm *NacosConfManager) PublishConfig(conf *config.Config) (err error) {
 	var bs []byte
-	if bs, err = json.Marshal(*conf); err != nil {
-		err = errors.Wrapf(err, "")
+	if bs, err = conf.MainLayer(); err != nil {
 		return
 	}
 	content := string(bs)
-	_, err = ncm.configClient.PublishConfig(vo.ConfigParam{
-		DataId:  ncm.dataID,
-		Group:   ncm.group,
-		Content: content,
+	err = util.Retry(ncm.ctx, nacosRetry, func(ctx context.Context) (err error) {
+		configClient, _ := ncm.clients()
+		_, err = configClient.PublishConfig(vo.ConfigParam{
+			DataId:  ncm.dataID,
+			Group:   ncm.group,
+			Content: content,
+		})
+		return
 	})
 	if err != nil {
 		err = errors.Wrapf(err, "")
@@ -159,31 +216,60 @@ func (ncm *NacosConfManager) PublishConfig(conf *config.Config) (err error) {
 }
 
 func (ncm *NacosConfManager) Register(ip string, port int) (err error) {
-	_, err = ncm.namingClient.RegisterInstance(vo.RegisterInstanceParam{
-		Ip:          ip,
-		Port:        uint64(port),
-		ServiceName: ncm.serviceName,
-		GroupName:   ncm.group,
-		Enable:      true,
-		Healthy:     true,
-		Ephemeral:   true,
-	})
-	if err != nil {
-		err = errors.Wrapf(err, "")
+	_, namingClient := ncm.clients()
+	if err = ncm.register(namingClient, ip, port); err != nil {
+		return
 	}
+	ncm.mux.Lock()
+	ncm.ip, ncm.port = ip, port
+	ncm.mux.Unlock()
 	ncm.instance = toInstanceID(ip, port)
 	return
 }
 
-func (ncm *NacosConfManager) Deregister(ip string, port int) (err error) {
-	_, err = ncm.namingClient.DeregisterInstance(
-		vo.DeregisterInstanceParam{
+func (ncm *NacosConfManager) register(namingClient naming_client.INamingClient, ip string, port int) (err error) {
+	err = util.Retry(ncm.ctx, nacosRetry, func(ctx context.Context) (err error) {
+		_, err = namingClient.RegisterInstance(vo.RegisterInstanceParam{
 			Ip:          ip,
 			Port:        uint64(port),
 			ServiceName: ncm.serviceName,
 			GroupName:   ncm.group,
+			Enable:      true,
+			Healthy:     true,
 			Ephemeral:   true,
 		})
+		return
+	})
+	if err != nil {
+		err = errors.Wrapf(err, "")
+	}
+	return
+}
+
+func (ncm *NacosConfManager) Deregister(ip string, port int) (err error) {
+	_, namingClient := ncm.clients()
+	if err = ncm.deregister(namingClient, ip, port); err != nil {
+		return
+	}
+	ncm.mux.Lock()
+	ncm.ip, ncm.port = "", 0
+	ncm.mux.Unlock()
+	return
+}
+
+func (ncm *NacosConfManager) deregister(namingClient naming_client.INamingClient, ip string, port int) (err error) {
+	// Deregistering happens at exit, when ncm.ctx may have been canceled.
+	err = util.Retry(context.Background(), nacosRetry, func(ctx context.Context) (err error) {
+		_, err = namingClient.DeregisterInstance(
+			vo.DeregisterInstanceParam{
+				Ip:          ip,
+				Port:        uint64(port),
+				ServiceName: ncm.serviceName,
+				GroupName:   ncm.group,
+				Ephemeral:   true,
+			})
+		return
+	})
 	if err != nil {
 		err = errors.Wrapf(err, "")
 	}
@@ -201,23 +287,17 @@ func (ncm *NacosConfManager) Run() {
 	}
 
 	// Listen to service and config change, and assign if necessary
-	configParam := vo.ConfigParam{
-		DataId:   ncm.dataID,
-		Group:    ncm.group,
-		OnChange: ncm.configOnChange,
-	}
-	if err = ncm.configClient.ListenConfig(configParam); err != nil {
+	configClient, namingClient := ncm.clients()
+	if err = configClient.ListenConfig(ncm.configParam()); err != nil {
 		util.Logger.Fatal("ncm.configClient.ListenConfig failed with permanent error", zap.Error(err))
 	}
-
-	subParam := vo.SubscribeParam{
-		GroupName:         ncm.group,
-		ServiceName:       ncm.serviceName,
-		SubscribeCallback: ncm.serviceOnChange,
-	}
-	if err = ncm.namingClient.Subscribe(&subParam); err != nil {
+	if err = namingClient.Subscribe(ncm.subscribeParam()); err != nil {
 		util.Logger.Fatal("ncm.namingClient.Subscribe failed with permanent error", zap.Error(err))
 	}
+	if ncm.usernameFile != "" || ncm.passwordFile != "" {
+		ncm.wg.Add(1)
+		go ncm.watchCredentials()
+	}
 
 	// Assign regularly to handle lag change
 LOOP_FOR:
@@ -238,25 +318,33 @@ LOOP_FOR:
 func (ncm *NacosConfManager) Stop() {
 	ncm.cancel()
 	ncm.wg.Wait()
-	var err error
-	configParam := vo.ConfigParam{
+	ncm.unlisten(ncm.clients())
+	util.Logger.Info("stopped nacos config manager")
+}
+
+func (ncm *NacosConfManager) configParam() vo.ConfigParam {
+	return vo.ConfigParam{
 		DataId:   ncm.dataID,
 		Group:    ncm.group,
 		OnChange: ncm.configOnChange,
 	}
-	if err = ncm.configClient.CancelListenConfig(configParam); err != nil {
-		util.Logger.Error("ncm.configClient.CancelListenConfig failed", zap.Error(err))
-	}
+}
 
-	subParam := vo.SubscribeParam{
+func (ncm *NacosConfManager) subscribeParam() *vo.SubscribeParam {
+	return &vo.SubscribeParam{
 		GroupName:         ncm.group,
 		ServiceName:       ncm.serviceName,
 		SubscribeCallback: ncm.serviceOnChange,
 	}
-	if err = ncm.namingClient.Unsubscribe(&subParam); err != nil {
+}
+
+func (ncm *NacosConfManager) unlisten(configClient config_client.IConfigClient, namingClient naming_client.INamingClient) {
+	if err := configClient.CancelListenConfig(ncm.configParam()); err != nil {
+		util.Logger.Error("ncm.configClient.CancelListenConfig failed", zap.Error(err))
+	}
+	if err := namingClient.Unsubscribe(ncm.subscribeParam()); err != nil {
 		util.Logger.Error("ncm.namingClient.Unsubscribe failed", zap.Error(err))
 	}
-	util.Logger.Info("stopped nacos config manager")
 }
 
 func (ncm *NacosConfManager) configOnChange(namespace, group, dataID, data string) {
@@ -279,26 +367,17 @@ func (ncm *NacosConfManager) serviceOnChange(services []model.SubscribeService,
 	}
 }
 
-type InstanceAssignment struct {
-	Instance string
-	TotalLag int64
-	TaskLags []TaskLag
-}
-
-type TaskLag struct {
-	Task string
-	Lag  int64
-}
-
 func (ncm *NacosConfManager) assign() (err error) {
-	ncm.mux.Lock()
-	defer ncm.mux.Unlock()
 	getServiceParam := vo.GetServiceParam{
 		GroupName:   ncm.group,
 		ServiceName: ncm.serviceName,
 	}
 	var service model.Service
-	if service, err = ncm.namingClient.GetService(getServiceParam); err != nil {
+	_, namingClient := ncm.clients()
+	if err = util.Retry(ncm.ctx, nacosRetry, func(ctx context.Context) (err error) {
+		service, err = namingClient.GetService(getServiceParam)
+		return
+	}); err != nil {
 		err = errors.Wrapf(err, "ncm.namingClient.GetService failed")
 		return
 	}
@@ -306,117 +385,5 @@ func (ncm *NacosConfManager) assign() (err error) {
 	for _, inst := range service.Hosts {
 		newInsts = append(newInsts, toInstanceID(inst.Ip, int(inst.Port)))
 	}
-	sort.Strings(newInsts)
-	if newInsts == nil || newInsts[0] != ncm.instance {
-		// Only the first instance is capable to assgin
-		return
-	}
-
-	var newCfg *config.Config
-	if newCfg, err = ncm.GetConfig(); err != nil {
-		err = errors.Wrapf(err, "ncm.GetConfig failed")
-		return
-	}
-	if reflect.DeepEqual(ncm.curInsts, newInsts) &&
-		reflect.DeepEqual(ncm.curCfg, newCfg) &&
-		ncm.curCfg.Assignment.UpdatedBy == ncm.instance &&
-		time.Unix(ncm.curCfg.Assignment.UpdatedAt, 0).Add(10*time.Minute).After(time.Now()) {
-		util.Logger.Info("Both instances and config are up-to-date, and the config was published by myself in less than 10 minutes.")
-		return
-	}
-
-	var taskLags map[string]int64
-	if taskLags, err = GetTaskLags(newCfg); err != nil {
-		return
-	}
-	util.Logger.Debug(fmt.Sprintf("task lags %+v", taskLags))
-
-	var validTasks []string
-	for _, taskCfg := range newCfg.Tasks {
-		if _, ok := taskLags[taskCfg.Name]; ok {
-			validTasks = append(validTasks, taskCfg.Name)
-		}
-	}
-	sort.Slice(validTasks, func(i, j int) bool {
-		taskNameI := validTasks[i]
-		lagI := taskLags[taskNameI]
-		taskNameJ := validTasks[j]
-		lagJ := taskLags[taskNameJ]
-		return (lagI > lagJ) || (lagI == lagJ && taskNameI < taskNameJ)
-	})
-
-	instAgs := make([]*InstanceAssignment, len(newInsts))
-	for i, instance := range newInsts {
-		instAgs[i] = &InstanceAssignment{
-			Instance: instance,
-		}
-	}
-	// distribute tasks in snake way
-	for idxTask := 0; idxTask < len(validTasks); idxTask++ {
-		idxInst := idxTask % len(newInsts)
-		if (idxTask/len(newInsts))%2 == 1 {
-			idxInst = len(newInsts) - 1 - idxInst
-		}
-		taskName := validTasks[idxTask]
-		taskLag := taskLags[taskName]
-		instAg := instAgs[idxInst]
-		instAg.TotalLag += taskLag
-		instAg.TaskLags = append(instAg.TaskLags, TaskLag{Task: taskName, Lag: taskLag})
-	}
-	// balance
-	if len(newInsts) >= 2 && len(validTasks) > len(newInsts) {
-		last := len(newInsts) - 1
-		for {
-			sort.Slice(instAgs, func(i, j int) bool {
-				return (instAgs[i].TotalLag > instAgs[j].TotalLag) || (instAgs[i].TotalLag == instAgs[j].TotalLag && instAgs[i].Instance < instAgs[j].Instance)
-			})
-			diffLag := float64(instAgs[0].TotalLag - instAgs[last].TotalLag)
-			diffLagAbs := math.Abs(diffLag)
-			if diffLag == 0.0 {
-				break
-			}
-			var moved bool
-			for idx := 0; idx < len(instAgs[0].TaskLags); idx++ {
-				movingTask := instAgs[0].TaskLags[idx]
-				if math.Abs(diffLag-float64(2*movingTask.Lag)) < diffLagAbs {
-					instAgs[0].TotalLag -= movingTask.Lag
-					instAgs[last].TotalLag += movingTask.Lag
-					instAgs[0].TaskLags = append(instAgs[0].TaskLags[:idx], instAgs[0].TaskLags[idx+1:]...)
-					instAgs[last].TaskLags = append(instAgs[last].TaskLags, movingTask)
-					sort.Slice(instAgs[last].TaskLags, func(i, j int) bool {
-						return instAgs[last].TaskLags[i].Lag > instAgs[last].TaskLags[j].Lag
-					})
-					moved = true
-					break
-				}
-			}
-			if !moved {
-				break
-			}
-		}
-	}
-
-	// publish assignment
-	newVer := ncm.curVer + 1
-	util.Logger.Debug("going to publish assignment", zap.Int("version", newVer), zap.Reflect("assignment", instAgs))
-	newCfg.Assignment.Map = make(map[string][]string)
-	for _, instAg := range instAgs {
-		var tasks []string
-		for _, taskLag := range instAg.TaskLags {
-			tasks = append(tasks, taskLag.Task)
-		}
-		sort.Strings(tasks)
-		newCfg.Assignment.Map[instAg.Instance] = tasks
-	}
-	newCfg.Assignment.Version = newVer
-	newCfg.Assignment.UpdatedBy = ncm.instance
-	newCfg.Assignment.UpdatedAt = time.Now().Unix()
-	if err = ncm.PublishConfig(newCfg); err != nil {
-		return
-	}
-	ncm.curCfg = newCfg
-	ncm.curInsts = newInsts
-	ncm.curVer = newVer
-
-	return
+	return ncm.assigner.assign(ncm, newInsts)
 }
@@ -0,0 +1,189 @@
+package rcm
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/forever765/clickhouse_sinker_nali/util"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+const (
+	nacosCredentialsCheck = 30 * time.Second
+	nacosRequestTimeout   = 5 * time.Second
+	nacosDefaultContext   = "/nacos"
+)
+
+// trustNacosCA makes the default transport trust the CA, since the Nacos SDK sends requests with it.
+func trustNacosCA(caFile string) (err error) {
+	tlsConfig, err := util.NewTLSConfig(caFile, "", "", "", false)
+	if err != nil {
+		return
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	http.DefaultTransport = transport
+	return
+}
+
+func readSecretFile(name string) (secret string, err error) {
+	var content []byte
+	if content, err = ioutil.ReadFile(name); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	secret = strings.TrimSpace(string(content))
+	return
+}
+
+// loadCredentials reads the username and password from files if they're given, and tells whether they changed.
+func (ncm *NacosConfManager) loadCredentials() (changed bool, err error) {
+	username, password := ncm.cc.Username, ncm.cc.Password
+	if ncm.usernameFile != "" {
+		if username, err = readSecretFile(ncm.usernameFile); err != nil {
+			return
+		}
+	}
+	if ncm.passwordFile != "" {
+		if password, err = readSecretFile(ncm.passwordFile); err != nil {
+			return
+		}
+	}
+	changed = username != ncm.cc.Username || password != ncm.cc.Password
+	ncm.cc.Username, ncm.cc.Password = username, password
+	return
+}
+
+// watchCredentials replaces clients once the credential files change, since a client logins with the credentials
+// it's created with, and fails to refresh its access token after they are rotated.
+func (ncm *NacosConfManager) watchCredentials() {
+	defer ncm.wg.Done()
+	for {
+		select {
+		case <-ncm.ctx.Done():
+			return
+		case <-time.After(nacosCredentialsCheck):
+		}
+		changed, err := ncm.loadCredentials()
+		if err != nil {
+			util.Logger.Warn("failed to read nacos credentials", zap.Error(err))
+			continue
+		}
+		if !changed {
+			continue
+		}
+		util.Logger.Info("nacos credentials changed, recreating clients", zap.String("username", ncm.cc.Username))
+		if err = ncm.rotate(); err != nil {
+			util.Logger.Error("failed to recreate nacos clients", zap.Error(err))
+		}
+	}
+}
+
+// rotate replaces clients with those of the current credentials, and moves the registration and listeners to them.
+func (ncm *NacosConfManager) rotate() (err error) {
+	configClient, namingClient, err := ncm.newClients()
+	if err != nil {
+		return
+	}
+	ncm.mux.Lock()
+	oldConfigClient, oldNamingClient := ncm.configClient, ncm.namingClient
+	ncm.configClient, ncm.namingClient = configClient, namingClient
+	ip, port := ncm.ip, ncm.port
+	ncm.mux.Unlock()
+
+	ncm.unlisten(oldConfigClient, oldNamingClient)
+	if ip != "" {
+		// Deregister with the old client to stop its heartbeats. The instance is absent until registered again.
+		if err = ncm.deregister(oldNamingClient, ip, port); err != nil {
+			util.Logger.Warn("failed to deregister with the old nacos client", zap.Error(err))
+		}
+		if err = ncm.register(namingClient, ip, port); err != nil {
+			return
+		}
+	}
+	if err = configClient.ListenConfig(ncm.configParam()); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	if err = namingClient.Subscribe(ncm.subscribeParam()); err != nil {
+		err = errors.Wrapf(err, "")
+	}
+	return
+}
+
+// resolveNamespace gets the ID of the namespace whose name is the given one from the first available server.
+func (ncm *NacosConfManager) resolveNamespace(name string) (namespaceID string, err error) {
+	client := &http.Client{Timeout: nacosRequestTimeout}
+	for _, sc := range ncm.sc {
+		base := fmt.Sprintf("%s://%s:%d%s", sc.Scheme, sc.IpAddr, sc.Port, nacosDefaultContext)
+		if namespaceID, err = ncm.resolveNamespaceAt(client, base, name); err == nil {
+			return
+		}
+		util.Logger.Warn("failed to list nacos namespaces", zap.String("server", base), zap.Error(err))
+	}
+	return
+}
+
+func (ncm *NacosConfManager) resolveNamespaceAt(client *http.Client, base, name string) (namespaceID string, err error) {
+	query := url.Values{}
+	if ncm.cc.Username != "" {
+		var login struct {
+			AccessToken string `json:"accessToken"`
+		}
+		form := url.Values{"username": []string{ncm.cc.Username}, "password": []string{ncm.cc.Password}}
+		if err = nacosRequest(client, http.MethodPost, base+"/v1/auth/login", form, &login); err != nil {
+			return
+		}
+		query.Set("accessToken", login.AccessToken)
+	}
+	var namespaces struct {
+		Data []struct {
+			Namespace         string `json:"namespace"`
+			NamespaceShowName string `json:"namespaceShowName"`
+		} `json:"data"`
+	}
+	if err = nacosRequest(client, http.MethodGet, base+"/v1/console/namespaces?"+query.Encode(), nil, &namespaces); err != nil {
+		return
+	}
+	for _, ns := range namespaces.Data {
+		if ns.NamespaceShowName == name {
+			namespaceID = ns.Namespace
+			return
+		}
+	}
+	err = errors.Errorf("nacos namespace %s doesn't exist", name)
+	return
+}
+
+func nacosRequest(client *http.Client, method, u string, form url.Values, out interface{}) (err error) {
+	var resp *http.Response
+	if form != nil {
+		resp, err = client.PostForm(u, form)
+	} else {
+		resp, err = client.Get(u)
+	}
+	if err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	defer resp.Body.Close()
+	var body []byte
+	if body, err = ioutil.ReadAll(resp.Body); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		err = errors.Errorf("%s %s: %s %s", method, strings.SplitN(u, "?", 2)[0], resp.Status, body)
+		return
+	}
+	if err = json.Unmarshal(body, out); err != nil {
+		err = errors.Wrapf(err, "")
+	}
+	return
+}
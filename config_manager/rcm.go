@@ -17,3 +17,14 @@ type RemoteConfManager interface {
 	Run()
 	Stop()
 }
+
+// ConfChangeNotifier is implemented by backends which watch the config, so that changes are applied without waiting for the next poll.
+type ConfChangeNotifier interface {
+	ConfChanged() <-chan struct{}
+}
+
+// Scaler is implemented by backends which are able to scale sinker replicas.
+type Scaler interface {
+	// Scale sets the number of replicas of target, see config.AutoscaleConfig.Target.
+	Scale(target string, replicas int) error
+}
@@ -0,0 +1,300 @@
+package rcm
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/forever765/clickhouse_sinker_nali/config"
+	"github.com/forever765/clickhouse_sinker_nali/util"
+	"github.com/go-zookeeper/zk"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+var _ RemoteConfManager = (*ZooKeeperConfManager)(nil)
+var _ ConfChangeNotifier = (*ZooKeeperConfManager)(nil)
+
+// ZooKeeperConfManager stores the config at a znode, and registers sinker instances as ephemeral znodes under the service znode.
+type ZooKeeperConfManager struct {
+	conn        *zk.Conn
+	acl         []zk.ACL
+	key         string // znode of the config
+	servicePath string // parent znode of instances, empty means not participating in assignment
+
+	mux        sync.Mutex // protect registered
+	registered string     // znode of this instance
+
+	// state of assignment loop
+	assigner
+	stopCh    chan struct{}
+	wg        sync.WaitGroup
+	changedCh chan struct{} // config changed
+	assignCh  chan struct{} // config or instances changed
+}
+
+// zkLogger redirects logs of the ZooKeeper client to util.Logger.
+type zkLogger struct{}
+
+func (zkLogger) Printf(format string, args ...interface{}) {
+	util.Logger.Info(fmt.Sprintf(format, args...))
+}
+
+// zkPath makes p an absolute znode path.
+func zkPath(p string) string {
+	if p == "" {
+		return ""
+	}
+	return path.Clean("/" + p)
+}
+
+func (zcm *ZooKeeperConfManager) Init(properties map[string]interface{}) (err error) {
+	servers := "127.0.0.1:2181"
+	if v, ok := properties["servers"].(string); ok && v != "" {
+		servers = v
+	}
+	key, _ := properties["key"].(string)
+	serviceName, _ := properties["serviceName"].(string)
+	username, _ := properties["username"].(string)
+	password, _ := properties["password"].(string)
+	zcm.key = zkPath(key)
+	zcm.servicePath = zkPath(serviceName)
+	if zcm.key == "" {
+		err = errors.Errorf("zookeeper key is required")
+		return
+	}
+	var events <-chan zk.Event
+	if zcm.conn, events, err = zk.Connect(strings.Split(servers, ","), 10*time.Second, zk.WithLogger(zkLogger{})); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	zcm.acl = zk.WorldACL(zk.PermAll)
+	if username != "" {
+		// The client resends credentials once it reconnects.
+		if err = zcm.conn.AddAuth("digest", []byte(username+":"+password)); err != nil {
+			zcm.conn.Close()
+			err = errors.Wrapf(err, "")
+			return
+		}
+		zcm.acl = zk.DigestACL(zk.PermAll, username, password)
+	}
+	zcm.stopCh = make(chan struct{})
+	zcm.changedCh = make(chan struct{}, 1)
+	zcm.assignCh = make(chan struct{}, 1)
+	zcm.wg.Add(2)
+	go zcm.handleEvents(events)
+	go zcm.watch(func() (<-chan zk.Event, error) {
+		_, _, ch, err := zcm.conn.GetW(zcm.key)
+		if err == zk.ErrNoNode {
+			// Wait for creation of the config.
+			_, _, ch, err = zcm.conn.ExistsW(zcm.key)
+		}
+		return ch, err
+	}, func() {
+		notify(zcm.changedCh)
+		notify(zcm.assignCh)
+	})
+	return
+}
+
+// ConfChanged implements ConfChangeNotifier.
+func (zcm *ZooKeeperConfManager) ConfChanged() <-chan struct{} {
+	return zcm.changedCh
+}
+
+// handleEvents recreates the instance znode once a new session is established, since the ephemeral one is gone with the expired session.
+func (zcm *ZooKeeperConfManager) handleEvents(events <-chan zk.Event) {
+	defer zcm.wg.Done()
+	for {
+		select {
+		case <-zcm.stopCh:
+			return
+		case ev, ok := <-events:
+			if !ok {
+				return
+			}
+			if ev.Type != zk.EventSession || ev.State != zk.StateHasSession {
+				continue
+			}
+			zcm.mux.Lock()
+			registered := zcm.registered
+			zcm.mux.Unlock()
+			if registered == "" {
+				continue
+			}
+			if err := zcm.createEphemeral(registered); err != nil {
+				util.Logger.Error("failed to register with zookeeper again", zap.String("znode", registered), zap.Error(err))
+			}
+		}
+	}
+}
+
+// watch sets a watch with setWatch, and calls onChange once it fires.
+// Since events could be lost during reconnecting, onChange is called after every re-watch due to failures as well.
+func (zcm *ZooKeeperConfManager) watch(setWatch func() (<-chan zk.Event, error), onChange func()) {
+	defer zcm.wg.Done()
+	var failed bool
+	for {
+		ch, err := setWatch()
+		if err != nil {
+			util.Logger.Warn("zookeeper watch failed", zap.Error(err))
+			failed = true
+			select {
+			case <-zcm.stopCh:
+				return
+			case <-time.After(5 * time.Second):
+			}
+			continue
+		}
+		if failed {
+			onChange()
+			failed = false
+		}
+		select {
+		case <-zcm.stopCh:
+			return
+		case ev := <-ch:
+			if ev.Type == zk.EventNotWatching {
+				failed = true
+				continue
+			}
+			onChange()
+		}
+	}
+}
+
+// ensureParent creates the parents of p as persistent znodes.
+func (zcm *ZooKeeperConfManager) ensureParent(p string) (err error) {
+	var cur string
+	for _, part := range strings.Split(path.Dir(p), "/") {
+		if part == "" {
+			continue
+		}
+		cur += "/" + part
+		if _, err = zcm.conn.Create(cur, nil, 0, zcm.acl); err != nil && err != zk.ErrNodeExists {
+			err = errors.Wrapf(err, "create %s", cur)
+			return
+		}
+	}
+	err = nil
+	return
+}
+
+func (zcm *ZooKeeperConfManager) createEphemeral(p string) (err error) {
+	if err = zcm.ensureParent(p); err != nil {
+		return
+	}
+	if _, err = zcm.conn.Create(p, nil, zk.FlagEphemeral, zcm.acl); err != nil && err != zk.ErrNodeExists {
+		err = errors.Wrapf(err, "create %s", p)
+		return
+	}
+	err = nil
+	return
+}
+
+// GetConfig merges the config at the znode and those it includes. Includes are znode paths.
+func (zcm *ZooKeeperConfManager) GetConfig() (conf *config.Config, err error) {
+	loader := config.Loader{Read: func(key string) (content []byte, err error) {
+		if content, _, err = zcm.conn.Get(key); err != nil {
+			err = errors.Wrapf(err, "get %s", key)
+		}
+		return
+	}}
+	return loader.Load(zcm.key)
+}
+
+func (zcm *ZooKeeperConfManager) PublishConfig(conf *config.Config) (err error) {
+	var bs []byte
+	if bs, err = conf.MainLayer(); err != nil {
+		return
+	}
+	if _, err = zcm.conn.Set(zcm.key, bs, -1); err == zk.ErrNoNode {
+		if err = zcm.ensureParent(zcm.key); err != nil {
+			return
+		}
+		_, err = zcm.conn.Create(zcm.key, bs, 0, zcm.acl)
+	}
+	if err != nil {
+		err = errors.Wrapf(err, "publish %s", zcm.key)
+	}
+	return
+}
+
+func (zcm *ZooKeeperConfManager) Register(ip string, port int) (err error) {
+	if zcm.servicePath == "" {
+		err = errors.Errorf("zookeeper service name is required to register")
+		return
+	}
+	zcm.instance = toInstanceID(ip, port)
+	p := zcm.servicePath + "/" + zcm.instance
+	if err = zcm.createEphemeral(p); err != nil {
+		return
+	}
+	zcm.mux.Lock()
+	zcm.registered = p
+	zcm.mux.Unlock()
+	return
+}
+
+func (zcm *ZooKeeperConfManager) Deregister(ip string, port int) (err error) {
+	p := zcm.servicePath + "/" + toInstanceID(ip, port)
+	zcm.mux.Lock()
+	if zcm.registered == p {
+		zcm.registered = ""
+	}
+	zcm.mux.Unlock()
+	if err = zcm.conn.Delete(p, -1); err != nil && err != zk.ErrNoNode {
+		err = errors.Wrapf(err, "delete %s", p)
+		return
+	}
+	err = nil
+	return
+}
+
+func (zcm *ZooKeeperConfManager) assign() (err error) {
+	var newInsts []string
+	if newInsts, _, err = zcm.conn.Children(zcm.servicePath); err != nil {
+		err = errors.Wrapf(err, "get children of %s", zcm.servicePath)
+		return
+	}
+	return zcm.assigner.assign(zcm, newInsts)
+}
+
+func (zcm *ZooKeeperConfManager) Run() {
+	zcm.wg.Add(2)
+	defer zcm.wg.Done()
+	go zcm.watch(func() (<-chan zk.Event, error) {
+		_, _, ch, err := zcm.conn.ChildrenW(zcm.servicePath)
+		return ch, err
+	}, func() {
+		notify(zcm.assignCh)
+	})
+	util.Logger.Debug("assign first")
+	if err := zcm.assign(); err != nil {
+		util.Logger.Error("first assign failed", zap.Error(err))
+	}
+	for {
+		select {
+		case <-zcm.stopCh:
+			util.Logger.Info("ZooKeeperConfManager.Run quit due to stop")
+			return
+		case <-zcm.assignCh:
+			util.Logger.Debug("assign triggered by config or instances change")
+		case <-time.After(5 * time.Minute):
+			util.Logger.Debug("assign triggered by 5 min timer")
+		}
+		if err := zcm.assign(); err != nil {
+			util.Logger.Error("assign failed", zap.Error(err))
+		}
+	}
+}
+
+func (zcm *ZooKeeperConfManager) Stop() {
+	close(zcm.stopCh)
+	zcm.wg.Wait()
+	// Closing the session removes the ephemeral znode of this instance at once.
+	zcm.conn.Close()
+	util.Logger.Info("stopped zookeeper config manager")
+}
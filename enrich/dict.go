@@ -0,0 +1,211 @@
+package enrich
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/tidwall/gjson"
+	"go.uber.org/zap"
+
+	"github.com/forever765/clickhouse_sinker_nali/pool"
+	"github.com/forever765/clickhouse_sinker_nali/util"
+)
+
+const defaultDictRefresh = 300
+
+// dictTable maps a key to the other columns of its row.
+type dictTable map[string]Fields
+
+// Dict joins the input field against a small dimension table, and outputs the other columns of the matched row.
+// Outputs are named after the columns. Nothing is output if the key is not found.
+// Params:
+//   - csv: path of a CSV file whose first row is the header
+//   - query: a ClickHouse query, such as "SELECT device_id, site, rack FROM devices". Exactly one of csv and query is required.
+//   - key: the key column, default to the first one
+//   - refresh: seconds between reloading the table, default to 300
+type Dict struct {
+	csvFile string
+	query   string
+	key     string
+
+	table  atomic.Value // dictTable
+	stopCh chan struct{}
+	wg     sync.WaitGroup
+}
+
+func NewDict(params map[string]string) (Enricher, error) {
+	d := &Dict{
+		csvFile: params["csv"],
+		query:   params["query"],
+		key:     params["key"],
+	}
+	if (d.csvFile == "") == (d.query == "") {
+		return nil, errors.Errorf("exactly one of params csv and query is required")
+	}
+	refresh, err := intParam(params, "refresh", defaultDictRefresh)
+	if err != nil {
+		return nil, err
+	}
+	table, err := d.load()
+	if err != nil {
+		return nil, err
+	}
+	d.table.Store(table)
+	d.stopCh = make(chan struct{})
+	d.wg.Add(1)
+	go d.refresh(time.Duration(refresh) * time.Second)
+	return d, nil
+}
+
+func (d *Dict) Enrich(input gjson.Result, out Fields) {
+	row, ok := d.table.Load().(dictTable)[input.String()]
+	if !ok {
+		return
+	}
+	for k, v := range row {
+		out[k] = v
+	}
+}
+
+// Close stops refreshing the table.
+func (d *Dict) Close() error {
+	close(d.stopCh)
+	d.wg.Wait()
+	return nil
+}
+
+func (d *Dict) refresh(interval time.Duration) {
+	defer d.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.stopCh:
+			return
+		case <-ticker.C:
+		}
+		table, err := d.load()
+		if err != nil {
+			// keep the stale one
+			util.Logger.Warn("failed to refresh dictionary", zap.String("csv", d.csvFile), zap.String("query", d.query), zap.Error(err))
+			continue
+		}
+		d.table.Store(table)
+	}
+}
+
+func (d *Dict) load() (table dictTable, err error) {
+	if d.csvFile != "" {
+		return d.loadCSV()
+	}
+	return d.loadQuery()
+}
+
+// keyIndex returns the position of the key column.
+func (d *Dict) keyIndex(columns []string) (idx int, err error) {
+	if d.key == "" {
+		return 0, nil
+	}
+	for i, col := range columns {
+		if col == d.key {
+			return i, nil
+		}
+	}
+	err = errors.Errorf("key column %s not found in %v", d.key, columns)
+	return
+}
+
+func (d *Dict) loadCSV() (table dictTable, err error) {
+	var f *os.File
+	if f, err = os.Open(d.csvFile); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	r.TrimLeadingSpace = true
+	var header []string
+	if header, err = r.Read(); err != nil {
+		err = errors.Wrapf(err, "%s", d.csvFile)
+		return
+	}
+	var keyIdx int
+	if keyIdx, err = d.keyIndex(header); err != nil {
+		return
+	}
+	table = make(dictTable)
+	for {
+		var record []string
+		if record, err = r.Read(); err != nil {
+			if err == io.EOF {
+				err = nil
+			} else {
+				err = errors.Wrapf(err, "%s", d.csvFile)
+			}
+			return
+		}
+		row := make(Fields, len(header)-1)
+		for i, col := range header {
+			if i != keyIdx {
+				row[col] = record[i]
+			}
+		}
+		table[record[keyIdx]] = row
+	}
+}
+
+func (d *Dict) loadQuery() (table dictTable, err error) {
+	if pool.NumShard() == 0 {
+		err = errors.Errorf("ClickHouse connection is not initialized")
+		return
+	}
+	var conn *sql.DB
+	if conn, _, err = pool.GetShardConn(0).NextGoodReplica(0); err != nil {
+		return
+	}
+	var rs *sql.Rows
+	if rs, err = conn.Query(d.query); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	defer rs.Close()
+	var columns []string
+	if columns, err = rs.Columns(); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	var keyIdx int
+	if keyIdx, err = d.keyIndex(columns); err != nil {
+		return
+	}
+	values := make([]interface{}, len(columns))
+	ptrs := make([]interface{}, len(columns))
+	for i := range values {
+		ptrs[i] = &values[i]
+	}
+	table = make(dictTable)
+	for rs.Next() {
+		if err = rs.Scan(ptrs...); err != nil {
+			err = errors.Wrapf(err, "")
+			return
+		}
+		row := make(Fields, len(columns)-1)
+		for i, col := range columns {
+			if i != keyIdx {
+				row[col] = values[i]
+			}
+		}
+		table[fmt.Sprint(values[keyIdx])] = row
+	}
+	if err = rs.Err(); err != nil {
+		err = errors.Wrapf(err, "")
+	}
+	return
+}
@@ -0,0 +1,204 @@
+package enrich
+
+import (
+	"io"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+
+	"github.com/forever765/clickhouse_sinker_nali/config"
+)
+
+// Fields collects the output of an Enricher, keyed by field name without prefix.
+type Fields map[string]interface{}
+
+// Enricher derives new fields from the value of the input field.
+// An Enricher which holds background resources shall implement io.Closer as well.
+type Enricher interface {
+	Enrich(input gjson.Result, out Fields)
+}
+
+// Creator creates an Enricher with type specific parameters.
+type Creator func(params map[string]string) (Enricher, error)
+
+var (
+	creatorsMux sync.RWMutex
+	creators    = make(map[string]Creator)
+)
+
+// Register makes an enrichment type available to task configurations.
+// Registering a type twice replaces the previous one.
+func Register(typ string, creator Creator) {
+	creatorsMux.Lock()
+	defer creatorsMux.Unlock()
+	creators[typ] = creator
+}
+
+// Types returns registered enrichment types in alphabetical order.
+func Types() (types []string) {
+	creatorsMux.RLock()
+	defer creatorsMux.RUnlock()
+	for typ := range creators {
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+	return
+}
+
+func init() {
+	Register("geoip", NewGeoIP)
+	Register("asn", NewASN)
+	Register("ua", NewUserAgent)
+	Register("url", NewURL)
+	Register("cidr", NewCIDR)
+	Register("rdns", NewReverseDNS)
+	Register("threat", NewThreat)
+	Register("dict", NewDict)
+}
+
+// Step is an Enricher bound to its input field and output names.
+type Step struct {
+	Type     string
+	Field    string
+	Prefix   string
+	names    map[string]string // output -> expanded field name
+	enricher Enricher
+}
+
+func (step *Step) expand(tpl, output string) string {
+	return os.Expand(tpl, func(name string) string {
+		switch name {
+		case "field":
+			return step.Field
+		case "prefix":
+			return step.Prefix
+		case "output":
+			return output
+		}
+		return ""
+	})
+}
+
+// outputName returns the field name of an output, or "" if it's dropped.
+func (step *Step) outputName(output string) string {
+	if name, ok := step.names[output]; ok {
+		return name
+	}
+	return step.Prefix + output
+}
+
+// Pipeline applies steps in order. Later steps can consume fields produced by earlier ones.
+type Pipeline struct {
+	Steps []*Step
+}
+
+// NewPipeline creates a Pipeline per the task configuration.
+func NewPipeline(cfgs []config.EnrichConfig) (p *Pipeline, err error) {
+	p = &Pipeline{}
+	for i, cfg := range cfgs {
+		creatorsMux.RLock()
+		creator, ok := creators[cfg.Type]
+		creatorsMux.RUnlock()
+		if !ok {
+			p.Close()
+			err = errors.Errorf("enrichment step %d: unknown type %s", i, cfg.Type)
+			return
+		}
+		var enricher Enricher
+		if enricher, err = creator(cfg.Params); err != nil {
+			p.Close()
+			err = errors.Wrapf(err, "enrichment step %d(%s)", i, cfg.Type)
+			return
+		}
+		if _, ok := enricher.(MessageEnricher); !ok && cfg.Field == "" {
+			if closer, ok := enricher.(io.Closer); ok {
+				_ = closer.Close()
+			}
+			p.Close()
+			err = errors.Errorf("enrichment step %d(%s) requires field", i, cfg.Type)
+			return
+		}
+		step := &Step{
+			Type:     cfg.Type,
+			Field:    cfg.Field,
+			names:    make(map[string]string),
+			enricher: enricher,
+		}
+		step.Prefix = step.expand(cfg.Prefix, "")
+		for output, tpl := range cfg.Outputs {
+			if tpl == "-" {
+				step.names[output] = ""
+			} else {
+				step.names[output] = step.expand(tpl, output)
+			}
+		}
+		p.Steps = append(p.Steps, step)
+	}
+	return
+}
+
+// Apply runs all steps against a JSON message and returns the enriched message.
+func (p *Pipeline) Apply(value []byte) (result []byte, err error) {
+	result = value
+	for _, step := range p.Steps {
+		if result, _, err = step.Apply(result); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Apply runs the step against a JSON message. It's skipped(applied is false) if the input field is absent,
+// unless the enricher is a MessageEnricher.
+func (step *Step) Apply(value []byte) (result []byte, applied bool, err error) {
+	result = value
+	out := make(Fields)
+	if me, ok := step.enricher.(MessageEnricher); ok {
+		me.EnrichMessage(gjson.ParseBytes(result), out)
+	} else {
+		input := gjson.GetBytes(result, step.Field)
+		if !input.Exists() {
+			return
+		}
+		step.enricher.Enrich(input, out)
+	}
+	applied = true
+	for output, v := range out {
+		name := step.outputName(output)
+		if name == "" {
+			continue
+		}
+		if result, err = sjson.SetBytes(result, name, v); err != nil {
+			err = errors.Wrapf(err, "enrichment step %s", step.Type)
+			return
+		}
+	}
+	return
+}
+
+// CacheStats is implemented by enrichers which cache lookup results.
+type CacheStats interface {
+	CacheStats() (hits, misses uint64)
+}
+
+// CacheStats returns cache statistics of the step. ok is false if the enricher doesn't cache.
+func (step *Step) CacheStats() (hits, misses uint64, ok bool) {
+	var cs CacheStats
+	if cs, ok = step.enricher.(CacheStats); ok {
+		hits, misses = cs.CacheStats()
+	}
+	return
+}
+
+// Close releases resources held by steps.
+func (p *Pipeline) Close() {
+	for _, step := range p.Steps {
+		if closer, ok := step.enricher.(io.Closer); ok {
+			_ = closer.Close()
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package enrich
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tidwall/gjson"
+
+	"github.com/forever765/clickhouse_sinker_nali/config"
+)
+
+func TestPipeline(t *testing.T) {
+	p, err := NewPipeline([]config.EnrichConfig{
+		{Type: "url", Field: "request", Prefix: "req_"},
+		{Type: "ua", Field: "agent", Prefix: "ua_"},
+		{Type: "url", Field: "absent", Prefix: "absent_"},
+	})
+	require.Nil(t, err)
+
+	msg := []byte(`{"request":"https://example.com:8443/a/b?x=1","agent":"Mozilla/5.0 (iPhone; CPU iPhone OS 15_4 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/15.4 Mobile/15E148 Safari/604.1"}`)
+	msg, err = p.Apply(msg)
+	require.Nil(t, err)
+
+	expected := map[string]string{
+		"req_scheme":         "https",
+		"req_host":           "example.com",
+		"req_port":           "8443",
+		"req_path":           "/a/b",
+		"req_query":          "x=1",
+		"ua_browser":         "Safari",
+		"ua_browser_version": "15.4",
+		"ua_os":              "iOS",
+		"ua_os_version":      "15.4",
+		"ua_device":          "mobile",
+	}
+	for k, v := range expected {
+		require.Equal(t, v, gjson.GetBytes(msg, k).String(), k)
+	}
+	require.False(t, gjson.GetBytes(msg, "absent_host").Exists())
+}
+
+func TestOutputs(t *testing.T) {
+	p, err := NewPipeline([]config.EnrichConfig{
+		{Type: "url", Field: "referer", Prefix: "${field}_", Outputs: map[string]string{
+			"host":  "refererHost",
+			"path":  "${field}_${output}_x",
+			"query": "-",
+		}},
+	})
+	require.Nil(t, err)
+	msg, err := p.Apply([]byte(`{"referer":"http://example.com/p?q=1"}`))
+	require.Nil(t, err)
+	require.Equal(t, "example.com", gjson.GetBytes(msg, "refererHost").String())
+	require.Equal(t, "/p", gjson.GetBytes(msg, "referer_path_x").String())
+	require.Equal(t, "http", gjson.GetBytes(msg, "referer_scheme").String())
+	require.False(t, gjson.GetBytes(msg, "referer_query").Exists())
+}
+
+type fullName struct{}
+
+func (fullName) Enrich(_ gjson.Result, _ Fields) {}
+
+func (fullName) EnrichMessage(msg gjson.Result, out Fields) {
+	out["full_name"] = msg.Get("first").String() + " " + msg.Get("last").String()
+}
+
+func TestMessageEnricher(t *testing.T) {
+	Register("test_full_name", func(_ map[string]string) (Enricher, error) { return fullName{}, nil })
+	p, err := NewPipeline([]config.EnrichConfig{{Type: "test_full_name"}})
+	require.Nil(t, err)
+	msg, err := p.Apply([]byte(`{"first":"Ada","last":"Lovelace"}`))
+	require.Nil(t, err)
+	require.Equal(t, "Ada Lovelace", gjson.GetBytes(msg, "full_name").String())
+
+	_, err = NewPipeline([]config.EnrichConfig{{Type: "url"}})
+	require.NotNil(t, err)
+}
+
+func TestUnknownType(t *testing.T) {
+	_, err := NewPipeline([]config.EnrichConfig{{Type: "nonexistent", Field: "ip"}})
+	require.NotNil(t, err)
+}
+
+func TestThreat(t *testing.T) {
+	f, err := ioutil.TempFile("", "threat")
+	require.Nil(t, err)
+	defer os.Remove(f.Name())
+	_, err = f.WriteString("# DROP list\n1.2.3.0/24 ; SBL001\n5.6.7.8\n")
+	require.Nil(t, err)
+	f.Close()
+
+	p, err := NewPipeline([]config.EnrichConfig{
+		{Type: "threat", Field: "ip", Prefix: "", Params: map[string]string{"feeds": "drop=" + f.Name() + ",all=" + f.Name()}},
+	})
+	require.Nil(t, err)
+	defer p.Close()
+
+	msg, err := p.Apply([]byte(`{"ip":"1.2.3.4"}`))
+	require.Nil(t, err)
+	require.Equal(t, `["all","drop"]`, gjson.GetBytes(msg, "threat_tags").Raw)
+	msg, err = p.Apply([]byte(`{"ip":"8.8.8.8"}`))
+	require.Nil(t, err)
+	require.Equal(t, `[]`, gjson.GetBytes(msg, "threat_tags").Raw)
+}
+
+func TestDict(t *testing.T) {
+	f, err := ioutil.TempFile("", "dict")
+	require.Nil(t, err)
+	defer os.Remove(f.Name())
+	_, err = f.WriteString("site,device_id,rack\nbj,dev1,r01\nsh,\"dev2\",r02\n")
+	require.Nil(t, err)
+	f.Close()
+
+	p, err := NewPipeline([]config.EnrichConfig{
+		{Type: "dict", Field: "device", Prefix: "", Params: map[string]string{"csv": f.Name(), "key": "device_id"}},
+	})
+	require.Nil(t, err)
+	defer p.Close()
+
+	msg, err := p.Apply([]byte(`{"device":"dev2"}`))
+	require.Nil(t, err)
+	require.Equal(t, "sh", gjson.GetBytes(msg, "site").String())
+	require.Equal(t, "r02", gjson.GetBytes(msg, "rack").String())
+	msg, err = p.Apply([]byte(`{"device":"dev3"}`))
+	require.Nil(t, err)
+	require.False(t, gjson.GetBytes(msg, "site").Exists())
+
+	_, err = NewPipeline([]config.EnrichConfig{{Type: "dict", Field: "device", Params: map[string]string{"csv": f.Name(), "key": "absent"}}})
+	require.NotNil(t, err)
+}
+
+func TestReverseDNSShared(t *testing.T) {
+	e1, err := NewReverseDNS(map[string]string{"timeout": "100"})
+	require.Nil(t, err)
+	e2, err := NewReverseDNS(map[string]string{"timeout": "100"})
+	require.Nil(t, err)
+	e3, err := NewReverseDNS(map[string]string{"timeout": "100", "failureTTL": "30"})
+	require.Nil(t, err)
+	require.Same(t, e1.(*ReverseDNS).resolver, e2.(*ReverseDNS).resolver)
+	require.NotSame(t, e1.(*ReverseDNS).resolver, e3.(*ReverseDNS).resolver)
+	_, err = NewReverseDNS(map[string]string{"failureTTL": "0"})
+	require.NotNil(t, err)
+}
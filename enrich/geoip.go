@@ -0,0 +1,151 @@
+package enrich
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/oschwald/geoip2-golang"
+	"github.com/pkg/errors"
+	"github.com/tidwall/gjson"
+	"go.uber.org/zap"
+
+	"github.com/forever765/clickhouse_sinker_nali/ipHandle/constant"
+	"github.com/forever765/clickhouse_sinker_nali/ipHandle/db"
+	"github.com/forever765/clickhouse_sinker_nali/ipHandle/entity"
+	"github.com/forever765/clickhouse_sinker_nali/util"
+)
+
+// NaliLookup returns location and isp of ip via nali
+func NaliLookup(ip string) (loc, isp string) {
+	// naliRspRaw example: 192.168.123.1[局域网 对方和您在同一内部网]   or   164.90.236.112[美国 ]
+	naliRspRaw := entity.ParseIP(ip).String()
+	naliRsp_1 := strings.TrimRight(naliRspRaw, "]")
+	// 清理可能存在的 ] 符号
+	naliRsp_2 := strings.TrimRight(naliRsp_1, "]")
+	// PureResult example: ["119.147.3.230","广东省深圳市 腾讯云] "]
+	PureResult := strings.Split(naliRsp_2, "[")
+
+	var PureResultList []string
+	// 提取地理位置，PureResult  --->   [220.166.187.228 四川省资阳市简阳市]
+	if len(PureResult) > 1 {
+		PureResultList = strings.Fields(PureResult[1])
+	}
+
+	loc = "未知"
+	isp = "未知"
+	LPR := len(PureResultList)
+	if LPR == 0 {
+		// if nali return null result, default value is "Unknown"
+		//util.Logger.Warn("Nali返回空结果：", zap.Any("结果为：", PureResultList))
+	} else if LPR == 1 {
+		// only have location
+		loc = PureResultList[0]
+	} else if LPR > 1 {
+		// 国外的地名和isp可能有空格，也有可能不存在运营商
+		loc = PureResultList[0]
+		if PureResultList[1] == "]" || PureResultList[1] == " " {
+			isp = PureResultList[0]
+		} else {
+			isp = strings.Join(PureResultList[1:], "")
+		}
+	} else {
+		util.Logger.Warn(fmt.Sprintf("nali return unknown data: %s, 个数：%v", PureResultList, LPR))
+	}
+
+	// 清理可能存在的 ] 符号
+	isp = strings.TrimRight(isp, "]")
+	// Replace 同一内部网 to 局域网
+	if strings.Contains(loc, "同一内部网") || strings.Contains(isp, "同一内部网") {
+		loc = "局域网"
+		isp = "局域网"
+	}
+	return
+}
+
+// GeoIP outputs "loc" and "isp" of an IP via nali.
+type GeoIP struct{}
+
+func NewGeoIP(_ map[string]string) (Enricher, error) {
+	return GeoIP{}, nil
+}
+
+func (GeoIP) Enrich(input gjson.Result, out Fields) {
+	out["loc"], out["isp"] = NaliLookup(input.String())
+}
+
+// ASN outputs "asn" and "as_org" of an IP via a MaxMind ASN database.
+// The database is reopened after geo databases are reloaded.
+// Params:
+//   - db: path of GeoLite2-ASN.mmdb, default to $NALI_DB_HOME/GeoLite2-ASN.mmdb
+type ASN struct {
+	path    string
+	mux     sync.RWMutex
+	db      *geoip2.Reader
+	version uint64
+}
+
+func NewASN(params map[string]string) (Enricher, error) {
+	a := &ASN{path: params["db"]}
+	if a.path == "" {
+		a.path = filepath.Join(constant.HomePath, "GeoLite2-ASN.mmdb")
+	}
+	if err := a.open(db.Version()); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// open assumes a.mux is locked or a isn't shared yet
+func (a *ASN) open(version uint64) error {
+	reader, err := geoip2.Open(a.path)
+	if err != nil {
+		return errors.Wrapf(err, "")
+	}
+	if a.db != nil {
+		a.db.Close()
+	}
+	a.db, a.version = reader, version
+	return nil
+}
+
+func (a *ASN) Enrich(input gjson.Result, out Fields) {
+	ip := net.ParseIP(input.String())
+	if ip == nil {
+		return
+	}
+	if version := db.Version(); version != a.getVersion() {
+		a.mux.Lock()
+		if version != a.version {
+			if err := a.open(version); err != nil {
+				// keep using the opened one
+				a.version = version
+				util.Logger.Error("failed to reopen ASN database", zap.String("path", a.path), zap.Error(err))
+			}
+		}
+		a.mux.Unlock()
+	}
+	a.mux.RLock()
+	record, err := a.db.ASN(ip)
+	a.mux.RUnlock()
+	if err != nil || record.AutonomousSystemNumber == 0 {
+		return
+	}
+	out["asn"] = record.AutonomousSystemNumber
+	out["as_org"] = record.AutonomousSystemOrganization
+}
+
+func (a *ASN) getVersion() uint64 {
+	a.mux.RLock()
+	defer a.mux.RUnlock()
+	return a.version
+}
+
+// Close closes the database.
+func (a *ASN) Close() error {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	return a.db.Close()
+}
@@ -0,0 +1,102 @@
+package enrich
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/tidwall/gjson"
+
+	"github.com/forever765/clickhouse_sinker_nali/ipHandle/cidr"
+	"github.com/forever765/clickhouse_sinker_nali/ipHandle/rdns"
+)
+
+// CIDR outputs "zone", the label of the most specific CIDR block containing an IP.
+// Params:
+//   - file: the CIDR-to-label mapping file, see cidr.LoadFile
+type CIDR struct {
+	table *cidr.Table
+}
+
+func NewCIDR(params map[string]string) (Enricher, error) {
+	if params["file"] == "" {
+		return nil, errors.Errorf("param file is required")
+	}
+	table, err := cidr.LoadFile(params["file"])
+	if err != nil {
+		return nil, err
+	}
+	return &CIDR{table: table}, nil
+}
+
+func (c *CIDR) Enrich(input gjson.Result, out Fields) {
+	if label, ok := c.table.Lookup(input.String()); ok {
+		out["zone"] = label
+	}
+}
+
+// ReverseDNS outputs "host", the host name of an IP via PTR lookup. Steps with the same params share a resolver, so
+// that they share its cache and the limit of in-flight lookups.
+// Params:
+//   - timeout: per-lookup timeout in milliseconds, default to 200
+//   - cacheTTL: seconds to cache a lookup result, default to 3600
+//   - failureTTL: seconds to cache a failed lookup, such as a timeout, default to 10
+//   - concurrency: max number of in-flight lookups, default to 16
+type ReverseDNS struct {
+	resolver *rdns.Resolver
+}
+
+type resolverKey struct {
+	timeout, cacheTTL, failureTTL, concurrency int
+}
+
+var (
+	resolversMux sync.Mutex
+	resolvers    = make(map[resolverKey]*rdns.Resolver)
+)
+
+func NewReverseDNS(params map[string]string) (Enricher, error) {
+	var err error
+	var key resolverKey
+	if key.timeout, err = intParam(params, "timeout", 200); err != nil {
+		return nil, err
+	}
+	if key.cacheTTL, err = intParam(params, "cacheTTL", 3600); err != nil {
+		return nil, err
+	}
+	if key.failureTTL, err = intParam(params, "failureTTL", 10); err != nil {
+		return nil, err
+	}
+	if key.concurrency, err = intParam(params, "concurrency", 16); err != nil {
+		return nil, err
+	}
+	resolversMux.Lock()
+	defer resolversMux.Unlock()
+	resolver, ok := resolvers[key]
+	if !ok {
+		resolver = rdns.NewResolver(time.Duration(key.timeout)*time.Millisecond, time.Duration(key.cacheTTL)*time.Second,
+			time.Duration(key.failureTTL)*time.Second, key.concurrency)
+		resolvers[key] = resolver
+	}
+	return &ReverseDNS{resolver: resolver}, nil
+}
+
+func (r *ReverseDNS) Enrich(input gjson.Result, out Fields) {
+	out["host"] = r.resolver.Lookup(input.String())
+}
+
+func (r *ReverseDNS) CacheStats() (hits, misses uint64) {
+	return r.resolver.Stats()
+}
+
+func intParam(params map[string]string, name string, defaultValue int) (value int, err error) {
+	s, ok := params[name]
+	if !ok || s == "" {
+		return defaultValue, nil
+	}
+	if value, err = strconv.Atoi(s); err != nil || value <= 0 {
+		err = errors.Errorf("param %s expects a positive integer, got %q", name, s)
+	}
+	return
+}
@@ -0,0 +1,54 @@
+package enrich
+
+import (
+	"plugin"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/tidwall/gjson"
+)
+
+// MessageEnricher is implemented by enrichers which need the whole message rather than the input field,
+// e.g. to combine several fields. Apply calls EnrichMessage instead of Enrich for them.
+type MessageEnricher interface {
+	Enricher
+	EnrichMessage(msg gjson.Result, out Fields)
+}
+
+var (
+	pluginsMux sync.Mutex
+	plugins    = make(map[string]struct{})
+)
+
+// LoadPlugins opens Go plugins(built with `go build -buildmode=plugin`), and calls their exported `Init() error`,
+// which is expected to register enrichment types via Register. A plugin is loaded at most once.
+func LoadPlugins(paths []string) (err error) {
+	pluginsMux.Lock()
+	defer pluginsMux.Unlock()
+	for _, path := range paths {
+		if _, ok := plugins[path]; ok {
+			continue
+		}
+		var p *plugin.Plugin
+		if p, err = plugin.Open(path); err != nil {
+			err = errors.Wrapf(err, "failed to open enrichment plugin %s", path)
+			return
+		}
+		var sym plugin.Symbol
+		if sym, err = p.Lookup("Init"); err != nil {
+			err = errors.Wrapf(err, "enrichment plugin %s", path)
+			return
+		}
+		initFn, ok := sym.(func() error)
+		if !ok {
+			err = errors.Errorf("enrichment plugin %s: Init is %T, expect func() error", path, sym)
+			return
+		}
+		if err = initFn(); err != nil {
+			err = errors.Wrapf(err, "enrichment plugin %s", path)
+			return
+		}
+		plugins[path] = struct{}{}
+	}
+	return
+}
@@ -0,0 +1,162 @@
+package enrich
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/tidwall/gjson"
+	"go.uber.org/zap"
+
+	"github.com/forever765/clickhouse_sinker_nali/ipHandle/cidr"
+	"github.com/forever765/clickhouse_sinker_nali/util"
+)
+
+const defaultThreatRefresh = 3600
+
+type threatFeed struct {
+	tag      string
+	location string // file path or http(s) URL
+	table    *cidr.Table
+}
+
+// Threat outputs "threat_tags", tags of the blocklists which contain an IP. It's empty if no blocklist matches.
+// Params:
+//   - feeds: comma-separated "<tag>=<location>", the location is a file path or an http(s) URL.
+//     Each line of a feed is an IP or CIDR, texts after "#" or ";" are ignored.
+//   - refresh: seconds between reloading feeds, default to 3600
+type Threat struct {
+	feeds  atomic.Value // []threatFeed
+	stopCh chan struct{}
+	wg     sync.WaitGroup
+}
+
+func NewThreat(params map[string]string) (Enricher, error) {
+	var feeds []threatFeed
+	for _, item := range strings.Split(params["feeds"], ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, errors.Errorf("invalid feed %q, expect <tag>=<location>", item)
+		}
+		feeds = append(feeds, threatFeed{tag: kv[0], location: kv[1]})
+	}
+	if len(feeds) == 0 {
+		return nil, errors.Errorf("param feeds is required")
+	}
+	refresh, err := intParam(params, "refresh", defaultThreatRefresh)
+	if err != nil {
+		return nil, err
+	}
+	for i := range feeds {
+		if feeds[i].table, err = loadThreatFeed(feeds[i].location); err != nil {
+			return nil, err
+		}
+	}
+	t := &Threat{stopCh: make(chan struct{})}
+	t.feeds.Store(feeds)
+	t.wg.Add(1)
+	go t.refresh(time.Duration(refresh) * time.Second)
+	return t, nil
+}
+
+func (t *Threat) Enrich(input gjson.Result, out Fields) {
+	ip := input.String()
+	tags := []string{}
+	for _, feed := range t.feeds.Load().([]threatFeed) {
+		if _, ok := feed.table.Lookup(ip); ok {
+			tags = append(tags, feed.tag)
+		}
+	}
+	sort.Strings(tags)
+	out["threat_tags"] = tags
+}
+
+// Close stops refreshing feeds.
+func (t *Threat) Close() error {
+	close(t.stopCh)
+	t.wg.Wait()
+	return nil
+}
+
+func (t *Threat) refresh(interval time.Duration) {
+	defer t.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.stopCh:
+			return
+		case <-ticker.C:
+		}
+		old := t.feeds.Load().([]threatFeed)
+		feeds := make([]threatFeed, len(old))
+		for i, feed := range old {
+			feeds[i] = feed
+			table, err := loadThreatFeed(feed.location)
+			if err != nil {
+				// keep the stale one
+				util.Logger.Warn("failed to refresh threat feed", zap.String("tag", feed.tag), zap.Error(err))
+				continue
+			}
+			feeds[i].table = table
+		}
+		t.feeds.Store(feeds)
+	}
+}
+
+func loadThreatFeed(location string) (table *cidr.Table, err error) {
+	var r io.Reader
+	if strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://") {
+		var resp *http.Response
+		client := http.Client{Timeout: 30 * time.Second}
+		if resp, err = client.Get(location); err != nil {
+			err = errors.Wrapf(err, "")
+			return
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			err = errors.Errorf("GET %s: %s", location, resp.Status)
+			return
+		}
+		r = resp.Body
+	} else {
+		var f *os.File
+		if f, err = os.Open(location); err != nil {
+			err = errors.Wrapf(err, "")
+			return
+		}
+		defer f.Close()
+		r = f
+	}
+	var body []byte
+	if body, err = ioutil.ReadAll(r); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	table = cidr.NewTable()
+	for _, line := range bytes.Split(body, []byte("\n")) {
+		if i := bytes.IndexAny(line, "#;"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(string(line))
+		if len(fields) == 0 {
+			continue
+		}
+		if err = table.Add(fields[0], ""); err != nil {
+			err = errors.Wrapf(err, "%s", location)
+			return
+		}
+	}
+	return
+}
@@ -0,0 +1,73 @@
+package enrich
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/tidwall/gjson"
+)
+
+type uaRule struct {
+	name string
+	re   *regexp.Regexp
+}
+
+// Rules are tried in order, so more specific ones(e.g. Edge, whose user agent also contains Chrome and Safari) come first.
+var (
+	browserRules = []uaRule{
+		{"Edge", regexp.MustCompile(`Edge?/([\d.]+)`)},
+		{"Opera", regexp.MustCompile(`(?:OPR|Opera)/([\d.]+)`)},
+		{"WeChat", regexp.MustCompile(`MicroMessenger/([\d.]+)`)},
+		{"Chrome", regexp.MustCompile(`(?:Chrome|CriOS)/([\d.]+)`)},
+		{"Firefox", regexp.MustCompile(`(?:Firefox|FxiOS)/([\d.]+)`)},
+		{"Safari", regexp.MustCompile(`Version/([\d.]+).*Safari/`)},
+		{"IE", regexp.MustCompile(`(?:MSIE |Trident/.*rv:)([\d.]+)`)},
+		{"curl", regexp.MustCompile(`curl/([\d.]+)`)},
+	}
+	osRules = []uaRule{
+		{"Windows", regexp.MustCompile(`Windows NT ([\d.]+)`)},
+		{"iOS", regexp.MustCompile(`(?:iPhone|CPU) OS ([\d_]+)`)},
+		{"Android", regexp.MustCompile(`Android ([\d.]+)`)},
+		{"macOS", regexp.MustCompile(`Mac OS X ([\d_.]+)`)},
+		{"Linux", regexp.MustCompile(`Linux()`)},
+	}
+	botRe    = regexp.MustCompile(`(?i)bot|spider|crawl|slurp`)
+	tabletRe = regexp.MustCompile(`iPad|Tablet`)
+	mobileRe = regexp.MustCompile(`Mobile|iPhone|Android`)
+)
+
+// UserAgent outputs "browser", "browser_version", "os", "os_version" and "device"(bot, tablet, mobile or desktop) of a User-Agent header.
+type UserAgent struct{}
+
+func NewUserAgent(_ map[string]string) (Enricher, error) {
+	return UserAgent{}, nil
+}
+
+func (UserAgent) Enrich(input gjson.Result, out Fields) {
+	ua := input.String()
+	if ua == "" {
+		return
+	}
+	out["browser"], out["browser_version"] = matchUA(browserRules, ua)
+	name, version := matchUA(osRules, ua)
+	out["os"], out["os_version"] = name, strings.ReplaceAll(version, "_", ".")
+	switch {
+	case botRe.MatchString(ua):
+		out["device"] = "bot"
+	case tabletRe.MatchString(ua):
+		out["device"] = "tablet"
+	case mobileRe.MatchString(ua):
+		out["device"] = "mobile"
+	default:
+		out["device"] = "desktop"
+	}
+}
+
+func matchUA(rules []uaRule, ua string) (name, version string) {
+	for _, rule := range rules {
+		if m := rule.re.FindStringSubmatch(ua); m != nil {
+			return rule.name, m[1]
+		}
+	}
+	return
+}
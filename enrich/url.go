@@ -0,0 +1,26 @@
+package enrich
+
+import (
+	"net/url"
+
+	"github.com/tidwall/gjson"
+)
+
+// URL splits a URL into "scheme", "host", "port", "path" and "query".
+type URL struct{}
+
+func NewURL(_ map[string]string) (Enricher, error) {
+	return URL{}, nil
+}
+
+func (URL) Enrich(input gjson.Result, out Fields) {
+	u, err := url.Parse(input.String())
+	if err != nil {
+		return
+	}
+	out["scheme"] = u.Scheme
+	out["host"] = u.Hostname()
+	out["port"] = u.Port()
+	out["path"] = u.Path
+	out["query"] = u.RawQuery
+}
@@ -0,0 +1,87 @@
+package filter
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+const dedupShards = 16
+
+// Deduper drops rows whose key has been seen within a window, which is safe for concurrent use.
+type Deduper struct {
+	fields  []string
+	window  int64 // nanoseconds
+	maxKeys int   // per shard
+	shards  [dedupShards]dedupShard
+}
+
+type dedupShard struct {
+	sync.Mutex
+	seen  map[uint64]int64 // key -> the time it's first seen
+	queue []dedupEntry     // keys in order of time, from head
+	head  int
+}
+
+type dedupEntry struct {
+	key uint64
+	ts  int64
+}
+
+// NewDeduper remembers keys for window, and at most maxKeys keys. The key of a row is values of fields, or the whole
+// message if fields is empty.
+func NewDeduper(fields []string, window time.Duration, maxKeys int) *Deduper {
+	d := &Deduper{fields: fields, window: int64(window), maxKeys: (maxKeys + dedupShards - 1) / dedupShards}
+	for i := range d.shards {
+		d.shards[i].seen = make(map[uint64]int64)
+	}
+	return d
+}
+
+// Duplicated tells whether the key of the row has been seen within the window. The window begins at the first row of
+// a key, duplicates don't extend it.
+func (d *Deduper) Duplicated(fields Fields, msg []byte) bool {
+	var key uint64
+	if len(d.fields) == 0 {
+		key = xxhash.Sum64(msg)
+	} else {
+		dig := xxhash.New()
+		for _, field := range d.fields {
+			if v := fields.GetString(field, true); v != nil {
+				_, _ = dig.WriteString(fmt.Sprint(v))
+			}
+			_, _ = dig.WriteString("\x00")
+		}
+		key = dig.Sum64()
+	}
+	return d.shards[key%dedupShards].check(key, time.Now().UnixNano(), d.window, d.maxKeys)
+}
+
+func (s *dedupShard) check(key uint64, now, window int64, maxKeys int) bool {
+	s.Lock()
+	defer s.Unlock()
+	if ts, ok := s.seen[key]; ok && now-ts < window {
+		return true
+	}
+	s.seen[key] = now
+	s.queue = append(s.queue, dedupEntry{key: key, ts: now})
+	// forget expired keys, and the oldest ones beyond maxKeys
+	for s.head < len(s.queue) {
+		e := s.queue[s.head]
+		if now-e.ts < window && len(s.seen) <= maxKeys {
+			break
+		}
+		// the key may have been seen again after expiry
+		if s.seen[e.key] == e.ts {
+			delete(s.seen, e.key)
+		}
+		s.head++
+	}
+	if s.head > len(s.queue)/2 {
+		s.queue = append(s.queue[:0], s.queue[s.head:]...)
+		s.head = 0
+	}
+	return false
+}
@@ -0,0 +1,610 @@
+// Package filter evaluates filter expressions of tasks on parsed fields, such as `response != "200" && bytes > 1024`,
+// and samples rows.
+//
+// The syntax is a subset of expr-lang(https://expr-lang.org):
+//   - literals: numbers, "strings" or 'strings', true, false, null, and lists such as [1, 2, 3]
+//   - fields: names such as response or req.host, and `backquoted` names of other characters
+//   - operators by precedence: `!`(or not) and unary `-`; `*`, `/`, `%`; `+`, `-`; `==`, `!=`, `<`, `<=`, `>`, `>=`,
+//     in, not in, contains, startsWith, endsWith, matches; `&&`(or and); `||`(or or)
+//
+// Values of fields are the text of JSON values or CSV columns, which are compared as numbers against numbers, as
+// booleans against booleans, and as strings otherwise. Two fields are ordered as numbers if both are numeric. A missing
+// field is null, which only equals null, and makes ordering and string operators false.
+package filter
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/pkg/errors"
+)
+
+// Fields gives the text of parsed fields, which model.Metric implements.
+type Fields interface {
+	GetString(key string, nullable bool) (val interface{})
+}
+
+// Filter is a compiled filter expression, which is safe for concurrent use.
+type Filter struct {
+	expr string
+	root node
+}
+
+// Compile parses the expression.
+func Compile(expr string) (f *Filter, err error) {
+	p := &exprParser{expr: expr}
+	if err = p.tokenize(); err != nil {
+		return
+	}
+	var root node
+	if root, err = p.parseOr(); err != nil {
+		return
+	}
+	if tok := p.peek(); tok.kind != tokEOF {
+		err = p.errorf(tok, "unexpected %s", tok.text)
+		return
+	}
+	f = &Filter{expr: expr, root: root}
+	return
+}
+
+// Match tells whether the row of the fields shall be kept.
+func (f *Filter) Match(fields Fields) bool {
+	return truthy(f.root.eval(fields))
+}
+
+func (f *Filter) String() string {
+	return f.expr
+}
+
+// values are nil, bool, float64, string or []interface{}
+type node interface {
+	eval(fields Fields) interface{}
+}
+
+type literal struct{ val interface{} }
+
+func (n literal) eval(Fields) interface{} { return n.val }
+
+type field struct{ name string }
+
+func (n field) eval(fields Fields) interface{} { return fields.GetString(n.name, true) }
+
+type list []node
+
+func (n list) eval(fields Fields) interface{} {
+	vals := make([]interface{}, len(n))
+	for i, e := range n {
+		vals[i] = e.eval(fields)
+	}
+	return vals
+}
+
+type unary struct {
+	op string
+	x  node
+}
+
+func (n unary) eval(fields Fields) interface{} {
+	v := n.x.eval(fields)
+	if n.op == "-" {
+		if f, ok := toNumber(v); ok {
+			return -f
+		}
+		return nil
+	}
+	return !truthy(v)
+}
+
+type logical struct {
+	and  bool
+	x, y node
+}
+
+func (n logical) eval(fields Fields) interface{} {
+	if truthy(n.x.eval(fields)) != n.and {
+		return !n.and
+	}
+	return truthy(n.y.eval(fields))
+}
+
+type binary struct {
+	op   string
+	x, y node
+	re   *regexp.Regexp // of matches
+}
+
+func (n binary) eval(fields Fields) interface{} {
+	x, y := n.x.eval(fields), n.y.eval(fields)
+	switch n.op {
+	case "==":
+		return equal(x, y)
+	case "!=":
+		return !equal(x, y)
+	case "<", "<=", ">", ">=":
+		c, ok := compare(x, y)
+		if !ok {
+			return false
+		}
+		switch n.op {
+		case "<":
+			return c < 0
+		case "<=":
+			return c <= 0
+		case ">":
+			return c > 0
+		default:
+			return c >= 0
+		}
+	case "in", "not in":
+		var found bool
+		if elems, ok := y.([]interface{}); ok {
+			for _, e := range elems {
+				if equal(x, e) {
+					found = true
+					break
+				}
+			}
+		}
+		return found == (n.op == "in")
+	case "contains", "startsWith", "endsWith", "matches":
+		s, ok1 := toString(x)
+		sub, ok2 := toString(y)
+		if !ok1 || !ok2 {
+			return false
+		}
+		switch n.op {
+		case "contains":
+			return strings.Contains(s, sub)
+		case "startsWith":
+			return strings.HasPrefix(s, sub)
+		case "endsWith":
+			return strings.HasSuffix(s, sub)
+		default:
+			return n.re.MatchString(s)
+		}
+	case "+":
+		if a, b, ok := toNumbers(x, y); ok {
+			return a + b
+		}
+		if a, ok := x.(string); ok {
+			if b, ok := y.(string); ok {
+				return a + b
+			}
+		}
+		return nil
+	default:
+		a, b, ok := toNumbers(x, y)
+		if !ok {
+			return nil
+		}
+		switch n.op {
+		case "-":
+			return a - b
+		case "*":
+			return a * b
+		case "/":
+			return a / b
+		default:
+			return math.Mod(a, b)
+		}
+	}
+}
+
+func truthy(v interface{}) bool {
+	switch v := v.(type) {
+	case bool:
+		return v
+	case float64:
+		return v != 0
+	case string:
+		b, _ := strconv.ParseBool(v)
+		return b
+	}
+	return false
+}
+
+func toNumber(v interface{}) (f float64, ok bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case string:
+		var err error
+		f, err = strconv.ParseFloat(v, 64)
+		return f, err == nil
+	}
+	return
+}
+
+func toNumbers(x, y interface{}) (a, b float64, ok bool) {
+	var ok1, ok2 bool
+	a, ok1 = toNumber(x)
+	b, ok2 = toNumber(y)
+	return a, b, ok1 && ok2
+}
+
+func toString(v interface{}) (s string, ok bool) {
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case bool:
+		return strconv.FormatBool(v), true
+	}
+	return
+}
+
+func toBool(v interface{}) (b, ok bool) {
+	switch v := v.(type) {
+	case bool:
+		return v, true
+	case string:
+		var err error
+		b, err = strconv.ParseBool(v)
+		return b, err == nil
+	}
+	return
+}
+
+func equal(x, y interface{}) bool {
+	if x == nil || y == nil {
+		return x == nil && y == nil
+	}
+	_, xNum := x.(float64)
+	_, yNum := y.(float64)
+	if xNum || yNum {
+		a, b, ok := toNumbers(x, y)
+		return ok && a == b
+	}
+	_, xBool := x.(bool)
+	_, yBool := y.(bool)
+	if xBool || yBool {
+		a, ok1 := toBool(x)
+		b, ok2 := toBool(y)
+		return ok1 && ok2 && a == b
+	}
+	a, ok1 := x.(string)
+	b, ok2 := y.(string)
+	return ok1 && ok2 && a == b
+}
+
+// compare orders x and y as numbers if either is a number or both are numeric strings, otherwise as strings.
+func compare(x, y interface{}) (c int, ok bool) {
+	_, xNum := x.(float64)
+	_, yNum := y.(float64)
+	a, b, numeric := toNumbers(x, y)
+	if xNum || yNum || numeric {
+		if !numeric {
+			return
+		}
+		switch {
+		case a < b:
+			c = -1
+		case a > b:
+			c = 1
+		}
+		return c, true
+	}
+	s1, ok1 := x.(string)
+	s2, ok2 := y.(string)
+	if !ok1 || !ok2 {
+		return
+	}
+	return strings.Compare(s1, s2), true
+}
+
+const (
+	tokEOF = iota
+	tokNumber
+	tokString
+	tokIdent  // field names and keywords
+	tokQuoted // `backquoted` field names
+	tokOp
+)
+
+type token struct {
+	kind int
+	text string // of tokString and tokQuoted, the unquoted content
+	pos  int
+}
+
+type exprParser struct {
+	expr   string
+	tokens []token
+	next   int
+}
+
+func (p *exprParser) errorf(tok token, format string, args ...interface{}) error {
+	return errors.Errorf("filter %q: %s at %d", p.expr, fmt.Sprintf(format, args...), tok.pos)
+}
+
+func (p *exprParser) tokenize() (err error) {
+	s := p.expr
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c >= '0' && c <= '9' || c == '.' && i+1 < len(s) && s[i+1] >= '0' && s[i+1] <= '9':
+			j := i
+			for j < len(s) && (isIdentChar(s[j]) || s[j] == '.' ||
+				(s[j] == '+' || s[j] == '-') && (s[j-1] == 'e' || s[j-1] == 'E')) {
+				j++
+			}
+			p.tokens = append(p.tokens, token{kind: tokNumber, text: s[i:j], pos: i})
+			i = j
+		case c == '"' || c == '\'':
+			j := i + 1
+			for j < len(s) && s[j] != c {
+				if s[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(s) {
+				return p.errorf(token{pos: i}, "unterminated string")
+			}
+			text := s[i : j+1]
+			if c == '\'' {
+				// requote as a double-quoted string
+				text = `"` + strings.Replace(strings.Replace(s[i+1:j], `\'`, `'`, -1), `"`, `\"`, -1) + `"`
+			}
+			var unquoted string
+			if unquoted, err = strconv.Unquote(text); err != nil {
+				return p.errorf(token{pos: i}, "invalid string %s", s[i:j+1])
+			}
+			p.tokens = append(p.tokens, token{kind: tokString, text: unquoted, pos: i})
+			i = j + 1
+		case c == '`':
+			j := strings.IndexByte(s[i+1:], '`')
+			if j < 0 {
+				return p.errorf(token{pos: i}, "unterminated field name")
+			}
+			p.tokens = append(p.tokens, token{kind: tokQuoted, text: s[i+1 : i+1+j], pos: i})
+			i += j + 2
+		case isIdentChar(c):
+			j := i
+			for j < len(s) && (isIdentChar(s[j]) || s[j] == '.') {
+				j++
+			}
+			p.tokens = append(p.tokens, token{kind: tokIdent, text: s[i:j], pos: i})
+			i = j
+		default:
+			op := ""
+			for _, candidate := range []string{"==", "!=", "<=", ">=", "&&", "||", "<", ">", "!", "+", "-", "*", "/", "%", "(", ")", "[", "]", ","} {
+				if strings.HasPrefix(s[i:], candidate) {
+					op = candidate
+					break
+				}
+			}
+			if op == "" {
+				return p.errorf(token{pos: i}, "unexpected character %q", c)
+			}
+			p.tokens = append(p.tokens, token{kind: tokOp, text: op, pos: i})
+			i += len(op)
+		}
+	}
+	p.tokens = append(p.tokens, token{kind: tokEOF, text: "end", pos: len(s)})
+	return
+}
+
+func isIdentChar(c byte) bool {
+	return c == '_' || c == '$' || c == '@' || c >= '0' && c <= '9' || unicode.IsLetter(rune(c)) || c >= 0x80
+}
+
+func (p *exprParser) peek() token {
+	return p.tokens[p.next]
+}
+
+// accept consumes the next token if it's one of the operators or keywords.
+func (p *exprParser) accept(texts ...string) (text string, ok bool) {
+	tok := p.peek()
+	if tok.kind != tokOp && tok.kind != tokIdent {
+		return
+	}
+	for _, t := range texts {
+		if tok.text == t {
+			p.next++
+			return t, true
+		}
+	}
+	return
+}
+
+func (p *exprParser) expect(text string) (err error) {
+	if _, ok := p.accept(text); !ok {
+		tok := p.peek()
+		err = p.errorf(tok, "expect %s but got %s", text, tok.text)
+	}
+	return
+}
+
+func (p *exprParser) parseOr() (n node, err error) {
+	if n, err = p.parseAnd(); err != nil {
+		return
+	}
+	for {
+		if _, ok := p.accept("||", "or"); !ok {
+			return
+		}
+		var y node
+		if y, err = p.parseAnd(); err != nil {
+			return
+		}
+		n = logical{and: false, x: n, y: y}
+	}
+}
+
+func (p *exprParser) parseAnd() (n node, err error) {
+	if n, err = p.parseComparison(); err != nil {
+		return
+	}
+	for {
+		if _, ok := p.accept("&&", "and"); !ok {
+			return
+		}
+		var y node
+		if y, err = p.parseComparison(); err != nil {
+			return
+		}
+		n = logical{and: true, x: n, y: y}
+	}
+}
+
+func (p *exprParser) parseComparison() (n node, err error) {
+	if n, err = p.parseAdditive(); err != nil {
+		return
+	}
+	tok := p.peek()
+	op, ok := p.accept("==", "!=", "<", "<=", ">", ">=", "in", "contains", "startsWith", "endsWith", "matches")
+	if !ok {
+		if _, ok = p.accept("not"); !ok {
+			return
+		}
+		if err = p.expect("in"); err != nil {
+			return
+		}
+		op = "not in"
+	}
+	var y node
+	if y, err = p.parseAdditive(); err != nil {
+		return
+	}
+	b := binary{op: op, x: n, y: y}
+	switch op {
+	case "in", "not in":
+		if _, isList := y.(list); !isList {
+			err = p.errorf(tok, "%s expects a list", op)
+			return
+		}
+	case "matches":
+		lit, isLit := y.(literal)
+		pattern, isStr := lit.val.(string)
+		if !isLit || !isStr {
+			err = p.errorf(tok, "matches expects a string of regexp")
+			return
+		}
+		if b.re, err = regexp.Compile(pattern); err != nil {
+			err = p.errorf(tok, "invalid regexp %s: %v", pattern, err)
+			return
+		}
+	}
+	n = b
+	return
+}
+
+func (p *exprParser) parseAdditive() (n node, err error) {
+	if n, err = p.parseMultiplicative(); err != nil {
+		return
+	}
+	for {
+		op, ok := p.accept("+", "-")
+		if !ok {
+			return
+		}
+		var y node
+		if y, err = p.parseMultiplicative(); err != nil {
+			return
+		}
+		n = binary{op: op, x: n, y: y}
+	}
+}
+
+func (p *exprParser) parseMultiplicative() (n node, err error) {
+	if n, err = p.parseUnary(); err != nil {
+		return
+	}
+	for {
+		op, ok := p.accept("*", "/", "%")
+		if !ok {
+			return
+		}
+		var y node
+		if y, err = p.parseUnary(); err != nil {
+			return
+		}
+		n = binary{op: op, x: n, y: y}
+	}
+}
+
+func (p *exprParser) parseUnary() (n node, err error) {
+	op, ok := p.accept("!", "not", "-")
+	if !ok {
+		return p.parsePrimary()
+	}
+	if n, err = p.parseUnary(); err != nil {
+		return
+	}
+	if op == "not" {
+		op = "!"
+	}
+	n = unary{op: op, x: n}
+	return
+}
+
+func (p *exprParser) parsePrimary() (n node, err error) {
+	tok := p.peek()
+	p.next++
+	switch tok.kind {
+	case tokNumber:
+		var f float64
+		if f, err = strconv.ParseFloat(tok.text, 64); err != nil {
+			err = p.errorf(tok, "invalid number %s", tok.text)
+			return
+		}
+		n = literal{f}
+	case tokString:
+		n = literal{tok.text}
+	case tokQuoted:
+		n = field{tok.text}
+	case tokIdent:
+		switch tok.text {
+		case "true":
+			n = literal{true}
+		case "false":
+			n = literal{false}
+		case "null", "nil":
+			n = literal{nil}
+		case "and", "or", "not", "in", "contains", "startsWith", "endsWith", "matches":
+			err = p.errorf(tok, "unexpected %s", tok.text)
+		default:
+			n = field{tok.text}
+		}
+	case tokOp:
+		switch tok.text {
+		case "(":
+			if n, err = p.parseOr(); err != nil {
+				return
+			}
+			err = p.expect(")")
+		case "[":
+			elems := list{}
+			for {
+				if _, ok := p.accept("]"); ok {
+					break
+				}
+				if len(elems) != 0 {
+					if err = p.expect(","); err != nil {
+						return
+					}
+				}
+				var e node
+				if e, err = p.parseOr(); err != nil {
+					return
+				}
+				elems = append(elems, e)
+			}
+			n = elems
+		default:
+			err = p.errorf(tok, "unexpected %s", tok.text)
+		}
+	default:
+		err = p.errorf(tok, "unexpected end")
+	}
+	return
+}
@@ -0,0 +1,128 @@
+package filter
+
+import (
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type mapFields map[string]string
+
+func (m mapFields) GetString(key string, nullable bool) (val interface{}) {
+	if v, ok := m[key]; ok {
+		return v
+	}
+	return
+}
+
+func TestFilter(t *testing.T) {
+	row := mapFields{"response": "404", "bytes": "2048", "method": "GET", "path": "/api/v1/users", "bot": "false",
+		"req.host": "example.com", "x-forwarded-for": "10.0.0.1", "rtt": "0.25", "min_rtt": "0.1"}
+	testCases := []struct {
+		expr  string
+		match bool
+	}{
+		{`response != "200" && bytes > 1024`, true},
+		{`response == 404`, true},
+		{`response == "200" || bytes > 4096`, false},
+		{`bytes >= 2048 and bytes <= 2048`, true},
+		{`bytes / 1024 == 2`, true},
+		{`-bytes < -1000 && bytes % 1000 == 48`, true},
+		{`rtt > min_rtt`, true},
+		{`method in ["GET", "HEAD"]`, true},
+		{`response not in [200, 304]`, true},
+		{`path startsWith "/api/" && path endsWith "users" && path contains "v1"`, true},
+		{`path matches '^/api/v[0-9]+/'`, true},
+		{`!bot && not (method == "POST")`, true},
+		{`bot == false`, true},
+		{`req.host == 'example.com' && ` + "`x-forwarded-for`" + ` startsWith "10."`, true},
+		{`absent == null && absent != 1`, true},
+		{`absent > 0 || absent contains ""`, false},
+		{`method + path == "GET/api/v1/users"`, true},
+		{`1 + 2 * 3 == 7 && (1 + 2) * 3 == 9`, true},
+	}
+	for _, tc := range testCases {
+		f, err := Compile(tc.expr)
+		require.Nil(t, err, tc.expr)
+		require.Equal(t, tc.match, f.Match(row), tc.expr)
+	}
+
+	for _, expr := range []string{
+		`bytes >`,
+		`(bytes > 1`,
+		`method in "GET"`,
+		`path matches path`,
+		`path matches "("`,
+		`response == "200`,
+		`bytes > 1 1`,
+		`bytes # 1`,
+	} {
+		_, err := Compile(expr)
+		require.NotNil(t, err, expr)
+	}
+}
+
+func TestSampler(t *testing.T) {
+	s := NewSampler(10, "user")
+	var kept int
+	for i := 0; i < 10000; i++ {
+		row := mapFields{"user": fmt.Sprintf("user%d", i)}
+		keep := s.Keep(row)
+		if keep {
+			kept++
+		}
+		// consistent for the same user
+		require.Equal(t, keep, s.Keep(row))
+	}
+	require.InDelta(t, 1000, kept, 200)
+
+	kept = 0
+	s = NewSampler(25, "")
+	for i := 0; i < 10000; i++ {
+		if s.Keep(mapFields{}) {
+			kept++
+		}
+	}
+	require.InDelta(t, 2500, kept, 300)
+	require.False(t, NewSampler(0, "user").Keep(mapFields{"user": "a"}))
+	require.True(t, NewSampler(100, "user").Keep(mapFields{"user": "a"}))
+}
+
+func TestDeduper(t *testing.T) {
+	d := NewDeduper([]string{"id", "ts"}, time.Hour, 1000)
+	require.False(t, d.Duplicated(mapFields{"id": "1", "ts": "10"}, []byte(`a`)))
+	require.True(t, d.Duplicated(mapFields{"id": "1", "ts": "10"}, []byte(`b`)))
+	require.False(t, d.Duplicated(mapFields{"id": "1", "ts": "11"}, []byte(`a`)))
+	require.False(t, d.Duplicated(mapFields{"id": "110"}, nil))
+	require.False(t, d.Duplicated(mapFields{"id": "1", "ts": "10x"}, nil))
+
+	// the whole message
+	d = NewDeduper(nil, time.Hour, 1000)
+	require.False(t, d.Duplicated(mapFields{}, []byte(`{"id":1}`)))
+	require.True(t, d.Duplicated(mapFields{}, []byte(`{"id":1}`)))
+	require.False(t, d.Duplicated(mapFields{}, []byte(`{"id":2}`)))
+
+	// keys expire
+	d = NewDeduper(nil, 10*time.Millisecond, 1000)
+	require.False(t, d.Duplicated(nil, []byte(`a`)))
+	time.Sleep(20 * time.Millisecond)
+	require.False(t, d.Duplicated(nil, []byte(`a`)))
+	require.True(t, d.Duplicated(nil, []byte(`a`)))
+
+	// the oldest keys are forgotten beyond the limit
+	d = NewDeduper(nil, time.Hour, 16*10)
+	for i := 0; i < 10000; i++ {
+		d.Duplicated(nil, []byte(strconv.Itoa(i)))
+	}
+	var keys int
+	for i := range d.shards {
+		keys += len(d.shards[i].seen)
+		require.LessOrEqual(t, len(d.shards[i].seen), 10)
+	}
+	require.Greater(t, keys, 100)
+	require.False(t, d.Duplicated(nil, []byte("0")))
+	require.True(t, d.Duplicated(nil, []byte("9999")))
+}
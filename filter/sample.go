@@ -0,0 +1,33 @@
+package filter
+
+import (
+	"fmt"
+	"math/rand"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// sampleScale is the resolution of sampling, 0.01%.
+const sampleScale = 10000
+
+// Sampler keeps a percent of rows, which is safe for concurrent use.
+type Sampler struct {
+	threshold uint64
+	key       string
+}
+
+// NewSampler keeps percent(0 to 100) of rows. If key is given, rows are sampled by the hash of the key field, so that
+// rows of the same value are consistently kept or dropped. Rows without the key field are sampled randomly.
+func NewSampler(percent float64, key string) *Sampler {
+	return &Sampler{threshold: uint64(percent * sampleScale / 100), key: key}
+}
+
+// Keep tells whether the row of the fields is sampled in.
+func (s *Sampler) Keep(fields Fields) bool {
+	if s.key != "" {
+		if v := fields.GetString(s.key, true); v != nil {
+			return xxhash.Sum64String(fmt.Sprint(v))%sampleScale < s.threshold
+		}
+	}
+	return uint64(rand.Int63n(sampleScale)) < s.threshold
+}
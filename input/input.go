@@ -14,6 +14,11 @@ const (
 	TypePulsar      = "pulsar"
 )
 
+const (
+	defaultFetchMaxBytes = 100 * 1024 * 1024
+	minFetchMaxBytes     = 4 * 1024 * 1024
+)
+
 type Inputer interface {
 	Init(cfg *config.Config, taskCfg *config.TaskConfig, putFn func(msg *model.InputMessage), cleanupFn func()) error
 	Run()
@@ -32,3 +37,16 @@ func NewInputer(typ string) Inputer {
 		return nil
 	}
 }
+
+// fetchMaxBytes is the max size of a fetch response. It's at most 1/16 of the memory limit of the container, since
+// every task fetches on its own, and fetched messages stay in memory until written.
+func fetchMaxBytes() int {
+	maxBytes := int64(defaultFetchMaxBytes)
+	if mem := util.MemoryLimit() / 16; mem > 0 && mem < maxBytes {
+		maxBytes = mem
+		if maxBytes < minFetchMaxBytes {
+			maxBytes = minFetchMaxBytes
+		}
+	}
+	return int(maxBytes)
+}
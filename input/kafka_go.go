@@ -72,7 +72,7 @@ func (k *KafkaGo) Init(cfg *config.Config, taskCfg *config.TaskConfig, putFn fun
 		Topic:          k.taskCfg.Topic,
 		StartOffset:    offset,
 		MinBytes:       1024 * 1024,                           // sarama.Config.Consumer.Fetch.Min
-		MaxBytes:       100 * 1024 * 1024,                     // sarama.Config.MaxResponseSize
+		MaxBytes:       fetchMaxBytes(),                       // sarama.Config.MaxResponseSize
 		MaxWait:        time.Duration(100) * time.Millisecond, // sarama.Config.Consumer.MaxWaitTime
 		CommitInterval: time.Second,                           // sarama.Config.Consumer.Offsets.AutoCommit.Interval
 		// PartitionWatchInterval is only used when GroupID is set and WatchPartitionChanges is set.
@@ -92,7 +92,7 @@ func (k *KafkaGo) Init(cfg *config.Config, taskCfg *config.TaskConfig, putFn fun
 	var dialer *kafka.Dialer
 	if kfkCfg.TLS.Enable {
 		var tlsConfig *tls.Config
-		if tlsConfig, err = util.NewTLSConfig(kfkCfg.TLS.CaCertFiles, kfkCfg.TLS.ClientCertFile, kfkCfg.TLS.ClientKeyFile, kfkCfg.TLS.EndpIdentAlgo == ""); err != nil {
+		if tlsConfig, err = util.NewTLSConfig(kfkCfg.TLS.CaCertFiles, kfkCfg.TLS.ClientCertFile, kfkCfg.TLS.ClientKeyFile, kfkCfg.TLS.ClientKeyPassword, kfkCfg.TLS.EndpIdentAlgo == ""); err != nil {
 			return
 		}
 		dialer = &kafka.Dialer{
@@ -153,14 +153,26 @@ LOOP_KAFKA_GO:
 				continue
 			}
 		}
-		k.putFn(&model.InputMessage{
+		inputMsg := &model.InputMessage{
 			Topic:     msg.Topic,
 			Partition: msg.Partition,
 			Key:       msg.Key,
 			Value:     msg.Value,
 			Offset:    msg.Offset,
 			Timestamp: &msg.Time,
-		})
+		}
+		if len(msg.Headers) != 0 && util.TracingEnabled() {
+			headers := msg.Headers
+			inputMsg.TraceCtx = util.ExtractTraceContext(func(key string) string {
+				for _, h := range headers {
+					if h.Key == key {
+						return string(h.Value)
+					}
+				}
+				return ""
+			})
+		}
+		k.putFn(inputMsg)
 	}
 }
 
@@ -19,7 +19,6 @@ import (
 	"context"
 	"crypto/sha256"
 	"crypto/sha512"
-	"fmt"
 	"github.com/tidwall/gjson"
 	"github.com/tidwall/sjson"
 	"hash"
@@ -29,7 +28,7 @@ import (
 
 	"github.com/Shopify/sarama"
 	"github.com/forever765/clickhouse_sinker_nali/config"
-	"github.com/forever765/clickhouse_sinker_nali/ipHandle/entity"
+	"github.com/forever765/clickhouse_sinker_nali/enrich"
 	"github.com/forever765/clickhouse_sinker_nali/model"
 	"github.com/forever765/clickhouse_sinker_nali/statistics"
 	"github.com/forever765/clickhouse_sinker_nali/util"
@@ -11576,48 +11575,7 @@ func SearchIP(raw []byte) []byte {
 		var readyResult []byte
 		var err, err2 error
 		ip := gjson.GetBytes(raw, "ip_" + obj)
-		// naliRspRaw example: 192.168.123.1[局域网 对方和您在同一内部网]   or   164.90.236.112[美国 ]
-		naliRspRaw := entity.ParseIP(ip.String()).String()
-		naliRsp_1 := strings.TrimRight(naliRspRaw, "]")
-		// 清理可能存在的 ] 符号
-		naliRsp_2 := strings.TrimRight(naliRsp_1, "]")
-		// PureResult example: ["119.147.3.230","广东省深圳市 腾讯云] "]
-		PureResult := strings.Split(naliRsp_2, "[")
-
-		var PureResultList []string
-		// 提取地理位置，PureResult  --->   [220.166.187.228 四川省资阳市简阳市]
-		if len(PureResult) > 1 {
-			PureResultList = strings.Fields(PureResult[1])
-		}
-
-		var loc = "未知"
-		var isp = "未知"
-		LPR := len(PureResultList)
-		if LPR == 0 {
-			// if nali return null result, default value is "Unknown"
-			//util.Logger.Warn("Nali返回空结果：", zap.Any("结果为：", PureResultList))
-		} else if LPR == 1 {
-			// only have location
-			loc = PureResultList[0]
-		} else if LPR > 1 {
-			// 国外的地名和isp可能有空格，也有可能不存在运营商
-			loc = PureResultList[0]
-			if PureResultList[1] == "]" || PureResultList[1] == " " {
-				isp = PureResultList[0]
-			} else {
-				isp = strings.Join(PureResultList[1:], "")
-			}
-		} else {
-			util.Logger.Warn(fmt.Sprintf("nali return unknown data: %s, 个数：%v", PureResultList, LPR))
-		}
-
-		// 清理可能存在的 ] 符号
-		isp = strings.TrimRight(isp, "]")
-		// Replace 同一内部网 to 局域网
-		if strings.Contains(loc, "同一内部网") || strings.Contains(isp, "同一内部网") {
-			loc = "局域网"
-			isp = "局域网"
-		}
+		loc, isp := enrich.NaliLookup(ip.String())
 
 		// raw example: {"event_type": "purge", "class": "Unknown/TLS", "etype": "800", "ip_src": "101.91.37.19", "ip_dst": "192.168.123.66", "port_src": 443, "port_dst": 8830, "ip_proto": "tcp", "timestamp_min": "2022-01-29 08:20:36.818873", "timestamp_max": "2022-01-29 08:20:37.000000", "stamp_inserted": "2022-01-29 08:15:50", "stamp_updated": "2022-01-29 08:20:41", "packets": 1, "bytes": 40, "writer_id": "default_kafka/16950"}
 		sourceRecord := raw
@@ -11679,14 +11637,26 @@ func (h MyConsumerGroupHandler) ConsumeClaim(sess sarama.ConsumerGroupSession, c
 		if h.k.taskCfg.GeoipHandle {
 			msg.Value = HandleMsg(msg.Value)
 		}
-		h.k.putFn(&model.InputMessage{
+		inputMsg := &model.InputMessage{
 			Topic:     msg.Topic,
 			Partition: int(msg.Partition),
 			Key:       msg.Key,
 			Value:     msg.Value,
 			Offset:    msg.Offset,
 			Timestamp: &msg.Timestamp,
-		})
+		}
+		if len(msg.Headers) != 0 && util.TracingEnabled() {
+			headers := msg.Headers
+			inputMsg.TraceCtx = util.ExtractTraceContext(func(key string) string {
+				for _, h := range headers {
+					if string(h.Key) == key {
+						return string(h.Value)
+					}
+				}
+				return ""
+			})
+		}
+		h.k.putFn(inputMsg)
 	}
 	return nil
 }
@@ -11733,7 +11703,7 @@ func GetSaramaConfig(kfkCfg *config.KafkaConfig) (sarCfg *sarama.Config, err err
 	}
 	if kfkCfg.TLS.Enable {
 		sarCfg.Net.TLS.Enable = true
-		if sarCfg.Net.TLS.Config, err = util.NewTLSConfig(kfkCfg.TLS.CaCertFiles, kfkCfg.TLS.ClientCertFile, kfkCfg.TLS.ClientKeyFile, kfkCfg.TLS.EndpIdentAlgo == ""); err != nil {
+		if sarCfg.Net.TLS.Config, err = util.NewTLSConfig(kfkCfg.TLS.CaCertFiles, kfkCfg.TLS.ClientCertFile, kfkCfg.TLS.ClientKeyFile, kfkCfg.TLS.ClientKeyPassword, kfkCfg.TLS.EndpIdentAlgo == ""); err != nil {
 			return
 		}
 	}
@@ -11756,6 +11726,8 @@ func GetSaramaConfig(kfkCfg *config.KafkaConfig) (sarCfg *sarama.Config, err err
 		sarCfg.Net.SASL.GSSAPI = kfkCfg.Sasl.GSSAPI
 	}
 	sarCfg.ChannelBufferSize = 1024
+	// it's global in sarama, and caps fetch requests as well
+	sarama.MaxResponseSize = int32(fetchMaxBytes())
 	return
 }
 
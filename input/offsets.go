@@ -0,0 +1,171 @@
+package input
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/forever765/clickhouse_sinker_nali/config"
+	"github.com/forever765/clickhouse_sinker_nali/util"
+)
+
+// SeekNone keeps partitions absent in offsets as is, see SeekOffsets.
+const SeekNone = 0
+
+// kafkaRetry retries Kafka admin operations, such as describing topics and groups, listing and committing offsets.
+var kafkaRetry = util.RetryPolicy{
+	MaxAttempts:    3,
+	InitialBackoff: 500 * time.Millisecond,
+	MaxBackoff:     2 * time.Second,
+	Retryable:      kafkaRetryable,
+}
+
+// kafkaRetryable retries errors which Kafka returns during leader elections and coordinator loading, and errors not
+// from Kafka, such as network ones. Other Kafka errors, such as authorization failures, are permanent.
+func kafkaRetryable(err error) bool {
+	var kerr sarama.KError
+	if errors.As(err, &kerr) {
+		switch kerr {
+		case sarama.ErrLeaderNotAvailable, sarama.ErrNotLeaderForPartition, sarama.ErrRequestTimedOut,
+			sarama.ErrNetworkException, sarama.ErrOffsetsLoadInProgress, sarama.ErrConsumerCoordinatorNotAvailable,
+			sarama.ErrNotCoordinatorForConsumer, sarama.ErrNotEnoughReplicas:
+			return true
+		}
+		return false
+	}
+	return util.IsRetryable(err)
+}
+
+// RetryKafka calls fn per kafkaRetry, for Kafka admin operations.
+func RetryKafka(fn func() error) error {
+	return util.Retry(context.Background(), kafkaRetry, func(ctx context.Context) error { return fn() })
+}
+
+// SeekOffsets commits offsets of the consumer group for the topic, so that consumers of the group resume from them.
+// at is where to seek partitions absent in offsets: sarama.OffsetOldest, sarama.OffsetNewest, a timestamp in
+// milliseconds, or SeekNone. The group shall have no active member, which means the task is stopped on all
+// instances, otherwise Kafka rejects the commit.
+func SeekOffsets(kfkCfg *config.KafkaConfig, group, topic string, at int64, offsets map[int32]int64) (committed map[int32]int64, err error) {
+	var sarCfg *sarama.Config
+	if sarCfg, err = GetSaramaConfig(kfkCfg); err != nil {
+		return
+	}
+	var client sarama.Client
+	if client, err = sarama.NewClient(strings.Split(kfkCfg.Brokers, ","), sarCfg); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	defer func() {
+		if err2 := client.Close(); err2 != nil {
+			util.Logger.Error("failed to close Kafka client", zap.Error(err2))
+		}
+	}()
+	var adminClient sarama.ClusterAdmin
+	if adminClient, err = sarama.NewClusterAdminFromClient(client); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	var groups []*sarama.GroupDescription
+	if err = RetryKafka(func() (err error) {
+		groups, err = adminClient.DescribeConsumerGroups([]string{group})
+		return
+	}); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	for _, g := range groups {
+		if len(g.Members) != 0 {
+			err = errors.Errorf("consumer group %s has %d active members, stop the task first", group, len(g.Members))
+			return
+		}
+	}
+
+	var partitions []int32
+	if err = RetryKafka(func() (err error) {
+		partitions, err = client.Partitions(topic)
+		return
+	}); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	committed = make(map[int32]int64)
+	for _, partition := range partitions {
+		offset, ok := offsets[partition]
+		if !ok {
+			if at == SeekNone {
+				continue
+			}
+			if offset, err = GetOffset(client, topic, partition, at); err != nil {
+				err = errors.Wrapf(err, "failed to get offset of %s partition %d", topic, partition)
+				return
+			}
+			if offset < 0 {
+				// No message at or after the timestamp.
+				if offset, err = GetOffset(client, topic, partition, sarama.OffsetNewest); err != nil {
+					err = errors.Wrapf(err, "failed to get offset of %s partition %d", topic, partition)
+					return
+				}
+			}
+		}
+		committed[partition] = offset
+	}
+	for partition := range offsets {
+		if _, ok := committed[partition]; !ok {
+			err = errors.Errorf("topic %s has no partition %d", topic, partition)
+			return
+		}
+	}
+	if len(committed) == 0 {
+		return
+	}
+
+	// Commit as a member of no generation, which is accepted for an empty group.
+	req := &sarama.OffsetCommitRequest{
+		Version:                 2,
+		ConsumerGroup:           group,
+		ConsumerGroupGeneration: -1,
+		RetentionTime:           -1,
+	}
+	for partition, offset := range committed {
+		req.AddBlock(topic, partition, offset, 0, "")
+	}
+	if err = RetryKafka(func() (err error) {
+		var coordinator *sarama.Broker
+		if coordinator, err = client.Coordinator(group); err != nil {
+			return
+		}
+		var resp *sarama.OffsetCommitResponse
+		if resp, err = coordinator.CommitOffset(req); err != nil {
+			// the coordinator may have moved
+			_ = client.RefreshCoordinator(group)
+			return
+		}
+		for partition, kerr := range resp.Errors[topic] {
+			if kerr != sarama.ErrNoError {
+				if kafkaRetryable(kerr) {
+					_ = client.RefreshCoordinator(group)
+				}
+				return errors.Wrapf(kerr, "failed to commit offset of %s partition %d", topic, partition)
+			}
+		}
+		return
+	}); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	util.Logger.Info("committed offsets", zap.String("group", group), zap.String("topic", topic), zap.Reflect("offsets", committed))
+	return
+}
+
+// GetOffset is client.GetOffset retried per kafkaRetry.
+func GetOffset(client sarama.Client, topic string, partition int32, at int64) (offset int64, err error) {
+	err = RetryKafka(func() (err error) {
+		offset, err = client.GetOffset(topic, partition, at)
+		return
+	})
+	return
+}
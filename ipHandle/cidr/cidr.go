@@ -0,0 +1,130 @@
+package cidr
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Table maps CIDR blocks to labels, the longest matching prefix wins.
+type Table struct {
+	// prefix length -> masked network address -> label
+	nets map[int]map[string]string
+	// prefix lengths present in nets, in descending order
+	lens []int
+}
+
+// NewTable creates an empty Table.
+func NewTable() *Table {
+	return &Table{nets: make(map[int]map[string]string)}
+}
+
+// LoadFile reads a mapping file. Each line is a CIDR followed by its label, separated by whitespaces.
+// Empty lines and lines starting with "#" are ignored. A plain IP is treated as a single-host CIDR.
+//
+//	10.0.0.0/8        idc-beijing
+//	192.168.10.0/24   office 3F
+func LoadFile(path string) (t *Table, err error) {
+	var f *os.File
+	if f, err = os.Open(path); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	defer f.Close()
+	return Load(f)
+}
+
+// Load reads mappings in the same format as LoadFile.
+func Load(r io.Reader) (t *Table, err error) {
+	t = NewTable()
+	scanner := bufio.NewScanner(r)
+	var lineNo int
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			err = errors.Errorf("line %d: expect \"<cidr> <label>\", got %q", lineNo, line)
+			return
+		}
+		label := strings.TrimSpace(strings.TrimPrefix(line, fields[0]))
+		if err = t.Add(fields[0], label); err != nil {
+			err = errors.Wrapf(err, "line %d", lineNo)
+			return
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		err = errors.Wrapf(err, "")
+	}
+	return
+}
+
+// Add inserts or replaces the label of a CIDR block.
+func (t *Table) Add(cidr, label string) (err error) {
+	if !strings.Contains(cidr, "/") {
+		if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+			cidr += "/32"
+		} else {
+			cidr += "/128"
+		}
+	}
+	var ipNet *net.IPNet
+	if _, ipNet, err = net.ParseCIDR(cidr); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	ones, bits := ipNet.Mask.Size()
+	// distinguish IPv4 and IPv6 prefixes of the same length
+	plen := ones
+	if bits == 128 {
+		plen += 128
+	}
+	m, ok := t.nets[plen]
+	if !ok {
+		m = make(map[string]string)
+		t.nets[plen] = m
+		t.lens = append(t.lens, plen)
+		sort.Sort(sort.Reverse(sort.IntSlice(t.lens)))
+	}
+	m[string(ipNet.IP)] = label
+	return
+}
+
+// Lookup returns the label of the most specific CIDR block containing ip.
+func (t *Table) Lookup(ip string) (label string, ok bool) {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return
+	}
+	bits, offset := 128, 128
+	if ip4 := parsed.To4(); ip4 != nil {
+		parsed, bits, offset = ip4, 32, 0
+	}
+	for _, plen := range t.lens {
+		ones := plen - offset
+		if ones < 0 || ones > bits {
+			continue
+		}
+		masked := parsed.Mask(net.CIDRMask(ones, bits))
+		if label, ok = t.nets[plen][string(masked)]; ok {
+			return
+		}
+	}
+	return
+}
+
+// Len returns the number of CIDR blocks.
+func (t *Table) Len() (n int) {
+	for _, m := range t.nets {
+		n += len(m)
+	}
+	return
+}
@@ -0,0 +1,49 @@
+package cidr
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLookup(t *testing.T) {
+	table, err := Load(strings.NewReader(`
+# internal networks
+10.0.0.0/8          idc
+10.1.0.0/16         idc-beijing
+192.168.10.0/24     office 3F
+172.16.1.1          vpn-gateway
+fd00::/8            idc-v6
+`))
+	require.Nil(t, err)
+	require.Equal(t, 5, table.Len())
+
+	testCases := []struct {
+		ip    string
+		label string
+		ok    bool
+	}{
+		{"10.2.3.4", "idc", true},
+		{"10.1.3.4", "idc-beijing", true},
+		{"192.168.10.254", "office 3F", true},
+		{"192.168.11.1", "", false},
+		{"172.16.1.1", "vpn-gateway", true},
+		{"172.16.1.2", "", false},
+		{"fd00::1", "idc-v6", true},
+		{"8.8.8.8", "", false},
+		{"not-an-ip", "", false},
+	}
+	for _, tc := range testCases {
+		label, ok := table.Lookup(tc.ip)
+		require.Equal(t, tc.ok, ok, tc.ip)
+		require.Equal(t, tc.label, label, tc.ip)
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	_, err := Load(strings.NewReader("10.0.0.0/33 bad"))
+	require.NotNil(t, err)
+	_, err = Load(strings.NewReader("10.0.0.0/8"))
+	require.NotNil(t, err)
+}
@@ -1,6 +1,29 @@
 package db
 
-import "github.com/forever765/clickhouse_sinker_nali/ipHandle/pkg/dbif"
+import (
+	"sync"
+	"sync/atomic"
 
+	"github.com/forever765/clickhouse_sinker_nali/ipHandle/pkg/dbif"
+)
+
+// dbMux protects dbCache, since lookups may come from multiple goroutines
+var dbMux sync.Mutex
+
+// dbVersion increases on every Reload
+var dbVersion uint64
 var dbCache = make(map[dbif.QueryType]dbif.DB)
 var queryCache = make(map[string]string)
+
+// Reload drops opened databases, so that the next lookup opens the database files again.
+func Reload() {
+	dbMux.Lock()
+	dbCache = make(map[dbif.QueryType]dbif.DB)
+	dbMux.Unlock()
+	atomic.AddUint64(&dbVersion, 1)
+}
+
+// Version returns the number of times Reload has been called. Callers which open database files themselves compare it to decide whether to reopen.
+func Version() uint64 {
+	return atomic.LoadUint64(&dbVersion)
+}
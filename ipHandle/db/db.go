@@ -44,6 +44,8 @@ func init() {
 }
 
 func GetDB(typ dbif.QueryType) (db dbif.DB) {
+	dbMux.Lock()
+	defer dbMux.Unlock()
 	if db, found := dbCache[typ]; found {
 		return db
 	}
@@ -0,0 +1,131 @@
+package rdns
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxCacheEntries bounds the memory used by the cache. Expired entries are purged when it's reached.
+const maxCacheEntries = 1 << 16
+
+// breakerThreshold is the number of lookups failed in a row, after which lookups are skipped for failureTTL.
+const breakerThreshold = 8
+
+type cacheEntry struct {
+	host     string
+	expireAt time.Time
+}
+
+// Resolver resolves IP addresses to host names via PTR lookups.
+// Lookups are bounded by a semaphore and a per-lookup timeout. Results(including "not found") are cached for ttl, and
+// failures such as timeouts for failureTTL. Once breakerThreshold lookups failed in a row, all lookups are skipped for
+// failureTTL, so that callers don't wait for the timeout per IP while the DNS server is down.
+type Resolver struct {
+	// keep 64-bit counters at the beginning for atomic alignment
+	hits      uint64
+	misses    uint64
+	openUntil int64 // unix nanoseconds until which lookups are skipped
+
+	lookupAddr func(ctx context.Context, addr string) ([]string, error)
+	timeout    time.Duration
+	ttl        time.Duration
+	failureTTL time.Duration
+	sem        chan struct{}
+	failures   int32 // lookups failed in a row
+
+	mux   sync.RWMutex
+	cache map[string]cacheEntry
+}
+
+// NewResolver creates a Resolver. concurrency is the max number of in-flight lookups.
+func NewResolver(timeout, ttl, failureTTL time.Duration, concurrency int) *Resolver {
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	return &Resolver{
+		lookupAddr: net.DefaultResolver.LookupAddr,
+		timeout:    timeout,
+		ttl:        ttl,
+		failureTTL: failureTTL,
+		sem:        make(chan struct{}, concurrency),
+		cache:      make(map[string]cacheEntry),
+	}
+}
+
+// Lookup returns the host name of ip, or "" if it's unknown or the lookup doesn't finish in time.
+func (r *Resolver) Lookup(ip string) (host string) {
+	if net.ParseIP(ip) == nil {
+		return
+	}
+	now := time.Now()
+	r.mux.RLock()
+	entry, ok := r.cache[ip]
+	r.mux.RUnlock()
+	if ok && now.Before(entry.expireAt) {
+		atomic.AddUint64(&r.hits, 1)
+		return entry.host
+	}
+	atomic.AddUint64(&r.misses, 1)
+	if now.UnixNano() < atomic.LoadInt64(&r.openUntil) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+	// Waiting for a free slot is also limited by the timeout, so that a slow DNS server can't stall callers.
+	select {
+	case r.sem <- struct{}{}:
+	case <-ctx.Done():
+		r.fail(ip, now)
+		return
+	}
+	names, err := r.lookupAddr(ctx, ip)
+	<-r.sem
+	if err != nil {
+		if dnsErr, ok := err.(*net.DNSError); !ok || !dnsErr.IsNotFound {
+			r.fail(ip, now)
+			return
+		}
+	} else if len(names) > 0 {
+		host = strings.TrimSuffix(names[0], ".")
+	}
+	atomic.StoreInt32(&r.failures, 0)
+	r.put(ip, host, now.Add(r.ttl))
+	return
+}
+
+// fail caches the failed lookup of ip for failureTTL, and opens the breaker once breakerThreshold lookups failed in a
+// row.
+func (r *Resolver) fail(ip string, now time.Time) {
+	r.put(ip, "", now.Add(r.failureTTL))
+	if atomic.AddInt32(&r.failures, 1) >= breakerThreshold {
+		atomic.StoreInt32(&r.failures, 0)
+		atomic.StoreInt64(&r.openUntil, now.Add(r.failureTTL).UnixNano())
+	}
+}
+
+func (r *Resolver) put(ip, host string, expireAt time.Time) {
+	now := time.Now()
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if len(r.cache) >= maxCacheEntries {
+		for k, v := range r.cache {
+			if now.After(v.expireAt) {
+				delete(r.cache, k)
+			}
+		}
+		if len(r.cache) >= maxCacheEntries {
+			r.cache = make(map[string]cacheEntry)
+		}
+	}
+	r.cache[ip] = cacheEntry{host: host, expireAt: expireAt}
+}
+
+// Stats returns the number of cache hits and misses.
+func (r *Resolver) Stats() (hits, misses uint64) {
+	return atomic.LoadUint64(&r.hits), atomic.LoadUint64(&r.misses)
+}
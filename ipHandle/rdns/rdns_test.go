@@ -0,0 +1,142 @@
+package rdns
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// newTestResolver returns a resolver whose lookups are answered by lookup, and counts them.
+func newTestResolver(timeout time.Duration, concurrency int, lookup func(ctx context.Context, addr string) ([]string, error)) (r *Resolver, calls *int32) {
+	calls = new(int32)
+	r = NewResolver(timeout, time.Hour, time.Minute, concurrency)
+	r.lookupAddr = func(ctx context.Context, addr string) ([]string, error) {
+		atomic.AddInt32(calls, 1)
+		return lookup(ctx, addr)
+	}
+	return
+}
+
+func TestLookupCache(t *testing.T) {
+	r, calls := newTestResolver(time.Second, 1, func(_ context.Context, addr string) ([]string, error) {
+		if addr == "10.0.0.1" {
+			return []string{"host1.example.com."}, nil
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: addr, IsNotFound: true}
+	})
+	require.Equal(t, "host1.example.com", r.Lookup("10.0.0.1"))
+	require.Equal(t, "host1.example.com", r.Lookup("10.0.0.1"))
+	// "not found" is cached as well
+	require.Equal(t, "", r.Lookup("10.0.0.2"))
+	require.Equal(t, "", r.Lookup("10.0.0.2"))
+	require.Equal(t, "", r.Lookup("not-an-ip"))
+	require.EqualValues(t, 2, atomic.LoadInt32(calls))
+	hits, misses := r.Stats()
+	require.EqualValues(t, 2, hits)
+	require.EqualValues(t, 2, misses)
+
+	// entries expire
+	r.put("10.0.0.1", "stale", time.Now().Add(-time.Second))
+	require.Equal(t, "host1.example.com", r.Lookup("10.0.0.1"))
+	require.EqualValues(t, 3, atomic.LoadInt32(calls))
+}
+
+func TestLookupFailure(t *testing.T) {
+	var fail int32 = 1
+	r, calls := newTestResolver(time.Second, 1, func(_ context.Context, addr string) ([]string, error) {
+		if atomic.LoadInt32(&fail) != 0 {
+			return nil, errors.New("server misbehaving")
+		}
+		return []string{"host.example.com."}, nil
+	})
+	// a failure is cached for failureTTL
+	require.Equal(t, "", r.Lookup("10.0.0.1"))
+	require.Equal(t, "", r.Lookup("10.0.0.1"))
+	require.EqualValues(t, 1, atomic.LoadInt32(calls))
+	r.mux.RLock()
+	entry := r.cache["10.0.0.1"]
+	r.mux.RUnlock()
+	require.True(t, entry.expireAt.Before(time.Now().Add(r.failureTTL+time.Second)))
+
+	// a success resets failures in a row
+	atomic.StoreInt32(&fail, 0)
+	require.Equal(t, "host.example.com", r.Lookup("10.0.0.2"))
+	require.EqualValues(t, 0, atomic.LoadInt32(&r.failures))
+}
+
+func TestLookupBreaker(t *testing.T) {
+	r, calls := newTestResolver(time.Second, 1, func(_ context.Context, addr string) ([]string, error) {
+		return nil, errors.New("server misbehaving")
+	})
+	ips := []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4", "10.0.0.5", "10.0.0.6", "10.0.0.7", "10.0.0.8", "10.0.0.9"}
+	require.Len(t, ips, breakerThreshold+1)
+	for _, ip := range ips[:breakerThreshold] {
+		require.Equal(t, "", r.Lookup(ip))
+	}
+	require.EqualValues(t, breakerThreshold, atomic.LoadInt32(calls))
+	// the breaker is open, lookups of other IPs are skipped as well
+	require.Equal(t, "", r.Lookup(ips[breakerThreshold]))
+	require.EqualValues(t, breakerThreshold, atomic.LoadInt32(calls))
+
+	atomic.StoreInt64(&r.openUntil, 0)
+	require.Equal(t, "", r.Lookup(ips[breakerThreshold]))
+	require.EqualValues(t, breakerThreshold+1, atomic.LoadInt32(calls))
+}
+
+func TestLookupConcurrency(t *testing.T) {
+	const concurrency = 2
+	var inflight, maxInflight int32
+	release := make(chan struct{})
+	r, _ := newTestResolver(time.Second, concurrency, func(ctx context.Context, addr string) ([]string, error) {
+		n := atomic.AddInt32(&inflight, 1)
+		defer atomic.AddInt32(&inflight, -1)
+		for {
+			old := atomic.LoadInt32(&maxInflight)
+			if n <= old || atomic.CompareAndSwapInt32(&maxInflight, old, n) {
+				break
+			}
+		}
+		select {
+		case <-release:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		return []string{addr + ".example.com"}, nil
+	})
+	var wg sync.WaitGroup
+	ips := []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4"}
+	for _, ip := range ips {
+		wg.Add(1)
+		go func(ip string) {
+			defer wg.Done()
+			require.Equal(t, ip+".example.com", r.Lookup(ip))
+		}(ip)
+	}
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&inflight) == concurrency }, time.Second, time.Millisecond)
+	close(release)
+	wg.Wait()
+	require.EqualValues(t, concurrency, atomic.LoadInt32(&maxInflight))
+}
+
+func TestLookupSlotTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	r, calls := newTestResolver(50*time.Millisecond, 1, func(ctx context.Context, addr string) ([]string, error) {
+		<-release
+		return nil, ctx.Err()
+	})
+	go r.Lookup("10.0.0.1")
+	require.Eventually(t, func() bool { return atomic.LoadInt32(calls) == 1 }, time.Second, time.Millisecond)
+	// waiting for the busy slot times out, and counts as a failure
+	begin := time.Now()
+	require.Equal(t, "", r.Lookup("10.0.0.2"))
+	require.Less(t, int64(time.Since(begin)), int64(time.Second))
+	require.EqualValues(t, 1, atomic.LoadInt32(&r.failures))
+	require.EqualValues(t, 1, atomic.LoadInt32(calls))
+}
@@ -0,0 +1,210 @@
+package updater
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/robfig/cron/v3"
+	"go.uber.org/zap"
+
+	"github.com/forever765/clickhouse_sinker_nali/config"
+	"github.com/forever765/clickhouse_sinker_nali/ipHandle/constant"
+	"github.com/forever765/clickhouse_sinker_nali/ipHandle/db"
+	"github.com/forever765/clickhouse_sinker_nali/util"
+)
+
+var httpClient = &http.Client{Timeout: 10 * time.Minute}
+
+// Updater downloads geo databases on a cron, and reloads them once any of them changed.
+type Updater struct {
+	cfg  config.GeoipUpdateConfig
+	cron *cron.Cron
+}
+
+func NewUpdater(cfg config.GeoipUpdateConfig) *Updater {
+	return &Updater{cfg: cfg}
+}
+
+// Start schedules updates. It's a no-op if cron spec is empty.
+func (u *Updater) Start() (err error) {
+	if u.cfg.Cron == "" || len(u.cfg.Databases) == 0 {
+		return
+	}
+	u.cron = cron.New()
+	if _, err = u.cron.AddFunc(u.cfg.Cron, u.UpdateAll); err != nil {
+		err = errors.Wrapf(err, "invalid cron spec %s", u.cfg.Cron)
+		return
+	}
+	u.cron.Start()
+	util.Logger.Info("scheduled geo database updates", zap.String("cron", u.cfg.Cron), zap.Int("databases", len(u.cfg.Databases)))
+	return
+}
+
+// Stop cancels scheduled updates and waits for the running one.
+func (u *Updater) Stop() {
+	if u.cron != nil {
+		<-u.cron.Stop().Done()
+		u.cron = nil
+	}
+}
+
+// UpdateAll downloads all databases, and reloads them if any one changed.
+func (u *Updater) UpdateAll() {
+	var changed bool
+	for _, dbCfg := range u.cfg.Databases {
+		begin := time.Now()
+		ok, err := Update(dbCfg)
+		if err != nil {
+			util.Logger.Error("failed to update geo database", zap.String("file", dbCfg.File), zap.Error(err))
+			continue
+		}
+		util.Logger.Info("checked geo database", zap.String("file", dbCfg.File), zap.Bool("changed", ok), zap.Duration("cost", time.Since(begin)))
+		changed = changed || ok
+	}
+	if changed {
+		db.Reload()
+		util.Logger.Info("reloaded geo databases")
+	}
+}
+
+// Update downloads a database, verifies its checksum, and replaces the local file if the content differs.
+func Update(dbCfg config.GeoipDatabase) (changed bool, err error) {
+	var body []byte
+	if body, err = fetch(dbCfg.URL, dbCfg); err != nil {
+		return
+	}
+	if err = verify(body, dbCfg); err != nil {
+		return
+	}
+	var data []byte
+	if data, err = extract(body, dbCfg); err != nil {
+		return
+	}
+
+	path := filepath.Join(constant.HomePath, dbCfg.File)
+	if old, err2 := ioutil.ReadFile(path); err2 == nil && bytes.Equal(old, data) {
+		return
+	}
+	// Write to a temp file at the same directory, and rename it to make the replacement atomic.
+	var f *os.File
+	if f, err = ioutil.TempFile(constant.HomePath, dbCfg.File+".*"); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	defer os.Remove(f.Name())
+	if _, err = f.Write(data); err != nil {
+		f.Close()
+		err = errors.Wrapf(err, "")
+		return
+	}
+	if err = f.Close(); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	if err = os.Chmod(f.Name(), 0644); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	if err = os.Rename(f.Name(), path); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	changed = true
+	return
+}
+
+func fetch(url string, dbCfg config.GeoipDatabase) (body []byte, err error) {
+	var req *http.Request
+	if req, err = http.NewRequest(http.MethodGet, url, nil); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	if dbCfg.Username != "" {
+		req.SetBasicAuth(dbCfg.Username, dbCfg.Password)
+	}
+	for k, v := range dbCfg.Headers {
+		req.Header.Set(k, v)
+	}
+	var resp *http.Response
+	if resp, err = httpClient.Do(req); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		err = errors.Errorf("GET %s: %s", url, resp.Status)
+		return
+	}
+	if body, err = ioutil.ReadAll(resp.Body); err != nil {
+		err = errors.Wrapf(err, "")
+	}
+	return
+}
+
+func verify(body []byte, dbCfg config.GeoipDatabase) (err error) {
+	expected := dbCfg.SHA256
+	if expected == "" && dbCfg.ChecksumURL != "" {
+		var sum []byte
+		if sum, err = fetch(dbCfg.ChecksumURL, dbCfg); err != nil {
+			return
+		}
+		if fields := strings.Fields(string(sum)); len(fields) != 0 {
+			expected = fields[0]
+		}
+	}
+	if expected == "" {
+		return
+	}
+	actual := sha256.Sum256(body)
+	if !strings.EqualFold(expected, hex.EncodeToString(actual[:])) {
+		err = errors.Errorf("checksum mismatch of %s, expect %s, got %s", dbCfg.URL, expected, hex.EncodeToString(actual[:]))
+	}
+	return
+}
+
+func extract(body []byte, dbCfg config.GeoipDatabase) (data []byte, err error) {
+	if dbCfg.Format == "" {
+		return body, nil
+	}
+	var zr *gzip.Reader
+	if zr, err = gzip.NewReader(bytes.NewReader(body)); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	defer zr.Close()
+	if dbCfg.Format == "gzip" {
+		if data, err = ioutil.ReadAll(zr); err != nil {
+			err = errors.Wrapf(err, "")
+		}
+		return
+	}
+	tr := tar.NewReader(zr)
+	for {
+		var hdr *tar.Header
+		if hdr, err = tr.Next(); err != nil {
+			if err == io.EOF {
+				err = errors.Errorf("%s not found in %s", dbCfg.File, dbCfg.URL)
+			} else {
+				err = errors.Wrapf(err, "")
+			}
+			return
+		}
+		if hdr.Typeflag == tar.TypeReg && filepath.Base(hdr.Name) == dbCfg.File {
+			if data, err = ioutil.ReadAll(tr); err != nil {
+				err = errors.Wrapf(err, "")
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package updater
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/forever765/clickhouse_sinker_nali/config"
+)
+
+func TestExtractAndVerify(t *testing.T) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(zw)
+	for name, content := range map[string]string{
+		"GeoLite2-City_20220301/LICENSE.txt":        "license",
+		"GeoLite2-City_20220301/GeoLite2-City.mmdb": "mmdb content",
+	} {
+		require.Nil(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}))
+		_, err := tw.Write([]byte(content))
+		require.Nil(t, err)
+	}
+	require.Nil(t, tw.Close())
+	require.Nil(t, zw.Close())
+	body := buf.Bytes()
+	sum := sha256.Sum256(body)
+
+	dbCfg := config.GeoipDatabase{File: "GeoLite2-City.mmdb", Format: "tar.gz", SHA256: hex.EncodeToString(sum[:])}
+	require.Nil(t, verify(body, dbCfg))
+	data, err := extract(body, dbCfg)
+	require.Nil(t, err)
+	require.Equal(t, "mmdb content", string(data))
+
+	dbCfg.SHA256 = "0000"
+	require.NotNil(t, verify(body, dbCfg))
+	dbCfg.File = "absent.mmdb"
+	_, err = extract(body, dbCfg)
+	require.NotNil(t, err)
+}
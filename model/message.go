@@ -12,11 +12,14 @@ import (
 	"github.com/cespare/xxhash/v2"
 	"github.com/forever765/clickhouse_sinker_nali/config"
 	"github.com/forever765/clickhouse_sinker_nali/statistics"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var (
-	rowsPool sync.Pool
-	FakedRow Row = make([]interface{}, 0)
+	rowsPool  sync.Pool
+	colsPool  sync.Pool
+	batchPool sync.Pool
+	FakedRow  Row = make([]interface{}, 0)
 )
 
 // MsgWithMeta abstract messages
@@ -28,22 +31,38 @@ type InputMessage struct {
 	Value     []byte
 	Offset    int64
 	Timestamp *time.Time
+	TraceCtx  trace.SpanContext // from message headers, only extracted if tracing is enabled
+	Span      trace.Span        // nil unless the message is traced
 }
 
 type Row []interface{}
 type Rows []*Row
 
+// Columns holds values of rows column by column, the layout in which the native protocol of ClickHouse takes them.
+// Batches of tables which can be written column by column are assembled into Columns, so that they aren't transposed
+// at writing.
+type Columns struct {
+	Vals [][]interface{} // of each column
+	Len  int             // number of rows
+}
+
 type MsgRow struct {
 	Msg   *InputMessage
 	Row   *Row
+	Extra []*Row // rows besides Row if the message is exploded, which go to the shard of Row
 	Shard int
 }
 
 type Batch struct {
 	Rows     *Rows
+	Cols     *Columns // rows are appended here instead of Rows if it's set, see Columns
+	LateRows *Rows    // rows routed to the late table, see config.LateDataConfig
 	BatchIdx int64
 	RealSize int
+	Bytes    int // total size of message values, including ones failed to parse
 	Group    *BatchGroup
+	// Timestamps are unix milliseconds of Kafka records of Rows, for measuring end-to-end latency. 0 means unknown.
+	Timestamps []int64
 }
 
 //BatchGroup consists of multiple batches.
@@ -53,20 +72,37 @@ type BatchGroup struct {
 	Batchs    []*Batch
 	Offsets   map[int]int64
 	Sys       *BatchSys
-	PendWrite int32 //how many batches in this group are pending to wirte to ClickHouse
+	PendWrite int32        //how many batches in this group are pending to wirte to ClickHouse
+	Spans     []trace.Span // spans of traced messages, ended once the group is committed
 }
 
 type BatchSys struct {
-	taskCfg  *config.TaskConfig
-	mux      sync.Mutex
-	groups   list.List
-	fnCommit func(partition int, offset int64) error
+	taskCfg   *config.TaskConfig
+	mux       sync.Mutex
+	groups    list.List
+	fnCommit  func(partition int, offset int64) error
+	committed map[int]int64 // the last committed offset of each partition
 }
 
 func NewBatchSys(taskCfg *config.TaskConfig, fnCommit func(partition int, offset int64) error) *BatchSys {
 	return &BatchSys{taskCfg: taskCfg, fnCommit: fnCommit}
 }
 
+// Committed returns the last offset committed for the partition.
+func (bs *BatchSys) Committed(partition int) (offset int64, ok bool) {
+	bs.mux.Lock()
+	defer bs.mux.Unlock()
+	offset, ok = bs.committed[partition]
+	return
+}
+
+// Pending returns the number of batch groups which haven't been committed.
+func (bs *BatchSys) Pending() int {
+	bs.mux.Lock()
+	defer bs.mux.Unlock()
+	return bs.groups.Len()
+}
+
 func (bs *BatchSys) TryCommit() error {
 	bs.mux.Lock()
 	defer bs.mux.Unlock()
@@ -83,6 +119,17 @@ LOOP:
 				return err
 			}
 			statistics.ConsumeOffsets.WithLabelValues(bs.taskCfg.Name, bs.taskCfg.Topic, strconv.Itoa(j)).Set(float64(off))
+			if bs.committed == nil {
+				bs.committed = make(map[int]int64)
+			}
+			bs.committed[j] = off
+		}
+		for _, span := range grp.Spans {
+			span.End()
+		}
+		// batches are acknowledged, nothing refers to them any longer
+		for _, batch := range grp.Batchs {
+			batch.Free()
 		}
 		eNext := e.Next()
 		bs.groups.Remove(e)
@@ -91,12 +138,13 @@ LOOP:
 	return nil
 }
 
-func (bs *BatchSys) CreateBatchGroupSingle(batch *Batch, partition int, offset int64) {
+func (bs *BatchSys) CreateBatchGroupSingle(batch *Batch, partition int, offset int64, spans []trace.Span) {
 	bg := &BatchGroup{
 		Sys:       bs,
 		Batchs:    []*Batch{batch},
 		Offsets:   make(map[int]int64),
 		PendWrite: 1,
+		Spans:     spans,
 	}
 	bg.Batchs[0].Group = bg
 	bg.Offsets[partition] = offset
@@ -105,8 +153,8 @@ func (bs *BatchSys) CreateBatchGroupSingle(batch *Batch, partition int, offset i
 	bs.mux.Unlock()
 }
 
-func (bs *BatchSys) CreateBatchGroupMulti(batches []*Batch, offsets map[int]int64) {
-	bg := &BatchGroup{Sys: bs, PendWrite: int32(len(batches))}
+func (bs *BatchSys) CreateBatchGroupMulti(batches []*Batch, offsets map[int]int64, spans []trace.Span) {
+	bg := &BatchGroup{Sys: bs, PendWrite: int32(len(batches)), Spans: spans}
 	bg.Batchs = append(bg.Batchs, batches...)
 	bg.Offsets = offsets
 	for _, batch := range bg.Batchs {
@@ -117,25 +165,80 @@ func (bs *BatchSys) CreateBatchGroupMulti(batches []*Batch, offsets map[int]int6
 	bs.mux.Unlock()
 }
 
+// MsgMillis returns the Kafka record timestamp of msg in unix milliseconds, 0 if it's unknown.
+func MsgMillis(msg *InputMessage) int64 {
+	if msg.Timestamp == nil || msg.Timestamp.IsZero() {
+		return 0
+	}
+	return msg.Timestamp.UnixNano() / int64(time.Millisecond)
+}
+
+// NewBatch returns an empty batch from the pool. It's returned to the pool along with its rows once its group is
+// committed, or by Free if it's discarded.
 func NewBatch() (b *Batch) {
-	return &Batch{
-		Rows: GetRows(),
+	if v := batchPool.Get(); v != nil {
+		b = v.(*Batch)
+	} else {
+		b = &Batch{}
+	}
+	b.Rows = GetRows()
+	return
+}
+
+// Append appends row of a message with the Kafka timestamp millis to b. row is put back to the pool at once if b is
+// assembled column by column.
+func (b *Batch) Append(row *Row, millis int64) {
+	if b.Cols != nil {
+		b.Cols.Append(row)
+		PutRow(row)
+	} else {
+		*b.Rows = append(*b.Rows, row)
+	}
+	b.Timestamps = append(b.Timestamps, millis)
+}
+
+// Free returns rows of b and b itself to pools. b can't be used afterwards.
+func (b *Batch) Free() {
+	for _, rows := range []*Rows{b.Rows, b.LateRows} {
+		if rows != nil {
+			for _, row := range *rows {
+				PutRow(row)
+			}
+			PutRows(rows)
+		}
 	}
+	if b.Cols != nil {
+		PutColumns(b.Cols)
+	}
+	*b = Batch{Timestamps: b.Timestamps[:0]}
+	batchPool.Put(b)
 }
 
 func (b *Batch) Size() int {
+	if b.Cols != nil {
+		return len(*b.Rows) + b.Cols.Len
+	}
 	return len(*b.Rows)
 }
 
-// Commit is not retry-able!
+// Commit is not retry-able! Rows are released at once, and b is released once the whole group is committed, maybe
+// by another batch of the group before Commit returns.
 func (b *Batch) Commit() error {
-	for _, row := range *b.Rows {
-		PutRow(row)
+	for _, rows := range []*Rows{b.Rows, b.LateRows} {
+		if rows != nil {
+			for _, row := range *rows {
+				PutRow(row)
+			}
+			PutRows(rows)
+		}
+	}
+	if b.Cols != nil {
+		PutColumns(b.Cols)
 	}
-	PutRows(b.Rows)
-	b.Rows = nil
-	atomic.AddInt32(&b.Group.PendWrite, -1)
-	return b.Group.Sys.TryCommit()
+	b.Rows, b.LateRows, b.Cols = nil, nil, nil
+	grp := b.Group
+	atomic.AddInt32(&grp.PendWrite, -1)
+	return grp.Sys.TryCommit()
 }
 
 func GetRows() (rs *Rows) {
@@ -152,6 +255,43 @@ func PutRows(rs *Rows) {
 	rowsPool.Put(rs)
 }
 
+// GetColumns returns empty columns from the pool.
+func GetColumns() (cols *Columns) {
+	if v := colsPool.Get(); v != nil {
+		return v.(*Columns)
+	}
+	return &Columns{}
+}
+
+// PutColumns returns cols to the pool, keeping the capacity of each column.
+func PutColumns(cols *Columns) {
+	for i := range cols.Vals {
+		cols.Vals[i] = cols.Vals[i][:0]
+	}
+	cols.Len = 0
+	colsPool.Put(cols)
+}
+
+// Append appends values of row to cols. Rows shall be as long as each other.
+func (cols *Columns) Append(row *Row) {
+	for len(cols.Vals) < len(*row) {
+		cols.Vals = append(cols.Vals, nil)
+	}
+	for i, v := range *row {
+		cols.Vals[i] = append(cols.Vals[i], v)
+	}
+	cols.Len++
+}
+
+// Row returns a row from the pool with values of the i-th row of cols.
+func (cols *Columns) Row(i int) (row *Row) {
+	row = GetRow()
+	for _, vals := range cols.Vals {
+		*row = append(*row, vals[i])
+	}
+	return
+}
+
 var rowPool sync.Pool
 
 func GetRow() *Row {
@@ -29,6 +29,22 @@ type Metric interface {
 	GetElasticDateTime(key string, nullable bool) (val interface{})
 	GetArray(key string, t int) (val interface{})
 	GetNewKeys(knownKeys, newKeys *sync.Map, white, black *regexp.Regexp) bool
+	// Fallbacks returns fields which have been got as the default value of a non-nullable column, or failed to convert.
+	Fallbacks() []Fallback
+}
+
+// Reasons of fallbacks
+const (
+	FallbackMissing = "missing" // the field is absent or null
+	FallbackInvalid = "invalid" // the field is present but can't be converted to the column type
+	FallbackCoerced = "coerced" // the field is converted to the column type with loss, by TypeWidening "coerce"
+)
+
+// Fallback is a field of a metric which has been written as the default value, or coerced.
+type Fallback struct {
+	Key    string
+	Reason string
+	Widen  int // the type of a column which would hold the value, or Unknown if widening doesn't help
 }
 
 // DimMetrics
@@ -43,4 +59,5 @@ type ColumnWithType struct {
 	Type       int
 	Nullable   bool
 	SourceName string
+	CHType     string // type declared in ClickHouse, such as LowCardinality(String)
 }
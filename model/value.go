@@ -98,11 +98,21 @@ func GetValueByType(metric Metric, cwt *ColumnWithType) (val interface{}) {
 }
 
 func WhichType(typ string) (dataType int, nullable bool) {
-	ti, ok := typeInfo[typ]
-	if ok {
+	var ok bool
+	if dataType, nullable, ok = TryWhichType(typ); !ok {
+		util.Logger.Fatal(fmt.Sprintf("LOGIC ERROR: unsupported ClickHouse data type %v", typ))
+	}
+	return
+}
+
+// TryWhichType is like WhichType, but reports unsupported types with ok instead of exiting.
+func TryWhichType(typ string) (dataType int, nullable bool, ok bool) {
+	var ti TypeInfo
+	if ti, ok = typeInfo[typ]; ok {
 		dataType, nullable = ti.Type, ti.Nullable
 		return
 	}
+	origTyp := typ
 	nullable = strings.HasPrefix(typ, "Nullable(")
 	if nullable {
 		typ = typ[len("Nullable(") : len(typ)-1]
@@ -127,9 +137,10 @@ func WhichType(typ string) (dataType int, nullable bool) {
 	} else if strings.HasPrefix(typ, "Enum16(") {
 		dataType = String
 	} else {
-		util.Logger.Fatal(fmt.Sprintf("LOGIC ERROR: unsupported ClickHouse data type %v", typ))
+		return
 	}
-	typeInfo[typ] = TypeInfo{Type: dataType, Nullable: nullable}
+	typeInfo[origTyp] = TypeInfo{Type: dataType, Nullable: nullable}
+	ok = true
 	return
 }
 
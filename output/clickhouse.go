@@ -20,7 +20,6 @@ import (
 	"database/sql"
 	"fmt"
 	"io"
-	"math"
 	"regexp"
 	"sort"
 	"strings"
@@ -32,9 +31,13 @@ import (
 	"github.com/forever765/clickhouse_sinker_nali/model"
 	"github.com/forever765/clickhouse_sinker_nali/pool"
 	"github.com/forever765/clickhouse_sinker_nali/statistics"
+	"github.com/forever765/clickhouse_sinker_nali/tenant"
 	"github.com/forever765/clickhouse_sinker_nali/util"
 	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
+	"golang.org/x/time/rate"
 )
 
 var (
@@ -61,20 +64,51 @@ type ClickHouse struct {
 
 	distMetricTbls []string
 	distSeriesTbls []string
+	distLateTbls   []string // of LateData.Table
 
-	bmSeries  *roaring64.Bitmap
-	numFlying int32
-	mux       sync.Mutex
-	taskDone  *sync.Cond
+	bmSeries    *roaring64.Bitmap
+	maxSeries   int // see config.DynamicSchemaConfig.MaxSeries
+	priority    util.Priority
+	numFlying   int32
+	mux         sync.Mutex
+	taskDone    *sync.Cond
+	quota       *tenant.Quota
+	limiter     *rate.Limiter       // for slow write queue
+	clipLimiter *rate.Limiter       // for clipped series
+	colKinds    []columnKind        // of columns of prepareSQL, nil if they can't be written column by column
+	rowWiseSQLs map[string]bool     // prepareSQLs of which the table turned out to differ from colKinds
+	idxLateTime int                 // index of the time column of LateData, -1 if disabled
+	lateSQL     string              // prepareSQL of the late table
+	throttles   []*util.RateLimiter // of rows written, the global one and that of the task, see WaitWrite
+	onPanic     func(err error)
+
+	writeErr      error // the last error of writing if it hasn't succeeded since
+	writeErrSince time.Time
 }
 
 // NewClickHouse new a clickhouse instance
 func NewClickHouse(cfg *config.Config, taskCfg *config.TaskConfig) *ClickHouse {
-	ck := &ClickHouse{cfg: cfg, taskCfg: taskCfg}
+	ck := &ClickHouse{cfg: cfg, taskCfg: taskCfg, quota: tenant.ForTask(taskCfg), maxSeries: taskCfg.DynamicSchema.MaxSeries,
+		limiter: rate.NewLimiter(rate.Every(10*time.Second), 1), clipLimiter: rate.NewLimiter(rate.Every(10*time.Second), 1)}
+	ck.throttles = []*util.RateLimiter{util.GetRateLimiter(util.RateLimitWrite),
+		util.GetRateLimiter(util.TaskRateLimiter(taskCfg.Name, util.RateLimitWrite))}
+	ck.priority, _ = util.ParsePriority(taskCfg.Priority)
 	ck.taskDone = sync.NewCond(&ck.mux)
 	return ck
 }
 
+// SetPanicHandler sets the handler of panics of writing, which the writing pool would otherwise only log.
+func (c *ClickHouse) SetPanicHandler(onPanic func(err error)) {
+	c.onPanic = onPanic
+}
+
+// SetMaxSeries changes the upper limit of distinct series, <=0 means unlimited.
+func (c *ClickHouse) SetMaxSeries(maxSeries int) {
+	c.mux.Lock()
+	c.maxSeries = maxSeries
+	c.mux.Unlock()
+}
+
 // Init the clickhouse intance
 func (c *ClickHouse) Init() (err error) {
 	return c.initSchema()
@@ -89,49 +123,134 @@ func (c *ClickHouse) Drain() {
 	c.mux.Unlock()
 }
 
+// Writing returns the number of batches sent and not done yet.
+func (c *ClickHouse) Writing() int32 {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.numFlying
+}
+
+// WaitInflight blocks while MaxInflightBatches batches of the task are being written. It's called before consuming
+// each message, so that the task is held back where it consumes rather than where it parses or flushes, which are
+// shared by all tasks. Batches of messages consumed already are still sent, so the cap may be exceeded by a few. It
+// returns the error of ctx once ctx is done.
+func (c *ClickHouse) WaitInflight(ctx context.Context) (err error) {
+	maxInflight := int32(c.taskCfg.MaxInflightBatches)
+	if maxInflight <= 0 {
+		return
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.numFlying < maxInflight {
+		return
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.mux.Lock()
+			c.taskDone.Broadcast()
+			c.mux.Unlock()
+		case <-done:
+		}
+	}()
+	for c.numFlying >= maxInflight {
+		if err = ctx.Err(); err != nil {
+			return
+		}
+		c.taskDone.Wait()
+	}
+	return
+}
+
+// WaitWrite blocks while writes of the task are throttled, counting a message as a row. Like WaitInflight, it's called
+// before consuming each message, and returns the error of ctx once ctx is done.
+func (c *ClickHouse) WaitWrite(ctx context.Context) (err error) {
+	for _, throttle := range c.throttles {
+		if err = throttle.WaitN(ctx, 1); err != nil {
+			return
+		}
+	}
+	return
+}
+
 // Send a batch to clickhouse
 func (c *ClickHouse) Send(batch *model.Batch) {
+	c.splitLate(batch)
 	c.mux.Lock()
 	c.numFlying++
 	c.mux.Unlock()
 	statistics.WritingPoolBacklog.WithLabelValues(c.taskCfg.Name).Inc()
-	_ = util.GlobalWritingPool.Submit(func() {
-		c.loopWrite(batch)
-		c.mux.Lock()
-		c.numFlying--
-		if c.numFlying == 0 {
+	queued := time.Now()
+	c.quota.SubmitWriteWithPriority(batch.Bytes, c.priority, func() {
+		defer func() {
+			c.mux.Lock()
+			c.numFlying--
+			// wakes up Drain, and WaitInflight
 			c.taskDone.Broadcast()
-		}
-		c.mux.Unlock()
-		statistics.WritingPoolBacklog.WithLabelValues(c.taskCfg.Name).Dec()
+			c.mux.Unlock()
+			statistics.WritingPoolBacklog.WithLabelValues(c.taskCfg.Name).Dec()
+		}()
+		// the batch is never committed after a panic, the task is expected to restart to consume it again
+		defer util.Recover(c.onPanic)
+		c.checkWriteQueue(batch, time.Since(queued))
+		c.loopWrite(batch)
 	})
 }
 
-func (c *ClickHouse) writeSeries(rows model.Rows, conn *sql.DB) (err error) {
+// writeSeries writes new series of rows to the series table. Rows of new series beyond maxSeries are clipped, kept
+// are the rows remaining for the metric table.
+func (c *ClickHouse) writeSeries(rows model.Rows, conn *sql.DB) (kept model.Rows, err error) {
 	var seriesRows model.Rows
+	var clipped int
 	c.mux.Lock()
-	for _, row := range rows {
+	for i, row := range rows {
 		seriesID := (*row)[c.IdxSerID].(uint64)
-		if c.bmSeries.CheckedAdd(seriesID) {
+		if !c.bmSeries.Contains(seriesID) {
+			if c.maxSeries > 0 && c.bmSeries.GetCardinality() >= uint64(c.maxSeries) {
+				if kept == nil {
+					kept = append(make(model.Rows, 0, len(rows)), rows[:i]...)
+				}
+				clipped++
+				continue
+			}
+			c.bmSeries.Add(seriesID)
 			seriesRows = append(seriesRows, row)
 		}
+		if kept != nil {
+			kept = append(kept, row)
+		}
 	}
+	cardinality, maxSeries := c.bmSeries.GetCardinality(), c.maxSeries
 	c.mux.Unlock()
+	if kept == nil {
+		kept = rows
+	}
+	statistics.SeriesCardinality.WithLabelValues(c.taskCfg.Name).Set(float64(cardinality))
+	if clipped != 0 {
+		statistics.CardinalityClippedTotal.WithLabelValues(c.taskCfg.Name, "series").Add(float64(clipped))
+		if c.clipLimiter.Allow() {
+			util.Logger.Warn("number of series reaches upper limit, dropped rows of new series", zap.String("task", c.taskCfg.Name),
+				zap.Int("limit", maxSeries), zap.Int("dropped", clipped))
+		}
+	}
 	if len(seriesRows) != 0 {
 		var numBad int
 		if numBad, err = writeRows(c.promSerSQL, seriesRows, c.IdxSerID, len(c.Dims), conn); err != nil {
 			return
 		}
 		if numBad != 0 {
-			statistics.ParseMsgsErrorTotal.WithLabelValues(c.taskCfg.Name).Add(float64(numBad))
+			statistics.ParseMsgsErrorTotal.WithLabelValues(c.taskCfg.Name, "insert").Add(float64(numBad))
 		}
 	}
 	return
 }
 
-// Write a batch to clickhouse
-func (c *ClickHouse) write(batch *model.Batch, sc *pool.ShardConn, dbVer *int) (err error) {
-	if len(*batch.Rows) == 0 {
+// Write a batch to clickhouse. written tells whether rows of the table have been written by a previous try, so that a
+// retry after failing to write late rows doesn't write them again.
+func (c *ClickHouse) write(batch *model.Batch, sc *pool.ShardConn, dbVer *int, written *bool) (err error) {
+	if batch.Size() == 0 && (batch.LateRows == nil || len(*batch.LateRows) == 0) {
 		return
 	}
 	var conn *sql.DB
@@ -143,56 +262,214 @@ func (c *ClickHouse) write(batch *model.Batch, sc *pool.ShardConn, dbVer *int) (
 	numDims := len(c.Dims)
 	if c.taskCfg.PrometheusSchema {
 		numDims = c.IdxSerID + 1
-		if err = c.writeSeries(*batch.Rows, conn); err != nil {
-			return
-		}
 	}
 	var numBad int
-	if numBad, err = writeRows(c.prepareSQL, *batch.Rows, 0, numDims, conn); err != nil {
-		return
+	if !*written {
+		rows := *batch.Rows
+		if c.taskCfg.PrometheusSchema {
+			if rows, err = c.writeSeries(rows, conn); err != nil {
+				return
+			}
+		}
+		if batch.Cols != nil && batch.Cols.Len != 0 {
+			if numBad, err = c.writeMetricRows(c.prepareSQL, nil, batch.Cols, numDims, conn); err != nil {
+				return
+			}
+			c.countRejected(batch, numBad, batch.Cols.Len)
+		}
+		if len(rows) != 0 {
+			if numBad, err = c.writeMetricRows(c.prepareSQL, rows, nil, numDims, conn); err != nil {
+				return
+			}
+			c.countRejected(batch, numBad, len(rows))
+		}
+		*written = true
 	}
-	if numBad != 0 {
-		statistics.ParseMsgsErrorTotal.WithLabelValues(c.taskCfg.Name).Add(float64(numBad))
+	if batch.LateRows != nil && len(*batch.LateRows) != 0 {
+		if numBad, err = c.writeMetricRows(c.lateSQL, *batch.LateRows, nil, numDims, conn); err != nil {
+			return
+		}
+		c.countRejected(batch, numBad, len(*batch.LateRows))
 	}
 	statistics.FlushMsgsTotal.WithLabelValues(c.taskCfg.Name).Add(float64(batch.RealSize))
+	statistics.FlushBatchRows.WithLabelValues(c.taskCfg.Name).Observe(float64(batch.RealSize))
 	return
 }
 
+// countRejected counts and reports numBad rows of total rejected by ClickHouse.
+func (c *ClickHouse) countRejected(batch *model.Batch, numBad, total int) {
+	if numBad == 0 {
+		return
+	}
+	statistics.ParseMsgsErrorTotal.WithLabelValues(c.taskCfg.Name, "insert").Add(float64(numBad))
+	PublishErrorEvent(NewBatchErrorEvent(c.taskCfg.Name, ReasonInsert, batch, numBad,
+		errors.Errorf("ClickHouse rejected %d rows of %d", numBad, total)))
+}
+
+// writeMetricRows writes rows, or cols of a batch assembled column by column, to the table of prepareSQL. They're
+// written column by column if the table allows, otherwise row by row.
+func (c *ClickHouse) writeMetricRows(prepareSQL string, rows model.Rows, cols *model.Columns, numDims int, conn *sql.DB) (numBad int, err error) {
+	c.mux.Lock()
+	rowWise := c.colKinds == nil || c.rowWiseSQLs[prepareSQL]
+	c.mux.Unlock()
+	if !rowWise {
+		toWrite := cols
+		if toWrite == nil {
+			// rows changed after assembling, such as rollups, late rows and those of the Prometheus schema
+			toWrite = model.GetColumns()
+			for _, row := range rows {
+				toWrite.Append(row)
+			}
+			defer model.PutColumns(toWrite)
+		}
+		if numBad, err = writeColumnar(prepareSQL, toWrite, c.colKinds, conn); !errors.Is(err, errColumnarUnsupported) {
+			return
+		}
+		c.mux.Lock()
+		if c.rowWiseSQLs == nil {
+			c.rowWiseSQLs = make(map[string]bool)
+		}
+		c.rowWiseSQLs[prepareSQL] = true
+		c.mux.Unlock()
+		util.Logger.Info("the table has columns which can't be written column by column, write row by row",
+			zap.String("task", c.taskCfg.Name), zap.String("sql", prepareSQL))
+	}
+	if cols != nil {
+		rows = make(model.Rows, cols.Len)
+		for i := range rows {
+			rows[i] = cols.Row(i)
+		}
+		defer func() {
+			for _, row := range rows {
+				model.PutRow(row)
+			}
+		}()
+	}
+	return writeRows(prepareSQL, rows, 0, numDims, conn)
+}
+
+// Columnar tells whether batches can be assembled column by column, which is the case if the table allows, and rows
+// are neither routed by LateData nor split for the series table.
+func (c *ClickHouse) Columnar() bool {
+	return c.colKinds != nil && c.idxLateTime < 0 && !c.taskCfg.PrometheusSchema
+}
+
+// checkWriteQueue logs and counts a batch which waited for a writer too long.
+func (c *ClickHouse) checkWriteQueue(batch *model.Batch, waited time.Duration) {
+	if !util.IsSlowWriteQueue(waited) {
+		return
+	}
+	statistics.SlowWriteQueueTotal.WithLabelValues(c.taskCfg.Name).Inc()
+	if c.limiter.Allow() {
+		c.mux.Lock()
+		numFlying := c.numFlying
+		c.mux.Unlock()
+		util.Logger.Warn("batch waited long for a writer", zap.String("task", c.taskCfg.Name),
+			zap.Duration("waited", waited), zap.Int("rows", batch.RealSize), zap.Int32("taskBatchesInFlight", numFlying),
+			zap.Int("writingPoolBacklog", util.GlobalWritingPool.Backlog()), zap.Int("writingPoolWorkers", util.GlobalWritingPool.MaxWorkers()))
+	}
+}
+
 // LoopWrite will dead loop to write the records
 func (c *ClickHouse) loopWrite(batch *model.Batch) {
-	var err error
 	var times int
-	var reconnect bool
 	var dbVer int
+	var written bool
 	sc := pool.GetShardConn(batch.BatchIdx)
-	for {
-		if err = c.write(batch, sc, &dbVer); err == nil {
-			if err = batch.Commit(); err == nil {
-				return
-			}
-			// Note: kafka_go and sarama commit give different error when context is cancceled.
-			if errors.Is(err, context.Canceled) || errors.Is(err, io.ErrClosedPipe) {
-				util.Logger.Warn("Batch.Commit failed due to the context has been cancelled", zap.String("task", c.taskCfg.Name))
-				return
-			}
-			util.Logger.Fatal("Batch.Commit failed with permanent error", zap.String("task", c.taskCfg.Name), zap.Error(err))
-		}
-		if errors.Is(err, context.Canceled) {
-			util.Logger.Info("ClickHouse.write failed due to the context has been cancelled", zap.String("task", c.taskCfg.Name))
+	begin := time.Now()
+	span := c.startInsertSpan(batch)
+	policy := util.RetryPolicy{
+		MaxAttempts:    c.taskCfg.RetryTimes,
+		InitialBackoff: time.Duration(c.taskCfg.RetryInterval) * time.Second,
+	}
+	err := util.Retry(context.Background(), policy, func(ctx context.Context) (err error) {
+		if err = c.write(batch, sc, &dbVer, &written); err == nil || errors.Is(err, context.Canceled) {
 			return
 		}
 		util.Logger.Error("flush batch failed", zap.String("task", c.taskCfg.Name), zap.Int("try", times), zap.Error(err))
 		statistics.FlushMsgsErrorTotal.WithLabelValues(c.taskCfg.Name).Add(float64(batch.RealSize))
+		statistics.ClickhouseErrorsTotal.WithLabelValues(c.taskCfg.Name, errorCode(err)).Inc()
+		PublishErrorEvent(NewBatchErrorEvent(c.taskCfg.Name, ReasonFlush, batch, batch.RealSize, err))
+		c.setWriteErr(err)
+		if span != nil {
+			span.RecordError(err, trace.WithAttributes(attribute.Int("try", times)))
+		}
 		times++
-		reconnect = shouldReconnect(err, sc)
-		if reconnect && (c.cfg.Clickhouse.RetryTimes <= 0 || times < c.cfg.Clickhouse.RetryTimes) {
-			time.Sleep(10 * time.Second)
-		} else {
-			util.Logger.Fatal("ClickHouse.loopWrite failed", zap.String("task", c.taskCfg.Name))
+		if !shouldReconnect(err, sc) {
+			err = util.Permanent(err)
 		}
+		return
+	})
+	if err != nil {
+		if errors.Is(err, context.Canceled) {
+			util.Logger.Info("ClickHouse.write failed due to the context has been cancelled", zap.String("task", c.taskCfg.Name))
+			return
+		}
+		util.Logger.Fatal("ClickHouse.loopWrite failed", zap.String("task", c.taskCfg.Name), zap.Error(err))
+	}
+	statistics.FlushDuration.WithLabelValues(c.taskCfg.Name).Observe(time.Since(begin).Seconds())
+	c.observeLatency(batch)
+	util.EndSpan(span, nil)
+	c.setWriteErr(nil)
+	if err = batch.Commit(); err == nil {
+		return
+	}
+	// Note: kafka_go and sarama commit give different error when context is cancceled.
+	if errors.Is(err, context.Canceled) || errors.Is(err, io.ErrClosedPipe) {
+		util.Logger.Warn("Batch.Commit failed due to the context has been cancelled", zap.String("task", c.taskCfg.Name))
+		return
+	}
+	util.Logger.Fatal("Batch.Commit failed with permanent error", zap.String("task", c.taskCfg.Name), zap.Error(err))
+}
+
+// observeLatency records the time from producing each record to Kafka to having it written to ClickHouse.
+func (c *ClickHouse) observeLatency(batch *model.Batch) {
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	h := statistics.EndToEndLatency.WithLabelValues(c.taskCfg.Name)
+	for _, ts := range batch.Timestamps {
+		if ts <= 0 {
+			continue
+		}
+		latency := now - ts
+		if latency < 0 {
+			// clock skew between producers and sinker
+			latency = 0
+		}
+		h.Observe(float64(latency) / 1000)
 	}
 }
 
+func (c *ClickHouse) setWriteErr(err error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if err != nil && c.writeErr == nil {
+		c.writeErrSince = time.Now()
+	}
+	c.writeErr = err
+}
+
+// WriteErr returns when writes began failing and the last error, which is nil if the last write succeeded.
+func (c *ClickHouse) WriteErr() (since time.Time, err error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.writeErrSince, c.writeErr
+}
+
+// startInsertSpan starts the span of writing a batch if any message of its group is traced. The span links to those
+// messages since a batch is a fan-in of many traces.
+func (c *ClickHouse) startInsertSpan(batch *model.Batch) trace.Span {
+	if batch.Group == nil || len(batch.Group.Spans) == 0 {
+		return nil
+	}
+	links := make([]trace.Link, 0, len(batch.Group.Spans))
+	for _, msgSpan := range batch.Group.Spans {
+		links = append(links, trace.Link{SpanContext: msgSpan.SpanContext()})
+	}
+	_, span := util.Tracer().Start(context.Background(), "insert", trace.WithSpanKind(trace.SpanKindClient), trace.WithLinks(links...),
+		trace.WithAttributes(attribute.String("task", c.taskCfg.Name), attribute.Int("rows", batch.RealSize), attribute.Int64("shard", batch.BatchIdx)))
+	return span
+}
+
 func (c *ClickHouse) initBmSeries(conn *sql.DB) (err error) {
 	var query string
 	if c.cfg.Clickhouse.Cluster != "" {
@@ -217,6 +494,7 @@ func (c *ClickHouse) initBmSeries(conn *sql.DB) (err error) {
 		c.bmSeries.Add(seriesID)
 	}
 	util.Logger.Info(fmt.Sprintf("loaded %d series from %v", c.bmSeries.GetCardinality(), c.seriesTbl), zap.String("task", c.taskCfg.Name))
+	statistics.SeriesCardinality.WithLabelValues(c.taskCfg.Name).Set(float64(c.bmSeries.GetCardinality()))
 	return
 }
 
@@ -332,6 +610,7 @@ func (c *ClickHouse) initSchema() (err error) {
 				Type:       tp,
 				Nullable:   nullable,
 				SourceName: dim.SourceName,
+				CHType:     dim.Type,
 			})
 		}
 	}
@@ -352,6 +631,11 @@ func (c *ClickHouse) initSchema() (err error) {
 	c.prepareSQL = "INSERT INTO " + c.cfg.Clickhouse.DB + "." + c.taskCfg.TableName + " (" + strings.Join(quotedDms, ",") + ") " +
 		"VALUES (" + strings.Join(params, ",") + ")"
 	util.Logger.Info(fmt.Sprintf("Prepare sql=> %s", c.prepareSQL), zap.String("task", c.taskCfg.Name))
+	// types may have been widened since
+	c.colKinds, c.rowWiseSQLs = columnKindsOf(c.Dims[:numDims]), nil
+	if err = c.initLateData(quotedDms, params); err != nil {
+		return
+	}
 
 	// Check distributed metric table
 	if chCfg := &c.cfg.Clickhouse; chCfg.Cluster != "" {
@@ -366,7 +650,8 @@ func (c *ClickHouse) initSchema() (err error) {
 	return nil
 }
 
-func (c *ClickHouse) ChangeSchema(newKeys *sync.Map) (err error) {
+// ChangeSchema adds columns for newKeys, as long as the number of columns doesn't exceed maxDims.
+func (c *ClickHouse) ChangeSchema(newKeys *sync.Map, maxDims int) (err error) {
 	var queries []string
 	var onCluster string
 	taskCfg := c.taskCfg
@@ -374,11 +659,19 @@ func (c *ClickHouse) ChangeSchema(newKeys *sync.Map) (err error) {
 	if chCfg.Cluster != "" {
 		onCluster = fmt.Sprintf("ON CLUSTER %s", chCfg.Cluster)
 	}
-	maxDims := math.MaxInt16
-	if taskCfg.DynamicSchema.MaxDims > 0 {
-		maxDims = taskCfg.DynamicSchema.MaxDims
-	}
 	newKeysQuota := maxDims - len(c.Dims)
+	var numNewKeys int
+	newKeys.Range(func(_, _ interface{}) bool {
+		numNewKeys++
+		return true
+	})
+	if numNewKeys > newKeysQuota {
+		numIgnored := numNewKeys
+		if newKeysQuota > 0 {
+			numIgnored -= newKeysQuota
+		}
+		statistics.CardinalityClippedTotal.WithLabelValues(taskCfg.Name, "columns").Add(float64(numIgnored))
+	}
 	if newKeysQuota <= 0 {
 		util.Logger.Warn("number of columns reaches upper limit", zap.Int("limit", maxDims), zap.Int("current", len(c.Dims)))
 		return
@@ -425,6 +718,10 @@ func (c *ClickHouse) ChangeSchema(newKeys *sync.Map) (err error) {
 			query := fmt.Sprintf("ALTER TABLE %s.%s %s ADD COLUMN IF NOT EXISTS `%s` %s", chCfg.DB, taskCfg.TableName, onCluster, strKey, strVal)
 			queries = append(queries, query)
 			affectDistMetric = true
+			if lateTbl := c.lateTable(); lateTbl != "" {
+				query = fmt.Sprintf("ALTER TABLE %s.%s %s ADD COLUMN IF NOT EXISTS `%s` %s", chCfg.DB, lateTbl, onCluster, strKey, strVal)
+				queries = append(queries, query)
+			}
 		}
 		return true
 	})
@@ -449,6 +746,11 @@ func (c *ClickHouse) ChangeSchema(newKeys *sync.Map) (err error) {
 			if err = recreateDistTbls(chCfg.Cluster, chCfg.DB, c.taskCfg.TableName, c.distMetricTbls, conn); err != nil {
 				return
 			}
+			if lateTbl := c.lateTable(); lateTbl != "" {
+				if err = recreateDistTbls(chCfg.Cluster, chCfg.DB, lateTbl, c.distLateTbls, conn); err != nil {
+					return
+				}
+			}
 		}
 		if affectDistSeries {
 			if err = recreateDistTbls(chCfg.Cluster, chCfg.DB, c.seriesTbl, c.distSeriesTbls, conn); err != nil {
@@ -459,6 +761,66 @@ func (c *ClickHouse) ChangeSchema(newKeys *sync.Map) (err error) {
 	return
 }
 
+// WidenColumns modifies columns of widenKeys, column name -> model.Float or model.String, to the wider type, of the
+// table and the late table if any. Columns which ClickHouse refuses to modify, such as those in the sorting key, are
+// returned instead of failing, so that they aren't tried again.
+func (c *ClickHouse) WidenColumns(widenKeys map[string]int) (refused []string, err error) {
+	if len(widenKeys) == 0 {
+		return
+	}
+	var onCluster string
+	taskCfg := c.taskCfg
+	chCfg := &c.cfg.Clickhouse
+	if chCfg.Cluster != "" {
+		onCluster = fmt.Sprintf("ON CLUSTER %s", chCfg.Cluster)
+	}
+	sc := pool.GetShardConn(0)
+	var conn *sql.DB
+	if conn, _, err = sc.NextGoodReplica(0); err != nil {
+		return
+	}
+	lateTbl := c.lateTable()
+	var widened bool
+	for _, dim := range c.Dims {
+		typ, ok := widenKeys[dim.Name]
+		if !ok {
+			continue
+		}
+		strVal := "Float64"
+		if typ == model.String {
+			strVal = "String"
+		}
+		if dim.Nullable {
+			strVal = fmt.Sprintf("Nullable(%s)", strVal)
+		}
+		// the late table first, a late table wider than the table still accepts rows of the table
+		tables := []string{taskCfg.TableName}
+		if lateTbl != "" {
+			tables = []string{lateTbl, taskCfg.TableName}
+		}
+		for _, table := range tables {
+			query := fmt.Sprintf("ALTER TABLE %s.%s %s MODIFY COLUMN `%s` %s", chCfg.DB, table, onCluster, dim.Name, strVal)
+			util.Logger.Info(fmt.Sprintf("executing sql=> %s", query), zap.String("task", taskCfg.Name))
+			if _, err1 := conn.Exec(query); err1 != nil {
+				util.Logger.Error("failed to widen column", zap.String("task", taskCfg.Name), zap.String("table", table),
+					zap.String("column", dim.Name), zap.Error(err1))
+				refused = append(refused, dim.Name)
+				break
+			}
+			widened = true
+		}
+	}
+	if widened && chCfg.Cluster != "" {
+		if err = recreateDistTbls(chCfg.Cluster, chCfg.DB, c.taskCfg.TableName, c.distMetricTbls, conn); err != nil {
+			return
+		}
+		if lateTbl != "" {
+			err = recreateDistTbls(chCfg.Cluster, chCfg.DB, lateTbl, c.distLateTbls, conn)
+		}
+	}
+	return
+}
+
 func (c *ClickHouse) getDistTbls(table string) (distTbls []string, err error) {
 	taskCfg := c.taskCfg
 	chCfg := &c.cfg.Clickhouse
@@ -0,0 +1,72 @@
+package output
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/forever765/clickhouse_sinker_nali/config"
+	"github.com/forever765/clickhouse_sinker_nali/util"
+)
+
+func TestWaitInflight(t *testing.T) {
+	c := &ClickHouse{taskCfg: &config.TaskConfig{Name: "test_inflight", MaxInflightBatches: 2}}
+	c.taskDone = sync.NewCond(&c.mux)
+	c.numFlying = 1
+	require.Nil(t, c.WaitInflight(context.Background()))
+
+	// waits until a batch is done
+	c.numFlying = 2
+	done := make(chan error)
+	go func() {
+		done <- c.WaitInflight(context.Background())
+	}()
+	select {
+	case <-done:
+		t.Fatal("MaxInflightBatches exceeded")
+	case <-time.After(50 * time.Millisecond):
+	}
+	c.mux.Lock()
+	c.numFlying--
+	c.taskDone.Broadcast()
+	c.mux.Unlock()
+	require.Nil(t, <-done)
+
+	// stops waiting once the task stops
+	c.numFlying = 2
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		done <- c.WaitInflight(ctx)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	require.Equal(t, context.Canceled, <-done)
+
+	// unlimited
+	c.taskCfg.MaxInflightBatches = 0
+	c.numFlying = 100
+	require.Nil(t, c.WaitInflight(context.Background()))
+}
+
+func TestWaitWrite(t *testing.T) {
+	name := "test_wait_write"
+	throttle := util.GetRateLimiter(util.TaskRateLimiter(name, util.RateLimitWrite))
+	defer util.RemoveRateLimiter(util.TaskRateLimiter(name, util.RateLimitWrite))
+	c := NewClickHouse(&config.Config{}, &config.TaskConfig{Name: name})
+	require.Nil(t, c.WaitWrite(context.Background()))
+
+	// a wait for tokens is canceled once the task stops
+	throttle.SetRate(1)
+	require.Nil(t, c.WaitWrite(context.Background()))
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+	begin := time.Now()
+	require.NotNil(t, c.WaitWrite(ctx))
+	require.Less(t, time.Since(begin), 500*time.Millisecond)
+}
@@ -3,6 +3,7 @@ package output
 import (
 	"database/sql"
 	"fmt"
+	"strconv"
 
 	"github.com/ClickHouse/clickhouse-go"
 	"github.com/RoaringBitmap/roaring"
@@ -29,6 +30,15 @@ func shouldReconnect(err error, sc *pool.ShardConn) bool {
 	return true
 }
 
+// errorCode labels a write failure with the exception code, or "network" if it isn't from clickhouse-server.
+func errorCode(err error) string {
+	var exp *clickhouse.Exception
+	if errors.As(err, &exp) {
+		return strconv.Itoa(int(exp.Code))
+	}
+	return "network"
+}
+
 func writeRows(prepareSQL string, rows model.Rows, idxBegin, idxEnd int, conn *sql.DB) (numBad int, err error) {
 	var stmt *sql.Stmt
 	var tx *sql.Tx
@@ -92,6 +102,19 @@ func writeRows(prepareSQL string, rows model.Rows, idxBegin, idxEnd int, conn *s
 	return
 }
 
+// InsertRows writes rows to a replica of shard batchNum%NumShard with insertSQL. It's for sinker's own tables.
+func InsertRows(batchNum int64, insertSQL string, rows model.Rows) (err error) {
+	if pool.NumShard() == 0 {
+		return errors.Errorf("no ClickHouse connection")
+	}
+	var conn *sql.DB
+	if conn, _, err = pool.GetShardConn(batchNum).NextGoodReplica(0); err != nil {
+		return
+	}
+	_, err = writeRows(insertSQL, rows, 0, len(*rows[0]), conn)
+	return
+}
+
 func getDims(database, table string, excludedColumns []string, conn *sql.DB) (dims []*model.ColumnWithType, err error) {
 	var rs *sql.Rows
 	if rs, err = conn.Query(fmt.Sprintf(selectSQLTemplate, database, table)); err != nil {
@@ -107,10 +130,11 @@ func getDims(database, table string, excludedColumns []string, conn *sql.DB) (di
 			err = errors.Wrapf(err, "")
 			return
 		}
+		chType := typ
 		typ = lowCardinalityRegexp.ReplaceAllString(typ, "$1")
 		if !util.StringContains(excludedColumns, name) && defaultKind != "MATERIALIZED" {
 			tp, nullable := model.WhichType(typ)
-			dims = append(dims, &model.ColumnWithType{Name: name, Type: tp, Nullable: nullable, SourceName: util.GetSourceName(name)})
+			dims = append(dims, &model.ColumnWithType{Name: name, Type: tp, Nullable: nullable, SourceName: util.GetSourceName(name), CHType: chType})
 		}
 	}
 	if len(dims) == 0 {
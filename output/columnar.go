@@ -0,0 +1,239 @@
+package output
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go"
+	"github.com/ClickHouse/clickhouse-go/lib/data"
+	"github.com/RoaringBitmap/roaring"
+	"github.com/forever765/clickhouse_sinker_nali/model"
+	"github.com/forever765/clickhouse_sinker_nali/util"
+	"github.com/pkg/errors"
+)
+
+// columnKind is how values of a column are appended to a block.
+type columnKind int
+
+const (
+	colInt8 columnKind = iota
+	colInt16
+	colInt32
+	colInt64
+	colUInt8
+	colUInt16
+	colUInt32
+	colUInt64
+	colFloat32
+	colFloat64
+	colString
+	colDate
+	colDateTime
+	colArray
+)
+
+var columnKinds = map[string]columnKind{
+	"Int8": colInt8, "Int16": colInt16, "Int32": colInt32, "Int64": colInt64,
+	"UInt8": colUInt8, "UInt16": colUInt16, "UInt32": colUInt32, "UInt64": colUInt64,
+	"Float32": colFloat32, "Float64": colFloat64,
+	"String": colString, "Date": colDate, "DateTime": colDateTime,
+}
+
+// errColumnarUnsupported tells that the table turned out to have columns other than expected, which can't be written
+// column by column.
+var errColumnarUnsupported = errors.New("columnar writing is unsupported by the table")
+
+func columnKindOf(chType string) (kind columnKind, ok bool) {
+	if kind, ok = columnKinds[chType]; ok {
+		return
+	}
+	switch {
+	case strings.HasPrefix(chType, "DateTime("):
+		return colDateTime, true
+	case strings.HasPrefix(chType, "Array("):
+		// arrays go through the same path as row-wise inserts
+		return colArray, true
+	}
+	return
+}
+
+// columnKindsOf returns kinds of columns of dims, nil if any of them can't be written column by column, such as
+// Nullable and LowCardinality ones whose typed writers of clickhouse-go v1 don't encode values the way they take.
+func columnKindsOf(dims []*model.ColumnWithType) (kinds []columnKind) {
+	kinds = make([]columnKind, len(dims))
+	for i, dim := range dims {
+		var ok bool
+		if kinds[i], ok = columnKindOf(dim.CHType); !ok {
+			return nil
+		}
+	}
+	return
+}
+
+// columnValid tells whether v can be appended to a column of kind.
+func columnValid(kind columnKind, v interface{}) bool {
+	switch kind {
+	case colFloat32, colFloat64:
+		_, ok := v.(float64)
+		return ok
+	case colString:
+		_, ok := v.(string)
+		return ok
+	case colDate, colDateTime:
+		_, ok := v.(time.Time)
+		return ok
+	case colArray:
+		return v != nil && reflect.TypeOf(v).Kind() == reflect.Slice
+	default:
+		_, ok := columnInt(v)
+		return ok
+	}
+}
+
+// columnInt converts integers which rows may hold, such as int of Kafka partitions and uint64 of series IDs.
+func columnInt(v interface{}) (i int64, ok bool) {
+	switch v := v.(type) {
+	case int64:
+		return v, true
+	case int:
+		return int64(v), true
+	case uint64:
+		return int64(v), true
+	}
+	return
+}
+
+func writeColumnValue(block *data.Block, c int, kind columnKind, v interface{}) error {
+	i, _ := columnInt(v)
+	switch kind {
+	case colInt8:
+		return block.WriteInt8(c, int8(i))
+	case colInt16:
+		return block.WriteInt16(c, int16(i))
+	case colInt32:
+		return block.WriteInt32(c, int32(i))
+	case colInt64:
+		return block.WriteInt64(c, i)
+	case colUInt8:
+		return block.WriteUInt8(c, uint8(i))
+	case colUInt16:
+		return block.WriteUInt16(c, uint16(i))
+	case colUInt32:
+		return block.WriteUInt32(c, uint32(i))
+	case colUInt64:
+		return block.WriteUInt64(c, uint64(i))
+	case colFloat32:
+		return block.WriteFloat32(c, float32(v.(float64)))
+	case colFloat64:
+		return block.WriteFloat64(c, v.(float64))
+	case colString:
+		return block.WriteString(c, v.(string))
+	case colDate:
+		return block.WriteDate(c, v.(time.Time))
+	case colDateTime:
+		t := v.(time.Time)
+		if t.IsZero() {
+			t = time.Unix(0, 0)
+		}
+		return block.WriteDateTime(c, t)
+	default:
+		return block.WriteArray(c, v)
+	}
+}
+
+// writeColumnar writes the first len(kinds) columns of cols like writeRows, but appends values column by column to a
+// native block instead of executing the statement row by row. Rows with values unfit for their columns are skipped up
+// front, so that a batch with bad rows is still written in a single round. If the table has columns other than kinds,
+// the insert is finished empty and errColumnarUnsupported is returned, since Rollback would close the connection.
+func writeColumnar(prepareSQL string, cols *model.Columns, kinds []columnKind, conn *sql.DB) (numBad int, err error) {
+	if len(cols.Vals) < len(kinds) {
+		err = errors.Errorf("%d columns to write %s", len(cols.Vals), prepareSQL)
+		return
+	}
+	var sc *sql.Conn
+	if sc, err = conn.Conn(context.Background()); err != nil {
+		err = errors.Wrapf(err, "conn.Conn")
+		return
+	}
+	defer sc.Close()
+	err = sc.Raw(func(dc interface{}) (err error) {
+		ch, ok := dc.(clickhouse.Clickhouse)
+		if !ok {
+			return errors.Errorf("unexpected driver connection %T", dc)
+		}
+		if _, err = ch.Begin(); err != nil {
+			return errors.Wrapf(err, "conn.Begin %s", prepareSQL)
+		}
+		defer func() {
+			if err != nil && !errors.Is(err, errColumnarUnsupported) {
+				_ = ch.Rollback()
+			}
+		}()
+		if _, err = ch.Prepare(prepareSQL); err != nil {
+			return errors.Wrapf(err, "conn.Prepare %s", prepareSQL)
+		}
+		var block *data.Block
+		if block, err = ch.Block(); err != nil {
+			return errors.Wrapf(err, "conn.Block")
+		}
+		if !blockOfKinds(block, kinds) {
+			if err = ch.Commit(); err != nil {
+				return errors.Wrapf(err, "conn.Commit")
+			}
+			return errColumnarUnsupported
+		}
+		var bmBad *roaring.Bitmap
+		for i := 0; i < cols.Len; i++ {
+			valid := true
+			for c := 0; valid && c < len(kinds); c++ {
+				valid = columnValid(kinds[c], cols.Vals[c][i])
+			}
+			if !valid {
+				if bmBad == nil {
+					bmBad = roaring.NewBitmap()
+				}
+				bmBad.AddInt(i)
+			}
+		}
+		if bmBad != nil {
+			numBad = int(bmBad.GetCardinality())
+		}
+		block.Reserve()
+		block.NumRows = uint64(cols.Len - numBad)
+		for c, kind := range kinds {
+			for i, v := range cols.Vals[c][:cols.Len] {
+				if bmBad != nil && bmBad.ContainsInt(i) {
+					continue
+				}
+				if err = writeColumnValue(block, c, kind, v); err != nil {
+					return errors.Wrapf(err, "column %s", block.Columns[c].Name())
+				}
+			}
+		}
+		if err = ch.Commit(); err != nil {
+			return errors.Wrapf(err, "conn.Commit")
+		}
+		return
+	})
+	if err == nil && numBad != 0 {
+		util.Logger.Warn(fmt.Sprintf("writeColumnar skipped %d rows of %d due to invalid content", numBad, cols.Len))
+	}
+	return
+}
+
+// blockOfKinds tells whether columns of the prepared block are of kinds.
+func blockOfKinds(block *data.Block, kinds []columnKind) bool {
+	if len(block.Columns) != len(kinds) {
+		return false
+	}
+	for i, col := range block.Columns {
+		if kind, ok := columnKindOf(col.CHType()); !ok || kind != kinds[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,86 @@
+package output
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/lib/column"
+	"github.com/ClickHouse/clickhouse-go/lib/data"
+	"github.com/stretchr/testify/require"
+
+	"github.com/forever765/clickhouse_sinker_nali/config"
+	"github.com/forever765/clickhouse_sinker_nali/model"
+)
+
+func TestColumnKindsOf(t *testing.T) {
+	dims := func(chTypes ...string) (dims []*model.ColumnWithType) {
+		for _, chType := range chTypes {
+			dims = append(dims, &model.ColumnWithType{Name: chType, CHType: chType})
+		}
+		return
+	}
+	require.Equal(t, []columnKind{colInt8, colUInt64, colFloat32, colString, colDate, colDateTime, colDateTime, colArray},
+		columnKindsOf(dims("Int8", "UInt64", "Float32", "String", "Date", "DateTime", "DateTime('UTC')", "Array(String)")))
+	require.Nil(t, columnKindsOf(dims("Int8", "Nullable(Int32)")))
+	require.Nil(t, columnKindsOf(dims("LowCardinality(String)", "Int8")))
+	// types unknown, such as those of columns of the series table
+	require.Nil(t, columnKindsOf(dims("")))
+}
+
+func TestColumnValid(t *testing.T) {
+	require.True(t, columnValid(colInt32, int64(1)))
+	require.True(t, columnValid(colUInt64, uint64(1)))
+	require.True(t, columnValid(colInt8, 1))
+	require.False(t, columnValid(colInt8, "1"))
+	require.True(t, columnValid(colFloat64, 1.5))
+	require.False(t, columnValid(colFloat64, int64(1)))
+	require.True(t, columnValid(colString, ""))
+	require.False(t, columnValid(colString, nil))
+	require.True(t, columnValid(colDateTime, time.Now()))
+	require.True(t, columnValid(colArray, []string{"a"}))
+	require.False(t, columnValid(colArray, nil))
+}
+
+func TestBlockOfKinds(t *testing.T) {
+	block := func(chTypes ...string) *data.Block {
+		b := &data.Block{}
+		for _, chType := range chTypes {
+			col, err := column.Factory(chType, chType, time.UTC)
+			require.Nil(t, err)
+			b.Columns = append(b.Columns, col)
+		}
+		return b
+	}
+	kinds := []columnKind{colInt64, colString}
+	require.True(t, blockOfKinds(block("Int64", "String"), kinds))
+	require.False(t, blockOfKinds(block("Int32", "String"), kinds))
+	require.False(t, blockOfKinds(block("Int64", "Nullable(String)"), kinds))
+	require.False(t, blockOfKinds(block("Int64"), kinds))
+}
+
+func TestColumnar(t *testing.T) {
+	newClickHouse := func(colKinds []columnKind, idxLateTime int, prometheus bool) *ClickHouse {
+		return &ClickHouse{taskCfg: &config.TaskConfig{PrometheusSchema: prometheus}, colKinds: colKinds, idxLateTime: idxLateTime}
+	}
+	kinds := []columnKind{colInt64}
+	require.True(t, newClickHouse(kinds, -1, false).Columnar())
+	require.False(t, newClickHouse(nil, -1, false).Columnar())
+	require.False(t, newClickHouse(kinds, 0, false).Columnar())
+	require.False(t, newClickHouse(kinds, -1, true).Columnar())
+}
+
+func TestBatchColumns(t *testing.T) {
+	batch := model.NewBatch()
+	batch.Cols = model.GetColumns()
+	for i := 0; i < 3; i++ {
+		row := model.GetRow()
+		*row = append(*row, int64(i), "v")
+		batch.Append(row, int64(i))
+	}
+	require.Equal(t, 3, batch.Size())
+	require.Empty(t, *batch.Rows)
+	require.Equal(t, [][]interface{}{{int64(0), int64(1), int64(2)}, {"v", "v", "v"}}, batch.Cols.Vals)
+	require.Equal(t, []int64{0, 1, 2}, batch.Timestamps)
+	require.Equal(t, model.Row{int64(1), "v"}, *batch.Cols.Row(1))
+	batch.Free()
+}
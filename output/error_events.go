@@ -0,0 +1,178 @@
+package output
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/cespare/xxhash/v2"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"golang.org/x/time/rate"
+
+	"github.com/forever765/clickhouse_sinker_nali/config"
+	"github.com/forever765/clickhouse_sinker_nali/input"
+	"github.com/forever765/clickhouse_sinker_nali/model"
+	"github.com/forever765/clickhouse_sinker_nali/statistics"
+	"github.com/forever765/clickhouse_sinker_nali/util"
+)
+
+// Reasons of error events
+const (
+	ReasonEnrich = "enrich" // a message failed to enrich, and is written without enrichment
+	ReasonScript = "script" // a message failed to transform by the script, and is skipped
+	ReasonParse  = "parse"  // a message failed to parse, and is skipped
+	ReasonInsert = "insert" // rows of a batch were rejected by ClickHouse, and are skipped
+	ReasonFlush  = "flush"  // a batch failed to write, and is retried
+
+	ReasonQuarantine = "quarantine" // a message has a value which doesn't fit its column, and is skipped by TypeWidening
+)
+
+// ErrorEvent is the JSON value published to ErrorEvents.Topic. Message events carry Topic, Partition, Offset and the
+// payload hash, while batch events carry Rows and Offsets.
+type ErrorEvent struct {
+	Time        time.Time     `json:"time"`
+	Instance    string        `json:"instance"`
+	Task        string        `json:"task"`
+	Reason      string        `json:"reason"`
+	Error       string        `json:"error"`
+	Topic       string        `json:"topic,omitempty"`
+	Partition   *int          `json:"partition,omitempty"`
+	Offset      *int64        `json:"offset,omitempty"`
+	PayloadHash string        `json:"payloadHash,omitempty"` // hex xxhash64 of the message value
+	PayloadSize int           `json:"payloadSize,omitempty"`
+	Rows        int           `json:"rows,omitempty"`
+	Offsets     map[int]int64 `json:"offsets,omitempty"` // the last offset of each partition in the batch group
+}
+
+// NewMessageErrorEvent describes a message failed with reason.
+func NewMessageErrorEvent(task, reason string, msg *model.InputMessage, err error) *ErrorEvent {
+	partition, offset := msg.Partition, msg.Offset
+	return &ErrorEvent{
+		Task:        task,
+		Reason:      reason,
+		Error:       err.Error(),
+		Topic:       msg.Topic,
+		Partition:   &partition,
+		Offset:      &offset,
+		PayloadHash: fmt.Sprintf("%016x", xxhash.Sum64(msg.Value)),
+		PayloadSize: len(msg.Value),
+	}
+}
+
+// NewBatchErrorEvent describes rows of a batch failed with reason.
+func NewBatchErrorEvent(task, reason string, batch *model.Batch, rows int, err error) *ErrorEvent {
+	ev := &ErrorEvent{
+		Task:   task,
+		Reason: reason,
+		Error:  err.Error(),
+		Rows:   rows,
+	}
+	if batch.Group != nil {
+		ev.Offsets = batch.Group.Offsets
+	}
+	return ev
+}
+
+// ErrorPublisher produces error events to Kafka asynchronously. Events are dropped rather than blocking sinking if the
+// rate limit or the producer queue is full.
+type ErrorPublisher struct {
+	topic    string
+	instance string
+	producer sarama.AsyncProducer
+	limiter  *rate.Limiter
+	wg       sync.WaitGroup
+}
+
+var (
+	errPubMux sync.RWMutex
+	errPub    *ErrorPublisher
+)
+
+func NewErrorPublisher(kfkCfg *config.KafkaConfig, evCfg config.ErrorEventsConfig, instance string) (p *ErrorPublisher, err error) {
+	var sarCfg *sarama.Config
+	if sarCfg, err = input.GetSaramaConfig(kfkCfg); err != nil {
+		return
+	}
+	sarCfg.Producer.RequiredAcks = sarama.WaitForLocal
+	sarCfg.Producer.Return.Successes = false
+	sarCfg.Producer.Return.Errors = true
+	p = &ErrorPublisher{
+		topic:    evCfg.Topic,
+		instance: instance,
+		limiter:  rate.NewLimiter(rate.Limit(evCfg.MaxPerSecond), evCfg.MaxPerSecond),
+	}
+	if p.producer, err = sarama.NewAsyncProducer(strings.Split(kfkCfg.Brokers, ","), sarCfg); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	p.wg.Add(1)
+	go p.drainErrors()
+	util.Logger.Info("publishing error events", zap.String("topic", p.topic))
+	return
+}
+
+func (p *ErrorPublisher) drainErrors() {
+	defer p.wg.Done()
+	limiter := rate.NewLimiter(rate.Every(10*time.Second), 1)
+	for perr := range p.producer.Errors() {
+		task, _ := perr.Msg.Metadata.(string)
+		statistics.ErrorEventsDroppedTotal.WithLabelValues(task).Inc()
+		if limiter.Allow() {
+			util.Logger.Warn("failed to publish error event", zap.String("topic", p.topic), zap.Error(perr.Err))
+		}
+	}
+}
+
+func (p *ErrorPublisher) publish(ev *ErrorEvent) {
+	if !p.limiter.Allow() {
+		statistics.ErrorEventsDroppedTotal.WithLabelValues(ev.Task).Inc()
+		return
+	}
+	ev.Time = time.Now()
+	ev.Instance = p.instance
+	value, err := json.Marshal(ev)
+	if err != nil {
+		statistics.ErrorEventsDroppedTotal.WithLabelValues(ev.Task).Inc()
+		return
+	}
+	msg := &sarama.ProducerMessage{
+		Topic:    p.topic,
+		Key:      sarama.StringEncoder(ev.Task),
+		Value:    sarama.ByteEncoder(value),
+		Metadata: ev.Task,
+	}
+	select {
+	case p.producer.Input() <- msg:
+	default:
+		statistics.ErrorEventsDroppedTotal.WithLabelValues(ev.Task).Inc()
+	}
+}
+
+// Close flushes pending events.
+func (p *ErrorPublisher) Close() {
+	p.producer.AsyncClose()
+	p.wg.Wait()
+	util.Logger.Info("stopped publishing error events", zap.String("topic", p.topic))
+}
+
+// SetErrorPublisher replaces the publisher of PublishErrorEvent, nil disables publishing. The previous one is returned
+// for the caller to close.
+func SetErrorPublisher(p *ErrorPublisher) (prev *ErrorPublisher) {
+	errPubMux.Lock()
+	defer errPubMux.Unlock()
+	prev, errPub = errPub, p
+	return
+}
+
+// PublishErrorEvent publishes ev if error events are enabled.
+func PublishErrorEvent(ev *ErrorEvent) {
+	errPubMux.RLock()
+	defer errPubMux.RUnlock()
+	if errPub != nil {
+		errPub.publish(ev)
+	}
+}
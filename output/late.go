@@ -0,0 +1,93 @@
+package output
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/forever765/clickhouse_sinker_nali/config"
+	"github.com/forever765/clickhouse_sinker_nali/model"
+	"github.com/forever765/clickhouse_sinker_nali/statistics"
+	"github.com/forever765/clickhouse_sinker_nali/util"
+)
+
+// initLateData binds LateData to the time column, and prepares the INSERT of the late table.
+func (c *ClickHouse) initLateData(quotedDms, params []string) (err error) {
+	lc := &c.taskCfg.LateData
+	c.idxLateTime, c.lateSQL = -1, ""
+	if lc.TimeColumn == "" {
+		return
+	}
+	for i, dim := range c.Dims {
+		if dim.Name == lc.TimeColumn {
+			c.idxLateTime = i
+			break
+		}
+	}
+	if c.idxLateTime < 0 {
+		err = errors.Errorf("lateData: no such column %s", lc.TimeColumn)
+		return
+	}
+	if typ := c.Dims[c.idxLateTime].Type; typ != model.DateTime {
+		err = errors.Errorf("lateData: time column %s is %s instead of DateTime", lc.TimeColumn, model.GetTypeName(typ))
+		return
+	}
+	if lc.Policy == config.LatePolicyTable {
+		c.lateSQL = "INSERT INTO " + c.cfg.Clickhouse.DB + "." + lc.Table + " (" + strings.Join(quotedDms, ",") + ") " +
+			"VALUES (" + strings.Join(params, ",") + ")"
+		util.Logger.Info(fmt.Sprintf("Prepare sql of late rows=> %s", c.lateSQL), zap.String("task", c.taskCfg.Name))
+		// distributed tables of the late table are optional, since late rows are written to the local table
+		if c.cfg.Clickhouse.Cluster != "" {
+			if c.distLateTbls, err = c.getDistTbls(lc.Table); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// lateTable returns the late table which gets schema changes of the table, or empty if none.
+func (c *ClickHouse) lateTable() string {
+	if lc := &c.taskCfg.LateData; lc.TimeColumn != "" && lc.Policy == config.LatePolicyTable {
+		return lc.Table
+	}
+	return ""
+}
+
+// splitLate counts late rows of the batch, and drops them or moves them to LateRows by the policy. It's called once
+// before writing, so that retries don't route a row differently.
+func (c *ClickHouse) splitLate(batch *model.Batch) {
+	if c.idxLateTime < 0 {
+		return
+	}
+	lc := &c.taskCfg.LateData
+	deadline := time.Now().Add(-time.Duration(lc.Threshold) * time.Second)
+	rows := *batch.Rows
+	kept := rows[:0]
+	var late int
+	for _, row := range rows {
+		if t, ok := (*row)[c.idxLateTime].(time.Time); !ok || !t.Before(deadline) {
+			kept = append(kept, row)
+			continue
+		}
+		late++
+		switch lc.Policy {
+		case config.LatePolicyDrop:
+			model.PutRow(row)
+		case config.LatePolicyTable:
+			if batch.LateRows == nil {
+				batch.LateRows = model.GetRows()
+			}
+			*batch.LateRows = append(*batch.LateRows, row)
+		default:
+			kept = append(kept, row)
+		}
+	}
+	*batch.Rows = kept
+	if late != 0 {
+		statistics.LateRowsTotal.WithLabelValues(c.taskCfg.Name, lc.Policy).Add(float64(late))
+	}
+}
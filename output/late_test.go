@@ -0,0 +1,70 @@
+package output
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/forever765/clickhouse_sinker_nali/config"
+	"github.com/forever765/clickhouse_sinker_nali/model"
+)
+
+func TestSplitLate(t *testing.T) {
+	now := time.Now()
+	newBatch := func() *model.Batch {
+		batch := model.NewBatch()
+		for _, ts := range []time.Time{now, now.Add(-2 * time.Hour), now.Add(-time.Minute), now.Add(-3 * time.Hour)} {
+			row := model.Row{ts, "v"}
+			*batch.Rows = append(*batch.Rows, &row)
+		}
+		// a row without the time is never late
+		*batch.Rows = append(*batch.Rows, &model.Row{nil, "v"})
+		batch.RealSize = len(*batch.Rows)
+		return batch
+	}
+	times := func(rows *model.Rows) (ts []interface{}) {
+		for _, row := range *rows {
+			ts = append(ts, (*row)[0])
+		}
+		return
+	}
+	lc := config.LateDataConfig{TimeColumn: "time", Threshold: 3600}
+	c := &ClickHouse{taskCfg: &config.TaskConfig{Name: "test_split_late"}}
+
+	// disabled
+	c.idxLateTime = -1
+	batch := newBatch()
+	c.splitLate(batch)
+	require.Len(t, *batch.Rows, 5)
+
+	c.idxLateTime = 0
+	lc.Policy = config.LatePolicyWrite
+	c.taskCfg.LateData = lc
+	batch = newBatch()
+	c.splitLate(batch)
+	require.Len(t, *batch.Rows, 5)
+	require.Nil(t, batch.LateRows)
+	require.Equal(t, 5, batch.RealSize)
+
+	lc.Policy = config.LatePolicyDrop
+	c.taskCfg.LateData = lc
+	batch = newBatch()
+	c.splitLate(batch)
+	require.Equal(t, []interface{}{now, now.Add(-time.Minute), nil}, times(batch.Rows))
+	require.Nil(t, batch.LateRows)
+	// RealSize is kept, since a row may be the rollup of many messages by aggregate. Dropped rows are counted by
+	// LateRowsTotal instead.
+	require.Equal(t, 5, batch.RealSize)
+
+	lc.Policy = config.LatePolicyTable
+	lc.Table = "test_late"
+	c.taskCfg.LateData = lc
+	batch = newBatch()
+	c.splitLate(batch)
+	require.Equal(t, []interface{}{now, now.Add(-time.Minute), nil}, times(batch.Rows))
+	require.Equal(t, []interface{}{now.Add(-2 * time.Hour), now.Add(-3 * time.Hour)}, times(batch.LateRows))
+	// late rows are still messages of the batch
+	require.Equal(t, 5, batch.RealSize)
+	batch.Free()
+}
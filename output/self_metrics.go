@@ -0,0 +1,155 @@
+package output
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"go.uber.org/zap"
+
+	"github.com/forever765/clickhouse_sinker_nali/config"
+	"github.com/forever765/clickhouse_sinker_nali/model"
+	"github.com/forever765/clickhouse_sinker_nali/util"
+)
+
+const selfMetricPrefix = "clickhouse_sinker_"
+
+// SelfMetricsSink periodically writes internal metrics of each task to a ClickHouse table, which gives long-term
+// history without a separate TSDB. Counters are written as the increase during the interval, and gauges as is.
+type SelfMetricsSink struct {
+	insertSQL string
+	interval  time.Duration
+	instance  string
+	prev      map[selfMetricKey]float64 // counters at the previous round
+	round     int64                     // rounds are written to shards in turn
+	ctx       context.Context
+	cancel    context.CancelFunc
+	stopped   chan struct{}
+}
+
+type selfMetricKey struct {
+	task   string
+	metric string
+}
+
+func NewSelfMetricsSink(cfg *config.Config, instance string) *SelfMetricsSink {
+	smCfg := cfg.SelfMetrics
+	k := &SelfMetricsSink{
+		insertSQL: fmt.Sprintf("INSERT INTO %s.%s (timestamp, instance, task, metric, value) VALUES (?, ?, ?, ?, ?)",
+			cfg.Clickhouse.DB, smCfg.Table),
+		interval: time.Duration(smCfg.Interval) * time.Second,
+		instance: instance,
+		prev:     make(map[selfMetricKey]float64),
+		stopped:  make(chan struct{}),
+	}
+	k.ctx, k.cancel = context.WithCancel(context.Background())
+	return k
+}
+
+func (k *SelfMetricsSink) Run() {
+	util.Logger.Info("writing self metrics", zap.String("sql", k.insertSQL), zap.Duration("interval", k.interval))
+	ticker := time.NewTicker(k.interval)
+	defer ticker.Stop()
+	// The first round records counters only, since their increase before is unknown.
+	_, _ = k.collect()
+FOR:
+	for {
+		select {
+		case <-ticker.C:
+			if err := k.write(); err != nil {
+				util.Logger.Error("failed to write self metrics", zap.Error(err))
+			}
+		case <-k.ctx.Done():
+			break FOR
+		}
+	}
+	k.stopped <- struct{}{}
+}
+
+func (k *SelfMetricsSink) Stop() {
+	k.cancel()
+	<-k.stopped
+	util.Logger.Info("stopped writing self metrics")
+}
+
+func (k *SelfMetricsSink) collect() (rows model.Rows, err error) {
+	var mfs []*dto.MetricFamily
+	if mfs, err = prometheus.DefaultGatherer.Gather(); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	now := time.Now()
+	samples := taskMetrics(mfs, k.prev)
+	keys := make([]selfMetricKey, 0, len(samples))
+	for key := range samples {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].task != keys[j].task {
+			return keys[i].task < keys[j].task
+		}
+		return keys[i].metric < keys[j].metric
+	})
+	for _, key := range keys {
+		row := model.Row{now, k.instance, key.task, key.metric, samples[key]}
+		rows = append(rows, &row)
+	}
+	return
+}
+
+func (k *SelfMetricsSink) write() (err error) {
+	var rows model.Rows
+	if rows, err = k.collect(); err != nil || len(rows) == 0 {
+		return
+	}
+	k.round++
+	return InsertRows(k.round, k.insertSQL, rows)
+}
+
+// taskMetrics sums counters and gauges of sinker by the "task" label, so that other labels such as partition are
+// aggregated away. Counters are turned into the increase since prev, which is updated in place.
+func taskMetrics(mfs []*dto.MetricFamily, prev map[selfMetricKey]float64) (samples map[selfMetricKey]float64) {
+	samples = make(map[selfMetricKey]float64)
+	counters := make(map[selfMetricKey]float64)
+	for _, mf := range mfs {
+		if !strings.HasPrefix(mf.GetName(), selfMetricPrefix) {
+			continue
+		}
+		name := strings.TrimPrefix(mf.GetName(), selfMetricPrefix)
+		for _, m := range mf.GetMetric() {
+			var task string
+			for _, lp := range m.GetLabel() {
+				if lp.GetName() == "task" {
+					task = lp.GetValue()
+				}
+			}
+			if task == "" {
+				continue
+			}
+			key := selfMetricKey{task: task, metric: name}
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				counters[key] += m.GetCounter().GetValue()
+			case dto.MetricType_GAUGE:
+				samples[key] += m.GetGauge().GetValue()
+			}
+		}
+	}
+	for key, value := range counters {
+		if last, ok := prev[key]; ok && value >= last {
+			samples[key] = value - last
+		}
+		prev[key] = value
+	}
+	for key := range prev {
+		if _, ok := counters[key]; !ok {
+			delete(prev, key)
+		}
+	}
+	return
+}
@@ -34,7 +34,8 @@ var _ Parser = (*CsvParser)(nil)
 
 // CsvParser implementation to parse input from a CSV format per RFC 4180
 type CsvParser struct {
-	pp *Pool
+	pp     *Pool
+	metric CsvMetric // reused by each Parse
 }
 
 // Parse extract a list of comma-separated values from the data
@@ -53,12 +54,14 @@ func (p *CsvParser) Parse(bs []byte) (metric model.Metric, err error) {
 		err = errors.Errorf("csv value doesn't match the format")
 		return
 	}
-	metric = &CsvMetric{p.pp, value}
+	p.metric = CsvMetric{fallbacks: p.metric.fallbacks[:0], pp: p.pp, values: value}
+	metric = &p.metric
 	return
 }
 
 // CsvMetic
 type CsvMetric struct {
+	fallbacks
 	pp     *Pool
 	values []string
 }
@@ -68,6 +71,7 @@ func (c *CsvMetric) GetString(key string, nullable bool) (val interface{}) {
 	var idx int
 	var ok bool
 	if idx, ok = c.pp.csvFormat[key]; !ok || c.values[idx] == "null" {
+		c.fallback(key, true, nullable)
 		if nullable {
 			return
 		}
@@ -83,6 +87,7 @@ func (c *CsvMetric) GetFloat(key string, nullable bool) (val interface{}) {
 	var idx int
 	var ok bool
 	if idx, ok = c.pp.csvFormat[key]; !ok || c.values[idx] == "null" {
+		c.fallback(key, true, nullable)
 		if nullable {
 			return
 		}
@@ -98,6 +103,7 @@ func (c *CsvMetric) GetInt(key string, nullable bool) (val interface{}) {
 	var idx int
 	var ok bool
 	if idx, ok = c.pp.csvFormat[key]; !ok || c.values[idx] == "null" {
+		c.fallback(key, true, nullable)
 		if nullable {
 			return
 		}
@@ -116,6 +122,7 @@ func (c *CsvMetric) GetDateTime(key string, nullable bool) (val interface{}) {
 	var idx int
 	var ok bool
 	if idx, ok = c.pp.csvFormat[key]; !ok || c.values[idx] == "null" {
+		c.fallback(key, true, nullable)
 		if nullable {
 			return
 		}
@@ -126,6 +133,7 @@ func (c *CsvMetric) GetDateTime(key string, nullable bool) (val interface{}) {
 	if dd, err := strconv.ParseFloat(s, 64); err != nil {
 		var err error
 		if val, err = c.pp.ParseDateTime(key, s); err != nil {
+			c.fallback(key, false, nullable)
 			val = Epoch
 		}
 	} else {
@@ -202,6 +210,7 @@ func (c *CsvMetric) GetArray(key string, typ int) (val interface{}) {
 		}
 		val = results
 	case model.DateTime:
+		var invalid bool
 		results := make([]time.Time, 0, len(array))
 		for _, e := range array {
 			var t time.Time
@@ -216,8 +225,14 @@ func (c *CsvMetric) GetArray(key string, typ int) (val interface{}) {
 			default:
 				t = Epoch
 			}
+			if t == Epoch {
+				invalid = true
+			}
 			results = append(results, t)
 		}
+		if invalid {
+			c.fallback(key, false, false)
+		}
 		val = results
 	default:
 		util.Logger.Fatal(fmt.Sprintf("LOGIC ERROR: unsupported array type %v", typ))
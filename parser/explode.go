@@ -0,0 +1,74 @@
+package parser
+
+import (
+	"github.com/pkg/errors"
+	"github.com/valyala/fastjson"
+
+	"github.com/forever765/clickhouse_sinker_nali/config"
+)
+
+// Exploder splits a JSON message into a message per element of an array field, so that each element is written as a
+// row. It's safe for concurrent use.
+type Exploder struct {
+	field     string
+	prefix    string
+	keepEmpty bool
+	pool      fastjson.ParserPool
+	arenas    fastjson.ArenaPool
+}
+
+// NewExploder creates an Exploder of the config.
+func NewExploder(explodeCfg *config.ExplodeConfig) *Exploder {
+	return &Exploder{field: explodeCfg.Field, prefix: explodeCfg.Prefix, keepEmpty: explodeCfg.KeepEmpty}
+}
+
+// Explode returns a message per element of the array field. Fields of an object element, with the prefix, are merged
+// into fields of the parent and take precedence. Other elements replace the array field. If the array is empty or
+// absent, the parent without the field is returned if keepEmpty, otherwise nothing.
+func (e *Exploder) Explode(value []byte) (values [][]byte, err error) {
+	p := e.pool.Get()
+	defer e.pool.Put(p)
+	var v *fastjson.Value
+	if v, err = p.ParseBytes(value); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	var parent *fastjson.Object
+	if parent, err = v.Object(); err != nil {
+		err = errors.Errorf("message is not a JSON object")
+		return
+	}
+	var elems []*fastjson.Value
+	if arr := parent.Get(e.field); arr != nil && arr.Type() != fastjson.TypeNull {
+		if elems, err = arr.Array(); err != nil {
+			err = errors.Errorf("field %s is a %s instead of an array", e.field, arr.Type())
+			return
+		}
+	}
+	parent.Del(e.field)
+	if len(elems) == 0 {
+		if e.keepEmpty {
+			values = append(values, v.MarshalTo(nil))
+		}
+		return
+	}
+	a := e.arenas.Get()
+	defer e.arenas.Put(a)
+	for _, elem := range elems {
+		a.Reset()
+		row := a.NewObject()
+		obj, _ := row.Object()
+		parent.Visit(func(key []byte, v *fastjson.Value) {
+			obj.Set(string(key), v)
+		})
+		if elemObj, errObj := elem.Object(); errObj == nil {
+			elemObj.Visit(func(key []byte, v *fastjson.Value) {
+				obj.Set(e.prefix+string(key), v)
+			})
+		} else {
+			obj.Set(e.field, elem)
+		}
+		values = append(values, row.MarshalTo(nil))
+	}
+	return
+}
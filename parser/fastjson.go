@@ -32,8 +32,9 @@ var _ Parser = (*FastjsonParser)(nil)
 
 // FastjsonParser, parser for get data in json format
 type FastjsonParser struct {
-	pp  *Pool
-	fjp fastjson.Parser
+	pp     *Pool
+	fjp    fastjson.Parser
+	metric FastjsonMetric // reused by each Parse, as the value is owned by fjp anyway
 }
 
 func (p *FastjsonParser) Parse(bs []byte) (metric model.Metric, err error) {
@@ -42,11 +43,16 @@ func (p *FastjsonParser) Parse(bs []byte) (metric model.Metric, err error) {
 		err = errors.Wrapf(err, "")
 		return
 	}
-	metric = &FastjsonMetric{pp: p.pp, value: value}
+	if p.pp.renamer != nil {
+		p.pp.renamer.renameFastjson(value)
+	}
+	p.metric = FastjsonMetric{fallbacks: p.metric.fallbacks[:0], pp: p.pp, value: value}
+	metric = &p.metric
 	return
 }
 
 type FastjsonMetric struct {
+	fallbacks
 	pp    *Pool
 	value *fastjson.Value
 }
@@ -54,6 +60,7 @@ type FastjsonMetric struct {
 func (c *FastjsonMetric) GetString(key string, nullable bool) (val interface{}) {
 	v := c.value.Get(key)
 	if v == nil || v.Type() == fastjson.TypeNull {
+		c.fallback(key, true, nullable)
 		if nullable {
 			return
 		}
@@ -73,10 +80,22 @@ func (c *FastjsonMetric) GetString(key string, nullable bool) (val interface{})
 func (c *FastjsonMetric) GetFloat(key string, nullable bool) (val interface{}) {
 	v := c.value.Get(key)
 	if !fjCompatibleFloat(v) {
+		switch {
+		case fjMissing(v), v.Type() == fastjson.TypeTrue, v.Type() == fastjson.TypeFalse:
+			c.fallback(key, fjMissing(v), nullable)
+		default:
+			if f, ok := c.coerceString(v); ok {
+				c.widen(key, model.String, true)
+				val = f
+				return
+			}
+			c.widen(key, model.String, false)
+		}
 		val = getDefaultFloat(nullable)
 		return
 	}
 	if val2, err := v.Float64(); err != nil {
+		c.fallback(key, false, nullable)
 		val = getDefaultFloat(nullable)
 	} else {
 		val = val2
@@ -87,6 +106,15 @@ func (c *FastjsonMetric) GetFloat(key string, nullable bool) (val interface{}) {
 func (c *FastjsonMetric) GetInt(key string, nullable bool) (val interface{}) {
 	v := c.value.Get(key)
 	if !fjCompatibleInt(v) {
+		if fjMissing(v) {
+			c.fallback(key, true, nullable)
+		} else if f, ok := c.coerceString(v); ok {
+			c.widen(key, model.String, true)
+			val = coerceInt(f)
+			return
+		} else {
+			c.widen(key, model.String, false)
+		}
 		val = getDefaultInt(nullable)
 		return
 	}
@@ -96,18 +124,35 @@ func (c *FastjsonMetric) GetInt(key string, nullable bool) (val interface{}) {
 	case fastjson.TypeFalse:
 		val = int64(0)
 	default:
-		if val2, err := v.Int64(); err != nil {
+		if val2, err := v.Int64(); err == nil {
+			val = val2
+		} else if f, err := v.Float64(); err != nil {
+			c.fallback(key, false, nullable)
 			val = getDefaultInt(nullable)
+		} else if c.pp.coerce {
+			// a fraction, or beyond the range of Int64
+			c.widen(key, model.Float, true)
+			val = coerceInt(f)
 		} else {
-			val = val2
+			c.widen(key, model.Float, false)
+			val = getDefaultInt(nullable)
 		}
 	}
 	return
 }
 
+// coerceString returns the number of a numeric string, if the pool coerces.
+func (c *FastjsonMetric) coerceString(v *fastjson.Value) (f float64, ok bool) {
+	if !c.pp.coerce || v.Type() != fastjson.TypeString {
+		return
+	}
+	return coerceNumber(string(v.GetStringBytes()))
+}
+
 func (c *FastjsonMetric) GetDateTime(key string, nullable bool) (val interface{}) {
 	v := c.value.Get(key)
 	if !fjCompatibleDateTime(v) {
+		c.fallback(key, fjMissing(v), nullable)
 		val = getDefaultDateTime(nullable)
 		return
 	}
@@ -116,6 +161,7 @@ func (c *FastjsonMetric) GetDateTime(key string, nullable bool) (val interface{}
 	case fastjson.TypeNumber:
 		var f float64
 		if f, err = v.Float64(); err != nil {
+			c.fallback(key, false, nullable)
 			val = getDefaultDateTime(nullable)
 			return
 		}
@@ -123,13 +169,16 @@ func (c *FastjsonMetric) GetDateTime(key string, nullable bool) (val interface{}
 	case fastjson.TypeString:
 		var b []byte
 		if b, err = v.StringBytes(); err != nil || len(b) == 0 {
+			c.fallback(key, err == nil, nullable)
 			val = getDefaultDateTime(nullable)
 			return
 		}
 		if val, err = c.pp.ParseDateTime(key, string(b)); err != nil {
+			c.fallback(key, false, nullable)
 			val = getDefaultDateTime(nullable)
 		}
 	default:
+		c.fallback(key, false, nullable)
 		val = getDefaultDateTime(nullable)
 	}
 	return
@@ -181,6 +230,7 @@ func (c *FastjsonMetric) GetArray(key string, typ int) (val interface{}) {
 			val = append(val.([]string), s)
 		}
 	case model.DateTime:
+		var invalid bool
 		for _, e := range array {
 			var t time.Time
 			switch e.Type() {
@@ -202,8 +252,14 @@ func (c *FastjsonMetric) GetArray(key string, typ int) (val interface{}) {
 			default:
 				t = Epoch
 			}
+			if t == Epoch {
+				invalid = true
+			}
 			val = append(val.([]time.Time), t)
 		}
+		if invalid {
+			c.fallback(key, false, false)
+		}
 	default:
 		util.Logger.Fatal(fmt.Sprintf("LOGIC ERROR: unsupported array type %v", typ))
 	}
@@ -236,6 +292,10 @@ func (c *FastjsonMetric) GetNewKeys(knownKeys, newKeys *sync.Map, white, black *
 	return
 }
 
+func fjMissing(v *fastjson.Value) bool {
+	return v == nil || v.Type() == fastjson.TypeNull
+}
+
 func fjCompatibleInt(v *fastjson.Value) (ok bool) {
 	if v == nil {
 		return
@@ -31,15 +31,22 @@ import (
 var _ Parser = (*GjsonParser)(nil)
 
 type GjsonParser struct {
-	pp *Pool
+	pp     *Pool
+	metric GjsonMetric // reused by each Parse
 }
 
 func (p *GjsonParser) Parse(bs []byte) (metric model.Metric, err error) {
-	metric = &GjsonMetric{p.pp, string(bs)}
+	raw := string(bs)
+	if p.pp.renamer != nil {
+		raw = p.pp.renamer.renameGjson(raw)
+	}
+	p.metric = GjsonMetric{fallbacks: p.metric.fallbacks[:0], pp: p.pp, raw: raw}
+	metric = &p.metric
 	return
 }
 
 type GjsonMetric struct {
+	fallbacks
 	pp  *Pool
 	raw string
 }
@@ -47,6 +54,7 @@ type GjsonMetric struct {
 func (c *GjsonMetric) GetString(key string, nullable bool) (val interface{}) {
 	r := gjson.Get(c.raw, key)
 	if !r.Exists() || r.Type == gjson.Null {
+		c.fallback(key, true, nullable)
 		if nullable {
 			return
 		}
@@ -67,6 +75,17 @@ func (c *GjsonMetric) GetString(key string, nullable bool) (val interface{}) {
 func (c *GjsonMetric) GetFloat(key string, nullable bool) (val interface{}) {
 	r := gjson.Get(c.raw, key)
 	if !gjCompatibleFloat(r) {
+		switch {
+		case gjMissing(r), r.Type == gjson.True, r.Type == gjson.False:
+			c.fallback(key, gjMissing(r), nullable)
+		default:
+			if f, ok := c.coerceString(r); ok {
+				c.widen(key, model.String, true)
+				val = f
+				return
+			}
+			c.widen(key, model.String, false)
+		}
 		val = getDefaultFloat(nullable)
 		return
 	}
@@ -74,6 +93,7 @@ func (c *GjsonMetric) GetFloat(key string, nullable bool) (val interface{}) {
 	case gjson.Number:
 		val = r.Num
 	default:
+		c.fallback(key, false, nullable)
 		val = getDefaultFloat(nullable)
 	}
 	return
@@ -82,6 +102,15 @@ func (c *GjsonMetric) GetFloat(key string, nullable bool) (val interface{}) {
 func (c *GjsonMetric) GetInt(key string, nullable bool) (val interface{}) {
 	r := gjson.Get(c.raw, key)
 	if !gjCompatibleInt(r) {
+		if gjMissing(r) {
+			c.fallback(key, true, nullable)
+		} else if f, ok := c.coerceString(r); ok {
+			c.widen(key, model.String, true)
+			val = coerceInt(f)
+			return
+		} else {
+			c.widen(key, model.String, false)
+		}
 		val = getDefaultInt(nullable)
 		return
 	}
@@ -91,20 +120,35 @@ func (c *GjsonMetric) GetInt(key string, nullable bool) (val interface{}) {
 	case gjson.False:
 		val = int64(0)
 	case gjson.Number:
-		if v := r.Int(); float64(v) != r.Num {
-			val = getDefaultInt(nullable)
-		} else {
+		if v := r.Int(); float64(v) == r.Num {
 			val = v
+		} else if c.pp.coerce {
+			// a fraction, or beyond the range of Int64
+			c.widen(key, model.Float, true)
+			val = coerceInt(r.Num)
+		} else {
+			c.widen(key, model.Float, false)
+			val = getDefaultInt(nullable)
 		}
 	default:
+		c.fallback(key, false, nullable)
 		val = getDefaultInt(nullable)
 	}
 	return
 }
 
+// coerceString returns the number of a numeric string, if the pool coerces.
+func (c *GjsonMetric) coerceString(r gjson.Result) (f float64, ok bool) {
+	if !c.pp.coerce || r.Type != gjson.String {
+		return
+	}
+	return coerceNumber(r.Str)
+}
+
 func (c *GjsonMetric) GetDateTime(key string, nullable bool) (val interface{}) {
 	r := gjson.Get(c.raw, key)
 	if !gjCompatibleDateTime(r) {
+		c.fallback(key, gjMissing(r), nullable)
 		val = getDefaultDateTime(nullable)
 		return
 	}
@@ -114,9 +158,11 @@ func (c *GjsonMetric) GetDateTime(key string, nullable bool) (val interface{}) {
 	case gjson.String:
 		var err error
 		if val, err = c.pp.ParseDateTime(key, r.Str); err != nil {
+			c.fallback(key, false, nullable)
 			val = getDefaultDateTime(nullable)
 		}
 	default:
+		c.fallback(key, false, nullable)
 		val = getDefaultDateTime(nullable)
 	}
 	return
@@ -184,6 +230,7 @@ func (c *GjsonMetric) GetArray(key string, typ int) (val interface{}) {
 		}
 		val = results
 	case model.DateTime:
+		var invalid bool
 		results := make([]time.Time, 0, len(array))
 		for _, e := range array {
 			var t time.Time
@@ -198,8 +245,14 @@ func (c *GjsonMetric) GetArray(key string, typ int) (val interface{}) {
 			default:
 				t = Epoch
 			}
+			if t == Epoch {
+				invalid = true
+			}
 			results = append(results, t)
 		}
+		if invalid {
+			c.fallback(key, false, false)
+		}
 		val = results
 	default:
 		util.Logger.Fatal(fmt.Sprintf("LOGIC ERROR: unsupported array type %v", typ))
@@ -229,6 +282,10 @@ func (c *GjsonMetric) GetNewKeys(knownKeys, newKeys *sync.Map, white, black *reg
 	return
 }
 
+func gjMissing(r gjson.Result) bool {
+	return !r.Exists() || r.Type == gjson.Null
+}
+
 func gjCompatibleInt(r gjson.Result) (ok bool) {
 	if !r.Exists() {
 		return
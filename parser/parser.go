@@ -17,9 +17,12 @@ package parser
 import (
 	"fmt"
 	"math"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/forever765/clickhouse_sinker_nali/config"
 	"github.com/forever765/clickhouse_sinker_nali/model"
 	"github.com/forever765/clickhouse_sinker_nali/util"
 	"github.com/pkg/errors"
@@ -65,7 +68,57 @@ var (
 	ErrParseDateTime = errors.Errorf("value doesn't contain DateTime")
 )
 
-// Parse is the Parser interface
+// fallbacks records fields of a metric which have been written as default values.
+type fallbacks []model.Fallback
+
+func (f fallbacks) Fallbacks() []model.Fallback {
+	return f
+}
+
+// fallback records key unless it's missing and nullable, which is written as null.
+func (f *fallbacks) fallback(key string, missing, nullable bool) {
+	reason := model.FallbackInvalid
+	if missing {
+		if nullable {
+			return
+		}
+		reason = model.FallbackMissing
+	}
+	*f = append(*f, model.Fallback{Key: key, Reason: reason})
+}
+
+// widen records key of which the value doesn't fit the column, but would if the column were widened to typ. coerced
+// tells whether the value has been converted with loss instead of written as the default value.
+func (f *fallbacks) widen(key string, typ int, coerced bool) {
+	reason := model.FallbackInvalid
+	if coerced {
+		reason = model.FallbackCoerced
+	}
+	*f = append(*f, model.Fallback{Key: key, Reason: reason, Widen: typ})
+}
+
+// coerceNumber parses a string value of a numeric column for TypeWidening "coerce". NaN and infinities aren't coerced.
+func coerceNumber(s string) (f float64, ok bool) {
+	var err error
+	if f, err = strconv.ParseFloat(strings.TrimSpace(s), 64); err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+		return
+	}
+	return f, true
+}
+
+// coerceInt truncates f towards zero, and clips it to the range of Int64.
+func coerceInt(f float64) int64 {
+	switch {
+	case f >= math.MaxInt64:
+		return math.MaxInt64
+	case f <= math.MinInt64:
+		return math.MinInt64
+	}
+	return int64(f)
+}
+
+// Parse is the Parser interface. The metric returned by Parse is owned by the Parser, and is only valid until the next
+// Parse or putting the Parser back to its pool.
 type Parser interface {
 	Parse(bs []byte) (metric model.Metric, err error)
 }
@@ -78,6 +131,8 @@ type Pool struct {
 	timeZone     *time.Location
 	timeUnit     float64
 	knownLayouts sync.Map
+	renamer      *renamer
+	coerce       bool // see config.TaskConfig.TypeWidening
 	pool         sync.Pool
 }
 
@@ -133,6 +188,12 @@ func (pp *Pool) Put(p Parser) {
 	pp.pool.Put(p)
 }
 
+// SetTypeWidening makes parsers of pp convert numbers and numeric strings of Int and Float columns with loss, instead
+// of getting the default value, if policy is "coerce".
+func (pp *Pool) SetTypeWidening(policy string) {
+	pp.coerce = policy == config.TypeWideningCoerce
+}
+
 // Assuming that all values of a field of kafka message has the same layout, and layouts of each field are unrelated.
 // Automatically detect the layout from till the first successful detection and reuse that layout forever.
 // Return time in UTC.
@@ -26,6 +26,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/forever765/clickhouse_sinker_nali/config"
 	"github.com/forever765/clickhouse_sinker_nali/model"
 	"github.com/forever765/clickhouse_sinker_nali/util"
 	"github.com/stretchr/testify/assert"
@@ -697,6 +698,144 @@ func TestGjsonDetectSchema(t *testing.T) {
 	require.Equal(t, jsonSchema, act)
 }
 
+func TestParserFallbacks(t *testing.T) {
+	sample := []byte(`{"its":"abc","fts":12.5,"dt":"not a time","nts":null,"dts":["2009-07-13","oops"]}`)
+	exp := []model.Fallback{
+		{Key: "its", Reason: model.FallbackInvalid, Widen: model.String},
+		{Key: "absent", Reason: model.FallbackMissing},
+		{Key: "dt", Reason: model.FallbackInvalid},
+		{Key: "nts", Reason: model.FallbackMissing},
+		{Key: "dts", Reason: model.FallbackInvalid},
+	}
+	for _, name := range []string{"fastjson", "gjson"} {
+		pp, _ := NewParserPool(name, nil, "", "", timeUnit)
+		parser := pp.Get()
+		metric, err := parser.Parse(sample)
+		require.Nil(t, err)
+		metric.GetInt("its", true)
+		metric.GetFloat("fts", false)
+		metric.GetString("absent", false)
+		metric.GetFloat("absent", true) // a missing nullable field is written as null
+		metric.GetDateTime("dt", false)
+		metric.GetInt("nts", false)
+		metric.GetArray("dts", model.DateTime)
+		require.Equal(t, exp, metric.Fallbacks(), name)
+		// the metric is reused by the next Parse
+		metric, err = parser.Parse([]byte(`{"its":1}`))
+		require.Nil(t, err)
+		require.Equal(t, int64(1), metric.GetInt("its", false), name)
+		require.Empty(t, metric.Fallbacks(), name)
+		pp.Put(parser)
+	}
+}
+
+func TestTypeWidening(t *testing.T) {
+	sample := []byte(`{"frac":12.7,"big":1e20,"str":" -3.5 ","word":"abc","obj":{"a":1},"flag":true}`)
+	for _, name := range []string{"fastjson", "gjson"} {
+		pp, _ := NewParserPool(name, nil, "", "", timeUnit)
+		parser := pp.Get()
+		metric, err := parser.Parse(sample)
+		require.Nil(t, err)
+		require.Equal(t, int64(0), metric.GetInt("frac", false), name)
+		require.Equal(t, float64(0), metric.GetFloat("str", false), name)
+		require.Equal(t, float64(0), metric.GetFloat("flag", false), name)
+		require.Equal(t, []model.Fallback{
+			{Key: "frac", Reason: model.FallbackInvalid, Widen: model.Float},
+			{Key: "str", Reason: model.FallbackInvalid, Widen: model.String},
+			{Key: "flag", Reason: model.FallbackInvalid},
+		}, metric.Fallbacks(), name)
+		pp.Put(parser)
+
+		pp.SetTypeWidening(config.TypeWideningCoerce)
+		parser = pp.Get()
+		metric, err = parser.Parse(sample)
+		require.Nil(t, err)
+		require.Equal(t, int64(12), metric.GetInt("frac", false), name)
+		require.Equal(t, int64(math.MaxInt64), metric.GetInt("big", false), name)
+		require.Equal(t, int64(-3), metric.GetInt("str", false), name)
+		require.Equal(t, -3.5, metric.GetFloat("str", false), name)
+		require.Equal(t, int64(0), metric.GetInt("word", false), name)
+		require.Nil(t, metric.GetFloat("obj", true), name)
+		require.Equal(t, []model.Fallback{
+			{Key: "frac", Reason: model.FallbackCoerced, Widen: model.Float},
+			{Key: "big", Reason: model.FallbackCoerced, Widen: model.Float},
+			{Key: "str", Reason: model.FallbackCoerced, Widen: model.String},
+			{Key: "str", Reason: model.FallbackCoerced, Widen: model.String},
+			{Key: "word", Reason: model.FallbackInvalid, Widen: model.String},
+			{Key: "obj", Reason: model.FallbackInvalid, Widen: model.String},
+		}, metric.Fallbacks(), name)
+		pp.Put(parser)
+	}
+}
+
+func TestRenameFields(t *testing.T) {
+	renames := map[string]string{"@timestamp": "ts", "host": "hostname"}
+	prefixes := []string{"@", "attr_"}
+	for _, name := range []string{"fastjson", "gjson"} {
+		pp, _ := NewParserPool(name, nil, "", "", timeUnit)
+		pp.SetRenameFields(renames, prefixes)
+		parser := pp.Get()
+		metric, err := parser.Parse([]byte(`{"@timestamp":1,"host":"a","hostname":"b","@level":"warn","attr_id":2,"@":3,"msg":"x"}`))
+		require.Nil(t, err, name)
+		require.Equal(t, int64(1), metric.GetInt("ts", false), name)
+		require.Equal(t, "a", metric.GetString("hostname", false), name)
+		require.Equal(t, "warn", metric.GetString("level", false), name)
+		require.Equal(t, int64(2), metric.GetInt("id", false), name)
+		require.Equal(t, int64(3), metric.GetInt("@", false), name)
+		require.Equal(t, "x", metric.GetString("msg", false), name)
+		require.Nil(t, metric.GetString("@level", true), name)
+
+		var knownKeys, newKeys sync.Map
+		metric.GetNewKeys(&knownKeys, &newKeys, nil, nil)
+		var keys []string
+		newKeys.Range(func(key, _ interface{}) bool {
+			keys = append(keys, key.(string))
+			return true
+		})
+		require.ElementsMatch(t, []string{"ts", "hostname", "level", "id", "@", "msg"}, keys, name)
+		pp.Put(parser)
+	}
+
+	pp, _ := NewParserPool("csv", []string{"@timestamp", "attr_id"}, ",", "", timeUnit)
+	pp.SetRenameFields(renames, prefixes)
+	parser := pp.Get()
+	metric, err := parser.Parse([]byte(`1,2`))
+	require.Nil(t, err)
+	require.Equal(t, int64(1), metric.GetInt("ts", false))
+	require.Equal(t, int64(2), metric.GetInt("id", false))
+}
+
+func TestExplode(t *testing.T) {
+	e := NewExploder(&config.ExplodeConfig{Field: "items", Prefix: "item_"})
+	values, err := e.Explode([]byte(`{"order":1,"items":[{"sku":"a","qty":2},{"sku":"b","order":9}],"user":"u"}`))
+	require.Nil(t, err)
+	require.Len(t, values, 2)
+	require.JSONEq(t, `{"order":1,"user":"u","item_sku":"a","item_qty":2}`, string(values[0]))
+	require.JSONEq(t, `{"order":1,"user":"u","item_sku":"b","item_order":9}`, string(values[1]))
+
+	// scalars replace the array field, and fields of elements take precedence without prefix
+	e = NewExploder(&config.ExplodeConfig{Field: "tags"})
+	values, err = e.Explode([]byte(`{"id":1,"tags":["x",2,{"id":3}]}`))
+	require.Nil(t, err)
+	require.Len(t, values, 3)
+	require.JSONEq(t, `{"id":1,"tags":"x"}`, string(values[0]))
+	require.JSONEq(t, `{"id":1,"tags":2}`, string(values[1]))
+	require.JSONEq(t, `{"id":3}`, string(values[2]))
+
+	values, err = e.Explode([]byte(`{"id":1,"tags":[]}`))
+	require.Nil(t, err)
+	require.Empty(t, values)
+	e = NewExploder(&config.ExplodeConfig{Field: "tags", KeepEmpty: true})
+	values, err = e.Explode([]byte(`{"id":1,"tags":null}`))
+	require.Nil(t, err)
+	require.Equal(t, []string{`{"id":1}`}, []string{string(values[0])})
+
+	_, err = e.Explode([]byte(`{"id":1,"tags":"x"}`))
+	require.NotNil(t, err)
+	_, err = e.Explode([]byte(`[1]`))
+	require.NotNil(t, err)
+}
+
 func BenchmarkUnmarshalljson(b *testing.B) {
 	object := map[string]interface{}{}
 	for i := 0; i < b.N; i++ {
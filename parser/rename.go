@@ -0,0 +1,113 @@
+package parser
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/tidwall/gjson"
+	"github.com/valyala/fastjson"
+)
+
+// renamer maps names of top-level fields into names of columns, by RenameFields and StripPrefixes of a task.
+type renamer struct {
+	renames  map[string]string
+	prefixes []string
+}
+
+// SetRenameFields makes parsers of pp rename top-level fields after parsing. A field in renames is renamed to the
+// mapped name, otherwise the first matched prefix is stripped. A renamed field replaces a field of the same name.
+func (pp *Pool) SetRenameFields(renames map[string]string, prefixes []string) {
+	if len(renames) == 0 && len(prefixes) == 0 {
+		pp.renamer = nil
+		return
+	}
+	pp.renamer = &renamer{renames: renames, prefixes: prefixes}
+	if pp.csvFormat != nil {
+		csvFormat := make(map[string]int, len(pp.csvFormat))
+		for title, i := range pp.csvFormat {
+			if col, ok := pp.renamer.column(title); ok {
+				title = col
+			}
+			csvFormat[title] = i
+		}
+		pp.csvFormat = csvFormat
+	}
+}
+
+// column returns the new name of the field, and whether it's renamed.
+func (r *renamer) column(key string) (col string, ok bool) {
+	if col, ok = r.renames[key]; ok {
+		return
+	}
+	for _, prefix := range r.prefixes {
+		if len(key) > len(prefix) && strings.HasPrefix(key, prefix) {
+			return key[len(prefix):], true
+		}
+	}
+	return
+}
+
+func (r *renamer) renameFastjson(value *fastjson.Value) {
+	obj, err := value.Object()
+	if err != nil {
+		return
+	}
+	var keys []string
+	var vals []*fastjson.Value
+	obj.Visit(func(key []byte, v *fastjson.Value) {
+		if _, ok := r.column(string(key)); ok {
+			keys = append(keys, string(key))
+			vals = append(vals, v)
+		}
+	})
+	// delete all before setting, in case a field is renamed to another renamed field
+	for _, key := range keys {
+		obj.Del(key)
+	}
+	for i, key := range keys {
+		col, _ := r.column(key)
+		obj.Set(col, vals[i])
+	}
+}
+
+// renameGjson rewrites the raw message with renamed keys, since gjson gets fields from the raw message.
+func (r *renamer) renameGjson(raw string) string {
+	result := gjson.Parse(raw)
+	if !result.IsObject() {
+		return raw
+	}
+	var cols map[string]struct{}
+	result.ForEach(func(k, _ gjson.Result) bool {
+		if col, ok := r.column(k.Str); ok {
+			if cols == nil {
+				cols = make(map[string]struct{})
+			}
+			cols[col] = struct{}{}
+		}
+		return true
+	})
+	if cols == nil {
+		return raw
+	}
+	var b strings.Builder
+	b.Grow(len(raw))
+	b.WriteByte('{')
+	result.ForEach(func(k, v gjson.Result) bool {
+		key := k.Raw
+		if col, ok := r.column(k.Str); ok {
+			quoted, _ := json.Marshal(col)
+			key = string(quoted)
+		} else if _, replaced := cols[k.Str]; replaced {
+			return true
+		}
+		if b.Len() > 1 {
+			b.WriteByte(',')
+		}
+		b.WriteString(key)
+		b.WriteByte(':')
+		b.WriteString(v.Raw)
+		return true
+	})
+	b.WriteByte('}')
+	return b.String()
+}
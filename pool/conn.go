@@ -19,6 +19,7 @@ package pool
 // Clickhouse connection pool
 
 import (
+	"crypto/tls"
 	"database/sql"
 	"fmt"
 	"net/url"
@@ -26,6 +27,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/ClickHouse/clickhouse-go"
 	"github.com/forever765/clickhouse_sinker_nali/config"
 	"github.com/forever765/clickhouse_sinker_nali/health"
 	"github.com/forever765/clickhouse_sinker_nali/util"
@@ -34,6 +36,9 @@ import (
 	"go.uber.org/zap"
 )
 
+// tlsConfigName is the name of the tls.Config registered to clickhouse-go for certificates of ClickHouseConfig.
+const tlsConfigName = "clickhouse_sinker"
+
 var (
 	lock        sync.Mutex
 	clusterConn []*ShardConn
@@ -125,22 +130,29 @@ func (sc *ShardConn) NextGoodReplica(failedVer int) (db *sql.DB, dbVer int, err
 	return nil, sc.dbVer, err
 }
 
-func InitClusterConn(hosts [][]string, port int, db, username, password, dsnParams string, secure, skipVerify bool, maxOpenConns int) (err error) {
+func InitClusterConn(chCfg *config.ClickHouseConfig) (err error) {
 	lock.Lock()
 	defer lock.Unlock()
 	freeClusterConn()
 	// Each shard has a *sql.DB which connects to one replica inside the shard.
 	// "alt_hosts" tolerates replica single-point-failure. However more flexable switching is needed for some cases for example https://github.com/ClickHouse/ClickHouse/issues/24036.
 	dsnSuffix = fmt.Sprintf("?database=%s&username=%s&password=%s&block_size=%d",
-		url.QueryEscape(db), url.QueryEscape(username), url.QueryEscape(password), 2*config.MaxBufferSize)
-	if dsnParams != "" {
-		dsnSuffix += "&" + dsnParams
+		url.QueryEscape(chCfg.DB), url.QueryEscape(chCfg.Username), url.QueryEscape(chCfg.Password), 2*config.MaxBufferSize)
+	if chCfg.DsnParams != "" {
+		dsnSuffix += "&" + chCfg.DsnParams
 	}
-	if secure {
-		dsnSuffix += "&secure=true&skip_verify=" + strconv.FormatBool(skipVerify)
+	if chCfg.Secure {
+		dsnSuffix += "&secure=true&skip_verify=" + strconv.FormatBool(chCfg.InsecureSkipVerify)
+		if chCfg.CaCertFiles != "" || chCfg.ClientCertFile != "" {
+			if err = registerTLSConfig(chCfg); err != nil {
+				return
+			}
+			dsnSuffix += "&tls_config=" + tlsConfigName
+		}
 	}
 
-	for _, replicas := range hosts {
+	port, maxOpenConns := chCfg.Port, chCfg.MaxOpenConns
+	for _, replicas := range chCfg.Hosts {
 		numReplicas := len(replicas)
 		replicaAddrs := make([]string, numReplicas)
 		for i, ip := range replicas {
@@ -161,6 +173,18 @@ func InitClusterConn(hosts [][]string, port int, db, username, password, dsnPara
 	return
 }
 
+// registerTLSConfig registers certificates of chCfg to clickhouse-go as tlsConfigName.
+func registerTLSConfig(chCfg *config.ClickHouseConfig) (err error) {
+	var tlsConfig *tls.Config
+	if tlsConfig, err = util.NewTLSConfig(chCfg.CaCertFiles, chCfg.ClientCertFile, chCfg.ClientKeyFile, chCfg.ClientKeyPassword, chCfg.InsecureSkipVerify); err != nil {
+		return
+	}
+	if err = clickhouse.RegisterTLSConfig(tlsConfigName, tlsConfig); err != nil {
+		err = errors.Wrapf(err, "")
+	}
+	return
+}
+
 func freeClusterConn() {
 	for _, sc := range clusterConn {
 		sc.Close()
@@ -0,0 +1,136 @@
+// Package privacy hashes, masks or anonymizes values of columns before insert, so that tables fed from raw logs don't
+// keep personal data in clear.
+package privacy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/forever765/clickhouse_sinker_nali/config"
+	"github.com/forever765/clickhouse_sinker_nali/model"
+	"github.com/forever765/clickhouse_sinker_nali/util"
+)
+
+// Transformer applies privacy transforms to rows of a table, which is safe for concurrent use.
+type Transformer struct {
+	columns []column
+}
+
+type column struct {
+	idx int
+	fn  func(string) string
+}
+
+// New binds privacy transforms to columns of the table. Each column shall exist and be String or Array(String), so that
+// a schema change never lets personal data through silently.
+func New(privacyCfgs []config.PrivacyConfig, dims []*model.ColumnWithType) (t *Transformer, err error) {
+	t = &Transformer{}
+	for _, pc := range privacyCfgs {
+		idx := -1
+		for i, dim := range dims {
+			if dim.Name == pc.Column {
+				idx = i
+				break
+			}
+		}
+		if idx < 0 {
+			err = errors.Errorf("privacy transform of column %s: no such column", pc.Column)
+			return
+		}
+		if typ := dims[idx].Type; typ != model.String && typ != model.StringArray {
+			err = errors.Errorf("privacy transform of column %s: type %s isn't String or Array(String)", pc.Column, model.GetTypeName(typ))
+			return
+		}
+		var fn func(string) string
+		switch pc.Method {
+		case "hash":
+			var salt string
+			if salt, err = util.ResolveSecret(pc.Salt); err != nil {
+				return
+			}
+			fn = hasher(salt)
+		case "mask":
+			fn = masker(pc.KeepPrefix, pc.KeepSuffix, pc.MaskChar)
+		case "anonymizeIP":
+			fn = AnonymizeIP
+		default:
+			err = errors.Errorf("privacy transform of column %s: unknown method %q", pc.Column, pc.Method)
+			return
+		}
+		t.columns = append(t.columns, column{idx: idx, fn: fn})
+	}
+	return
+}
+
+// Apply transforms values of the row in place. Null and empty values are kept.
+func (t *Transformer) Apply(row model.Row) {
+	for _, col := range t.columns {
+		if col.idx >= len(row) {
+			continue
+		}
+		switch v := row[col.idx].(type) {
+		case string:
+			if v != "" {
+				row[col.idx] = col.fn(v)
+			}
+		case []string:
+			vals := make([]string, len(v))
+			for i, e := range v {
+				if e != "" {
+					e = col.fn(e)
+				}
+				vals[i] = e
+			}
+			row[col.idx] = vals
+		}
+	}
+}
+
+// hasher returns the hex of SHA-256 of salt and value.
+func hasher(salt string) func(string) string {
+	return func(s string) string {
+		h := sha256.New()
+		_, _ = h.Write([]byte(salt))
+		_, _ = h.Write([]byte(s))
+		return hex.EncodeToString(h.Sum(nil))
+	}
+}
+
+// masker replaces characters except keepPrefix ones at the beginning and keepSuffix ones at the end. A value not longer
+// than keepPrefix+keepSuffix is masked entirely.
+func masker(keepPrefix, keepSuffix int, maskChar string) func(string) string {
+	return func(s string) string {
+		runes := []rune(s)
+		prefix, suffix := keepPrefix, keepSuffix
+		if len(runes) <= prefix+suffix {
+			prefix, suffix = 0, 0
+		}
+		var b strings.Builder
+		b.Grow(len(s))
+		for i, r := range runes {
+			if i < prefix || i >= len(runes)-suffix {
+				b.WriteRune(r)
+			} else {
+				b.WriteString(maskChar)
+			}
+		}
+		return b.String()
+	}
+}
+
+// AnonymizeIP zeroes the last octet of an IPv4 address, or the last 64 bits of an IPv6 address. A value which isn't an
+// IP address is dropped as an empty string.
+func AnonymizeIP(s string) string {
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return ""
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(64, 128)).String()
+}
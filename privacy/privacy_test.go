@@ -0,0 +1,58 @@
+package privacy
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/forever765/clickhouse_sinker_nali/config"
+	"github.com/forever765/clickhouse_sinker_nali/model"
+)
+
+func TestApply(t *testing.T) {
+	dims := []*model.ColumnWithType{
+		{Name: "email", Type: model.String},
+		{Name: "phone", Type: model.String, Nullable: true},
+		{Name: "ip", Type: model.String},
+		{Name: "ips", Type: model.StringArray},
+		{Name: "bytes", Type: model.Int},
+	}
+	os.Setenv("TEST_PRIVACY_SALT", "pepper")
+	tr, err := New([]config.PrivacyConfig{
+		{Column: "email", Method: "hash", Salt: "env:TEST_PRIVACY_SALT"},
+		{Column: "phone", Method: "mask", KeepPrefix: 3, KeepSuffix: 2, MaskChar: "*"},
+		{Column: "ip", Method: "anonymizeIP"},
+		{Column: "ips", Method: "anonymizeIP"},
+	}, dims)
+	require.Nil(t, err)
+
+	ips := []string{"2001:db8:1:2:3:4:5:6", "", "bad"}
+	row := model.Row{"alice@example.com", "13812345678", "192.168.1.123", ips, int64(1)}
+	tr.Apply(row)
+	require.Len(t, row[0], 64)
+	require.Equal(t, hasher("pepper")("alice@example.com"), row[0])
+	require.NotEqual(t, hasher("")("alice@example.com"), row[0])
+	require.Equal(t, "138******78", row[1])
+	require.Equal(t, "192.168.1.0", row[2])
+	require.Equal(t, []string{"2001:db8:1:2::", "", ""}, row[3])
+	require.Equal(t, "2001:db8:1:2:3:4:5:6", ips[0]) // the array of the metric isn't changed
+	require.Equal(t, int64(1), row[4])
+
+	row = model.Row{"", nil, "10.0.0.1", []string{}, int64(1)}
+	tr.Apply(row)
+	require.Equal(t, "", row[0])
+	require.Nil(t, row[1])
+	require.Equal(t, "10.0.0.0", row[2])
+
+	// short values are masked entirely
+	require.Equal(t, "####", masker(3, 2, "#")("1234"))
+	require.Equal(t, "张**", masker(1, 0, "*")("张小明"))
+
+	_, err = New([]config.PrivacyConfig{{Column: "absent", Method: "hash"}}, dims)
+	require.NotNil(t, err)
+	_, err = New([]config.PrivacyConfig{{Column: "bytes", Method: "hash"}}, dims)
+	require.NotNil(t, err)
+	_, err = New([]config.PrivacyConfig{{Column: "email", Method: "hash", Salt: "env:TEST_PRIVACY_ABSENT"}}, dims)
+	require.NotNil(t, err)
+}
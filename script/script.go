@@ -0,0 +1,263 @@
+// Package script transforms messages with Lua scripts of tasks, for the long tail of transformations which don't
+// justify a Go code change.
+package script
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+
+	"github.com/forever765/clickhouse_sinker_nali/config"
+)
+
+// fnName is the function which the script shall define.
+const fnName = "transform"
+
+// maxExactInt is the largest magnitude of integers which Lua numbers(float64) represent exactly.
+const maxExactInt = 1 << 53
+
+// Transformer calls transform(row) of the script with fields of each message. row is a table which the function can
+// change in place or replace. The returned table is encoded as the new message, and nil or false drops the message.
+// Only the base, table, string and math libraries are available. Transformer is safe for concurrent use, each
+// goroutine runs the script in a Lua state of its own, so globals aren't shared between messages reliably.
+type Transformer struct {
+	proto   *lua.FunctionProto
+	timeout time.Duration
+
+	mux    sync.Mutex
+	states []*lua.LState // idle states
+}
+
+// NewTransformer compiles the script, and makes sure it defines transform.
+func NewTransformer(scriptCfg *config.ScriptConfig) (t *Transformer, err error) {
+	source, name := scriptCfg.Source, "<source>"
+	if scriptCfg.File != "" {
+		var b []byte
+		if b, err = ioutil.ReadFile(scriptCfg.File); err != nil {
+			err = errors.Wrapf(err, "")
+			return
+		}
+		source, name = string(b), scriptCfg.File
+	}
+	chunk, err := parse.Parse(bytes.NewReader([]byte(source)), name)
+	if err != nil {
+		err = errors.Wrapf(err, "script %s", name)
+		return
+	}
+	t = &Transformer{timeout: time.Duration(scriptCfg.Timeout) * time.Millisecond}
+	if t.proto, err = lua.Compile(chunk, name); err != nil {
+		err = errors.Wrapf(err, "script %s", name)
+		return
+	}
+	var L *lua.LState
+	if L, err = t.newState(); err != nil {
+		return
+	}
+	if L.GetGlobal(fnName).Type() != lua.LTFunction {
+		L.Close()
+		err = errors.Errorf("script %s doesn't define function %s", name, fnName)
+		return
+	}
+	t.put(L)
+	return
+}
+
+func (t *Transformer) newState() (L *lua.LState, err error) {
+	L = lua.NewState(lua.Options{SkipOpenLibs: true})
+	for _, lib := range []struct {
+		name string
+		fn   lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.fn))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	// no access to files
+	for _, name := range []string{"dofile", "loadfile"} {
+		L.SetGlobal(name, lua.LNil)
+	}
+	L.Push(L.NewFunctionFromProto(t.proto))
+	if err = L.PCall(0, lua.MultRet, nil); err != nil {
+		L.Close()
+		err = errors.Wrapf(err, "")
+	}
+	return
+}
+
+func (t *Transformer) get() (L *lua.LState, err error) {
+	t.mux.Lock()
+	if n := len(t.states); n != 0 {
+		L = t.states[n-1]
+		t.states = t.states[:n-1]
+	}
+	t.mux.Unlock()
+	if L == nil {
+		L, err = t.newState()
+	}
+	return
+}
+
+func (t *Transformer) put(L *lua.LState) {
+	t.mux.Lock()
+	t.states = append(t.states, L)
+	t.mux.Unlock()
+}
+
+// Close releases Lua states.
+func (t *Transformer) Close() {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	for _, L := range t.states {
+		L.Close()
+	}
+	t.states = nil
+}
+
+// Transform returns the transformed message, or nil if the script drops it.
+func (t *Transformer) Transform(value []byte) (result []byte, err error) {
+	var obj map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(value))
+	dec.UseNumber()
+	if err = dec.Decode(&obj); err != nil || obj == nil {
+		err = errors.Errorf("message is not a JSON object")
+		return
+	}
+	var L *lua.LState
+	if L, err = t.get(); err != nil {
+		return
+	}
+	if t.timeout > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), t.timeout)
+		defer cancel()
+		L.SetContext(ctx)
+	}
+	err = L.CallByParam(lua.P{Fn: L.GetGlobal(fnName), NRet: 1, Protect: true}, toLua(L, obj))
+	if err != nil {
+		// the state may be left inconsistent by a timeout
+		L.Close()
+		err = errors.Wrapf(err, "")
+		return
+	}
+	ret := L.Get(-1)
+	L.Pop(1)
+	L.RemoveContext()
+	t.put(L)
+	if lua.LVIsFalse(ret) {
+		return
+	}
+	tbl, ok := ret.(*lua.LTable)
+	if !ok {
+		err = errors.Errorf("%s returned a %s instead of a table or nil", fnName, ret.Type())
+		return
+	}
+	var row interface{}
+	if row, err = fromLua(tbl, true); err != nil {
+		return
+	}
+	fields, ok := row.(map[string]interface{})
+	if !ok {
+		err = errors.Errorf("%s returned an array instead of a table of fields", fnName)
+		return
+	}
+	// Lua numbers are float64, keep original texts of unchanged numbers such as 64 bits IDs.
+	for k, v := range fields {
+		if num, ok := v.(json.Number); ok {
+			if orig, ok := obj[k].(json.Number); ok && sameNumber(num, orig) {
+				fields[k] = orig
+			}
+		}
+	}
+	if result, err = json.Marshal(fields); err != nil {
+		err = errors.Wrapf(err, "")
+	}
+	return
+}
+
+func sameNumber(a, b json.Number) bool {
+	f1, err1 := a.Float64()
+	f2, err2 := b.Float64()
+	return err1 == nil && err2 == nil && f1 == f2
+}
+
+func toLua(L *lua.LState, v interface{}) lua.LValue {
+	switch v := v.(type) {
+	case bool:
+		return lua.LBool(v)
+	case json.Number:
+		f, _ := v.Float64()
+		return lua.LNumber(f)
+	case string:
+		return lua.LString(v)
+	case []interface{}:
+		tbl := L.CreateTable(len(v), 0)
+		for i, e := range v {
+			tbl.RawSetInt(i+1, toLua(L, e))
+		}
+		return tbl
+	case map[string]interface{}:
+		tbl := L.CreateTable(0, len(v))
+		for k, e := range v {
+			tbl.RawSetString(k, toLua(L, e))
+		}
+		return tbl
+	}
+	return lua.LNil
+}
+
+// fromLua converts a Lua value into a JSON value. A table whose keys are 1..n is an array, otherwise an object.
+// An empty table is an object if top, otherwise an array.
+func fromLua(v lua.LValue, top bool) (result interface{}, err error) {
+	switch v := v.(type) {
+	case lua.LBool:
+		return bool(v), nil
+	case lua.LNumber:
+		f := float64(v)
+		switch {
+		case math.IsNaN(f) || math.IsInf(f, 0):
+			return nil, nil
+		case f == math.Trunc(f) && math.Abs(f) <= maxExactInt:
+			return json.Number(strconv.FormatInt(int64(f), 10)), nil
+		default:
+			return json.Number(strconv.FormatFloat(f, 'g', -1, 64)), nil
+		}
+	case lua.LString:
+		return string(v), nil
+	case *lua.LTable:
+		n, keys := v.MaxN(), 0
+		v.ForEach(func(lua.LValue, lua.LValue) { keys++ })
+		if keys == 0 && top || keys != n {
+			obj := make(map[string]interface{}, keys)
+			v.ForEach(func(key, val lua.LValue) {
+				if err != nil {
+					return
+				}
+				obj[key.String()], err = fromLua(val, false)
+			})
+			return obj, err
+		}
+		arr := make([]interface{}, n)
+		for i := range arr {
+			if arr[i], err = fromLua(v.RawGetInt(i+1), false); err != nil {
+				return
+			}
+		}
+		return arr, nil
+	case *lua.LNilType:
+		return nil, nil
+	}
+	return nil, errors.Errorf("%s can't be converted to JSON", v.Type())
+}
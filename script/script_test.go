@@ -0,0 +1,61 @@
+package script
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/forever765/clickhouse_sinker_nali/config"
+)
+
+func TestTransform(t *testing.T) {
+	tr, err := NewTransformer(&config.ScriptConfig{Source: `
+function transform(row)
+  if row.level == "debug" then
+    return nil
+  end
+  row.kb = row.bytes / 1024
+  row.path = string.lower(row.path)
+  row.tags = {"a", "b"}
+  row.secret = nil
+  return row
+end`, Timeout: 100})
+	require.Nil(t, err)
+	defer tr.Close()
+
+	result, err := tr.Transform([]byte(`{"id":1234567890123456789,"bytes":2048,"path":"/API","secret":"x","extra":{"k":[]}}`))
+	require.Nil(t, err)
+	var obj map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(result))
+	dec.UseNumber()
+	require.Nil(t, dec.Decode(&obj))
+	require.Equal(t, json.Number("1234567890123456789"), obj["id"])
+	require.Equal(t, json.Number("2"), obj["kb"])
+	require.Equal(t, "/api", obj["path"])
+	require.Equal(t, []interface{}{"a", "b"}, obj["tags"])
+	require.Equal(t, map[string]interface{}{"k": []interface{}{}}, obj["extra"])
+	require.NotContains(t, obj, "secret")
+
+	result, err = tr.Transform([]byte(`{"level":"debug"}`))
+	require.Nil(t, err)
+	require.Nil(t, result)
+
+	_, err = tr.Transform([]byte(`[1]`))
+	require.NotNil(t, err)
+
+	// a runaway script is stopped by the timeout
+	tr2, err := NewTransformer(&config.ScriptConfig{Source: `function transform(row) while true do end end`, Timeout: 10})
+	require.Nil(t, err)
+	_, err = tr2.Transform([]byte(`{}`))
+	require.NotNil(t, err)
+
+	_, err = NewTransformer(&config.ScriptConfig{Source: `function transfrom(row) return row end`})
+	require.NotNil(t, err)
+	// no io library
+	tr3, err := NewTransformer(&config.ScriptConfig{Source: `function transform(row) io.open("/etc/passwd") end`})
+	require.Nil(t, err)
+	_, err = tr3.Transform([]byte(`{}`))
+	require.NotNil(t, err)
+}
@@ -0,0 +1,57 @@
+package statistics
+
+import (
+	"math"
+	"sort"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// AddBuckets adds cumulative counts of buckets of h to buckets by upper bound, including +Inf.
+func AddBuckets(buckets map[float64]uint64, h *dto.Histogram) {
+	for _, b := range h.GetBucket() {
+		buckets[b.GetUpperBound()] += b.GetCumulativeCount()
+	}
+	buckets[math.Inf(1)] += h.GetSampleCount()
+}
+
+// Quantile estimates the q-quantile of values observed between prev and cur by linear interpolation within
+// buckets, like histogram_quantile of Prometheus. ok is false if nothing was observed.
+func Quantile(q float64, cur, prev map[float64]uint64) (value float64, ok bool) {
+	bounds := make([]float64, 0, len(cur))
+	for bound := range cur {
+		bounds = append(bounds, bound)
+	}
+	sort.Float64s(bounds)
+	if len(bounds) == 0 {
+		return
+	}
+	counts := make([]float64, len(bounds))
+	for i, bound := range bounds {
+		if cur[bound] < prev[bound] {
+			return
+		}
+		counts[i] = float64(cur[bound] - prev[bound])
+	}
+	total := counts[len(counts)-1]
+	if total <= 0 {
+		return
+	}
+	ok = true
+	rank := q * total
+	var lower, below float64
+	for i, bound := range bounds {
+		if counts[i] >= rank {
+			if math.IsInf(bound, 1) {
+				// beyond the largest finite bound
+				return lower, ok
+			}
+			if counts[i] == below {
+				return bound, ok
+			}
+			return lower + (bound-lower)*(rank-below)/(counts[i]-below), ok
+		}
+		lower, below = bound, counts[i]
+	}
+	return lower, ok
+}
@@ -0,0 +1,213 @@
+package statistics
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/forever765/clickhouse_sinker_nali/util"
+)
+
+// RemoteWriter sends metrics of the default registry to a Prometheus remote-write endpoint, such as Prometheus with
+// --web.enable-remote-write-receiver, Thanos receive, Cortex, Mimir or VictoriaMetrics.
+type RemoteWriter struct {
+	url      string
+	interval int
+	instance string
+	client   *http.Client
+	ctx      context.Context
+	cancel   context.CancelFunc
+	stopped  chan struct{}
+}
+
+// NewRemoteWriter writes to writeURL every interval seconds. Basic auth credentials can be given as its userinfo.
+func NewRemoteWriter(writeURL string, interval int, selfAddr string) *RemoteWriter {
+	return &RemoteWriter{
+		url:      writeURL,
+		interval: interval,
+		instance: selfAddr,
+		client:   &http.Client{Timeout: 30 * time.Second},
+		stopped:  make(chan struct{}),
+	}
+}
+
+func (w *RemoteWriter) Init() error {
+	if w.url == "" || w.interval <= 0 {
+		return errors.Errorf("invalid configuration for remote writer")
+	}
+	w.ctx, w.cancel = context.WithCancel(context.Background())
+	return nil
+}
+
+func (w *RemoteWriter) Run() {
+	ticker := time.NewTicker(time.Second * time.Duration(w.interval))
+	defer ticker.Stop()
+FOR:
+	for {
+		select {
+		case <-ticker.C:
+			if err := w.write(); err != nil {
+				util.Logger.Error("remote writing metrics failed", zap.String("url", redactURL(w.url)), zap.Error(err))
+			}
+		case <-w.ctx.Done():
+			util.Logger.Info("RemoteWriter.Run quit due to context has been canceled")
+			break FOR
+		}
+	}
+	w.stopped <- struct{}{}
+}
+
+func (w *RemoteWriter) Stop() {
+	w.cancel()
+	<-w.stopped
+	// Send the final values, so that counters of a short-lived instance aren't lost.
+	if err := w.write(); err != nil {
+		util.Logger.Error("remote writing metrics failed", zap.String("url", redactURL(w.url)), zap.Error(err))
+	}
+	util.Logger.Info("stopped metric remote writer")
+}
+
+func (w *RemoteWriter) write() (err error) {
+	var mfs []*dto.MetricFamily
+	if mfs, err = prometheus.DefaultGatherer.Gather(); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	extra := []*dto.LabelPair{
+		{Name: strPtr("job"), Value: strPtr("clickhouse_sinker_nali")},
+		{Name: strPtr("instance"), Value: strPtr(w.instance)},
+	}
+	body := snappy.Encode(nil, encodeWriteRequest(mfs, extra, time.Now().UnixNano()/int64(time.Millisecond)))
+	var req *http.Request
+	if req, err = http.NewRequest(http.MethodPost, w.url, bytes.NewReader(body)); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	var resp *http.Response
+	if resp, err = w.client.Do(req); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		err = errors.Errorf("remote write responded %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return
+}
+
+// redactURL hides the password in url.
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	return u.Redacted()
+}
+
+func strPtr(s string) *string {
+	return &s
+}
+
+// encodeWriteRequest encodes metric families into a prometheus.WriteRequest protobuf message. Histograms and summaries
+// are expanded into series as the text format does.
+func encodeWriteRequest(mfs []*dto.MetricFamily, extra []*dto.LabelPair, ts int64) []byte {
+	var buf []byte
+	for _, mf := range mfs {
+		name := mf.GetName()
+		for _, m := range mf.GetMetric() {
+			labels := append(append([]*dto.LabelPair{}, m.GetLabel()...), extra...)
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				buf = appendSeries(buf, name, labels, nil, m.GetCounter().GetValue(), ts)
+			case dto.MetricType_GAUGE:
+				buf = appendSeries(buf, name, labels, nil, m.GetGauge().GetValue(), ts)
+			case dto.MetricType_UNTYPED:
+				buf = appendSeries(buf, name, labels, nil, m.GetUntyped().GetValue(), ts)
+			case dto.MetricType_HISTOGRAM:
+				h := m.GetHistogram()
+				var infSeen bool
+				for _, b := range h.GetBucket() {
+					infSeen = infSeen || math.IsInf(b.GetUpperBound(), 1)
+					le := &dto.LabelPair{Name: strPtr("le"), Value: strPtr(formatFloat(b.GetUpperBound()))}
+					buf = appendSeries(buf, name+"_bucket", labels, le, float64(b.GetCumulativeCount()), ts)
+				}
+				if !infSeen {
+					le := &dto.LabelPair{Name: strPtr("le"), Value: strPtr("+Inf")}
+					buf = appendSeries(buf, name+"_bucket", labels, le, float64(h.GetSampleCount()), ts)
+				}
+				buf = appendSeries(buf, name+"_sum", labels, nil, h.GetSampleSum(), ts)
+				buf = appendSeries(buf, name+"_count", labels, nil, float64(h.GetSampleCount()), ts)
+			case dto.MetricType_SUMMARY:
+				s := m.GetSummary()
+				for _, q := range s.GetQuantile() {
+					quantile := &dto.LabelPair{Name: strPtr("quantile"), Value: strPtr(formatFloat(q.GetQuantile()))}
+					buf = appendSeries(buf, name, labels, quantile, q.GetValue(), ts)
+				}
+				buf = appendSeries(buf, name+"_sum", labels, nil, s.GetSampleSum(), ts)
+				buf = appendSeries(buf, name+"_count", labels, nil, float64(s.GetSampleCount()), ts)
+			}
+		}
+	}
+	return buf
+}
+
+// appendSeries appends a TimeSeries with a single sample as field 1 of WriteRequest. Labels are sorted by name as
+// receivers require.
+func appendSeries(buf []byte, name string, labels []*dto.LabelPair, extra *dto.LabelPair, value float64, ts int64) []byte {
+	all := make([]*dto.LabelPair, 0, len(labels)+2)
+	all = append(all, &dto.LabelPair{Name: strPtr("__name__"), Value: strPtr(name)})
+	all = append(all, labels...)
+	if extra != nil {
+		all = append(all, extra)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].GetName() < all[j].GetName() })
+
+	var series []byte
+	for _, lp := range all {
+		var label []byte
+		label = protowire.AppendTag(label, 1, protowire.BytesType)
+		label = protowire.AppendString(label, lp.GetName())
+		label = protowire.AppendTag(label, 2, protowire.BytesType)
+		label = protowire.AppendString(label, lp.GetValue())
+		series = protowire.AppendTag(series, 1, protowire.BytesType)
+		series = protowire.AppendBytes(series, label)
+	}
+	var sample []byte
+	sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+	sample = protowire.AppendFixed64(sample, math.Float64bits(value))
+	sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+	sample = protowire.AppendVarint(sample, uint64(ts))
+	series = protowire.AppendTag(series, 2, protowire.BytesType)
+	series = protowire.AppendBytes(series, sample)
+
+	buf = protowire.AppendTag(buf, 1, protowire.BytesType)
+	return protowire.AppendBytes(buf, series)
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
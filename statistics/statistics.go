@@ -31,13 +31,20 @@ import (
 var (
 	prefix = "clickhouse_sinker_"
 
-	// ConsumeMsgsTotal = ParseMsgsErrorTotal + RingMsgsOffTooSmallErrorTotal + FlushMsgsTotal + FlushMsgsErrorTotal
+	// ConsumeMsgsTotal = ParseMsgsErrorTotal + FilteredRowsTotal + DuplicatedRowsTotal + RingMsgsOffTooSmallErrorTotal + FlushMsgsTotal + FlushMsgsErrorTotal
 	ConsumeMsgsTotal = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: prefix + "consume_msgs_total",
 			Help: "total num of consumed msgs",
 		},
-		[]string{"task"},
+		[]string{"task", "topic", "partition"},
+	)
+	ConsumeBytesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: prefix + "consume_bytes_total",
+			Help: "total size of values of consumed msgs",
+		},
+		[]string{"task", "topic", "partition"},
 	)
 	ConsumeMsgsErrorTotal = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
@@ -49,9 +56,9 @@ var (
 	ParseMsgsErrorTotal = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: prefix + "parse_msgs_error_total",
-			Help: "total num of msgs with parse failure",
+			Help: "total num of msgs with parse failure, reason is parse(malformed msgs) or insert(rows rejected by ClickHouse)",
 		},
-		[]string{"task"},
+		[]string{"task", "reason"},
 	)
 	RingMsgsOffTooSmallErrorTotal = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
@@ -102,6 +109,136 @@ var (
 		},
 		[]string{"task"},
 	)
+	FlushBatchRows = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    prefix + "flush_batch_rows",
+			Help:    "num of rows of flushed batches",
+			Buckets: prometheus.ExponentialBuckets(16, 4, 8),
+		},
+		[]string{"task"},
+	)
+	FlushDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    prefix + "flush_duration_seconds",
+			Help:    "time to write a batch to ClickHouse, including retries",
+			Buckets: prometheus.ExponentialBuckets(0.005, 2, 14),
+		},
+		[]string{"task"},
+	)
+	EndToEndLatency = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    prefix + "end_to_end_latency_seconds",
+			Help:    "time from the Kafka record timestamp to the row being written to ClickHouse",
+			Buckets: prometheus.ExponentialBuckets(0.1, 2, 15),
+		},
+		[]string{"task"},
+	)
+	ClickhouseErrorsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: prefix + "clickhouse_errors_total",
+			Help: "total num of failed writes, code is the ClickHouse exception code, or network for other failures",
+		},
+		[]string{"task", "code"},
+	)
+	ErrorEventsDroppedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: prefix + "error_events_dropped_total",
+			Help: "total num of error events not published to Kafka due to rate limit, a full queue or produce failures",
+		},
+		[]string{"task"},
+	)
+	SlowParsesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: prefix + "slow_parses_total",
+			Help: "total num of msgs taking longer than slowPath.parseMs to enrich and parse",
+		},
+		[]string{"task"},
+	)
+	FilteredRowsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: prefix + "filtered_rows_total",
+			Help: "total num of rows dropped by the filter, the script or sampling of the task",
+		},
+		[]string{"task"},
+	)
+	DuplicatedRowsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: prefix + "duplicated_rows_total",
+			Help: "total num of rows dropped by dedup of the task",
+		},
+		[]string{"task"},
+	)
+	TypeWideningsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: prefix + "type_widenings_total",
+			Help: "total num of values which don't fit their columns, by the typeWidening policy applied",
+		},
+		[]string{"task", "column", "policy"},
+	)
+	LateRowsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: prefix + "late_rows_total",
+			Help: "total num of rows older than lateData.threshold of the task, by the policy applied",
+		},
+		[]string{"task", "policy"},
+	)
+	SlowWriteQueueTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: prefix + "slow_write_queue_total",
+			Help: "total num of batches waiting longer than slowPath.writeQueueMs for a writer",
+		},
+		[]string{"task"},
+	)
+	ColumnFallbacksTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: prefix + "column_fallbacks_total",
+			Help: "total num of fields written as default values, by reason missing or invalid",
+		},
+		[]string{"task", "column", "reason"},
+	)
+	SeriesCardinality = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: prefix + "series_cardinality",
+			Help: "num of distinct series known to a task with prometheusSchema",
+		},
+		[]string{"task"},
+	)
+	CardinalityClippedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: prefix + "cardinality_clipped_total",
+			Help: "total num of rows of new series dropped beyond dynamicSchema.maxSeries, or new keys ignored beyond dynamicSchema.maxDims",
+		},
+		[]string{"task", "kind"},
+	)
+	WatchdogBreached = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: prefix + "watchdog_breached",
+			Help: "1 if the resource exceeded its watchdog threshold at the last check, otherwise 0",
+		},
+		[]string{"resource"},
+	)
+	WatchdogDumpsTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: prefix + "watchdog_dumps_total",
+			Help: "total num of diagnostics dumps written by the watchdog",
+		},
+	)
+	PoolWorkers = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: prefix + "pool_workers",
+			Help: "expected num of workers of the parsing or writing pool",
+		},
+		[]string{"pool"},
+	)
+	LogsSampledOutTotal = prometheus.NewCounterFunc(
+		prometheus.CounterOpts{
+			Name: prefix + "logs_sampled_out_total",
+			Help: "total num of logs dropped by logSampling",
+		},
+		func() float64 { return float64(util.SampledOutLogs()) },
+	)
+	ThrottledSecondsTotal = &throttleCollector{prometheus.NewDesc(prefix+"throttled_seconds_total",
+		"total seconds spent waiting for each rate limiter", []string{"limiter"}, nil)}
 	ConsumeOffsets = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Name: prefix + "consume_offsets",
@@ -109,6 +246,20 @@ var (
 		},
 		[]string{"task", "topic", "partition"},
 	)
+	ConsumerLag = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: prefix + "consumer_lag",
+			Help: "number of messages behind the newest offset for each topic partition pair",
+		},
+		[]string{"task", "topic", "partition"},
+	)
+	ConsumerLagSeconds = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: prefix + "consumer_lag_seconds",
+			Help: "estimated time the oldest unconsumed message has been waiting for each topic partition pair",
+		},
+		[]string{"task", "topic", "partition"},
+	)
 	ClickhouseReconnectTotal = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: prefix + "clickhouse_reconnect_total",
@@ -144,10 +295,56 @@ var (
 		},
 		[]string{"task"},
 	)
+	TaskFailed = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: prefix + "task_failed",
+			Help: "1 if the task failed due to a panic and hasn't been restarted, otherwise 0",
+		},
+		[]string{"task"},
+	)
+	TaskRestartsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: prefix + "task_restarts_total",
+			Help: "total num of restarts of the task after failures",
+		},
+		[]string{"task"},
+	)
+	BuildInfo = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: prefix + "build_info",
+			Help: "always 1, labeled by the build running",
+		},
+		[]string{"version", "commit", "date", "goversion", "features"},
+	)
+	ConfigVersion = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: prefix + "config_version",
+			Help: "version of the config in effect",
+		},
+	)
+	AutoscaleLag = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: prefix + "autoscale_lag",
+			Help: "total lag of tasks",
+		},
+	)
+	AutoscaleIncomingRate = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: prefix + "autoscale_incoming_rate",
+			Help: "messages produced to topics of tasks per second",
+		},
+	)
+	DesiredReplicas = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: prefix + "desired_replicas",
+			Help: "number of replicas to sink incoming messages and drain the lag in time",
+		},
+	)
 )
 
 func init() {
 	prometheus.MustRegister(ConsumeMsgsTotal)
+	prometheus.MustRegister(ConsumeBytesTotal)
 	prometheus.MustRegister(ConsumeMsgsErrorTotal)
 	prometheus.MustRegister(ParseMsgsErrorTotal)
 	prometheus.MustRegister(RingMsgsOffTooSmallErrorTotal)
@@ -157,12 +354,40 @@ func init() {
 	prometheus.MustRegister(RingForceBatchAllTotal)
 	prometheus.MustRegister(FlushMsgsTotal)
 	prometheus.MustRegister(FlushMsgsErrorTotal)
+	prometheus.MustRegister(FlushBatchRows)
+	prometheus.MustRegister(FlushDuration)
+	prometheus.MustRegister(EndToEndLatency)
+	prometheus.MustRegister(ClickhouseErrorsTotal)
+	prometheus.MustRegister(ErrorEventsDroppedTotal)
+	prometheus.MustRegister(SlowParsesTotal)
+	prometheus.MustRegister(FilteredRowsTotal)
+	prometheus.MustRegister(DuplicatedRowsTotal)
+	prometheus.MustRegister(LateRowsTotal)
+	prometheus.MustRegister(TypeWideningsTotal)
+	prometheus.MustRegister(SlowWriteQueueTotal)
+	prometheus.MustRegister(ColumnFallbacksTotal)
+	prometheus.MustRegister(SeriesCardinality)
+	prometheus.MustRegister(CardinalityClippedTotal)
+	prometheus.MustRegister(WatchdogBreached)
+	prometheus.MustRegister(WatchdogDumpsTotal)
+	prometheus.MustRegister(LogsSampledOutTotal)
+	prometheus.MustRegister(ThrottledSecondsTotal)
+	prometheus.MustRegister(PoolWorkers)
 	prometheus.MustRegister(ConsumeOffsets)
+	prometheus.MustRegister(ConsumerLag)
+	prometheus.MustRegister(ConsumerLagSeconds)
 	prometheus.MustRegister(ClickhouseReconnectTotal)
 	prometheus.MustRegister(RingMsgs)
 	prometheus.MustRegister(ShardMsgs)
 	prometheus.MustRegister(ParsingPoolBacklog)
 	prometheus.MustRegister(WritingPoolBacklog)
+	prometheus.MustRegister(TaskFailed)
+	prometheus.MustRegister(TaskRestartsTotal)
+	prometheus.MustRegister(BuildInfo)
+	prometheus.MustRegister(ConfigVersion)
+	prometheus.MustRegister(AutoscaleLag)
+	prometheus.MustRegister(AutoscaleIncomingRate)
+	prometheus.MustRegister(DesiredReplicas)
 	prometheus.MustRegister(collectors.NewBuildInfoCollector())
 }
 
@@ -241,22 +466,7 @@ func (p *Pusher) reconnect() {
 		nextAddr = (p.inUseAddr + 1) % len(p.pgwAddrs)
 	}
 	p.pusher = push.New(p.pgwAddrs[nextAddr], "clickhouse_sinker_nali").
-		Collector(ConsumeMsgsTotal).
-		Collector(ConsumeMsgsErrorTotal).
-		Collector(ParseMsgsErrorTotal).
-		Collector(RingMsgsOffTooSmallErrorTotal).
-		Collector(RingMsgsOffTooLargeErrorTotal).
-		Collector(RingNormalBatchsTotal).
-		Collector(RingForceBatchsTotal).
-		Collector(RingForceBatchAllTotal).
-		Collector(FlushMsgsTotal).
-		Collector(FlushMsgsErrorTotal).
-		Collector(ConsumeOffsets).
-		Collector(ClickhouseReconnectTotal).
-		Collector(RingMsgs).
-		Collector(ShardMsgs).
-		Collector(ParsingPoolBacklog).
-		Collector(WritingPoolBacklog).
+		Gatherer(prometheus.DefaultGatherer).
 		Grouping("instance", p.instance).Format(expfmt.FmtText)
 	p.inUseAddr = nextAddr
 }
@@ -0,0 +1,23 @@
+package statistics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/forever765/clickhouse_sinker_nali/util"
+)
+
+// throttleCollector exports the time throttled by each rate limiter of util, which are created and removed at runtime.
+type throttleCollector struct {
+	desc *prometheus.Desc
+}
+
+func (c *throttleCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *throttleCollector) Collect(ch chan<- prometheus.Metric) {
+	names, throttled := util.RateLimiterThrottled()
+	for i, name := range names {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.CounterValue, throttled[i].Seconds(), name)
+	}
+}
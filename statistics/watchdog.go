@@ -0,0 +1,159 @@
+package statistics
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/forever765/clickhouse_sinker_nali/config"
+	"github.com/forever765/clickhouse_sinker_nali/util"
+)
+
+const watchdogInterval = 10 * time.Second
+
+// Watchdog checks resources of the process against thresholds. On a breach, it writes heap and goroutine profiles
+// to disk, so that the cause of an OOM kill can be found after the process is gone.
+type Watchdog struct {
+	cfg      config.WatchdogConfig
+	lastDump time.Time
+	ctx      context.Context
+	cancel   context.CancelFunc
+	stopped  chan struct{}
+}
+
+func NewWatchdog(cfg config.WatchdogConfig) *Watchdog {
+	w := &Watchdog{
+		cfg:     cfg,
+		stopped: make(chan struct{}),
+	}
+	w.ctx, w.cancel = context.WithCancel(context.Background())
+	return w
+}
+
+func (w *Watchdog) Run() {
+	util.Logger.Info("watchdog started", zap.Int("rssMB", w.cfg.RssMB), zap.Int("goroutines", w.cfg.Goroutines),
+		zap.Int("backlog", w.cfg.Backlog))
+	ticker := time.NewTicker(watchdogInterval)
+	defer ticker.Stop()
+FOR:
+	for {
+		select {
+		case <-ticker.C:
+			w.check()
+		case <-w.ctx.Done():
+			break FOR
+		}
+	}
+	WatchdogBreached.Reset()
+	w.stopped <- struct{}{}
+}
+
+func (w *Watchdog) Stop() {
+	w.cancel()
+	<-w.stopped
+	util.Logger.Info("watchdog stopped")
+}
+
+func (w *Watchdog) check() {
+	var breaches []zap.Field
+	observe := func(resource string, value, threshold int) {
+		if threshold <= 0 {
+			return
+		}
+		if value > threshold {
+			WatchdogBreached.WithLabelValues(resource).Set(1)
+			breaches = append(breaches, zap.Int(resource, value), zap.Int(resource+"Threshold", threshold))
+		} else {
+			WatchdogBreached.WithLabelValues(resource).Set(0)
+		}
+	}
+	if w.cfg.RssMB > 0 {
+		observe("rssMB", int(residentMemory()>>20), w.cfg.RssMB)
+	}
+	observe("goroutines", runtime.NumGoroutine(), w.cfg.Goroutines)
+	if w.cfg.Backlog > 0 {
+		var backlog int
+		for _, pool := range []*util.WorkerPool{util.GlobalParsingPool, util.GlobalWritingPool} {
+			if pool != nil && pool.Backlog() > backlog {
+				backlog = pool.Backlog()
+			}
+		}
+		observe("backlog", backlog, w.cfg.Backlog)
+	}
+	if len(breaches) == 0 {
+		return
+	}
+	if time.Since(w.lastDump) < time.Duration(w.cfg.MinDumpInterval)*time.Second {
+		util.Logger.Warn("watchdog threshold exceeded", breaches...)
+		return
+	}
+	w.lastDump = time.Now()
+	files, err := w.dump()
+	if err != nil {
+		util.Logger.Error("watchdog failed to dump profiles", append(breaches, zap.Error(err))...)
+		return
+	}
+	WatchdogDumpsTotal.Inc()
+	util.Logger.Warn("watchdog threshold exceeded, dumped profiles", append(breaches, zap.Strings("files", files))...)
+}
+
+// dump writes heap and goroutine profiles to DumpDir.
+func (w *Watchdog) dump() (files []string, err error) {
+	dir := w.cfg.DumpDir
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	suffix := fmt.Sprintf("%s-%d", time.Now().Format("20060102T150405"), os.Getpid())
+	for _, prof := range []struct {
+		name  string
+		file  string
+		debug int
+	}{
+		{"heap", "heap-" + suffix + ".pb.gz", 0},
+		{"goroutine", "goroutine-" + suffix + ".txt", 2},
+	} {
+		var f *os.File
+		path := filepath.Join(dir, prof.file)
+		if f, err = os.Create(path); err != nil {
+			err = errors.Wrapf(err, "")
+			return
+		}
+		err = pprof.Lookup(prof.name).WriteTo(f, prof.debug)
+		_ = f.Close()
+		if err != nil {
+			err = errors.Wrapf(err, "")
+			return
+		}
+		files = append(files, path)
+	}
+	return
+}
+
+// residentMemory returns the RSS of the process in bytes on Linux. Elsewhere memory obtained by the Go runtime is
+// returned instead.
+func residentMemory() uint64 {
+	if b, err := ioutil.ReadFile("/proc/self/statm"); err == nil {
+		if fields := bytes.Fields(b); len(fields) > 1 {
+			if pages, err := strconv.ParseUint(string(fields[1]), 10, 64); err == nil {
+				return pages * uint64(os.Getpagesize())
+			}
+		}
+	}
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	return ms.Sys
+}
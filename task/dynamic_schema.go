@@ -0,0 +1,59 @@
+package task
+
+import (
+	"math"
+	"regexp"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/forever765/clickhouse_sinker_nali/config"
+	"github.com/forever765/clickhouse_sinker_nali/util"
+)
+
+// dynamicSchema is the DynamicSchema in effect. It's replaced as a whole when changed at runtime.
+type dynamicSchema struct {
+	enable    bool
+	maxDims   int
+	whiteList *regexp.Regexp
+	blackList *regexp.Regexp
+}
+
+func newDynamicSchema(dsCfg *config.DynamicSchemaConfig) (ds *dynamicSchema, err error) {
+	ds = &dynamicSchema{enable: dsCfg.Enable, maxDims: math.MaxInt16}
+	if dsCfg.MaxDims > 0 {
+		ds.maxDims = dsCfg.MaxDims
+	}
+	if dsCfg.WhiteList != "" {
+		if ds.whiteList, err = regexp.Compile(dsCfg.WhiteList); err != nil {
+			err = errors.Wrapf(err, "WhiteList %s is invalid regexp", dsCfg.WhiteList)
+			return
+		}
+	}
+	if dsCfg.BlackList != "" {
+		if ds.blackList, err = regexp.Compile(dsCfg.BlackList); err != nil {
+			err = errors.Wrapf(err, "BlackList %s is invalid regexp", dsCfg.BlackList)
+			return
+		}
+	}
+	return
+}
+
+func (service *Service) dynamicSchema() *dynamicSchema {
+	return service.dynSchema.Load().(*dynamicSchema)
+}
+
+// SetDynamicSchema changes DynamicSchema of the task without restarting it. Keys found before the change are still
+// added as columns.
+func (service *Service) SetDynamicSchema(dsCfg config.DynamicSchemaConfig) (err error) {
+	var ds *dynamicSchema
+	if ds, err = newDynamicSchema(&dsCfg); err != nil {
+		return
+	}
+	service.dynSchema.Store(ds)
+	service.clickhouse.SetMaxSeries(dsCfg.MaxSeries)
+	util.Logger.Info("changed DynamicSchema", zap.String("task", service.taskCfg.Name), zap.Bool("enable", ds.enable),
+		zap.Int("maxDims", dsCfg.MaxDims), zap.String("whiteList", dsCfg.WhiteList), zap.String("blackList", dsCfg.BlackList),
+		zap.Int("maxSeries", dsCfg.MaxSeries))
+	return
+}
@@ -0,0 +1,62 @@
+package task
+
+// Internals is a snapshot of the internal state of a task for inspection.
+type Internals struct {
+	Parsing       int32               `json:"parsing"`       // messages submitted to the parsing pool and not done
+	PendingGroups int                 `json:"pendingGroups"` // batch groups not committed yet
+	Writing       int32               `json:"writing"`       // batches sent to ClickHouse and not done, -1 if unknown
+	Partitions    []PartitionInternal `json:"partitions,omitempty"`
+	ShardRows     []int               `json:"shardRows,omitempty"` // rows buffered for each shard
+}
+
+// PartitionInternal is the state of the ring of a partition.
+type PartitionInternal struct {
+	Partition int   `json:"partition"`
+	Buffered  int64 `json:"buffered"`  // messages in the ring
+	Offset    int64 `json:"offset"`    // 1 + the max offset put into the ring
+	Committed int64 `json:"committed"` // the last committed offset, -1 if none yet
+	Idle      bool  `json:"idle"`
+}
+
+// Internals returns the state of service.
+func (service *Service) Internals() (in Internals) {
+	service.Lock()
+	in.Parsing = service.numFlying
+	rings := append([]*Ring(nil), service.rings...)
+	sharder := service.sharder
+	service.Unlock()
+	in.Writing = service.clickhouse.Writing()
+	for _, ring := range rings {
+		if ring == nil {
+			continue
+		}
+		ring.mux.Lock()
+		pi := PartitionInternal{
+			Partition: ring.partition,
+			Buffered:  ring.ringFilledOffset - ring.ringGroundOff,
+			Offset:    ring.ringCeilingOff,
+			Committed: -1,
+			Idle:      ring.isIdle,
+		}
+		ring.mux.Unlock()
+		// offsets are committed by the sharder instead of rings if there's one
+		batchSys := ring.batchSys
+		if sharder != nil {
+			batchSys = sharder.batchSys
+		}
+		if off, ok := batchSys.Committed(ring.partition); ok {
+			pi.Committed = off
+		}
+		in.Partitions = append(in.Partitions, pi)
+		in.PendingGroups += ring.batchSys.Pending()
+	}
+	if sharder != nil {
+		sharder.mux.Lock()
+		for _, batch := range sharder.msgBuf {
+			in.ShardRows = append(in.ShardRows, batch.Size())
+		}
+		sharder.mux.Unlock()
+		in.PendingGroups += sharder.batchSys.Pending()
+	}
+	return
+}
@@ -4,10 +4,10 @@ import (
 	"fmt"
 	"sync"
 	"sync/atomic"
-	"time"
 
 	"github.com/fagongzi/goetty"
 	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 
 	"github.com/forever765/clickhouse_sinker_nali/model"
@@ -24,6 +24,7 @@ type Ring struct {
 	ringGroundOff    int64 //min message offset inside the ring
 	ringCeilingOff   int64 //1 + max message offset inside the ring
 	ringFilledOffset int64 //every message which's offset inside range [ringGroundOff, ringFilledOffset) is in the ring
+	filledBytes      int   //size of messages inside range [ringGroundOff, ringFilledOffset)
 	batchSizeShift   uint  //the shift of desired batch size
 	tid              goetty.Timeout
 	idleCnt          int
@@ -68,6 +69,7 @@ func (ring *Ring) PutElem(msgRow model.MsgRow) {
 	}
 
 	pMsgRow.Row = msgRow.Row
+	pMsgRow.Extra = msgRow.Extra
 	if ring.service.sharder != nil && msgRow.Row != &model.FakedRow {
 		if msgRow.Shard, err = ring.service.sharder.Calc(msgRow.Row); err != nil {
 			util.Logger.Fatal("shard number calculation failed", zap.String("task", taskCfg.Name), zap.Error(err))
@@ -75,8 +77,10 @@ func (ring *Ring) PutElem(msgRow model.MsgRow) {
 		pMsgRow.Shard = msgRow.Shard
 	}
 	for ; ring.ringFilledOffset < ring.ringCeilingOff && ring.ringBuf[ring.ringFilledOffset&(ring.ringCapMask)].Row != nil; ring.ringFilledOffset++ {
+		ring.filledBytes += len(ring.ringBuf[ring.ringFilledOffset&(ring.ringCapMask)].Msg.Value)
 	}
-	if (ring.ringFilledOffset >> ring.batchSizeShift) != (ring.ringGroundOff >> ring.batchSizeShift) {
+	if (ring.ringFilledOffset>>ring.batchSizeShift) != (ring.ringGroundOff>>ring.batchSizeShift) ||
+		taskCfg.BufferBytes > 0 && ring.filledBytes >= taskCfg.BufferBytes {
 		ring.genBatchOrShard()
 		ring.scheduleForchBatchOrShard()
 	}
@@ -100,6 +104,7 @@ func (ring *Ring) MakeRoom(newMsg *model.InputMessage) {
 			}
 			msgRow.Msg = nil
 			msgRow.Row = nil
+			msgRow.Extra = nil
 		}
 		util.Logger.Info(fmt.Sprintf("Ring.MakeRoom discarded %d messages for topic %v patittion %d, offset [%d,%d)",
 			msgCnt, taskCfg.Topic, ring.partition, ring.ringGroundOff, ring.ringGroundOff+ring.ringCap),
@@ -107,6 +112,7 @@ func (ring *Ring) MakeRoom(newMsg *model.InputMessage) {
 		ring.ringGroundOff = newMsg.Offset
 		ring.ringFilledOffset = newMsg.Offset
 		ring.ringCeilingOff = newMsg.Offset
+		ring.filledBytes = 0
 	} else {
 		for ; prevMsgOff > ring.ringGroundOff && ring.ringBuf[(prevMsgOff-1)&ring.ringCapMask].Msg != nil; prevMsgOff-- {
 		}
@@ -119,6 +125,7 @@ func (ring *Ring) MakeRoom(newMsg *model.InputMessage) {
 			}
 			msgRow.Msg = nil
 			msgRow.Row = nil
+			msgRow.Extra = nil
 		}
 		util.Logger.Info(fmt.Sprintf("Ring.MakeRoom discarded %d messages for topic %v patittion %d, offset [%d,%d)",
 			msgCnt, taskCfg.Topic, ring.partition, ring.ringGroundOff, prevMsgOff),
@@ -126,6 +133,7 @@ func (ring *Ring) MakeRoom(newMsg *model.InputMessage) {
 		ring.ringGroundOff = prevMsgOff
 		ring.ringFilledOffset = newMsg.Offset
 		ring.ringCeilingOff = newMsg.Offset
+		ring.filledBytes = 0
 	}
 }
 
@@ -151,12 +159,21 @@ func (ring *Ring) ForceBatchOrShard(_ interface{}) {
 	}
 }
 
+// flushAll generates batches for all parsed messages, across batchSize boundaries.
+func (ring *Ring) flushAll() {
+	ring.mux.Lock()
+	defer ring.mux.Unlock()
+	for ring.ringFilledOffset > ring.ringGroundOff {
+		ring.genBatchOrShard()
+	}
+}
+
 // schedule ForchBatchOrShard
 // assume ring.mux is locked
 func (ring *Ring) scheduleForchBatchOrShard() {
 	var err error
 	ring.tid.Stop()
-	if ring.tid, err = util.GlobalTimerWheel.Schedule(time.Duration(ring.service.taskCfg.FlushInterval)*time.Second, ring.ForceBatchOrShard, nil); err != nil {
+	if ring.tid, err = ring.service.timerWheel().Schedule(ring.service.flushInterval(), ring.ForceBatchOrShard, nil); err != nil {
 		if errors.Is(err, goetty.ErrSystemStopped) {
 			util.Logger.Warn("Ring.ForceBatchOrShard scheduling timer to a stopped timer wheel", zap.String("task", ring.service.taskCfg.Name), zap.Error(err))
 		} else {
@@ -177,32 +194,60 @@ func (ring *Ring) genBatchOrShard() {
 		endOff = ring.ringFilledOffset
 	}
 	msgCnt := endOff - ring.ringGroundOff
+	for i := ring.ringGroundOff; i < endOff; i++ {
+		if msg := ring.ringBuf[i&(ring.ringCapMask)].Msg; msg != nil {
+			ring.filledBytes -= len(msg.Value)
+		}
+	}
+	if ring.filledBytes < 0 {
+		ring.filledBytes = 0
+	}
 	if atomic.LoadUint32(&ring.service.state) != util.StateRunning {
 		util.Logger.Info(fmt.Sprintf("Ring.genBatchOrShard discarded a batch for topic %v patittion %d, offset [%d,%d), messages %d",
 			taskCfg.Topic, ring.partition, ring.ringGroundOff, endOff, msgCnt),
 			zap.String("task", taskCfg.Name))
 		for i := ring.ringGroundOff; i < endOff; i++ {
 			msgRow := &ring.ringBuf[i&(ring.ringCapMask)]
+			if msgRow.Msg != nil && msgRow.Msg.Span != nil {
+				msgRow.Msg.Span.End()
+			}
+			if msgRow.Row != nil && msgRow.Row != &model.FakedRow {
+				model.PutRow(msgRow.Row)
+			}
+			for _, row := range msgRow.Extra {
+				model.PutRow(row)
+			}
 			msgRow.Msg = nil
 			msgRow.Row = nil
+			msgRow.Extra = nil
 			msgRow.Shard = -1
 		}
 	} else if ring.service.sharder != nil {
 		ring.service.sharder.PutElems(ring.partition, ring.ringBuf, ring.ringGroundOff, endOff, ring.ringCapMask)
 	} else {
-		batch := model.NewBatch()
+		batch := ring.service.newBatch()
+		var spans []trace.Span
 		for i := ring.ringGroundOff; i < endOff; i++ {
 			msgRow := &ring.ringBuf[i&(ring.ringCapMask)]
 			if msgRow.Row != &model.FakedRow {
-				*batch.Rows = append(*batch.Rows, msgRow.Row)
+				millis := model.MsgMillis(msgRow.Msg)
+				batch.Append(msgRow.Row, millis)
+				for _, row := range msgRow.Extra {
+					batch.Append(row, millis)
+				}
 			} else {
 				parseErrs++
 			}
+			if msgRow.Msg.Span != nil {
+				spans = append(spans, msgRow.Msg.Span)
+			}
+			batch.Bytes += len(msgRow.Msg.Value)
 			msgRow.Msg = nil
 			msgRow.Row = nil
+			msgRow.Extra = nil
 			msgRow.Shard = -1
 		}
-		batch.RealSize = len(*batch.Rows)
+		batch.RealSize = batch.Size()
 
 		if batch.RealSize > 0 {
 			util.Logger.Debug(fmt.Sprintf("going to flush a batch for topic %v patittion %d, offset [%d,%d), messages %d, parse errors: %d",
@@ -210,9 +255,11 @@ func (ring *Ring) genBatchOrShard() {
 				zap.String("task", taskCfg.Name))
 
 			batch.BatchIdx = ring.ringGroundOff >> ring.batchSizeShift
-			ring.batchSys.CreateBatchGroupSingle(batch, ring.partition, endOff-1)
+			ring.batchSys.CreateBatchGroupSingle(batch, ring.partition, endOff-1, spans)
 			ring.service.Flush(batch)
 			statistics.RingNormalBatchsTotal.WithLabelValues(taskCfg.Name).Inc()
+		} else {
+			batch.Free()
 		}
 	}
 	statistics.RingMsgs.WithLabelValues(taskCfg.Name).Sub(float64(msgCnt))
@@ -0,0 +1,73 @@
+package task
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/forever765/clickhouse_sinker_nali/config"
+	"github.com/forever765/clickhouse_sinker_nali/model"
+	"github.com/forever765/clickhouse_sinker_nali/util"
+)
+
+// newTestRing returns a ring of a task which isn't running, so that batches are generated and discarded.
+func newTestRing(taskCfg *config.TaskConfig) *Ring {
+	util.Logger = zap.NewNop()
+	service := &Service{taskCfg: taskCfg, state: util.StateStopped}
+	service.wheel.Store(util.NewTimerWheel())
+	batchSizeShift := util.GetShift(taskCfg.BufferSize)
+	ringCap := int64(1 << (batchSizeShift + 1))
+	ring := &Ring{
+		ringCap:        ringCap,
+		ringCapMask:    ringCap - 1,
+		batchSizeShift: batchSizeShift,
+		isIdle:         true,
+		service:        service,
+	}
+	ring.available = sync.NewCond(&ring.mux)
+	return ring
+}
+
+func putTestMsg(ring *Ring, offset int64, size int) {
+	msg := &model.InputMessage{Offset: offset, Value: make([]byte, size)}
+	ring.mux.Lock()
+	ring.PutMsgNolock(msg)
+	ring.mux.Unlock()
+	ring.PutElem(model.MsgRow{Msg: msg, Row: &model.FakedRow})
+}
+
+func TestRingBufferBytes(t *testing.T) {
+	ring := newTestRing(&config.TaskConfig{Name: "test_buffer_bytes", BufferSize: 1024, BufferBytes: 100, FlushInterval: 5})
+	putTestMsg(ring, 0, 40)
+	putTestMsg(ring, 1, 40)
+	require.Equal(t, int64(0), ring.ringGroundOff)
+	require.Equal(t, 80, ring.filledBytes)
+	// the third message reaches BufferBytes long before BufferSize
+	putTestMsg(ring, 2, 40)
+	require.Equal(t, int64(3), ring.ringGroundOff)
+	require.Equal(t, 0, ring.filledBytes)
+
+	// messages parsed out of order are counted once their predecessors are parsed
+	msg4 := &model.InputMessage{Offset: 4, Value: make([]byte, 60)}
+	ring.mux.Lock()
+	ring.PutMsgNolock(msg4)
+	ring.mux.Unlock()
+	ring.PutElem(model.MsgRow{Msg: msg4, Row: &model.FakedRow})
+	require.Equal(t, 0, ring.filledBytes)
+	putTestMsg(ring, 3, 50)
+	require.Equal(t, int64(5), ring.ringGroundOff)
+	require.Equal(t, 0, ring.filledBytes)
+}
+
+func TestRingBufferBytesDisabled(t *testing.T) {
+	ring := newTestRing(&config.TaskConfig{Name: "test_buffer_bytes_disabled", BufferSize: 4, FlushInterval: 5})
+	for i := 0; i < 3; i++ {
+		putTestMsg(ring, int64(i), 1000)
+	}
+	require.Equal(t, int64(0), ring.ringGroundOff)
+	// BufferSize still triggers
+	putTestMsg(ring, 3, 1000)
+	require.Equal(t, int64(4), ring.ringGroundOff)
+}
@@ -14,6 +14,7 @@ import (
 	"github.com/forever765/clickhouse_sinker_nali/statistics"
 	"github.com/forever765/clickhouse_sinker_nali/util"
 	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 )
 
@@ -106,7 +107,8 @@ type Sharder struct {
 	batchSys *model.BatchSys
 	ckNum    int
 	mux      sync.Mutex
-	msgBuf   []*model.Rows
+	msgBuf   []*model.Batch // rows of each shard which haven't been flushed
+	spans    []trace.Span
 	offsets  map[int]int64
 	tid      goetty.Timeout
 }
@@ -123,11 +125,11 @@ func NewSharder(service *Service) (sh *Sharder, err error) {
 		policy:   policy,
 		batchSys: model.NewBatchSys(taskCfg, service.fnCommit),
 		ckNum:    ckNum,
-		msgBuf:   make([]*model.Rows, ckNum),
+		msgBuf:   make([]*model.Batch, ckNum),
 		offsets:  make(map[int]int64),
 	}
 	for i := 0; i < ckNum; i++ {
-		sh.msgBuf[i] = model.GetRows()
+		sh.msgBuf[i] = service.newBatch()
 	}
 	return
 }
@@ -149,29 +151,41 @@ func (sh *Sharder) PutElems(partition int, ringBuf []model.MsgRow, begOff, endOf
 		msgRow := &ringBuf[i&ringCapMask]
 		//assert msg.Offset==i
 		if msgRow.Row != &model.FakedRow {
-			rows := sh.msgBuf[msgRow.Shard]
-			*rows = append(*rows, msgRow.Row)
+			buf := sh.msgBuf[msgRow.Shard]
+			millis := model.MsgMillis(msgRow.Msg)
+			buf.Append(msgRow.Row, millis)
+			for _, row := range msgRow.Extra {
+				buf.Append(row, millis)
+			}
+			buf.Bytes += len(msgRow.Msg.Value)
 		} else {
 			parseErrs++
 		}
+		if msgRow.Msg.Span != nil {
+			sh.spans = append(sh.spans, msgRow.Msg.Span)
+		}
 		msgRow.Msg = nil
 		msgRow.Row = nil
+		msgRow.Extra = nil
 		msgRow.Shard = -1
 	}
 
 	sh.offsets[partition] = endOff - 1
 	statistics.ShardMsgs.WithLabelValues(taskCfg.Name).Add(float64(msgCnt))
-	var maxBatchSize int
+	var maxBatchSize, maxBatchBytes int
 	for i := 0; i < sh.ckNum; i++ {
-		batchSize := len(*sh.msgBuf[i])
+		batchSize := sh.msgBuf[i].Size()
 		if maxBatchSize < batchSize {
 			maxBatchSize = batchSize
 		}
+		if maxBatchBytes < sh.msgBuf[i].Bytes {
+			maxBatchBytes = sh.msgBuf[i].Bytes
+		}
 	}
 	util.Logger.Debug(fmt.Sprintf("sharded a batch for topic %v patittion %d, offset [%d, %d), messages %d, parse errors: %d",
 		taskCfg.Topic, partition, begOff, endOff, msgCnt, parseErrs),
 		zap.String("task", taskCfg.Name))
-	if maxBatchSize >= taskCfg.BufferSize {
+	if maxBatchSize >= taskCfg.BufferSize || taskCfg.BufferBytes > 0 && maxBatchBytes >= taskCfg.BufferBytes {
 		sh.doFlush(nil)
 	}
 }
@@ -188,23 +202,21 @@ func (sh *Sharder) doFlush(_ interface{}) {
 	var msgCnt int
 	var batches []*model.Batch
 	taskCfg := sh.service.taskCfg
-	for i, rows := range sh.msgBuf {
-		realSize := len(*rows)
+	for i, batch := range sh.msgBuf {
+		realSize := batch.Size()
 		if realSize > 0 {
 			msgCnt += realSize
-			batch := &model.Batch{
-				Rows:     rows,
-				BatchIdx: int64(i),
-				RealSize: realSize,
-			}
+			batch.BatchIdx = int64(i)
+			batch.RealSize = realSize
 			batches = append(batches, batch)
-			sh.msgBuf[i] = model.GetRows()
+			sh.msgBuf[i] = sh.service.newBatch()
 		}
 	}
 	if msgCnt > 0 {
 		util.Logger.Debug(fmt.Sprintf("going to flush batch group for topic %v, offsets %+v, messages %d", taskCfg.Topic, sh.offsets, msgCnt), zap.String("task", taskCfg.Name))
-		sh.batchSys.CreateBatchGroupMulti(batches, sh.offsets)
+		sh.batchSys.CreateBatchGroupMulti(batches, sh.offsets, sh.spans)
 		sh.offsets = make(map[int]int64)
+		sh.spans = nil
 		// ALL batches in a group shall be populated before sending any one to next stage.
 		for _, batch := range batches {
 			sh.service.Flush(batch)
@@ -214,7 +226,7 @@ func (sh *Sharder) doFlush(_ interface{}) {
 
 	// reschedule the delayed ForceFlush
 	sh.tid.Stop()
-	if sh.tid, err = util.GlobalTimerWheel.Schedule(time.Duration(taskCfg.FlushInterval)*time.Second, sh.ForceFlush, nil); err != nil {
+	if sh.tid, err = sh.service.timerWheel().Schedule(sh.service.flushInterval(), sh.ForceFlush, nil); err != nil {
 		if errors.Is(err, goetty.ErrSystemStopped) {
 			util.Logger.Info("Sharder.doFlush scheduling timer to a stopped timer wheel")
 		} else {
@@ -16,20 +16,27 @@ limitations under the License.
 package task
 
 import (
+	"context"
 	"fmt"
-	"math"
-	"regexp"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/fagongzi/goetty"
+	"github.com/forever765/clickhouse_sinker_nali/aggregate"
 	"github.com/forever765/clickhouse_sinker_nali/config"
+	"github.com/forever765/clickhouse_sinker_nali/enrich"
+	"github.com/forever765/clickhouse_sinker_nali/filter"
 	"github.com/forever765/clickhouse_sinker_nali/input"
 	"github.com/forever765/clickhouse_sinker_nali/model"
 	"github.com/forever765/clickhouse_sinker_nali/output"
 	"github.com/forever765/clickhouse_sinker_nali/parser"
+	"github.com/forever765/clickhouse_sinker_nali/privacy"
+	"github.com/forever765/clickhouse_sinker_nali/script"
 	"github.com/forever765/clickhouse_sinker_nali/statistics"
+	"github.com/forever765/clickhouse_sinker_nali/tenant"
 	"github.com/forever765/clickhouse_sinker_nali/util"
 	"github.com/pkg/errors"
 	"go.uber.org/zap"
@@ -44,9 +51,20 @@ type Service struct {
 	pp         *parser.Pool
 	cfg        *config.Config
 	taskCfg    *config.TaskConfig
-	whiteList  *regexp.Regexp
-	blackList  *regexp.Regexp
+	dynSchema  atomic.Value // *dynamicSchema
 	dims       []*model.ColumnWithType
+	pipeline   *enrich.Pipeline
+	filter     *filter.Filter
+	sampler    *filter.Sampler
+	deduper    *filter.Deduper
+	exploder   *parser.Exploder
+	script     *script.Transformer
+	privacy    *privacy.Transformer
+	aggregator *aggregate.Aggregator
+	columnar   bool // batches are assembled column by column, see model.Columns
+	quota      *tenant.Quota
+	priority   util.Priority
+	throttles  []*util.RateLimiter // of bytes consumed, the global one and that of the task
 
 	idxSerID int
 	nameKey  string
@@ -55,22 +73,40 @@ type Service struct {
 	newKeys    sync.Map
 	cntNewKeys int32 // size of newKeys
 	tid        goetty.Timeout
+	wheel      atomic.Value // *goetty.TimeoutWheel of the current run
 
+	widenMux    sync.Mutex
+	widenings   map[string]*pendingWidening // of columns, kept across restarts until widened
+	unwidenable sync.Map                    // columns which ClickHouse refused to widen, kept across restarts
+
+	ctx      context.Context // canceled at stopping, to stop waiting for throttles
+	cancel   context.CancelFunc
 	rings    []*Ring
 	sharder  *Sharder
 	limiter1 *rate.Limiter
 	limiter2 *rate.Limiter
+	limiter3 *rate.Limiter // for slow parsing
 
 	wgRun     sync.WaitGroup
 	state     uint32
+	draining  uint32 // 1 once Shutdown begins, new messages are ignored
 	numFlying int32
 	taskDone  *sync.Cond
+
+	restartMux sync.Mutex // serializes Stop and restarts after failures
+	closed     bool       // Stop has been called, no more restarts
+	halted     bool       // stopped due to a failure, and not restarted yet
+	failing    uint32     // 1 from a failure until the task is restarted
+	restarts   int        // consecutive restarts
+	runSince   time.Time
 }
 
 // NewTaskService creates an instance of new tasks with kafka, clickhouse and paser instances
 func NewTaskService(cfg *config.Config, taskCfg *config.TaskConfig) (service *Service) {
 	ck := output.NewClickHouse(cfg, taskCfg)
 	pp, _ := parser.NewParserPool(taskCfg.Parser, taskCfg.CsvFormat, taskCfg.Delimiter, taskCfg.TimeZone, taskCfg.TimeUnit)
+	pp.SetRenameFields(taskCfg.RenameFields, taskCfg.StripPrefixes)
+	pp.SetTypeWidening(taskCfg.TypeWidening)
 	inputer := input.NewInputer(taskCfg.KafkaClient)
 	service = &Service{
 		inputer:    inputer,
@@ -78,23 +114,35 @@ func NewTaskService(cfg *config.Config, taskCfg *config.TaskConfig) (service *Se
 		pp:         pp,
 		cfg:        cfg,
 		taskCfg:    taskCfg,
+		quota:      tenant.Get(taskCfg.Tenant),
+		widenings:  make(map[string]*pendingWidening),
 	}
+	service.priority, _ = util.ParsePriority(taskCfg.Priority)
 	service.taskDone = sync.NewCond(service)
-	if taskCfg.DynamicSchema.WhiteList != "" {
-		service.whiteList = regexp.MustCompile(taskCfg.DynamicSchema.WhiteList)
-	}
-	if taskCfg.DynamicSchema.BlackList != "" {
-		service.blackList = regexp.MustCompile(taskCfg.DynamicSchema.BlackList)
-	}
+	taskThrottle := util.GetRateLimiter(util.TaskRateLimiter(taskCfg.Name, util.RateLimitConsume))
+	taskThrottle.SetRate(taskCfg.RateLimit.ConsumeBytesPerSecond)
+	util.GetRateLimiter(util.TaskRateLimiter(taskCfg.Name, util.RateLimitWrite)).SetRate(taskCfg.RateLimit.WriteRowsPerSecond)
+	service.throttles = []*util.RateLimiter{util.GetRateLimiter(util.RateLimitConsume), taskThrottle}
+	ck.SetPanicHandler(service.fail)
+	ds, _ := newDynamicSchema(&taskCfg.DynamicSchema)
+	service.dynSchema.Store(ds)
 	return
 }
 
+// SetInputer replaces the Kafka consumer of the task, such as with a reader of files. It shall be called before Init.
+func (service *Service) SetInputer(inputer input.Inputer) {
+	service.inputer = inputer
+}
+
 // Init initializes the kafak and clickhouse task associated with this service
 func (service *Service) Init() (err error) {
 	taskCfg := service.taskCfg
 	util.Logger.Info("task initializing", zap.String("task", taskCfg.Name))
 	service.numFlying = 0
 	atomic.StoreUint32(&service.state, util.StateRunning)
+	atomic.StoreUint32(&service.draining, 0)
+	service.runSince = time.Now()
+	service.ctx, service.cancel = context.WithCancel(context.Background())
 	if err = service.clickhouse.Init(); err != nil {
 		return
 	}
@@ -104,6 +152,56 @@ func (service *Service) Init() (err error) {
 	service.nameKey = service.clickhouse.NameKey
 	service.limiter1 = rate.NewLimiter(rate.Every(10*time.Second), 1)
 	service.limiter2 = rate.NewLimiter(rate.Every(10*time.Second), 1)
+	service.limiter3 = rate.NewLimiter(rate.Every(10*time.Second), 1)
+
+	if steps := service.enrichSteps(); len(steps) != 0 && service.pipeline == nil {
+		if service.pipeline, err = enrich.NewPipeline(steps); err != nil {
+			return
+		}
+	}
+
+	if (taskCfg.Script.File != "" || taskCfg.Script.Source != "") && service.script == nil {
+		if service.script, err = script.NewTransformer(&taskCfg.Script); err != nil {
+			return
+		}
+	}
+	service.filter = nil
+	if taskCfg.Filter != "" {
+		if service.filter, err = filter.Compile(taskCfg.Filter); err != nil {
+			return
+		}
+	}
+	// keys are forgotten on restart, since messages since the last commit are consumed again
+	service.deduper = nil
+	if dc := taskCfg.Dedup; dc.Enable {
+		service.deduper = filter.NewDeduper(dc.Fields, time.Duration(dc.Window)*time.Second, dc.MaxKeys)
+	}
+	service.exploder = nil
+	if taskCfg.Explode.Field != "" {
+		service.exploder = parser.NewExploder(&taskCfg.Explode)
+	}
+	service.sampler = nil
+	if taskCfg.SamplePercent > 0 && taskCfg.SamplePercent < 100 {
+		service.sampler = filter.NewSampler(taskCfg.SamplePercent, taskCfg.SampleKey)
+	}
+	// bound to columns, which may change with the schema
+	service.privacy = nil
+	if len(taskCfg.Privacy) != 0 {
+		if service.privacy, err = privacy.New(taskCfg.Privacy, service.dims); err != nil {
+			err = errors.Wrapf(err, "task %s", taskCfg.Name)
+			return
+		}
+	}
+	service.aggregator = nil
+	if taskCfg.Aggregate.Enable {
+		if service.aggregator, err = aggregate.New(&taskCfg.Aggregate, service.dims); err != nil {
+			err = errors.Wrapf(err, "task %s", taskCfg.Name)
+			return
+		}
+	}
+
+	// rollups are computed from rows
+	service.columnar = service.aggregator == nil && service.clickhouse.Columnar()
 
 	service.rings = make([]*Ring, 0)
 	if taskCfg.ShardingKey != "" {
@@ -116,24 +214,20 @@ func (service *Service) Init() (err error) {
 		return
 	}
 
-	if taskCfg.DynamicSchema.Enable {
-		maxDims := math.MaxInt16
-		if taskCfg.DynamicSchema.MaxDims > 0 {
-			maxDims = taskCfg.DynamicSchema.MaxDims
-		}
-		if maxDims <= len(service.dims) {
-			taskCfg.DynamicSchema.Enable = false
-			util.Logger.Warn(fmt.Sprintf("disabled DynamicSchema since the number of columns reaches upper limit %d", maxDims), zap.String("task", taskCfg.Name))
-		} else {
-			for _, dim := range service.dims {
-				service.knownKeys.Store(dim.SourceName, nil)
-			}
-			for _, dim := range taskCfg.ExcludeColumns {
-				service.knownKeys.Store(dim, nil)
-			}
-			service.newKeys = sync.Map{}
-			atomic.StoreInt32(&service.cntNewKeys, 0)
-		}
+	// Known keys are kept even if DynamicSchema is disabled, since it can be enabled at runtime.
+	for _, dim := range service.dims {
+		service.knownKeys.Store(dim.SourceName, nil)
+	}
+	for _, dim := range taskCfg.ExcludeColumns {
+		service.knownKeys.Store(dim, nil)
+	}
+	service.newKeys = sync.Map{}
+	atomic.StoreInt32(&service.cntNewKeys, 0)
+	if ds := service.dynamicSchema(); ds.enable && ds.maxDims <= len(service.dims) {
+		disabled := *ds
+		disabled.enable = false
+		service.dynSchema.Store(&disabled)
+		util.Logger.Warn(fmt.Sprintf("disabled DynamicSchema since the number of columns reaches upper limit %d", ds.maxDims), zap.String("task", taskCfg.Name))
 	}
 	return
 }
@@ -144,9 +238,10 @@ func (service *Service) Run() {
 	service.wgRun.Add(1)
 	defer service.wgRun.Done()
 	taskCfg := service.taskCfg
+	service.wheel.Store(util.NewTimerWheel())
 	if service.sharder != nil {
 		// schedule a delayed ForceFlush
-		if service.sharder.tid, err = util.GlobalTimerWheel.Schedule(time.Duration(taskCfg.FlushInterval)*time.Second, service.sharder.ForceFlush, nil); err != nil {
+		if service.sharder.tid, err = service.timerWheel().Schedule(service.flushInterval(), service.sharder.ForceFlush, nil); err != nil {
 			if errors.Is(err, goetty.ErrSystemStopped) {
 				util.Logger.Info("Service.Run scheduling timer to a stopped timer wheel")
 			} else {
@@ -165,7 +260,9 @@ func (service *Service) fnCommit(partition int, offset int64) error {
 
 func (service *Service) putToRing(msg *model.InputMessage) (ok bool) {
 	taskCfg := service.taskCfg
-	statistics.ConsumeMsgsTotal.WithLabelValues(taskCfg.Name).Inc()
+	partition := strconv.Itoa(msg.Partition)
+	statistics.ConsumeMsgsTotal.WithLabelValues(taskCfg.Name, msg.Topic, partition).Inc()
+	statistics.ConsumeBytesTotal.WithLabelValues(taskCfg.Name, msg.Topic, partition).Add(float64(len(msg.Value)))
 	// ensure ring for this message exist
 	service.Lock()
 	var ring *Ring
@@ -249,23 +346,43 @@ func (service *Service) putToRing(msg *model.InputMessage) (ok bool) {
 }
 
 func (service *Service) put(msg *model.InputMessage) {
-	if atomic.LoadUint32(&service.state) != util.StateRunning {
+	if atomic.LoadUint32(&service.state) != util.StateRunning || atomic.LoadUint32(&service.draining) == 1 {
+		return
+	}
+	taskCfg := service.taskCfg
+	if util.TracingEnabled() {
+		msg.Span = util.StartMessageSpan(msg.TraceCtx, taskCfg.Name, msg.Topic, msg.Partition, msg.Offset)
+	}
+	if service.quota.WaitRow(service.ctx) != nil {
+		util.EndSpan(msg.Span, nil)
+		return
+	}
+	for _, throttle := range service.throttles {
+		if throttle.WaitN(service.ctx, len(msg.Value)) != nil {
+			util.EndSpan(msg.Span, nil)
+			return
+		}
+	}
+	if service.clickhouse.WaitWrite(service.ctx) != nil || service.clickhouse.WaitInflight(service.ctx) != nil {
+		util.EndSpan(msg.Span, nil)
 		return
 	}
 	if !service.putToRing(msg) {
+		util.EndSpan(msg.Span, nil)
 		return
 	}
 	// submit message to the parsing pool
-	taskCfg := service.taskCfg
 	service.Lock()
 	service.numFlying++
 	service.Unlock()
 	statistics.ParsingPoolBacklog.WithLabelValues(taskCfg.Name).Inc()
-	_ = util.GlobalParsingPool.Submit(func() {
+	service.quota.AcquireParsing()
+	_ = util.GlobalParsingPool.SubmitWithPriority(func() {
 		var err error
 		var row *model.Row
 		var foundNewKeys bool
-		var metric model.Metric
+		// the ring never gets the row after a panic, the task is expected to restart to consume the message again
+		defer util.Recover(service.fail)
 		defer func() {
 			service.Lock()
 			service.numFlying--
@@ -274,28 +391,96 @@ func (service *Service) put(msg *model.InputMessage) {
 			}
 			service.Unlock()
 			statistics.ParsingPoolBacklog.WithLabelValues(taskCfg.Name).Dec()
+			service.quota.ReleaseParsing()
 		}()
-		p := service.pp.Get()
-		metric, err = p.Parse(msg.Value)
+		begin := time.Now()
+		parseSpan := util.StartChildSpan(msg.Span, "parse")
+		if service.pipeline != nil {
+			var value []byte
+			if value, err = service.pipeline.Apply(msg.Value); err != nil {
+				output.PublishErrorEvent(output.NewMessageErrorEvent(taskCfg.Name, output.ReasonEnrich, msg, err))
+				if service.limiter1.Allow() {
+					util.Logger.Error(fmt.Sprintf("failed to enrich message(topic %v, partition %d, offset %v)",
+						msg.Topic, msg.Partition, msg.Offset), zap.String("task", taskCfg.Name), zap.Error(err))
+				}
+			} else {
+				msg.Value = value
+			}
+		}
+		var dropped bool
+		if service.script != nil {
+			var value []byte
+			if value, err = service.script.Transform(msg.Value); err != nil {
+				dropped = true
+				statistics.ParseMsgsErrorTotal.WithLabelValues(taskCfg.Name, output.ReasonScript).Inc()
+				output.PublishErrorEvent(output.NewMessageErrorEvent(taskCfg.Name, output.ReasonScript, msg, err))
+				if service.limiter1.Allow() {
+					util.Logger.Error(fmt.Sprintf("failed to transform message(topic %v, partition %d, offset %v)",
+						msg.Topic, msg.Partition, msg.Offset), zap.String("task", taskCfg.Name), zap.Error(err))
+				}
+			} else if value == nil {
+				dropped = true
+				statistics.FilteredRowsTotal.WithLabelValues(taskCfg.Name).Inc()
+			} else {
+				msg.Value = value
+			}
+		}
+		var rows []*model.Row
+		if !dropped {
+			// errors of enrichments have been reported, the message is parsed as is
+			err = nil
+			values := [][]byte{msg.Value}
+			if service.exploder != nil {
+				if values, err = service.exploder.Explode(msg.Value); err == nil && len(values) == 0 {
+					statistics.FilteredRowsTotal.WithLabelValues(taskCfg.Name).Inc()
+				}
+			}
+			for _, value := range values {
+				if err != nil {
+					break
+				}
+				var found bool
+				if row, found, err = service.toRow(msg, value); row != nil && row != &model.FakedRow {
+					rows = append(rows, row)
+				}
+				foundNewKeys = foundNewKeys || found
+			}
+		}
+		util.EndSpan(parseSpan, err)
+		if elapsed := time.Since(begin); util.IsSlowParse(elapsed) {
+			statistics.SlowParsesTotal.WithLabelValues(taskCfg.Name).Inc()
+			if service.limiter3.Allow() {
+				util.Logger.Warn(fmt.Sprintf("slow parsing of message(topic %v, partition %d, offset %v)",
+					msg.Topic, msg.Partition, msg.Offset), zap.String("task", taskCfg.Name), zap.Duration("elapsed", elapsed),
+					zap.Int("size", len(msg.Value)), zap.Int("parsingPoolBacklog", util.GlobalParsingPool.Backlog()),
+					zap.Int("writingPoolBacklog", util.GlobalWritingPool.Backlog()))
+			}
+		}
 		// WARNNING: Always PutElem even if there's parsing error, so that this message can be acked to Kafka and skipped writing to ClickHouse.
-		if err != nil {
+		var extra []*model.Row
+		if dropped {
+			row = &model.FakedRow
+		} else if err != nil {
+			// an exploded message is written entirely or not at all
+			for _, r := range rows {
+				model.PutRow(r)
+			}
 			row = &model.FakedRow
-			statistics.ParseMsgsErrorTotal.WithLabelValues(taskCfg.Name).Inc()
+			reason := output.ReasonParse
+			if errors.Is(err, errQuarantined) {
+				reason = output.ReasonQuarantine
+			}
+			statistics.ParseMsgsErrorTotal.WithLabelValues(taskCfg.Name, reason).Inc()
+			output.PublishErrorEvent(output.NewMessageErrorEvent(taskCfg.Name, reason, msg, err))
 			if service.limiter1.Allow() {
 				util.Logger.Error(fmt.Sprintf("failed to parse message(topic %v, partition %d, offset %v)",
 					msg.Topic, msg.Partition, msg.Offset), zap.String("message value", string(msg.Value)), zap.String("task", taskCfg.Name), zap.Error(err))
 			}
+		} else if len(rows) == 0 {
+			row = &model.FakedRow
 		} else {
-			row = model.MetricToRow(metric, msg, service.dims, service.idxSerID, service.nameKey)
-			if taskCfg.DynamicSchema.Enable {
-				foundNewKeys = metric.GetNewKeys(&service.knownKeys, &service.newKeys, service.whiteList, service.blackList)
-			}
-			// Dumping message and result
-			//util.Logger.Debug("parsed kafka message", zap.Int("partition", msg.Partition), zap.Int64("offset", msg.Offset),
-			//	zap.String("message value", string(msg.Value)), zap.String("row(spew)", spew.Sdump(row)))
+			row, extra = rows[0], rows[1:]
 		}
-		// WARNNING: metric.GetXXX may depend on p. Don't call them after p been freed.
-		service.pp.Put(p)
 
 		if foundNewKeys {
 			cntNewKeys := atomic.AddInt32(&service.cntNewKeys, 1)
@@ -310,7 +495,7 @@ func (service *Service) put(msg *model.InputMessage) {
 				if service.sharder != nil {
 					service.sharder.ForceFlush(nil)
 				}
-				if service.tid, err = util.GlobalTimerWheel.Schedule(time.Duration(taskCfg.FlushInterval)*time.Second, service.changeSchema, nil); err != nil {
+				if service.tid, err = service.timerWheel().Schedule(time.Duration(taskCfg.FlushInterval)*time.Second, service.changeSchema, nil); err != nil {
 					if errors.Is(err, goetty.ErrSystemStopped) {
 						util.Logger.Info("Service.put scheduling timer to a stopped timer wheel")
 					} else {
@@ -325,9 +510,9 @@ func (service *Service) put(msg *model.InputMessage) {
 			service.Lock()
 			ring = service.rings[msg.Partition]
 			service.Unlock()
-			ring.PutElem(model.MsgRow{Msg: msg, Row: row})
+			ring.PutElem(model.MsgRow{Msg: msg, Row: row, Extra: extra})
 		}
-	})
+	}, service.priority)
 }
 
 // drain ensure we have completeted procession(discard or write&commit) for all received messages, and cleared service state.
@@ -353,35 +538,261 @@ func (service *Service) drain() {
 	util.Logger.Debug("drained flying messages", zap.String("task", service.taskCfg.Name))
 }
 
+// toRow parses a value of the message into a row, which is FakedRow if the filter, dedup or sampling drops it.
+func (service *Service) toRow(msg *model.InputMessage, value []byte) (row *model.Row, foundNewKeys bool, err error) {
+	taskCfg := service.taskCfg
+	p := service.pp.Get()
+	// WARNNING: metric.GetXXX may depend on p. Don't call them after p been freed.
+	defer service.pp.Put(p)
+	var metric model.Metric
+	if metric, err = p.Parse(value); err != nil {
+		return
+	}
+	if service.filter != nil && !service.filter.Match(metric) {
+		row = &model.FakedRow
+		statistics.FilteredRowsTotal.WithLabelValues(taskCfg.Name).Inc()
+	} else if service.deduper != nil && service.deduper.Duplicated(metric, value) {
+		row = &model.FakedRow
+		statistics.DuplicatedRowsTotal.WithLabelValues(taskCfg.Name).Inc()
+	} else if service.sampler != nil && !service.sampler.Keep(metric) {
+		row = &model.FakedRow
+		statistics.FilteredRowsTotal.WithLabelValues(taskCfg.Name).Inc()
+	} else {
+		row = model.MetricToRow(metric, msg, service.dims, service.idxSerID, service.nameKey)
+		if taskCfg.TypeWidening != "" {
+			if foundNewKeys, err = service.widen(metric.Fallbacks()); err != nil {
+				model.PutRow(row)
+				row = nil
+				return
+			}
+		}
+		if service.privacy != nil {
+			service.privacy.Apply(*row)
+		}
+		for _, fb := range metric.Fallbacks() {
+			statistics.ColumnFallbacksTotal.WithLabelValues(taskCfg.Name, strings.Replace(fb.Key, "\\.", ".", -1), fb.Reason).Inc()
+		}
+		if ds := service.dynamicSchema(); ds.enable {
+			foundNewKeys = metric.GetNewKeys(&service.knownKeys, &service.newKeys, ds.whiteList, ds.blackList) || foundNewKeys
+		}
+	}
+	return
+}
+
+// enrichSteps returns Enrichments, after "cidr" steps of IPZoneFile and "rdns" steps of ReverseDNS.
+func (service *Service) enrichSteps() (steps []config.EnrichConfig) {
+	if file := service.taskCfg.IPZoneFile; file != "" {
+		for _, obj := range []string{"src", "dst"} {
+			steps = append(steps, config.EnrichConfig{
+				Type:    "cidr",
+				Field:   "ip_" + obj,
+				Outputs: map[string]string{"zone": "ip_zone_" + obj},
+				Params:  map[string]string{"file": file},
+			})
+		}
+	}
+	rc := &service.taskCfg.ReverseDNS
+	if rc.Enable {
+		params := map[string]string{
+			"timeout":     strconv.Itoa(rc.Timeout),
+			"cacheTTL":    strconv.Itoa(rc.CacheTTL),
+			"failureTTL":  strconv.Itoa(rc.FailureTTL),
+			"concurrency": strconv.Itoa(rc.Concurrency),
+		}
+		for _, field := range rc.Fields {
+			steps = append(steps, config.EnrichConfig{Type: "rdns", Field: field, Prefix: field + "_", Params: params})
+		}
+	}
+	return append(steps, service.taskCfg.Enrichments...)
+}
+
+// newBatch returns an empty batch, which is assembled column by column if the task allows.
+func (service *Service) newBatch() (batch *model.Batch) {
+	batch = model.NewBatch()
+	if service.columnar {
+		batch.Cols = model.GetColumns()
+	}
+	return
+}
+
 func (service *Service) Flush(batch *model.Batch) (err error) {
-	if (len(*batch.Rows)) == 0 {
+	if batch.Size() == 0 {
 		return batch.Commit()
 	}
+	if service.aggregator != nil {
+		service.aggregator.Apply(batch)
+	}
 	service.clickhouse.Send(batch)
 	return nil
 }
 
+// WriteErr returns when writes to ClickHouse began failing and the last error, which is nil if the last write succeeded.
+func (service *Service) WriteErr() (since time.Time, err error) {
+	return service.clickhouse.WriteErr()
+}
+
 func (service *Service) changeSchema(arg interface{}) {
 	var err error
 	taskCfg := service.taskCfg
 	// change schema
-	if err = service.clickhouse.ChangeSchema(&service.newKeys); err != nil {
+	if err = service.clickhouse.ChangeSchema(&service.newKeys, service.dynamicSchema().maxDims); err != nil {
 		util.Logger.Fatal("clickhouse.ChangeSchema failed", zap.String("task", taskCfg.Name), zap.Error(err))
 	}
+	if err = service.widenColumns(); err != nil {
+		util.Logger.Fatal("clickhouse.WidenColumns failed", zap.String("task", taskCfg.Name), zap.Error(err))
+	}
 	// restart myself
-	service.Stop()
+	service.restartMux.Lock()
+	defer service.restartMux.Unlock()
+	if service.closed || service.halted {
+		return
+	}
+	service.stop()
 	if err = service.Init(); err != nil {
 		util.Logger.Fatal("service.Init failed", zap.String("task", taskCfg.Name), zap.Error(err))
 	}
 	go service.Run()
 }
 
-// Stop stop kafka and clickhouse client. This is blocking.
+// fail marks the task failed after a panic of its parsing or writing, and restarts it per Config.TaskRestart, so that
+// other tasks keep running.
+func (service *Service) fail(err error) {
+	if !atomic.CompareAndSwapUint32(&service.failing, 0, 1) {
+		return
+	}
+	util.Logger.Error("task failed", zap.String("task", service.taskCfg.Name), zap.Error(err))
+	statistics.TaskFailed.WithLabelValues(service.taskCfg.Name).Set(1)
+	go service.restart()
+}
+
+func (service *Service) restart() {
+	taskCfg := service.taskCfg
+	policy := &service.cfg.TaskRestart
+	service.restartMux.Lock()
+	if service.closed {
+		service.restartMux.Unlock()
+		return
+	}
+	if !service.halted {
+		service.stop()
+		service.halted = true
+	}
+	if time.Since(service.runSince) >= time.Duration(policy.ResetAfter)*time.Second {
+		service.restarts = 0
+	}
+	if policy.MaxRestarts > 0 && service.restarts >= policy.MaxRestarts {
+		service.restartMux.Unlock()
+		util.Logger.Error("task is left failed after too many restarts", zap.String("task", taskCfg.Name),
+			zap.Int("restarts", service.restarts))
+		return
+	}
+	backoff := restartBackoff(policy, service.restarts)
+	service.restarts++
+	service.restartMux.Unlock()
+	util.Logger.Warn("restarting task", zap.String("task", taskCfg.Name), zap.Duration("backoff", backoff),
+		zap.Int("restarts", service.restarts))
+	time.Sleep(backoff)
+
+	service.restartMux.Lock()
+	defer service.restartMux.Unlock()
+	if service.closed || atomic.LoadUint32(&service.draining) == 1 {
+		return
+	}
+	statistics.TaskRestartsTotal.WithLabelValues(taskCfg.Name).Inc()
+	atomic.StoreUint32(&service.failing, 0)
+	if err := service.Init(); err != nil {
+		go service.fail(err)
+		return
+	}
+	service.halted = false
+	statistics.TaskFailed.WithLabelValues(taskCfg.Name).Set(0)
+	go service.Run()
+}
+
+// restartBackoff is InitialBackoff doubled for each of the previous consecutive restarts, at most MaxBackoff.
+func restartBackoff(policy *config.RestartPolicy, restarts int) time.Duration {
+	backoff := time.Duration(policy.InitialBackoff) * time.Second
+	maxBackoff := time.Duration(policy.MaxBackoff) * time.Second
+	for i := 0; i < restarts && backoff < maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxBackoff {
+		backoff = maxBackoff
+	}
+	return backoff
+}
+
+func (service *Service) timerWheel() *goetty.TimeoutWheel {
+	return service.wheel.Load().(*goetty.TimeoutWheel)
+}
+
+// flushInterval returns FlushInterval spread by FlushJitter.
+func (service *Service) flushInterval() time.Duration {
+	return util.Jitter(time.Duration(service.taskCfg.FlushInterval)*time.Second, float64(service.taskCfg.FlushJitter)/100)
+}
+
+// Shutdown stops accepting messages, writes all buffered rows, waits until in-flight batches are written and
+// committed, and then stops the task. Unlike Stop, buffered rows are flushed instead of discarded. It gives up once
+// ctx is done, and returns the state of what's left, undrained is false if everything was drained. Messages ignored
+// meanwhile are consumed again after restarting, since their offsets are not committed.
+func (service *Service) Shutdown(ctx context.Context) (left Internals, undrained bool) {
+	atomic.StoreUint32(&service.draining, 1)
+	done := make(chan struct{})
+	go func() {
+		service.Lock()
+		for service.numFlying != 0 {
+			service.taskDone.Wait()
+		}
+		for _, ring := range service.rings {
+			if ring != nil {
+				ring.flushAll()
+			}
+		}
+		service.Unlock()
+		if service.sharder != nil {
+			service.sharder.ForceFlush(nil)
+		}
+		service.clickhouse.Drain()
+		service.Stop()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return
+	case <-ctx.Done():
+	}
+	// The draining goroutine may hold locks while blocked by writes, so the state is taken best-effort.
+	got := make(chan Internals, 1)
+	go func() { got <- service.Internals() }()
+	select {
+	case left = <-got:
+	case <-time.After(time.Second):
+		left.Writing = -1
+	}
+	return left, true
+}
+
+// Stop stop kafka and clickhouse client. This is blocking. A stopped task is never restarted after failures.
 func (service *Service) Stop() {
+	service.restartMux.Lock()
+	defer service.restartMux.Unlock()
+	service.closed = true
+	if !service.halted {
+		service.stop()
+	}
+	util.RemoveRateLimiter(util.TaskRateLimiter(service.taskCfg.Name, util.RateLimitConsume))
+	util.RemoveRateLimiter(util.TaskRateLimiter(service.taskCfg.Name, util.RateLimitWrite))
+	statistics.TaskFailed.WithLabelValues(service.taskCfg.Name).Set(0)
+}
+
+func (service *Service) stop() {
 	taskCfg := service.taskCfg
 
 	util.Logger.Debug("stopping task service...", zap.String("task", taskCfg.Name))
 	atomic.StoreUint32(&service.state, util.StateStopped)
+	if service.cancel != nil {
+		service.cancel()
+	}
 	for _, ring := range service.rings {
 		if ring != nil {
 			ring.mux.Lock()
@@ -394,6 +805,10 @@ func (service *Service) Stop() {
 		service.sharder.tid.Stop()
 	}
 	service.tid.Stop()
+	if wheel, ok := service.wheel.Load().(*goetty.TimeoutWheel); ok {
+		// Asynchronously since Stop may be called by a callback of the wheel, see changeSchema.
+		go wheel.Stop()
+	}
 	util.Logger.Debug("stopped internal timers", zap.String("task", taskCfg.Name))
 
 	if err := service.inputer.Stop(); err != nil {
@@ -402,5 +817,13 @@ func (service *Service) Stop() {
 	util.Logger.Debug("stopped input", zap.String("task", taskCfg.Name))
 
 	service.wgRun.Wait()
+	if service.pipeline != nil {
+		service.pipeline.Close()
+		service.pipeline = nil
+	}
+	if service.script != nil {
+		service.script.Close()
+		service.script = nil
+	}
 	util.Logger.Debug("stopped task", zap.String("task", taskCfg.Name))
 }
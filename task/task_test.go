@@ -0,0 +1,32 @@
+package task
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/forever765/clickhouse_sinker_nali/config"
+	"github.com/forever765/clickhouse_sinker_nali/enrich"
+)
+
+func TestEnrichSteps(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "ip_zones.txt")
+	require.Nil(t, os.WriteFile(file, []byte("10.0.0.0/8 idc\n192.168.10.0/24 office\n"), 0644))
+	taskCfg := &config.TaskConfig{
+		IPZoneFile:  file,
+		Enrichments: []config.EnrichConfig{{Type: "url", Field: "url", Prefix: "url_"}},
+	}
+	service := &Service{taskCfg: taskCfg}
+	steps := service.enrichSteps()
+	require.Len(t, steps, 3)
+	require.Equal(t, "url", steps[2].Type)
+
+	p, err := enrich.NewPipeline(steps)
+	require.Nil(t, err)
+	defer p.Close()
+	result, err := p.Apply([]byte(`{"ip_src":"10.1.2.3","ip_dst":"8.8.8.8"}`))
+	require.Nil(t, err)
+	require.JSONEq(t, `{"ip_src":"10.1.2.3","ip_dst":"8.8.8.8","ip_zone_src":"idc"}`, string(result))
+}
@@ -0,0 +1,98 @@
+package task
+
+import (
+	"github.com/pkg/errors"
+
+	"github.com/forever765/clickhouse_sinker_nali/config"
+	"github.com/forever765/clickhouse_sinker_nali/model"
+	"github.com/forever765/clickhouse_sinker_nali/statistics"
+)
+
+// errQuarantined is the cause of errors of messages skipped by TypeWidening "quarantine".
+var errQuarantined = errors.New("quarantined by TypeWidening")
+
+// pendingWidening is a column of which values don't fit it, see config.TypeWideningAlter.
+type pendingWidening struct {
+	count int // values which don't fit the column
+	typ   int // the type which would hold all of them
+}
+
+// widerType returns the wider of column types a and b, each of which is model.Unknown, model.Float or model.String.
+func widerType(a, b int) int {
+	switch {
+	case a == model.String || b == model.String:
+		return model.String
+	case a == model.Float || b == model.Float:
+		return model.Float
+	}
+	return model.Unknown
+}
+
+// widen applies TypeWidening to fallbacks of a row which don't fit their columns. foundWiden tells whether a column
+// reaches TypeWideningThreshold and is to be widened, which changes the schema and restarts the task as new keys do.
+// err is set if the message is quarantined.
+func (service *Service) widen(fallbacks []model.Fallback) (foundWiden bool, err error) {
+	taskCfg := service.taskCfg
+	for _, fb := range fallbacks {
+		if fb.Widen == model.Unknown {
+			continue
+		}
+		var dim *model.ColumnWithType
+		for _, d := range service.dims {
+			if d.SourceName == fb.Key {
+				dim = d
+				break
+			}
+		}
+		if dim == nil {
+			continue
+		}
+		switch taskCfg.TypeWidening {
+		case config.TypeWideningAlter:
+			if _, ok := service.unwidenable.Load(dim.Name); ok {
+				// ClickHouse refused to widen it, the value is written as the default value
+				continue
+			}
+			service.widenMux.Lock()
+			pw := service.widenings[dim.Name]
+			if pw == nil {
+				pw = &pendingWidening{}
+				service.widenings[dim.Name] = pw
+			}
+			pw.count++
+			pw.typ = widerType(pw.typ, fb.Widen)
+			foundWiden = foundWiden || pw.count >= taskCfg.TypeWideningThreshold
+			service.widenMux.Unlock()
+		case config.TypeWideningQuarantine:
+			err = errors.Wrapf(errQuarantined, "field %s doesn't fit column %s of type %s", fb.Key, dim.Name,
+				model.GetTypeName(dim.Type))
+		}
+		statistics.TypeWideningsTotal.WithLabelValues(taskCfg.Name, dim.Name, taskCfg.TypeWidening).Inc()
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// widenColumns widens columns which reach TypeWideningThreshold. Columns which ClickHouse refuses to widen are left as
+// they are from then on.
+func (service *Service) widenColumns() (err error) {
+	service.widenMux.Lock()
+	defer service.widenMux.Unlock()
+	widenKeys := make(map[string]int)
+	for column, pw := range service.widenings {
+		if pw.count >= service.taskCfg.TypeWideningThreshold {
+			widenKeys[column] = pw.typ
+			delete(service.widenings, column)
+		}
+	}
+	var refused []string
+	if refused, err = service.clickhouse.WidenColumns(widenKeys); err != nil {
+		return
+	}
+	for _, column := range refused {
+		service.unwidenable.Store(column, nil)
+	}
+	return
+}
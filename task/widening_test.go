@@ -0,0 +1,85 @@
+package task
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/forever765/clickhouse_sinker_nali/config"
+	"github.com/forever765/clickhouse_sinker_nali/model"
+	"github.com/forever765/clickhouse_sinker_nali/parser"
+	"github.com/forever765/clickhouse_sinker_nali/util"
+)
+
+func newWideningService(t *testing.T, policy string, threshold int) *Service {
+	util.Logger = zap.NewNop()
+	taskCfg := &config.TaskConfig{Name: "test_widening_" + policy, Parser: "fastjson", TypeWidening: policy,
+		TypeWideningThreshold: threshold}
+	pp, err := parser.NewParserPool(taskCfg.Parser, nil, "", "", 1.0)
+	require.Nil(t, err)
+	pp.SetTypeWidening(policy)
+	service := &Service{taskCfg: taskCfg, pp: pp, idxSerID: -1, widenings: make(map[string]*pendingWidening)}
+	service.dims = []*model.ColumnWithType{
+		{Name: "count", Type: model.Int, SourceName: "count"},
+		{Name: "ratio", Type: model.Float, SourceName: "ratio"},
+	}
+	ds, _ := newDynamicSchema(&taskCfg.DynamicSchema)
+	service.dynSchema.Store(ds)
+	return service
+}
+
+func TestWiderType(t *testing.T) {
+	require.Equal(t, model.Float, widerType(model.Unknown, model.Float))
+	require.Equal(t, model.String, widerType(model.Float, model.String))
+	require.Equal(t, model.String, widerType(model.String, model.Float))
+	require.Equal(t, model.Float, widerType(model.Float, model.Float))
+}
+
+func TestTypeWideningAlter(t *testing.T) {
+	service := newWideningService(t, config.TypeWideningAlter, 3)
+	msg := &model.InputMessage{}
+	// values before the threshold are written as the default value
+	for i := 0; i < 2; i++ {
+		row, found, err := service.toRow(msg, []byte(`{"count":1.5,"ratio":0.5}`))
+		require.Nil(t, err)
+		require.False(t, found)
+		require.Equal(t, int64(0), (*row)[0])
+	}
+	_, found, err := service.toRow(msg, []byte(`{"count":"abc","ratio":0.5}`))
+	require.Nil(t, err)
+	require.True(t, found)
+	require.Equal(t, &pendingWidening{count: 3, typ: model.String}, service.widenings["count"])
+	require.Nil(t, service.widenings["ratio"])
+
+	// a column which ClickHouse refused to widen is left as it is
+	service.unwidenable.Store("ratio", nil)
+	for i := 0; i < 3; i++ {
+		_, found, err = service.toRow(msg, []byte(`{"count":1,"ratio":"abc"}`))
+		require.Nil(t, err)
+		require.False(t, found)
+	}
+	require.Nil(t, service.widenings["ratio"])
+}
+
+func TestTypeWideningCoerce(t *testing.T) {
+	service := newWideningService(t, config.TypeWideningCoerce, 0)
+	row, found, err := service.toRow(&model.InputMessage{}, []byte(`{"count":1.5,"ratio":"0.25"}`))
+	require.Nil(t, err)
+	require.False(t, found)
+	require.Equal(t, int64(1), (*row)[0])
+	require.Equal(t, 0.25, (*row)[1])
+	require.Empty(t, service.widenings)
+}
+
+func TestTypeWideningQuarantine(t *testing.T) {
+	service := newWideningService(t, config.TypeWideningQuarantine, 0)
+	row, _, err := service.toRow(&model.InputMessage{}, []byte(`{"count":1,"ratio":0.5}`))
+	require.Nil(t, err)
+	require.Equal(t, int64(1), (*row)[0])
+	row, found, err := service.toRow(&model.InputMessage{}, []byte(`{"count":1,"ratio":"abc"}`))
+	require.True(t, errors.Is(err, errQuarantined))
+	require.Nil(t, row)
+	require.False(t, found)
+}
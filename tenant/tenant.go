@@ -0,0 +1,256 @@
+// Package tenant caps resources shared by tasks of the same tenant, so that a noisy tenant can't degrade others.
+// Waits happen in the consuming goroutine of a task, so that shared parsing and writing workers are never held by a
+// tenant out of quota.
+package tenant
+
+import (
+	"context"
+	"math"
+	"sync"
+
+	"github.com/forever765/clickhouse_sinker_nali/config"
+	"github.com/forever765/clickhouse_sinker_nali/util"
+)
+
+var (
+	mux    sync.Mutex
+	quotas = make(map[string]*Quota)
+	// defaultPendingBytes caps pending bytes of tasks without a tenant, and of tenants without MaxPendingBytes.
+	defaultPendingBytes int64
+)
+
+// Quota is the resource caps of a tenant. A nil *Quota is unlimited.
+type Quota struct {
+	name    string
+	limiter *util.RateLimiter
+	parent  *Quota // writes are submitted to the parent instead of the writing pool
+
+	mux  sync.Mutex
+	cond *sync.Cond // signaled once parsing or pending bytes decrease
+
+	parsingLimit int // 0 means unlimited
+	parsing      int
+
+	maxWriters int // 0 means unlimited
+	writers    int
+	queue      []write // writes waiting for a free writer
+
+	maxPendingBytes int64 // 0 means unlimited
+	pendingBytes    int64
+}
+
+type write struct {
+	bytes int64
+	prio  util.Priority
+	fn    func()
+}
+
+// SetDefaultPendingBytes sets the cap of pending bytes for tasks without a tenant, which share a quota, and for
+// tenants without MaxPendingBytes. 0 means unlimited. It's expected to be called before any task starts.
+func SetDefaultPendingBytes(n int64) {
+	mux.Lock()
+	defer mux.Unlock()
+	defaultPendingBytes = n
+}
+
+// Get returns the quota of the named tenant. It's nil for an empty name, unless there's a default cap of pending bytes.
+func Get(name string) *Quota {
+	mux.Lock()
+	defer mux.Unlock()
+	if name == "" && defaultPendingBytes <= 0 {
+		return nil
+	}
+	q, ok := quotas[name]
+	if !ok {
+		q = &Quota{name: name, limiter: util.GetRateLimiter("tenant/" + name), maxPendingBytes: defaultPendingBytes}
+		q.cond = sync.NewCond(&q.mux)
+		quotas[name] = q
+	}
+	return q
+}
+
+// ForTask returns the quota on writes of a task, which caps writers of the task and submits writes to its tenant.
+func ForTask(taskCfg *config.TaskConfig) *Quota {
+	parent := Get(taskCfg.Tenant)
+	if taskCfg.MaxWriters <= 0 {
+		return parent
+	}
+	q := &Quota{name: taskCfg.Name, parent: parent, maxWriters: taskCfg.MaxWriters}
+	q.cond = sync.NewCond(&q.mux)
+	return q
+}
+
+// Apply updates quotas in place, so that running tasks see new caps at once. Tenants absent in cfgs become unlimited.
+// parsingWorkers is the size of the parsing pool, against which ParsingShare is calculated.
+func Apply(cfgs map[string]config.TenantConfig, parsingWorkers int) {
+	mux.Lock()
+	names := make([]string, 0, len(quotas)+len(cfgs))
+	for name := range quotas {
+		names = append(names, name)
+	}
+	mux.Unlock()
+	for name := range cfgs {
+		names = append(names, name)
+	}
+	for _, name := range names {
+		if q := Get(name); q != nil {
+			q.set(cfgs[name], parsingWorkers)
+		}
+	}
+}
+
+func (q *Quota) set(cfg config.TenantConfig, parsingWorkers int) {
+	q.limiter.SetRate(cfg.MaxRowsPerSecond)
+	q.mux.Lock()
+	q.parsingLimit = 0
+	if cfg.ParsingShare > 0 && cfg.ParsingShare < 1 {
+		q.parsingLimit = int(math.Max(1, math.Ceil(cfg.ParsingShare*float64(parsingWorkers))))
+	}
+	q.maxWriters = cfg.MaxWriters
+	q.maxPendingBytes = cfg.MaxPendingBytes
+	if q.maxPendingBytes == 0 {
+		mux.Lock()
+		q.maxPendingBytes = defaultPendingBytes
+		mux.Unlock()
+	}
+	var ready []write
+	for len(q.queue) != 0 && (q.maxWriters <= 0 || q.writers < q.maxWriters) {
+		ready = append(ready, q.dequeue())
+		q.writers++
+	}
+	q.cond.Broadcast()
+	q.mux.Unlock()
+	for _, w := range ready {
+		q.submit(w, true)
+	}
+}
+
+// WaitRow blocks until the tenant is allowed to consume another message, and there's room for pending batches. It
+// returns ctx.Err() once ctx is done.
+func (q *Quota) WaitRow(ctx context.Context) (err error) {
+	if q == nil {
+		return
+	}
+	if err = q.limiter.WaitN(ctx, 1); err != nil {
+		return
+	}
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	if q.maxPendingBytes <= 0 || q.pendingBytes < q.maxPendingBytes {
+		return
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			q.mux.Lock()
+			q.cond.Broadcast()
+			q.mux.Unlock()
+		case <-done:
+		}
+	}()
+	for q.maxPendingBytes > 0 && q.pendingBytes >= q.maxPendingBytes {
+		if err = ctx.Err(); err != nil {
+			return
+		}
+		q.cond.Wait()
+	}
+	return
+}
+
+// AcquireParsing blocks until the tenant has a free share of the parsing pool. It shall be paired with ReleaseParsing.
+func (q *Quota) AcquireParsing() {
+	if q == nil {
+		return
+	}
+	q.mux.Lock()
+	for q.parsingLimit > 0 && q.parsing >= q.parsingLimit {
+		q.cond.Wait()
+	}
+	q.parsing++
+	q.mux.Unlock()
+}
+
+func (q *Quota) ReleaseParsing() {
+	if q == nil {
+		return
+	}
+	q.mux.Lock()
+	q.parsing--
+	q.cond.Broadcast()
+	q.mux.Unlock()
+}
+
+// SubmitWrite runs fn in the global writing pool once the tenant has a free writer. It queues fn instead of blocking
+// if the tenant has none. bytes is counted as pending until fn returns.
+func (q *Quota) SubmitWrite(bytes int, fn func()) {
+	q.SubmitWriteWithPriority(bytes, util.PriorityNormal, fn)
+}
+
+// SubmitWriteWithPriority is SubmitWrite with a priority, which applies to both the tenant queue and the writing pool.
+func (q *Quota) SubmitWriteWithPriority(bytes int, prio util.Priority, fn func()) {
+	if q == nil {
+		_ = util.GlobalWritingPool.SubmitWithPriority(fn, prio)
+		return
+	}
+	w := write{bytes: int64(bytes), prio: prio, fn: fn}
+	q.mux.Lock()
+	q.pendingBytes += w.bytes
+	if q.maxWriters > 0 && q.writers >= q.maxWriters {
+		q.queue = append(q.queue, w)
+		q.mux.Unlock()
+		return
+	}
+	q.writers++
+	q.mux.Unlock()
+	q.submit(w, false)
+}
+
+// submit sends w to the writing pool. Writes dequeued by a finishing one are submitted asynchronously, since
+// submitting blocks once the pool is full, and a worker must not wait for the pool itself.
+func (q *Quota) submit(w write, async bool) {
+	job := func() {
+		w.fn()
+		q.done(w)
+	}
+	submit := func() { _ = util.GlobalWritingPool.SubmitWithPriority(job, w.prio) }
+	if q.parent != nil {
+		submit = func() { q.parent.SubmitWriteWithPriority(int(w.bytes), w.prio, job) }
+	}
+	if async {
+		go submit()
+	} else {
+		submit()
+	}
+}
+
+// dequeue removes the first queued write of the highest priority. q.mux must be held.
+func (q *Quota) dequeue() (w write) {
+	idx := 0
+	for i := range q.queue {
+		if q.queue[i].prio < q.queue[idx].prio {
+			idx = i
+		}
+	}
+	w = q.queue[idx]
+	q.queue = append(q.queue[:idx], q.queue[idx+1:]...)
+	return
+}
+
+func (q *Quota) done(w write) {
+	q.mux.Lock()
+	q.pendingBytes -= w.bytes
+	q.writers--
+	var next *write
+	if len(q.queue) != 0 && (q.maxWriters <= 0 || q.writers < q.maxWriters) {
+		w := q.dequeue()
+		next = &w
+		q.writers++
+	}
+	q.cond.Broadcast()
+	q.mux.Unlock()
+	if next != nil {
+		q.submit(*next, true)
+	}
+}
@@ -0,0 +1,143 @@
+package tenant
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/forever765/clickhouse_sinker_nali/config"
+	"github.com/forever765/clickhouse_sinker_nali/util"
+)
+
+func TestQuota(t *testing.T) {
+	util.Logger = zap.NewNop()
+	util.InitGlobalWritingPool(4)
+	Apply(map[string]config.TenantConfig{
+		"t1": {ParsingShare: 0.5, MaxWriters: 1},
+	}, 4)
+	require.Nil(t, Get(""))
+	q := Get("t1")
+	require.Equal(t, 2, q.parsingLimit)
+
+	// The third acquisition waits for a release.
+	q.AcquireParsing()
+	q.AcquireParsing()
+	acquired := make(chan struct{})
+	go func() {
+		q.AcquireParsing()
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("parsing share exceeded")
+	case <-time.After(50 * time.Millisecond):
+	}
+	q.ReleaseParsing()
+	<-acquired
+
+	// Writes run one by one.
+	var running, maxRunning int32
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		q.SubmitWrite(10, func() {
+			defer wg.Done()
+			n := atomic.AddInt32(&running, 1)
+			if n > atomic.LoadInt32(&maxRunning) {
+				atomic.StoreInt32(&maxRunning, n)
+			}
+			time.Sleep(5 * time.Millisecond)
+			atomic.AddInt32(&running, -1)
+		})
+	}
+	wg.Wait()
+	require.EqualValues(t, 1, atomic.LoadInt32(&maxRunning))
+	require.Eventually(t, func() bool {
+		q.mux.Lock()
+		defer q.mux.Unlock()
+		return q.pendingBytes == 0 && q.writers == 0
+	}, time.Second, 10*time.Millisecond)
+
+	// Removed tenants become unlimited.
+	Apply(nil, 4)
+	require.Equal(t, 0, q.parsingLimit)
+	require.Equal(t, 0, q.maxWriters)
+}
+
+func TestForTask(t *testing.T) {
+	util.Logger = zap.NewNop()
+	util.InitGlobalWritingPool(4)
+	Apply(map[string]config.TenantConfig{"t2": {MaxWriters: 2}}, 4)
+	require.Equal(t, Get("t2"), ForTask(&config.TaskConfig{Name: "a", Tenant: "t2"}))
+	q := ForTask(&config.TaskConfig{Name: "a", Tenant: "t2", MaxWriters: 1})
+	require.Equal(t, Get("t2"), q.parent)
+
+	// The task cap is tighter than the tenant one.
+	var running, maxRunning int32
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		q.SubmitWrite(10, func() {
+			defer wg.Done()
+			n := atomic.AddInt32(&running, 1)
+			if n > atomic.LoadInt32(&maxRunning) {
+				atomic.StoreInt32(&maxRunning, n)
+			}
+			time.Sleep(5 * time.Millisecond)
+			atomic.AddInt32(&running, -1)
+		})
+	}
+	wg.Wait()
+	require.EqualValues(t, 1, atomic.LoadInt32(&maxRunning))
+	require.Eventually(t, func() bool {
+		p := q.parent
+		p.mux.Lock()
+		defer p.mux.Unlock()
+		return p.pendingBytes == 0 && p.writers == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestDefaultPendingBytes(t *testing.T) {
+	util.Logger = zap.NewNop()
+	SetDefaultPendingBytes(100)
+	defer SetDefaultPendingBytes(0)
+	Apply(map[string]config.TenantConfig{"t3": {}, "t4": {MaxPendingBytes: 10}}, 4)
+	q := Get("")
+	require.NotNil(t, q)
+	require.EqualValues(t, 100, q.maxPendingBytes)
+	require.EqualValues(t, 100, Get("t3").maxPendingBytes)
+	require.EqualValues(t, 10, Get("t4").maxPendingBytes)
+}
+
+func TestWaitRow(t *testing.T) {
+	util.Logger = zap.NewNop()
+	q := &Quota{name: "t5", maxPendingBytes: 10, pendingBytes: 10}
+	q.cond = sync.NewCond(&q.mux)
+	require.Nil(t, (*Quota)(nil).WaitRow(context.Background()))
+
+	// Waiting for room of pending bytes stops once ctx is canceled.
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error)
+	go func() { errs <- q.WaitRow(ctx) }()
+	select {
+	case <-errs:
+		t.Fatal("pending bytes exceeded")
+	case <-time.After(50 * time.Millisecond):
+	}
+	cancel()
+	require.ErrorIs(t, <-errs, context.Canceled)
+
+	// It returns once pending bytes decrease.
+	go func() { errs <- q.WaitRow(context.Background()) }()
+	time.Sleep(10 * time.Millisecond)
+	q.mux.Lock()
+	q.pendingBytes = 0
+	q.cond.Broadcast()
+	q.mux.Unlock()
+	require.Nil(t, <-errs)
+}
@@ -19,6 +19,8 @@ import (
 	"go.uber.org/zap"
 )
 
+// Run runs jobFunc after initFunc until the exit signal, or a stop request if the process is a Windows service, then
+// runs cleanupFunc.
 func Run(appName string, initFunc, jobFunc, cleanupFunc func() error) {
 	Logger.Info(appName + " initialization")
 	if err := initFunc(); err != nil {
@@ -31,10 +33,14 @@ func Run(appName string, initFunc, jobFunc, cleanupFunc func() error) {
 		}
 	}()
 
-	WaitForExitSign()
+	done := waitForExit(appName)
 	Logger.Info(appName + " got the exit signal, start to clean")
+	if err := SdNotify("STOPPING=1"); err != nil {
+		Logger.Warn("SdNotify failed", zap.Error(err))
+	}
 	if err := cleanupFunc(); err != nil {
 		Logger.Fatal(appName+" clean failed", zap.Error(err))
 	}
 	Logger.Info(appName + " clean completed, exit")
+	done()
 }
@@ -0,0 +1,143 @@
+package util
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+const (
+	cgroupRoot = "/sys/fs/cgroup"
+	// cgroup v1 reports a huge page-aligned number rather than "max" if memory is unlimited
+	cgroupMemUnlimited = int64(1) << 62
+)
+
+var (
+	containerOnce sync.Once
+	containerCPU  float64
+	containerMem  int64
+)
+
+// ContainerLimits returns the CPU quota (in cores) and memory limit (in bytes) of the cgroup which the process
+// belongs to, both cgroup v1 and v2 are supported. Zero means unlimited or unknown, such as on hosts other than Linux.
+func ContainerLimits() (cpu float64, mem int64) {
+	containerOnce.Do(func() {
+		b, err := ioutil.ReadFile("/proc/self/cgroup")
+		if err != nil {
+			return
+		}
+		containerCPU, containerMem = readCgroupLimits(cgroupRoot, b)
+	})
+	return containerCPU, containerMem
+}
+
+// NumCPU is runtime.NumCPU capped by the CPU quota of the container. The quota is rounded up.
+func NumCPU() (n int) {
+	n = runtime.NumCPU()
+	if cpu, _ := ContainerLimits(); cpu > 0 && int(math.Ceil(cpu)) < n {
+		n = int(math.Ceil(cpu))
+	}
+	return
+}
+
+// MemoryLimit is the memory limit of the container, 0 if it's unlimited or unknown.
+func MemoryLimit() int64 {
+	_, mem := ContainerLimits()
+	return mem
+}
+
+// ApplyContainerLimits logs limits of the container, and sets GOMAXPROCS to NumCPU unless $GOMAXPROCS is set.
+// Otherwise the Go runtime schedules goroutines on all host cores, and the process is throttled by the CPU quota.
+func ApplyContainerLimits() {
+	cpu, mem := ContainerLimits()
+	if cpu == 0 && mem == 0 {
+		return
+	}
+	if _, ok := os.LookupEnv("GOMAXPROCS"); !ok {
+		runtime.GOMAXPROCS(NumCPU())
+	}
+	Logger.Info("detected container limits", zap.Float64("cpu", cpu), zap.Int64("memoryBytes", mem),
+		zap.Int("gomaxprocs", runtime.GOMAXPROCS(0)))
+}
+
+// readCgroupLimits reads limits of cgroups listed in procCgroup, the content of /proc/self/cgroup, under root.
+func readCgroupLimits(root string, procCgroup []byte) (cpu float64, mem int64) {
+	// hierarchy-ID:controller-list:cgroup-path, the controller list is empty for cgroup v2
+	paths := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(procCgroup))
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		for _, ctrl := range strings.Split(fields[1], ",") {
+			paths[ctrl] = fields[2]
+		}
+	}
+	if _, err := os.Stat(filepath.Join(root, "cgroup.controllers")); err == nil {
+		dirs := cgroupDirs(root, paths[""])
+		if fields := strings.Fields(readCgroupFile(dirs, "cpu.max")); len(fields) == 2 {
+			cpu = cpuQuota(fields[0], fields[1])
+		}
+		mem = memLimit(readCgroupFile(dirs, "memory.max"))
+		return
+	}
+	if path, ok := paths["cpu"]; ok {
+		for _, sub := range []string{"cpu", "cpu,cpuacct", "cpuacct,cpu"} {
+			dirs := cgroupDirs(filepath.Join(root, sub), path)
+			if quota := readCgroupFile(dirs, "cpu.cfs_quota_us"); quota != "" {
+				cpu = cpuQuota(quota, readCgroupFile(dirs, "cpu.cfs_period_us"))
+				break
+			}
+		}
+	}
+	if path, ok := paths["memory"]; ok {
+		mem = memLimit(readCgroupFile(cgroupDirs(filepath.Join(root, "memory"), path), "memory.limit_in_bytes"))
+	}
+	return
+}
+
+// cgroupDirs lists where files of a cgroup may be. The cgroup of the process is usually mounted at root inside a
+// container with its own cgroup namespace, though /proc/self/cgroup still shows the full path of the host.
+func cgroupDirs(root, path string) []string {
+	if path == "" || path == "/" {
+		return []string{root}
+	}
+	return []string{filepath.Join(root, path), root}
+}
+
+func readCgroupFile(dirs []string, name string) string {
+	for _, dir := range dirs {
+		if b, err := ioutil.ReadFile(filepath.Join(dir, name)); err == nil {
+			return strings.TrimSpace(string(b))
+		}
+	}
+	return ""
+}
+
+func cpuQuota(quota, period string) float64 {
+	q, err1 := strconv.ParseFloat(quota, 64)
+	p, err2 := strconv.ParseFloat(period, 64)
+	// quota is "max" for cgroup v2, and -1 for v1 if unlimited
+	if err1 != nil || err2 != nil || q <= 0 || p <= 0 {
+		return 0
+	}
+	return q / p
+}
+
+func memLimit(limit string) int64 {
+	mem, err := strconv.ParseInt(limit, 10, 64)
+	if err != nil || mem <= 0 || mem >= cgroupMemUnlimited {
+		return 0
+	}
+	return mem
+}
@@ -0,0 +1,51 @@
+package util
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func writeCgroupFiles(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		fp := filepath.Join(dir, name)
+		require.Nil(t, os.MkdirAll(filepath.Dir(fp), 0755))
+		require.Nil(t, ioutil.WriteFile(fp, []byte(content+"\n"), 0600))
+	}
+}
+
+func TestReadCgroupLimits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cgroup")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	// cgroup v2, files of the cgroup namespace are mounted at root
+	v2 := filepath.Join(dir, "v2")
+	writeCgroupFiles(t, v2, map[string]string{
+		"cgroup.controllers": "cpu memory",
+		"cpu.max":            "250000 100000",
+		"memory.max":         "536870912",
+	})
+	cpu, mem := readCgroupLimits(v2, []byte("0::/kubepods/pod1/c1\n"))
+	require.Equal(t, 2.5, cpu)
+	require.Equal(t, int64(512<<20), mem)
+
+	writeCgroupFiles(t, v2, map[string]string{"cpu.max": "max 100000", "memory.max": "max"})
+	cpu, mem = readCgroupLimits(v2, []byte("0::/\n"))
+	require.Zero(t, cpu)
+	require.Zero(t, mem)
+
+	// cgroup v1 with the full path
+	v1 := filepath.Join(dir, "v1")
+	writeCgroupFiles(t, v1, map[string]string{
+		"cpu,cpuacct/docker/c1/cpu.cfs_quota_us":  "50000",
+		"cpu,cpuacct/docker/c1/cpu.cfs_period_us": "100000",
+		"memory/docker/c1/memory.limit_in_bytes":  "9223372036854771712",
+	})
+	cpu, mem = readCgroupLimits(v1, []byte("12:memory:/docker/c1\n4:cpu,cpuacct:/docker/c1\n1:name=systemd:/docker/c1\n"))
+	require.Equal(t, 0.5, cpu)
+	require.Zero(t, mem)
+}
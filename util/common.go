@@ -16,17 +16,14 @@ limitations under the License.
 package util
 
 import (
-	"bytes"
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
 	"io/ioutil"
+	"math/rand"
 	"net"
 	"os"
-	"os/exec"
-	"path/filepath"
 	"reflect"
-	"runtime"
 	"strconv"
 	"strings"
 	"time"
@@ -39,21 +36,43 @@ import (
 	"github.com/pkg/errors"
 )
 
+// The resolution of flush timers, which is enough for jitter of flush intervals in seconds.
+const timerWheelTick = 100 * time.Millisecond
+
 var (
-	GlobalTimerWheel  *goetty.TimeoutWheel //the global timer wheel
-	GlobalParsingPool *WorkerPool          //for all tasks' parsing, cpu intensive
-	GlobalWritingPool *WorkerPool          //the all tasks' writing ClickHouse, cpu-net balance
+	GlobalParsingPool *WorkerPool //for all tasks' parsing, cpu intensive
+	GlobalWritingPool *WorkerPool //the all tasks' writing ClickHouse, cpu-net balance
 	Logger            *zap.Logger
 	logAtomLevel      zap.AtomicLevel
 	logPaths          []string
+	logEncoding       = "json"
+	logRotation       = LogRotation{MaxSize: 100, MaxBackups: 10}
 )
 
-// InitGlobalTimerWheel initialize the global timer wheel
-func InitGlobalTimerWheel() {
-	if GlobalTimerWheel != nil {
-		return
+// LogRotation rotates log files, see lumberjack.Logger. Zero MaxBackups and MaxAge mean keeping all.
+type LogRotation struct {
+	MaxSize    int  // megabytes of a file before rotated
+	MaxBackups int  // rotated files to keep
+	MaxAge     int  // days to keep rotated files
+	Compress   bool // gzip rotated files
+}
+
+// NewTimerWheel creates a timer wheel for flushing a task. Callbacks of a wheel run one by one, so each task has its
+// own wheel, and a task blocked in flushing doesn't delay timers of others.
+func NewTimerWheel() *goetty.TimeoutWheel {
+	return goetty.NewTimeoutWheel(goetty.WithTickInterval(timerWheelTick), goetty.WithBucketsExponent(6), goetty.WithLocksExponent(2))
+}
+
+// Jitter randomly spreads d by up to ratio of it in both directions, so that timers of the same interval don't fire
+// at the same instant.
+func Jitter(d time.Duration, ratio float64) time.Duration {
+	if ratio <= 0 {
+		return d
+	}
+	if ratio > 1 {
+		ratio = 1
 	}
-	GlobalTimerWheel = goetty.NewTimeoutWheel(goetty.WithTickInterval(time.Second))
+	return d + time.Duration((rand.Float64()*2-1)*ratio*float64(d))
 }
 
 // InitGlobalParsingPool initialize GlobalParsingPool
@@ -61,17 +80,24 @@ func InitGlobalParsingPool() {
 	if GlobalParsingPool != nil {
 		return
 	}
-	maxWorkers := 10
-	if runtime.NumCPU() >= 2 {
-		if maxWorkers > runtime.NumCPU()/2 {
-			maxWorkers = runtime.NumCPU() / 2
+	maxWorkers := DefaultParsingWorkers()
+	queueSize := 1 << 16
+	GlobalParsingPool = NewWorkerPool(maxWorkers, queueSize)
+	Logger.Info("initialized parsing pool", zap.Int("maxWorkers", maxWorkers), zap.Int("queueSize", queueSize))
+}
+
+// DefaultParsingWorkers is the size of GlobalParsingPool unless it's resized by PoolSizer. CPUs are counted by NumCPU,
+// so that the pool fits the CPU quota of the container.
+func DefaultParsingWorkers() (maxWorkers int) {
+	maxWorkers = 10
+	if NumCPU() >= 2 {
+		if maxWorkers > NumCPU()/2 {
+			maxWorkers = NumCPU() / 2
 		}
 	} else {
 		maxWorkers = 1
 	}
-	queueSize := 1 << 16
-	GlobalParsingPool = NewWorkerPool(maxWorkers, queueSize)
-	Logger.Info("initialized parsing pool", zap.Int("maxWorkers", maxWorkers), zap.Int("queueSize", queueSize))
+	return
 }
 
 // InitGlobalWritingPool initialize GlobalWritingPool
@@ -107,9 +133,13 @@ func GetShift(s int) (shift uint) {
 	return
 }
 
-// GetOutboundIP get preferred outbound ip of this machine
+// GetOutboundIP get preferred outbound ip of this machine. selector is an interface name(such as eth0) or a CIDR(such
+// as 10.0.0.0/8), see InterfaceIP. Empty selector means the IP routing to the Internet, which requires a default route.
 //https://stackoverflow.com/questions/23558425/how-do-i-get-the-local-ip-address-in-go
-func GetOutboundIP() (ip net.IP, err error) {
+func GetOutboundIP(selector string) (ip net.IP, err error) {
+	if selector != "" {
+		return InterfaceIP(selector)
+	}
 	var conn net.Conn
 	if conn, err = net.Dial("udp", "8.8.8.8:80"); err != nil {
 		err = errors.Wrapf(err, "")
@@ -121,20 +151,6 @@ func GetOutboundIP() (ip net.IP, err error) {
 	return
 }
 
-// GetSpareTCPPort find a spare TCP port
-func GetSpareTCPPort(portBegin int) (port int) {
-LOOP:
-	for port = portBegin; ; port++ {
-		addr := fmt.Sprintf(":%d", port)
-		ln, err := net.Listen("tcp", addr)
-		if err == nil {
-			ln.Close()
-			break LOOP
-		}
-	}
-	return
-}
-
 // https://stackoverflow.com/questions/50428176/how-to-get-ip-and-port-from-net-addr-when-it-could-be-a-net-udpaddr-or-net-tcpad
 func GetNetAddrPort(addr net.Addr) (port int) {
 	switch addr := addr.(type) {
@@ -150,29 +166,31 @@ func GetNetAddrPort(addr net.Addr) (port int) {
 // https://medium.com/processone/using-tls-authentication-for-your-go-kafka-client-3c5841f2a625
 // https://github.com/denji/golang-tls
 // https://www.baeldung.com/java-keystore-truststore-difference
-func NewTLSConfig(caCertFiles, clientCertFile, clientKeyFile string, insecureSkipVerify bool) (*tls.Config, error) {
+func NewTLSConfig(caCertFiles, clientCertFile, clientKeyFile, clientKeyPassword string, insecureSkipVerify bool) (*tls.Config, error) {
 	tlsConfig := tls.Config{}
-	// Load client cert
+	// Load client cert, which is reloaded once the files change. An encrypted key is decrypted with the passphrase
+	// which clientKeyPassword refers to.
 	if clientCertFile != "" && clientKeyFile != "" {
-		cert, err := tls.LoadX509KeyPair(clientCertFile, clientKeyFile)
+		r, err := getCertReloader(clientCertFile, clientKeyFile, clientKeyPassword)
 		if err != nil {
-			err = errors.Wrapf(err, "")
 			return &tlsConfig, err
 		}
-		tlsConfig.Certificates = []tls.Certificate{cert}
+		tlsConfig.GetClientCertificate = r.getClientCertificate
 	}
 
-	// Load CA cert
-	caCertPool := x509.NewCertPool()
-	for _, caCertFile := range strings.Split(caCertFiles, ",") {
-		caCert, err := ioutil.ReadFile(caCertFile)
-		if err != nil {
-			err = errors.Wrapf(err, "")
-			return &tlsConfig, err
+	// Load CA cert. The system ones are used if none is given.
+	if caCertFiles != "" {
+		caCertPool := x509.NewCertPool()
+		for _, caCertFile := range strings.Split(caCertFiles, ",") {
+			caCert, err := ioutil.ReadFile(caCertFile)
+			if err != nil {
+				err = errors.Wrapf(err, "")
+				return &tlsConfig, err
+			}
+			caCertPool.AppendCertsFromPEM(caCert)
 		}
-		caCertPool.AppendCertsFromPEM(caCert)
+		tlsConfig.RootCAs = caCertPool
 	}
-	tlsConfig.RootCAs = caCertPool
 	tlsConfig.InsecureSkipVerify = insecureSkipVerify
 	return &tlsConfig, nil
 }
@@ -196,6 +214,17 @@ func EnvIntVar(value *int, key string) {
 	}
 }
 
+func EnvFloatVar(value *float64, key string) {
+	realKey := strings.ReplaceAll(strings.ToUpper(key), "-", "_")
+	val, found := os.LookupEnv(realKey)
+	if found {
+		valFloat, err := strconv.ParseFloat(val, 64)
+		if err == nil {
+			*value = valFloat
+		}
+	}
+}
+
 func EnvBoolVar(value *bool, key string) {
 	realKey := strings.ReplaceAll(strings.ToUpper(key), "-", "_")
 	if _, found := os.LookupEnv(realKey); found {
@@ -203,52 +232,25 @@ func EnvBoolVar(value *bool, key string) {
 	}
 }
 
-// JksToPem converts JKS to PEM
-// Refers to:
-// https://serverfault.com/questions/715827/how-to-generate-key-and-crt-file-from-jks-file-for-httpd-apache-server
-func JksToPem(jksPath, jksPassword string, overwrite bool) (certPemPath, keyPemPath string, err error) {
-	dir, fn := filepath.Split(jksPath)
-	certPemPath = filepath.Join(dir, fn+".cert.pem")
-	keyPemPath = filepath.Join(dir, fn+".key.pem")
-	pkcs12Path := filepath.Join(dir, fn+".p12")
-	if overwrite {
-		for _, fp := range []string{certPemPath, keyPemPath, pkcs12Path} {
-			if err = os.RemoveAll(fp); err != nil {
-				err = errors.Wrapf(err, "")
-				return
-			}
-		}
-	} else {
-		for _, fp := range []string{certPemPath, keyPemPath, pkcs12Path} {
-			if _, err = os.Stat(fp); err == nil {
-				return
-			}
-		}
+// SetLogEncoding sets the encoding of logs, "json" or "console" which is human-readable. It takes effect at the next
+// InitLogger.
+func SetLogEncoding(encoding string) {
+	if encoding != logEncoding {
+		logEncoding = encoding
+		logPaths = nil
 	}
-	cmds := [][]string{
-		{"keytool", "-importkeystore", "-srckeystore", jksPath, "-destkeystore", pkcs12Path, "-deststoretype", "PKCS12"},
-		{"openssl", "pkcs12", "-in", pkcs12Path, "-nokeys", "-out", certPemPath, "-passin", "env:password"},
-		{"openssl", "pkcs12", "-in", pkcs12Path, "-nodes", "-nocerts", "-out", keyPemPath, "-passin", "env:password"},
-	}
-	for _, cmd := range cmds {
-		Logger.Info(strings.Join(cmd, " "))
-		exe := exec.Command(cmd[0], cmd[1:]...)
-		if cmd[0] == "keytool" {
-			exe.Stdin = bytes.NewReader([]byte(jksPassword + "\n" + jksPassword + "\n" + jksPassword))
-		} else if cmd[0] == "openssl" {
-			exe.Env = []string{fmt.Sprintf("password=%s", jksPassword)}
-		}
-		var out []byte
-		out, err = exe.CombinedOutput()
-		Logger.Info(string(out))
-		if err != nil {
-			err = errors.Wrapf(err, "")
-			return
-		}
+}
+
+// SetLogRotation sets rotation of log files. It takes effect at the next InitLogger.
+func SetLogRotation(rotation LogRotation) {
+	if rotation != logRotation {
+		logRotation = rotation
+		logPaths = nil
 	}
-	return
 }
 
+// InitLogger writes logs to each of newLogPaths, which is a file, "stdout", "stderr", or a sink of syslog or journald,
+// see parseLogSink.
 func InitLogger(newLogPaths []string) {
 	if reflect.DeepEqual(logPaths, newLogPaths) {
 		return
@@ -256,7 +258,15 @@ func InitLogger(newLogPaths []string) {
 	logAtomLevel = zap.NewAtomicLevel()
 	logPaths = newLogPaths
 	var syncers []zapcore.WriteSyncer
+	var sinks []logSink
 	for _, p := range logPaths {
+		if sink, err := parseLogSink(p); err != nil {
+			fmt.Fprintf(os.Stderr, "ignored log path %s: %+v\n", p, err)
+			continue
+		} else if sink != nil {
+			sinks = append(sinks, sink)
+			continue
+		}
 		switch p {
 		case "stdout":
 			syncers = append(syncers, zapcore.AddSync(os.Stdout))
@@ -265,8 +275,10 @@ func InitLogger(newLogPaths []string) {
 		default:
 			writeFile := zapcore.AddSync(&lumberjack.Logger{
 				Filename:   p,
-				MaxSize:    100, // megabytes
-				MaxBackups: 10,
+				MaxSize:    logRotation.MaxSize,
+				MaxBackups: logRotation.MaxBackups,
+				MaxAge:     logRotation.MaxAge,
+				Compress:   logRotation.Compress,
 				LocalTime:  true,
 			})
 			syncers = append(syncers, writeFile)
@@ -275,20 +287,31 @@ func InitLogger(newLogPaths []string) {
 
 	cfg := zap.NewProductionEncoderConfig()
 	cfg.EncodeTime = zapcore.ISO8601TimeEncoder
-	core := zapcore.NewCore(
-		zapcore.NewJSONEncoder(cfg),
+	encoder := zapcore.NewJSONEncoder(cfg)
+	if logEncoding == "console" {
+		cfg.EncodeLevel = zapcore.CapitalLevelEncoder
+		encoder = zapcore.NewConsoleEncoder(cfg)
+	}
+	cores := []zapcore.Core{zapcore.NewCore(
+		encoder,
 		zapcore.NewMultiWriteSyncer(syncers...),
-		logAtomLevel,
-	)
-	Logger = zap.New(core, zap.AddStacktrace(zap.ErrorLevel))
+		zapcore.DebugLevel,
+	)}
+	for _, sink := range sinks {
+		cores = append(cores, &sinkCore{zapcore.DebugLevel, encoder.Clone(), sink})
+	}
+	core := zapcore.NewTee(taskLevelCore{Core: newSamplingCore(zapcore.NewTee(cores...)), level: logAtomLevel}, errorRecorder{})
+	Logger = zap.New(core, zap.AddStacktrace(zap.ErrorLevel), zap.AddCaller())
 }
 
+// SetLogLevel sets the global level and levels of modules, see ParseLogLevel. An invalid spec means info.
 func SetLogLevel(newLogLevel string) {
 	if Logger != nil {
-		var lvl zapcore.Level
-		if err := lvl.Set(newLogLevel); err != nil {
-			lvl = zap.InfoLevel
+		lvl, modules, err := ParseLogLevel(newLogLevel)
+		if err != nil {
+			lvl, modules = zap.InfoLevel, nil
 		}
 		logAtomLevel.SetLevel(lvl)
+		curModuleLevels.Store(newTaskLevels(modules))
 	}
 }
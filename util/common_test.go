@@ -3,6 +3,7 @@ package util
 import (
 	"os"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -21,3 +22,11 @@ func TestJksToPem(t *testing.T) {
 		t.Logf("converted %s to %s, %s\n", jksPath, certPemPath, keyPemPath)
 	}
 }
+
+func TestJitter(t *testing.T) {
+	require.Equal(t, 5*time.Second, Jitter(5*time.Second, 0))
+	for i := 0; i < 1000; i++ {
+		d := Jitter(10*time.Second, 0.2)
+		require.True(t, d >= 8*time.Second && d <= 12*time.Second, d)
+	}
+}
@@ -0,0 +1,126 @@
+package util
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pavlo-v-chernykh/keystore-go/v4"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// Magic number at the beginning of JKS files. Other key stores are taken as PKCS12, the default type since Java 9.
+var jksMagic = []byte{0xfe, 0xed, 0xfe, 0xed}
+
+// JksToPem converts a JKS or PKCS12 key store to PEM files next to it, certificates to "<jksPath>.cert.pem" and the
+// private key (if any) to "<jksPath>.key.pem" in PKCS#8. Existing PEM files are reused unless overwrite is set.
+// Private keys of JKS are expected to be protected by the store password.
+func JksToPem(jksPath, jksPassword string, overwrite bool) (certPemPath, keyPemPath string, err error) {
+	dir, fn := filepath.Split(jksPath)
+	certPemPath = filepath.Join(dir, fn+".cert.pem")
+	keyPemPath = filepath.Join(dir, fn+".key.pem")
+	// intermediate file of former conversions by keytool
+	pkcs12Path := filepath.Join(dir, fn+".p12")
+	if overwrite {
+		for _, fp := range []string{certPemPath, keyPemPath, pkcs12Path} {
+			if err = os.RemoveAll(fp); err != nil {
+				err = errors.Wrapf(err, "")
+				return
+			}
+		}
+	} else {
+		for _, fp := range []string{certPemPath, keyPemPath} {
+			if _, err = os.Stat(fp); err == nil {
+				return
+			}
+		}
+	}
+	var data []byte
+	if data, err = ioutil.ReadFile(jksPath); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	var certs, keys []*pem.Block
+	if bytes.HasPrefix(data, jksMagic) {
+		certs, keys, err = decodeJks(data, jksPassword)
+	} else {
+		certs, keys, err = decodePkcs12(data, jksPassword)
+	}
+	if err != nil {
+		err = errors.Wrapf(err, "failed to decode %s", jksPath)
+		return
+	}
+	for fp, blocks := range map[string][]*pem.Block{certPemPath: certs, keyPemPath: keys} {
+		var buf bytes.Buffer
+		for _, block := range blocks {
+			_ = pem.Encode(&buf, block)
+		}
+		if err = ioutil.WriteFile(fp, buf.Bytes(), 0600); err != nil {
+			err = errors.Wrapf(err, "")
+			return
+		}
+	}
+	Logger.Info("converted key store to PEM", zap.String("keyStore", jksPath), zap.Int("certificates", len(certs)),
+		zap.Int("keys", len(keys)))
+	return
+}
+
+func decodeJks(data []byte, password string) (certs, keys []*pem.Block, err error) {
+	ks := keystore.New()
+	if err = ks.Load(bytes.NewReader(data), []byte(password)); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	for _, alias := range ks.Aliases() {
+		switch {
+		case ks.IsPrivateKeyEntry(alias):
+			var entry keystore.PrivateKeyEntry
+			if entry, err = ks.GetPrivateKeyEntry(alias, []byte(password)); err != nil {
+				err = errors.Wrapf(err, "alias %s", alias)
+				return
+			}
+			keys = append(keys, &pem.Block{Type: "PRIVATE KEY", Bytes: entry.PrivateKey})
+			for _, cert := range entry.CertificateChain {
+				certs = append(certs, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Content})
+			}
+		case ks.IsTrustedCertificateEntry(alias):
+			var entry keystore.TrustedCertificateEntry
+			if entry, err = ks.GetTrustedCertificateEntry(alias); err != nil {
+				err = errors.Wrapf(err, "alias %s", alias)
+				return
+			}
+			certs = append(certs, &pem.Block{Type: "CERTIFICATE", Bytes: entry.Certificate.Content})
+		}
+	}
+	return
+}
+
+func decodePkcs12(data []byte, password string) (certs, keys []*pem.Block, err error) {
+	key, cert, caCerts, err := pkcs12.DecodeChain(data, password)
+	if err != nil {
+		// trust stores hold certificates only
+		var errTrust error
+		if caCerts, errTrust = pkcs12.DecodeTrustStore(data, password); errTrust != nil {
+			err = errors.Wrapf(err, "")
+			return
+		}
+		err = nil
+	} else {
+		var der []byte
+		if der, err = x509.MarshalPKCS8PrivateKey(key); err != nil {
+			err = errors.Wrapf(err, "")
+			return
+		}
+		keys = append(keys, &pem.Block{Type: "PRIVATE KEY", Bytes: der})
+		caCerts = append([]*x509.Certificate{cert}, caCerts...)
+	}
+	for _, c := range caCerts {
+		certs = append(certs, &pem.Block{Type: "CERTIFICATE", Bytes: c.Raw})
+	}
+	return
+}
@@ -0,0 +1,80 @@
+package util
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pavlo-v-chernykh/keystore-go/v4"
+	"github.com/stretchr/testify/require"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+func TestKeyStoreToPem(t *testing.T) {
+	InitLogger([]string{"stdout"})
+	dir, err := ioutil.TempDir("", "keystore")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.Nil(t, err)
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	require.Nil(t, err)
+	password := "123456"
+
+	ks := keystore.New()
+	require.Nil(t, ks.SetPrivateKeyEntry("client", keystore.PrivateKeyEntry{
+		CreationTime:     time.Now(),
+		PrivateKey:       keyDer,
+		CertificateChain: []keystore.Certificate{{Type: "X509", Content: der}},
+	}, []byte(password)))
+	var buf bytes.Buffer
+	require.Nil(t, ks.Store(&buf, []byte(password)))
+	jksPath := filepath.Join(dir, "client.keystore.jks")
+	require.Nil(t, ioutil.WriteFile(jksPath, buf.Bytes(), 0600))
+
+	p12, err := pkcs12.Encode(rand.Reader, key, cert, nil, password)
+	require.Nil(t, err)
+	p12Path := filepath.Join(dir, "client.keystore.p12")
+	require.Nil(t, ioutil.WriteFile(p12Path, p12, 0600))
+
+	for _, path := range []string{jksPath, p12Path} {
+		certPemPath, keyPemPath, err := JksToPem(path, password, false)
+		require.Nil(t, err)
+		pair, err := tls.LoadX509KeyPair(certPemPath, keyPemPath)
+		require.Nil(t, err)
+		require.Equal(t, der, pair.Certificate[0])
+	}
+
+	trust, err := pkcs12.EncodeTrustStore(rand.Reader, []*x509.Certificate{cert}, password)
+	require.Nil(t, err)
+	trustPath := filepath.Join(dir, "client.truststore.p12")
+	require.Nil(t, ioutil.WriteFile(trustPath, trust, 0600))
+	certPemPath, _, err := JksToPem(trustPath, password, false)
+	require.Nil(t, err)
+	_, err = NewTLSConfig(certPemPath, "", "", "", false)
+	require.Nil(t, err)
+
+	_, _, err = JksToPem(jksPath, "wrong", true)
+	require.NotNil(t, err)
+}
@@ -0,0 +1,101 @@
+package util
+
+import (
+	"hash/fnv"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+const logSampleBuckets = 4096
+
+type logSampling struct {
+	first      uint64
+	thereafter uint64
+}
+
+var (
+	curLogSampling atomic.Value // logSampling
+	sampledOutLogs uint64
+)
+
+// SetLogSampling limits logs of the same level and message to the first ones each second, and every thereafter-th
+// one beyond, so that a flood of identical logs can't fill the disk. first 0 disables sampling, thereafter 0 drops
+// all beyond the first ones. Logs of dpanic and higher levels are never dropped.
+func SetLogSampling(first, thereafter int) {
+	if first < 0 {
+		first = 0
+	}
+	if thereafter < 0 {
+		thereafter = 0
+	}
+	curLogSampling.Store(logSampling{first: uint64(first), thereafter: uint64(thereafter)})
+}
+
+// SampledOutLogs returns the number of logs dropped by sampling.
+func SampledOutLogs() uint64 {
+	return atomic.LoadUint64(&sampledOutLogs)
+}
+
+type logCounter struct {
+	resetAt int64
+	n       uint64
+}
+
+// inc counts an entry in the second since resetAt, the race of resetting is tolerable.
+func (c *logCounter) inc(now int64) uint64 {
+	if atomic.LoadInt64(&c.resetAt) > now {
+		return atomic.AddUint64(&c.n, 1)
+	}
+	atomic.StoreUint64(&c.n, 1)
+	atomic.StoreInt64(&c.resetAt, now+int64(time.Second))
+	return 1
+}
+
+// logCounters are hashed by level and message. Collisions only make sampling a bit more aggressive.
+type logCounters [zapcore.FatalLevel - zapcore.DebugLevel + 1][logSampleBuckets]logCounter
+
+// samplingCore drops entries beyond the sampling setting. It's wrapped by taskLevelCore, so only entries which pass
+// the level filter are counted.
+type samplingCore struct {
+	zapcore.Core
+	counters *logCounters
+}
+
+func newSamplingCore(core zapcore.Core) samplingCore {
+	return samplingCore{Core: core, counters: &logCounters{}}
+}
+
+func (c samplingCore) With(fields []zapcore.Field) zapcore.Core {
+	return samplingCore{Core: c.Core.With(fields), counters: c.counters}
+}
+
+func (c samplingCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(ent.Level) {
+		return ce.AddCore(ent, c)
+	}
+	return ce
+}
+
+func (c samplingCore) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+	if c.sampledOut(ent) {
+		atomic.AddUint64(&sampledOutLogs, 1)
+		return nil
+	}
+	return c.Core.Write(ent, fields)
+}
+
+func (c samplingCore) sampledOut(ent zapcore.Entry) bool {
+	s, _ := curLogSampling.Load().(logSampling)
+	if s.first == 0 || ent.Level < zapcore.DebugLevel || ent.Level >= zapcore.DPanicLevel {
+		return false
+	}
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(ent.Message))
+	n := c.counters[ent.Level-zapcore.DebugLevel][h.Sum32()%logSampleBuckets].inc(ent.Time.UnixNano())
+	if n <= s.first {
+		return false
+	}
+	return s.thereafter == 0 || (n-s.first)%s.thereafter != 0
+}
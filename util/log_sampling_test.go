@@ -0,0 +1,36 @@
+package util
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestLogSampling(t *testing.T) {
+	inner, logs := observer.New(zapcore.DebugLevel)
+	logger := zap.New(newSamplingCore(inner))
+	SetLogSampling(2, 3)
+	defer SetLogSampling(0, 0)
+
+	before := SampledOutLogs()
+	for i := 0; i < 10; i++ {
+		logger.Warn("flood", zap.Int("i", i))
+	}
+	logger.Warn("other")
+	logger.Error("flood")
+	logger.DPanic("flood")
+
+	var got []int64
+	for _, e := range logs.FilterMessage("flood").FilterLevelExact(zapcore.WarnLevel).All() {
+		got = append(got, e.ContextMap()["i"].(int64))
+	}
+	// the first 2, then every 3rd
+	require.Equal(t, []int64{0, 1, 4, 7}, got)
+	require.Equal(t, 1, logs.FilterMessage("other").Len())
+	require.Equal(t, 1, logs.FilterLevelExact(zapcore.ErrorLevel).Len())
+	require.Equal(t, 1, logs.FilterLevelExact(zapcore.DPanicLevel).Len())
+	require.Equal(t, uint64(6), SampledOutLogs()-before)
+}
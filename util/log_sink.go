@@ -0,0 +1,205 @@
+package util
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap/zapcore"
+)
+
+const (
+	journaldSocket = "/run/systemd/journal/socket"
+	syslogFacility = 3 // daemon
+)
+
+// local syslog sockets of Linux, macOS and BSD
+var syslogSockets = []string{"/dev/log", "/var/run/syslog", "/var/run/log"}
+
+// logSink writes an encoded log entry with its level, which is mapped to the priority of syslog and journald.
+type logSink interface {
+	writeLevel(lvl zapcore.Level, p []byte) error
+	Sync() error
+}
+
+// parseLogSink returns the sink of a log path, or nil if the path is a file. The paths are:
+//   - "journald": the native protocol of systemd-journald
+//   - "syslog://": the local syslog daemon
+//   - "syslog://host:port" or "syslog+udp://host:port": a remote syslog server over UDP
+//   - "syslog+tcp://host:port": a remote syslog server over TCP, each message is terminated by a newline
+//   - "syslog:///path/to/socket": a unix socket of syslog
+//
+// Connections are made at the first write, and made again after a failed write.
+func parseLogSink(path string) (sink logSink, err error) {
+	if path == "journald" {
+		return &journaldSink{netSink: netSink{network: "unixgram", addrs: []string{journaldSocket}}}, nil
+	}
+	if !strings.HasPrefix(path, "syslog") || !strings.Contains(path, "://") {
+		return
+	}
+	var u *url.URL
+	if u, err = url.Parse(path); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	if u.Scheme != "syslog" && u.Scheme != "syslog+udp" && u.Scheme != "syslog+tcp" {
+		err = errors.Errorf("unknown log path %s", path)
+		return
+	}
+	s := &syslogSink{tag: filepath.Base(os.Args[0]), pid: os.Getpid()}
+	s.hostname, _ = os.Hostname()
+	switch {
+	case u.Host != "" && u.Scheme == "syslog+tcp":
+		s.network, s.addrs, s.framed = "tcp", []string{u.Host}, true
+	case u.Host != "":
+		s.network, s.addrs = "udp", []string{u.Host}
+	case u.Path != "":
+		s.network, s.addrs = "unixgram", []string{u.Path}
+	default:
+		s.network, s.addrs = "unixgram", syslogSockets
+	}
+	return s, nil
+}
+
+// netSink writes each message with a write of a connection.
+type netSink struct {
+	mux     sync.Mutex
+	network string
+	addrs   []string // tried in order at connecting
+	conn    net.Conn
+}
+
+func (s *netSink) write(msg []byte) (err error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.conn != nil {
+		if _, err = s.conn.Write(msg); err == nil {
+			return
+		}
+		s.conn.Close()
+		s.conn = nil
+	}
+	for _, addr := range s.addrs {
+		if s.conn, err = net.DialTimeout(s.network, addr, 5*time.Second); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	if _, err = s.conn.Write(msg); err != nil {
+		err = errors.Wrapf(err, "")
+	}
+	return
+}
+
+func (s *netSink) Sync() error {
+	return nil
+}
+
+// syslogSink writes messages in the format of RFC 3164, the one understood by most syslog daemons.
+type syslogSink struct {
+	netSink
+	framed   bool // terminate each message with a newline, as required by TCP
+	tag      string
+	hostname string
+	pid      int
+}
+
+func (s *syslogSink) writeLevel(lvl zapcore.Level, p []byte) error {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "<%d>%s %s %s[%d]: ", syslogFacility*8+logSeverity(lvl), time.Now().Format(time.RFC3339),
+		s.hostname, s.tag, s.pid)
+	b.Write(bytes.TrimRight(p, "\n"))
+	if s.framed {
+		b.WriteByte('\n')
+	}
+	return s.write(b.Bytes())
+}
+
+// journaldSink writes messages in the native protocol of systemd-journald.
+type journaldSink struct {
+	netSink
+}
+
+func (s *journaldSink) writeLevel(lvl zapcore.Level, p []byte) error {
+	return s.write(journaldMessage(lvl, filepath.Base(os.Args[0]), bytes.TrimRight(p, "\n")))
+}
+
+func journaldMessage(lvl zapcore.Level, identifier string, msg []byte) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "PRIORITY=%d\nSYSLOG_IDENTIFIER=%s\n", logSeverity(lvl), identifier)
+	if bytes.IndexByte(msg, '\n') < 0 {
+		b.WriteString("MESSAGE=")
+		b.Write(msg)
+		b.WriteByte('\n')
+		return b.Bytes()
+	}
+	// a value with newlines, such as a stack trace, is prefixed with its little-endian 64-bit length instead
+	b.WriteString("MESSAGE\n")
+	_ = binary.Write(&b, binary.LittleEndian, uint64(len(msg)))
+	b.Write(msg)
+	b.WriteByte('\n')
+	return b.Bytes()
+}
+
+// logSeverity maps zap levels to syslog severities.
+func logSeverity(lvl zapcore.Level) int {
+	switch lvl {
+	case zapcore.DebugLevel:
+		return 7
+	case zapcore.InfoLevel:
+		return 6
+	case zapcore.WarnLevel:
+		return 4
+	case zapcore.ErrorLevel:
+		return 3
+	default:
+		return 2
+	}
+}
+
+// sinkCore encodes entries for a logSink.
+type sinkCore struct {
+	zapcore.LevelEnabler
+	enc  zapcore.Encoder
+	sink logSink
+}
+
+func (c *sinkCore) With(fields []zapcore.Field) zapcore.Core {
+	enc := c.enc.Clone()
+	for _, f := range fields {
+		f.AddTo(enc)
+	}
+	return &sinkCore{c.LevelEnabler, enc, c.sink}
+}
+
+func (c *sinkCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(ent.Level) {
+		return ce.AddCore(ent, c)
+	}
+	return ce
+}
+
+func (c *sinkCore) Write(ent zapcore.Entry, fields []zapcore.Field) (err error) {
+	buf, err := c.enc.EncodeEntry(ent, fields)
+	if err != nil {
+		return
+	}
+	err = c.sink.writeLevel(ent.Level, buf.Bytes())
+	buf.Free()
+	return
+}
+
+func (c *sinkCore) Sync() error {
+	return c.sink.Sync()
+}
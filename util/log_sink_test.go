@@ -0,0 +1,43 @@
+package util
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zapcore"
+)
+
+func TestLogSink(t *testing.T) {
+	sink, err := parseLogSink("/var/log/sinker.log")
+	require.Nil(t, err)
+	require.Nil(t, sink)
+	_, err = parseLogSink("syslog+quic://localhost:514")
+	require.NotNil(t, err)
+
+	// syslog over UDP
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer pc.Close()
+	sink, err = parseLogSink("syslog://" + pc.LocalAddr().String())
+	require.Nil(t, err)
+	require.Nil(t, sink.writeLevel(zapcore.WarnLevel, []byte(`{"msg":"hello"}`+"\n")))
+	buf := make([]byte, 1024)
+	n, _, err := pc.ReadFrom(buf)
+	require.Nil(t, err)
+	msg := string(buf[:n])
+	require.True(t, strings.HasPrefix(msg, "<28>"), msg)
+	require.True(t, strings.HasSuffix(msg, `]: {"msg":"hello"}`), msg)
+
+	// journald, values with newlines are length-prefixed
+	require.Equal(t, "PRIORITY=6\nSYSLOG_IDENTIFIER=sinker\nMESSAGE=hello\n",
+		string(journaldMessage(zapcore.InfoLevel, "sinker", []byte("hello"))))
+	var expected bytes.Buffer
+	expected.WriteString("PRIORITY=3\nSYSLOG_IDENTIFIER=sinker\nMESSAGE\n")
+	require.Nil(t, binary.Write(&expected, binary.LittleEndian, uint64(11)))
+	expected.WriteString("panic\nstack\n")
+	require.Equal(t, expected.Bytes(), journaldMessage(zapcore.ErrorLevel, "sinker", []byte("panic\nstack")))
+}
@@ -15,7 +15,13 @@ limitations under the License.
 
 package util
 
-import "net"
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+
+	"github.com/pkg/errors"
+)
 
 func GetIP4Byname(host string) (ips []string, err error) {
 	addrs, err := net.LookupIP(host)
@@ -30,3 +36,108 @@ func GetIP4Byname(host string) (ips []string, err error) {
 	}
 	return
 }
+
+// GetSpareTCPPort finds a spare TCP port in [portBegin, portEnd], or from portBegin upward if portEnd is 0. In a
+// bounded range, the search starts at StablePort of identity and wraps around, so that an instance listens at the same
+// port across restarts as long as it's free. Ports already taken by other instances are skipped.
+func GetSpareTCPPort(portBegin, portEnd int, identity string) (port int, err error) {
+	if portEnd == 0 {
+		for port = portBegin; ; port++ {
+			if isSpareTCPPort(port) {
+				return
+			}
+		}
+	}
+	if portEnd < portBegin {
+		err = errors.Errorf("invalid port range [%d, %d]", portBegin, portEnd)
+		return
+	}
+	size := portEnd - portBegin + 1
+	start := StablePort(portBegin, portEnd, identity)
+	for i := 0; i < size; i++ {
+		if port = portBegin + (start-portBegin+i)%size; isSpareTCPPort(port) {
+			return
+		}
+	}
+	err = errors.Errorf("no spare TCP port in [%d, %d]", portBegin, portEnd)
+	return
+}
+
+// StablePort maps identity, such as the host name, to a port in [portBegin, portEnd]. Empty identity maps to portBegin.
+func StablePort(portBegin, portEnd int, identity string) int {
+	if identity == "" || portEnd <= portBegin {
+		return portBegin
+	}
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(identity))
+	return portBegin + int(h.Sum32()%uint32(portEnd-portBegin+1))
+}
+
+func isSpareTCPPort(port int) bool {
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return false
+	}
+	ln.Close()
+	return true
+}
+
+type ifaceAddrs struct {
+	name  string
+	addrs []net.Addr
+}
+
+// InterfaceIP returns the IP of the interface named selector, or the first IP in selector if it's a CIDR. Only
+// interfaces which are up are considered, and IPv4 addresses are preferred.
+func InterfaceIP(selector string) (ip net.IP, err error) {
+	var ifaces []net.Interface
+	if ifaces, err = net.Interfaces(); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	var candidates []ifaceAddrs
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 {
+			continue
+		}
+		var addrs []net.Addr
+		if addrs, err = iface.Addrs(); err != nil {
+			err = errors.Wrapf(err, "interface %s", iface.Name)
+			return
+		}
+		candidates = append(candidates, ifaceAddrs{iface.Name, addrs})
+	}
+	return selectIP(selector, candidates)
+}
+
+func selectIP(selector string, candidates []ifaceAddrs) (ip net.IP, err error) {
+	_, cidr, errCIDR := net.ParseCIDR(selector)
+	var matched []net.IP
+	for _, c := range candidates {
+		if errCIDR != nil && c.name != selector {
+			continue
+		}
+		for _, addr := range c.addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok || (errCIDR == nil && !cidr.Contains(ipNet.IP)) {
+				continue
+			}
+			matched = append(matched, ipNet.IP)
+		}
+	}
+	// IPv4 first, then global unicast IPv6 rather than link-local ones, which are useless without the zone
+	for _, prefer := range []func(net.IP) bool{
+		func(ip net.IP) bool { return ip.To4() != nil },
+		func(ip net.IP) bool { return ip.IsGlobalUnicast() },
+		func(ip net.IP) bool { return true },
+	} {
+		for _, ip = range matched {
+			if prefer(ip) {
+				return
+			}
+		}
+	}
+	ip = nil
+	err = errors.Errorf("no IP of any interface up matches %s", selector)
+	return
+}
@@ -0,0 +1,60 @@
+package util
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSelectIP(t *testing.T) {
+	ipNet := func(s string) net.Addr {
+		ip, n, err := net.ParseCIDR(s)
+		require.Nil(t, err)
+		n.IP = ip
+		return n
+	}
+	candidates := []ifaceAddrs{
+		{"lo", []net.Addr{ipNet("127.0.0.1/8"), ipNet("::1/128")}},
+		{"eth0", []net.Addr{ipNet("fe80::1/64"), ipNet("2001:db8::1/64"), ipNet("192.168.1.10/24")}},
+		{"eth1", []net.Addr{ipNet("fe80::2/64"), ipNet("10.1.2.3/16")}},
+		{"wg0", []net.Addr{ipNet("fe80::3/64"), ipNet("2001:db8:1::3/64")}},
+	}
+	for _, tc := range []struct {
+		selector string
+		ip       string
+	}{
+		{"eth0", "192.168.1.10"},
+		{"eth1", "10.1.2.3"},
+		{"wg0", "2001:db8:1::3"},
+		{"10.0.0.0/8", "10.1.2.3"},
+		{"2001:db8::/32", "2001:db8::1"},
+		{"127.0.0.0/8", "127.0.0.1"},
+	} {
+		ip, err := selectIP(tc.selector, candidates)
+		require.Nil(t, err, tc.selector)
+		require.Equal(t, tc.ip, ip.String(), tc.selector)
+	}
+	for _, selector := range []string{"eth2", "172.16.0.0/12"} {
+		_, err := selectIP(selector, candidates)
+		require.NotNil(t, err, selector)
+	}
+}
+
+func TestGetSpareTCPPort(t *testing.T) {
+	require.Equal(t, 9000, StablePort(9000, 9100, ""))
+	port := StablePort(9000, 9100, "sinker-0")
+	require.True(t, port >= 9000 && port <= 9100)
+	require.Equal(t, port, StablePort(9000, 9100, "sinker-0"))
+
+	// the stable port is skipped once taken, and the search wraps around within the range
+	ln, err := net.Listen("tcp", ":0")
+	require.Nil(t, err)
+	defer ln.Close()
+	taken := GetNetAddrPort(ln.Addr())
+	port, err = GetSpareTCPPort(taken, taken+1, "")
+	require.Nil(t, err)
+	require.Equal(t, taken+1, port)
+	_, err = GetSpareTCPPort(taken, taken, "")
+	require.NotNil(t, err)
+}
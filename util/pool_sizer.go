@@ -0,0 +1,115 @@
+package util
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"strconv"
+
+	"go.uber.org/zap"
+)
+
+const (
+	poolGrowBelowCPU   = 0.75 // grow only if CPU utilization is below it
+	poolShrinkAboveCPU = 0.9  // shrink if CPU utilization is above it, more workers only add contention
+)
+
+// PoolSizer resizes a WorkerPool between bounds by its queue depth and CPU utilization of the host. Adjust is
+// expected to be called periodically.
+type PoolSizer struct {
+	name string
+	pool *WorkerPool
+	cpu  cpuSampler
+}
+
+func NewPoolSizer(name string, pool *WorkerPool) *PoolSizer {
+	return &PoolSizer{name: name, pool: pool}
+}
+
+// Adjust resizes the pool by at most one step, and returns the new worker number. defaultWorkers is restored if
+// maxWorkers <= 0.
+func (ps *PoolSizer) Adjust(minWorkers, maxWorkers, defaultWorkers int) int {
+	cur := ps.pool.MaxWorkers()
+	var next int
+	if maxWorkers <= 0 {
+		next = defaultWorkers
+	} else {
+		cpu, ok := ps.cpu.utilization()
+		next = nextPoolSize(cur, minWorkers, maxWorkers, ps.pool.Backlog(), cpu, ok)
+	}
+	if next != cur {
+		ps.pool.Resize(next)
+		Logger.Info("resized pool", zap.String("pool", ps.name), zap.Int("from", cur), zap.Int("to", next),
+			zap.Int("backlog", ps.pool.Backlog()))
+	}
+	return next
+}
+
+// nextPoolSize grows the pool by a quarter when functions are queued and CPU is spare, and shrinks it by one when the
+// pool is mostly idle or CPU is saturated. cpuKnown is false where CPU utilization is unavailable.
+func nextPoolSize(cur, minWorkers, maxWorkers, backlog int, cpu float64, cpuKnown bool) (next int) {
+	if minWorkers <= 0 {
+		minWorkers = 1
+	}
+	if maxWorkers < minWorkers {
+		maxWorkers = minWorkers
+	}
+	next = cur
+	switch queued := backlog - cur; {
+	case cpuKnown && cpu > poolShrinkAboveCPU:
+		next--
+	case queued > 0 && queued >= cur/2 && (!cpuKnown || cpu < poolGrowBelowCPU):
+		step := cur / 4
+		if step < 1 {
+			step = 1
+		}
+		next += step
+	case backlog < cur/2:
+		next--
+	}
+	if next < minWorkers {
+		next = minWorkers
+	}
+	if next > maxWorkers {
+		next = maxWorkers
+	}
+	return
+}
+
+// cpuSampler computes CPU utilization of the host between calls from /proc/stat, which is only available on Linux.
+type cpuSampler struct {
+	busy, total uint64
+}
+
+func (s *cpuSampler) utilization() (cpu float64, ok bool) {
+	b, err := ioutil.ReadFile("/proc/stat")
+	if err != nil {
+		return
+	}
+	line, _, _ := bufio.NewReader(bytes.NewReader(b)).ReadLine()
+	fields := bytes.Fields(line)
+	// cpu user nice system idle iowait irq softirq steal guest guest_nice, guest time is included in user already.
+	if len(fields) < 5 || string(fields[0]) != "cpu" {
+		return
+	}
+	if len(fields) > 9 {
+		fields = fields[:9]
+	}
+	var busy, total uint64
+	for i, f := range fields[1:] {
+		v, err := strconv.ParseUint(string(f), 10, 64)
+		if err != nil {
+			return
+		}
+		total += v
+		if i != 3 && i != 4 {
+			busy += v
+		}
+	}
+	prevBusy, prevTotal := s.busy, s.total
+	s.busy, s.total = busy, total
+	if prevTotal == 0 || total <= prevTotal || busy < prevBusy {
+		return
+	}
+	return float64(busy-prevBusy) / float64(total-prevTotal), true
+}
@@ -0,0 +1,23 @@
+package util
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNextPoolSize(t *testing.T) {
+	// queued functions grow the pool by a quarter, bounded by maxWorkers
+	require.Equal(t, 10, nextPoolSize(8, 2, 16, 20, 0.5, true))
+	require.Equal(t, 16, nextPoolSize(16, 2, 16, 40, 0.5, true))
+	require.Equal(t, 3, nextPoolSize(2, 1, 16, 5, 0, false))
+	// no growth if CPU is busy, shrink if saturated
+	require.Equal(t, 8, nextPoolSize(8, 2, 16, 20, 0.8, true))
+	require.Equal(t, 7, nextPoolSize(8, 2, 16, 20, 0.95, true))
+	// idle pools shrink down to minWorkers
+	require.Equal(t, 7, nextPoolSize(8, 2, 16, 1, 0.1, true))
+	require.Equal(t, 2, nextPoolSize(2, 2, 16, 0, 0.1, true))
+	// out of bounds after bounds changed
+	require.Equal(t, 4, nextPoolSize(8, 1, 4, 8, 0.5, true))
+	require.Equal(t, 6, nextPoolSize(2, 6, 16, 2, 0.5, true))
+}
@@ -0,0 +1,171 @@
+package util
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"hash"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+var (
+	oidPBES2        = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2       = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidHMACSHA1     = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACSHA256   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidHMACSHA512   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 11}
+	oidAES128CBC    = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC    = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC    = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+	oidDESEDE3CBC   = asn1.ObjectIdentifier{1, 2, 840, 113549, 3, 7}
+	errKeyPassword  = errors.New("incorrect password of private key")
+	errKeyEncrypted = errors.New("private key is encrypted, but no password is given")
+)
+
+type encryptedPrivateKeyInfo struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt           []byte
+	IterationCount int
+	KeyLength      int                      `asn1:"optional"`
+	PRF            pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+// DecryptKeyPEM decrypts private keys in keyPEM with password, and returns the PEM with plain keys. Supported are
+// encrypted PKCS#8 ("ENCRYPTED PRIVATE KEY" of PBES2 with PBKDF2 and AES-CBC or DES-EDE3-CBC) which OpenSSL produces
+// by default, and legacy encrypted PEM with a "Proc-Type: 4,ENCRYPTED" header. Other blocks are kept as is.
+func DecryptKeyPEM(keyPEM []byte, password string) (out []byte, err error) {
+	for rest := keyPEM; ; {
+		var block *pem.Block
+		if block, rest = pem.Decode(rest); block == nil {
+			break
+		}
+		switch {
+		case block.Type == "ENCRYPTED PRIVATE KEY":
+			if password == "" {
+				return nil, errKeyEncrypted
+			}
+			var der []byte
+			if der, err = decryptPKCS8(block.Bytes, password); err != nil {
+				return
+			}
+			block = &pem.Block{Type: "PRIVATE KEY", Bytes: der}
+		//nolint:staticcheck // legacy PEM encryption is deprecated as insecure, but still issued by some PKIs
+		case x509.IsEncryptedPEMBlock(block):
+			if password == "" {
+				return nil, errKeyEncrypted
+			}
+			var der []byte
+			//nolint:staticcheck
+			if der, err = x509.DecryptPEMBlock(block, []byte(password)); err != nil {
+				return nil, errKeyPassword
+			}
+			block = &pem.Block{Type: block.Type, Bytes: der}
+		}
+		out = append(out, pem.EncodeToMemory(block)...)
+	}
+	return
+}
+
+func decryptPKCS8(data []byte, password string) (der []byte, err error) {
+	var info encryptedPrivateKeyInfo
+	if _, err = asn1.Unmarshal(data, &info); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	if !info.Algorithm.Algorithm.Equal(oidPBES2) {
+		err = errors.Errorf("unsupported encryption %v of private key, only PBES2 is supported", info.Algorithm.Algorithm)
+		return
+	}
+	var params pbes2Params
+	if _, err = asn1.Unmarshal(info.Algorithm.Parameters.FullBytes, &params); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	if !params.KeyDerivationFunc.Algorithm.Equal(oidPBKDF2) {
+		err = errors.Errorf("unsupported key derivation %v of private key", params.KeyDerivationFunc.Algorithm)
+		return
+	}
+	var kdf pbkdf2Params
+	if _, err = asn1.Unmarshal(params.KeyDerivationFunc.Parameters.FullBytes, &kdf); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	var prf func() hash.Hash
+	switch oid := kdf.PRF.Algorithm; {
+	case len(oid) == 0, oid.Equal(oidHMACSHA1):
+		prf = sha1.New
+	case oid.Equal(oidHMACSHA256):
+		prf = sha256.New
+	case oid.Equal(oidHMACSHA512):
+		prf = sha512.New
+	default:
+		err = errors.Errorf("unsupported PRF %v of private key", oid)
+		return
+	}
+	var newCipher func(key []byte) (cipher.Block, error)
+	var keyLen int
+	switch oid := params.EncryptionScheme.Algorithm; {
+	case oid.Equal(oidAES128CBC):
+		newCipher, keyLen = aes.NewCipher, 16
+	case oid.Equal(oidAES192CBC):
+		newCipher, keyLen = aes.NewCipher, 24
+	case oid.Equal(oidAES256CBC):
+		newCipher, keyLen = aes.NewCipher, 32
+	case oid.Equal(oidDESEDE3CBC):
+		newCipher, keyLen = des.NewTripleDESCipher, 24
+	default:
+		err = errors.Errorf("unsupported cipher %v of private key", oid)
+		return
+	}
+	var iv []byte
+	if _, err = asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	key := pbkdf2.Key([]byte(password), kdf.Salt, kdf.IterationCount, keyLen, prf)
+	block, err := newCipher(key)
+	if err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	bs := block.BlockSize()
+	if len(iv) != bs || len(info.EncryptedData) == 0 || len(info.EncryptedData)%bs != 0 {
+		err = errors.New("malformed encrypted private key")
+		return
+	}
+	der = make([]byte, len(info.EncryptedData))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(der, info.EncryptedData)
+	// a wrong password almost always results in invalid padding or an unparsable key
+	pad := int(der[len(der)-1])
+	if pad == 0 || pad > bs {
+		return nil, errKeyPassword
+	}
+	for _, b := range der[len(der)-pad:] {
+		if int(b) != pad {
+			return nil, errKeyPassword
+		}
+	}
+	der = der[:len(der)-pad]
+	if _, err = x509.ParsePKCS8PrivateKey(der); err != nil {
+		return nil, errKeyPassword
+	}
+	return
+}
@@ -0,0 +1,115 @@
+package util
+
+import (
+	"context"
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Kinds of rate limiters. Limiters of a kind are named after it globally, and by TaskRateLimiter for each task.
+const (
+	RateLimitConsume = "consume" // of bytes consumed
+	RateLimitWrite   = "write"   // of rows written
+)
+
+var (
+	rateLimitersMux sync.Mutex
+	rateLimiters    = make(map[string]*RateLimiter)
+)
+
+// RateLimiter is a token bucket which records how long its users have been throttled. A nil *RateLimiter is
+// unlimited. The rate is changed in place, so that users see new rates at once.
+type RateLimiter struct {
+	name      string
+	lim       *rate.Limiter
+	throttled int64 // nanoseconds spent waiting for tokens
+}
+
+// GetRateLimiter returns the limiter of the name, which is unlimited until SetRate. Limiters of the same name are
+// shared, such as a global one by all tasks. Names are used as the label of metric throttled seconds.
+func GetRateLimiter(name string) *RateLimiter {
+	rateLimitersMux.Lock()
+	defer rateLimitersMux.Unlock()
+	l, ok := rateLimiters[name]
+	if !ok {
+		l = &RateLimiter{name: name, lim: rate.NewLimiter(rate.Inf, 1)}
+		rateLimiters[name] = l
+	}
+	return l
+}
+
+// TaskRateLimiter returns the name of the limiter of the kind for a task.
+func TaskRateLimiter(task, kind string) string {
+	return task + "/" + kind
+}
+
+// RemoveRateLimiter forgets the limiter of the name, such as that of a removed task. Existing users keep working.
+func RemoveRateLimiter(name string) {
+	rateLimitersMux.Lock()
+	defer rateLimitersMux.Unlock()
+	delete(rateLimiters, name)
+}
+
+// RateLimiterThrottled returns the time throttled by each limiter.
+func RateLimiterThrottled() (names []string, throttled []time.Duration) {
+	rateLimitersMux.Lock()
+	defer rateLimitersMux.Unlock()
+	for name := range rateLimiters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		throttled = append(throttled, rateLimiters[name].Throttled())
+	}
+	return
+}
+
+// Name returns the name which the limiter is registered with.
+func (l *RateLimiter) Name() string {
+	return l.name
+}
+
+// SetRate changes the rate to perSecond tokens, with a burst of a second. perSecond <= 0 means unlimited.
+func (l *RateLimiter) SetRate(perSecond float64) {
+	if perSecond <= 0 {
+		l.lim.SetLimit(rate.Inf)
+		return
+	}
+	l.lim.SetBurst(int(math.Max(1, math.Ceil(perSecond))))
+	l.lim.SetLimit(rate.Limit(perSecond))
+}
+
+// WaitN blocks until n tokens are available or ctx is done. n beyond the burst is waited for in pieces.
+func (l *RateLimiter) WaitN(ctx context.Context, n int) (err error) {
+	if l == nil || l.lim.Limit() == rate.Inf || n <= 0 {
+		return
+	}
+	begin := time.Now()
+	defer func() {
+		atomic.AddInt64(&l.throttled, int64(time.Since(begin)))
+	}()
+	for n > 0 {
+		k := n
+		if burst := l.lim.Burst(); k > burst {
+			k = burst
+		}
+		if err = l.lim.WaitN(ctx, k); err != nil {
+			return
+		}
+		n -= k
+	}
+	return
+}
+
+// Throttled returns the total time its users waited for tokens.
+func (l *RateLimiter) Throttled() time.Duration {
+	if l == nil {
+		return 0
+	}
+	return time.Duration(atomic.LoadInt64(&l.throttled))
+}
@@ -0,0 +1,41 @@
+package util
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimiter(t *testing.T) {
+	name := TaskRateLimiter("test", RateLimitConsume)
+	l := GetRateLimiter(name)
+	defer RemoveRateLimiter(name)
+	require.True(t, l == GetRateLimiter(name))
+
+	// unlimited until SetRate
+	require.Nil(t, l.WaitN(context.Background(), 1<<30))
+	require.Zero(t, l.Throttled())
+
+	// n beyond the burst is waited for in pieces, instead of failing
+	l.SetRate(100)
+	begin := time.Now()
+	require.Nil(t, l.WaitN(context.Background(), 150))
+	require.True(t, time.Since(begin) >= 400*time.Millisecond)
+	require.True(t, l.Throttled() >= 400*time.Millisecond)
+
+	names, throttled := RateLimiterThrottled()
+	require.Contains(t, names, name)
+	require.Len(t, throttled, len(names))
+
+	// stops waiting once ctx is done
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	require.NotNil(t, l.WaitN(ctx, 1000))
+
+	l.SetRate(0)
+	require.Nil(t, l.WaitN(context.Background(), 1<<30))
+	var unlimited *RateLimiter
+	require.Nil(t, unlimited.WaitN(context.Background(), 1))
+}
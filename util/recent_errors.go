@@ -0,0 +1,88 @@
+package util
+
+import (
+	"sync"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+const maxRecentErrors = 100
+
+// ErrorEvent is a log entry at error level or above.
+type ErrorEvent struct {
+	Time    time.Time              `json:"time"`
+	Level   string                 `json:"level"`
+	Message string                 `json:"message"`
+	Fields  map[string]interface{} `json:"fields,omitempty"`
+}
+
+var recentErrors struct {
+	sync.Mutex
+	events []ErrorEvent // ring buffer
+	next   int
+}
+
+// RecentErrors returns the latest error logs, newest first.
+func RecentErrors() (events []ErrorEvent) {
+	recentErrors.Lock()
+	defer recentErrors.Unlock()
+	n := len(recentErrors.events)
+	events = make([]ErrorEvent, 0, n)
+	for i := 1; i <= n; i++ {
+		events = append(events, recentErrors.events[(recentErrors.next-i+n)%n])
+	}
+	return
+}
+
+func recordError(ev ErrorEvent) {
+	recentErrors.Lock()
+	defer recentErrors.Unlock()
+	if len(recentErrors.events) < maxRecentErrors {
+		recentErrors.events = append(recentErrors.events, ev)
+		recentErrors.next = len(recentErrors.events) % maxRecentErrors
+		return
+	}
+	recentErrors.events[recentErrors.next] = ev
+	recentErrors.next = (recentErrors.next + 1) % maxRecentErrors
+}
+
+// errorRecorder is a zapcore.Core which keeps recent error logs in memory for the web UI.
+type errorRecorder struct {
+	fields []zapcore.Field
+}
+
+func (r errorRecorder) Enabled(lvl zapcore.Level) bool {
+	return lvl >= zapcore.ErrorLevel
+}
+
+func (r errorRecorder) With(fields []zapcore.Field) zapcore.Core {
+	return errorRecorder{fields: append(r.fields[:len(r.fields):len(r.fields)], fields...)}
+}
+
+func (r errorRecorder) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if r.Enabled(ent.Level) {
+		return ce.AddCore(ent, r)
+	}
+	return ce
+}
+
+func (r errorRecorder) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+	enc := zapcore.NewMapObjectEncoder()
+	for _, f := range r.fields {
+		f.AddTo(enc)
+	}
+	for _, f := range fields {
+		f.AddTo(enc)
+	}
+	ev := ErrorEvent{Time: ent.Time, Level: ent.Level.String(), Message: ent.Message}
+	if len(enc.Fields) != 0 {
+		ev.Fields = enc.Fields
+	}
+	recordError(ev)
+	return nil
+}
+
+func (r errorRecorder) Sync() error {
+	return nil
+}
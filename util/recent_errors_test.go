@@ -0,0 +1,23 @@
+package util
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestRecentErrors(t *testing.T) {
+	logger := zap.New(errorRecorder{}).With(zap.String("task", "t1"))
+	logger.Info("ignored")
+	for i := 0; i < maxRecentErrors+5; i++ {
+		logger.Error(fmt.Sprintf("error %d", i), zap.Int("i", i))
+	}
+	events := RecentErrors()
+	require.Len(t, events, maxRecentErrors)
+	require.Equal(t, fmt.Sprintf("error %d", maxRecentErrors+4), events[0].Message)
+	require.Equal(t, "error 5", events[maxRecentErrors-1].Message)
+	require.Equal(t, "t1", events[0].Fields["task"])
+	require.EqualValues(t, maxRecentErrors+4, events[0].Fields["i"])
+}
@@ -0,0 +1,23 @@
+package util
+
+import (
+	"fmt"
+	"runtime/debug"
+
+	"go.uber.org/zap"
+)
+
+// Recover recovers a panic of the calling goroutine, and passes it along with the stack to onPanic. It must be
+// deferred directly, such as "defer util.Recover(fn)". A nil onPanic only logs the panic.
+func Recover(onPanic func(err error)) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	err := fmt.Errorf("panic: %v\n%s", r, debug.Stack())
+	if onPanic == nil {
+		Logger.Error("recovered a panic", zap.Error(err))
+		return
+	}
+	onPanic(err)
+}
@@ -0,0 +1,97 @@
+package util
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// RetryPolicy tells Retry how many times and how long to wait between attempts. The backoff starts at
+// InitialBackoff, and doubles after each attempt up to MaxBackoff.
+type RetryPolicy struct {
+	MaxAttempts    int           // including the first attempt, <= 0 means unlimited
+	InitialBackoff time.Duration // default to 1 second
+	MaxBackoff     time.Duration // 0 means a constant InitialBackoff
+	Jitter         float64       // spreads each backoff by the ratio, see Jitter
+	// Retryable classifies errors, default to IsRetryable.
+	Retryable func(err error) bool
+	// OnRetry is called with the failed attempt(starting at 1) and its error before each backoff, such as logging.
+	OnRetry func(attempt int, err error)
+}
+
+// RetryableError is implemented by errors which know whether the failed operation is worth retrying.
+type RetryableError interface {
+	error
+	Retryable() bool
+}
+
+type classifiedError struct {
+	error
+	retryable bool
+}
+
+func (e *classifiedError) Retryable() bool { return e.retryable }
+func (e *classifiedError) Unwrap() error   { return e.error }
+
+// Permanent marks err as not retryable, such as a rejected request which fails the same way every time.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &classifiedError{err, false}
+}
+
+// Transient marks err as retryable, which overrides the classification of errors it wraps.
+func Transient(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &classifiedError{err, true}
+}
+
+// IsRetryable tells whether err is worth retrying. The outermost RetryableError in the chain decides, cancellation
+// and expiration of contexts are not retryable, and others are.
+func IsRetryable(err error) bool {
+	var re RetryableError
+	if errors.As(err, &re) {
+		return re.Retryable()
+	}
+	return !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+}
+
+// Retry calls fn until it succeeds, fails with an error not retryable, reaches policy.MaxAttempts, or ctx is done.
+// It returns the last error of fn, or that of ctx wrapping the last error of fn.
+func Retry(ctx context.Context, policy RetryPolicy, fn func(ctx context.Context) error) (err error) {
+	retryable := policy.Retryable
+	if retryable == nil {
+		retryable = IsRetryable
+	}
+	backoff := policy.InitialBackoff
+	if backoff <= 0 {
+		backoff = time.Second
+	}
+	for attempt := 1; ; attempt++ {
+		if err = fn(ctx); err == nil {
+			return
+		}
+		if !retryable(err) || (policy.MaxAttempts > 0 && attempt >= policy.MaxAttempts) {
+			return
+		}
+		if policy.OnRetry != nil {
+			policy.OnRetry(attempt, err)
+		}
+		timer := time.NewTimer(Jitter(backoff, policy.Jitter))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return errors.Wrapf(ctx.Err(), "gave up retrying after %d attempts, the last error: %v", attempt, err)
+		case <-timer.C:
+		}
+		if policy.MaxBackoff > backoff {
+			if backoff *= 2; backoff > policy.MaxBackoff {
+				backoff = policy.MaxBackoff
+			}
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package util
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetry(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: 4 * time.Millisecond}
+	var attempts []int
+	policy.OnRetry = func(attempt int, err error) { attempts = append(attempts, attempt) }
+
+	// succeeds at the third attempt
+	var calls int
+	err := Retry(context.Background(), policy, func(ctx context.Context) error {
+		if calls++; calls < 3 {
+			return errors.New("transient")
+		}
+		return nil
+	})
+	require.Nil(t, err)
+	require.Equal(t, []int{1, 2}, attempts)
+
+	// gives up after MaxAttempts
+	calls = 0
+	errLast := errors.New("always")
+	err = Retry(context.Background(), policy, func(ctx context.Context) error {
+		calls++
+		return errLast
+	})
+	require.Equal(t, errLast, err)
+	require.Equal(t, 3, calls)
+
+	// stops at once on permanent errors, which are still visible to errors.Is
+	calls = 0
+	err = Retry(context.Background(), policy, func(ctx context.Context) error {
+		calls++
+		return Permanent(errLast)
+	})
+	require.True(t, errors.Is(err, errLast))
+	require.Equal(t, 1, calls)
+	require.False(t, IsRetryable(errors.Wrap(context.Canceled, "")))
+	require.True(t, IsRetryable(Transient(context.DeadlineExceeded)))
+
+	// stops once the context is done
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err = Retry(ctx, RetryPolicy{InitialBackoff: time.Millisecond}, func(ctx context.Context) error {
+		return errLast
+	})
+	require.True(t, errors.Is(err, context.DeadlineExceeded))
+}
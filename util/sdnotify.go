@@ -0,0 +1,46 @@
+package util
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// SdNotify sends state, such as "READY=1", to the service manager which started the process with $NOTIFY_SOCKET, see
+// sd_notify(3). It does nothing unless the process is a systemd service with Type=notify or NotifyAccess set.
+func SdNotify(state string) (err error) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return
+	}
+	if socket[0] == '@' {
+		// abstract namespace
+		socket = "\x00" + socket[1:]
+	}
+	var conn net.Conn
+	if conn, err = net.Dial("unixgram", socket); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	defer conn.Close()
+	if _, err = conn.Write([]byte(state)); err != nil {
+		err = errors.Wrapf(err, "")
+	}
+	return
+}
+
+// SdWatchdogInterval returns how often "WATCHDOG=1" shall be sent, which is half of WatchdogSec of the service. It's 0
+// if the watchdog isn't enabled for this process.
+func SdWatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
@@ -0,0 +1,95 @@
+package util
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const vaultRequestTimeout = 10 * time.Second
+
+// ResolveSecret returns the secret which ref refers to:
+//   - "env:NAME", the environment variable NAME.
+//   - "vault:PATH#FIELD", field FIELD of the secret at PATH of Vault, such as "vault:secret/data/sinker#keyPassword".
+//     Vault is accessed at $VAULT_ADDR with token $VAULT_TOKEN, and $VAULT_CACERT if given. Both KV v1 and v2 are
+//     supported.
+//   - otherwise, ref itself.
+func ResolveSecret(ref string) (secret string, err error) {
+	switch {
+	case strings.HasPrefix(ref, "env:"):
+		name := strings.TrimPrefix(ref, "env:")
+		var found bool
+		if secret, found = os.LookupEnv(name); !found {
+			err = errors.Errorf("environment variable %s is not set", name)
+		}
+	case strings.HasPrefix(ref, "vault:"):
+		secret, err = readVaultSecret(strings.TrimPrefix(ref, "vault:"))
+	default:
+		secret = ref
+	}
+	return
+}
+
+func readVaultSecret(ref string) (secret string, err error) {
+	pos := strings.LastIndex(ref, "#")
+	if pos <= 0 || pos == len(ref)-1 {
+		err = errors.Errorf("invalid vault secret %q, expect PATH#FIELD", ref)
+		return
+	}
+	path, field := strings.Trim(ref[:pos], "/"), ref[pos+1:]
+	addr, token := os.Getenv("VAULT_ADDR"), os.Getenv("VAULT_TOKEN")
+	if addr == "" || token == "" {
+		err = errors.Errorf("VAULT_ADDR and VAULT_TOKEN are required to read vault secret %s", path)
+		return
+	}
+	client := &http.Client{Timeout: vaultRequestTimeout}
+	if caCert := os.Getenv("VAULT_CACERT"); caCert != "" {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		if transport.TLSClientConfig, err = NewTLSConfig(caCert, "", "", "", false); err != nil {
+			return
+		}
+		client.Transport = transport
+	}
+	req, err := http.NewRequest(http.MethodGet, strings.TrimRight(addr, "/")+"/v1/"+path, nil)
+	if err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	req.Header.Set("X-Vault-Token", token)
+	if ns := os.Getenv("VAULT_NAMESPACE"); ns != "" {
+		req.Header.Set("X-Vault-Namespace", ns)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		err = errors.Errorf("failed to read vault secret %s: %s", path, resp.Status)
+		return
+	}
+	var body struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	data := body.Data
+	// KV v2 nests the secret in data.data
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		if _, found := data[field]; !found {
+			data = nested
+		}
+	}
+	var ok bool
+	if secret, ok = data[field].(string); !ok {
+		err = errors.Errorf("field %s of vault secret %s is absent or not a string", field, path)
+	}
+	return
+}
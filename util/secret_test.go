@@ -0,0 +1,54 @@
+package util
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolveSecret(t *testing.T) {
+	secret, err := ResolveSecret("plain")
+	require.Nil(t, err)
+	require.Equal(t, "plain", secret)
+
+	os.Setenv("SINKER_TEST_SECRET", "from env")
+	defer os.Unsetenv("SINKER_TEST_SECRET")
+	secret, err = ResolveSecret("env:SINKER_TEST_SECRET")
+	require.Nil(t, err)
+	require.Equal(t, "from env", secret)
+	_, err = ResolveSecret("env:SINKER_TEST_ABSENT")
+	require.NotNil(t, err)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/secret/data/sinker":
+			_, _ = w.Write([]byte(`{"data":{"data":{"keyPassword":"kv2"},"metadata":{"version":1}}}`))
+		case "/v1/kv/sinker":
+			_, _ = w.Write([]byte(`{"data":{"keyPassword":"kv1"}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	os.Setenv("VAULT_ADDR", srv.URL)
+	os.Setenv("VAULT_TOKEN", "token")
+	defer os.Unsetenv("VAULT_ADDR")
+	defer os.Unsetenv("VAULT_TOKEN")
+	secret, err = ResolveSecret("vault:secret/data/sinker#keyPassword")
+	require.Nil(t, err)
+	require.Equal(t, "kv2", secret)
+	secret, err = ResolveSecret("vault:kv/sinker#keyPassword")
+	require.Nil(t, err)
+	require.Equal(t, "kv1", secret)
+	_, err = ResolveSecret("vault:kv/sinker#absent")
+	require.NotNil(t, err)
+	_, err = ResolveSecret("vault:kv/absent#keyPassword")
+	require.NotNil(t, err)
+}
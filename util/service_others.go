@@ -0,0 +1,22 @@
+//go:build !windows
+// +build !windows
+
+package util
+
+import "github.com/pkg/errors"
+
+// waitForExit waits for SIGINT or SIGTERM. done shall be called once cleanup is done.
+func waitForExit(appName string) (done func()) {
+	WaitForExitSign()
+	return func() {}
+}
+
+// InstallService is only supported on Windows. Use a systemd unit with Type=notify elsewhere.
+func InstallService(name, exePath string, args []string) error {
+	return errors.Errorf("services are only supported on Windows")
+}
+
+// UninstallService is only supported on Windows.
+func UninstallService(name string) error {
+	return errors.Errorf("services are only supported on Windows")
+}
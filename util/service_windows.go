@@ -0,0 +1,93 @@
+package util
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// serviceHandler reports the service running at once, and stop pending from a stop request until cleanup is done.
+type serviceHandler struct {
+	stopping chan struct{}
+	done     chan struct{}
+}
+
+func (h *serviceHandler) Execute(args []string, r <-chan svc.ChangeRequest, s chan<- svc.Status) (bool, uint32) {
+	s <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for req := range r {
+		switch req.Cmd {
+		case svc.Interrogate:
+			s <- req.CurrentStatus
+		case svc.Stop, svc.Shutdown:
+			s <- svc.Status{State: svc.StopPending}
+			close(h.stopping)
+			<-h.done
+			return false, 0
+		}
+	}
+	return false, 0
+}
+
+// waitForExit waits for a stop request of the service control manager if the process runs as a Windows service, and
+// for SIGINT or SIGTERM otherwise. done shall be called once cleanup is done.
+func waitForExit(appName string) (done func()) {
+	if isService, err := svc.IsWindowsService(); err != nil || !isService {
+		WaitForExitSign()
+		return func() {}
+	}
+	h := &serviceHandler{stopping: make(chan struct{}), done: make(chan struct{})}
+	exited := make(chan struct{})
+	go func() {
+		if err := svc.Run(appName, h); err != nil {
+			Logger.Error("svc.Run failed", zap.Error(err))
+		}
+		close(exited)
+	}()
+	select {
+	case <-h.stopping:
+	case <-exited:
+	}
+	return func() {
+		close(h.done)
+		select {
+		case <-exited:
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+// InstallService registers exePath with args as a Windows service which starts automatically.
+func InstallService(name, exePath string, args []string) (err error) {
+	var m *mgr.Mgr
+	if m, err = mgr.Connect(); err != nil {
+		return errors.Wrapf(err, "")
+	}
+	defer m.Disconnect()
+	var s *mgr.Service
+	if s, err = m.CreateService(name, exePath, mgr.Config{DisplayName: name, StartType: mgr.StartAutomatic}, args...); err != nil {
+		return errors.Wrapf(err, "")
+	}
+	s.Close()
+	return
+}
+
+// UninstallService removes the Windows service.
+func UninstallService(name string) (err error) {
+	var m *mgr.Mgr
+	if m, err = mgr.Connect(); err != nil {
+		return errors.Wrapf(err, "")
+	}
+	defer m.Disconnect()
+	var s *mgr.Service
+	if s, err = m.OpenService(name); err != nil {
+		return errors.Wrapf(err, "")
+	}
+	defer s.Close()
+	if err = s.Delete(); err != nil {
+		return errors.Wrapf(err, "")
+	}
+	return
+}
@@ -21,8 +21,9 @@ import (
 	"syscall"
 )
 
+// WaitForExitSign waits for SIGINT or SIGTERM. SIGHUP is left to reloading config.
 func WaitForExitSign() {
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	<-c
 }
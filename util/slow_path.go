@@ -0,0 +1,30 @@
+package util
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+var (
+	slowParse      int64 // time.Duration
+	slowWriteQueue int64 // time.Duration
+)
+
+// SetSlowPathThresholds sets how long parsing a message and a batch waiting for a writer may take before they are
+// logged and counted as slow. 0 disables the check.
+func SetSlowPathThresholds(parse, writeQueue time.Duration) {
+	atomic.StoreInt64(&slowParse, int64(parse))
+	atomic.StoreInt64(&slowWriteQueue, int64(writeQueue))
+}
+
+// IsSlowParse tells whether parsing a message took too long.
+func IsSlowParse(d time.Duration) bool {
+	threshold := atomic.LoadInt64(&slowParse)
+	return threshold > 0 && int64(d) > threshold
+}
+
+// IsSlowWriteQueue tells whether a batch waited for a writer too long.
+func IsSlowWriteQueue(d time.Duration) bool {
+	threshold := atomic.LoadInt64(&slowWriteQueue)
+	return threshold > 0 && int64(d) > threshold
+}
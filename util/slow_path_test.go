@@ -0,0 +1,17 @@
+package util
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSlowPathThresholds(t *testing.T) {
+	defer SetSlowPathThresholds(0, 0)
+	require.False(t, IsSlowParse(time.Hour))
+	SetSlowPathThresholds(10*time.Millisecond, 0)
+	require.True(t, IsSlowParse(11*time.Millisecond))
+	require.False(t, IsSlowParse(10*time.Millisecond))
+	require.False(t, IsSlowWriteQueue(time.Hour))
+}
@@ -0,0 +1,144 @@
+package util
+
+import (
+	"strings"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap/zapcore"
+)
+
+type taskLevels struct {
+	levels map[string]zapcore.Level
+	min    zapcore.Level
+}
+
+var (
+	curTaskLevels   atomic.Value // *taskLevels
+	curModuleLevels atomic.Value // *taskLevels
+)
+
+func newTaskLevels(levels map[string]zapcore.Level) *taskLevels {
+	tl := &taskLevels{levels: levels, min: zapcore.FatalLevel}
+	for _, lvl := range levels {
+		if lvl < tl.min {
+			tl.min = lvl
+		}
+	}
+	return tl
+}
+
+// SetTaskLogLevels overrides the log level of tasks. The key is the task name. Tasks absent in levels follow the
+// global level.
+func SetTaskLogLevels(levels map[string]string) {
+	parsed := make(map[string]zapcore.Level)
+	for task, s := range levels {
+		var lvl zapcore.Level
+		if err := lvl.Set(s); err != nil {
+			continue
+		}
+		parsed[task] = lvl
+	}
+	curTaskLevels.Store(newTaskLevels(parsed))
+}
+
+// ParseLogLevel parses a level spec such as "info,parser=debug,output=warn". The optional item without a module is
+// the global level, default to info. A module is the directory of the package logging, such as parser, output, task
+// and rdns.
+func ParseLogLevel(spec string) (global zapcore.Level, modules map[string]zapcore.Level, err error) {
+	global = zapcore.InfoLevel
+	modules = make(map[string]zapcore.Level)
+	for _, item := range strings.Split(spec, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		module, level := "", item
+		if i := strings.Index(item, "="); i >= 0 {
+			module, level = strings.TrimSpace(item[:i]), strings.TrimSpace(item[i+1:])
+			if module == "" {
+				err = errors.Errorf("empty module in log level %q", spec)
+				return
+			}
+		}
+		var lvl zapcore.Level
+		if err = lvl.Set(level); err != nil {
+			err = errors.Wrapf(err, "log level %q", spec)
+			return
+		}
+		if module == "" {
+			global = lvl
+		} else {
+			modules[module] = lvl
+		}
+	}
+	return
+}
+
+// taskLevelCore filters entries by the level of the task they're logged for, which is told by a "task" field, then the
+// level of the module they're logged from. The wrapped core shall enable all levels.
+type taskLevelCore struct {
+	zapcore.Core
+	level zapcore.LevelEnabler // the global level
+	task  string               // the task added by With
+}
+
+func (c taskLevelCore) levelOf(task string, caller zapcore.EntryCaller) zapcore.LevelEnabler {
+	if tl, ok := curTaskLevels.Load().(*taskLevels); ok && task != "" {
+		if lvl, ok := tl.levels[task]; ok {
+			return lvl
+		}
+	}
+	if ml, ok := curModuleLevels.Load().(*taskLevels); ok && len(ml.levels) != 0 && caller.Defined {
+		if lvl, ok := ml.levels[moduleOf(caller.File)]; ok {
+			return lvl
+		}
+	}
+	return c.level
+}
+
+func (c taskLevelCore) Enabled(lvl zapcore.Level) bool {
+	if c.level.Enabled(lvl) {
+		return true
+	}
+	for _, v := range []*atomic.Value{&curTaskLevels, &curModuleLevels} {
+		if tl, ok := v.Load().(*taskLevels); ok && len(tl.levels) != 0 && lvl >= tl.min {
+			return true
+		}
+	}
+	return false
+}
+
+func (c taskLevelCore) With(fields []zapcore.Field) zapcore.Core {
+	return taskLevelCore{Core: c.Core.With(fields), level: c.level, task: taskOf(c.task, fields)}
+}
+
+func (c taskLevelCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(ent.Level) {
+		return ce.AddCore(ent, c)
+	}
+	return ce
+}
+
+func (c taskLevelCore) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+	if !c.levelOf(taskOf(c.task, fields), ent.Caller).Enabled(ent.Level) {
+		return nil
+	}
+	return c.Core.Write(ent, fields)
+}
+
+func taskOf(task string, fields []zapcore.Field) string {
+	for _, f := range fields {
+		if f.Key == "task" && f.Type == zapcore.StringType {
+			task = f.String
+		}
+	}
+	return task
+}
+
+// moduleOf returns the directory name of a source file.
+func moduleOf(file string) string {
+	if i := strings.LastIndexByte(file, '/'); i >= 0 {
+		file = file[:i]
+	}
+	return file[strings.LastIndexByte(file, '/')+1:]
+}
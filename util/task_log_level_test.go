@@ -0,0 +1,68 @@
+package util
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestTaskLogLevel(t *testing.T) {
+	inner, logs := observer.New(zapcore.DebugLevel)
+	logger := zap.New(taskLevelCore{Core: inner, level: zapcore.InfoLevel})
+	SetTaskLogLevels(map[string]string{"verbose": "debug", "quiet": "error"})
+	defer SetTaskLogLevels(nil)
+
+	logger.Debug("global debug")
+	logger.Info("global info")
+	logger.Debug("verbose debug", zap.String("task", "verbose"))
+	logger.With(zap.String("task", "quiet")).Warn("quiet warn")
+	logger.Error("quiet error", zap.String("task", "quiet"))
+
+	var msgs []string
+	for _, e := range logs.All() {
+		msgs = append(msgs, e.Message)
+	}
+	require.Equal(t, []string{"global info", "verbose debug", "quiet error"}, msgs)
+}
+
+func TestModuleLogLevel(t *testing.T) {
+	inner, logs := observer.New(zapcore.DebugLevel)
+	logger := zap.New(taskLevelCore{Core: inner, level: zapcore.ErrorLevel}, zap.AddCaller())
+	_, modules, err := ParseLogLevel("error,util=debug")
+	require.Nil(t, err)
+	curModuleLevels.Store(newTaskLevels(modules))
+	defer curModuleLevels.Store(newTaskLevels(nil))
+	SetTaskLogLevels(map[string]string{"quiet": "warn"})
+	defer SetTaskLogLevels(nil)
+
+	logger.Debug("module debug")
+	logger.Info("quiet info", zap.String("task", "quiet"))
+
+	var msgs []string
+	for _, e := range logs.All() {
+		msgs = append(msgs, e.Message)
+	}
+	require.Equal(t, []string{"module debug"}, msgs)
+	require.Equal(t, "util", moduleOf("/src/clickhouse_sinker/util/task_log_level_test.go"))
+	require.Equal(t, "rdns", moduleOf("ipHandle/rdns/rdns.go"))
+}
+
+func TestParseLogLevel(t *testing.T) {
+	global, modules, err := ParseLogLevel("parser=debug, warn ,output=error")
+	require.Nil(t, err)
+	require.Equal(t, zapcore.WarnLevel, global)
+	require.Equal(t, map[string]zapcore.Level{"parser": zapcore.DebugLevel, "output": zapcore.ErrorLevel}, modules)
+
+	global, modules, err = ParseLogLevel("")
+	require.Nil(t, err)
+	require.Equal(t, zapcore.InfoLevel, global)
+	require.Len(t, modules, 0)
+
+	_, _, err = ParseLogLevel("parser=verbose")
+	require.NotNil(t, err)
+	_, _, err = ParseLogLevel("=debug")
+	require.NotNil(t, err)
+}
@@ -0,0 +1,131 @@
+package util
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// Files of client certificates are checked for changes at most once in this interval.
+const certCheckInterval = 10 * time.Second
+
+// certReloader serves a client certificate to TLS handshakes, and reloads it once its files change. Connections
+// made after a reload use the new certificate, so rotating certificates doesn't require restarting tasks.
+type certReloader struct {
+	certFile, keyFile string
+	keyPassword       string // refers to the passphrase of keyFile, see ResolveSecret
+
+	mux       sync.Mutex
+	cert      *tls.Certificate
+	modTimes  [2]time.Time // of certFile and keyFile
+	checkedAt time.Time
+}
+
+var certReloaders struct {
+	sync.Mutex
+	all map[[3]string]*certReloader // by certFile, keyFile and keyPassword
+}
+
+// getCertReloader returns the reloader of the files, and loads them if it's new.
+func getCertReloader(certFile, keyFile, keyPassword string) (r *certReloader, err error) {
+	key := [3]string{certFile, keyFile, keyPassword}
+	certReloaders.Lock()
+	defer certReloaders.Unlock()
+	if r = certReloaders.all[key]; r != nil {
+		return
+	}
+	r = &certReloader{certFile: certFile, keyFile: keyFile, keyPassword: keyPassword}
+	if err = r.reload(); err != nil {
+		return nil, err
+	}
+	if certReloaders.all == nil {
+		certReloaders.all = make(map[[3]string]*certReloader)
+	}
+	certReloaders.all[key] = r
+	return
+}
+
+// ReloadCertificates reloads all client certificates in use at once, such as on SIGHUP. Certificates failed to load
+// are kept as is.
+func ReloadCertificates() {
+	certReloaders.Lock()
+	all := make([]*certReloader, 0, len(certReloaders.all))
+	for _, r := range certReloaders.all {
+		all = append(all, r)
+	}
+	certReloaders.Unlock()
+	for _, r := range all {
+		r.mux.Lock()
+		if err := r.reload(); err != nil {
+			Logger.Error("failed to reload client certificate", zap.String("certFile", r.certFile), zap.Error(err))
+		}
+		r.mux.Unlock()
+	}
+}
+
+func (r *certReloader) getClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if time.Since(r.checkedAt) >= certCheckInterval {
+		r.checkedAt = time.Now()
+		if modTimes, err := r.stat(); err == nil && modTimes != r.modTimes {
+			if err = r.reload(); err != nil {
+				Logger.Error("failed to reload client certificate, keep the current one", zap.String("certFile", r.certFile), zap.Error(err))
+			}
+		}
+	}
+	return r.cert, nil
+}
+
+// reload loads the files. The passphrase is resolved again, so that it can be rotated along with the key. r.mux must
+// be held unless r is new.
+func (r *certReloader) reload() (err error) {
+	var modTimes [2]time.Time
+	if modTimes, err = r.stat(); err != nil {
+		return
+	}
+	var certPEM, keyPEM []byte
+	if certPEM, err = ioutil.ReadFile(r.certFile); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	if keyPEM, err = ioutil.ReadFile(r.keyFile); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	var password string
+	if password, err = ResolveSecret(r.keyPassword); err != nil {
+		return
+	}
+	if keyPEM, err = DecryptKeyPEM(keyPEM, password); err != nil {
+		err = errors.Wrapf(err, "failed to decrypt %s", r.keyFile)
+		return
+	}
+	var cert tls.Certificate
+	if cert, err = tls.X509KeyPair(certPEM, keyPEM); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	if r.cert != nil {
+		Logger.Info("reloaded client certificate", zap.String("certFile", r.certFile), zap.String("keyFile", r.keyFile))
+	}
+	r.cert, r.modTimes, r.checkedAt = &cert, modTimes, time.Now()
+	return
+}
+
+func (r *certReloader) stat() (modTimes [2]time.Time, err error) {
+	for i, file := range []string{r.certFile, r.keyFile} {
+		var fi os.FileInfo
+		if fi, err = os.Stat(file); err != nil {
+			err = errors.Wrapf(err, "")
+			return
+		}
+		modTimes[i] = fi.ModTime()
+	}
+	return
+}
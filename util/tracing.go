@@ -0,0 +1,130 @@
+package util
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.7.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+const tracerName = "github.com/forever765/clickhouse_sinker_nali"
+
+var (
+	tracingEnabled uint32
+	tracerProvider *sdktrace.TracerProvider
+	propagator     = propagation.TraceContext{}
+)
+
+// InitTracing exports spans to an OpenTelemetry collector at endpoint with OTLP/HTTP. The endpoint is host:port, or
+// http://host:port for a plain text connection. Messages carrying a sampled trace context in their Kafka headers are
+// always traced, others are sampled at sampleRatio.
+func InitTracing(endpoint string, sampleRatio float64, instance string) (err error) {
+	opts := []otlptracehttp.Option{}
+	if strings.HasPrefix(endpoint, "http://") {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	endpoint = strings.TrimPrefix(strings.TrimPrefix(endpoint, "http://"), "https://")
+	opts = append(opts, otlptracehttp.WithEndpoint(endpoint))
+	var exporter sdktrace.SpanExporter
+	if exporter, err = otlptracehttp.New(context.Background(), opts...); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	res := resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceNameKey.String("clickhouse_sinker_nali"),
+		semconv.ServiceInstanceIDKey.String(instance))
+	tracerProvider = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(sampleRatio))),
+		sdktrace.WithResource(res))
+	otel.SetTracerProvider(tracerProvider)
+	atomic.StoreUint32(&tracingEnabled, 1)
+	Logger.Info("tracing enabled", zap.String("endpoint", endpoint), zap.Float64("sampleRatio", sampleRatio))
+	return
+}
+
+// ShutdownTracing flushes pending spans.
+func ShutdownTracing() {
+	if tracerProvider == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := tracerProvider.Shutdown(ctx); err != nil {
+		Logger.Warn("failed to flush spans", zap.Error(err))
+	}
+}
+
+// TracingEnabled tells whether spans are exported. Callers skip extracting trace contexts if not.
+func TracingEnabled() bool {
+	return atomic.LoadUint32(&tracingEnabled) == 1
+}
+
+// Tracer returns the tracer of sinker, which is a no-op one until InitTracing.
+func Tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// HeaderGetter looks up a message header, and returns "" if it's absent.
+type HeaderGetter func(key string) string
+
+func (g HeaderGetter) Get(key string) string { return g(key) }
+func (g HeaderGetter) Set(string, string)    {}
+func (g HeaderGetter) Keys() []string        { return nil }
+
+// ExtractTraceContext returns the W3C trace context in message headers, which is invalid if absent.
+func ExtractTraceContext(get HeaderGetter) trace.SpanContext {
+	return trace.SpanContextFromContext(propagator.Extract(context.Background(), get))
+}
+
+// StartMessageSpan starts the span of a message, which is a child of the trace context in its headers if any. It's
+// nil unless sampled.
+func StartMessageSpan(parent trace.SpanContext, task, topic string, partition int, offset int64) trace.Span {
+	ctx := context.Background()
+	if parent.IsValid() {
+		ctx = trace.ContextWithRemoteSpanContext(ctx, parent)
+	}
+	_, span := Tracer().Start(ctx, "message", trace.WithSpanKind(trace.SpanKindConsumer), trace.WithAttributes(
+		attribute.String("task", task),
+		semconv.MessagingSystemKey.String("kafka"),
+		semconv.MessagingDestinationKey.String(topic),
+		semconv.MessagingKafkaPartitionKey.Int(partition),
+		attribute.Int64("messaging.kafka.offset", offset)))
+	if !span.IsRecording() {
+		return nil
+	}
+	return span
+}
+
+// StartChildSpan starts a span under parent, and is nil if parent is.
+func StartChildSpan(parent trace.Span, name string, opts ...trace.SpanStartOption) trace.Span {
+	if parent == nil {
+		return nil
+	}
+	_, span := Tracer().Start(trace.ContextWithSpan(context.Background(), parent), name, opts...)
+	return span
+}
+
+// EndSpan ends span if not nil, and marks it failed if err is not nil.
+func EndSpan(span trace.Span, err error) {
+	if span == nil {
+		return
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
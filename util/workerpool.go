@@ -2,6 +2,7 @@ package util
 
 import (
 	"errors"
+	"fmt"
 	"sync"
 	"sync/atomic"
 )
@@ -11,6 +12,30 @@ const (
 	StateStopped uint32 = 1
 )
 
+// Priority is the class of a function submitted to a WorkerPool. Queued functions of a higher class run first, so
+// latency-sensitive tasks aren't stuck behind bulk ones.
+type Priority int
+
+const (
+	PriorityHigh Priority = iota
+	PriorityNormal
+	PriorityLow
+	numPriorities
+)
+
+// ParsePriority parses "high", "normal" and "low". Empty means normal.
+func ParsePriority(s string) (Priority, error) {
+	switch s {
+	case "high":
+		return PriorityHigh, nil
+	case "", "normal":
+		return PriorityNormal, nil
+	case "low":
+		return PriorityLow, nil
+	}
+	return PriorityNormal, fmt.Errorf("unknown priority %s", s)
+}
+
 // WorkerPool is a blocked worker pool inspired by https://github.com/gammazero/workerpool/
 type WorkerPool struct {
 	inNums     uint64
@@ -18,7 +43,7 @@ type WorkerPool struct {
 	curWorkers int
 
 	maxWorkers int
-	workChan   chan func()
+	workChans  [numPriorities]chan func() // indexed by Priority
 
 	taskDone *sync.Cond
 	state    uint32
@@ -36,7 +61,9 @@ func NewWorkerPool(maxWorkers int, queueSize int) *WorkerPool {
 
 	w := &WorkerPool{
 		maxWorkers: maxWorkers,
-		workChan:   make(chan func(), queueSize),
+	}
+	for i := range w.workChans {
+		w.workChans[i] = make(chan func(), queueSize)
 	}
 
 	w.taskDone = sync.NewCond(w)
@@ -55,8 +82,8 @@ func (w *WorkerPool) wokerFunc() {
 	w.curWorkers++
 	w.Unlock()
 LOOP:
-	for fn := range w.workChan {
-		fn()
+	for {
+		w.run(w.next())
 		var needQuit bool
 		w.Lock()
 		w.outNums++
@@ -74,12 +101,52 @@ LOOP:
 	}
 }
 
+// run runs fn, a panic of which is logged rather than crashing the process. Functions which know better, such as
+// those of tasks, recover by themselves.
+func (w *WorkerPool) run(fn func()) {
+	defer Recover(nil)
+	fn()
+}
+
+// next waits for a function, preferring higher priorities.
+func (w *WorkerPool) next() func() {
+	for _, ch := range w.workChans {
+		select {
+		case fn := <-ch:
+			return fn
+		default:
+		}
+	}
+	select {
+	case fn := <-w.workChans[PriorityHigh]:
+		return fn
+	case fn := <-w.workChans[PriorityNormal]:
+		return fn
+	case fn := <-w.workChans[PriorityLow]:
+		return fn
+	}
+}
+
 func (w *WorkerPool) start() {
 	for i := 0; i < w.maxWorkers; i++ {
 		go w.wokerFunc()
 	}
 }
 
+// MaxWorkers returns the expected worker number.
+func (w *WorkerPool) MaxWorkers() int {
+	w.Lock()
+	defer w.Unlock()
+	return w.maxWorkers
+}
+
+// Backlog returns the number of submitted functions which haven't finished, including running ones.
+func (w *WorkerPool) Backlog() int {
+	w.Lock()
+	defer w.Unlock()
+	return int(w.inNums - w.outNums)
+}
+
 // Resize ensures worker number match the expected one.
 func (w *WorkerPool) Resize(maxWorkers int) {
 	w.Lock()
@@ -94,6 +161,15 @@ func (w *WorkerPool) Resize(maxWorkers int) {
 // Submit enqueues a function for a worker to execute.
 // Submit will block regardless if there is no free workers.
 func (w *WorkerPool) Submit(fn func()) (err error) {
+	return w.SubmitWithPriority(fn, PriorityNormal)
+}
+
+// SubmitWithPriority is Submit with a priority. Each priority has its own queue, so a full queue of low priority
+// doesn't block submitting higher ones.
+func (w *WorkerPool) SubmitWithPriority(fn func(), prio Priority) (err error) {
+	if prio < PriorityHigh || prio >= numPriorities {
+		prio = PriorityNormal
+	}
 	if atomic.LoadUint32(&w.state) == StateStopped {
 		return ErrStopped
 	}
@@ -102,7 +178,7 @@ func (w *WorkerPool) Submit(fn func()) (err error) {
 	w.inNums++
 	w.Unlock()
 
-	w.workChan <- fn
+	w.workChans[prio] <- fn
 	return nil
 }
 
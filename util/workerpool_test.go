@@ -1,6 +1,7 @@
 package util
 
 import (
+	"strings"
 	"testing"
 )
 
@@ -34,3 +35,45 @@ func TestWorkerPool(t *testing.T) {
 		}
 	}
 }
+
+func TestWorkerPoolPriority(t *testing.T) {
+	wp := NewWorkerPool(1, 4)
+	block := make(chan struct{})
+	_ = wp.Submit(func() { <-block })
+	var order []Priority
+	for _, prio := range []Priority{PriorityLow, PriorityNormal, PriorityHigh, PriorityLow, PriorityHigh} {
+		prio := prio
+		_ = wp.SubmitWithPriority(func() { order = append(order, prio) }, prio)
+	}
+	close(block)
+	wp.StopWait()
+	exp := []Priority{PriorityHigh, PriorityHigh, PriorityNormal, PriorityLow, PriorityLow}
+	if len(order) != len(exp) {
+		t.Fatalf("got %v, expect %v", order, exp)
+	}
+	for i := range exp {
+		if order[i] != exp[i] {
+			t.Fatalf("got %v, expect %v", order, exp)
+		}
+	}
+}
+
+func TestWorkerPoolPanic(t *testing.T) {
+	InitLogger([]string{"stdout"})
+	wp := NewWorkerPool(1, 2)
+	_ = wp.Submit(func() { panic("boom") })
+	var recovered error
+	_ = wp.Submit(func() {
+		defer Recover(func(err error) { recovered = err })
+		panic("bang")
+	})
+	done := false
+	_ = wp.Submit(func() { done = true })
+	wp.StopWait()
+	if recovered == nil || !strings.Contains(recovered.Error(), "panic: bang") {
+		t.Fatal("expect the panic passed to onPanic, got", recovered)
+	}
+	if !done || wp.Backlog() != 0 {
+		t.Fatal("the worker quit due to a panic")
+	}
+}